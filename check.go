@@ -0,0 +1,452 @@
+package waitron
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flosch/pongo2"
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/state"
+	"gopkg.in/yaml.v2"
+)
+
+// `waitron check -config waitron.yaml` goes through a config the way the
+// server would without serving it, so CI can gate config changes on it. It
+// loads the config, connects to the backends it configures, loads every
+// group, machine and VM definition as strict_definitions would along with
+// the preseed and finish templates machines name, parses every template in
+// templatepath and resolves the hooks of the config and of every machine:
+// scripts have to parse, programs have to be in PATH and plugins have to be
+// there. Pattern definitions are left out, they are only complete for a
+// hostname. Every check is reported, as a table or with -o json, and the
+// exit code is 1 when one failed. Nothing is started or written to, except
+// that a git checkout is synced as it is at startup.
+
+const checkDialTimeout = 5 * time.Second
+
+// Ports of the backends reached by URL, when the URL leaves it out
+var checkSchemePorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ldap":  "389",
+	"ldaps": "636",
+	"nats":  "4222",
+	"mqtt":  "1883",
+	"redis": "6379",
+	"kafka": "9092",
+}
+
+// checkResult is the outcome of one check, Error is empty when it passed
+type checkResult struct {
+	Kind  string
+	Name  string
+	Error string `json:",omitempty"`
+}
+
+type checkReport struct {
+	OK     bool
+	Checks []checkResult
+}
+
+func (r *checkReport) record(kind string, name string, err error) {
+	c := checkResult{Kind: kind, Name: name}
+	if err != nil {
+		c.Error = err.Error()
+		r.OK = false
+	}
+	r.Checks = append(r.Checks, c)
+}
+
+// Run `waitron check` with the arguments after check, returns the exit code
+func checkCommand(args []string) int {
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	configFile := flags.String("config", os.Getenv("CONFIG_FILE"), "Path to config file, CONFIG_FILE by default.")
+	output := flags.String("o", "table", "Output format: table or json.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *configFile == "" && !configpkg.HasConfigEnv(os.Environ()) {
+		logger.Error("-config, CONFIG_FILE or WAITRON_* is required")
+		return 2
+	}
+	if *output != "table" && *output != "json" {
+		logger.Error("unknown output format, expected table or json", "output", *output)
+		return 2
+	}
+
+	report := checkConfig(*configFile)
+	writeCheckReport(os.Stdout, report, *output)
+	if !report.OK {
+		return 1
+	}
+	return 0
+}
+
+func writeCheckReport(out io.Writer, report checkReport, output string) {
+	if output == "json" {
+		result, _ := json.MarshalIndent(&report, "", "  ")
+		fmt.Fprintln(out, string(result))
+	} else {
+		w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "KIND\tNAME\tRESULT")
+		for _, c := range report.Checks {
+			result := "OK"
+			if c.Error != "" {
+				result = c.Error
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", c.Kind, c.Name, result)
+		}
+		w.Flush()
+	}
+}
+
+// Check the config in configFile and everything it refers to
+func checkConfig(configFile string) checkReport {
+	r := checkReport{OK: true}
+
+	config, err := configpkg.LoadConfig(configFile)
+	name := configFile
+	if name == "" {
+		name = "environment"
+	}
+	r.record("config", name, err)
+	if err != nil {
+		return r
+	}
+	config.StrictDefinitions = true
+
+	if config.Agent != nil {
+		// Definitions, templates and hooks are the central waitron's
+		r.record("backend", "central", checkReachable(config.Agent.Central, "80"))
+		return r
+	}
+
+	r.checkBackends(&config)
+	machines := r.checkDefinitions(config)
+	r.checkTemplates(config)
+	r.checkHooks(config, machines)
+	return r
+}
+
+// Set up and reach what config keeps definitions, state and records in, the
+// way NewState does
+func (r *checkReport) checkBackends(config *configpkg.Config) {
+	var err error
+
+	if config.PluginPath != "" {
+		config.Plugins, err = machine.DiscoverPlugins(config.PluginPath)
+		r.record("backend", "plugins", err)
+	}
+
+	configpkg.ConfigureS3(config.S3)
+	if config.S3.Endpoint != "" {
+		r.record("backend", "s3", checkReachable(config.S3.Endpoint, "443"))
+	}
+
+	if config.Resolver != nil {
+		config.AttributeResolver = machine.NewMachineResolver(*config.Resolver)
+		if config.Resolver.LDAP != nil {
+			r.record("backend", "ldap", checkReachable(config.Resolver.LDAP.URL, "389"))
+		}
+	}
+
+	store, err := state.NewStore(*config)
+	if err == nil {
+		err = store.Ping()
+	}
+	r.record("backend", "state", err)
+
+	if config.Consul != nil && config.Git != nil {
+		r.record("backend", "consul", errors.New("machine definitions can come from consul or git, not both"))
+	} else if config.Consul != nil {
+		if config.ConsulKV, err = configpkg.NewConsulKV(*config.Consul); err == nil {
+			err = config.ConsulKV.Healthy()
+		}
+		r.record("backend", "consul", err)
+	} else if config.Git != nil {
+		var repo *machine.GitRepo
+		if repo, err = machine.NewGitRepo(*config.Git); err == nil {
+			if _, err = repo.Sync(); err == nil {
+				config.MachinePath = repo.Dir(repo.Config.MachineDir)
+				config.GroupPath = repo.Dir(repo.Config.GroupDir)
+				config.TemplatePath = repo.Dir(repo.Config.TemplateDir)
+			}
+		}
+		r.record("backend", "git", err)
+	}
+
+	if config.IPAM != nil {
+		_, err := state.NewIPAM(*config.IPAM, state.NewMemoryStore())
+		switch {
+		case err != nil:
+		case config.IPAM.Driver == "phpipam":
+			err = checkReachable(config.IPAM.PHPIPAM.URL, "443")
+		case config.IPAM.Driver == "netbox":
+			err = checkReachable(config.IPAM.NetBox.URL, "443")
+		}
+		r.record("backend", "ipam", err)
+	}
+
+	if config.DNS != nil {
+		_, err := state.NewDNSUpdater(*config.DNS, state.NewMemoryStore())
+		switch {
+		case err != nil:
+		case config.DNS.Driver == "rfc2136":
+			err = checkReachable(config.DNS.RFC2136.Server, "53")
+		case config.DNS.Driver == "route53" && config.DNS.Route53.Endpoint != "":
+			err = checkReachable(config.DNS.Route53.Endpoint, "443")
+		}
+		r.record("backend", "dns", err)
+	}
+
+	if config.Proxmox != nil || config.Libvirt != nil || config.VSphere != nil {
+		_, err := state.NewVMDriver(*config)
+		switch {
+		case err != nil:
+		case config.Proxmox != nil:
+			err = checkReachable(config.Proxmox.URL, "8006")
+		case config.VSphere != nil:
+			err = checkReachable(config.VSphere.URL, "443")
+		}
+		r.record("backend", "vms", err)
+	}
+
+	if config.DHCPLeases != nil {
+		if config.DHCPLeases.URL != "" {
+			err = checkReachable(config.DHCPLeases.URL, "8000")
+		} else {
+			_, err = os.Stat(config.DHCPLeases.Path)
+		}
+		r.record("backend", "dhcp_leases", err)
+	}
+
+	for _, nc := range config.Notifiers {
+		name := nc.Name
+		if name == "" {
+			name = nc.Type
+		}
+		_, err := state.NewNotifier(nc)
+		if err == nil && nc.SMTPServer != "" {
+			err = checkReachable(nc.SMTPServer, "25")
+		} else if err == nil && nc.URL != "" && !strings.Contains(nc.URL, "{{") {
+			err = checkReachable(nc.URL, "443")
+		}
+		r.record("notifier", name, err)
+	}
+}
+
+// Connect to the host and port of address, a URL or host:port, and hang up
+func checkReachable(address string, port string) error {
+	if address == "" {
+		return errors.New("no address configured")
+	}
+	host := address
+	if u, err := url.Parse(address); err == nil && u.Host != "" {
+		host = u.Host
+		if p, found := checkSchemePorts[u.Scheme]; found {
+			port = p
+		}
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, port)
+	}
+	conn, err := net.DialTimeout("tcp", host, checkDialTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Load every group, site, machine and VM definition, returns the machines
+// that loaded
+func (r *checkReport) checkDefinitions(config configpkg.Config) []machine.Machine {
+	if config.ConsulKV == nil && config.GroupPath != "" {
+		files, err := configpkg.StorageFor(config.GroupPath).List(config.GroupPath)
+		if err != nil {
+			r.record("group", config.GroupPath, err)
+		}
+		for _, file := range files {
+			ext := path.Ext(file.Name)
+			if file.Dir || (ext != ".yaml" && ext != ".yml") {
+				continue
+			}
+			group := strings.TrimSuffix(file.Name, ext)
+			data, err := machine.ReadDefinition(config.GroupPath, group)
+			if err == nil {
+				err = machine.CheckDefinition(machine.MachineSchema, "group", group, data, config)
+			}
+			if err == nil {
+				var m machine.Machine
+				err = yaml.Unmarshal(data, &m)
+			}
+			r.record("group", group, err)
+		}
+	}
+
+	for name, site := range config.Sites {
+		r.record("site", name, machine.ValidateSite(site, config))
+	}
+
+	var machines []machine.Machine
+	files, err := machine.NewInventory(config).MachineFiles()
+	if err != nil {
+		r.record("machine", config.MachinePath, err)
+	}
+	for _, file := range files {
+		hostname := strings.TrimSuffix(file.Name, path.Ext(file.Name))
+		m, err := machine.MachineDefinition(hostname, config.MachinePath, config)
+		if err == nil {
+			err = checkMachine(m, config)
+		}
+		r.record("machine", hostname, err)
+		if err == nil {
+			machines = append(machines, m)
+		}
+	}
+
+	if config.VmPath != "" {
+		files, err := ioutil.ReadDir(config.VmPath)
+		if err != nil {
+			r.record("vm", config.VmPath, err)
+		}
+		for _, file := range files {
+			if file.IsDir() || path.Ext(file.Name()) != ".yaml" {
+				continue
+			}
+			hostname := strings.TrimSuffix(file.Name(), ".yaml")
+			_, err := machine.VMDefinition(hostname, config)
+			r.record("vm", hostname, err)
+		}
+	}
+
+	return machines
+}
+
+// What loading m doesn't catch: the templates it names and the order of its
+// hooks
+func checkMachine(m machine.Machine, config configpkg.Config) error {
+	for _, template := range []string{m.Preseed, m.Finish} {
+		if template == "" {
+			continue
+		}
+		if _, err := machine.LoadTemplate(template, config); err != nil {
+			return err
+		}
+	}
+	for stage, hooks := range m.Hooks {
+		if !configpkg.HasHookDependencies(hooks) {
+			continue
+		}
+		if err := configpkg.ValidateHookGraph(hooks); err != nil {
+			return fmt.Errorf("%s hooks: %s", stage, err)
+		}
+	}
+	return nil
+}
+
+// Parse every template in templatepath
+func (r *checkReport) checkTemplates(config configpkg.Config) {
+	err := configpkg.WalkLocation(config.TemplatePath, func(p string) error {
+		_, err := configpkg.StorageTemplates.FromFile(p)
+		r.record("template", p, err)
+		return nil
+	})
+	if err != nil {
+		r.record("template", config.TemplatePath, err)
+	}
+}
+
+// Resolve the hooks of the config and of machines, each once
+func (r *checkReport) checkHooks(config configpkg.Config, machines []machine.Machine) {
+	seen := make(map[string]bool)
+	check := func(stage string, hooks []configpkg.Hook) {
+		for _, hook := range hooks {
+			name := stage + "/" + hook.String()
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			r.record("hook", name, checkHook(hook, config))
+		}
+	}
+
+	stages := func(hooks map[string][]configpkg.Hook) []string {
+		var names []string
+		for stage := range hooks {
+			names = append(names, stage)
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	check(machine.StagePreHook, config.PreHooks)
+	check(machine.StagePostHook, config.PostHooks)
+	for _, stage := range stages(config.Hooks) {
+		check(stage, config.Hooks[stage])
+	}
+	for _, m := range machines {
+		check(machine.StagePreHook, m.PreHooks)
+		check(machine.StagePostHook, m.PostHooks)
+		for _, stage := range stages(m.Hooks) {
+			check(stage, m.Hooks[stage])
+		}
+	}
+}
+
+// Whether hook could run: its templates parse and what it runs is there
+func checkHook(hook configpkg.Hook, config configpkg.Config) error {
+	for _, tpl := range append([]string{hook.URL, hook.Body, hook.Command}, hook.Args...) {
+		if _, err := pongo2.FromString(tpl); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case hook.Plugin != "":
+		_, err := config.Plugin(hook.Plugin, machine.PluginTypeHook)
+		return err
+	case hook.URL != "":
+		if strings.Contains(hook.URL, "{{") {
+			return nil
+		}
+		u, err := url.Parse(hook.URL)
+		if err != nil {
+			return err
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("webhook url %s isn't http or https", hook.URL)
+		}
+		return nil
+	case hook.Command != "":
+		program := "bash"
+		if len(hook.Args) > 0 {
+			program = hook.Command
+		}
+		if strings.Contains(program, "{{") {
+			return nil
+		}
+		_, err := exec.LookPath(program)
+		return err
+	}
+
+	script := path.Join(config.HookPath, hook.Name)
+	if _, err := os.Stat(script); err != nil {
+		return err
+	}
+	_, err := pongo2.FromFile(script)
+	return err
+}
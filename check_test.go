@@ -0,0 +1,63 @@
+package waitron
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string, data string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("templates/preseed.j2", "d-i netcfg/get_hostname string {{ machine.Hostname }}")
+	write("hooks/notify.sh", "#!/bin/sh\necho {{ machine.Hostname }}")
+	write("groups/example.com.yaml", `{"params": {"site": "ams1"}}`)
+	write("machines/dns01.example.com.yaml", `{"preseed": "preseed.j2", "network": [{"macaddress": "de:ad:be:ef:00:01"}]}`)
+	config := `{"templatepath": "` + dir + `/templates", "machinepath": "` + dir + `/machines", "grouppath": "` + dir + `/groups",
+		"hookpath": "` + dir + `/hooks", "hooks": {"done": [{"name": "notify.sh"}, {"command": "sh", "args": ["-c", "true"]}]}}`
+	write("config.yaml", config)
+
+	report := checkConfig(filepath.Join(dir, "config.yaml"))
+	if !report.OK {
+		t.Fatalf("expected the config to pass, got %+v", report.Checks)
+	}
+
+	write("machines/dns02.example.com.yaml", `{"preseed": "missing.j2", "network": [{"macaddress": "de:ad:be:ef:00:02"}]}`)
+	write("machines/dns03.example.com.yaml", `{"presed": "preseed.j2", "network": [{"macaddress": "de:ad:be:ef:00:03"}]}`)
+	write("config.yaml", strings.Replace(config, `"sh"`, `"no-such-program-for-waitron"`, 1))
+	report = checkConfig(filepath.Join(dir, "config.yaml"))
+	failed := make(map[string]bool)
+	for _, c := range report.Checks {
+		if c.Error != "" {
+			failed[c.Kind+" "+c.Name] = true
+		}
+	}
+	if report.OK || len(failed) != 3 || !failed["machine dns02.example.com"] || !failed["machine dns03.example.com"] ||
+		!failed["hook done/no-such-program-for-waitron"] {
+		t.Errorf("expected the missing template, the misspelt field and the missing program to fail, got %+v", report.Checks)
+	}
+
+	var out bytes.Buffer
+	writeCheckReport(&out, report, "json")
+	var served checkReport
+	if err := json.Unmarshal(out.Bytes(), &served); err != nil || served.OK || len(served.Checks) != len(report.Checks) {
+		t.Errorf("expected the report as json, got %s", out.String())
+	}
+
+	if report := checkConfig(filepath.Join(dir, "missing.yaml")); report.OK || len(report.Checks) != 1 || report.Checks[0].Kind != "config" {
+		t.Errorf("expected a config that doesn't load to fail, got %+v", report)
+	}
+}
@@ -0,0 +1,9 @@
+// Command waitron serves machine definitions, templates and build mode to
+// installers. See the README for its config file.
+package main
+
+import "github.com/ns1/waitron"
+
+func main() {
+	waitron.Main()
+}
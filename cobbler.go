@@ -0,0 +1,410 @@
+package waitron
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ns1/waitron/machine"
+)
+
+// Reading systems from Cobbler's XML-RPC API for `waitron import`. A system
+// inherits from its profile, the profile from its parents and the distro,
+// which is worked out here: the kernel options and autoinstall metadata of
+// all of them are merged into the cmdline and params, and the kickstart of
+// the system or else its profile becomes the preseed.
+
+const cobblerInherit = "<<inherit>>"
+
+type cobblerSource struct {
+	url    string
+	client *http.Client
+}
+
+// An object as Cobbler returns it
+type cobblerObject map[string]interface{}
+
+func (o cobblerObject) str(key string) string {
+	s, _ := o[key].(string)
+	if s == cobblerInherit {
+		return ""
+	}
+	return s
+}
+
+// A dict, or a string of space separated key=value, as key/values
+func (o cobblerObject) options(key string) map[string]string {
+	options := make(map[string]string)
+	switch v := o[key].(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			if value == nil {
+				options[k] = ""
+			} else {
+				options[k] = fmt.Sprint(value)
+			}
+		}
+	case string:
+		if v == cobblerInherit {
+			break
+		}
+		for _, option := range strings.Fields(v) {
+			kv := strings.SplitN(option, "=", 2)
+			if len(kv) == 2 {
+				options[kv[0]] = kv[1]
+			} else {
+				options[kv[0]] = ""
+			}
+		}
+	}
+	return options
+}
+
+// The kickstart, renamed autoinstall in Cobbler 3
+func (o cobblerObject) kickstart() string {
+	if ks := o.str("autoinstall"); ks != "" {
+		return ks
+	}
+	return o.str("kickstart")
+}
+
+// The kernel options or autoinstall metadata of o, each overriding the
+// ones before it
+func mergeOptions(key string, objects ...cobblerObject) map[string]string {
+	merged := make(map[string]string)
+	for _, o := range objects {
+		for k, v := range o.options(key) {
+			merged[k] = v
+		}
+	}
+	return merged
+}
+
+func cmdlineString(options map[string]string) string {
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var cmdline []string
+	for _, k := range keys {
+		if options[k] == "" {
+			cmdline = append(cmdline, k)
+		} else {
+			cmdline = append(cmdline, k+"="+options[k])
+		}
+	}
+	return strings.Join(cmdline, " ")
+}
+
+func (c *cobblerSource) objects(method string) (map[string]cobblerObject, error) {
+	v, err := xmlrpcCall(c.client, c.url, method)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a list, got %T", method, v)
+	}
+	objects := make(map[string]cobblerObject)
+	for _, item := range list {
+		if o, ok := item.(map[string]interface{}); ok {
+			objects[cobblerObject(o).str("name")] = o
+		}
+	}
+	return objects, nil
+}
+
+func (c *cobblerSource) hosts() ([]importedHost, error) {
+	distros, err := c.objects("get_distros")
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := c.objects("get_profiles")
+	if err != nil {
+		return nil, err
+	}
+	systems, err := c.objects("get_systems")
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(systems))
+	for name := range systems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hosts := make([]importedHost, 0, len(systems))
+	for _, name := range names {
+		hosts = append(hosts, cobblerHost(systems[name], profiles, distros))
+	}
+	return hosts, nil
+}
+
+func cobblerHost(system cobblerObject, profiles map[string]cobblerObject, distros map[string]cobblerObject) importedHost {
+	// The profile chain, the distro and the system, least specific first
+	var chain []cobblerObject
+	seen := make(map[string]bool)
+	for name := system.str("profile"); name != "" && !seen[name]; {
+		seen[name] = true
+		p, found := profiles[name]
+		if !found {
+			break
+		}
+		chain = append([]cobblerObject{p}, chain...)
+		name = p.str("parent")
+	}
+	var distro cobblerObject
+	for _, p := range chain {
+		if d, found := distros[p.str("distro")]; found {
+			distro = d
+		}
+	}
+	objects := append(append([]cobblerObject{distro}, chain...), system)
+
+	hostname := system.str("hostname")
+	if hostname == "" {
+		hostname = system.str("name")
+	}
+	h := importedHost{
+		Hostname: hostname,
+		Machine: importedMachine{
+			Cmdline: cmdlineString(mergeOptions("kernel_options", objects...)),
+			Params:  mergeOptions("autoinstall_meta", objects...),
+			Labels:  map[string]string{},
+			Network: cobblerNetwork(system),
+		},
+		Templates: map[string]string{},
+	}
+	for k, v := range mergeOptions("ks_meta", objects...) {
+		if _, found := h.Machine.Params[k]; !found {
+			h.Machine.Params[k] = v
+		}
+	}
+	if profile := system.str("profile"); profile != "" {
+		h.Machine.Labels["profile"] = profile
+	}
+	if distro != nil {
+		h.Machine.Labels["distro"] = distro.str("name")
+		h.Machine.OperatingSystem = distro.str("os_version")
+		if h.Machine.OperatingSystem == "" {
+			h.Machine.OperatingSystem = distro.str("breed")
+		}
+	}
+
+	for i := len(objects) - 1; i > 0; i-- {
+		if ks := objects[i].kickstart(); ks != "" {
+			h.Machine.Preseed = stubName(ks)
+			h.Templates[h.Machine.Preseed] = fmt.Sprintf("cobbler kickstart %q", ks)
+			break
+		}
+	}
+	return h
+}
+
+func cobblerNetwork(system cobblerObject) []machine.Interface {
+	interfaces, _ := system["interfaces"].(map[string]interface{})
+	names := make([]string, 0, len(interfaces))
+	for name := range interfaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var network []machine.Interface
+	hasGateway := false
+	for _, name := range names {
+		values, _ := interfaces[name].(map[string]interface{})
+		i := cobblerObject(values)
+		if i.str("interface_type") == "bmc" || (i.str("mac_address") == "" && i.str("ip_address") == "") {
+			continue
+		}
+		iface := machine.Interface{Name: name, MacAddress: strings.ToLower(i.str("mac_address")), Gateway4: i.str("if_gateway")}
+		if ip := i.str("ip_address"); ip != "" {
+			mask := i.str("netmask")
+			iface.Addresses4 = []machine.IPConfig{{IPAddress: ip, Netmask: mask, Cidr: netmaskBits(mask)}}
+		}
+		if ip := i.str("ipv6_address"); ip != "" {
+			address := machine.IPConfig{IPAddress: ip}
+			if parts := strings.SplitN(ip, "/", 2); len(parts) == 2 {
+				address = machine.IPConfig{IPAddress: parts[0], Cidr: parts[1]}
+			}
+			iface.Addresses6 = []machine.IPConfig{address}
+			iface.Gateway6 = i.str("ipv6_default_gateway")
+		}
+		hasGateway = hasGateway || iface.Gateway4 != ""
+		network = append(network, iface)
+	}
+
+	// The system's gateway goes with its first address
+	if gateway := system.str("gateway"); gateway != "" && !hasGateway {
+		for n := range network {
+			if len(network[n].Addresses4) > 0 {
+				network[n].Gateway4 = gateway
+				break
+			}
+		}
+	}
+	return network
+}
+
+func netmaskBits(mask string) string {
+	ip := net.ParseIP(mask).To4()
+	if ip == nil {
+		return ""
+	}
+	bits, total := net.IPMask(ip).Size()
+	if total == 0 {
+		return ""
+	}
+	return strconv.Itoa(bits)
+}
+
+// Call an XML-RPC method with string parameters
+func xmlrpcCall(client *http.Client, url string, method string, params ...string) (interface{}, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><methodCall><methodName>`)
+	xml.EscapeText(&body, []byte(method))
+	body.WriteString(`</methodName><params>`)
+	for _, p := range params {
+		body.WriteString(`<param><value><string>`)
+		xml.EscapeText(&body, []byte(p))
+		body.WriteString(`</string></value></param>`)
+	}
+	body.WriteString(`</params></methodCall>`)
+
+	response, err := client.Post(url, "text/xml", &body)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", method, response.Status)
+	}
+
+	d := xml.NewDecoder(response.Body)
+	fault := false
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", method, err)
+		}
+		start, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch start.Name.Local {
+		case "fault":
+			fault = true
+		case "value":
+			v, err := xmlrpcValue(d)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", method, err)
+			}
+			if fault {
+				f, _ := v.(map[string]interface{})
+				return nil, fmt.Errorf("%s: %v", method, f["faultString"])
+			}
+			return v, nil
+		}
+	}
+}
+
+// The value whose <value> was just read. Untyped values are strings.
+func xmlrpcValue(d *xml.Decoder) (interface{}, error) {
+	var text []byte
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.CharData:
+			text = append(text, t...)
+		case xml.EndElement:
+			return string(text), nil
+		case xml.StartElement:
+			v, err := xmlrpcTyped(d, t)
+			if err != nil {
+				return nil, err
+			}
+			return v, d.Skip()
+		}
+	}
+}
+
+func xmlrpcTyped(d *xml.Decoder, start xml.StartElement) (interface{}, error) {
+	switch start.Name.Local {
+	case "nil":
+		return nil, d.Skip()
+	case "array":
+		list := []interface{}{}
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				if t.Name.Local == "value" {
+					v, err := xmlrpcValue(d)
+					if err != nil {
+						return nil, err
+					}
+					list = append(list, v)
+				}
+			case xml.EndElement:
+				if t.Name.Local == "array" {
+					return list, nil
+				}
+			}
+		}
+	case "struct":
+		members := make(map[string]interface{})
+		var name string
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, err
+			}
+			switch t := tok.(type) {
+			case xml.StartElement:
+				switch t.Name.Local {
+				case "name":
+					if err := d.DecodeElement(&name, &t); err != nil {
+						return nil, err
+					}
+				case "value":
+					v, err := xmlrpcValue(d)
+					if err != nil {
+						return nil, err
+					}
+					members[name] = v
+				}
+			case xml.EndElement:
+				if t.Name.Local == "struct" {
+					return members, nil
+				}
+			}
+		}
+	}
+
+	var s string
+	if err := d.DecodeElement(&s, &start); err != nil {
+		return nil, err
+	}
+	switch start.Name.Local {
+	case "int", "i4", "i8":
+		return strconv.ParseInt(strings.TrimSpace(s), 10, 64)
+	case "boolean":
+		return strings.TrimSpace(s) == "1", nil
+	case "double":
+		return strconv.ParseFloat(strings.TrimSpace(s), 64)
+	}
+	return s, nil
+}
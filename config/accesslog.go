@@ -0,0 +1,13 @@
+package config
+
+// AccessLogConfig says where the access log goes and in which format:
+// common (the default), combined or json. A file is rotated when it grows
+// past RotateSizeMB or is older than RotateEvery (e.g. "24h"), keeping
+// MaxBackups rotated files.
+type AccessLogConfig struct {
+	Path         string `yaml:"path"`
+	Format       string `yaml:"format"`
+	RotateSizeMB int    `yaml:"rotate_size_mb"`
+	RotateEvery  string `yaml:"rotate_every"`
+	MaxBackups   int    `yaml:"max_backups"`
+}
@@ -0,0 +1,14 @@
+package config
+
+// AgentConfig makes waitron the agent of a central instance, see server/agent.go
+type AgentConfig struct {
+	// Base URL of the central waitron
+	Central string `yaml:"central"`
+
+	// Where images and static files are cached, a temporary directory by
+	// default
+	CachePath string `yaml:"cache_path"`
+
+	// Most the cache holds, the least recently served files go first
+	CacheMaxBytes int64 `yaml:"cache_max_bytes"`
+}
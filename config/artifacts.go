@@ -0,0 +1,68 @@
+package config
+
+import (
+	"errors"
+	"mime"
+)
+
+// Installers and finish scripts upload what they found out about a machine,
+// e.g. a hardware report, the installed package list or the fingerprints of
+// the generated host keys, with POST /artifacts/<hostname>/<token>?name=.
+// An artifact is kept in the state store next to the build record, which
+// lists them, and is downloaded from /api/v1/builds/<token>/artifacts/<name>
+// with the content type it was uploaded with. Uploading a name again
+// replaces it. Artifacts go with their build record when build_retention
+// evicts it, to history_path when there is one.
+
+const (
+	ArtifactsBucket = "artifacts"
+
+	defaultMaxArtifactBytes     = 1 << 20
+	defaultMaxArtifactsPerBuild = 20
+)
+
+// Content types accepted unless artifacts.content_types says otherwise
+var defaultArtifactContentTypes = []string{"text/plain", "application/json", "application/x-yaml", "application/gzip"}
+
+var (
+	ErrArtifactContentType = errors.New("artifact content type is not accepted")
+)
+
+// ArtifactConfig limits what installers upload
+type ArtifactConfig struct {
+	MaxBytes     int64    `yaml:"max_bytes"`
+	MaxPerBuild  int      `yaml:"max_per_build"`
+	ContentTypes []string `yaml:"content_types"`
+}
+
+func (c ArtifactConfig) ByteLimit() int64 {
+	if c.MaxBytes <= 0 {
+		return defaultMaxArtifactBytes
+	}
+	return c.MaxBytes
+}
+
+func (c ArtifactConfig) PerBuildLimit() int {
+	if c.MaxPerBuild <= 0 {
+		return defaultMaxArtifactsPerBuild
+	}
+	return c.MaxPerBuild
+}
+
+// The media type of contentType if it is accepted, without parameters
+func (c ArtifactConfig) Accept(contentType string) (string, error) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return "", ErrArtifactContentType
+	}
+	accepted := c.ContentTypes
+	if len(accepted) == 0 {
+		accepted = defaultArtifactContentTypes
+	}
+	for _, t := range accepted {
+		if t == mediaType {
+			return mediaType, nil
+		}
+	}
+	return "", ErrArtifactContentType
+}
@@ -0,0 +1,15 @@
+package config
+
+type BurnInConfig struct {
+	ImageURL string `yaml:"image_url"`
+	Kernel   string `yaml:"kernel"`
+	Initrd   string `yaml:"initrd"`
+	Cmdline  string `yaml:"cmdline"`
+
+	// How long the image stresses the machine
+	DurationSeconds int `yaml:"duration_secs"`
+
+	// How long after burn-in starts its results have to be in,
+	// duration_secs and an hour by default
+	TimeoutSeconds int `yaml:"timeout_secs"`
+}
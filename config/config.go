@@ -0,0 +1,310 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+type BuildCommand struct {
+	Command        string
+	TimeoutSeconds int  `yaml:"timeout_seconds"`
+	ErrorsFatal    bool `yaml:"errors_fatal"`
+	ShouldLog      bool `yaml:"should_log"`
+}
+
+type Config struct {
+	TemplatePath        string
+	GroupPath           string
+	MachinePath         string
+	VmPath              string
+	HookPath            string
+	StaticFilesPath     string `yaml:"staticspath"`
+	StatePath           string `yaml:"statepath"`
+	PluginPath          string `yaml:"pluginpath"`
+	BaseURL             string
+	ForemanProxyAddress string `yaml:"foreman_proxy_address"`
+
+	Cmdline  string `yaml:"cmdline"`
+	Kernel   string `yaml:"kernel"`
+	Initrd   string `yaml:"initrd"`
+	ImageURL string `yaml:"image_url"`
+
+	RescueCmdline  string `yaml:"rescue_cmdline"`
+	RescueKernel   string `yaml:"rescue_kernel"`
+	RescueInitrd   string `yaml:"rescue_initrd"`
+	RescueImageURL string `yaml:"rescue_image_url"`
+
+	OperatingSystem string
+	Finish          string
+	Preseed         string
+	Params          map[string]string
+
+	// Free form key/values for selecting machines, see machine/inventory.go
+	Labels map[string]string `yaml:"labels"`
+
+	// Served to Puppet's external node classifier, see server/enc.go
+	Puppet PuppetConfig `yaml:"puppet" json:"-"`
+
+	// How salt-ssh logs in to machines in /salt/roster, see server/salt.go
+	SaltSSH SaltSSHConfig `yaml:"salt_ssh"`
+
+	InventoryRefreshSeconds int `yaml:"inventory_refresh_secs"`
+
+	// How often hosts are checked for drift since their last build, see
+	// state/drift.go
+	DriftCheckSeconds int `yaml:"drift_check_secs" json:"-"`
+
+	// Read machine and group definitions from Consul KV instead of
+	// MachinePath and GroupPath, see consul.go
+	Consul *ConsulConfig `yaml:"consul" json:"-"`
+
+	// Serve machinepath, grouppath and templatepath from a git repository,
+	// see machine/gitrepo.go
+	Git *GitRepoConfig `yaml:"git" json:"-"`
+
+	// How to build machines nothing defines, see server/profile.go
+	DefaultProfile *DefaultProfileConfig `yaml:"default_profile" json:"-"`
+
+	// Definitions a build request can merge over the machine's by name, see
+	// server/profile.go
+	BuildProfiles map[string]map[string]interface{} `yaml:"build_profiles" json:"-"`
+
+	// Settings merged over the machine's by the network a request comes
+	// from, see machine/site.go
+	Sites map[string]SiteConfig `yaml:"sites" json:"-"`
+
+	// Fill in what definitions leave out from DNS and LDAP, see resolver.go
+	Resolver *ResolverConfig `yaml:"resolver" json:"-"`
+
+	// Address pools for interfaces with ip: auto, see state/ipam.go
+	IPAM *IPAMConfig `yaml:"ipam" json:"-"`
+
+	// The pool those interfaces use when they don't name one
+	IPAMPool string `yaml:"ipam_pool"`
+
+	// Records for built machines, see state/dns.go
+	DNS *DNSConfig `yaml:"dns" json:"-"`
+
+	// Refuse machine, group and VM definitions that don't match their
+	// schema rather than only logging the problems, see schema.go
+	StrictDefinitions bool `yaml:"strict_definitions"`
+
+	// Where to read DHCP leases of building machines from, see state/dhcp.go
+	DHCPLeases *DHCPLeaseConfig `yaml:"dhcp_leases" json:"-"`
+
+	// Get VMs ready and boot them when they are built, see state/vm.go
+	Proxmox *ProxmoxConfig `yaml:"proxmox" json:"-"`
+	Libvirt *LibvirtConfig `yaml:"libvirt" json:"-"`
+	VSphere *VSphereConfig `yaml:"vsphere" json:"-"`
+
+	// Disks, partitions and filesystems for the installer, see partitioning.go
+	StorageLayout *StorageLayout `yaml:"storage" json:"-"`
+
+	// Images to boot before installing, see state/preinstall.go
+	Firmware *FirmwareConfig `yaml:"firmware" json:"-"`
+	RAID     *RAIDConfig     `yaml:"raid" json:"-"`
+	BurnIn   *BurnInConfig   `yaml:"burn_in" json:"-"`
+	Wipe     *WipeConfig     `yaml:"wipe" json:"-"`
+
+	// Checks a build has to pass after /done to be complete, see state/validate.go
+	Validation *ValidationConfig `yaml:"validation" json:"-"`
+
+	// An EC2 style metadata service for cloud-init, see server/metadata.go
+	Metadata *MetadataConfig `yaml:"metadata" json:"-"`
+
+	// OpenSSH public keys the metadata service hands out
+	PublicKeys []string `yaml:"public_keys"`
+
+	// Credentials and endpoint for s3:// paths, see s3.go
+	S3 S3Config `yaml:"s3" json:"-"`
+
+	StaleBuildThresholdSeconds  int            `yaml:"stale_build_threshold_secs"`
+	StaleBuildCheckFrequency    int            `yaml:"stale_build_check_frequency_secs"`
+	StaleBuildJitterSeconds     int            `yaml:"stale_build_jitter_secs"`
+	StaleBuildCommands          []BuildCommand `yaml:"stalebuild_commands"`
+	CancelStaleBuilds           bool           `yaml:"cancel_stale_builds"`
+	StaleSilenceSeconds         int            `yaml:"stale_silence_secs"`
+	StaleActiveThresholdSeconds int            `yaml:"stale_active_build_threshold_secs"`
+	BuildRetries                int            `yaml:"build_retries"`
+	BuildRetryBackoffSeconds    int            `yaml:"build_retry_backoff_secs"`
+	BuildOverduePercent         int            `yaml:"build_overdue_percent"`
+	PreBuildCommands            []BuildCommand `yaml:"prebuild_commands"`
+	PostBuildCommands           []BuildCommand `yaml:"postbuild_commands"`
+	CancelBuildCommands         []BuildCommand `yaml:"cancelbuild_commands"`
+
+	LogFormat string `yaml:"log_format"`
+	LogLevel  string `yaml:"log_level"`
+
+	// Timeouts, limits and TLS for the listener
+	Server ServerConfig `yaml:"server" json:"-"`
+
+	// Deadlines for answering requests, per route class
+	RequestTimeouts RequestTimeoutsConfig `yaml:"request_timeouts" json:"-"`
+
+	// Loopback address:port for the pprof and debug endpoints, off when unset
+	AdminAddress string `yaml:"admin_address"`
+
+	// address:port for the machine and hook APIs, events, stats and debug
+	// endpoints, see server/management.go. Served on the main listener when unset.
+	ManagementAddress string `yaml:"management_address"`
+
+	// Management URL of the waitron this one replaces, see state/handover.go
+	HandoverFrom string `yaml:"handover_from"`
+
+	// Run as the agent of a central waitron instead, see server/agent.go
+	Agent *AgentConfig `yaml:"agent" json:"-"`
+
+	// Reuse rendered templates until their inputs change, see template/templatecache.go.
+	// Like everything in Config it can be set per group or machine.
+	TemplateCache bool `yaml:"template_cache"`
+
+	// Boot images downloaded to ImagePath and served as /images/<name>
+	Images           []BootImage `yaml:"images" json:"-"`
+	ImagePath        string      `yaml:"imagepath"`
+	ImageSyncSeconds int         `yaml:"image_sync_secs"`
+
+	// Bearer tokens for the admin endpoints, e.g. uploading files. Those
+	// endpoints are disabled without any.
+	AdminTokens []string `yaml:"admin_tokens" json:"-"`
+
+	// Concurrency and bandwidth caps for /files/, none when unset
+	FileLimits *FileLimitsConfig `yaml:"file_limits" json:"-"`
+
+	// How many finished build records to keep, see state/retention.go
+	BuildRetention BuildRetentionConfig `yaml:"build_retention" json:"-"`
+
+	// Limits on what installers upload to /artifacts/, see state/artifacts.go
+	Artifacts ArtifactConfig `yaml:"artifacts" json:"-"`
+
+	// Access log destination and format, stdout in common format when unset
+	AccessLog *AccessLogConfig `yaml:"access_log" json:"-"`
+
+	HookTimeoutSeconds int  `yaml:"hook_timeout_secs"`
+	HookDryRun         bool `yaml:"hook_dry_run"`
+	HookWorkers        int  `yaml:"hook_workers"`
+
+	// Stub hooks and external integrations and walk builds through a fake
+	// installer, see server/simulate.go
+	Simulate            bool `yaml:"simulate"`
+	SimulateStepSeconds int  `yaml:"simulate_step_secs"`
+
+	PreHooks  []Hook `yaml:"pre_hooks"`
+	PostHooks []Hook `yaml:"post_hooks"`
+
+	// Hooks for the other build stages, keyed by stage name
+	Hooks map[string][]Hook `yaml:"hooks"`
+
+	// Where build events are sent, see state/notify.go
+	Notifiers []NotifierConfig `yaml:"notifiers" json:"-"`
+
+	// Send metrics to statsd when set
+	Statsd *StatsdConfig `yaml:"statsd" json:"-"`
+
+	// Extra email notification recipients, usually set per group or machine
+	NotifyEmail []string `yaml:"notify_email"`
+
+	// SHA256 of the loaded config file, never read from or written to YAML.
+	Checksum string `yaml:"-" json:"-"`
+
+	// Plugins discovered in PluginPath at startup
+	Plugins []*Plugin `yaml:"-" json:"-"`
+
+	// Definitions loaded from Consul at startup, nil without Consul
+	ConsulKV *consulKV `yaml:"-" json:"-"`
+
+	// Built from Resolver at startup, nil without one
+	AttributeResolver *MachineResolver `yaml:"-" json:"-"`
+}
+
+// LoadConfig reads the config at configPath, a file or a remote source, and
+// applies what the environment sets, see configsource.go. An empty
+// configPath is a config set by the environment alone.
+func LoadConfig(configPath string) (Config, error) {
+
+	var c Config
+
+	var data []byte
+	var err error
+	if configPath != "" {
+		if data, err = readConfigSource(configPath); err != nil {
+			return Config{}, err
+		}
+		if err = yaml.Unmarshal(data, &c); err != nil {
+			return Config{}, err
+		}
+	}
+
+	env, err := applyConfigEnv(&c, os.Environ())
+	if err != nil {
+		return Config{}, err
+	}
+
+	for stage, hooks := range c.Hooks {
+		if !HasHookDependencies(hooks) {
+			continue
+		}
+		if err := ValidateHookGraph(hooks); err != nil {
+			return Config{}, fmt.Errorf("%s hooks: %s", stage, err)
+		}
+	}
+
+	if err := validateImages(c.Images); err != nil {
+		return Config{}, err
+	}
+
+	if c.Resolver != nil {
+		if err := ValidateResolver(*c.Resolver); err != nil {
+			return Config{}, err
+		}
+	}
+
+	// What the environment set is part of the config loaded
+	if len(env) > 0 {
+		data = append(data, []byte("\n"+strings.Join(env, "\n"))...)
+	}
+	sum := sha256.Sum256(data)
+	c.Checksum = hex.EncodeToString(sum[:])
+
+	return c, nil
+}
+
+func (c Config) listMachines() ([]string, error) {
+	var machines []string
+
+	files, err := StorageFor(c.MachinePath).List(c.MachinePath)
+
+	for _, file := range files {
+		name := file.Name
+		if path.Ext(name) == ".yaml" || path.Ext(name) == ".yml" {
+			machines = append(machines, name)
+		}
+	}
+
+	if err != nil {
+		return machines, err
+	}
+
+	return machines, nil
+}
+
+func (c Config) ListHooks() ([]string, error) {
+	var hooks []string
+	files, err := ioutil.ReadDir(c.HookPath)
+	for _, file := range files {
+		name := file.Name()
+		if path.Ext(name) == ".sh" {
+			hooks = append(hooks, name)
+		}
+	}
+	if err != nil {
+		return hooks, err
+	}
+	return hooks, nil
+}
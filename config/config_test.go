@@ -1,11 +1,21 @@
-package main
+package config
 
 import (
+	"os"
 	"testing"
 )
 
+// The tests read config.yaml, machines, groups and templates from the top of
+// the repository
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
 func TestLoadConfig(t *testing.T) {
-	c, err := loadConfig("config.yaml")
+	c, err := LoadConfig("config.yaml")
 	if err != nil {
 		t.Errorf("Failed to load test configuration")
 	}
@@ -15,21 +25,21 @@ func TestLoadConfig(t *testing.T) {
 }
 
 func TestInvalidConfig(t *testing.T) {
-	_, err := loadConfig("invalid.yaml")
+	_, err := LoadConfig("invalid.yaml")
 	if err == nil {
 		t.Errorf("No error presented when invalid configuration is loaded")
 	}
 }
 
 func TestInvalidYAMLConfig(t *testing.T) {
-	_, err := loadConfig("README.md")
+	_, err := LoadConfig("README.md")
 	if err == nil {
 		t.Errorf("No error presented when invalid configuration is loaded")
 	}
 }
 
 func TestListMachines(t *testing.T) {
-	c, _ := loadConfig("config.yaml")
+	c, _ := LoadConfig("config.yaml")
 	machines, err := c.listMachines()
 	if err != nil {
 		t.Errorf("Failed to list machines")
@@ -46,3 +56,13 @@ func TestListMachinesWithInvalidPath(t *testing.T) {
 		t.Errorf("Invalid machine path should throw errors")
 	}
 }
+
+func TestLoadConfigChecksum(t *testing.T) {
+	c, err := LoadConfig("config.yaml")
+	if err != nil {
+		t.Errorf("Failed to load test configuration")
+	}
+	if len(c.Checksum) != 64 {
+		t.Errorf("expected a sha256 config checksum, got %q", c.Checksum)
+	}
+}
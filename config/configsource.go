@@ -0,0 +1,228 @@
+package config
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// The config doesn't have to be a file baked into an image. -config, or
+// CONFIG_FILE, takes an http:// or https:// URL, consul://host:port/key for a
+// key in Consul KV, with the token in CONSUL_HTTP_TOKEN, or
+// etcd://host:port/key for a key in etcd, through its v3 JSON gateway.
+// consul+https:// and etcd+https:// reach them over TLS. The config is read
+// once at startup.
+//
+// Any config value can then be set in the environment: WAITRON_<KEY> sets a
+// top level key, e.g. WAITRON_BASEURL or WAITRON_STALE_BUILD_THRESHOLD_SECS,
+// and a double underscore goes down into a section, e.g.
+// WAITRON_SERVER__TLS_CERT_FILE. Values other than strings are YAML, so
+// WAITRON_ADMIN_TOKENS='[token1, token2]' sets a list and WAITRON_DNS='{...}'
+// a whole section. The environment wins over the config, and without any
+// config the environment is all there is to it.
+
+const (
+	configEnvPrefix        = "WAITRON_"
+	configSourceTimeout    = 30 * time.Second
+	configEnvSectionMarker = "__"
+)
+
+var configSourceClient = &http.Client{Timeout: configSourceTimeout}
+
+// The config at location, a file or one of the remote sources above
+func readConfigSource(location string) ([]byte, error) {
+	scheme := ""
+	if i := strings.Index(location, "://"); i >= 0 {
+		scheme = location[:i]
+	}
+	switch scheme {
+	case "":
+		return ioutil.ReadFile(location)
+	case "http", "https":
+		return StorageFor(location).Read(location)
+	case "consul", "consul+https":
+		return readConsulConfig(location)
+	case "etcd", "etcd+https":
+		return readEtcdConfig(location)
+	}
+	return nil, fmt.Errorf("unknown config source %s, expected a file, http, https, consul or etcd", location)
+}
+
+// The address and key of a consul:// or etcd:// location
+func configSourceKey(location string) (string, string) {
+	i := strings.Index(location, "://")
+	scheme, rest := location[:i], location[i+3:]
+	protocol := "http"
+	if strings.HasSuffix(scheme, "+https") {
+		protocol = "https"
+	}
+	host, key := rest, ""
+	if j := strings.Index(rest, "/"); j >= 0 {
+		host, key = rest[:j], rest[j+1:]
+	}
+	return protocol + "://" + host, key
+}
+
+func readConsulConfig(location string) ([]byte, error) {
+	address, key := configSourceKey(location)
+	request, err := http.NewRequest("GET", address+"/v1/kv/"+key+"?raw", nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		request.Header.Set("X-Consul-Token", token)
+	}
+	response, err := configSourceClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("consul answered %s for %s", response.Status, key)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
+// What etcd's v3 gateway answers a range request with, values are base64
+// which []byte decodes
+type etcdRange struct {
+	Kvs []struct {
+		Value []byte `json:"value"`
+	} `json:"kvs"`
+}
+
+func readEtcdConfig(location string) ([]byte, error) {
+	address, key := configSourceKey(location)
+	body, _ := json.Marshal(map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(key))})
+	response, err := configSourceClient.Post(address+"/v3/kv/range", "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("etcd answered %s for %s", response.Status, key)
+	}
+	var r etcdRange
+	if err := json.NewDecoder(response.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	if len(r.Kvs) == 0 {
+		return nil, fmt.Errorf("etcd has no key %s", key)
+	}
+	return r.Kvs[0].Value, nil
+}
+
+// Whether env, as os.Environ returns it, sets any config values
+func HasConfigEnv(env []string) bool {
+	for _, kv := range env {
+		if strings.HasPrefix(kv, configEnvPrefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Set the config values env sets, returns the variables that did, sorted
+func applyConfigEnv(c *Config, env []string) ([]string, error) {
+	var applied []string
+	for _, kv := range env {
+		if !strings.HasPrefix(kv, configEnvPrefix) {
+			continue
+		}
+		name, value := kv, ""
+		if i := strings.Index(kv, "="); i >= 0 {
+			name, value = kv[:i], kv[i+1:]
+		}
+		keys := strings.Split(strings.ToLower(strings.TrimPrefix(name, configEnvPrefix)), configEnvSectionMarker)
+		index, found := ConfigFieldIndex(reflect.TypeOf(*c), keys)
+		if !found {
+			logger.Warn("ignoring environment variable that isn't a config value", "name", name)
+			continue
+		}
+		if err := setConfigValue(ConfigField(reflect.ValueOf(c).Elem(), index), value); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		applied = append(applied, kv)
+	}
+	sort.Strings(applied)
+	return applied, nil
+}
+
+// The field indexes down to what keys name in t, a struct or a pointer to
+// one, with the YAML names yaml.v2 uses, see schema.go
+func ConfigFieldIndex(t reflect.Type, keys []string) ([]int, bool) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct || len(keys) == 0 {
+		return nil, false
+	}
+	for n := 0; n < t.NumField(); n++ {
+		f := t.Field(n)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		tag := f.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		if strings.Contains(tag, ",inline") {
+			if index, found := ConfigFieldIndex(f.Type, keys); found {
+				return append([]int{n}, index...), true
+			}
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		if name != keys[0] {
+			continue
+		}
+		if len(keys) == 1 {
+			return []int{n}, true
+		}
+		if index, found := ConfigFieldIndex(f.Type, keys[1:]); found {
+			return append([]int{n}, index...), true
+		}
+		return nil, false
+	}
+	return nil, false
+}
+
+// The field of v at index, making the sections on the way that are nil
+func ConfigField(v reflect.Value, index []int) reflect.Value {
+	for _, n := range index {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(n)
+	}
+	return v
+}
+
+func setConfigValue(field reflect.Value, value string) error {
+	if field.Kind() == reflect.String {
+		field.SetString(value)
+		return nil
+	}
+	v := reflect.New(field.Type())
+	if err := yaml.Unmarshal([]byte(value), v.Interface()); err != nil {
+		return err
+	}
+	field.Set(v.Elem())
+	return nil
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConfigEnv(t *testing.T) {
+	var c Config
+	applied, err := applyConfigEnv(&c, []string{
+		"HOME=/root",
+		"WAITRON_BASEURL=http://waitron.example.com:9090",
+		`WAITRON_PARAMS={"dns_server": "10.0.0.1"}`,
+		"WAITRON_SERVER__TLS_CERT_FILE=/etc/waitron/cert.pem",
+		`WAITRON_ADMIN_TOKENS=["s3cret", "0ther"]`,
+		"WAITRON_CONSUL__NO_SUCH_KEY=1",
+		"WAITRON_NO_SUCH_KEY=1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.BaseURL != "http://waitron.example.com:9090" || c.Params["dns_server"] != "10.0.0.1" ||
+		c.Server.TLSCertFile != "/etc/waitron/cert.pem" || !reflect.DeepEqual(c.AdminTokens, []string{"s3cret", "0ther"}) {
+		t.Errorf("expected the environment to set the config, got %+v", c)
+	}
+	if c.Consul != nil {
+		t.Error("expected a key that doesn't exist not to make its section")
+	}
+	if len(applied) != 4 {
+		t.Errorf("expected 4 variables applied, got %v", applied)
+	}
+
+	if _, err := applyConfigEnv(&c, []string{`WAITRON_PARAMS=["10.0.0.1", "10.0.0.2"]`}); err == nil {
+		t.Error("expected a value of the wrong type to be refused")
+	}
+}
+
+func TestConfigSources(t *testing.T) {
+	config := `{"baseurl": "http://waitron.example.com", "machinepath": "/data/machines"}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/kv/waitron/config":
+			if r.Header.Get("X-Consul-Token") != "t0ken" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			io.WriteString(w, config)
+		case "/v3/kv/range":
+			var q struct{ Key string }
+			json.NewDecoder(r.Body).Decode(&q)
+			if key, _ := base64.StdEncoding.DecodeString(q.Key); string(key) != "/waitron/config" {
+				io.WriteString(w, `{}`)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"kvs": []map[string][]byte{{"value": []byte(config)}}})
+		case "/waitron.yaml":
+			io.WriteString(w, config)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	os.Setenv("CONSUL_HTTP_TOKEN", "t0ken")
+	defer os.Unsetenv("CONSUL_HTTP_TOKEN")
+	for _, location := range []string{"consul://" + host + "/waitron/config", "etcd://" + host + "//waitron/config", server.URL + "/waitron.yaml"} {
+		if data, err := readConfigSource(location); err != nil || string(data) != config {
+			t.Errorf("expected the config from %s, got %q %v", location, data, err)
+		}
+	}
+	for _, location := range []string{"consul://" + host + "/waitron/other", "etcd://" + host + "/other", "ftp://" + host + "/waitron.yaml"} {
+		if _, err := readConfigSource(location); err == nil {
+			t.Errorf("expected no config from %s", location)
+		}
+	}
+
+	c, err := LoadConfig("consul://" + host + "/waitron/config")
+	if err != nil || c.BaseURL != "http://waitron.example.com" || c.MachinePath != "/data/machines" {
+		t.Fatalf("expected the config from consul, got %+v %v", c, err)
+	}
+	os.Setenv("WAITRON_MACHINEPATH", "/srv/machines")
+	defer os.Unsetenv("WAITRON_MACHINEPATH")
+	overridden, err := LoadConfig("consul://" + host + "/waitron/config")
+	if err != nil || overridden.MachinePath != "/srv/machines" || overridden.Checksum == c.Checksum {
+		t.Errorf("expected the environment to override the config and its checksum, got %+v %v", overridden, err)
+	}
+}
@@ -0,0 +1,309 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Machine and group definitions can come from Consul KV instead of
+// machinepath and grouppath. Every key under the prefix is kept in memory and
+// a blocking query waits for the next change, so definitions are current
+// without polling. The keys mirror the directories:
+//
+//	<prefix>/machines/<hostname>.yaml
+//	<prefix>/groups/<group>.yaml
+//
+// .yml and no extension work too. When Consul can't be reached the last
+// definitions seen are kept and the consul readiness check fails.
+
+const (
+	defaultConsulAddress     = "http://127.0.0.1:8500"
+	defaultConsulPrefix      = "waitron"
+	defaultConsulWaitSeconds = 300
+	maxConsulBackoff         = time.Minute
+)
+
+// ConsulConfig points waitron at definitions in Consul KV
+type ConsulConfig struct {
+	Address     string `yaml:"address"`
+	Token       string `yaml:"token"`
+	Datacenter  string `yaml:"datacenter"`
+	Prefix      string `yaml:"prefix"`
+	WaitSeconds int    `yaml:"wait_secs"`
+}
+
+type consulValue struct {
+	data        []byte
+	modifyIndex uint64
+	modTime     time.Time // when this process first saw the value
+}
+
+type consulKV struct {
+	config ConsulConfig
+	client *http.Client
+
+	mux      sync.RWMutex
+	index    uint64
+	machines map[string]consulValue
+	groups   map[string]consulValue
+	err      error // of the last query
+	onChange []func()
+}
+
+// The KV entries as returned by Consul, Value is base64 which []byte decodes
+type ConsulEntry struct {
+	Key         string
+	Value       []byte
+	ModifyIndex uint64
+}
+
+// Connect to Consul and load the definitions once
+func NewConsulKV(config ConsulConfig) (*consulKV, error) {
+	if config.Address == "" {
+		config.Address = defaultConsulAddress
+	}
+	config.Address = strings.TrimRight(config.Address, "/")
+	if config.Prefix == "" {
+		config.Prefix = defaultConsulPrefix
+	}
+	config.Prefix = strings.Trim(config.Prefix, "/")
+	wait := Seconds(config.WaitSeconds, defaultConsulWaitSeconds)
+
+	kv := &consulKV{
+		config: config,
+		// Consul adds up to wait/16 of jitter to a blocking query
+		client:   &http.Client{Timeout: wait + wait/16 + 10*time.Second},
+		machines: make(map[string]consulValue),
+		groups:   make(map[string]consulValue),
+	}
+	if _, err := kv.fetch(0); err != nil {
+		return nil, err
+	}
+	return kv, nil
+}
+
+// Call f after the definitions changed
+func (kv *consulKV) Subscribe(f func()) {
+	kv.mux.Lock()
+	kv.onChange = append(kv.onChange, f)
+	kv.mux.Unlock()
+}
+
+// Follow changes until stop is closed
+func (kv *consulKV) Watch(stop <-chan struct{}) {
+	go func() {
+		backoff := time.Second
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			kv.mux.RLock()
+			index := kv.index
+			kv.mux.RUnlock()
+
+			changed, err := kv.fetch(index)
+			if err != nil {
+				logger.Error("cannot read definitions from consul", "address", kv.config.Address, "prefix", kv.config.Prefix, "error", err)
+				select {
+				case <-stop:
+					return
+				case <-time.After(backoff):
+				}
+				if backoff *= 2; backoff > maxConsulBackoff {
+					backoff = maxConsulBackoff
+				}
+				continue
+			}
+			backoff = time.Second
+
+			if changed {
+				kv.mux.RLock()
+				logger.Info("definitions changed in consul", "machines", len(kv.machines), "groups", len(kv.groups), "index", kv.index)
+				subscribers := append([]func(){}, kv.onChange...)
+				kv.mux.RUnlock()
+				for _, f := range subscribers {
+					f()
+				}
+			}
+		}
+	}()
+}
+
+// Read everything under the prefix, waiting for a change past index when it
+// isn't 0. Reports whether anything changed.
+func (kv *consulKV) fetch(index uint64) (bool, error) {
+	query := url.Values{"recurse": {"true"}}
+	if index > 0 {
+		query.Set("index", strconv.FormatUint(index, 10))
+		query.Set("wait", fmt.Sprintf("%ds", Seconds(kv.config.WaitSeconds, defaultConsulWaitSeconds)/time.Second))
+	}
+	if kv.config.Datacenter != "" {
+		query.Set("dc", kv.config.Datacenter)
+	}
+
+	request, err := http.NewRequest("GET", kv.config.Address+"/v1/kv/"+kv.config.Prefix+"/?"+query.Encode(), nil)
+	if err != nil {
+		return false, err
+	}
+	if kv.config.Token != "" {
+		request.Header.Set("X-Consul-Token", kv.config.Token)
+	}
+
+	response, err := kv.client.Do(request)
+	if err != nil {
+		kv.failed(err)
+		return false, err
+	}
+	defer response.Body.Close()
+
+	var entries []ConsulEntry
+	switch response.StatusCode {
+	case http.StatusOK:
+		if err := json.NewDecoder(response.Body).Decode(&entries); err != nil {
+			kv.failed(err)
+			return false, err
+		}
+	case http.StatusNotFound:
+		// Nothing under the prefix yet
+	default:
+		err := fmt.Errorf("consul answered %s", response.Status)
+		kv.failed(err)
+		return false, err
+	}
+
+	newIndex, _ := strconv.ParseUint(response.Header.Get("X-Consul-Index"), 10, 64)
+	if newIndex < index {
+		// The index went backwards, e.g. after a snapshot restore: start over
+		newIndex = 0
+	}
+
+	kv.mux.Lock()
+	defer kv.mux.Unlock()
+	kv.err = nil
+	if index > 0 && newIndex == index {
+		return false, nil
+	}
+	kv.index = newIndex
+
+	now := time.Now()
+	machines := make(map[string]consulValue)
+	groups := make(map[string]consulValue)
+	for _, e := range entries {
+		kind, name := path.Split(strings.TrimPrefix(e.Key, kv.config.Prefix+"/"))
+		if name == "" {
+			continue // a folder
+		}
+		ext := path.Ext(name)
+		if ext == ".yaml" || ext == ".yml" {
+			name = strings.TrimSuffix(name, ext)
+		}
+		name = strings.ToLower(name)
+
+		var previous, current map[string]consulValue
+		switch kind {
+		case "machines/":
+			previous, current = kv.machines, machines
+		case "groups/":
+			previous, current = kv.groups, groups
+		default:
+			continue
+		}
+		if _, found := current[name]; found && ext != ".yaml" {
+			// Like the files, name.yaml wins over the others
+			continue
+		}
+
+		v := consulValue{data: e.Value, modifyIndex: e.ModifyIndex, modTime: now}
+		if p, found := previous[name]; found && p.modifyIndex == e.ModifyIndex {
+			v.modTime = p.modTime
+		}
+		current[name] = v
+	}
+	changed := !sameConsulValues(kv.machines, machines) || !sameConsulValues(kv.groups, groups)
+	kv.machines, kv.groups = machines, groups
+	return changed, nil
+}
+
+func sameConsulValues(a, b map[string]consulValue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for k, v := range a {
+		if w, found := b[k]; !found || w.modifyIndex != v.modifyIndex {
+			return false
+		}
+	}
+	return true
+}
+
+func (kv *consulKV) failed(err error) {
+	kv.mux.Lock()
+	kv.err = err
+	kv.mux.Unlock()
+}
+
+func (kv *consulKV) get(kind string, name string) ([]byte, error) {
+	kv.mux.RLock()
+	defer kv.mux.RUnlock()
+	values := kv.machines
+	if kind == "groups" {
+		values = kv.groups
+	}
+	v, found := values[strings.ToLower(name)]
+	if !found {
+		return nil, &os.PathError{Op: "get", Path: "consul:" + kv.config.Prefix + "/" + kind + "/" + name, Err: os.ErrNotExist}
+	}
+	return v.data, nil
+}
+
+// A machine definition, an os.IsNotExist error when there is none
+func (kv *consulKV) Machine(hostname string) ([]byte, error) {
+	return kv.get("machines", hostname)
+}
+
+// A group definition, an os.IsNotExist error when there is none
+func (kv *consulKV) Group(group string) ([]byte, error) {
+	return kv.get("groups", group)
+}
+
+// When the machine or group definition last changed, for the render cache
+func (kv *consulKV) ModTime(hostname string, group string) time.Time {
+	kv.mux.RLock()
+	defer kv.mux.RUnlock()
+	newest := kv.machines[strings.ToLower(hostname)].modTime
+	if t := kv.groups[strings.ToLower(group)].modTime; t.After(newest) {
+		newest = t
+	}
+	return newest
+}
+
+// The machine definitions and when they changed, sorted by hostname
+func (kv *consulKV) MachineFiles() []StorageEntry {
+	kv.mux.RLock()
+	defer kv.mux.RUnlock()
+	files := make([]StorageEntry, 0, len(kv.machines))
+	for hostname, v := range kv.machines {
+		files = append(files, StorageEntry{Name: hostname + ".yaml", ModTime: v.modTime})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files
+}
+
+// Why the last query failed, nil when it didn't
+func (kv *consulKV) Healthy() error {
+	kv.mux.RLock()
+	defer kv.mux.RUnlock()
+	return kv.err
+}
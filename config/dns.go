@@ -0,0 +1,18 @@
+package config
+
+// DNSConfig is how records for built machines are published
+type DNSConfig struct {
+	// rfc2136 or route53
+	Driver string    `yaml:"driver"`
+	TTL    int       `yaml:"ttl"`
+	Zones  []DNSZone `yaml:"zones"`
+
+	RFC2136 RFC2136Config `yaml:"rfc2136"`
+	Route53 Route53Config `yaml:"route53"`
+}
+
+type DNSZone struct {
+	Name string `yaml:"name"`
+	// The hosted zone id with route53
+	ID string `yaml:"id"`
+}
@@ -0,0 +1,4 @@
+// Package config is the configuration of Waitron, how it is read and
+// checked, and the logger, secrets and storage backends every other package
+// uses.
+package config
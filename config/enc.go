@@ -0,0 +1,58 @@
+package config
+
+// Puppet's external node classifier can ask waitron how to classify a node,
+// so the definitions that installed a machine keep describing it afterwards.
+// The puppet section can be set in the config, the group and the machine like
+// everything else; classes and parameters given as maps are merged across
+// them, a list of classes replaces the one before it. The machine's params
+// are the parameters the puppet section doesn't set.
+//
+// 	puppet:
+// 	  environment: production
+// 	  classes:
+// 	    ntp:
+// 	    apache:
+// 	      default_vhost: false
+// 	  parameters:
+// 	    datacenter: ams1
+
+// PuppetConfig is how Puppet classifies a machine
+type PuppetConfig struct {
+	Environment string                 `yaml:"environment"`
+	Classes     puppetClasses          `yaml:"classes"`
+	Parameters  map[string]interface{} `yaml:"parameters"`
+}
+
+// Classes by name with their parameters, which may be nil
+type puppetClasses map[string]interface{}
+
+// Both a list of class names and a map of classes to their parameters
+func (c *puppetClasses) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var names []string
+	if err := unmarshal(&names); err == nil {
+		*c = puppetClasses{}
+		for _, name := range names {
+			(*c)[name] = nil
+		}
+		return nil
+	}
+
+	classes := map[string]interface{}{}
+	if err := unmarshal(&classes); err != nil {
+		return err
+	}
+	if *c == nil {
+		*c = puppetClasses{}
+	}
+	for name, params := range classes {
+		(*c)[name] = params
+	}
+	return nil
+}
+
+func (puppetClasses) jsonSchema() *JSONSchema {
+	return &JSONSchema{AnyOf: []*JSONSchema{
+		{Type: "array", Items: &JSONSchema{Type: "string"}},
+		{Type: "object", AdditionalProperties: &JSONSchema{}},
+	}}
+}
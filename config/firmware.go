@@ -0,0 +1,22 @@
+package config
+
+// FirmwarePackage is a firmware version for a component and where to get it
+type FirmwarePackage struct {
+	Version string `yaml:"version"`
+	URL     string `yaml:"url"`
+	SHA256  string `yaml:"sha256" json:",omitempty"`
+}
+
+type FirmwareConfig struct {
+	ImageURL string `yaml:"image_url"`
+	Kernel   string `yaml:"kernel"`
+	Initrd   string `yaml:"initrd"`
+	Cmdline  string `yaml:"cmdline"`
+
+	ModelLabel string `yaml:"model_label"`
+
+	// Packages by model, then by component, e.g. bios, bmc or nic
+	Models map[string]map[string]FirmwarePackage `yaml:"models"`
+
+	TimeoutSeconds int `yaml:"timeout_secs"`
+}
@@ -0,0 +1,13 @@
+package config
+
+// GitRepoConfig points waitron at a repository with definitions and templates
+type GitRepoConfig struct {
+	URL           string `yaml:"url"`
+	Branch        string `yaml:"branch"`
+	Path          string `yaml:"path"`
+	SyncSeconds   int    `yaml:"sync_secs"`
+	MachineDir    string `yaml:"machine_dir"`
+	GroupDir      string `yaml:"group_dir"`
+	TemplateDir   string `yaml:"template_dir"`
+	WebhookSecret string `yaml:"webhook_secret"`
+}
@@ -0,0 +1,23 @@
+package config
+
+import (
+	"errors"
+	"io"
+	"os"
+)
+
+func CheckPathReadable(p string) error {
+	if p == "" {
+		return errors.New("not configured")
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Readdirnames(1)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
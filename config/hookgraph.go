@@ -0,0 +1,78 @@
+package config
+
+import (
+	"fmt"
+)
+
+// Hooks in a stage can name others in the same stage in DependsOn. Hooks
+// with no dependency between them run concurrently, the rest wait for what
+// they depend on and are skipped if any of it failed.
+
+func HasHookDependencies(hooks []Hook) bool {
+	for _, hook := range hooks {
+		if len(hook.DependsOn) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Check that every dependency names a synchronous hook in the same stage and
+// that there are no cycles.
+func ValidateHookGraph(hooks []Hook) error {
+	byName := map[string]Hook{}
+	for _, hook := range hooks {
+		if _, found := byName[hook.String()]; found {
+			return fmt.Errorf("hook %s is listed twice, dependencies are ambiguous", hook)
+		}
+		byName[hook.String()] = hook
+	}
+
+	for _, hook := range hooks {
+		if hook.Async && len(hook.DependsOn) > 0 {
+			return fmt.Errorf("async hook %s can't depend on other hooks", hook)
+		}
+		for _, dep := range hook.DependsOn {
+			d, found := byName[dep]
+			if !found {
+				return fmt.Errorf("hook %s depends on unknown hook %s", hook, dep)
+			}
+			if d.Async {
+				return fmt.Errorf("hook %s depends on async hook %s", hook, dep)
+			}
+		}
+	}
+
+	// Kahn's algorithm, anything left over is part of a cycle
+	pending := map[string]int{}
+	dependents := map[string][]string{}
+	for _, hook := range hooks {
+		pending[hook.String()] = len(hook.DependsOn)
+		for _, dep := range hook.DependsOn {
+			dependents[dep] = append(dependents[dep], hook.String())
+		}
+	}
+
+	var ready []string
+	for name, n := range pending {
+		if n == 0 {
+			ready = append(ready, name)
+		}
+	}
+
+	for len(ready) > 0 {
+		name := ready[0]
+		ready = ready[1:]
+		delete(pending, name)
+		for _, d := range dependents[name] {
+			if pending[d]--; pending[d] == 0 {
+				ready = append(ready, d)
+			}
+		}
+	}
+
+	for name := range pending {
+		return fmt.Errorf("hook %s is part of a dependency cycle", name)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestValidateHookGraph(t *testing.T) {
+	tests := []struct {
+		hooks []Hook
+		valid bool
+	}{
+		{[]Hook{{Name: "a"}, {Name: "b", DependsOn: []string{"a"}}}, true},
+		{[]Hook{{Name: "b", DependsOn: []string{"missing"}}}, false},
+		{[]Hook{{Name: "a", DependsOn: []string{"b"}}, {Name: "b", DependsOn: []string{"a"}}}, false},
+		{[]Hook{{Name: "a", Async: true}, {Name: "b", DependsOn: []string{"a"}}}, false},
+		{[]Hook{{Name: "a"}, {Name: "a"}, {Name: "b", DependsOn: []string{"a"}}}, false},
+	}
+
+	for i, test := range tests {
+		if err := ValidateHookGraph(test.hooks); (err == nil) != test.valid {
+			t.Errorf("%d: expected valid=%v, got %v", i, test.valid, err)
+		}
+	}
+}
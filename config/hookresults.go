@@ -0,0 +1,28 @@
+package config
+
+import (
+	"bytes"
+)
+
+// How much of a hook's output is kept, and how many results per host
+const maxHookOutput = 64 * 1024
+
+// Buffer that silently drops anything written past its limit
+type limitedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); room < len(p) {
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+func NewLimitedBuffer() *limitedBuffer {
+	return &limitedBuffer{limit: maxHookOutput}
+}
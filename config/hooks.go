@@ -0,0 +1,83 @@
+package config
+
+import (
+	"reflect"
+	"time"
+)
+
+// Hook is either a script in HookPath, given as a plain string in the config,
+// or an HTTP call described by a mapping with at least a url.
+type Hook struct {
+	Name    string            `yaml:"name"`
+	URL     string            `yaml:"url"`
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+
+	// Name of a hook plugin to run instead of a script or webhook
+	Plugin string `yaml:"plugin"`
+
+	// A command line run through bash, or with Args, a program run directly.
+	// Both are rendered as templates first.
+	Command string   `yaml:"command"`
+	Args    []string `yaml:"args"`
+
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+
+	// Async hooks run in the background instead of holding up the request.
+	// Failed attempts are retried with exponential backoff starting at
+	// RetryBackoffSeconds.
+	Async               bool `yaml:"async"`
+	Retries             int  `yaml:"retries"`
+	RetryBackoffSeconds int  `yaml:"retry_backoff_secs"`
+
+	// Names of hooks in the same stage that have to succeed before this one
+	DependsOn []string `yaml:"depends_on"`
+
+	// Limits on script and command hooks
+	Sandbox *HookSandbox `yaml:"sandbox"`
+}
+
+const defaultHookTimeoutSeconds = 60
+
+// The hook's own timeout, falling back to the global one and then the default
+func (h Hook) Timeout(config Config) time.Duration {
+	seconds := h.TimeoutSeconds
+	if seconds <= 0 {
+		seconds = config.HookTimeoutSeconds
+	}
+	if seconds <= 0 {
+		seconds = defaultHookTimeoutSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (h *Hook) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var name string
+	if err := unmarshal(&name); err == nil {
+		h.Name = name
+		return nil
+	}
+
+	type plain Hook
+	return unmarshal((*plain)(h))
+}
+
+// A hook is its name or the whole hook
+func (Hook) jsonSchema() *JSONSchema {
+	type plain Hook
+	return &JSONSchema{AnyOf: []*JSONSchema{{Type: "string"}, schemaFor(reflect.TypeOf(plain{}), map[reflect.Type]bool{})}}
+}
+
+func (h Hook) String() string {
+	if h.Name != "" {
+		return h.Name
+	}
+	if h.Plugin != "" {
+		return h.Plugin
+	}
+	if h.Command != "" {
+		return h.Command
+	}
+	return h.URL
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// BootImage is a file waitron downloads and serves. Without SHA256 the
+// download isn't verified and is only refreshed when the server says it
+// changed.
+type BootImage struct {
+	Name   string `yaml:"name"`
+	URL    string `yaml:"url"`
+	SHA256 string `yaml:"sha256"`
+}
+
+var imageNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+var SHA256Re = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func validateImages(images []BootImage) error {
+	seen := make(map[string]bool)
+	for _, img := range images {
+		if !imageNameRe.MatchString(img.Name) {
+			return fmt.Errorf("invalid image name %q", img.Name)
+		}
+		if seen[img.Name] {
+			return fmt.Errorf("image %s is declared twice", img.Name)
+		}
+		seen[img.Name] = true
+
+		if img.URL == "" {
+			return fmt.Errorf("image %s has no url", img.Name)
+		}
+		if img.SHA256 != "" && !SHA256Re.MatchString(strings.ToLower(img.SHA256)) {
+			return fmt.Errorf("image %s has an invalid sha256", img.Name)
+		}
+	}
+	return nil
+}
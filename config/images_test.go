@@ -0,0 +1,24 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestValidateImages(t *testing.T) {
+	good := []BootImage{{Name: "focal-linux", URL: "http://example.com/linux"}}
+	if err := validateImages(good); err != nil {
+		t.Error(err)
+	}
+
+	bad := [][]BootImage{
+		{{Name: "../linux", URL: "http://example.com/linux"}},
+		{{Name: "linux"}},
+		{{Name: "linux", URL: "http://example.com/linux", SHA256: "abc"}},
+		{{Name: "linux", URL: "http://example.com/a"}, {Name: "linux", URL: "http://example.com/b"}},
+	}
+	for _, images := range bad {
+		if err := validateImages(images); err == nil {
+			t.Errorf("expected %+v to be invalid", images)
+		}
+	}
+}
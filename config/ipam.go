@@ -0,0 +1,27 @@
+package config
+
+// IPAMConfig is the address pools interfaces with ip: auto get addresses from
+type IPAMConfig struct {
+	Pools []IPPoolConfig `yaml:"pools"`
+
+	// builtin, phpipam or netbox, builtin when unset
+	Driver  string           `yaml:"driver"`
+	PHPIPAM PHPIPAMConfig    `yaml:"phpipam"`
+	NetBox  NetBoxIPAMConfig `yaml:"netbox"`
+}
+
+type IPPoolConfig struct {
+	Name   string `yaml:"name"`
+	Subnet string `yaml:"subnet"`
+
+	// The range handed out, the whole subnet without its network and
+	// broadcast addresses by default
+	Start string `yaml:"start"`
+	End   string `yaml:"end"`
+
+	Gateway string   `yaml:"gateway"`
+	Exclude []string `yaml:"exclude"`
+
+	// Give addresses back once their build is done rather than keeping them
+	ReleaseOnDone bool `yaml:"release_on_done"`
+}
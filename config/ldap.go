@@ -0,0 +1,281 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"time"
+)
+
+// Just enough LDAPv3 to look machines up for the resolver: a simple bind and
+// a search for the entry whose attribute equals a value. Messages are BER
+// encoded, see RFC 4511.
+
+const (
+	berBoolean     = 0x01
+	BerInteger     = 0x02
+	BerOctetString = 0x04
+	BerEnumerated  = 0x0a
+	BerSequence    = 0x30
+	BerSet         = 0x31
+
+	LDAPBindRequest       = 0x60
+	LDAPBindResponse      = 0x61
+	LDAPUnbindRequest     = 0x42
+	LDAPSearchRequest     = 0x63
+	LDAPSearchResultEntry = 0x64
+	LDAPSearchResultDone  = 0x65
+	ldapSimpleAuth        = 0x80
+	ldapFilterAnd         = 0xa0
+	ldapFilterEquality    = 0xa3
+
+	LDAPSuccess           = 0
+	ldapSizeLimitExceeded = 4
+	ldapNoSuchObject      = 32
+
+	defaultLDAPPort  = "389"
+	defaultLDAPSPort = "636"
+)
+
+// A BER element: its tag and either its content or, once parsed, its children
+type berElement struct {
+	Tag      byte
+	Content  []byte
+	Children []berElement
+}
+
+func BerEncode(tag byte, content ...[]byte) []byte {
+	var body []byte
+	for _, c := range content {
+		body = append(body, c...)
+	}
+	n := len(body)
+	var length []byte
+	switch {
+	case n < 0x80:
+		length = []byte{byte(n)}
+	default:
+		for ; n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		length = append([]byte{0x80 | byte(len(length))}, length...)
+	}
+	return append(append([]byte{tag}, length...), body...)
+}
+
+func BerInt(tag byte, v int) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v > 0; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+	if b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	}
+	return BerEncode(tag, b)
+}
+
+func BerString(tag byte, s string) []byte {
+	return BerEncode(tag, []byte(s))
+}
+
+// Read one element, parsing constructed ones into their children
+func BerRead(r io.Reader) (berElement, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return berElement{}, err
+	}
+	n := int(header[1])
+	if n&0x80 != 0 {
+		octets := n & 0x7f
+		if octets == 0 || octets > 4 {
+			return berElement{}, errors.New("ldap: unsupported BER length")
+		}
+		b := make([]byte, octets)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return berElement{}, err
+		}
+		n = 0
+		for _, c := range b {
+			n = n<<8 | int(c)
+		}
+	}
+	e := berElement{Tag: header[0], Content: make([]byte, n)}
+	if _, err := io.ReadFull(r, e.Content); err != nil {
+		return berElement{}, err
+	}
+	if e.Tag&0x20 != 0 { // constructed
+		rest := bytes.NewReader(e.Content)
+		for {
+			child, err := BerRead(rest)
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return berElement{}, err
+			}
+			e.Children = append(e.Children, child)
+		}
+	}
+	return e, nil
+}
+
+func (e berElement) Int() int {
+	v := 0
+	for _, c := range e.Content {
+		v = v<<8 | int(c)
+	}
+	return v
+}
+
+// An LDAP connection, used for one lookup at a time
+type ldapConn struct {
+	conn      net.Conn
+	r         *bufio.Reader
+	messageID int
+	timeout   time.Duration
+}
+
+// Connect to an ldap:// or ldaps:// URL
+func dialLDAP(rawurl string, timeout time.Duration) (*ldapConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		conn, err = dialer.Dial("tcp", HostWithPort(u.Host, defaultLDAPPort))
+	case "ldaps":
+		conn, err = tls.DialWithDialer(dialer, "tcp", HostWithPort(u.Host, defaultLDAPSPort), &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("ldap: unsupported URL %s", rawurl)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ldapConn{conn: conn, r: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+func HostWithPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func (c *ldapConn) send(op []byte) error {
+	c.messageID++
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(BerEncode(BerSequence, BerInt(BerInteger, c.messageID), op))
+	return err
+}
+
+// The protocol op of the next message
+func (c *ldapConn) receive() (berElement, error) {
+	message, err := BerRead(c.r)
+	if err != nil {
+		return berElement{}, err
+	}
+	if message.Tag != BerSequence || len(message.Children) < 2 {
+		return berElement{}, errors.New("ldap: malformed message")
+	}
+	return message.Children[1], nil
+}
+
+// The result code and diagnostic message of an LDAPResult
+func ldapResult(op berElement) (int, string) {
+	if len(op.Children) < 3 {
+		return -1, "malformed result"
+	}
+	return op.Children[0].Int(), string(op.Children[2].Content)
+}
+
+func (c *ldapConn) bind(dn string, password string) error {
+	err := c.send(BerEncode(LDAPBindRequest,
+		BerInt(BerInteger, 3),
+		BerString(BerOctetString, dn),
+		BerString(ldapSimpleAuth, password)))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if op.Tag != LDAPBindResponse {
+		return fmt.Errorf("ldap: unexpected response to bind: %#x", op.Tag)
+	}
+	if code, message := ldapResult(op); code != LDAPSuccess {
+		return fmt.Errorf("ldap: bind as %q failed: %d %s", dn, code, message)
+	}
+	return nil
+}
+
+// The attributes of the first entry under base where attribute equals value,
+// and objectClass equals class when it is set. nil when there is none.
+func (c *ldapConn) searchOne(base string, class string, attribute string, value string, attributes []string) (map[string][]string, error) {
+	filter := BerEncode(ldapFilterEquality, BerString(BerOctetString, attribute), BerString(BerOctetString, value))
+	if class != "" {
+		filter = BerEncode(ldapFilterAnd,
+			BerEncode(ldapFilterEquality, BerString(BerOctetString, "objectClass"), BerString(BerOctetString, class)),
+			filter)
+	}
+	var wanted [][]byte
+	for _, a := range attributes {
+		wanted = append(wanted, BerString(BerOctetString, a))
+	}
+	err := c.send(BerEncode(LDAPSearchRequest,
+		BerString(BerOctetString, base),
+		BerInt(BerEnumerated, 2), // wholeSubtree
+		BerInt(BerEnumerated, 0), // neverDerefAliases
+		BerInt(BerInteger, 1),    // sizeLimit
+		BerInt(BerInteger, int(c.timeout/time.Second)),
+		BerEncode(berBoolean, []byte{0}),
+		filter,
+		BerEncode(BerSequence, wanted...)))
+	if err != nil {
+		return nil, err
+	}
+
+	var found map[string][]string
+	for {
+		op, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch op.Tag {
+		case LDAPSearchResultEntry:
+			if found != nil || len(op.Children) < 2 {
+				continue
+			}
+			found = make(map[string][]string)
+			for _, a := range op.Children[1].Children {
+				if len(a.Children) < 2 {
+					continue
+				}
+				name := string(a.Children[0].Content)
+				for _, v := range a.Children[1].Children {
+					found[name] = append(found[name], string(v.Content))
+				}
+			}
+		case LDAPSearchResultDone:
+			code, message := ldapResult(op)
+			switch code {
+			case LDAPSuccess, ldapSizeLimitExceeded, ldapNoSuchObject:
+				return found, nil
+			}
+			return nil, fmt.Errorf("ldap: search failed: %d %s", code, message)
+		}
+		// References and anything else are skipped
+	}
+}
+
+func (c *ldapConn) close() {
+	c.send(BerEncode(LDAPUnbindRequest))
+	c.conn.Close()
+}
@@ -0,0 +1,14 @@
+package config
+
+// LibvirtConfig is how to reach the hypervisors
+type LibvirtConfig struct {
+	// Connection URI, {host} is the hypervisor, qemu+ssh://root@{host}/system
+	// by default
+	URI string `yaml:"uri"`
+	// For NICs of VMs without a virt_network, br0 by default
+	Bridge string `yaml:"bridge"`
+	// Where disks are made when the VM doesn't say, default by default
+	Pool string `yaml:"pool"`
+	// Path to virsh, found in PATH by default
+	Virsh string `yaml:"virsh"`
+}
@@ -0,0 +1,224 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Leveled logging with key/value fields, written as text (the default, like
+// the standard logger), logfmt or JSON lines.
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	LevelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[logLevel]string{
+	levelDebug: "debug",
+	LevelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for level, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+	if strings.EqualFold(s, "warning") {
+		return levelWarn, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+type logOutput struct {
+	mux    sync.Mutex
+	w      io.Writer
+	format string
+	level  logLevel
+}
+
+// Logger writes log lines carrying its fields. Loggers made with With share
+// the output of the logger they came from.
+type Logger struct {
+	out    *logOutput
+	fields []interface{}
+}
+
+// Log is what every package of Waitron logs with, ConfigureLogging sets its
+// format and level
+var Log = NewLogger(os.Stderr, "text", LevelInfo)
+
+var logger = Log
+
+func NewLogger(w io.Writer, format string, level logLevel) *Logger {
+	return &Logger{out: &logOutput{w: w, format: format, level: level}}
+}
+
+// Set the format (text, logfmt or json) and level of the default logger
+func ConfigureLogging(format string, level string) error {
+	if format == "" {
+		format = "text"
+	}
+	switch format {
+	case "text", "logfmt", "json":
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+
+	l := LevelInfo
+	if level != "" {
+		var err error
+		if l, err = parseLogLevel(level); err != nil {
+			return err
+		}
+	}
+
+	logger.out.mux.Lock()
+	logger.out.format = format
+	logger.out.level = l
+	logger.out.mux.Unlock()
+	return nil
+}
+
+// A logger adding the key/value pairs kv to every line
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+	return &Logger{out: l.out, fields: fields}
+}
+
+// What a logger for lines about a machine adds, see machine.Machine.LogFields
+type loggedMachine interface {
+	LogFields() []interface{}
+}
+
+// A logger for lines about machine m
+func (l *Logger) Machine(m loggedMachine) *Logger {
+	kv := m.LogFields()
+	if len(kv) == 0 {
+		return l
+	}
+	return l.With(kv...)
+}
+
+// A logger for lines about a request
+func RequestLogger(request *http.Request) *Logger {
+	if request == nil {
+		return logger
+	}
+	kv := []interface{}{"route", request.Method + " " + request.URL.Path}
+	if id := RequestID(request); id != "" {
+		kv = append([]interface{}{"request_id", id}, kv...)
+	}
+	return logger.With(kv...)
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(levelDebug, msg, kv) }
+
+func (l *Logger) Info(msg string, kv ...interface{}) { l.log(LevelInfo, msg, kv) }
+
+func (l *Logger) Warn(msg string, kv ...interface{}) { l.log(levelWarn, msg, kv) }
+
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(levelError, msg, kv) }
+
+// Log at error level and exit
+func (l *Logger) Fatal(msg string, kv ...interface{}) {
+	l.log(levelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *Logger) log(level logLevel, msg string, kv []interface{}) {
+	l.out.mux.Lock()
+	defer l.out.mux.Unlock()
+
+	if level < l.out.level {
+		return
+	}
+
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+	if len(fields)%2 != 0 {
+		fields = append(fields, "")
+	}
+
+	var line []byte
+	now := time.Now()
+	switch l.out.format {
+	case "json":
+		line = formatJSON(now, level, msg, fields)
+	case "logfmt":
+		line = formatLogfmt(now, level, msg, fields)
+	default:
+		line = formatText(now, level, msg, fields)
+	}
+	l.out.w.Write(line)
+}
+
+func fieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func formatJSON(t time.Time, level logLevel, msg string, fields []interface{}) []byte {
+	line := map[string]interface{}{
+		"time":  t.Format(time.RFC3339Nano),
+		"level": logLevelNames[level],
+		"msg":   msg,
+	}
+	for i := 0; i < len(fields); i += 2 {
+		line[fmt.Sprint(fields[i])] = fieldValue(fields[i+1])
+	}
+
+	js, err := json.Marshal(line)
+	if err != nil {
+		js, _ = json.Marshal(map[string]string{"time": t.Format(time.RFC3339Nano), "level": logLevelNames[level], "msg": msg})
+	}
+	return append(js, '\n')
+}
+
+func logfmtValue(v interface{}) string {
+	s := fmt.Sprint(fieldValue(v))
+	if s == "" || strings.ContainsAny(s, " =\"\t\r\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func formatLogfmt(t time.Time, level logLevel, msg string, fields []interface{}) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "time=%s level=%s msg=%s", t.Format(time.RFC3339Nano), logLevelNames[level], logfmtValue(msg))
+	for i := 0; i < len(fields); i += 2 {
+		fmt.Fprintf(&buf, " %s=%s", fields[i], logfmtValue(fields[i+1]))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+func formatText(t time.Time, level logLevel, msg string, fields []interface{}) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s %s", t.Format("2006/01/02 15:04:05"), strings.ToUpper(logLevelNames[level]), msg)
+	for i := 0; i < len(fields); i += 2 {
+		fmt.Fprintf(&buf, " %s=%s", fields[i], logfmtValue(fields[i+1]))
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
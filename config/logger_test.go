@@ -0,0 +1,49 @@
+package config
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLoggerLevel(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewLogger(&buf, "logfmt", levelWarn)
+
+	l.Info("not logged")
+	l.Warn("logged", "path", "/tmp/some file")
+
+	if strings.Contains(buf.String(), "not logged") {
+		t.Errorf("expected info lines to be dropped at warn level")
+	}
+	if !strings.Contains(buf.String(), `level=warn msg=logged path="/tmp/some file"`) {
+		t.Errorf("unexpected logfmt line %q", buf.String())
+	}
+}
+
+func TestRequestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	request, _ := http.NewRequest("GET", "/done/dns02.example.com/token", nil)
+	request.Header.Set(RequestIDHeader, "req-1")
+
+	l := RequestLogger(request)
+	l.out = &logOutput{w: &buf, format: "logfmt"}
+	l.Info("done")
+
+	if !strings.Contains(buf.String(), `request_id=req-1 route="GET /done/dns02.example.com/token"`) {
+		t.Errorf("expected the request ID and route, got %q", buf.String())
+	}
+}
+
+func TestConfigureLogging(t *testing.T) {
+	if err := ConfigureLogging("xml", ""); err == nil {
+		t.Errorf("expected an unknown format to fail")
+	}
+	if err := ConfigureLogging("", "verbose"); err == nil {
+		t.Errorf("expected an unknown level to fail")
+	}
+	if err := ConfigureLogging("", ""); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
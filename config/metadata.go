@@ -0,0 +1,27 @@
+package config
+
+// With metadata set, a listener of its own answers the paths of EC2's
+// instance metadata service, so images built for cloud-init's Ec2 datasource
+// get their hostname, SSH keys and user data on bare metal as well. Requests
+// to 169.254.169.254:80 have to reach metadata.address with the machine's
+// own source address, e.g. with the address on a dummy interface of the
+// waitron host and a route to it, or with DNAT: the source address is what
+// tells machines apart. Machines being built are found by their interface
+// addresses and DHCP lease, others by the addresses in their definition and
+// those ipam lent them.
+//
+//	/latest/meta-data/instance-id      i- and a hash of the hostname
+//	/latest/meta-data/hostname         also local-hostname
+//	/latest/meta-data/local-ipv4       the address the request came from
+//	/latest/meta-data/mac              of the first interface
+//	/latest/meta-data/public-keys/     public_keys of the machine
+//	/latest/user-data                  <hostname>.cloud-init next to the machine definition
+//
+// Any API version such as 2009-04-04 works in place of latest. PUT
+// /latest/api/token hands out IMDSv2 tokens so cloud-init doesn't wait for
+// it to time out, but the tokens aren't checked.
+
+type MetadataConfig struct {
+	// address:port to listen on, e.g. 169.254.169.254:80
+	Address string `yaml:"address"`
+}
@@ -0,0 +1,9 @@
+package config
+
+// StatsdConfig configures sending metrics to statsd. With DogStatsd tags are
+// added the Datadog way, plain statsd has no tags.
+type StatsdConfig struct {
+	Address   string `yaml:"address"`
+	Prefix    string `yaml:"prefix"`
+	DogStatsd bool   `yaml:"dogstatsd"`
+}
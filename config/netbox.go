@@ -0,0 +1,14 @@
+package config
+
+// Addresses from NetBox's available-ips of the prefix matching a pool. They
+// are created with status reserved and the machine's hostname as DNS name,
+// and become active once their build is done. The token needs to add,
+// change and delete IP addresses.
+
+// NetBoxIPAMConfig is access to the NetBox API
+type NetBoxIPAMConfig struct {
+	// e.g. https://netbox.example.com, NETBOX_URL when unset
+	URL string `yaml:"url"`
+	// A secret reference, see secrets.go, NETBOX_TOKEN when unset
+	Token string `yaml:"token"`
+}
@@ -0,0 +1,48 @@
+package config
+
+// NotifierConfig configures one notifier from the notifiers list in the
+// config. Events limits it to the given event types, by default all build
+// events. Templates override the message sent for an event type.
+type NotifierConfig struct {
+	Name      string            `yaml:"name"`
+	Type      string            `yaml:"type"`
+	URL       string            `yaml:"url"`
+	Channel   string            `yaml:"channel"`
+	Username  string            `yaml:"username"`
+	Events    []string          `yaml:"events"`
+	Templates map[string]string `yaml:"templates"`
+
+	// webhook: url and headers are templates too. Body is used for events
+	// without their own template, by default the whole event as JSON.
+	Method  string            `yaml:"method"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+
+	// nats, kafka, mqtt and redis, see state/publish.go, state/mqtt.go and state/redis.go.
+	// Subject, topic, channel and stream are templates.
+	Subject      string `yaml:"subject"`
+	Topic        string `yaml:"topic"`
+	Stream       string `yaml:"stream"`
+	StreamMaxLen int    `yaml:"stream_max_len"`
+
+	// pagerduty and opsgenie, see state/alert.go
+	RoutingKey string `yaml:"routing_key"`
+	APIKey     string `yaml:"api_key"`
+	Severity   string `yaml:"severity"`
+
+	// email: recipients are To plus the notify_email of the machine or its
+	// group, the subject is templated per event like the body.
+	SMTPServer   string            `yaml:"smtp_server"`
+	SMTPUsername string            `yaml:"smtp_username"`
+	SMTPPassword string            `yaml:"smtp_password"`
+	From         string            `yaml:"from"`
+	To           []string          `yaml:"to"`
+	Subjects     map[string]string `yaml:"subjects"`
+}
+
+func (nc NotifierConfig) String() string {
+	if nc.Name != "" {
+		return nc.Name
+	}
+	return nc.Type
+}
@@ -0,0 +1,352 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// A definition's storage section declares the disks, partitions, LVM volume
+// groups and filesystems of a machine once, and templates render it for
+// whichever installer they are for:
+//
+//	{{ partman_recipe() }}    preseed partman-auto lines
+//	{{ kickstart_storage() }} kickstart clearpart, part, volgroup and logvol lines
+//	{{ curtin_storage(2) }}   a curtin or autoinstall storage section, indented
+//
+// The section is checked when the definition is loaded, so a machine with a
+// layout that doesn't add up can't be built.
+
+var errNoStorageLayout = errors.New("the definition has no storage section")
+
+// Filesystems a partition or logical volume can have. bios_grub is the
+// partition GRUB embeds itself in on GPT disks booting with BIOS.
+var layoutFilesystems = map[string]bool{
+	"ext4": true, "ext3": true, "xfs": true, "btrfs": true, "vfat": true, "swap": true, "bios_grub": true,
+}
+
+type StorageLayout struct {
+	Disks        []DiskLayout  `yaml:"disks"`
+	VolumeGroups []VolumeGroup `yaml:"volume_groups"`
+}
+
+type DiskLayout struct {
+	Device string `yaml:"device"`
+	// gpt by default, or msdos
+	Table      string      `yaml:"table"`
+	Partitions []Partition `yaml:"partitions"`
+}
+
+type Partition struct {
+	// The rest of the disk when 0, only for the last partition
+	SizeMB     int    `yaml:"size_mb"`
+	Filesystem string `yaml:"filesystem"`
+	Mount      string `yaml:"mount"`
+	// An LVM physical volume of this volume group instead of a filesystem
+	VolumeGroup string `yaml:"volume_group"`
+}
+
+type VolumeGroup struct {
+	Name           string          `yaml:"name"`
+	LogicalVolumes []LogicalVolume `yaml:"logical_volumes"`
+}
+
+type LogicalVolume struct {
+	Name string `yaml:"name"`
+	// The rest of the volume group when 0, only for the last volume
+	SizeMB     int    `yaml:"size_mb"`
+	Filesystem string `yaml:"filesystem"`
+	Mount      string `yaml:"mount"`
+}
+
+// What is wrong with l, if anything
+func (l *StorageLayout) Validate() error {
+	if len(l.Disks) == 0 {
+		return errors.New("no disks")
+	}
+	mounts := make(map[string]bool)
+	checkFilesystem := func(name string, filesystem string, mount string) error {
+		if !layoutFilesystems[filesystem] {
+			return fmt.Errorf("%s: unknown filesystem %q", name, filesystem)
+		}
+		if filesystem == "swap" || filesystem == "bios_grub" {
+			if mount != "" {
+				return fmt.Errorf("%s: %s can't be mounted", name, filesystem)
+			}
+			return nil
+		}
+		if !strings.HasPrefix(mount, "/") {
+			return fmt.Errorf("%s: mount %q isn't an absolute path", name, mount)
+		}
+		if mounts[mount] {
+			return fmt.Errorf("%s: %s is mounted twice", name, mount)
+		}
+		mounts[mount] = true
+		return nil
+	}
+
+	groups := make(map[string]bool)
+	for _, vg := range l.VolumeGroups {
+		if vg.Name == "" || groups[vg.Name] {
+			return fmt.Errorf("volume group %q: missing or duplicate name", vg.Name)
+		}
+		groups[vg.Name] = true
+	}
+	used := make(map[string]bool)
+	for _, d := range l.Disks {
+		if d.Device == "" {
+			return errors.New("disk without a device")
+		}
+		if d.Table != "" && d.Table != "gpt" && d.Table != "msdos" {
+			return fmt.Errorf("%s: unknown partition table %q", d.Device, d.Table)
+		}
+		if len(d.Partitions) == 0 {
+			return fmt.Errorf("%s: no partitions", d.Device)
+		}
+		for i, p := range d.Partitions {
+			name := fmt.Sprintf("%s partition %d", d.Device, i+1)
+			if p.SizeMB < 0 || (p.SizeMB == 0 && i != len(d.Partitions)-1) {
+				return fmt.Errorf("%s: only the last partition can fill the disk", name)
+			}
+			if p.VolumeGroup != "" {
+				if p.Filesystem != "" || p.Mount != "" {
+					return fmt.Errorf("%s: a physical volume has no filesystem of its own", name)
+				}
+				if !groups[p.VolumeGroup] {
+					return fmt.Errorf("%s: unknown volume group %q", name, p.VolumeGroup)
+				}
+				used[p.VolumeGroup] = true
+				continue
+			}
+			if err := checkFilesystem(name, p.Filesystem, p.Mount); err != nil {
+				return err
+			}
+		}
+	}
+	for _, vg := range l.VolumeGroups {
+		if !used[vg.Name] {
+			return fmt.Errorf("volume group %s: no physical volumes", vg.Name)
+		}
+		for i, lv := range vg.LogicalVolumes {
+			name := fmt.Sprintf("logical volume %s/%s", vg.Name, lv.Name)
+			if lv.Name == "" {
+				return fmt.Errorf("volume group %s: logical volume %d has no name", vg.Name, i+1)
+			}
+			if lv.SizeMB < 0 || (lv.SizeMB == 0 && i != len(vg.LogicalVolumes)-1) {
+				return fmt.Errorf("%s: only the last logical volume can fill the volume group", name)
+			}
+			if lv.Filesystem == "bios_grub" {
+				return fmt.Errorf("%s: bios_grub has to be a partition", name)
+			}
+			if err := checkFilesystem(name, lv.Filesystem, lv.Mount); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (d DiskLayout) table() string {
+	if d.Table == "" {
+		return "gpt"
+	}
+	return d.Table
+}
+
+// A partman-auto expert recipe and the lines that go with it. partman
+// recipes describe a single disk.
+func (l *StorageLayout) Partman() (string, error) {
+	if l == nil {
+		return "", errNoStorageLayout
+	}
+	if len(l.Disks) != 1 {
+		return "", fmt.Errorf("partman recipes cover one disk, the storage section has %d", len(l.Disks))
+	}
+	d := l.Disks[0]
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "d-i partman-auto/disk string %s\n", d.Device)
+	if len(l.VolumeGroups) > 0 {
+		b.WriteString("d-i partman-auto/method string lvm\n")
+		b.WriteString("d-i partman-auto-lvm/guided_size string max\n")
+		b.WriteString("d-i partman-lvm/device_remove_lvm boolean true\n")
+		b.WriteString("d-i partman-lvm/confirm boolean true\n")
+		b.WriteString("d-i partman-lvm/confirm_nooverwrite boolean true\n")
+	} else {
+		b.WriteString("d-i partman-auto/method string regular\n")
+	}
+	fmt.Fprintf(&b, "d-i partman-partitioning/choose_label select %s\n", d.table())
+	fmt.Fprintf(&b, "d-i partman-partitioning/default_label string %s\n", d.table())
+	b.WriteString("d-i partman-auto/choose_recipe select waitron\n")
+	b.WriteString("d-i partman-auto/expert_recipe string waitron ::")
+
+	size := func(mb int) string {
+		if mb == 0 {
+			return "1024 1024 -1"
+		}
+		return fmt.Sprintf("%d %d %d", mb, mb, mb)
+	}
+	// The filesystem partman knows it as and how it is set up
+	filesystem := func(filesystem string, mount string) (string, string) {
+		switch {
+		case filesystem == "swap":
+			return "linux-swap", "method{ swap } format{ }"
+		case filesystem == "vfat" && mount == "/boot/efi":
+			return "fat32", "method{ efi } format{ }"
+		case filesystem == "vfat":
+			filesystem = "fat32"
+		}
+		return filesystem, fmt.Sprintf("method{ format } format{ } use_filesystem{ } filesystem{ %s } mountpoint{ %s }", filesystem, mount)
+	}
+	for _, p := range d.Partitions {
+		b.WriteString(" \\\n    ")
+		switch {
+		case p.Filesystem == "bios_grub":
+			fmt.Fprintf(&b, "%s free $bios_boot{ } method{ biosgrub } .", size(p.SizeMB))
+		case p.VolumeGroup != "":
+			fmt.Fprintf(&b, "%s ext4 $defaultignore{ } $primary{ } method{ lvm } vg_name{ %s } .", size(p.SizeMB), p.VolumeGroup)
+		default:
+			fs, setup := filesystem(p.Filesystem, p.Mount)
+			fmt.Fprintf(&b, "%s %s $primary{ } %s .", size(p.SizeMB), fs, setup)
+		}
+	}
+	for _, vg := range l.VolumeGroups {
+		for _, lv := range vg.LogicalVolumes {
+			fs, setup := filesystem(lv.Filesystem, lv.Mount)
+			fmt.Fprintf(&b, " \\\n    %s %s $lvmok{ } in_vg{ %s } lv_name{ %s } %s .", size(lv.SizeMB), fs, vg.Name, lv.Name, setup)
+		}
+	}
+	b.WriteString("\n")
+	return b.String(), nil
+}
+
+// Kickstart lines that clear the disks and lay them out
+func (l *StorageLayout) Kickstart() (string, error) {
+	if l == nil {
+		return "", errNoStorageLayout
+	}
+	var drives []string
+	for _, d := range l.Disks {
+		drives = append(drives, strings.TrimPrefix(d.Device, "/dev/"))
+	}
+
+	var b bytes.Buffer
+	b.WriteString("zerombr\n")
+	fmt.Fprintf(&b, "clearpart --all --initlabel --drives=%s --disklabel=%s\n", strings.Join(drives, ","), l.Disks[0].table())
+	size := func(mb int) string {
+		if mb == 0 {
+			return "--size=1 --grow"
+		}
+		return fmt.Sprintf("--size=%d", mb)
+	}
+	filesystem := func(filesystem string, mount string) string {
+		switch {
+		case filesystem == "swap":
+			return "swap --fstype=swap"
+		case filesystem == "bios_grub":
+			return "biosboot --fstype=biosboot"
+		case filesystem == "vfat" && mount == "/boot/efi":
+			return "/boot/efi --fstype=efi"
+		}
+		return fmt.Sprintf("%s --fstype=%s", mount, filesystem)
+	}
+	pvs := make(map[string][]string)
+	for i, d := range l.Disks {
+		for _, p := range d.Partitions {
+			if p.VolumeGroup != "" {
+				pv := fmt.Sprintf("pv.%s.%d", p.VolumeGroup, len(pvs[p.VolumeGroup])+1)
+				pvs[p.VolumeGroup] = append(pvs[p.VolumeGroup], pv)
+				fmt.Fprintf(&b, "part %s %s --ondisk=%s\n", pv, size(p.SizeMB), drives[i])
+				continue
+			}
+			fmt.Fprintf(&b, "part %s %s --ondisk=%s\n", filesystem(p.Filesystem, p.Mount), size(p.SizeMB), drives[i])
+		}
+	}
+	for _, vg := range l.VolumeGroups {
+		fmt.Fprintf(&b, "volgroup %s %s\n", vg.Name, strings.Join(pvs[vg.Name], " "))
+		for _, lv := range vg.LogicalVolumes {
+			fmt.Fprintf(&b, "logvol %s --vgname=%s --name=%s %s\n", filesystem(lv.Filesystem, lv.Mount), vg.Name, lv.Name, size(lv.SizeMB))
+		}
+	}
+	return b.String(), nil
+}
+
+// A curtin storage section, which autoinstall takes as is, with every line
+// indented by indent spaces
+func (l *StorageLayout) Curtin(indent int) (string, error) {
+	if l == nil {
+		return "", errNoStorageLayout
+	}
+	var b bytes.Buffer
+	prefix := strings.Repeat(" ", indent)
+	fmt.Fprintf(&b, "%sstorage:\n%s  version: 1\n%s  config:\n", prefix, prefix, prefix)
+	entry := func(fields ...string) {
+		fmt.Fprintf(&b, "%s  - {%s}\n", prefix, strings.Join(fields, ", "))
+	}
+	size := func(mb int) string {
+		if mb == 0 {
+			return "size: -1"
+		}
+		return fmt.Sprintf("size: %dM", mb)
+	}
+	filesystem := func(id string, volume string, filesystem string, mount string) {
+		switch filesystem {
+		case "bios_grub":
+			return
+		case "vfat":
+			filesystem = "fat32"
+		case "swap":
+			mount = "none"
+		}
+		entry("type: format", "id: "+id+"-format", "volume: "+volume, "fstype: "+filesystem)
+		entry("type: mount", "id: "+id+"-mount", "device: "+id+"-format", "path: "+mount)
+	}
+
+	pvs := make(map[string][]string)
+	for _, d := range l.Disks {
+		disk := "disk-" + strings.Replace(strings.TrimPrefix(d.Device, "/dev/"), "/", "-", -1)
+		bios := false
+		for _, p := range d.Partitions {
+			bios = bios || p.Filesystem == "bios_grub"
+		}
+		fields := []string{"type: disk", "id: " + disk, "path: " + d.Device, "ptable: " + d.table(), "wipe: superblock-recursive", "preserve: false"}
+		if bios {
+			fields = append(fields, "grub_device: true")
+		}
+		entry(fields...)
+		for i, p := range d.Partitions {
+			id := fmt.Sprintf("%s-part%d", disk, i+1)
+			fields := []string{"type: partition", "id: " + id, "device: " + disk, fmt.Sprintf("number: %d", i+1), size(p.SizeMB)}
+			switch {
+			case p.Filesystem == "bios_grub":
+				fields = append(fields, "flag: bios_grub")
+			case p.Filesystem == "vfat" && p.Mount == "/boot/efi":
+				fields = append(fields, "flag: boot", "grub_device: true")
+			case p.Filesystem == "swap":
+				fields = append(fields, "flag: swap")
+			}
+			entry(fields...)
+			if p.VolumeGroup != "" {
+				pvs[p.VolumeGroup] = append(pvs[p.VolumeGroup], id)
+				continue
+			}
+			filesystem(id, id, p.Filesystem, p.Mount)
+		}
+	}
+	for _, vg := range l.VolumeGroups {
+		group := "vg-" + vg.Name
+		entry("type: lvm_volgroup", "id: "+group, "name: "+vg.Name, "devices: ["+strings.Join(pvs[vg.Name], ", ")+"]")
+		for _, lv := range vg.LogicalVolumes {
+			id := fmt.Sprintf("lv-%s-%s", vg.Name, lv.Name)
+			fields := []string{"type: lvm_partition", "id: " + id, "name: " + lv.Name, "volgroup: " + group}
+			if lv.SizeMB > 0 {
+				// Without a size it takes the rest of the volume group
+				fields = append(fields, size(lv.SizeMB))
+			}
+			entry(fields...)
+			filesystem(id, id, lv.Filesystem, lv.Mount)
+		}
+	}
+	return b.String(), nil
+}
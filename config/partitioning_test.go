@@ -0,0 +1,119 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func testStorageLayout() *StorageLayout {
+	return &StorageLayout{
+		Disks: []DiskLayout{{Device: "/dev/sda", Partitions: []Partition{
+			{SizeMB: 1, Filesystem: "bios_grub"},
+			{SizeMB: 512, Filesystem: "vfat", Mount: "/boot/efi"},
+			{SizeMB: 1024, Filesystem: "ext4", Mount: "/boot"},
+			{VolumeGroup: "vg0"},
+		}}},
+		VolumeGroups: []VolumeGroup{{Name: "vg0", LogicalVolumes: []LogicalVolume{
+			{Name: "root", SizeMB: 20480, Filesystem: "xfs", Mount: "/"},
+			{Name: "swap", SizeMB: 4096, Filesystem: "swap"},
+			{Name: "var", Filesystem: "xfs", Mount: "/var"},
+		}}},
+	}
+}
+
+func TestStorageLayoutValidate(t *testing.T) {
+	if err := testStorageLayout().Validate(); err != nil {
+		t.Fatal(err)
+	}
+	for problem, change := range map[string]func(l *StorageLayout){
+		"only the last partition": func(l *StorageLayout) { l.Disks[0].Partitions[2].SizeMB = 0 },
+		"unknown volume group":    func(l *StorageLayout) { l.Disks[0].Partitions[3].VolumeGroup = "vg1" },
+		"no physical volumes":     func(l *StorageLayout) { l.Disks[0].Partitions = l.Disks[0].Partitions[:3] },
+		"unknown filesystem":      func(l *StorageLayout) { l.Disks[0].Partitions[2].Filesystem = "zfs" },
+		"mounted twice":           func(l *StorageLayout) { l.VolumeGroups[0].LogicalVolumes[2].Mount = "/boot" },
+		"can't be mounted":        func(l *StorageLayout) { l.VolumeGroups[0].LogicalVolumes[1].Mount = "/swap" },
+		"isn't an absolute path":  func(l *StorageLayout) { l.VolumeGroups[0].LogicalVolumes[0].Mount = "" },
+	} {
+		l := testStorageLayout()
+		change(l)
+		if err := l.Validate(); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q, got %v", problem, err)
+		}
+	}
+}
+
+func TestStorageLayoutRender(t *testing.T) {
+	l := testStorageLayout()
+
+	partman, err := l.Partman()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"d-i partman-auto/disk string /dev/sda\n",
+		"d-i partman-auto/method string lvm\n",
+		"d-i partman-partitioning/choose_label select gpt\n",
+		"    1 1 1 free $bios_boot{ } method{ biosgrub } . \\\n",
+		"    512 512 512 fat32 $primary{ } method{ efi } format{ } . \\\n",
+		"    1024 1024 1024 ext4 $primary{ } method{ format } format{ } use_filesystem{ } filesystem{ ext4 } mountpoint{ /boot } . \\\n",
+		"    1024 1024 -1 ext4 $defaultignore{ } $primary{ } method{ lvm } vg_name{ vg0 } . \\\n",
+		"    4096 4096 4096 linux-swap $lvmok{ } in_vg{ vg0 } lv_name{ swap } method{ swap } format{ } . \\\n",
+		"    1024 1024 -1 xfs $lvmok{ } in_vg{ vg0 } lv_name{ var } method{ format } format{ } use_filesystem{ } filesystem{ xfs } mountpoint{ /var } .\n",
+	} {
+		if !strings.Contains(partman, line) {
+			t.Errorf("expected %q in the partman recipe\n%s", line, partman)
+		}
+	}
+
+	kickstart, err := l.Kickstart()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `zerombr
+clearpart --all --initlabel --drives=sda --disklabel=gpt
+part biosboot --fstype=biosboot --size=1 --ondisk=sda
+part /boot/efi --fstype=efi --size=512 --ondisk=sda
+part /boot --fstype=ext4 --size=1024 --ondisk=sda
+part pv.vg0.1 --size=1 --grow --ondisk=sda
+volgroup vg0 pv.vg0.1
+logvol / --fstype=xfs --vgname=vg0 --name=root --size=20480
+logvol swap --fstype=swap --vgname=vg0 --name=swap --size=4096
+logvol /var --fstype=xfs --vgname=vg0 --name=var --size=1 --grow
+`
+	if kickstart != expected {
+		t.Errorf("unexpected kickstart lines\n%s", kickstart)
+	}
+
+	curtin, err := l.Curtin(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"  storage:\n    version: 1\n    config:\n",
+		"    - {type: disk, id: disk-sda, path: /dev/sda, ptable: gpt, wipe: superblock-recursive, preserve: false, grub_device: true}\n",
+		"    - {type: partition, id: disk-sda-part1, device: disk-sda, number: 1, size: 1M, flag: bios_grub}\n",
+		"    - {type: format, id: disk-sda-part2-format, volume: disk-sda-part2, fstype: fat32}\n",
+		"    - {type: mount, id: disk-sda-part2-mount, device: disk-sda-part2-format, path: /boot/efi}\n",
+		"    - {type: partition, id: disk-sda-part4, device: disk-sda, number: 4, size: -1}\n",
+		"    - {type: lvm_volgroup, id: vg-vg0, name: vg0, devices: [disk-sda-part4]}\n",
+		"    - {type: lvm_partition, id: lv-vg0-root, name: root, volgroup: vg-vg0, size: 20480M}\n",
+		"    - {type: mount, id: lv-vg0-swap-mount, device: lv-vg0-swap-format, path: none}\n",
+		"    - {type: lvm_partition, id: lv-vg0-var, name: var, volgroup: vg-vg0}\n",
+	} {
+		if !strings.Contains(curtin, line) {
+			t.Errorf("expected %q in the curtin config\n%s", line, curtin)
+		}
+	}
+	if strings.Contains(curtin, "disk-sda-part1-format") {
+		t.Errorf("expected no filesystem on the bios_grub partition\n%s", curtin)
+	}
+
+	l.Disks = append(l.Disks, DiskLayout{Device: "/dev/sdb", Partitions: []Partition{{Filesystem: "xfs", Mount: "/srv"}}})
+	if _, err := l.Partman(); err == nil {
+		t.Error("expected partman to refuse more than one disk")
+	}
+	var none *StorageLayout
+	if _, err := none.Kickstart(); err != errNoStorageLayout {
+		t.Errorf("expected an error without a storage section, got %v", err)
+	}
+}
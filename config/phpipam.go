@@ -0,0 +1,12 @@
+package config
+
+// PHPIPAMConfig is access to the phpIPAM API
+type PHPIPAMConfig struct {
+	// e.g. https://phpipam.example.com
+	URL string `yaml:"url"`
+	// The API app id
+	App string `yaml:"app"`
+	// The app code, a secret reference, see secrets.go, PHPIPAM_TOKEN when
+	// unset
+	Token string `yaml:"token"`
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Plugins are executables in PluginPath speaking JSON on stdin and stdout.
+// Each invocation gets one PluginRequest and must answer with one
+// pluginResponse. Version is bumped on incompatible protocol changes.
+const pluginProtocolVersion = 1
+
+const pluginCallTimeout = 10 * time.Second
+
+type PluginRequest struct {
+	Version  int
+	Action   string
+	Stage    string `json:",omitempty"`
+	Hostname string `json:",omitempty"`
+	// mac
+	MacAddress string          `json:",omitempty"`
+	RequestID  string          `json:",omitempty"`
+	Requester  string          `json:",omitempty"`
+	Machine    json.RawMessage `json:",omitempty"`
+}
+
+type pluginResponse struct {
+	Error string `json:",omitempty"`
+
+	// info
+	Name  string   `json:",omitempty"`
+	Types []string `json:",omitempty"`
+
+	// hook
+	Output string `json:",omitempty"`
+
+	// machine: whether the plugin knows the host, and its definition using
+	// the same field names as the machine YAML
+	Found   bool            `json:",omitempty"`
+	Machine json.RawMessage `json:",omitempty"`
+
+	// mac: the hostname of the machine with the MAC address, when Found
+	Hostname string `json:",omitempty"`
+}
+
+// Plugin is a discovered, healthy plugin
+type Plugin struct {
+	Name  string
+	Path  string
+	Types []string
+}
+
+func (p *Plugin) HasType(t string) bool {
+	for _, pt := range p.Types {
+		if pt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Plugin) Call(ctx context.Context, req PluginRequest) (pluginResponse, error) {
+	var resp pluginResponse
+
+	req.Version = pluginProtocolVersion
+	input, err := json.Marshal(&req)
+	if err != nil {
+		return resp, err
+	}
+
+	stderr := NewLimitedBuffer()
+	cmd := exec.CommandContext(ctx, p.Path)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stderr = stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		return resp, fmt.Errorf("plugin %s: %s: %s", p.Name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return resp, fmt.Errorf("plugin %s: invalid response: %s", p.Name, err)
+	}
+	if resp.Error != "" {
+		return resp, fmt.Errorf("plugin %s: %s", p.Name, resp.Error)
+	}
+	return resp, nil
+}
+
+func (p *Plugin) CallWithTimeout(req PluginRequest) (pluginResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), pluginCallTimeout)
+	defer cancel()
+	return p.Call(ctx, req)
+}
+
+func (c Config) Plugin(name string, pluginType string) (*Plugin, error) {
+	for _, p := range c.Plugins {
+		if p.Name == name {
+			if !p.HasType(pluginType) {
+				return nil, fmt.Errorf("plugin %s is not a %s plugin", name, pluginType)
+			}
+			return p, nil
+		}
+	}
+	return nil, errors.New("no such plugin " + name)
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/flosch/pongo2"
+)
+
+// Brand-new hardware usually boots before anybody wrote its definition. With
+// default_profile, PUT /build/{hostname} for a hostname nothing defines
+// builds it with the profile's definition in place of the machine file, and
+// with boot_unknown set pixiecore asking about a MAC address no definition
+// has gets a build started for it too. The group and the config still apply.
+// Machines built this way have machine.DefaultProfile set, which templates
+// can use to fall back to DHCP.
+
+const defaultProfileHostname = "unknown-{{ mac }}"
+
+// Named build profiles work the other way around: each is a definition,
+// usually an operating system with its images, templates and flags, that
+// PUT /build/{hostname}?profile=<name> merges over the machine's, for that
+// build only. A host can be reinstalled with another OS without editing its
+// file first. Machines built this way have machine.Profile set.
+
+// DefaultProfileConfig is how machines nothing defines are built
+type DefaultProfileConfig struct {
+	// Start builds for MAC addresses pixiecore asks about that no definition
+	// knows
+	BootUnknown bool `yaml:"boot_unknown"`
+
+	// Hostname for those, rendered with mac, in which : is replaced by -
+	Hostname string `yaml:"hostname"`
+
+	// Used as the machine definition
+	Definition map[string]interface{} `yaml:"definition"`
+}
+
+func (p *DefaultProfileConfig) HostnameFor(mac string) (string, error) {
+	hostname := p.Hostname
+	if hostname == "" {
+		hostname = defaultProfileHostname
+	}
+	tpl, err := pongo2.FromString(hostname)
+	if err != nil {
+		return "", err
+	}
+	return tpl.Execute(pongo2.Context{"mac": strings.Replace(strings.ToLower(mac), ":", "-", -1)})
+}
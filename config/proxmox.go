@@ -0,0 +1,18 @@
+package config
+
+// ProxmoxConfig is access to the Proxmox VE API
+type ProxmoxConfig struct {
+	// e.g. https://pve1.example.com:8006
+	URL string `yaml:"url"`
+	// user@realm!name and its secret, secret references, see secrets.go,
+	// PROXMOX_TOKEN_ID and PROXMOX_TOKEN_SECRET when unset
+	TokenID     string `yaml:"token_id"`
+	TokenSecret string `yaml:"token_secret"`
+	// PEM file with the CA of the API's certificate, which Proxmox signs
+	// itself by default
+	CAFile string `yaml:"ca_file"`
+	// Where new disks are made when the VM doesn't say, local-lvm by default
+	Storage string `yaml:"storage"`
+	// For NICs of VMs without a virt_network, vmbr0 by default
+	Bridge string `yaml:"bridge"`
+}
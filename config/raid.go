@@ -0,0 +1,32 @@
+package config
+
+type RAIDConfig struct {
+	ImageURL string `yaml:"image_url"`
+	Kernel   string `yaml:"kernel"`
+	Initrd   string `yaml:"initrd"`
+	Cmdline  string `yaml:"cmdline"`
+
+	// perccli, storcli or ssacli
+	Controller string `yaml:"controller"`
+	// The controller's number for perccli and storcli, its slot for ssacli
+	ControllerID int         `yaml:"controller_id"`
+	Arrays       []RAIDArray `yaml:"arrays"`
+
+	// Rendered instead of the script for controller when set
+	Template string `yaml:"template"`
+
+	TimeoutSeconds int `yaml:"timeout_secs"`
+}
+
+// RAIDArray is a virtual disk to create
+type RAIDArray struct {
+	Name  string `yaml:"name"`
+	Level string `yaml:"level"`
+	// In the controller's syntax, e.g. 32:0-1 for perccli and storcli or
+	// 1I:1:1,1I:1:2 for ssacli
+	Drives string `yaml:"drives"`
+	// The whole drives when 0
+	SizeGB int `yaml:"size_gb"`
+	// Boot from it
+	Boot bool `yaml:"boot"`
+}
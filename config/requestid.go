@@ -0,0 +1,21 @@
+package config
+
+import (
+	"net/http"
+)
+
+type contextKey string
+
+const RequestIDHeader = "X-Request-ID"
+
+const RequestIDKey contextKey = "request-id"
+
+func RequestID(request *http.Request) string {
+	if request == nil {
+		return ""
+	}
+	if id, ok := request.Context().Value(RequestIDKey).(string); ok {
+		return id
+	}
+	return request.Header.Get(RequestIDHeader)
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The resolver fills in what a machine definition leaves out from DNS and
+// LDAP, so data already kept there needn't be repeated in the YAML files:
+//
+//   - the domain of a short hostname, from its canonical name
+//   - the addresses of the first interface with resolve set, from A and AAAA
+//     records, with the prefix and gateway of the subnet they are in
+//   - params from key=value TXT records on the hostname, such as location
+//   - the owner param from the machine's LDAP entry
+//
+// Definitions always win, nothing they set is replaced. An interface on DHCP
+// for a family gets no addresses of it, nor does one outside every subnet, it
+// couldn't be rendered without a prefix. Lookups are cached
+// for cache_secs, failures are logged and retried a little later.
+
+const (
+	DefaultResolverCacheSeconds   = 300
+	DefaultResolverTimeoutSeconds = 5
+	resolverRetryAfter            = 30 * time.Second
+)
+
+// ResolverConfig turns the resolver on
+type ResolverConfig struct {
+	// Look machines up in DNS
+	DNS bool `yaml:"dns"`
+	// address:port of the DNS server to ask, the system resolver when unset
+	Nameserver string `yaml:"nameserver"`
+	// TXT keys to take as params, location when unset
+	TXTKeys []string `yaml:"txt_keys"`
+	// What resolved addresses are configured with
+	Subnets []ResolverSubnet `yaml:"subnets"`
+
+	LDAP *LDAPResolverConfig `yaml:"ldap"`
+
+	CacheSeconds   int `yaml:"cache_secs"`
+	TimeoutSeconds int `yaml:"timeout_secs"`
+}
+
+// ResolverSubnet gives an address resolved from DNS in it a prefix and gateway
+type ResolverSubnet struct {
+	// The subnet in CIDR notation
+	CIDR    string `yaml:"cidr"`
+	Gateway string `yaml:"gateway"`
+}
+
+func ValidateResolver(config ResolverConfig) error {
+	for _, s := range config.Subnets {
+		ip, _, err := net.ParseCIDR(s.CIDR)
+		if err != nil {
+			return fmt.Errorf("resolver subnet: %s", err)
+		}
+		// IPv6 gateways are often link-local, outside the subnet
+		if gateway := net.ParseIP(s.Gateway); s.Gateway != "" && (gateway == nil || (gateway.To4() == nil) != (ip.To4() == nil)) {
+			return fmt.Errorf("resolver subnet %s: invalid gateway %q", s.CIDR, s.Gateway)
+		}
+	}
+	return nil
+}
+
+// LDAPResolverConfig finds a machine's entry and the params to take from it
+type LDAPResolverConfig struct {
+	URL          string `yaml:"url"`
+	BindDN       string `yaml:"bind_dn"`
+	BindPassword string `yaml:"bind_password"`
+	BaseDN       string `yaml:"base_dn"`
+	// Entries are found by attribute == hostname, cn when unset, and
+	// objectClass when it is set
+	Attribute   string `yaml:"attribute"`
+	ObjectClass string `yaml:"object_class"`
+	// Param name to LDAP attribute, owner from owner when unset
+	Params map[string]string `yaml:"params"`
+}
+
+type ResolverEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+type MachineResolver struct {
+	Config  ResolverConfig
+	TTL     time.Duration
+	Timeout time.Duration
+
+	LookupCNAME func(ctx context.Context, host string) (string, error)
+	LookupIP    func(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupTXT   func(ctx context.Context, host string) ([]string, error)
+	LookupLDAP  func(hostname string) (map[string][]string, error)
+
+	mux   sync.Mutex
+	Cache map[string]ResolverEntry
+}
+
+// The cached result of lookup, or a fresh one once it has expired. Failures
+// are cached for resolverRetryAfter so a dead server doesn't slow every
+// request down.
+func (r *MachineResolver) Cached(key string, lookup func() (interface{}, error)) interface{} {
+	r.mux.Lock()
+	e, found := r.Cache[key]
+	r.mux.Unlock()
+	if found && time.Now().Before(e.expires) {
+		return e.value
+	}
+
+	value, err := lookup()
+	e = ResolverEntry{value: value, expires: time.Now().Add(r.TTL)}
+	if err != nil {
+		logger.Warn("cannot resolve machine attributes", "lookup", key, "error", err)
+		e.expires = time.Now().Add(resolverRetryAfter)
+	}
+	r.mux.Lock()
+	r.Cache[key] = e
+	r.mux.Unlock()
+	return value
+}
+
+// DNS failures other than the name not existing
+func DNSFailure(err error) error {
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		return nil
+	}
+	return err
+}
+
+func (r *MachineResolver) Context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), r.Timeout)
+}
+
+// The domain of a short hostname, "" when DNS doesn't know it
+func (r *MachineResolver) Domain(hostname string) string {
+	if !r.Config.DNS {
+		return ""
+	}
+	name, _ := r.Cached("cname:"+hostname, func() (interface{}, error) {
+		ctx, cancel := r.Context()
+		defer cancel()
+		name, err := r.LookupCNAME(ctx, hostname)
+		return strings.TrimSuffix(name, "."), DNSFailure(err)
+	}).(string)
+	if i := strings.Index(name, "."); i >= 0 && strings.EqualFold(name[:i], hostname) {
+		return strings.ToLower(name[i+1:])
+	}
+	return ""
+}
+
+// The most specific subnet ip is in and its prefix length
+func (r *MachineResolver) SubnetOf(ip net.IP) (ResolverSubnet, int, bool) {
+	var subnet ResolverSubnet
+	longest := -1
+	for _, s := range r.Config.Subnets {
+		_, network, err := net.ParseCIDR(s.CIDR)
+		if err != nil || !network.Contains(ip) {
+			continue
+		}
+		if ones, _ := network.Mask.Size(); ones > longest {
+			subnet, longest = s, ones
+		}
+	}
+	return subnet, longest, longest >= 0
+}
+
+// The LDAP entry for hostname, nil when there is none
+func (r *MachineResolver) SearchLDAP(hostname string) (map[string][]string, error) {
+	config := r.Config.LDAP
+	conn, err := dialLDAP(config.URL, r.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.close()
+
+	if config.BindDN != "" {
+		if err := conn.bind(config.BindDN, config.BindPassword); err != nil {
+			return nil, err
+		}
+	}
+	var attributes []string
+	for _, a := range config.Params {
+		attributes = append(attributes, a)
+	}
+	return conn.searchOne(config.BaseDN, config.ObjectClass, config.Attribute, hostname, attributes)
+}
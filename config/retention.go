@@ -0,0 +1,10 @@
+package config
+
+// BuildRetentionConfig limits how many finished build records are kept in
+// the state store, and for how long
+type BuildRetentionConfig struct {
+	MaxRecords    int    `yaml:"max_records"`
+	MaxAgeSeconds int    `yaml:"max_age_secs"`
+	HistoryPath   string `yaml:"history_path"`
+	CheckSeconds  int    `yaml:"check_secs"`
+}
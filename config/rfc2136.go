@@ -0,0 +1,13 @@
+package config
+
+// RFC2136Config is the server dynamic updates are sent to and how they are
+// signed
+type RFC2136Config struct {
+	// host:port, port 53 when left out
+	Server   string `yaml:"server"`
+	TSIGName string `yaml:"tsig_name"`
+	// base64, as in a BIND key statement
+	TSIGSecret string `yaml:"tsig_secret"`
+	// hmac-sha1, hmac-sha256 or hmac-sha512, hmac-sha256 when unset
+	TSIGAlgorithm string `yaml:"tsig_algorithm"`
+}
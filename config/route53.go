@@ -0,0 +1,11 @@
+package config
+
+// Route53Config is access to Route 53, the hosted zones are the ids of the
+// DNS zones. The keys and the session token are secret references, see
+// secrets.go, from the AWS environment variables when unset.
+type Route53Config struct {
+	Endpoint     string `yaml:"endpoint"`
+	AccessKey    string `yaml:"access_key"`
+	SecretKey    string `yaml:"secret_key"`
+	SessionToken string `yaml:"session_token"`
+}
@@ -0,0 +1,277 @@
+package config
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Content in S3, or anything speaking its API such as MinIO, is addressed as
+// s3://bucket/prefix. Requests are signed with AWS signature version 4 using
+// the keys from the config or the standard AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, AWS_SESSION_TOKEN and AWS_REGION environment
+// variables. Listing needs s3:ListBucket, without it S3 answers 403 rather
+// than 404 for missing keys too.
+
+const defaultS3Region = "us-east-1"
+
+// S3Config sets up access to s3:// locations
+type S3Config struct {
+	Region string `yaml:"region"`
+	// e.g. http://minio:9000, addressed path-style. AWS when unset.
+	Endpoint     string `yaml:"endpoint"`
+	AccessKey    string `yaml:"access_key"`
+	SecretKey    string `yaml:"secret_key"`
+	SessionToken string `yaml:"session_token"`
+}
+
+var (
+	s3Mux     sync.Mutex
+	s3Storage *remoteStorage
+)
+
+// Set up s3:// locations, filling in what config leaves out from the environment
+func ConfigureS3(config S3Config) {
+	s3Mux.Lock()
+	defer s3Mux.Unlock()
+	s3Storage = newS3Storage(config)
+}
+
+func currentS3Storage() *remoteStorage {
+	s3Mux.Lock()
+	defer s3Mux.Unlock()
+	if s3Storage == nil {
+		s3Storage = newS3Storage(S3Config{})
+	}
+	return s3Storage
+}
+
+// Fill in the region and credentials config leaves out from the environment
+func AWSFromEnv(config S3Config) S3Config {
+	fromEnv := func(v *string, names ...string) {
+		for _, name := range names {
+			if *v == "" {
+				*v = os.Getenv(name)
+			}
+		}
+	}
+	fromEnv(&config.Region, "AWS_REGION", "AWS_DEFAULT_REGION")
+	fromEnv(&config.AccessKey, "AWS_ACCESS_KEY_ID")
+	fromEnv(&config.SecretKey, "AWS_SECRET_ACCESS_KEY")
+	fromEnv(&config.SessionToken, "AWS_SESSION_TOKEN")
+	if config.Region == "" {
+		config.Region = defaultS3Region
+	}
+	return config
+}
+
+func newS3Storage(config S3Config) *remoteStorage {
+	config = AWSFromEnv(config)
+	config.Endpoint = strings.TrimRight(config.Endpoint, "/")
+
+	r := newRemoteStorage(http.DefaultClient, func(request *http.Request) error {
+		if config.AccessKey == "" {
+			return nil // public bucket
+		}
+		signS3Request(request, config, time.Now())
+		return nil
+	})
+	r.urlFor = func(location string) (string, error) {
+		bucket, key, err := parseS3Location(location)
+		if err != nil {
+			return "", err
+		}
+		return s3URL(config, bucket, key, nil), nil
+	}
+	r.list = func(location string) ([]StorageEntry, error) {
+		return listS3(r, config, location)
+	}
+	return r
+}
+
+func parseS3Location(location string) (string, string, error) {
+	rest := strings.TrimPrefix(location, "s3://")
+	bucket, key := rest, ""
+	if i := strings.Index(rest, "/"); i >= 0 {
+		bucket, key = rest[:i], rest[i+1:]
+	}
+	if bucket == "" {
+		return "", "", fmt.Errorf("no bucket in %s", location)
+	}
+	return bucket, key, nil
+}
+
+func s3URL(config S3Config, bucket string, key string, query url.Values) string {
+	u := url.URL{Scheme: "https", Host: bucket + ".s3." + config.Region + ".amazonaws.com", Path: "/" + key}
+	if config.Endpoint != "" {
+		if e, err := url.Parse(config.Endpoint); err == nil {
+			u.Scheme, u.Host, u.Path = e.Scheme, e.Host, strings.TrimRight(e.Path, "/")+"/"+bucket+"/"+key
+		}
+	}
+	u.RawPath = S3Escape(u.Path, false)
+	u.RawQuery = S3Query(query)
+	return u.String()
+}
+
+// URI encoding the way signature version 4 wants it
+func S3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func S3Query(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var pairs []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			pairs = append(pairs, S3Escape(k, true)+"="+S3Escape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Sign request with signature version 4, covering every header set so far
+func signS3Request(request *http.Request, config S3Config, now time.Time) {
+	SignAWSRequest(request, config, "s3", now)
+}
+
+// Signature version 4 for any AWS service, with credentials and region from
+// config. X-Amz-Content-Sha256 is the payload hash when it is set.
+func SignAWSRequest(request *http.Request, config S3Config, service string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	if request.Header.Get("X-Amz-Content-Sha256") == "" {
+		request.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	}
+	if config.SessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", config.SessionToken)
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for k, v := range request.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		S3Query(request.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		request.Header.Get("X-Amz-Content-Sha256"),
+	}, "\n")
+
+	scope := date + "/" + config.Region + "/" + service + "/aws4_request"
+	sum := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := hmacSHA256([]byte("AWS4"+config.SecretKey), date)
+	key = hmacSHA256(key, config.Region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+config.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+type s3ListResult struct {
+	Contents []struct {
+		Key          string
+		LastModified time.Time
+	}
+	CommonPrefixes []struct {
+		Prefix string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+// The keys and common prefixes directly under location
+func listS3(r *remoteStorage, config S3Config, location string) ([]StorageEntry, error) {
+	bucket, prefix, err := parseS3Location(location)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix = strings.TrimSuffix(prefix, "/") + "/"
+	}
+
+	var entries []StorageEntry
+	query := url.Values{"list-type": {"2"}, "delimiter": {"/"}, "prefix": {prefix}}
+	for {
+		response, err := r.get(s3URL(config, bucket, "", query), "", "")
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListResult
+		if response.StatusCode != http.StatusOK {
+			response.Body.Close()
+			return nil, fmt.Errorf("listing %s: %s", location, response.Status)
+		}
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("listing %s: %s", location, err)
+		}
+
+		for _, c := range result.Contents {
+			if name := strings.TrimPrefix(c.Key, prefix); name != "" {
+				entries = append(entries, StorageEntry{Name: name, ModTime: c.LastModified})
+			}
+		}
+		for _, p := range result.CommonPrefixes {
+			entries = append(entries, StorageEntry{Name: strings.TrimSuffix(strings.TrimPrefix(p.Prefix, prefix), "/"), Dir: true})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		query.Set("continuation-token", result.NextContinuationToken)
+	}
+	if len(entries) == 0 && prefix != "" {
+		// S3 has no directories, an empty prefix is as good as a missing one
+		return nil, NotExist(location)
+	}
+	return entries, nil
+}
@@ -0,0 +1,15 @@
+package config
+
+// Salt can use the machine definitions too: /salt/pillar/{minion} is meant
+// for the http_json ext_pillar and puts what waitron knows about the minion
+// under the waitron key, and /salt/roster lists the machines for salt-ssh.
+// Minion ids are hostnames. How salt-ssh logs in comes from salt_ssh, which
+// can be set in the config, the group and the machine.
+
+// SaltSSHConfig is how salt-ssh logs in to machines in the roster
+type SaltSSHConfig struct {
+	User string `yaml:"user"`
+	Port int    `yaml:"port"`
+	Sudo bool   `yaml:"sudo"`
+	Priv string `yaml:"priv"`
+}
@@ -0,0 +1,184 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// HookSandbox restricts what a script or command hook can do. Running as
+// another user or in a chroot needs waitron to run as root; the wall clock is
+// already bounded by the hook timeout.
+type HookSandbox struct {
+	User   string `yaml:"user"`
+	Chroot string `yaml:"chroot"`
+	Dir    string `yaml:"dir"`
+
+	CPUSeconds int `yaml:"cpu_secs"`
+	MemoryMB   int `yaml:"memory_mb"`
+
+	// Only pass the WAITRON_ variables and those named in KeepEnv instead of
+	// waitron's whole environment
+	CleanEnv bool     `yaml:"clean_env"`
+	KeepEnv  []string `yaml:"keep_env"`
+}
+
+const sandboxPath = "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+func (s *HookSandbox) Env(env []string) []string {
+	if s == nil || !s.CleanEnv {
+		return env
+	}
+
+	keep := map[string]bool{}
+	for _, name := range s.KeepEnv {
+		keep[name] = true
+	}
+
+	clean := []string{}
+	hasPath := false
+	for _, v := range env {
+		name := strings.SplitN(v, "=", 2)[0]
+		if strings.HasPrefix(name, "WAITRON_") || keep[name] {
+			clean = append(clean, v)
+			hasPath = hasPath || name == "PATH"
+		}
+	}
+	if !hasPath {
+		clean = append(clean, sandboxPath)
+	}
+	return clean
+}
+
+// Where script hooks are written, inside the chroot if there is one
+func (s *HookSandbox) TempDir() string {
+	if s == nil || s.Chroot == "" {
+		return "/tmp/"
+	}
+	return path.Join(s.Chroot, "tmp")
+}
+
+// The path of a file written to TempDir as seen by the hook
+func (s *HookSandbox) Path(file string) string {
+	if s == nil || s.Chroot == "" {
+		return file
+	}
+	return path.Join("/", strings.TrimPrefix(file, s.Chroot))
+}
+
+// Where the command name is inside the chroot, looked up in the PATH of env
+// like exec does on the host. Without a chroot it is left to exec.
+func (s *HookSandbox) LookPath(name string, env []string) (string, error) {
+	if s == nil || s.Chroot == "" {
+		return name, nil
+	}
+
+	var candidates []string
+	switch {
+	case path.IsAbs(name):
+		candidates = []string{name}
+	case strings.Contains(name, "/"):
+		candidates = []string{path.Join("/", s.Dir, name)}
+	default:
+		search := strings.TrimPrefix(sandboxPath, "PATH=")
+		for _, v := range s.Env(env) {
+			if strings.HasPrefix(v, "PATH=") {
+				search = strings.TrimPrefix(v, "PATH=")
+			}
+		}
+		for _, dir := range filepath.SplitList(search) {
+			candidates = append(candidates, path.Join("/", dir, name))
+		}
+	}
+
+	for _, candidate := range candidates {
+		// A symlink is followed inside the chroot when the hook starts
+		info, err := os.Lstat(path.Join(s.Chroot, candidate))
+		if err == nil && (info.Mode()&os.ModeSymlink != 0 || (info.Mode().IsRegular() && info.Mode()&0111 != 0)) {
+			return candidate, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in chroot %s", name, s.Chroot)
+}
+
+func (s *HookSandbox) credential() (*syscall.Credential, error) {
+	u, err := user.Lookup(s.User)
+	if err != nil {
+		if u, err = user.LookupId(s.User); err != nil {
+			return nil, fmt.Errorf("unknown sandbox user %s", s.User)
+		}
+	}
+
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}, nil
+}
+
+// Make the open script hook f readable by the sandbox user
+func (s *HookSandbox) Chown(f *os.File) error {
+	if s == nil || s.User == "" {
+		return nil
+	}
+	cred, err := s.credential()
+	if err != nil {
+		return err
+	}
+	return f.Chown(int(cred.Uid), int(cred.Gid))
+}
+
+// Apply the sandbox to c before it is started. Resource limits are set by
+// running the hook through sh with ulimit, which then execs the hook, so with
+// a chroot they need a /bin/sh inside it.
+func (s *HookSandbox) Apply(c *exec.Cmd) error {
+	if s == nil {
+		return nil
+	}
+
+	if c.SysProcAttr == nil {
+		c.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	if s.User != "" {
+		cred, err := s.credential()
+		if err != nil {
+			return err
+		}
+		c.SysProcAttr.Credential = cred
+	}
+	c.SysProcAttr.Chroot = s.Chroot
+
+	c.Dir = s.Dir
+	if c.Dir == "" && s.Chroot != "" {
+		c.Dir = "/"
+	}
+
+	var limits []string
+	if s.CPUSeconds > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -t %d", s.CPUSeconds))
+	}
+	if s.MemoryMB > 0 {
+		limits = append(limits, fmt.Sprintf("ulimit -v %d", s.MemoryMB*1024))
+	}
+	if len(limits) > 0 {
+		if _, err := s.LookPath("/bin/sh", nil); err != nil {
+			return fmt.Errorf("cpu_secs and memory_mb need /bin/sh: %s", err)
+		}
+		script := strings.Join(limits, " && ") + ` && exec "$@"`
+		c.Args = append([]string{"sh", "-c", script, "sh", c.Path}, c.Args[1:]...)
+		c.Path = "/bin/sh"
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSandboxEnv(t *testing.T) {
+	env := []string{"HOME=/root", "SECRET=hunter2", "WAITRON_HOSTNAME=dns02.example.com", "HTTP_PROXY=http://proxy:3128"}
+
+	if got := (*HookSandbox)(nil).Env(env); len(got) != len(env) {
+		t.Errorf("expected no sandbox to keep the environment, got %v", got)
+	}
+
+	s := &HookSandbox{CleanEnv: true, KeepEnv: []string{"HTTP_PROXY"}}
+	got := strings.Join(s.Env(env), " ")
+	expected := "WAITRON_HOSTNAME=dns02.example.com HTTP_PROXY=http://proxy:3128 " + sandboxPath
+	if got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestSandboxChrootPath(t *testing.T) {
+	s := &HookSandbox{Chroot: "/srv/hooks"}
+	if dir := s.TempDir(); dir != "/srv/hooks/tmp" {
+		t.Errorf("unexpected temp dir %s", dir)
+	}
+	if p := s.Path("/srv/hooks/tmp/notify.sh"); p != "/tmp/notify.sh" {
+		t.Errorf("unexpected path inside the chroot %s", p)
+	}
+	if p := (*HookSandbox)(nil).Path("/tmp/notify.sh"); p != "/tmp/notify.sh" {
+		t.Errorf("unexpected path without a sandbox %s", p)
+	}
+}
+
+func TestSandboxChrootLookPath(t *testing.T) {
+	root, _ := ioutil.TempDir("", "waitron-chroot")
+	defer os.RemoveAll(root)
+	os.MkdirAll(filepath.Join(root, "usr/local/bin"), 0755)
+	ioutil.WriteFile(filepath.Join(root, "usr/local/bin/register-dns"), []byte("#!/bin/sh\n"), 0755)
+
+	s := &HookSandbox{Chroot: root}
+	env := []string{"PATH=/usr/bin:/usr/local/bin"}
+	if p, err := s.LookPath("register-dns", env); err != nil || p != "/usr/local/bin/register-dns" {
+		t.Errorf("expected the command inside the chroot, got %q %v", p, err)
+	}
+	// bash is on the host, not in the chroot
+	if _, err := s.LookPath("bash", env); err == nil {
+		t.Errorf("expected a command missing from the chroot to fail")
+	}
+	if p, err := (*HookSandbox)(nil).LookPath("bash", env); err != nil || p != "bash" {
+		t.Errorf("expected the name left to exec without a chroot, got %q %v", p, err)
+	}
+
+	s.CPUSeconds = 5
+	if err := s.Apply(exec.Command("/usr/local/bin/register-dns")); err == nil || !strings.Contains(err.Error(), "/bin/sh") {
+		t.Errorf("expected limits to need /bin/sh in the chroot, got %v", err)
+	}
+}
+
+func TestSandboxUnknownUser(t *testing.T) {
+	s := &HookSandbox{User: "no-such-waitron-user"}
+	if err := s.Apply(exec.Command("true")); err == nil {
+		t.Errorf("expected an unknown user to fail")
+	}
+}
@@ -0,0 +1,277 @@
+package config
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Machine, group and VM definitions are checked against a JSON Schema made
+// from the types they are read into, so a misspelt field is reported rather
+// than quietly doing nothing. Field names are the ones yaml.v2 uses: the
+// yaml tag, or the lower cased field name. Like yaml.v2, a string field also
+// takes numbers and booleans. Problems are logged when a definition is
+// loaded and fail the load with strict_definitions; /api/v2/machines refuses
+// to write a definition with problems. GET /schema/machine and
+// GET /schema/vm serve the schemas for tools to check definitions with
+// before submitting them.
+
+const JSONSchemaDraft = "http://json-schema.org/draft-07/schema#"
+
+type JSONSchema struct {
+	Schema     string                 `json:"$schema,omitempty"`
+	Title      string                 `json:"title,omitempty"`
+	Type       string                 `json:"type,omitempty"`
+	Properties map[string]*JSONSchema `json:"properties,omitempty"`
+	// false, or the schema of every value of a map
+	AdditionalProperties interface{}   `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema   `json:"items,omitempty"`
+	AnyOf                []*JSONSchema `json:"anyOf,omitempty"`
+}
+
+// Types with their own UnmarshalYAML say what they take
+type schemaDescriber interface {
+	jsonSchema() *JSONSchema
+}
+
+func NewJSONSchema(title string, t reflect.Type) *JSONSchema {
+	s := schemaFor(t, map[reflect.Type]bool{})
+	s.Schema = JSONSchemaDraft
+	s.Title = title
+	return s
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	describerType = reflect.TypeOf((*schemaDescriber)(nil)).Elem()
+)
+
+// The schema of what yaml.v2 decodes into t. Types already being described
+// further up, which only recursive types run into, take anything.
+func schemaFor(t reflect.Type, seen map[reflect.Type]bool) *JSONSchema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Implements(describerType) {
+		return reflect.Zero(t).Interface().(schemaDescriber).jsonSchema()
+	}
+	if reflect.PtrTo(t).Implements(describerType) {
+		return reflect.New(t).Interface().(schemaDescriber).jsonSchema()
+	}
+	if t == timeType {
+		return &JSONSchema{Type: "string"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return &JSONSchema{Type: "string"}
+	case reflect.Bool:
+		return &JSONSchema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &JSONSchema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &JSONSchema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &JSONSchema{Type: "array", Items: schemaFor(t.Elem(), seen)}
+	case reflect.Map:
+		return &JSONSchema{Type: "object", AdditionalProperties: schemaFor(t.Elem(), seen)}
+	case reflect.Struct:
+		if seen[t] {
+			return &JSONSchema{}
+		}
+		seen[t] = true
+		defer delete(seen, t)
+		s := &JSONSchema{Type: "object", Properties: map[string]*JSONSchema{}, AdditionalProperties: false}
+		addStructFields(s, t, seen)
+		return s
+	}
+	// interface{} and whatever yaml.v2 can't decode into
+	return &JSONSchema{}
+}
+
+func addStructFields(s *JSONSchema, t reflect.Type, seen map[reflect.Type]bool) {
+	for n := 0; n < t.NumField(); n++ {
+		f := t.Field(n)
+		if f.PkgPath != "" {
+			continue // unexported
+		}
+		tag := f.Tag.Get("yaml")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if strings.Contains(tag, ",inline") {
+			ft := f.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				addStructFields(s, ft, seen)
+			} else {
+				s.AdditionalProperties = schemaFor(ft.Elem(), seen)
+			}
+			continue
+		}
+		kind := f.Type.Kind()
+		if kind == reflect.Func || kind == reflect.Chan || (kind == reflect.Interface && f.Type.NumMethod() > 0) {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		s.Properties[name] = schemaFor(f.Type, seen)
+	}
+}
+
+// Problems with value, a decoded YAML or JSON document, sorted
+func (s *JSONSchema) Validate(value interface{}) []string {
+	var problems []string
+	s.check(value, "", &problems)
+	sort.Strings(problems)
+	return problems
+}
+
+func schemaPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func (s *JSONSchema) check(value interface{}, path string, problems *[]string) {
+	if value == nil {
+		return // null leaves the field as it is
+	}
+	at := path
+	if at == "" {
+		at = "the definition"
+	}
+	if len(s.AnyOf) > 0 {
+		for _, alternative := range s.AnyOf {
+			var p []string
+			if alternative.check(value, path, &p); len(p) == 0 {
+				return
+			}
+		}
+		*problems = append(*problems, fmt.Sprintf("%s: %s", at, s.describe()))
+		return
+	}
+
+	fail := func() {
+		*problems = append(*problems, fmt.Sprintf("%s: expected %s, got %s", at, s.Type, schemaValueType(value)))
+	}
+	switch s.Type {
+	case "object":
+		entries, ok := schemaObject(value)
+		if !ok {
+			fail()
+			return
+		}
+		keys := make([]string, 0, len(entries))
+		for k := range entries {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if p, found := s.Properties[k]; found {
+				p.check(entries[k], schemaPath(path, k), problems)
+				continue
+			}
+			switch additional := s.AdditionalProperties.(type) {
+			case *JSONSchema:
+				additional.check(entries[k], schemaPath(path, k), problems)
+			case bool:
+				if !additional {
+					*problems = append(*problems, fmt.Sprintf("%s: unknown field", schemaPath(path, k)))
+				}
+			}
+		}
+	case "array":
+		list, ok := value.([]interface{})
+		if !ok {
+			fail()
+			return
+		}
+		for n, item := range list {
+			s.Items.check(item, fmt.Sprintf("%s[%d]", path, n), problems)
+		}
+	case "string":
+		if _, isObject := schemaObject(value); isObject {
+			fail()
+		} else if _, isList := value.([]interface{}); isList {
+			fail()
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			fail()
+		}
+	case "integer", "number":
+		f, ok := schemaNumber(value)
+		if !ok || (s.Type == "integer" && f != math.Trunc(f)) {
+			fail()
+		}
+	}
+}
+
+func (s *JSONSchema) describe() string {
+	var types []string
+	for _, a := range s.AnyOf {
+		t := a.Type
+		if t == "array" && a.Items != nil && a.Items.Type != "" {
+			t = "array of " + a.Items.Type
+		}
+		types = append(types, t)
+	}
+	return "expected " + strings.Join(types, " or ")
+}
+
+// The keys of a map as yaml.v2 or encoding/json decode it
+func schemaObject(value interface{}) (map[string]interface{}, bool) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, true
+	case map[interface{}]interface{}:
+		entries := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			entries[fmt.Sprint(k)] = e
+		}
+		return entries, true
+	}
+	return nil, false
+}
+
+func schemaNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func schemaValueType(value interface{}) string {
+	if _, ok := schemaObject(value); ok {
+		return "object"
+	}
+	switch value.(type) {
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	}
+	if _, ok := schemaNumber(value); ok {
+		return "number"
+	}
+	return fmt.Sprintf("%T", value)
+}
@@ -0,0 +1,101 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Credentials that say so can be references to a secret rather than the
+// secret itself, and are read every time they are used so rotated secrets
+// are picked up:
+//
+//	env:NAME               an environment variable
+//	file:/path             a file, without trailing newlines
+//	vault:path#field       a field of a Vault secret, from VAULT_ADDR with VAULT_TOKEN
+//
+// KV version 2 paths include data/, e.g.
+// vault:secret/data/waitron/vsphere#password. Anything else, an empty string
+// included, is the secret itself.
+
+const secretTimeout = 10 * time.Second
+
+var secretClient = &http.Client{Timeout: secretTimeout}
+
+func ResolveSecret(value string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, "env:"):
+		name := strings.TrimPrefix(value, "env:")
+		secret, found := os.LookupEnv(name)
+		if !found {
+			return "", fmt.Errorf("secret %s: %s is not set", value, name)
+		}
+		return secret, nil
+	case strings.HasPrefix(value, "file:"):
+		data, err := ioutil.ReadFile(strings.TrimPrefix(value, "file:"))
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %s", value, err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(value, "vault:"):
+		secret, err := readVaultSecret(strings.TrimPrefix(value, "vault:"))
+		if err != nil {
+			return "", fmt.Errorf("secret %s: %s", value, err)
+		}
+		return secret, nil
+	}
+	return value, nil
+}
+
+func readVaultSecret(reference string) (string, error) {
+	i := strings.LastIndex(reference, "#")
+	if i < 0 {
+		return "", fmt.Errorf("expected path#field")
+	}
+	secretPath, field := strings.Trim(reference[:i], "/"), reference[i+1:]
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", fmt.Errorf("VAULT_ADDR is not set")
+	}
+
+	request, err := http.NewRequest("GET", strings.TrimRight(addr, "/")+"/v1/"+secretPath, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("X-Vault-Token", os.Getenv("VAULT_TOKEN"))
+	response, err := secretClient.Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault answered %s", response.Status)
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&secret); err != nil {
+		return "", err
+	}
+	fields := secret.Data
+	// KV version 2 has the fields under data.data, next to the metadata
+	if inner, ok := fields["data"].(map[string]interface{}); ok {
+		if _, found := fields[field]; !found {
+			fields = inner
+		}
+	}
+	v, found := fields[field]
+	if !found {
+		return "", fmt.Errorf("no field %s", field)
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("field %s isn't a string", field)
+	}
+	return s, nil
+}
@@ -0,0 +1,66 @@
+package config
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-secrets")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "password"), []byte("from-file\n"), 0600)
+
+	vault := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/waitron":
+			io.WriteString(w, `{"data": {"data": {"password": "from-kv2"}, "metadata": {"version": 3}}}`)
+		case "/v1/kv/waitron":
+			io.WriteString(w, `{"data": {"password": "from-kv1", "port": 443}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer vault.Close()
+	os.Setenv("VAULT_ADDR", vault.URL)
+	os.Setenv("VAULT_TOKEN", "s.token")
+	os.Setenv("WAITRON_TEST_SECRET", "from-env")
+	defer os.Unsetenv("VAULT_ADDR")
+	defer os.Unsetenv("VAULT_TOKEN")
+	defer os.Unsetenv("WAITRON_TEST_SECRET")
+
+	for value, expected := range map[string]string{
+		"plain":                              "plain",
+		"":                                   "",
+		"env:WAITRON_TEST_SECRET":            "from-env",
+		"file:" + dir + "/password":          "from-file",
+		"vault:secret/data/waitron#password": "from-kv2",
+		"vault:/kv/waitron#password":         "from-kv1",
+	} {
+		if secret, err := ResolveSecret(value); err != nil || secret != expected {
+			t.Errorf("expected %s to be %q, got %q %v", value, expected, secret, err)
+		}
+	}
+
+	for value, problem := range map[string]string{
+		"env:WAITRON_TEST_UNSET":   "is not set",
+		"file:" + dir + "/missing": "no such file",
+		"vault:kv/waitron":         "path#field",
+		"vault:kv/waitron#user":    "no field user",
+		"vault:kv/waitron#port":    "isn't a string",
+		"vault:kv/missing#user":    "404",
+	} {
+		if _, err := ResolveSecret(value); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %s to fail with %s, got %v", value, problem, err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package config
+
+import (
+	"time"
+)
+
+// ServerConfig tunes the HTTP listener. Headers have to arrive within
+// read_header_timeout_secs, which is what stops slowloris style clients from
+// holding connections open. Reading a request body and writing a response
+// are not limited by default, as image uploads and throttled downloads can
+// legitimately take a long time.
+type ServerConfig struct {
+	ReadHeaderTimeoutSeconds int  `yaml:"read_header_timeout_secs"`
+	ReadTimeoutSeconds       int  `yaml:"read_timeout_secs"`
+	WriteTimeoutSeconds      int  `yaml:"write_timeout_secs"`
+	IdleTimeoutSeconds       int  `yaml:"idle_timeout_secs"`
+	MaxHeaderBytes           int  `yaml:"max_header_bytes"`
+	DisableKeepAlives        bool `yaml:"disable_keepalives"`
+
+	// Bind with SO_REUSEPORT so a new waitron can start next to the old one
+	ReusePort bool `yaml:"reuse_port"`
+
+	// How long in-flight requests get to finish on shutdown
+	ShutdownTimeoutSeconds int `yaml:"shutdown_timeout_secs"`
+
+	// Serve HTTPS, which also enables HTTP/2 unless DisableHTTP2 is set
+	TLSCertFile  string `yaml:"tls_cert_file"`
+	TLSKeyFile   string `yaml:"tls_key_file"`
+	DisableHTTP2 bool   `yaml:"disable_http2"`
+
+	// Verify client certificates against these CAs, hosts can call /done
+	// and /cancel with one, see state/hostauth.go
+	TLSClientCAFile string `yaml:"tls_client_ca_file"`
+}
+
+func Seconds(n int, fallback int) time.Duration {
+	if n <= 0 {
+		n = fallback
+	}
+	return time.Duration(n) * time.Second
+}
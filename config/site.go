@@ -0,0 +1,20 @@
+package config
+
+// One config can serve several datacenters. Each of sites has the subnets
+// in it and a definition, usually its mirrors, boot server and file server
+// URLs and DNS servers, that is merged over the machine's whenever a
+// template, cloud-init or pixiecore's boot config is rendered for a request
+// from one of those subnets. The most specific subnet wins. A request from
+// no site, pixiecore asking from a network of its own for example, goes by
+// the machine's lease and addresses instead. The site wins over the
+// definitions, for that request only, and templates see its name as
+// machine.Site.
+
+// SiteConfig is what machines get in one site
+type SiteConfig struct {
+	// The networks of the site, in CIDR notation
+	Subnets []string `yaml:"subnets"`
+
+	// Merged over the machine definition
+	Definition map[string]interface{} `yaml:"definition"`
+}
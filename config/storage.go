@@ -0,0 +1,364 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flosch/pongo2"
+)
+
+// Machine and group definitions and templates are read through a Storage,
+// picked by how templatepath, machinepath and grouppath are written: a local
+// directory, an http:// or https:// URL, or s3://bucket/prefix (see s3.go).
+// Remote content is kept in memory and revalidated with its ETag once it is
+// older than remoteMaxAge, so an unchanged file costs a 304 at most. Listing
+// a directory over HTTP needs a JSON index, e.g. nginx with
+// autoindex_format json.
+
+const (
+	remoteMaxAge        = 5 * time.Second
+	remoteClientTimeout = 30 * time.Second
+)
+
+// Storage is where definitions and templates are read from. Locations are
+// the directory from the config joined with a name, see JoinLocation.
+type Storage interface {
+	// The content at location, an os.IsNotExist error when there is none
+	Read(location string) ([]byte, error)
+
+	// When the content at location last changed
+	ModTime(location string) (time.Time, error)
+
+	// The entries directly under the directory at location
+	List(location string) ([]StorageEntry, error)
+}
+
+// A file or directory in a Storage
+type StorageEntry struct {
+	Name    string
+	ModTime time.Time
+	Dir     bool
+}
+
+var errListingUnsupported = errors.New("the server does not list directories as JSON")
+
+var (
+	localStorage = fileStorage{}
+	httpStorage  = newRemoteStorage(http.DefaultClient, nil)
+)
+
+// The Storage for location
+func StorageFor(location string) Storage {
+	switch {
+	case strings.HasPrefix(location, "s3://"):
+		return currentS3Storage()
+	case strings.HasPrefix(location, "http://"), strings.HasPrefix(location, "https://"):
+		return httpStorage
+	}
+	return localStorage
+}
+
+func IsRemote(location string) bool {
+	return strings.Contains(location, "://")
+}
+
+// Join a location with names, keeping the scheme of URLs intact
+func JoinLocation(base string, elem ...string) string {
+	if i := strings.Index(base, "://"); i >= 0 {
+		return base[:i+3] + path.Join(append([]string{base[i+3:]}, elem...)...)
+	}
+	return path.Join(append([]string{base}, elem...)...)
+}
+
+// The directory location is in
+func ParentLocation(location string) string {
+	if i := strings.Index(location, "://"); i >= 0 {
+		return location[:i+3] + path.Dir(location[i+3:])
+	}
+	return path.Dir(location)
+}
+
+func NotExist(location string) error {
+	return &os.PathError{Op: "get", Path: location, Err: os.ErrNotExist}
+}
+
+// Call fn for every file under the directory at location
+func WalkLocation(location string, fn func(location string) error) error {
+	entries, err := StorageFor(location).List(location)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		p := JoinLocation(location, e.Name)
+		if e.Dir {
+			err = WalkLocation(p, fn)
+		} else {
+			err = fn(p)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether the directory at location can be listed. Plain HTTP servers may not
+// list directories, answering at all is enough for them.
+func CheckLocationReadable(location string) error {
+	if !IsRemote(location) {
+		return CheckPathReadable(location)
+	}
+	if _, err := StorageFor(location).List(location); err != nil && err != errListingUnsupported {
+		return err
+	}
+	return nil
+}
+
+type fileStorage struct{}
+
+func (fileStorage) Read(location string) ([]byte, error) {
+	return ioutil.ReadFile(location)
+}
+
+func (fileStorage) ModTime(location string) (time.Time, error) {
+	info, err := os.Stat(location)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+func (fileStorage) List(location string) ([]StorageEntry, error) {
+	files, err := ioutil.ReadDir(location)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]StorageEntry, 0, len(files))
+	for _, f := range files {
+		entries = append(entries, StorageEntry{Name: f.Name(), ModTime: f.ModTime(), Dir: f.IsDir()})
+	}
+	return entries, nil
+}
+
+// Templates, and whatever they include or extend, load through storage
+type storageLoader struct{}
+
+func (storageLoader) Abs(base string, name string) string {
+	if base == "" || IsRemote(name) || path.IsAbs(name) {
+		return name
+	}
+	return JoinLocation(ParentLocation(base), name)
+}
+
+func (storageLoader) Get(location string) (io.Reader, error) {
+	data, err := StorageFor(location).Read(location)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+var StorageTemplates = pongo2.NewSet("storage", storageLoader{})
+
+// What remoteStorage knows about a location
+type remoteObject struct {
+	data    []byte
+	etag    string
+	modTime time.Time
+	found   bool
+	checked time.Time
+	entries []StorageEntry // when it was listed
+}
+
+// remoteStorage reads over HTTP, with sign adding credentials to requests
+// and urlFor and list covering what differs between backends
+type remoteStorage struct {
+	client *http.Client
+	sign   func(request *http.Request) error
+	urlFor func(location string) (string, error)
+	list   func(location string) ([]StorageEntry, error)
+	maxAge time.Duration
+
+	mux     sync.Mutex
+	objects map[string]*remoteObject
+}
+
+func newRemoteStorage(client *http.Client, sign func(*http.Request) error) *remoteStorage {
+	if client == http.DefaultClient {
+		client = &http.Client{Timeout: remoteClientTimeout}
+	}
+	r := &remoteStorage{
+		client:  client,
+		sign:    sign,
+		urlFor:  func(location string) (string, error) { return location, nil },
+		maxAge:  remoteMaxAge,
+		objects: make(map[string]*remoteObject),
+	}
+	r.list = r.listJSON
+	return r
+}
+
+func (r *remoteStorage) get(u string, etag string, accept string) (*http.Response, error) {
+	request, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept != "" {
+		request.Header.Set("Accept", accept)
+	}
+	if r.sign != nil {
+		if err := r.sign(request); err != nil {
+			return nil, err
+		}
+	}
+	if etag != "" {
+		request.Header.Set("If-None-Match", etag)
+	}
+	return r.client.Do(request)
+}
+
+// The object at location, fetched again or revalidated when it is stale
+func (r *remoteStorage) fetch(location string) (remoteObject, error) {
+	r.mux.Lock()
+	cached, found := r.objects[location]
+	if found && time.Since(cached.checked) < r.maxAge {
+		o := *cached
+		r.mux.Unlock()
+		return o, nil
+	}
+	etag := ""
+	if found && cached.found {
+		etag = cached.etag
+	}
+	r.mux.Unlock()
+
+	u, err := r.urlFor(location)
+	if err != nil {
+		return remoteObject{}, err
+	}
+	response, err := r.get(u, etag, "")
+	if err != nil {
+		return remoteObject{}, err
+	}
+	defer response.Body.Close()
+
+	o := remoteObject{checked: time.Now()}
+	switch response.StatusCode {
+	case http.StatusNotModified:
+		if !found {
+			return remoteObject{}, fmt.Errorf("GET %s: unexpected %s", location, response.Status)
+		}
+		o = *cached
+		o.checked = time.Now()
+	case http.StatusNotFound:
+	case http.StatusOK:
+		if o.data, err = ioutil.ReadAll(response.Body); err != nil {
+			return remoteObject{}, err
+		}
+		o.found = true
+		o.etag = response.Header.Get("ETag")
+		o.modTime = o.checked
+		if t, err := http.ParseTime(response.Header.Get("Last-Modified")); err == nil {
+			o.modTime = t
+		} else if found && cached.found && bytes.Equal(cached.data, o.data) {
+			o.modTime = cached.modTime
+		}
+	default:
+		return remoteObject{}, fmt.Errorf("GET %s: %s", location, response.Status)
+	}
+
+	r.mux.Lock()
+	r.objects[location] = &o
+	r.mux.Unlock()
+	return o, nil
+}
+
+func (r *remoteStorage) Read(location string) ([]byte, error) {
+	o, err := r.fetch(location)
+	if err != nil {
+		return nil, err
+	}
+	if !o.found {
+		return nil, NotExist(location)
+	}
+	return o.data, nil
+}
+
+func (r *remoteStorage) ModTime(location string) (time.Time, error) {
+	o, err := r.fetch(location)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !o.found {
+		return time.Time{}, NotExist(location)
+	}
+	return o.modTime, nil
+}
+
+func (r *remoteStorage) List(location string) ([]StorageEntry, error) {
+	key := strings.TrimSuffix(location, "/") + "/"
+	r.mux.Lock()
+	if cached, found := r.objects[key]; found && time.Since(cached.checked) < r.maxAge {
+		r.mux.Unlock()
+		return cached.entries, nil
+	}
+	r.mux.Unlock()
+
+	entries, err := r.list(location)
+	if err != nil {
+		return nil, err
+	}
+	r.mux.Lock()
+	r.objects[key] = &remoteObject{checked: time.Now(), entries: entries}
+	r.mux.Unlock()
+	return entries, nil
+}
+
+// A directory index in the JSON nginx writes with autoindex_format json
+type JSONIndexEntry struct {
+	Name  string `json:"name"`
+	Type  string `json:"type"`
+	MTime string `json:"mtime"`
+}
+
+func (r *remoteStorage) listJSON(location string) ([]StorageEntry, error) {
+	u, err := r.urlFor(location)
+	if err != nil {
+		return nil, err
+	}
+	response, err := r.get(strings.TrimSuffix(u, "/")+"/", "", "application/json")
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusNotFound:
+		return nil, NotExist(location)
+	case response.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("GET %s/: %s", location, response.Status)
+	case !strings.Contains(response.Header.Get("Content-Type"), "json"):
+		return nil, errListingUnsupported
+	}
+
+	var index []JSONIndexEntry
+	if err := json.NewDecoder(response.Body).Decode(&index); err != nil {
+		return nil, errListingUnsupported
+	}
+	entries := make([]StorageEntry, 0, len(index))
+	for _, e := range index {
+		t, _ := http.ParseTime(e.MTime)
+		entries = append(entries, StorageEntry{Name: e.Name, ModTime: t, Dir: e.Type == "directory"})
+	}
+	return entries, nil
+}
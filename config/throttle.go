@@ -0,0 +1,12 @@
+package config
+
+// FileLimitsConfig caps /files/ so a mass rebuild downloading images doesn't
+// starve the API on the same listener. Zero means no limit. Downloads over a
+// concurrency limit wait up to QueueTimeoutSeconds for a slot, then get a 503.
+type FileLimitsConfig struct {
+	MaxDownloads         int `yaml:"max_downloads"`
+	MaxClientDownloads   int `yaml:"max_client_downloads"`
+	MaxBytesPerSec       int `yaml:"max_bytes_per_sec"`
+	MaxClientBytesPerSec int `yaml:"max_client_bytes_per_sec"`
+	QueueTimeoutSeconds  int `yaml:"queue_timeout_secs"`
+}
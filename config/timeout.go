@@ -0,0 +1,37 @@
+package config
+
+import (
+	"time"
+)
+
+// Routes get a deadline by class: short for status and listing endpoints,
+// long for the ones that render templates or run hooks. A request that has
+// not started answering by its deadline gets a 503 with a JSON body, and the
+// hooks it runs are cut off at the deadline too, so a slow hook can't pile up
+// requests behind it. Streams, downloads and uploads have no deadline.
+
+// RequestTimeoutsConfig sets the deadline per route class, -1 turns it off
+type RequestTimeoutsConfig struct {
+	ShortSeconds int `yaml:"short_secs"`
+	LongSeconds  int `yaml:"long_secs"`
+}
+
+const (
+	defaultShortTimeoutSeconds = 10
+	DefaultLongTimeoutSeconds  = 180
+)
+
+func routeTimeout(n int, fallback int) time.Duration {
+	if n < 0 {
+		return 0
+	}
+	return Seconds(n, fallback)
+}
+
+func (c RequestTimeoutsConfig) Short() time.Duration {
+	return routeTimeout(c.ShortSeconds, defaultShortTimeoutSeconds)
+}
+
+func (c RequestTimeoutsConfig) Long() time.Duration {
+	return routeTimeout(c.LongSeconds, DefaultLongTimeoutSeconds)
+}
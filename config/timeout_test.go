@@ -0,0 +1,17 @@
+package config
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRouteTimeoutDefaults(t *testing.T) {
+	c := RequestTimeoutsConfig{}
+	if c.Short() != defaultShortTimeoutSeconds*time.Second || c.Long() != DefaultLongTimeoutSeconds*time.Second {
+		t.Errorf("unexpected defaults %s %s", c.Short(), c.Long())
+	}
+	c = RequestTimeoutsConfig{ShortSeconds: -1, LongSeconds: 5}
+	if c.Short() != 0 || c.Long() != 5*time.Second {
+		t.Errorf("unexpected timeouts %s %s", c.Short(), c.Long())
+	}
+}
@@ -0,0 +1,21 @@
+package config
+
+type ValidationConfig struct {
+	SSH     bool `yaml:"ssh"`
+	SSHPort int  `yaml:"ssh_port"`
+
+	Callback bool `yaml:"callback"`
+
+	// Regular expression for the kernel the callback reports, implies
+	// callback
+	Kernel string `yaml:"kernel"`
+
+	// Wait for cloud-init's phone_home once the installed system is up
+	PhoneHome bool `yaml:"phone_home"`
+
+	TimeoutSeconds int `yaml:"timeout_secs"`
+}
+
+func (v *ValidationConfig) Enabled() bool {
+	return v != nil && (v.SSH || v.Callback || v.Kernel != "" || v.PhoneHome)
+}
@@ -0,0 +1,18 @@
+package config
+
+// Build metadata, overridden at link time via -ldflags "-X github.com/ns1/waitron/config.Version=..."
+var (
+	Version   = "dev"
+	GitCommit = "unknown"
+	BuildDate = "unknown"
+)
+
+type VersionInfo struct {
+	Version        string
+	GitCommit      string
+	BuildDate      string
+	ConfigChecksum string
+
+	// The commit definitions and templates are served from, see machine/gitrepo.go
+	DefinitionsCommit string `json:",omitempty"`
+}
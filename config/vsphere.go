@@ -0,0 +1,22 @@
+package config
+
+// VSphereConfig is access to vCenter
+type VSphereConfig struct {
+	// e.g. https://vcenter.example.com
+	URL string `yaml:"url"`
+	// Secret references, see secrets.go, VSPHERE_USERNAME and
+	// VSPHERE_PASSWORD when unset
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// PEM file with the CA of vCenter's certificate, the VMCA's by default
+	CAFile string `yaml:"ca_file"`
+	// Where recreated VMs go when the VM doesn't say, the folder is vm,
+	// the datacenter's top one, by default
+	Folder       string `yaml:"folder"`
+	ResourcePool string `yaml:"resource_pool"`
+	Datastore    string `yaml:"datastore"`
+	// Port group for NICs of VMs without a virt_network
+	Network string `yaml:"network"`
+	// For recreated VMs, OTHER_LINUX_64 by default
+	GuestOS string `yaml:"guest_os"`
+}
@@ -0,0 +1,13 @@
+package config
+
+type WipeConfig struct {
+	ImageURL string `yaml:"image_url"`
+	Kernel   string `yaml:"kernel"`
+	Initrd   string `yaml:"initrd"`
+	Cmdline  string `yaml:"cmdline"`
+
+	// How the image is to wipe, e.g. nist-purge, secure-erase or zero
+	Method string `yaml:"method"`
+
+	TimeoutSeconds int `yaml:"timeout_secs"`
+}
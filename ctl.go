@@ -0,0 +1,525 @@
+package waitron
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/server"
+	"gopkg.in/yaml.v2"
+)
+
+// `waitron ctl`, or waitron run as waitronctl, is a client of the API for
+// operators: build, cancel, status, list, logs and watch. Where it connects
+// and with what comes from its flags or a config file,
+// ~/.config/waitron/ctl.yaml unless WAITRONCTL_CONFIG or -config says
+// otherwise:
+//
+//	url: https://waitron.example.com:9091
+//	token: env:WAITRON_ADMIN_TOKEN
+//
+// The token, one of admin_tokens, can be a secret reference, see config/secrets.go.
+// It is sent as a bearer token. Answers are printed as tables, or with
+// -o json as the API gave them.
+
+const (
+	defaultCtlURL     = "http://localhost:9090"
+	ctlRequestTimeout = 5 * time.Minute
+)
+
+// How often watch asks for the status, replaced in tests
+var ctlPollInterval = 2 * time.Second
+
+var errCtlUsage = errors.New(`usage: waitronctl [-config file] [-url url] [-token token] [-o table|json] <command>
+
+commands:
+  build [-profile name] [-force] [-cmdline params] [-mac address] <hostname>
+  cancel <hostname>
+  status [hostname]
+  list [-selector labels]
+  logs <hostname>
+  watch [hostname]`)
+
+type ctlConfig struct {
+	URL   string `yaml:"url"`
+	Token string `yaml:"token"`
+}
+
+type ctlClient struct {
+	url    string
+	token  string
+	json   bool
+	client *http.Client
+	out    io.Writer
+}
+
+// What the CLI needs of a build in /status
+type ctlBuild struct {
+	Hostname        string
+	Token           string
+	Status          string
+	State           machine.BuildState
+	BuildStart      time.Time
+	ETA             *machine.BuildETA
+	Progress        *machine.BuildProgress
+	ProgressHistory []machine.BuildProgress
+	Transitions     []machine.StateTransition
+	Phases          []machine.BuildPhase
+	HookResults     []machine.HookResult
+}
+
+var ctlCommands = map[string]func(c *ctlClient, args []string) error{
+	"build":  (*ctlClient).build,
+	"cancel": (*ctlClient).cancel,
+	"status": (*ctlClient).status,
+	"list":   (*ctlClient).list,
+	"logs":   (*ctlClient).logs,
+	"watch":  (*ctlClient).watch,
+}
+
+// Run `waitron ctl` with the arguments after ctl, returns the exit code
+func ctlCommand(args []string) int {
+	flags := flag.NewFlagSet("ctl", flag.ContinueOnError)
+	configFile := flags.String("config", "", "Config file with the url and token, ~/.config/waitron/ctl.yaml by default.")
+	baseURL := flags.String("url", "", "URL of waitron's management listener, overrides the config file.")
+	token := flags.String("token", "", "Admin token, overrides the config file.")
+	output := flags.String("o", "table", "Output: table or json.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 || ctlCommands[flags.Arg(0)] == nil || (*output != "table" && *output != "json") {
+		fmt.Fprintln(os.Stderr, errCtlUsage)
+		return 2
+	}
+
+	c, err := newCtlClient(*configFile, *baseURL, *token)
+	if err != nil {
+		logger.Error("cannot set up the client", "error", err)
+		return 2
+	}
+	c.json = *output == "json"
+
+	if err := ctlCommands[flags.Arg(0)](c, flags.Args()[1:]); err != nil {
+		if err == errCtlUsage {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		logger.Error(flags.Arg(0)+" failed", "error", err)
+		return 1
+	}
+	return 0
+}
+
+func newCtlClient(configFile string, baseURL string, token string) (*ctlClient, error) {
+	var config ctlConfig
+	if configFile == "" {
+		configFile = os.Getenv("WAITRONCTL_CONFIG")
+	}
+	explicit := configFile != ""
+	if !explicit {
+		if home, err := os.UserHomeDir(); err == nil {
+			configFile = filepath.Join(home, ".config", "waitron", "ctl.yaml")
+		}
+	}
+	if configFile != "" {
+		data, err := ioutil.ReadFile(configFile)
+		if err != nil && (explicit || !os.IsNotExist(err)) {
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, &config); err != nil {
+			return nil, fmt.Errorf("cannot parse %s: %s", configFile, err)
+		}
+	}
+
+	if baseURL != "" {
+		config.URL = baseURL
+	}
+	if config.URL == "" {
+		config.URL = defaultCtlURL
+	}
+	if token != "" {
+		config.Token = token
+	}
+	secret, err := configpkg.ResolveSecret(config.Token)
+	if err != nil {
+		return nil, err
+	}
+	return &ctlClient{
+		url:    strings.TrimRight(config.URL, "/"),
+		token:  secret,
+		client: &http.Client{Timeout: ctlRequestTimeout},
+		out:    os.Stdout,
+	}, nil
+}
+
+// Make a request to path, returns the response and its body. Anything but
+// a 2xx or 304 is an error with the message the API answered with.
+func (c *ctlClient) request(method string, path string, query url.Values, header http.Header) (*http.Response, []byte, error) {
+	u := c.url + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	request, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.StatusCode != http.StatusNotModified && (response.StatusCode < 200 || response.StatusCode > 299) {
+		return nil, nil, fmt.Errorf("%s %s: %d %s", method, path, response.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return response, body, nil
+}
+
+// Make a request and decode the JSON answer into v
+func (c *ctlClient) call(method string, path string, query url.Values, v interface{}) ([]byte, error) {
+	_, body, err := c.request(method, path, query, nil)
+	if err != nil {
+		return nil, err
+	}
+	if v != nil {
+		if err := json.Unmarshal(body, v); err != nil {
+			return nil, fmt.Errorf("unexpected answer from %s: %s", path, err)
+		}
+	}
+	return body, nil
+}
+
+func (c *ctlClient) printJSON(body []byte) error {
+	_, err := fmt.Fprintln(c.out, strings.TrimSpace(string(body)))
+	return err
+}
+
+func (c *ctlClient) table(header ...string) *tabwriter.Writer {
+	w := tabwriter.NewWriter(c.out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	return w
+}
+
+func ctlTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Local().Format(time.RFC3339)
+}
+
+// The builds in progress, by hostname
+func (c *ctlClient) builds() (map[string]ctlBuild, []byte, error) {
+	builds := make(map[string]ctlBuild)
+	body, err := c.call("GET", "/status", nil, &builds)
+	return builds, body, err
+}
+
+func (c *ctlClient) build(args []string) error {
+	flags := flag.NewFlagSet("build", flag.ContinueOnError)
+	profile := flags.String("profile", "", "Build profile to merge over the machine definition.")
+	force := flags.Bool("force", false, "Cancel a build of the host in progress instead of refusing.")
+	cmdline := flags.String("cmdline", "", "Kernel parameters to add to the cmdline of this build.")
+	mac := flags.String("mac", "", "MAC address of a machine built with the default profile.")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errCtlUsage
+	}
+
+	query := url.Values{}
+	for name, value := range map[string]string{"profile": *profile, "cmdline": *cmdline, "mac": *mac} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if *force {
+		query.Set("force", "true")
+	}
+	var r server.Result
+	body, err := c.call("PUT", "/build/"+url.PathEscape(flags.Arg(0)), query, &r)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(body)
+	}
+	w := c.table("HOSTNAME", "TOKEN")
+	fmt.Fprintf(w, "%s\t%s\n", flags.Arg(0), r.Token)
+	return w.Flush()
+}
+
+func (c *ctlClient) cancel(args []string) error {
+	if len(args) != 1 {
+		return errCtlUsage
+	}
+	builds, _, err := c.builds()
+	if err != nil {
+		return err
+	}
+	b, found := builds[strings.ToLower(args[0])]
+	if !found {
+		return fmt.Errorf("%s is not building", args[0])
+	}
+	body, err := c.call("GET", "/cancel/"+url.PathEscape(b.Hostname)+"/"+url.PathEscape(b.Token), nil, nil)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(body)
+	}
+	_, err = fmt.Fprintf(c.out, "cancelled the build of %s\n", b.Hostname)
+	return err
+}
+
+func (c *ctlClient) status(args []string) error {
+	if len(args) > 1 {
+		return errCtlUsage
+	}
+	builds, body, err := c.builds()
+	if err != nil {
+		return err
+	}
+	var hostnames []string
+	if len(args) == 1 {
+		if _, found := builds[strings.ToLower(args[0])]; !found {
+			return fmt.Errorf("%s is not building", args[0])
+		}
+		hostnames = []string{strings.ToLower(args[0])}
+	} else {
+		for hostname := range builds {
+			hostnames = append(hostnames, hostname)
+		}
+		sort.Strings(hostnames)
+	}
+
+	if c.json {
+		if len(args) == 1 {
+			var all map[string]json.RawMessage
+			json.Unmarshal(body, &all)
+			body = all[hostnames[0]]
+		}
+		return c.printJSON(body)
+	}
+	w := c.table("HOSTNAME", "STATE", "STARTED", "PROGRESS", "ETA")
+	for _, hostname := range hostnames {
+		b := builds[hostname]
+		progress, eta := "-", "-"
+		if b.Progress != nil {
+			progress = fmt.Sprintf("%s %d%%", b.Progress.Phase, b.Progress.Percent)
+		}
+		if b.ETA != nil {
+			eta = ctlTime(b.ETA.Estimated)
+			if b.ETA.Overdue {
+				eta += " (overdue)"
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", b.Hostname, b.State, ctlTime(b.BuildStart), progress, eta)
+	}
+	return w.Flush()
+}
+
+func (c *ctlClient) list(args []string) error {
+	flags := flag.NewFlagSet("list", flag.ContinueOnError)
+	selector := flags.String("selector", "", "Only machines with matching labels, e.g. rack=r12,role!=db.")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 0 {
+		return errCtlUsage
+	}
+
+	query := url.Values{}
+	if *selector != "" {
+		query.Set("selector", *selector)
+	}
+	var entries []machine.InventoryEntry
+	body, err := c.call("GET", "/api/v1/inventory", query, &entries)
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return c.printJSON(body)
+	}
+	w := c.table("HOSTNAME", "MACS", "LABELS")
+	for _, e := range entries {
+		var labels []string
+		for k, v := range e.Labels {
+			labels = append(labels, k+"="+v)
+		}
+		sort.Strings(labels)
+		fmt.Fprintf(w, "%s\t%s\t%s\n", e.Hostname, strings.Join(e.MACs, ","), strings.Join(labels, ","))
+	}
+	return w.Flush()
+}
+
+// What happened in a build, in order
+type ctlLogLine struct {
+	Time    time.Time
+	Kind    string
+	Message string
+}
+
+func (c *ctlClient) logs(args []string) error {
+	if len(args) != 1 {
+		return errCtlUsage
+	}
+	hostname := strings.ToLower(args[0])
+
+	// The build in progress, or else the latest one in the host history
+	builds, _, err := c.builds()
+	if err != nil {
+		return err
+	}
+	b, found := builds[hostname]
+	if !found {
+		var h machine.HostHistory
+		if _, err := c.call("GET", "/history/"+url.PathEscape(hostname), nil, &h); err != nil {
+			return err
+		}
+		if len(h.Entries) == 0 {
+			return fmt.Errorf("%s was never built", hostname)
+		}
+		var record machine.BuildRecord
+		body, err := c.call("GET", "/api/v1/builds/"+url.PathEscape(h.Entries[len(h.Entries)-1].Token), nil, &record)
+		if err != nil {
+			return err
+		}
+		if c.json {
+			return c.printJSON(body)
+		}
+		b = ctlBuild{Transitions: record.Transitions, Phases: record.Phases, HookResults: record.HookResults}
+		if record.Progress != nil {
+			b.ProgressHistory = []machine.BuildProgress{*record.Progress}
+		}
+	} else if c.json {
+		js, _ := json.Marshal(b)
+		return c.printJSON(js)
+	}
+
+	var lines []ctlLogLine
+	for _, t := range b.Transitions {
+		lines = append(lines, ctlLogLine{t.Timestamp, "state", t.Message()})
+	}
+	for _, p := range b.Phases {
+		message := p.Name
+		if p.Message != "" {
+			message += ": " + p.Message
+		}
+		lines = append(lines, ctlLogLine{p.Timestamp, "phase", message})
+	}
+	for _, p := range b.ProgressHistory {
+		lines = append(lines, ctlLogLine{p.Timestamp, "progress", fmt.Sprintf("%s %d%% %s", p.Phase, p.Percent, p.Message)})
+	}
+	for _, r := range b.HookResults {
+		message := fmt.Sprintf("%s %s exit %d", r.Stage, r.Hook, r.ExitCode)
+		if r.Error != "" {
+			message += ": " + r.Error
+		}
+		lines = append(lines, ctlLogLine{r.Started, "hook", message})
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Time.Before(lines[j].Time) })
+
+	w := c.table("TIME", "KIND", "MESSAGE")
+	for _, l := range lines {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", ctlTime(l.Time), l.Kind, strings.TrimSpace(l.Message))
+	}
+	return w.Flush()
+}
+
+// Print every change of state or progress of the builds, or of the build of
+// one host until it leaves build mode
+func (c *ctlClient) watch(args []string) error {
+	if len(args) > 1 {
+		return errCtlUsage
+	}
+	hostname := ""
+	if len(args) == 1 {
+		hostname = strings.ToLower(args[0])
+	}
+
+	seen := make(map[string]string)
+	etag := ""
+	for {
+		header := http.Header{}
+		if etag != "" {
+			header.Set("If-None-Match", etag)
+		}
+		response, body, err := c.request("GET", "/status", nil, header)
+		if err != nil {
+			return err
+		}
+		if response.StatusCode == http.StatusNotModified {
+			time.Sleep(ctlPollInterval)
+			continue
+		}
+		etag = response.Header.Get("ETag")
+		builds := make(map[string]ctlBuild)
+		if err := json.Unmarshal(body, &builds); err != nil {
+			return fmt.Errorf("unexpected answer from /status: %s", err)
+		}
+
+		var hostnames []string
+		for h := range builds {
+			if hostname == "" || h == hostname {
+				hostnames = append(hostnames, h)
+			}
+		}
+		sort.Strings(hostnames)
+		for _, h := range hostnames {
+			b := builds[h]
+			line := string(b.State)
+			if b.Progress != nil {
+				line += fmt.Sprintf(" %s %d%%", b.Progress.Phase, b.Progress.Percent)
+			}
+			if seen[h] == line {
+				continue
+			}
+			seen[h] = line
+			if c.json {
+				js, _ := json.Marshal(b)
+				c.printJSON(js)
+			} else {
+				fmt.Fprintf(c.out, "%s %s %s\n", ctlTime(time.Now()), b.Hostname, line)
+			}
+		}
+
+		var gone []string
+		for h := range seen {
+			if _, found := builds[h]; !found {
+				gone = append(gone, h)
+			}
+		}
+		sort.Strings(gone)
+		for _, h := range gone {
+			delete(seen, h)
+			if !c.json {
+				fmt.Fprintf(c.out, "%s %s left build mode\n", ctlTime(time.Now()), h)
+			}
+		}
+		if hostname != "" && len(hostnames) == 0 {
+			if len(gone) == 0 {
+				return fmt.Errorf("%s is not building", hostname)
+			}
+			return nil
+		}
+		time.Sleep(ctlPollInterval)
+	}
+}
@@ -0,0 +1,109 @@
+package waitron
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCtl(t *testing.T) {
+	polls := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "Invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method + " " + r.URL.Path {
+		case "PUT /build/dns02.example.com":
+			if r.URL.Query().Get("profile") != "noble" || r.URL.Query().Get("force") != "true" {
+				http.Error(w, "unexpected query "+r.URL.RawQuery, http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"State": "OK", "Token": "1234"}`))
+		case "GET /status":
+			polls++
+			if polls > 2 {
+				w.Write([]byte(`{}`))
+				return
+			}
+			w.Write([]byte(`{"dns02.example.com": {"Hostname": "dns02.example.com", "Token": "1234", "State": "installing",
+				"BuildStart": "2026-10-14T10:00:00Z", "Progress": {"Phase": "packages", "Percent": 60},
+				"Transitions": [{"To": "pending", "Timestamp": "2026-10-14T10:00:00Z"}, {"From": "pending", "To": "installing", "Timestamp": "2026-10-14T10:02:00Z"}],
+				"Phases": [{"Name": "preseed-fetched", "Timestamp": "2026-10-14T10:01:00Z"}]}}`))
+		case "GET /cancel/dns02.example.com/1234":
+			w.Write([]byte(`{"State": "OK"}`))
+		case "GET /history/dns02.example.com":
+			w.Write([]byte(`{"Hostname": "dns02.example.com", "Entries": [{"Token": "0999"}, {"Token": "1234"}]}`))
+		case "GET /api/v1/builds/1234":
+			w.Write([]byte(`{"Hostname": "dns02.example.com", "Token": "1234", "Transitions": [{"From": "finishing", "To": "done", "Timestamp": "2026-10-14T10:20:00Z"}],
+				"HookResults": [{"Hook": "notify", "Stage": "done", "ExitCode": 1, "Error": "exit status 1", "Started": "2026-10-14T10:20:01Z"}]}`))
+		case "GET /api/v1/inventory":
+			w.Write([]byte(`[{"Hostname": "dns02.example.com", "MACs": ["de:ad:c0:de:ca:fe"], "Labels": {"rack": "r12", "role": "dns"}}]`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	interval := ctlPollInterval
+	ctlPollInterval = time.Millisecond
+	defer func() { ctlPollInterval = interval }()
+
+	run := func(json bool, command string, args ...string) (string, error) {
+		c, err := newCtlClient("/dev/null", server.URL+"/", "s3cret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out bytes.Buffer
+		c.out, c.json = &out, json
+		err = ctlCommands[command](c, args)
+		return out.String(), err
+	}
+
+	if out, err := run(false, "build", "-profile", "noble", "-force", "dns02.example.com"); err != nil || !strings.Contains(out, "dns02.example.com  1234") {
+		t.Errorf("expected the token of the build, got %q %v", out, err)
+	}
+	if out, err := run(false, "status"); err != nil || !strings.Contains(out, "installing") || !strings.Contains(out, "packages 60%") {
+		t.Errorf("expected the build in the status table, got %q %v", out, err)
+	}
+	if out, err := run(true, "status", "dns02.example.com"); err != nil || !strings.HasPrefix(out, `{"Hostname": "dns02.example.com"`) {
+		t.Errorf("expected the host's status as JSON, got %q %v", out, err)
+	}
+	polls = 0
+	out, err := run(false, "logs", "dns02.example.com")
+	if lines := strings.Split(strings.TrimSpace(out), "\n"); err != nil || len(lines) != 4 || !strings.Contains(lines[2], "preseed-fetched") ||
+		!strings.Contains(lines[3], "pending -> installing") {
+		t.Errorf("expected the build's log in order, got %q %v", out, err)
+	}
+	if out, err := run(false, "list"); err != nil || !strings.Contains(out, "rack=r12,role=dns") {
+		t.Errorf("expected the inventory, got %q %v", out, err)
+	}
+
+	polls = 1
+	if out, err := run(false, "watch", "dns02.example.com"); err != nil || !strings.Contains(out, "installing packages 60%") ||
+		!strings.Contains(out, "dns02.example.com left build mode") {
+		t.Errorf("expected the build to be watched until it left build mode, got %q %v", out, err)
+	}
+	out, err = run(false, "logs", "dns02.example.com")
+	if err != nil || !strings.Contains(out, "finishing -> done") || !strings.Contains(out, "done notify exit 1: exit status 1") {
+		t.Errorf("expected the log of the last build from its record, got %q %v", out, err)
+	}
+	if _, err := run(false, "cancel", "dns02.example.com"); err == nil || !strings.Contains(err.Error(), "not building") {
+		t.Errorf("expected a host that isn't building not to be cancelled, got %v", err)
+	}
+	polls = 0
+	if out, err := run(false, "cancel", "dns02.example.com"); err != nil || !strings.Contains(out, "cancelled") {
+		t.Errorf("expected the build to be cancelled, got %q %v", out, err)
+	}
+
+	c, _ := newCtlClient("/dev/null", server.URL, "wrong")
+	if err := c.status(nil); err == nil || !strings.Contains(err.Error(), "401 Invalid admin token") {
+		t.Errorf("expected the API's error, got %v", err)
+	}
+	if _, err := newCtlClient("/nonexistent/ctl.yaml", "", ""); err == nil {
+		t.Error("expected a config file that was asked for to be required")
+	}
+}
@@ -0,0 +1,264 @@
+package waitron
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/ns1/waitron/machine"
+)
+
+// Reading hosts from Foreman's API v2 for `waitron import`. Interfaces get
+// their netmask and gateway from their subnet, and a host's operating system
+// decides its provision and finish templates.
+
+const foremanPerPage = 100
+
+type foremanSource struct {
+	url      string
+	user     string
+	password string
+	client   *http.Client
+
+	subnets   map[int]foremanSubnet
+	templates map[int]map[string]string
+}
+
+type foremanHost struct {
+	ID                  int    `json:"id"`
+	Name                string `json:"name"`
+	OperatingSystemID   int    `json:"operatingsystem_id"`
+	OperatingSystemName string `json:"operatingsystem_name"`
+	HostgroupTitle      string `json:"hostgroup_title"`
+	EnvironmentName     string `json:"environment_name"`
+}
+
+type foremanInterface struct {
+	Identifier string `json:"identifier"`
+	MAC        string `json:"mac"`
+	IP         string `json:"ip"`
+	IP6        string `json:"ip6"`
+	Primary    bool   `json:"primary"`
+	SubnetID   int    `json:"subnet_id"`
+	Subnet6ID  int    `json:"subnet6_id"`
+	Type       string `json:"type"`
+}
+
+type foremanSubnet struct {
+	ID      int    `json:"id"`
+	Mask    string `json:"mask"`
+	CIDR    int    `json:"cidr"`
+	Gateway string `json:"gateway"`
+}
+
+type foremanParameter struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+}
+
+type foremanTemplate struct {
+	Kind string `json:"template_kind_name"`
+	Name string `json:"provisioning_template_name"`
+}
+
+// One page of a Foreman index
+type foremanPage struct {
+	Subtotal int               `json:"subtotal"`
+	Results  []json.RawMessage `json:"results"`
+}
+
+func (f *foremanSource) get(path string, page int, into interface{}) error {
+	request, err := http.NewRequest("GET", fmt.Sprintf("%s%s?per_page=%d&page=%d", f.url, path, foremanPerPage, page), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Accept", "application/json")
+	if f.user != "" {
+		request.SetBasicAuth(f.user, f.password)
+	}
+	response, err := f.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(into)
+}
+
+// Every result of an index, all pages of it, decoded one by one with add
+func (f *foremanSource) list(path string, add func(json.RawMessage) error) error {
+	for page, seen := 1, 0; ; page++ {
+		var p foremanPage
+		if err := f.get(path, page, &p); err != nil {
+			return err
+		}
+		for _, r := range p.Results {
+			if err := add(r); err != nil {
+				return fmt.Errorf("%s: %s", path, err)
+			}
+		}
+		seen += len(p.Results)
+		if len(p.Results) == 0 || seen >= p.Subtotal {
+			return nil
+		}
+	}
+}
+
+func (f *foremanSource) loadSubnets() error {
+	f.subnets = make(map[int]foremanSubnet)
+	return f.list("/api/v2/subnets", func(r json.RawMessage) error {
+		var s foremanSubnet
+		if err := json.Unmarshal(r, &s); err != nil {
+			return err
+		}
+		f.subnets[s.ID] = s
+		return nil
+	})
+}
+
+// The templates of an operating system by kind, e.g. provision
+func (f *foremanSource) osTemplates(id int) (map[string]string, error) {
+	if t, found := f.templates[id]; found {
+		return t, nil
+	}
+	t := make(map[string]string)
+	err := f.list("/api/v2/operatingsystems/"+strconv.Itoa(id)+"/os_default_templates", func(r json.RawMessage) error {
+		var template foremanTemplate
+		if err := json.Unmarshal(r, &template); err != nil {
+			return err
+		}
+		t[template.Kind] = template.Name
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	f.templates[id] = t
+	return t, nil
+}
+
+func (f *foremanSource) network(host foremanHost) ([]machine.Interface, error) {
+	var primary, others []machine.Interface
+	err := f.list("/api/v2/hosts/"+strconv.Itoa(host.ID)+"/interfaces", func(r json.RawMessage) error {
+		var i foremanInterface
+		if err := json.Unmarshal(r, &i); err != nil {
+			return err
+		}
+		if i.Type == "bmc" {
+			return nil
+		}
+		iface := machine.Interface{Name: i.Identifier, MacAddress: i.MAC}
+		if i.IP != "" {
+			s := f.subnets[i.SubnetID]
+			iface.Addresses4 = []machine.IPConfig{{IPAddress: i.IP, Netmask: s.Mask, Cidr: cidrString(s.CIDR)}}
+			iface.Gateway4 = s.Gateway
+		}
+		if i.IP6 != "" {
+			s := f.subnets[i.Subnet6ID]
+			iface.Addresses6 = []machine.IPConfig{{IPAddress: i.IP6, Netmask: s.Mask, Cidr: cidrString(s.CIDR)}}
+			iface.Gateway6 = s.Gateway
+		}
+		if i.Primary {
+			primary = append(primary, iface)
+		} else {
+			others = append(others, iface)
+		}
+		return nil
+	})
+	return append(primary, others...), err
+}
+
+func (f *foremanSource) params(host foremanHost) (map[string]string, error) {
+	params := make(map[string]string)
+	err := f.list("/api/v2/hosts/"+strconv.Itoa(host.ID)+"/parameters", func(r json.RawMessage) error {
+		var p foremanParameter
+		if err := json.Unmarshal(r, &p); err != nil {
+			return err
+		}
+		params[p.Name] = fmt.Sprint(p.Value)
+		return nil
+	})
+	return params, err
+}
+
+func (f *foremanSource) host(host foremanHost) (importedHost, error) {
+	h := importedHost{
+		Hostname: host.Name,
+		Machine: importedMachine{
+			OperatingSystem: host.OperatingSystemName,
+			Labels:          map[string]string{},
+		},
+		Templates: map[string]string{},
+	}
+	if host.HostgroupTitle != "" {
+		h.Machine.Labels["hostgroup"] = host.HostgroupTitle
+	}
+	if host.EnvironmentName != "" {
+		h.Machine.Puppet = &importedPuppet{Environment: host.EnvironmentName}
+	}
+
+	var err error
+	if h.Machine.Network, err = f.network(host); err != nil {
+		return h, err
+	}
+	if h.Machine.Params, err = f.params(host); err != nil {
+		return h, err
+	}
+
+	if host.OperatingSystemID == 0 {
+		return h, nil
+	}
+	templates, err := f.osTemplates(host.OperatingSystemID)
+	if err != nil {
+		return h, err
+	}
+	if name := templates["provision"]; name != "" {
+		h.Machine.Preseed = stubName(name)
+		h.Templates[h.Machine.Preseed] = fmt.Sprintf("foreman provisioning template %q", name)
+	}
+	if name := templates["finish"]; name != "" {
+		h.Machine.Finish = stubName(name)
+		h.Templates[h.Machine.Finish] = fmt.Sprintf("foreman finish template %q", name)
+	}
+	return h, nil
+}
+
+func (f *foremanSource) hosts() ([]importedHost, error) {
+	f.templates = make(map[int]map[string]string)
+	if err := f.loadSubnets(); err != nil {
+		return nil, err
+	}
+
+	var foremanHosts []foremanHost
+	err := f.list("/api/v2/hosts", func(r json.RawMessage) error {
+		var host foremanHost
+		if err := json.Unmarshal(r, &host); err != nil {
+			return err
+		}
+		foremanHosts = append(foremanHosts, host)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := make([]importedHost, 0, len(foremanHosts))
+	for _, host := range foremanHosts {
+		h, err := f.host(host)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", host.Name, err)
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+func cidrString(bits int) string {
+	if bits == 0 {
+		return ""
+	}
+	return strconv.Itoa(bits)
+}
@@ -1,2 +1,2 @@
 go get github.com/yvasiyarov/swagger
-$GOPATH/bin/swagger -apiPackage="github.com/ns1/waitron" -mainApiFile="github.com/ns1/waitron/main.go" -format="markdown"
+$GOPATH/bin/swagger -apiPackage="github.com/ns1/waitron/server" -mainApiFile="github.com/ns1/waitron/server/main.go" -format="markdown"
@@ -5,6 +5,7 @@ require (
 	github.com/gorilla/handlers v1.4.0
 	github.com/julienschmidt/httprouter v1.2.0
 	github.com/satori/go.uuid v1.2.0
+	golang.org/x/sys v0.0.0-20190412213103-97732733099d
 	gopkg.in/check.v1 v1.0.0-20180628173108-788fd7840127 // indirect
 	gopkg.in/yaml.v2 v2.2.2
 )
@@ -0,0 +1,146 @@
+package hooks
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/state"
+	"github.com/satori/go.uuid"
+)
+
+const DeadLetterBucket = "dead-letter"
+
+var ErrUnknownDeadLetter = errors.New("no such dead letter")
+
+// DeadLetter is a hook that failed every attempt, kept so it can be looked
+// at and replayed once the downstream system is back. The machine is kept as
+// it was at the time so a replay renders the hook the same way.
+type DeadLetter struct {
+	ID        string
+	Hook      config.Hook
+	Stage     string
+	Hostname  string
+	Token     string `json:",omitempty"`
+	RequestID string `json:",omitempty"`
+	Attempts  int
+	LastError string
+	Created   time.Time
+	Replayed  *time.Time `json:",omitempty"`
+	Machine   *machine.Machine
+}
+
+func deadLetterHook(state *state.State, hook config.Hook, m *machine.Machine, hc hookContext, attempts int, err error) {
+	id, uerr := uuid.NewV4()
+	if uerr != nil {
+		logger.Error("cannot dead-letter hook", "hook", hook, "error", uerr)
+		return
+	}
+
+	d := DeadLetter{
+		ID:        id.String(),
+		Hook:      hook,
+		Stage:     hc.Stage,
+		Hostname:  m.Hostname,
+		Token:     m.Token,
+		RequestID: hc.RequestID,
+		Attempts:  attempts,
+		Created:   time.Now(),
+		Machine:   m,
+	}
+	if err != nil {
+		d.LastError = err.Error()
+	}
+
+	hookLogger(hc, m).Warn("dead-lettering hook", "hook", hook, "attempts", attempts, "id", d.ID)
+	if err := state.Store.Put(DeadLetterBucket, d.ID, d); err != nil {
+		logger.Error("cannot store dead letter", "id", d.ID, "error", err)
+	}
+	state.Emit(machine.EventHookDeadLetter, m, fmt.Sprintf("%s hook %s failed %d attempts: %s", hc.Stage, hook, attempts, d.LastError))
+}
+
+// Dead letters, oldest first
+func LoadDeadLetters(store state.Store) ([]DeadLetter, error) {
+	keys, err := store.List(DeadLetterBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	letters := []DeadLetter{}
+	for _, key := range keys {
+		var d DeadLetter
+		found, err := store.Get(DeadLetterBucket, key, &d)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			letters = append(letters, d)
+		}
+	}
+
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Created.Before(letters[j].Created) })
+	return letters, nil
+}
+
+func LoadDeadLetter(store state.Store, id string) (*DeadLetter, error) {
+	var d DeadLetter
+	found, err := store.Get(DeadLetterBucket, id, &d)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrUnknownDeadLetter
+	}
+	return &d, nil
+}
+
+// Run a dead-lettered hook once more. It is removed from the list when it
+// succeeds and kept with the new error when it doesn't.
+func ReplayDeadLetter(state *state.State, id string, config config.Config, hc hookContext) (machine.HookResult, error) {
+	d, err := LoadDeadLetter(state.Store, id)
+	if err != nil {
+		return machine.HookResult{}, err
+	}
+
+	m := d.Machine
+	if m == nil {
+		m = &machine.Machine{Hostname: d.Hostname, Token: d.Token}
+	}
+
+	hc.Stage = d.Stage
+	if hc.RequestID == "" {
+		hc.RequestID = d.RequestID
+	}
+
+	var result machine.HookResult
+	if perr := state.Workers.Run(m.Hostname, func() {
+		result, err = ExecuteHook(d.Hook, m, config, hc)
+	}); perr != nil {
+		result.Error, err = perr.Error(), perr
+	}
+	result.Stage = d.Stage
+	result.Attempt = d.Attempts + 1
+	RecordHookResult(state, m, result)
+
+	if hc.DryRun {
+		return result, err
+	}
+
+	if err == nil {
+		hookLogger(hc, m).Info("replayed hook", "hook", d.Hook, "id", id)
+		return result, state.Store.Delete(DeadLetterBucket, id)
+	}
+
+	now := time.Now()
+	d.Attempts++
+	d.LastError = err.Error()
+	d.Replayed = &now
+	if perr := state.Store.Put(DeadLetterBucket, id, d); perr != nil {
+		logger.Error("cannot store dead letter", "id", id, "error", perr)
+	}
+
+	return result, err
+}
@@ -0,0 +1,8 @@
+// Package hooks runs the hooks of build stages, sandboxed and in the order
+// their dependencies give, and keeps their results. Runner runs them for what
+// a state.State does to builds by itself.
+package hooks
+
+import "github.com/ns1/waitron/config"
+
+var logger = config.Log
@@ -0,0 +1,65 @@
+package hooks
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ns1/waitron/config"
+)
+
+// Run hooks as soon as everything they depend on has succeeded, returning
+// the first error.
+func runHookGraph(hooks []config.Hook, run func(config.Hook) error) error {
+	if err := config.ValidateHookGraph(hooks); err != nil {
+		return err
+	}
+
+	done := map[string]chan struct{}{}
+	errs := map[string]error{}
+	for _, hook := range hooks {
+		done[hook.String()] = make(chan struct{})
+	}
+
+	var mux sync.Mutex
+	var wg sync.WaitGroup
+	var first error
+
+	for _, hook := range hooks {
+		hook := hook
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[hook.String()])
+
+			for _, dep := range hook.DependsOn {
+				<-done[dep]
+			}
+
+			mux.Lock()
+			for _, dep := range hook.DependsOn {
+				if errs[dep] != nil {
+					errs[hook.String()] = fmt.Errorf("skipped, dependency %s failed", dep)
+				}
+			}
+			skipped := errs[hook.String()]
+			mux.Unlock()
+
+			if skipped != nil {
+				logger.Warn("skipping hook", "hook", hook, "reason", skipped)
+				return
+			}
+
+			err := run(hook)
+
+			mux.Lock()
+			errs[hook.String()] = err
+			if err != nil && first == nil {
+				first = err
+			}
+			mux.Unlock()
+		}()
+	}
+
+	wg.Wait()
+	return first
+}
@@ -0,0 +1,68 @@
+package hooks
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+)
+
+func TestRunHookGraph(t *testing.T) {
+	hooks := []config.Hook{
+		{Name: "create-dns", DependsOn: []string{"allocate-ip"}},
+		{Name: "allocate-ip"},
+		{Name: "notify"},
+		{Name: "monitoring", DependsOn: []string{"create-dns"}},
+	}
+
+	var mux sync.Mutex
+	var order []string
+	err := runHookGraph(hooks, func(hook config.Hook) error {
+		if hook.Name == "allocate-ip" {
+			time.Sleep(10 * time.Millisecond)
+		}
+		mux.Lock()
+		order = append(order, hook.Name)
+		mux.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	expected := []string{"notify", "allocate-ip", "create-dns", "monitoring"}
+	for i := range expected {
+		if i >= len(order) || order[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, order)
+		}
+	}
+}
+
+func TestRunHookGraphSkipsDependents(t *testing.T) {
+	hooks := []config.Hook{
+		{Name: "allocate-ip"},
+		{Name: "create-dns", DependsOn: []string{"allocate-ip"}},
+		{Name: "notify"},
+	}
+
+	ran := map[string]bool{}
+	var mux sync.Mutex
+	err := runHookGraph(hooks, func(hook config.Hook) error {
+		mux.Lock()
+		ran[hook.Name] = true
+		mux.Unlock()
+		if hook.Name == "allocate-ip" {
+			return errors.New("no addresses left")
+		}
+		return nil
+	})
+
+	if err == nil || err.Error() != "no addresses left" {
+		t.Errorf("expected the allocate-ip error, got %v", err)
+	}
+	if ran["create-dns"] || !ran["notify"] {
+		t.Errorf("expected create-dns to be skipped and notify to run, got %v", ran)
+	}
+}
@@ -0,0 +1,61 @@
+package hooks
+
+import (
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+const hookResultsBucket = "hook-results"
+
+const maxHookResults = 50
+
+// Record a hook result against the machine's build and the per host results
+// kept in the store. m can be a snapshot of the build, the result goes on the
+// build too.
+func RecordHookResult(state *statepkg.State, m *machine.Machine, result machine.HookResult) {
+	result.Token = m.Token
+
+	state.Mux.Lock()
+	live, building := state.MachineByUUID[m.Token]
+	if building && live != m {
+		live.HookResults = append(live.HookResults, result)
+	}
+	m.HookResults = append(m.HookResults, result)
+	state.Version++
+	state.Mux.Unlock()
+
+	// Hooks that run after the build left build mode, e.g. post hooks on
+	// cancel, still belong in that build's record.
+	if !building && m.Token != "" {
+		var b machine.BuildRecord
+		if found, err := state.Store.Get(statepkg.BuildsBucket, m.Token, &b); err == nil && found {
+			b.HookResults = append(b.HookResults, result)
+			if err := state.Store.Put(statepkg.BuildsBucket, m.Token, b); err != nil {
+				logger.Machine(m).Error("cannot store build record", "error", err)
+			}
+		}
+	}
+
+	results, err := LoadHookResults(state.Store, m.Hostname)
+	if err != nil {
+		logger.Machine(m).Error("cannot load hook results", "error", err)
+		return
+	}
+
+	results = append(results, result)
+	if len(results) > maxHookResults {
+		results = results[len(results)-maxHookResults:]
+	}
+
+	if err := state.Store.Put(hookResultsBucket, m.Hostname, results); err != nil {
+		logger.Machine(m).Error("cannot store hook results", "error", err)
+	}
+}
+
+func LoadHookResults(store statepkg.Store, hostname string) ([]machine.HookResult, error) {
+	results := []machine.HookResult{}
+	if _, err := store.Get(hookResultsBucket, hostname, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
@@ -0,0 +1,588 @@
+package hooks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flosch/pongo2"
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/state"
+)
+
+const defaultHookBackoffSeconds = 1
+
+const maxHookBackoff = 5 * time.Minute
+
+// Details of why and for whom a hook is being run
+type hookContext struct {
+	Stage     string
+	RequestID string
+	Requester string
+	DryRun    bool
+
+	// Set when already running on the worker pool for this machine
+	inWorker bool
+
+	// When the request waiting on the hooks gives up, zero for none
+	deadline time.Time
+}
+
+// Build the hook context for a stage triggered by request, which is nil for
+// stages Waitron triggers itself.
+func NewHookContext(stage string, request *http.Request) hookContext {
+	hc := hookContext{Stage: stage}
+	if request != nil {
+		hc.DryRun, _ = strconv.ParseBool(request.URL.Query().Get("dry_run"))
+		hc.RequestID = configpkg.RequestID(request)
+		hc.deadline = requestDeadline(request)
+		hc.Requester = request.RemoteAddr
+		if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+			hc.Requester = host
+		}
+	}
+	return hc
+}
+
+// The document handed to script hooks on stdin
+type hookInput struct {
+	Stage     string
+	Token     string
+	RequestID string
+	Requester string
+	Machine   *machine.Machine
+}
+
+// HookTimeoutError is returned when a hook did not finish within its timeout
+type HookTimeoutError struct {
+	Hook    string
+	Timeout time.Duration
+}
+
+func (e *HookTimeoutError) Error() string {
+	return fmt.Sprintf("hook %s timed out after %s", e.Hook, e.Timeout)
+}
+
+func renderString(tpl string, m *machine.Machine, config configpkg.Config, hc hookContext) (string, error) {
+	t, err := pongo2.FromString(tpl)
+	if err != nil {
+		return "", err
+	}
+	return t.Execute(hc.templateContext(m, config))
+}
+
+// Call a webhook, with its url, headers and body rendered against the machine.
+func executeWebhook(ctx context.Context, hook configpkg.Hook, m *machine.Machine, config configpkg.Config, hc hookContext, result *machine.HookResult) error {
+	url, err := renderString(hook.URL, m, config, hc)
+	if err != nil {
+		return err
+	}
+
+	body, err := renderString(hook.Body, m, config, hc)
+	if err != nil {
+		return err
+	}
+
+	method := hook.Method
+	if method == "" {
+		method = "POST"
+	}
+
+	req, err := http.NewRequest(strings.ToUpper(method), url, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set(configpkg.RequestIDHeader, hc.RequestID)
+
+	for k, v := range hook.Headers {
+		if v, err = renderString(v, m, config, hc); err != nil {
+			return err
+		}
+		req.Header.Set(k, v)
+	}
+
+	if hc.DryRun {
+		hookLogger(hc, m).Info("dry run, not calling webhook", "method", req.Method, "url", url, "body", body)
+		result.Stdout = fmt.Sprintf("%s %s\n%s", req.Method, url, body)
+		return nil
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out := configpkg.NewLimitedBuffer()
+	io.Copy(out, resp.Body)
+	result.Stdout = out.String()
+	result.StatusCode = resp.StatusCode
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s %s returned %s", req.Method, url, resp.Status)
+	}
+
+	hookLogger(hc, m).Info("called webhook", "method", req.Method, "url", url)
+	return nil
+}
+
+func renderHook(hookName string, m *machine.Machine, config configpkg.Config, hc hookContext) (string, error) {
+
+	hookName = path.Join(config.HookPath, hookName)
+	if _, err := os.Stat(hookName); err != nil {
+		hookLogger(hc, m).Error("hook does not exist", "hook", hookName)
+		return "", err
+	}
+
+	tpl, err := pongo2.FromFile(hookName)
+	if err != nil {
+		hookLogger(hc, m).Error("cannot parse hook", "hook", hookName, "error", err)
+		return "", err
+	}
+	result, err := tpl.Execute(hc.templateContext(m, config))
+	if err != nil {
+		hookLogger(hc, m).Error("cannot render hook", "hook", hookName, "error", err)
+		return "", err
+	}
+	return result, err
+}
+
+// Run the hooks for a stage in order, stopping at the first failure. If a
+// stage fails, the failure stage hooks are run as well.
+func ExecuteHooks(stage string, m *machine.Machine, config configpkg.Config, state *state.State, request *http.Request) error {
+	if m == nil {
+		return nil
+	}
+
+	hc := NewHookContext(stage, request)
+	hc.DryRun = hc.DryRun || config.HookDryRun
+
+	return executeStageHooks(hc, m, config, state)
+}
+
+// Hooks run on the worker pool so only so many run at once, and only one at a
+// time per host. Async hooks are queued, the others are waited for.
+func executeStageHooks(hc hookContext, m *machine.Machine, config configpkg.Config, state *state.State) error {
+	hooks := m.HooksForStage(hc.Stage)
+	if configpkg.HasHookDependencies(hooks) {
+		return executeHookGraph(hooks, hc, m, config, state)
+	}
+
+	for _, hook := range hooks {
+		hook := hook
+
+		if hook.Async {
+			executeAsyncHook(hook, hc, m, config, state)
+			continue
+		}
+
+		var err error
+		if hc.inWorker {
+			// Already holding this host's slot, queueing again would deadlock
+			err = executeHookWithRetry(hook, m, m, config, state, hc)
+		} else {
+			if perr := state.Workers.Run(m.Hostname, func() {
+				err = executeHookWithRetry(hook, m, m, config, state, hc)
+			}); perr != nil {
+				err = perr
+			}
+		}
+
+		if err != nil {
+			executeFailureHooks(hc, m, config, state)
+			return err
+		}
+	}
+	return nil
+}
+
+// Runner runs the hooks of what a State does to builds by itself, see
+// State.Hooks
+type Runner struct{}
+
+func (Runner) RunHooks(stage string, m *machine.Machine, config configpkg.Config, state *state.State, request *http.Request) error {
+	return ExecuteHooks(stage, m, config, state, request)
+}
+
+func (Runner) RunWorkerHooks(stage string, m *machine.Machine, config configpkg.Config, state *state.State) error {
+	hc := hookContext{Stage: stage, DryRun: config.HookDryRun, inWorker: true}
+	return executeStageHooks(hc, m, config, state)
+}
+
+// The synchronous hooks of the stage run as one job on the host's slot,
+// concurrently where their dependencies allow.
+func executeHookGraph(hooks []configpkg.Hook, hc hookContext, m *machine.Machine, config configpkg.Config, state *state.State) error {
+	if err := configpkg.ValidateHookGraph(hooks); err != nil {
+		hookLogger(hc, m).Error("invalid hook dependencies", "error", err)
+		executeFailureHooks(hc, m, config, state)
+		return err
+	}
+
+	var graph []configpkg.Hook
+	for _, hook := range hooks {
+		if hook.Async {
+			executeAsyncHook(hook, hc, m, config, state)
+			continue
+		}
+		graph = append(graph, hook)
+	}
+
+	run := func() error {
+		return runHookGraph(graph, func(hook configpkg.Hook) error {
+			return executeHookWithRetry(hook, m, m, config, state, hc)
+		})
+	}
+
+	var err error
+	if hc.inWorker {
+		err = run()
+	} else {
+		if perr := state.Workers.Run(m.Hostname, func() { err = run() }); perr != nil {
+			err = perr
+		}
+	}
+
+	if err != nil {
+		executeFailureHooks(hc, m, config, state)
+	}
+	return err
+}
+
+func executeAsyncHook(hook configpkg.Hook, hc hookContext, m *machine.Machine, config configpkg.Config, state *state.State) {
+	// Render against a snapshot, the machine keeps changing while we retry
+	state.Mux.Lock()
+	snapshot := *m
+	state.Mux.Unlock()
+
+	// Nobody waits for async hooks, the request's deadline doesn't apply
+	whc := hc
+	whc.inWorker = true
+	whc.deadline = time.Time{}
+	state.Workers.Submit(m.Hostname, func() {
+		if err := executeHookWithRetry(hook, m, &snapshot, config, state, whc); err != nil {
+			executeFailureHooks(whc, m, config, state)
+		}
+	})
+}
+
+func executeFailureHooks(hc hookContext, m *machine.Machine, config configpkg.Config, state *state.State) {
+	if hc.Stage == machine.StageFailure {
+		return
+	}
+	reason := fmt.Sprintf("%s hooks failed", hc.Stage)
+	state.Transition(m, machine.BuildFailed, reason)
+	state.Emit(machine.EventBuildFailed, m, reason)
+	hc.Stage = machine.StageFailure
+	hc.deadline = time.Time{}
+	executeStageHooks(hc, m, config, state)
+	state.RetryBuild(m, config, reason)
+}
+
+// Run a hook up to 1+Retries times, recording every attempt against m and
+// dead-lettering it if no attempt succeeds. render is what the hook sees.
+func executeHookWithRetry(hook configpkg.Hook, m *machine.Machine, render *machine.Machine, config configpkg.Config, state *state.State, hc hookContext) error {
+	backoff := time.Duration(hook.RetryBackoffSeconds) * time.Second
+	if backoff <= 0 {
+		backoff = defaultHookBackoffSeconds * time.Second
+	}
+
+	var err error
+	attempts := 0
+	for attempt := 1; attempt <= hook.Retries+1; attempt++ {
+		if attempt > 1 {
+			if !hc.deadline.IsZero() && time.Now().Add(backoff).After(hc.deadline) {
+				break
+			}
+			time.Sleep(backoff)
+			if backoff *= 2; backoff > maxHookBackoff {
+				backoff = maxHookBackoff
+			}
+		}
+
+		var result machine.HookResult
+		attempts = attempt
+		result, err = ExecuteHook(hook, render, config, hc)
+		result.Stage = hc.Stage
+		result.Attempt = attempt
+		RecordHookResult(state, m, result)
+
+		if err == nil {
+			return nil
+		}
+
+		if terr, ok := err.(*HookTimeoutError); ok {
+			hookLogger(hc, m).Error("hook timed out", "hook", hook, "attempt", attempt, "error", terr)
+			state.Emit(machine.EventHookTimeout, m, terr.Error())
+		} else {
+			hookLogger(hc, m).Error("cannot execute hook", "hook", hook, "attempt", attempt, "error", err)
+			state.Emit(machine.EventHookFailed, m, fmt.Sprintf("%s: %s", hook, err))
+		}
+	}
+
+	deadLetterHook(state, hook, m, hc, attempts, err)
+	return err
+}
+
+// Run a single hook, script or webhook, bounded by its timeout.
+func ExecuteHook(hook configpkg.Hook, m *machine.Machine, config configpkg.Config, hc hookContext) (machine.HookResult, error) {
+	timeout := hook.Timeout(config)
+	if !hc.deadline.IsZero() {
+		if left := time.Until(hc.deadline); left < timeout {
+			timeout = left
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	result := machine.HookResult{Hook: hook.String(), Started: time.Now(), DryRun: hc.DryRun}
+
+	var err error
+	if hook.Plugin != "" {
+		err = executePluginHook(ctx, hook, m, config, hc, &result)
+	} else if hook.URL != "" {
+		err = executeWebhook(ctx, hook, m, config, hc, &result)
+	} else if hook.Command != "" {
+		err = executeCommandHook(ctx, hook, m, config, hc, &result)
+	} else {
+		err = executeScriptHook(ctx, hook, m, config, hc, &result)
+	}
+
+	result.Finished = time.Now()
+	result.Duration = result.Finished.Sub(result.Started)
+
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = &HookTimeoutError{Hook: hook.String(), Timeout: timeout}
+		result.TimedOut = true
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	return result, err
+}
+
+func executeScriptHook(ctx context.Context, hook configpkg.Hook, m *machine.Machine, config configpkg.Config, hc hookContext, result *machine.HookResult) error {
+	rendered, err := renderHook(hook.Name, m, config, hc)
+	if err != nil {
+		return err
+	}
+
+	if hc.DryRun {
+		hookLogger(hc, m).Info("dry run, not executing hook", "hook", hook.Name, "script", rendered)
+		result.Stdout = rendered
+		return nil
+	}
+
+	tempFile, err := generateTempFile(hook.Sandbox.TempDir(), hook.Name, rendered, hook.Sandbox)
+	if err != nil {
+		return err
+	}
+
+	input, err := hookStdin(m, hc)
+	if err != nil {
+		deleteTempFile(tempFile)
+		return err
+	}
+
+	return executeFile(ctx, tempFile, hook.Sandbox, hookEnv(m, hc), input, result)
+}
+
+// Run a templated command hook, e.g. "register-dns {{ Hostname }} {{ IP }}"
+func executeCommandHook(ctx context.Context, hook configpkg.Hook, m *machine.Machine, config configpkg.Config, hc hookContext, result *machine.HookResult) error {
+	command, err := renderString(hook.Command, m, config, hc)
+	if err != nil {
+		return err
+	}
+
+	var args []string
+	if len(hook.Args) == 0 {
+		command, args = "bash", []string{"-c", command}
+	}
+	for _, a := range hook.Args {
+		rendered, err := renderString(a, m, config, hc)
+		if err != nil {
+			return err
+		}
+		args = append(args, rendered)
+	}
+
+	if hc.DryRun {
+		hookLogger(hc, m).Info("dry run, not executing hook", "command", strings.TrimSpace(command+" "+strings.Join(args, " ")))
+		result.Stdout = strings.TrimSpace(command + " " + strings.Join(args, " "))
+		return nil
+	}
+
+	input, err := hookStdin(m, hc)
+	if err != nil {
+		return err
+	}
+
+	env := hookEnv(m, hc)
+	if command, err = hook.Sandbox.LookPath(command, env); err != nil {
+		return err
+	}
+	return runHookCommand(ctx, exec.CommandContext(ctx, command, args...), hook.Sandbox, env, input, result)
+}
+
+func hookStdin(m *machine.Machine, hc hookContext) ([]byte, error) {
+	return json.Marshal(&hookInput{
+		Stage:     hc.Stage,
+		Token:     m.Token,
+		RequestID: hc.RequestID,
+		Requester: hc.Requester,
+		Machine:   m,
+	})
+}
+
+// Write a script hook to a file of its own in tmpDir, executable by the
+// sandbox user. The file is new and only opened once, so nothing left in
+// tmpDir by an earlier hook is written through, and hooks run at the same
+// time don't share it.
+func generateTempFile(tmpDir string, hookName string, renderedHook string, sandbox *configpkg.HookSandbox) (string, error) {
+	f, err := ioutil.TempFile(tmpDir, path.Base(hookName)+"-")
+	if err != nil {
+		return "", err
+	}
+	filename := f.Name()
+
+	if _, err = io.WriteString(f, renderedHook); err == nil {
+		if err = f.Chmod(0700); err == nil {
+			err = sandbox.Chown(f)
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		deleteTempFile(filename)
+		return "", err
+	}
+	return filename, nil
+}
+
+func deleteTempFile(filename string) error {
+	err := os.Remove(filename)
+	if err != nil {
+		logger.Error("cannot remove hook file", "path", filename, "error", err)
+	}
+	return err
+}
+
+// Besides machine and config, the fields most hooks need are available at the
+// top level, e.g. {{ Hostname }} and {{ IP }}.
+func (hc hookContext) templateContext(m *machine.Machine, config configpkg.Config) pongo2.Context {
+	ctx := pongo2.Context{
+		"machine":    m,
+		"config":     config,
+		"stage":      hc.Stage,
+		"Hostname":   m.Hostname,
+		"ShortName":  m.ShortName,
+		"Domain":     m.Domain,
+		"Token":      m.Token,
+		"IP":         "",
+		"MAC":        "",
+		"request_id": hc.RequestID,
+		"requester":  hc.Requester,
+	}
+
+	if len(m.Network) > 0 {
+		ctx["MAC"] = m.Network[0].MacAddress
+		if len(m.Network[0].Addresses4) > 0 {
+			ctx["IP"] = m.Network[0].Addresses4[0].IPAddress
+		}
+	}
+
+	return ctx
+}
+
+// Environment passed to hook scripts on top of Waitron's own. The full machine
+// is in WAITRON_MACHINE as JSON, and on stdin along with the rest of the context.
+func hookEnv(m *machine.Machine, hc hookContext) []string {
+	env := append(os.Environ(),
+		"WAITRON_HOSTNAME="+m.Hostname,
+		"WAITRON_SHORTNAME="+m.ShortName,
+		"WAITRON_DOMAIN="+m.Domain,
+		"WAITRON_TOKEN="+m.Token,
+		"WAITRON_STAGE="+hc.Stage,
+		"WAITRON_REQUEST_ID="+hc.RequestID,
+		"WAITRON_REQUESTER="+hc.Requester,
+	)
+
+	if len(m.Network) > 0 {
+		env = append(env, "WAITRON_MACADDRESS="+m.Network[0].MacAddress)
+		if len(m.Network[0].Addresses4) > 0 {
+			env = append(env, "WAITRON_IPADDRESS="+m.Network[0].Addresses4[0].IPAddress)
+		}
+	}
+
+	if js, err := json.Marshal(m); err == nil {
+		env = append(env, "WAITRON_MACHINE="+string(js))
+	}
+
+	return env
+}
+
+func executeFile(ctx context.Context, cmd string, sandbox *configpkg.HookSandbox, env []string, stdin []byte, result *machine.HookResult) error {
+	defer deleteTempFile(cmd)
+	return runHookCommand(ctx, exec.CommandContext(ctx, sandbox.Path(cmd)), sandbox, env, stdin, result)
+}
+
+func runHookCommand(ctx context.Context, c *exec.Cmd, sandbox *configpkg.HookSandbox, env []string, stdin []byte, result *machine.HookResult) error {
+	stdout, stderr := configpkg.NewLimitedBuffer(), configpkg.NewLimitedBuffer()
+
+	c.Env = sandbox.Env(env)
+	c.Stdin = bytes.NewReader(stdin)
+	c.Stdout = stdout
+	c.Stderr = stderr
+	// Own process group so a timeout also takes down anything the hook spawned
+	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := sandbox.Apply(c); err != nil {
+		return err
+	}
+
+	if err := c.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	err := c.Wait()
+	close(done)
+
+	result.Stdout = stdout.String()
+	result.Stderr = stderr.String()
+	if c.ProcessState != nil {
+		result.ExitCode = c.ProcessState.ExitCode()
+	}
+
+	if err != nil {
+		return err
+	}
+
+	logger.Info("executed hook", "command", strings.Join(c.Args, " "))
+	return nil
+}
@@ -0,0 +1,375 @@
+package hooks
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/state"
+)
+
+func TestExecuteWebhook(t *testing.T) {
+	var method, auth, requestID, body string
+	ts := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		method = request.Method
+		auth = request.Header.Get("Authorization")
+		requestID = request.Header.Get("X-Request-ID")
+		b, _ := ioutil.ReadAll(request.Body)
+		body = string(b)
+	}))
+	defer ts.Close()
+
+	m := &machine.Machine{Hostname: "dns02.example.com"}
+	hook := configpkg.Hook{
+		URL:     ts.URL + "/hosts/{{ machine.Hostname }}",
+		Method:  "put",
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+		Body:    `{"hostname": "{{ machine.Hostname }}"}`,
+	}
+
+	if err := executeWebhook(context.Background(), hook, m, configpkg.Config{}, hookContext{RequestID: "req-1"}, &machine.HookResult{}); err != nil {
+		t.Fatalf("webhook failed: %s", err)
+	}
+
+	if method != "PUT" {
+		t.Errorf("expected PUT, got %s", method)
+	}
+	if auth != "Bearer secret" {
+		t.Errorf("expected Authorization header to be passed, got %q", auth)
+	}
+	if requestID != "req-1" {
+		t.Errorf("expected request id req-1, got %q", requestID)
+	}
+	if body != `{"hostname": "dns02.example.com"}` {
+		t.Errorf("unexpected body %s", body)
+	}
+}
+
+func TestExecuteWebhookFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		http.Error(response, "nope", http.StatusInternalServerError)
+	}))
+	defer ts.Close()
+
+	if err := executeWebhook(context.Background(), configpkg.Hook{URL: ts.URL}, &machine.Machine{}, configpkg.Config{}, hookContext{}, &machine.HookResult{}); err == nil {
+		t.Errorf("expected an error for a non-2xx webhook response")
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		time.Sleep(2 * time.Second)
+	}))
+	defer ts.Close()
+
+	result, err := ExecuteHook(configpkg.Hook{URL: ts.URL, TimeoutSeconds: 1}, &machine.Machine{}, configpkg.Config{}, hookContext{})
+	if _, ok := err.(*HookTimeoutError); !ok {
+		t.Errorf("expected a HookTimeoutError, got %v", err)
+	}
+	if !result.TimedOut {
+		t.Errorf("expected the result to be marked as timed out")
+	}
+}
+
+func TestExecuteFileTimeout(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-hooks")
+	defer os.RemoveAll(dir)
+
+	script := path.Join(dir, "slow.sh")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\nsleep 10\n"), 0700)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := executeFile(ctx, script, nil, os.Environ(), nil, &machine.HookResult{}); err == nil {
+		t.Errorf("expected an error from a killed hook")
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("hook was not killed on timeout")
+	}
+}
+
+func TestRenderHookParseError(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-hooks")
+	defer os.RemoveAll(dir)
+
+	ioutil.WriteFile(path.Join(dir, "broken.sh"), []byte("#!/bin/sh\n{% if %}\n"), 0700)
+	if _, err := renderHook("broken.sh", &machine.Machine{}, configpkg.Config{HookPath: dir}, hookContext{}); err == nil {
+		t.Errorf("expected an error for a hook that doesn't parse")
+	}
+}
+
+func TestExecuteFileCapturesOutput(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-hooks")
+	defer os.RemoveAll(dir)
+
+	script := path.Join(dir, "fail.sh")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\necho out\necho err >&2\nexit 3\n"), 0700)
+
+	result := machine.HookResult{}
+	if err := executeFile(context.Background(), script, nil, os.Environ(), nil, &result); err == nil {
+		t.Errorf("expected an error from a failing hook")
+	}
+	if result.Stdout != "out\n" || result.Stderr != "err\n" {
+		t.Errorf("unexpected output %q / %q", result.Stdout, result.Stderr)
+	}
+	if result.ExitCode != 3 {
+		t.Errorf("expected exit code 3, got %d", result.ExitCode)
+	}
+}
+
+func TestGenerateTempFileIgnoresSymlinks(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-hooks")
+	defer os.RemoveAll(dir)
+
+	// What a sandboxed hook could leave where the next one used to be written
+	target := path.Join(dir, "target")
+	ioutil.WriteFile(target, []byte("untouched"), 0600)
+	os.Symlink(target, path.Join(dir, "notify.sh"))
+
+	file, err := generateTempFile(dir, "notify.sh", "#!/bin/sh\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+	if info, err := os.Lstat(file); err != nil || !info.Mode().IsRegular() || info.Mode().Perm() != 0700 {
+		t.Errorf("expected a new executable file, got %v %v", info, err)
+	}
+	if data, _ := ioutil.ReadFile(target); string(data) != "untouched" {
+		t.Errorf("expected the symlink not to be written through, got %q", data)
+	}
+}
+
+func TestGenerateTempFilePerInvocation(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-hooks")
+	defer os.RemoveAll(dir)
+
+	// The same hook rendered for two hosts at once
+	first, err := generateTempFile(dir, "notify.sh", "echo dns01\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := generateTempFile(dir, "notify.sh", "echo dns02\n", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("expected a file per invocation, got %s twice", first)
+	}
+
+	deleteTempFile(second)
+	if data, err := ioutil.ReadFile(first); err != nil || string(data) != "echo dns01\n" {
+		t.Errorf("expected the first host's script to be left alone, got %q %v", data, err)
+	}
+}
+
+func TestGenerateTempFileMissingDir(t *testing.T) {
+	if file, err := generateTempFile("/nonexistent/waitron", "notify.sh", "#!/bin/sh\n", nil); err == nil {
+		os.Remove(file)
+		t.Error("expected an error without a directory to write to")
+	}
+}
+
+func TestRecordHookResult(t *testing.T) {
+	state := state.New()
+	m := &machine.Machine{Hostname: "dns02.example.com", Token: "token"}
+	state.MachineByUUID["token"] = m
+
+	RecordHookResult(state, m, machine.HookResult{Hook: "notify-slack.sh", Stage: "pre-hook"})
+
+	if len(m.HookResults) != 1 {
+		t.Errorf("expected the result on the machine, got %d", len(m.HookResults))
+	}
+	results, _ := LoadHookResults(state.Store, "dns02.example.com")
+	if len(results) != 1 || results[0].Token != "token" {
+		t.Errorf("expected one stored result for the build, got %+v", results)
+	}
+}
+
+func TestRecordHookResultSnapshot(t *testing.T) {
+	state := state.New()
+	m := &machine.Machine{Hostname: "dns02.example.com", Token: "token"}
+	state.MachineByUUID["token"] = m
+	snapshot := *m
+
+	RecordHookResult(state, &snapshot, machine.HookResult{Hook: "notify-slack.sh", Stage: "template"})
+
+	if len(m.HookResults) != 1 || len(snapshot.HookResults) != 1 {
+		t.Errorf("expected the result on the build and the snapshot, got %d and %d", len(m.HookResults), len(snapshot.HookResults))
+	}
+}
+
+func TestHookRetryDeadLetter(t *testing.T) {
+	state := state.New()
+	m := &machine.Machine{Hostname: "dns02.example.com"}
+	config := configpkg.Config{HookPath: "hooks"}
+
+	err := executeHookWithRetry(configpkg.Hook{Name: "missing.sh", Retries: 1}, m, m, config, state, hookContext{Stage: machine.StageDone})
+	if err == nil {
+		t.Fatalf("expected a missing hook to fail")
+	}
+
+	if len(m.HookResults) != 2 || m.HookResults[1].Attempt != 2 {
+		t.Errorf("expected two recorded attempts, got %+v", m.HookResults)
+	}
+
+	keys, _ := state.Store.List(DeadLetterBucket)
+	if len(keys) != 1 {
+		t.Fatalf("expected one dead letter, got %d", len(keys))
+	}
+
+	var d DeadLetter
+	state.Store.Get(DeadLetterBucket, keys[0], &d)
+	if d.Hostname != "dns02.example.com" || d.Attempts != 2 || d.Stage != machine.StageDone {
+		t.Errorf("unexpected dead letter %+v", d)
+	}
+}
+
+func TestReplayDeadLetter(t *testing.T) {
+	up := false
+	ts := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if !up {
+			http.Error(response, "down", http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	state := state.New()
+	m := &machine.Machine{Hostname: "dns02.example.com"}
+	executeHookWithRetry(configpkg.Hook{URL: ts.URL}, m, m, configpkg.Config{}, state, hookContext{Stage: machine.StageDone})
+
+	letters, _ := LoadDeadLetters(state.Store)
+	if len(letters) != 1 || letters[0].Machine == nil {
+		t.Fatalf("expected one dead letter with the machine, got %+v", letters)
+	}
+
+	if _, err := ReplayDeadLetter(state, letters[0].ID, configpkg.Config{}, hookContext{}); err == nil {
+		t.Errorf("expected the replay to fail while the webhook is down")
+	}
+	if d, _ := LoadDeadLetter(state.Store, letters[0].ID); d == nil || d.Attempts != 2 || d.Replayed == nil {
+		t.Errorf("expected the failed replay to be recorded, got %+v", d)
+	}
+
+	up = true
+	if _, err := ReplayDeadLetter(state, letters[0].ID, configpkg.Config{}, hookContext{}); err != nil {
+		t.Errorf("expected the replay to succeed, got %s", err)
+	}
+	if _, err := LoadDeadLetter(state.Store, letters[0].ID); err != ErrUnknownDeadLetter {
+		t.Errorf("expected the dead letter to be removed, got %v", err)
+	}
+}
+
+func TestWebhookRetrySucceeds(t *testing.T) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		calls++
+		if calls < 2 {
+			http.Error(response, "try again", http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+
+	state := state.New()
+	m := &machine.Machine{Hostname: "dns02.example.com"}
+
+	if err := executeHookWithRetry(configpkg.Hook{URL: ts.URL, Retries: 2}, m, m, configpkg.Config{}, state, hookContext{}); err != nil {
+		t.Errorf("expected the retry to succeed, got %s", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+	if keys, _ := state.Store.List(DeadLetterBucket); len(keys) != 0 {
+		t.Errorf("expected no dead letters, got %v", keys)
+	}
+}
+
+func TestHookEnvAndStdin(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-hooks")
+	defer os.RemoveAll(dir)
+
+	script := path.Join(dir, "env.sh")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\necho $WAITRON_HOSTNAME $WAITRON_TOKEN $WAITRON_STAGE $WAITRON_MACADDRESS\ncat\n"), 0700)
+
+	m := &machine.Machine{Hostname: "dns02.example.com", Token: "token", Network: []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}}
+	hc := hookContext{Stage: machine.StageDone, Requester: "10.0.0.1"}
+
+	result := machine.HookResult{}
+	if err := executeFile(context.Background(), script, nil, hookEnv(m, hc), []byte(`{"Stage":"done"}`), &result); err != nil {
+		t.Fatalf("hook failed: %s", err)
+	}
+
+	expected := "dns02.example.com token done de:ad:c0:de:ca:fe\n{\"Stage\":\"done\"}"
+	if result.Stdout != expected {
+		t.Errorf("expected %q, got %q", expected, result.Stdout)
+	}
+}
+
+func TestNewHookContext(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/done/dns02.example.com/token", nil)
+	request.RemoteAddr = "10.0.0.1:4242"
+	request.Header.Set("X-Request-ID", "req-1")
+
+	hc := NewHookContext(machine.StageDone, request)
+	if hc.Requester != "10.0.0.1" || hc.RequestID != "req-1" || hc.Stage != machine.StageDone {
+		t.Errorf("unexpected hook context %+v", hc)
+	}
+
+	if hc := NewHookContext(machine.StageStale, nil); hc.Requester != "" || hc.Stage != machine.StageStale {
+		t.Errorf("unexpected hook context %+v", hc)
+	}
+}
+
+func TestWebhookDryRun(t *testing.T) {
+	called := false
+	ts := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		called = true
+	}))
+	defer ts.Close()
+
+	result, err := ExecuteHook(configpkg.Hook{URL: ts.URL, Body: `{"a": 1}`}, &machine.Machine{}, configpkg.Config{}, hookContext{DryRun: true})
+	if err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if called {
+		t.Errorf("dry run should not call the webhook")
+	}
+	if !result.DryRun || !strings.Contains(result.Stdout, `{"a": 1}`) {
+		t.Errorf("expected a dry run result with the rendered body, got %+v", result)
+	}
+}
+
+func TestNewHookContextDryRun(t *testing.T) {
+	request, _ := http.NewRequest("PUT", "/build/dns02.example.com?dry_run=true", nil)
+	if hc := NewHookContext(machine.StageBuildStart, request); !hc.DryRun {
+		t.Errorf("expected dry_run=true to set DryRun")
+	}
+}
+
+func TestCommandHook(t *testing.T) {
+	m := &machine.Machine{Hostname: "dns02.example.com", Token: "token", Network: []machine.Interface{{Addresses4: []machine.IPConfig{{IPAddress: "192.168.1.10"}}}}}
+
+	result, err := ExecuteHook(configpkg.Hook{Command: "echo {{ Hostname }} {{ IP }} {{ Token }}"}, m, configpkg.Config{}, hookContext{Stage: machine.StageDone})
+	if err != nil {
+		t.Fatalf("hook failed: %s", err)
+	}
+	if result.Stdout != "dns02.example.com 192.168.1.10 token\n" {
+		t.Errorf("unexpected output %q", result.Stdout)
+	}
+
+	result, err = ExecuteHook(configpkg.Hook{Command: "printf", Args: []string{"%s|%s", "{{ Hostname }}", "a b"}}, m, configpkg.Config{}, hookContext{Stage: machine.StageDone})
+	if err != nil {
+		t.Fatalf("hook failed: %s", err)
+	}
+	if result.Stdout != "dns02.example.com|a b" {
+		t.Errorf("unexpected output %q", result.Stdout)
+	}
+}
@@ -0,0 +1,18 @@
+package hooks
+
+import (
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// A logger for lines about running hooks for m
+func hookLogger(hc hookContext, m *machine.Machine) *config.Logger {
+	l := logger
+	if hc.RequestID != "" {
+		l = l.With("request_id", hc.RequestID)
+	}
+	if hc.Stage != "" {
+		l = l.With("stage", hc.Stage)
+	}
+	return l.Machine(m)
+}
@@ -0,0 +1,37 @@
+package hooks
+
+import (
+	"context"
+	"encoding/json"
+
+	configpkg "github.com/ns1/waitron/config"
+	machinepkg "github.com/ns1/waitron/machine"
+)
+
+// Run a hook implemented by a plugin
+func executePluginHook(ctx context.Context, hook configpkg.Hook, m *machinepkg.Machine, config configpkg.Config, hc hookContext, result *machinepkg.HookResult) error {
+	p, err := config.Plugin(hook.Plugin, machinepkg.PluginTypeHook)
+	if err != nil {
+		return err
+	}
+
+	if hc.DryRun {
+		hookLogger(hc, m).Info("dry run, not calling hook plugin", "plugin", p.Name)
+		return nil
+	}
+
+	machine, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	resp, err := p.Call(ctx, configpkg.PluginRequest{
+		Action:    machinepkg.PluginActionHook,
+		Stage:     hc.Stage,
+		Hostname:  m.Hostname,
+		RequestID: hc.RequestID,
+		Requester: hc.Requester,
+		Machine:   machine,
+	})
+	result.Stdout = resp.Output
+	return err
+}
@@ -0,0 +1,62 @@
+package hooks
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+const testPlugin = `#!/bin/sh
+input=$(cat)
+case "$input" in
+  *'"Action":"info"'*) echo '{"Name":"test","Types":["hook","inventory"]}' ;;
+  *'"Action":"health"'*) echo '{}' ;;
+  *'"Action":"machine"'*'"Hostname":"dns02.example.com"'*) echo '{"Found":true,"Machine":{"params":{"rack":"r1"}}}' ;;
+  *'"Action":"machine"'*) echo '{"Found":false}' ;;
+  *'"Action":"mac"'*'"MacAddress":"de:ad:c0:de:ca:fe"'*) echo '{"Found":true,"Hostname":"dns02.example.com"}' ;;
+  *'"Action":"mac"'*) echo '{"Found":false}' ;;
+  *'"Action":"hook"'*) echo '{"Output":"hooked"}' ;;
+esac
+`
+
+const unhealthyPlugin = `#!/bin/sh
+input=$(cat)
+case "$input" in
+  *'"Action":"info"'*) echo '{"Name":"broken","Types":["hook"]}' ;;
+  *) echo '{"Error":"backend unreachable"}' ;;
+esac
+`
+
+func pluginDir(t *testing.T) string {
+	dir, _ := ioutil.TempDir("", "waitron-plugins")
+	ioutil.WriteFile(path.Join(dir, "test-plugin"), []byte(testPlugin), 0700)
+	ioutil.WriteFile(path.Join(dir, "broken-plugin"), []byte(unhealthyPlugin), 0700)
+	ioutil.WriteFile(path.Join(dir, "README"), []byte("not a plugin"), 0600)
+	return dir
+}
+
+func TestPluginHook(t *testing.T) {
+	dir := pluginDir(t)
+	defer os.RemoveAll(dir)
+
+	plugins, _ := machine.DiscoverPlugins(dir)
+	config := configpkg.Config{Plugins: plugins}
+
+	result := machine.HookResult{}
+	err := executePluginHook(context.Background(), configpkg.Hook{Plugin: "test"}, &machine.Machine{Hostname: "dns02.example.com"}, config, hookContext{Stage: machine.StageDone}, &result)
+	if err != nil {
+		t.Fatalf("plugin hook failed: %s", err)
+	}
+	if result.Stdout != "hooked" {
+		t.Errorf("expected plugin output, got %q", result.Stdout)
+	}
+
+	if err := executePluginHook(context.Background(), configpkg.Hook{Plugin: "missing"}, &machine.Machine{}, config, hookContext{}, &result); err == nil {
+		t.Errorf("expected an error for an unknown plugin")
+	}
+}
@@ -0,0 +1,30 @@
+package hooks
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestSandboxLimits(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-sandbox")
+	defer os.RemoveAll(dir)
+	dir, _ = filepath.EvalSymlinks(dir)
+
+	ctx := context.Background()
+	s := &config.HookSandbox{Dir: dir, CPUSeconds: 5}
+
+	result := machine.HookResult{}
+	if err := runHookCommand(ctx, exec.CommandContext(ctx, "sh", "-c", "ulimit -t; pwd"), s, os.Environ(), nil, &result); err != nil {
+		t.Fatalf("hook failed: %s", err)
+	}
+	if result.Stdout != "5\n"+dir+"\n" {
+		t.Errorf("expected the cpu limit and working directory, got %q", result.Stdout)
+	}
+}
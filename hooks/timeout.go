@@ -0,0 +1,15 @@
+package hooks
+
+import (
+	"net/http"
+	"time"
+)
+
+// The deadline of request, if any, for the hooks it runs
+func requestDeadline(request *http.Request) time.Time {
+	if request == nil {
+		return time.Time{}
+	}
+	deadline, _ := request.Context().Deadline()
+	return deadline
+}
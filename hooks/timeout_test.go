@@ -0,0 +1,28 @@
+package hooks
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestHookHonorsRequestDeadline(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		time.Sleep(2 * time.Second)
+	}))
+	defer ts.Close()
+
+	hc := hookContext{deadline: time.Now().Add(100 * time.Millisecond)}
+	start := time.Now()
+	_, err := ExecuteHook(config.Hook{URL: ts.URL, TimeoutSeconds: 10}, &machine.Machine{}, config.Config{}, hc)
+	if _, ok := err.(*HookTimeoutError); !ok {
+		t.Errorf("expected a HookTimeoutError, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the hook to stop at the request deadline, took %s", elapsed)
+	}
+}
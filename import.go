@@ -0,0 +1,182 @@
+package waitron
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/state"
+	"gopkg.in/yaml.v2"
+)
+
+// `waitron import` converts the hosts of a Foreman or Cobbler server, or the
+// machines of MaaS, into machine definitions, to make moving off them
+// practical:
+//
+//	waitron import --from=foreman --url=https://foreman.example.com --user=admin --machinepath=machines --templatepath=templates
+//
+// Every host becomes <machinepath>/<hostname>.yaml with its operating
+// system, interfaces, parameters and the hostgroup or profile as a label.
+// The provisioning templates or kickstarts hosts use become the machines'
+// preseed and finish, and with --templatepath a stub is written for each so
+// they can be ported to pongo2. Existing files are left alone unless
+// --overwrite is given. The password, or the MaaS API key, is read from
+// IMPORT_PASSWORD.
+
+const importTimeout = 30 * time.Second
+
+// What an import writes as a machine definition, the fields it can fill
+type importedMachine struct {
+	OperatingSystem string              `yaml:"operatingsystem,omitempty"`
+	Preseed         string              `yaml:"preseed,omitempty"`
+	Finish          string              `yaml:"finish,omitempty"`
+	Cmdline         string              `yaml:"cmdline,omitempty"`
+	Params          map[string]string   `yaml:"params,omitempty"`
+	Labels          map[string]string   `yaml:"labels,omitempty"`
+	Puppet          *importedPuppet     `yaml:"puppet,omitempty"`
+	Network         []machine.Interface `yaml:"network,omitempty"`
+}
+
+type importedPuppet struct {
+	Environment string `yaml:"environment"`
+}
+
+// A host from the system imported from, and the templates it uses by stub
+// name with where they came from
+type importedHost struct {
+	Hostname  string
+	Machine   importedMachine
+	Templates map[string]string
+}
+
+type importSource interface {
+	hosts() ([]importedHost, error)
+}
+
+func newImportSource(from string, url string, user string, password string) (importSource, error) {
+	if url == "" {
+		return nil, fmt.Errorf("--url is required")
+	}
+	client := &http.Client{Timeout: importTimeout}
+	url = strings.TrimRight(url, "/")
+	switch from {
+	case "foreman":
+		return &foremanSource{url: url, user: user, password: password, client: client}, nil
+	case "cobbler":
+		return &cobblerSource{url: url, client: client}, nil
+	case "maas":
+		return &maasSource{url: url, key: password, client: client}, nil
+	}
+	return nil, fmt.Errorf("--from must be foreman, cobbler or maas, not %q", from)
+}
+
+var unsafeTemplateName = regexp.MustCompile(`[^a-z0-9._-]+`)
+
+// The stub a template called name is imported as
+func stubName(name string) string {
+	name = strings.Trim(unsafeTemplateName.ReplaceAllString(strings.ToLower(filepath.Base(name)), "-"), "-")
+	if name == "" {
+		name = "imported"
+	}
+	return name + ".j2"
+}
+
+func templateStub(origin string) []byte {
+	return []byte("{# Imported from " + origin + ", port it to pongo2 #}\n")
+}
+
+// Write the hosts out, returns how many machine definitions were written and
+// skipped
+func writeImport(hosts []importedHost, machinePath string, templatePath string, overwrite bool) (int, int, error) {
+	written, skipped := 0, 0
+	stubs := make(map[string]string)
+	for _, h := range hosts {
+		hostname := strings.ToLower(h.Hostname)
+		if !state.ValidHostname.MatchString(hostname) {
+			logger.Warn("skipping host with an invalid hostname", "hostname", h.Hostname)
+			skipped++
+			continue
+		}
+		file := filepath.Join(machinePath, hostname+".yaml")
+		if _, err := os.Stat(file); err == nil && !overwrite {
+			logger.Info("machine definition exists, skipping", "path", file)
+			skipped++
+			continue
+		}
+		data, err := yaml.Marshal(h.Machine)
+		if err != nil {
+			return written, skipped, err
+		}
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			return written, skipped, err
+		}
+		written++
+		for name, origin := range h.Templates {
+			stubs[name] = origin
+		}
+	}
+
+	if templatePath == "" {
+		return written, skipped, nil
+	}
+	names := make([]string, 0, len(stubs))
+	for name := range stubs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		file := filepath.Join(templatePath, name)
+		if _, err := os.Stat(file); err == nil {
+			continue
+		}
+		if err := ioutil.WriteFile(file, templateStub(stubs[name]), 0644); err != nil {
+			return written, skipped, err
+		}
+		logger.Info("wrote template stub", "path", file, "from", stubs[name])
+	}
+	return written, skipped, nil
+}
+
+// Run `waitron import` with the arguments after import, returns the exit code
+func importCommand(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	from := flags.String("from", "", "Where to import from: foreman, cobbler or maas.")
+	url := flags.String("url", "", "URL of the Foreman or MaaS server, e.g. http://maas:5240/MAAS, or of Cobbler's XML-RPC API, e.g. http://cobbler/cobbler_api.")
+	user := flags.String("user", "", "User for the Foreman API, the password is read from IMPORT_PASSWORD.")
+	machinePath := flags.String("machinepath", "", "Directory to write machine definitions to.")
+	templatePath := flags.String("templatepath", "", "Directory to write template stubs to, none are written when unset.")
+	overwrite := flags.Bool("overwrite", false, "Replace existing machine definitions.")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *machinePath == "" {
+		logger.Error("--machinepath is required")
+		return 2
+	}
+
+	source, err := newImportSource(*from, *url, *user, os.Getenv("IMPORT_PASSWORD"))
+	if err != nil {
+		logger.Error("cannot import", "error", err)
+		return 2
+	}
+	hosts, err := source.hosts()
+	if err != nil {
+		logger.Error("cannot read hosts", "from", *from, "url", *url, "error", err)
+		return 1
+	}
+	written, skipped, err := writeImport(hosts, *machinePath, *templatePath, *overwrite)
+	if err != nil {
+		logger.Error("cannot write machine definitions", "error", err)
+		return 1
+	}
+	logger.Info("import done", "from", *from, "written", written, "skipped", skipped)
+	return 0
+}
@@ -0,0 +1,263 @@
+package waitron
+
+import (
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"gopkg.in/yaml.v2"
+)
+
+func TestForemanImport(t *testing.T) {
+	pages := map[string][]string{
+		"/api/v2/subnets": {`{"subtotal": 1, "results": [{"id": 3, "mask": "255.255.255.0", "cidr": 24, "gateway": "192.0.2.254"}]}`},
+		"/api/v2/hosts": {
+			`{"subtotal": 2, "results": [{"id": 1, "name": "node01.example.com", "operatingsystem_id": 2, "operatingsystem_name": "CentOS 7",
+				"hostgroup_title": "web/prod", "environment_name": "production"}]}`,
+			`{"subtotal": 2, "results": [{"id": 2, "name": "node02.example.com"}]}`,
+		},
+		"/api/v2/hosts/1/interfaces": {`{"subtotal": 3, "results": [
+			{"identifier": "ipmi", "mac": "de:ad:be:ef:00:09", "type": "bmc"},
+			{"identifier": "eth1", "mac": "de:ad:be:ef:00:02"},
+			{"identifier": "eth0", "mac": "de:ad:be:ef:00:01", "ip": "192.0.2.1", "subnet_id": 3, "primary": true}]}`},
+		"/api/v2/hosts/1/parameters":                      {`{"subtotal": 1, "results": [{"name": "rack", "value": 12}]}`},
+		"/api/v2/hosts/2/interfaces":                      {`{"subtotal": 0, "results": []}`},
+		"/api/v2/hosts/2/parameters":                      {`{"subtotal": 0, "results": []}`},
+		"/api/v2/operatingsystems/2/os_default_templates": {`{"subtotal": 2, "results": [{"template_kind_name": "provision", "provisioning_template_name": "Kickstart default"}, {"template_kind_name": "PXELinux", "provisioning_template_name": "PXELinux default"}]}`},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "admin" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		p := pages[r.URL.Path]
+		page := 0
+		if r.URL.Query().Get("page") == "2" {
+			page = 1
+		}
+		if page >= len(p) {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(p[page]))
+	}))
+	defer server.Close()
+
+	source, err := newImportSource("foreman", server.URL+"/", "admin", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := source.hosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 2 {
+		t.Fatalf("expected both pages of hosts, got %+v", hosts)
+	}
+	m := hosts[0].Machine
+	if hosts[0].Hostname != "node01.example.com" || m.OperatingSystem != "CentOS 7" || m.Labels["hostgroup"] != "web/prod" ||
+		m.Params["rack"] != "12" || m.Puppet == nil || m.Puppet.Environment != "production" {
+		t.Errorf("unexpected machine %+v", m)
+	}
+	if len(m.Network) != 2 || m.Network[0].Name != "eth0" || m.Network[0].Addresses4[0].Cidr != "24" ||
+		m.Network[0].Addresses4[0].Netmask != "255.255.255.0" || m.Network[0].Gateway4 != "192.0.2.254" {
+		t.Errorf("expected the primary interface first without the bmc, got %+v", m.Network)
+	}
+	if m.Preseed != "kickstart-default.j2" || m.Finish != "" || hosts[0].Templates["kickstart-default.j2"] == "" {
+		t.Errorf("expected the provision template as preseed, got %+v %v", m, hosts[0].Templates)
+	}
+
+	wrong, _ := newImportSource("foreman", server.URL, "admin", "wrong")
+	if _, err := wrong.hosts(); err == nil {
+		t.Error("expected the wrong password to fail")
+	}
+}
+
+func TestCobblerImport(t *testing.T) {
+	str := func(s string) string {
+		var b strings.Builder
+		xml.EscapeText(&b, []byte(s))
+		return "<value><string>" + b.String() + "</string></value>"
+	}
+	object := func(members ...string) string {
+		s := "<value><struct>"
+		for i := 0; i+1 < len(members); i += 2 {
+			s += "<member><name>" + members[i] + "</name>" + members[i+1] + "</member>"
+		}
+		return s + "</struct></value>"
+	}
+	list := func(values ...string) string {
+		return "<methodResponse><params><param><value><array><data>" + strings.Join(values, "") + "</data></array></value></param></params></methodResponse>"
+	}
+	responses := map[string]string{
+		"get_distros": list(object("name", str("centos7"), "breed", str("redhat"), "os_version", str("rhel7"),
+			"kernel_options", object("console", str("ttyS0")))),
+		"get_profiles": list(
+			object("name", str("base"), "distro", str("centos7"), "kickstart", "<value>/var/lib/cobbler/kickstarts/base.ks</value>",
+				"kernel_options", object("quiet", "<value><nil/></value>")),
+			object("name", str("web"), "parent", str("base"), "distro", str(cobblerInherit), "kickstart", str(cobblerInherit),
+				"ks_meta", str("role=web tree=http://mirror/centos"))),
+		"get_systems": list(
+			object("name", str("node01"), "hostname", str("node01.example.com"), "profile", str("web"), "gateway", str("192.0.2.254"),
+				"kernel_options", str("console=tty0"), "interfaces", object(
+					"eth0", object("mac_address", str("DE:AD:BE:EF:00:01"), "ip_address", str("192.0.2.1"), "netmask", str("255.255.255.0"),
+						"management", "<value><boolean>0</boolean></value>", "mtu", "<value><int>1500</int></value>"),
+					"ipmi", object("mac_address", str("de:ad:be:ef:00:09"), "interface_type", str("bmc"))))),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var call struct {
+			MethodName string `xml:"methodName"`
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		xml.Unmarshal(body, &call)
+		response, found := responses[call.MethodName]
+		if !found {
+			response = `<methodResponse><fault>` + object("faultCode", "<value><int>1</int></value>", "faultString", str("unknown method")) + `</fault></methodResponse>`
+		}
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	source, err := newImportSource("cobbler", server.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := source.hosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 {
+		t.Fatalf("expected one host, got %+v", hosts)
+	}
+	m := hosts[0].Machine
+	if hosts[0].Hostname != "node01.example.com" || m.OperatingSystem != "rhel7" || m.Labels["profile"] != "web" || m.Labels["distro"] != "centos7" {
+		t.Errorf("unexpected machine %+v", m)
+	}
+	if m.Cmdline != "console=tty0 quiet" || m.Params["role"] != "web" || m.Params["tree"] != "http://mirror/centos" {
+		t.Errorf("expected the options merged along the profile chain, got %q %v", m.Cmdline, m.Params)
+	}
+	if m.Preseed != "base.ks.j2" || !strings.Contains(hosts[0].Templates["base.ks.j2"], "/var/lib/cobbler/kickstarts/base.ks") {
+		t.Errorf("expected the parent profile's kickstart, got %q %v", m.Preseed, hosts[0].Templates)
+	}
+	if len(m.Network) != 1 || m.Network[0].MacAddress != "de:ad:be:ef:00:01" || m.Network[0].Addresses4[0].Cidr != "24" || m.Network[0].Gateway4 != "192.0.2.254" {
+		t.Errorf("unexpected network %+v", m.Network)
+	}
+
+	if _, err := xmlrpcCall(http.DefaultClient, server.URL, "get_images"); err == nil || !strings.Contains(err.Error(), "unknown method") {
+		t.Errorf("expected the fault as error, got %v", err)
+	}
+}
+
+func TestWriteImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-import")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "node02.example.com.yaml"), []byte(`{"operatingsystem": "debian"}`), 0644)
+
+	hosts := []importedHost{
+		{Hostname: "Node01.example.com", Machine: importedMachine{OperatingSystem: "CentOS 7", Preseed: "base.ks.j2"},
+			Templates: map[string]string{"base.ks.j2": `cobbler kickstart "base.ks"`}},
+		{Hostname: "node02.example.com", Machine: importedMachine{OperatingSystem: "CentOS 7"}},
+		{Hostname: "not a hostname"},
+	}
+	written, skipped, err := writeImport(hosts, dir, dir, false)
+	if err != nil || written != 1 || skipped != 2 {
+		t.Fatalf("expected one written and two skipped, got %d %d %v", written, skipped, err)
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dir, "node01.example.com.yaml"))
+	var m machine.Machine
+	if err := yaml.Unmarshal(data, &m); err != nil || m.OperatingSystem != "CentOS 7" || m.Preseed != "base.ks.j2" {
+		t.Errorf("expected a machine definition, got %s %v", data, err)
+	}
+	if stub, _ := ioutil.ReadFile(filepath.Join(dir, "base.ks.j2")); !strings.Contains(string(stub), "base.ks") {
+		t.Errorf("expected a template stub, got %q", stub)
+	}
+	if m, _ := machine.MachineDefinition("node02.example.com", dir, config.Config{MachinePath: dir, GroupPath: dir}); m.OperatingSystem != "debian" {
+		t.Error("expected the existing definition to be left alone")
+	}
+
+	if written, _, _ := writeImport(hosts[1:2], dir, "", true); written != 1 {
+		t.Error("expected --overwrite to replace the definition")
+	}
+	if m, _ := machine.MachineDefinition("node02.example.com", dir, config.Config{MachinePath: dir, GroupPath: dir}); m.OperatingSystem != "CentOS 7" {
+		t.Errorf("expected the imported definition, got %+v", m)
+	}
+}
+
+func TestMaaSImport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.Contains(auth, `oauth_consumer_key="consumer"`) || !strings.Contains(auth, `oauth_signature="&secret"`) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/MAAS/api/2.0/machines/":
+			if r.URL.Query().Get("op") == "power_parameters" {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write([]byte(`[{"system_id": "4y3h7n", "fqdn": "node01.example.com", "osystem": "ubuntu", "distro_series": "jammy",
+				"power_type": "ipmi", "tag_names": ["gpu", "ssd"], "zone": {"name": "dc1"}, "pool": {"name": "compute"},
+				"boot_interface": {"id": 2},
+				"interface_set": [
+					{"id": 1, "name": "eno2", "type": "physical", "mac_address": "DE:AD:BE:EF:00:02", "links": []},
+					{"id": 2, "name": "eno1", "type": "physical", "mac_address": "DE:AD:BE:EF:00:01", "links": [
+						{"mode": "static", "ip_address": "192.0.2.1", "subnet": {"cidr": "192.0.2.0/24", "gateway_ip": "192.0.2.254"}},
+						{"mode": "auto", "ip_address": "2001:db8::1", "subnet": {"cidr": "2001:db8::/64", "gateway_ip": "2001:db8::fe"}}]},
+					{"id": 3, "name": "bond0", "type": "bond", "mac_address": "DE:AD:BE:EF:00:01", "links": []}]}]`))
+		case "/MAAS/api/2.0/machines/4y3h7n/":
+			w.Write([]byte(`{"power_address": "10.0.0.5", "power_user": "admin", "power_pass": "hunter2", "power_driver": "LAN_2_0"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	source, err := newImportSource("maas", server.URL+"/MAAS", "", "consumer:token:secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts, err := source.hosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 {
+		t.Fatalf("expected one machine, got %+v", hosts)
+	}
+	m := hosts[0].Machine
+	if hosts[0].Hostname != "node01.example.com" || m.OperatingSystem != "ubuntu" || m.Params["distro_series"] != "jammy" ||
+		m.Labels["zone"] != "dc1" || m.Labels["pool"] != "compute" || m.Params["maas_tags"] != "gpu,ssd" {
+		t.Errorf("unexpected machine %+v", m)
+	}
+	if m.Params["power_type"] != "ipmi" || m.Params["power_address"] != "10.0.0.5" || m.Params["ipmi_address"] != "10.0.0.5" ||
+		m.Params["power_user"] != "admin" || m.Params["power_pass"] != "" {
+		t.Errorf("expected the power parameters without the password, got %v", m.Params)
+	}
+	if len(m.Network) != 2 || m.Network[0].Name != "eno1" || m.Network[0].MacAddress != "de:ad:be:ef:00:01" {
+		t.Fatalf("expected the physical interfaces, boot interface first, got %+v", m.Network)
+	}
+	if a := m.Network[0].Addresses4; len(a) != 1 || a[0].Cidr != "24" || a[0].Netmask != "255.255.255.0" || m.Network[0].Gateway4 != "192.0.2.254" {
+		t.Errorf("unexpected IPv4 config %+v", m.Network[0])
+	}
+	if a := m.Network[0].Addresses6; len(a) != 1 || a[0].Cidr != "64" || m.Network[0].Gateway6 != "2001:db8::fe" {
+		t.Errorf("unexpected IPv6 config %+v", m.Network[0])
+	}
+
+	wrong, _ := newImportSource("maas", server.URL+"/MAAS", "", "consumer:token:wrong")
+	if _, err := wrong.hosts(); err == nil {
+		t.Error("expected the wrong key to fail")
+	}
+	if _, err := maasAuthorization("not-a-key"); err == nil {
+		t.Error("expected a malformed key to be refused")
+	}
+}
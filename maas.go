@@ -0,0 +1,214 @@
+package waitron
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ns1/waitron/machine"
+)
+
+// Reading machines from Canonical MaaS's API 2.0 for `waitron import`. The
+// API key, consumer:token:secret as `maas apikey` prints it, signs requests
+// the way MaaS expects, OAuth 1.0 with PLAINTEXT signatures. Physical
+// interfaces become the network, the boot interface first, with their
+// static or assigned addresses. Power parameters become params, except for
+// passwords, which are left for the operator to add.
+
+type maasSource struct {
+	url    string
+	key    string
+	client *http.Client
+}
+
+type maasMachine struct {
+	SystemID     string          `json:"system_id"`
+	FQDN         string          `json:"fqdn"`
+	OSystem      string          `json:"osystem"`
+	DistroSeries string          `json:"distro_series"`
+	Architecture string          `json:"architecture"`
+	PowerType    string          `json:"power_type"`
+	TagNames     []string        `json:"tag_names"`
+	Zone         maasName        `json:"zone"`
+	Pool         maasName        `json:"pool"`
+	BootID       *maasBootID     `json:"boot_interface"`
+	Interfaces   []maasInterface `json:"interface_set"`
+}
+
+type maasName struct {
+	Name string `json:"name"`
+}
+
+type maasBootID struct {
+	ID int `json:"id"`
+}
+
+type maasInterface struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	MACAddress string     `json:"mac_address"`
+	Links      []maasLink `json:"links"`
+}
+
+type maasLink struct {
+	Mode      string `json:"mode"`
+	IPAddress string `json:"ip_address"`
+	Subnet    *struct {
+		CIDR      string `json:"cidr"`
+		GatewayIP string `json:"gateway_ip"`
+	} `json:"subnet"`
+}
+
+// The Authorization header for a request with key
+func maasAuthorization(key string) (string, error) {
+	parts := strings.Split(key, ":")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("the MaaS API key must be consumer:token:secret")
+	}
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`OAuth oauth_version="1.0", oauth_signature_method="PLAINTEXT", oauth_consumer_key="%s", oauth_token="%s", oauth_signature="&%s", oauth_nonce="%s", oauth_timestamp="%d"`,
+		parts[0], parts[1], parts[2], hex.EncodeToString(nonce), time.Now().Unix()), nil
+}
+
+func (s *maasSource) get(path string, into interface{}) error {
+	request, err := http.NewRequest("GET", s.url+"/api/2.0"+path, nil)
+	if err != nil {
+		return err
+	}
+	auth, err := maasAuthorization(s.key)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", auth)
+	request.Header.Set("Accept", "application/json")
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", path, response.Status)
+	}
+	return json.NewDecoder(response.Body).Decode(into)
+}
+
+func (s *maasSource) hosts() ([]importedHost, error) {
+	var machines []maasMachine
+	if err := s.get("/machines/", &machines); err != nil {
+		return nil, err
+	}
+	sort.Slice(machines, func(i, j int) bool { return machines[i].FQDN < machines[j].FQDN })
+
+	hosts := make([]importedHost, 0, len(machines))
+	for _, m := range machines {
+		power := make(map[string]interface{})
+		if m.PowerType != "" {
+			if err := s.get("/machines/"+m.SystemID+"/?op=power_parameters", &power); err != nil {
+				return nil, fmt.Errorf("%s: %s", m.FQDN, err)
+			}
+		}
+		hosts = append(hosts, maasHost(m, power))
+	}
+	return hosts, nil
+}
+
+func maasHost(m maasMachine, power map[string]interface{}) importedHost {
+	h := importedHost{
+		Hostname: m.FQDN,
+		Machine: importedMachine{
+			OperatingSystem: m.OSystem,
+			Params:          map[string]string{"maas_system_id": m.SystemID},
+			Labels:          map[string]string{},
+			Network:         maasNetwork(m),
+		},
+	}
+	if m.DistroSeries != "" {
+		h.Machine.Params["distro_series"] = m.DistroSeries
+	}
+	if m.Architecture != "" {
+		h.Machine.Params["architecture"] = m.Architecture
+	}
+	if len(m.TagNames) > 0 {
+		h.Machine.Params["maas_tags"] = strings.Join(m.TagNames, ",")
+	}
+	if m.Zone.Name != "" {
+		h.Machine.Labels["zone"] = m.Zone.Name
+	}
+	if m.Pool.Name != "" {
+		h.Machine.Labels["pool"] = m.Pool.Name
+	}
+
+	if m.PowerType != "" {
+		h.Machine.Params["power_type"] = m.PowerType
+	}
+	for k, v := range power {
+		if strings.Contains(k, "pass") || v == nil || v == "" {
+			continue
+		}
+		h.Machine.Params["power_"+strings.TrimPrefix(k, "power_")] = fmt.Sprint(v)
+	}
+	// What the example templates use for IPMI
+	if address := h.Machine.Params["power_address"]; m.PowerType == "ipmi" && address != "" {
+		h.Machine.Params["ipmi_address"] = address
+	}
+	return h
+}
+
+func maasNetwork(m maasMachine) []machine.Interface {
+	bootID := -1
+	if m.BootID != nil {
+		bootID = m.BootID.ID
+	}
+	var boot, others []machine.Interface
+	for _, i := range m.Interfaces {
+		if i.Type != "physical" {
+			continue
+		}
+		iface := machine.Interface{Name: i.Name, MacAddress: strings.ToLower(i.MACAddress)}
+		for _, l := range i.Links {
+			if l.IPAddress == "" {
+				continue
+			}
+			address := machine.IPConfig{IPAddress: l.IPAddress}
+			gateway := ""
+			if l.Subnet != nil {
+				if _, network, err := net.ParseCIDR(l.Subnet.CIDR); err == nil {
+					bits, _ := network.Mask.Size()
+					address.Cidr = strconv.Itoa(bits)
+					if network.IP.To4() != nil {
+						address.Netmask = net.IP(network.Mask).String()
+					}
+				}
+				gateway = l.Subnet.GatewayIP
+			}
+			if net.ParseIP(l.IPAddress).To4() != nil {
+				iface.Addresses4 = append(iface.Addresses4, address)
+				if iface.Gateway4 == "" {
+					iface.Gateway4 = gateway
+				}
+			} else {
+				iface.Addresses6 = append(iface.Addresses6, address)
+				if iface.Gateway6 == "" {
+					iface.Gateway6 = gateway
+				}
+			}
+		}
+		if i.ID == bootID {
+			boot = append(boot, iface)
+		} else {
+			others = append(others, iface)
+		}
+	}
+	return append(boot, others...)
+}
@@ -0,0 +1,13 @@
+package machine
+
+import (
+	"time"
+)
+
+// Annotations are operator notes attached to a machine, kept in the state
+// store rather than the machine definition.
+type Annotations struct {
+	Notes       string            `json:",omitempty"`
+	Annotations map[string]string `json:",omitempty"`
+	UpdatedAt   time.Time
+}
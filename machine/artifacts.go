@@ -0,0 +1,25 @@
+package machine
+
+import (
+	"time"
+)
+
+// ArtifactInfo is what a build record says about one of its artifacts
+type ArtifactInfo struct {
+	Name        string
+	ContentType string
+	Size        int64
+	SHA256      string
+	Uploaded    time.Time
+}
+
+// Where m lists the artifact name, -1 if it doesn't. Callers must hold
+// state.Mux if m is in state.
+func (m *Machine) ArtifactIndex(name string) int {
+	for i, a := range m.Artifacts {
+		if a.Name == name {
+			return i
+		}
+	}
+	return -1
+}
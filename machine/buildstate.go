@@ -0,0 +1,140 @@
+package machine
+
+import (
+	"fmt"
+	"time"
+)
+
+// BuildState is where a build is in its lifecycle. A build starts pending
+// when its token is issued and goes through the pre-install stages it has
+// first, updating-firmware, configuring-raid, burning-in and wiping, see
+// state/preinstall.go. It is booting once its boot config is served or its VM is
+// booted, installing once the installer fetches its preseed or cloud-init
+// or reports progress, and finishing once it fetches its finish template.
+// With validation, /done makes it validating until its checks pass, see
+// state/validate.go. It ends done, or booted when validation waited for the
+// installed system to phone home, or cancelled. failed and stale are where
+// hooks that fail and the stale watcher put it, a retry takes it back to
+// pending.
+// Only the moves in buildTransitions are allowed, every one is timestamped
+// in the build's Transitions and emitted as a build-state-changed event.
+//
+// Status is derived from the state for clients that predate it: Installing
+// until the build is done or booted, then Installed, or Terminated once
+// cancelled.
+type BuildState string
+
+const (
+	BuildPending          BuildState = "pending"
+	BuildUpdatingFirmware BuildState = "updating-firmware"
+	BuildConfiguringRAID  BuildState = "configuring-raid"
+	BuildBurningIn        BuildState = "burning-in"
+	BuildWiping           BuildState = "wiping"
+	BuildBooting          BuildState = "booting"
+	BuildInstalling       BuildState = "installing"
+	BuildFinishing        BuildState = "finishing"
+	BuildValidating       BuildState = "validating"
+	BuildDone             BuildState = "done"
+	BuildBooted           BuildState = "booted"
+	BuildFailed           BuildState = "failed"
+	BuildCancelled        BuildState = "cancelled"
+	BuildStale            BuildState = "stale"
+)
+
+// Where a build can go from each state, done, booted and cancelled are final
+var buildTransitions = map[BuildState][]BuildState{
+	BuildPending:          {BuildUpdatingFirmware, BuildConfiguringRAID, BuildBurningIn, BuildWiping, BuildBooting, BuildInstalling, BuildFinishing, BuildValidating, BuildDone, BuildFailed, BuildCancelled, BuildStale},
+	BuildBooting:          {BuildInstalling, BuildFinishing, BuildValidating, BuildDone, BuildFailed, BuildCancelled, BuildStale},
+	BuildInstalling:       {BuildFinishing, BuildValidating, BuildDone, BuildFailed, BuildCancelled, BuildStale},
+	BuildFinishing:        {BuildValidating, BuildDone, BuildFailed, BuildCancelled, BuildStale},
+	BuildUpdatingFirmware: {BuildConfiguringRAID, BuildBurningIn, BuildWiping, BuildPending, BuildFailed, BuildCancelled},
+	BuildConfiguringRAID:  {BuildBurningIn, BuildWiping, BuildPending, BuildFailed, BuildCancelled},
+	BuildBurningIn:        {BuildWiping, BuildPending, BuildFailed, BuildCancelled},
+	BuildWiping:           {BuildPending, BuildFailed, BuildCancelled},
+	BuildValidating:       {BuildDone, BuildBooted, BuildFailed, BuildCancelled},
+	BuildFailed:           {BuildPending, BuildValidating, BuildDone, BuildBooted, BuildCancelled},
+	BuildStale:            {BuildPending, BuildInstalling, BuildFinishing, BuildValidating, BuildDone, BuildFailed, BuildCancelled},
+}
+
+// The state a phase Waitron observes moves a build to
+var PhaseStates = map[string]BuildState{
+	PhaseVMBooted:   BuildBooting,
+	PhaseBootServed: BuildBooting,
+	PhasePreseed:    BuildInstalling,
+	PhaseCloudInit:  BuildInstalling,
+	PhaseFinish:     BuildFinishing,
+}
+
+// StateTransition is a move of a build from one state to another
+type StateTransition struct {
+	From      BuildState `json:",omitempty"`
+	To        BuildState
+	Timestamp time.Time
+	Reason    string `json:",omitempty"`
+}
+
+func (s BuildState) CanMoveTo(to BuildState) bool {
+	for _, next := range buildTransitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// The Status clients that predate BuildState see
+func (s BuildState) status() string {
+	switch s {
+	case BuildDone, BuildBooted:
+		return "Installed"
+	case BuildCancelled:
+		return "Terminated"
+	}
+	return "Installing"
+}
+
+func (t StateTransition) Message() string {
+	message := string(t.To)
+	if t.From != "" {
+		message = fmt.Sprintf("%s -> %s", t.From, t.To)
+	}
+	if t.Reason != "" {
+		message += ": " + t.Reason
+	}
+	return message
+}
+
+// Move m to state to, for reason if any. A build without a state yet is
+// taken as pending. Moving to the state m is already in does nothing and
+// returns nil. Callers must hold state.Mux if m is in state, and emit the
+// transition returned with state.emitTransition once they let go of it.
+func (m *Machine) SetState(to BuildState, reason string) (*StateTransition, error) {
+	if m.State == to {
+		return nil, nil
+	}
+	from := m.State
+	if from == "" {
+		from = BuildPending
+	}
+	if to != from && !from.CanMoveTo(to) {
+		return nil, fmt.Errorf("build of %s cannot go from %s to %s", m.Hostname, m.State, to)
+	}
+	t := StateTransition{From: m.State, To: to, Timestamp: time.Now(), Reason: reason}
+	m.State = to
+	m.Status = to.status()
+	m.Transitions = append(m.Transitions, t)
+	return &t, nil
+}
+
+// Move m along with a phase it went through, if that's a move forward.
+// Observed phases come in any order, a machine that network boots again
+// while it installs is served its boot config again, so one that would go
+// back is only a phase. Callers must hold state.Mux if m is in state.
+func (m *Machine) Advance(phase string) *StateTransition {
+	to, found := PhaseStates[phase]
+	if !found || (m.State != "" && !m.State.CanMoveTo(to)) {
+		return nil
+	}
+	t, _ := m.SetState(to, "")
+	return t
+}
@@ -0,0 +1,42 @@
+package machine
+
+import (
+	"time"
+)
+
+// A build with burn_in is burning-in before it is installed, see
+// state/preinstall.go: its machine boots a stress or memtest image, which gets
+// machine.BurnIn.DurationSeconds through its cmdline, posts its results to
+// /burnin/<hostname>/<token> and reboots. Only a machine that passes goes
+// on to be installed.
+
+// How long past duration_secs a burn-in has to report by default
+const defaultBurnInGraceSeconds = 3600
+
+// BurnInResult is what a burn-in image reports
+type BurnInResult struct {
+	Passed  bool
+	Message string `json:",omitempty"`
+
+	// Free form details, e.g. memtest errors or temperatures
+	Results map[string]string `json:",omitempty"`
+
+	Reported time.Time
+}
+
+var BurnInStage = &PreinstallStage{
+	Name:        "burn-in",
+	State:       BuildBurningIn,
+	PassedEvent: EventBurnInPassed,
+	Image: func(m *Machine) (stageImage, time.Duration, bool) {
+		b := m.BurnIn
+		if b == nil || b.Kernel == "" {
+			return stageImage{}, 0, false
+		}
+		timeout := time.Duration(b.DurationSeconds+defaultBurnInGraceSeconds) * time.Second
+		if b.TimeoutSeconds > 0 {
+			timeout = time.Duration(b.TimeoutSeconds) * time.Second
+		}
+		return stageImage{ImageURL: b.ImageURL, Kernel: b.Kernel, Initrd: b.Initrd, Cmdline: b.Cmdline}, timeout, true
+	},
+}
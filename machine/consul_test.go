@@ -0,0 +1,159 @@
+package machine
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+)
+
+// A Consul KV endpoint that answers blocking queries
+type fakeConsul struct {
+	mux     sync.Mutex
+	index   uint64
+	values  map[string]string
+	changed chan struct{}
+}
+
+func newFakeConsul(values map[string]string) (*fakeConsul, *httptest.Server) {
+	c := &fakeConsul{index: 1, values: values, changed: make(chan struct{})}
+	return c, httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("X-Consul-Token") != "secret" {
+			response.WriteHeader(http.StatusForbidden)
+			return
+		}
+		index, _ := strconv.ParseUint(request.URL.Query().Get("index"), 10, 64)
+
+		c.mux.Lock()
+		if index >= c.index {
+			changed := c.changed
+			c.mux.Unlock()
+			select {
+			case <-changed:
+			case <-time.After(time.Second):
+			}
+			c.mux.Lock()
+		}
+		defer c.mux.Unlock()
+
+		prefix := strings.TrimPrefix(request.URL.Path, "/v1/kv/")
+		entries := []config.ConsulEntry{}
+		for k, v := range c.values {
+			if strings.HasPrefix(k, prefix) {
+				entries = append(entries, config.ConsulEntry{Key: k, Value: []byte(v), ModifyIndex: uint64(len(v))})
+			}
+		}
+		response.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+		json.NewEncoder(response).Encode(entries)
+	}))
+}
+
+func (c *fakeConsul) set(key string, value string) {
+	c.mux.Lock()
+	c.values[key] = value
+	c.index++
+	close(c.changed)
+	c.changed = make(chan struct{})
+	c.mux.Unlock()
+}
+
+func TestConsulDefinitions(t *testing.T) {
+	_, ts := newFakeConsul(map[string]string{
+		"waitron/machines/node01.example.com.yaml": `{"operatingsystem": "debian"}`,
+		"waitron/machines/node01.example.com.yml":  `{"operatingsystem": "ignored"}`,
+		"waitron/machines/":                        "",
+		"waitron/groups/example.com":               `{"operatingsystem": "ubuntu", "finish": "finish.j2"}`,
+		"other/machines/node02.example.com.yaml":   `{}`,
+	})
+	defer ts.Close()
+
+	kv, err := config.NewConsulKV(config.ConsulConfig{Address: ts.URL, Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := MachineDefinition("node01.example.com", "", config.Config{ConsulKV: kv})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.OperatingSystem != "debian" || m.Finish != "finish.j2" {
+		t.Errorf("expected the machine to be merged over its group, got %+v", m)
+	}
+
+	if _, err := MachineDefinition("node02.example.com", "", config.Config{ConsulKV: kv}); !os.IsNotExist(err) {
+		t.Errorf("expected a machine outside the prefix not to be found, got %v", err)
+	}
+	if files := kv.MachineFiles(); len(files) != 1 || files[0].Name != "node01.example.com.yaml" {
+		t.Errorf("unexpected machine files %+v", files)
+	}
+	if err := kv.Healthy(); err != nil {
+		t.Errorf("expected consul to be healthy, got %v", err)
+	}
+
+	if _, err := config.NewConsulKV(config.ConsulConfig{Address: ts.URL}); err == nil {
+		t.Error("expected a missing token to fail")
+	}
+}
+
+func TestConsulWatch(t *testing.T) {
+	consul, ts := newFakeConsul(map[string]string{
+		"waitron/machines/node01.example.com.yaml": `{"network": [{"macaddress": "AA:BB:CC:00:00:01"}]}`,
+		"waitron/groups/example.com.yaml":          `{"labels": {"rack": "r1"}}`,
+	})
+	defer ts.Close()
+
+	kv, err := config.NewConsulKV(config.ConsulConfig{Address: ts.URL, Token: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	inv := NewInventory(config.Config{ConsulKV: kv})
+	if err := inv.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if e, found := inv.LookupMAC("aa:bb:cc:00:00:01"); !found || e.Hostname != "node01.example.com" || e.Labels["rack"] != "r1" {
+		t.Errorf("expected the machine to be indexed from consul, got %+v", e)
+	}
+
+	groupChanged := kv.ModTime("", "example.com")
+	refreshed := make(chan struct{}, 1)
+	kv.Subscribe(func() {
+		inv.Refresh()
+		refreshed <- struct{}{}
+	})
+	stop := make(chan struct{})
+	defer close(stop)
+	kv.Watch(stop)
+
+	consul.set("waitron/machines/node02.example.com.yaml", `{"network": [{"macaddress": "AA:BB:CC:00:00:02"}], "labels": {"rack": "r2"}}`)
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the change to be picked up")
+	}
+
+	if e, found := inv.LookupHostname("node02.example.com"); !found || e.Labels["rack"] != "r2" {
+		t.Errorf("expected the new machine to be indexed, got %+v", e)
+	}
+	if !kv.ModTime("", "example.com").Equal(groupChanged) {
+		t.Error("expected an unchanged group to keep its modification time")
+	}
+
+	ts.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for kv.Healthy() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if kv.Healthy() == nil {
+		t.Error("expected consul going away to be reported")
+	}
+	if _, err := kv.Machine("node01.example.com"); err != nil {
+		t.Errorf("expected the last definitions to be kept, got %v", err)
+	}
+}
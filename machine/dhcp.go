@@ -0,0 +1,31 @@
+package machine
+
+import (
+	"time"
+)
+
+// DHCPLease is the lease of one of a machine's MAC addresses
+type DHCPLease struct {
+	MacAddress string
+	IPAddress  string
+	Hostname   string     `json:",omitempty"`
+	Renewed    *time.Time `json:",omitempty"`
+	// Zero when it doesn't expire
+	Expires time.Time
+}
+
+func (l *DHCPLease) Same(o *DHCPLease) bool {
+	if l == nil || o == nil {
+		return l == o
+	}
+	return l.MacAddress == o.MacAddress && l.IPAddress == o.IPAddress && l.Hostname == o.Hostname &&
+		l.Expires.Equal(o.Expires) && (l.Renewed == o.Renewed || (l.Renewed != nil && o.Renewed != nil && l.Renewed.Equal(*o.Renewed)))
+}
+
+// Whether l is more recent than o
+func (l DHCPLease) Newer(o DHCPLease) bool {
+	if l.Renewed != nil && o.Renewed != nil && !l.Renewed.Equal(*o.Renewed) {
+		return l.Renewed.After(*o.Renewed)
+	}
+	return l.Expires.After(o.Expires) || (l.Expires.IsZero() && !o.Expires.IsZero())
+}
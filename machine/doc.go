@@ -0,0 +1,8 @@
+// Package machine is what Waitron knows about machines: their definitions,
+// from files, patterns, consul, git, inventory plugins and profiles, their
+// network and partitioning, and the inventory that indexes them.
+package machine
+
+import "github.com/ns1/waitron/config"
+
+var logger = config.Log
@@ -0,0 +1,35 @@
+package machine
+
+import (
+	"time"
+)
+
+const defaultBuildOverduePercent = 20
+
+// BuildETA is when a build in progress should be done
+type BuildETA struct {
+	// From the median of earlier builds
+	Estimated time.Time
+	// The build takes longer than 95% of earlier builds past this
+	P95     time.Time
+	Samples int
+	// Ran build_overdue_percent past P95
+	Overdue bool `json:",omitempty"`
+}
+
+// When the build of m is overdue, zero if it never is before going stale
+func (m *Machine) OverdueAt() time.Time {
+	if m.ETA == nil {
+		return time.Time{}
+	}
+	percent := m.BuildOverduePercent
+	if percent <= 0 {
+		percent = defaultBuildOverduePercent
+	}
+	p95 := m.ETA.P95.Sub(m.BuildStart)
+	due := m.BuildStart.Add(p95 + p95*time.Duration(percent)/100)
+	if m.StaleBuildThresholdSeconds > 0 && !due.Before(m.BuildStart.Add(time.Duration(m.StaleBuildThresholdSeconds)*time.Second)) {
+		return time.Time{}
+	}
+	return due
+}
@@ -0,0 +1,26 @@
+package machine
+
+// Event types emitted over a build's lifecycle
+const (
+	EventBuildStarted    = "build-started"
+	EventBuildCompleted  = "build-completed"
+	EventBuildCancelled  = "build-cancelled"
+	EventBuildFailed     = "build-failed"
+	EventBuildStale      = "build-stale"
+	EventBuildRetried    = "build-retried"
+	EventBuildOverdue    = "build-overdue"
+	EventFirmwareUpdated = "firmware-updated"
+	EventRAIDConfigured  = "raid-configured"
+	EventBurnInPassed    = "burn-in-passed"
+	EventDisksWiped      = "disks-wiped"
+
+	// Every move a build makes between the states in buildstate.go
+	EventBuildStateChanged = "build-state-changed"
+
+	// A bulk build stopped starting hosts after too many failed, see state/bulk.go
+	EventBulkBuildPaused = "bulk-build-paused"
+
+	EventHookFailed     = "hook-failed"
+	EventHookTimeout    = "hook-timeout"
+	EventHookDeadLetter = "hook-dead-lettered"
+)
@@ -0,0 +1,76 @@
+package machine
+
+import (
+	"time"
+
+	"github.com/ns1/waitron/config"
+)
+
+// A build whose machine has firmware configured for its hardware model is
+// updating-firmware first, see state/preinstall.go. Its machine boots a firmware
+// update image, which gets what to apply from /firmware/<hostname>/<token>,
+// applies it, posts how every component went to the same URL and reboots.
+// The model is the machine's label named by model_label, model by default.
+// A machine whose model has nothing configured skips the stage.
+
+const (
+	defaultFirmwareTimeoutSeconds = 3600
+	defaultFirmwareModelLabel     = "model"
+)
+
+// FirmwareManifest is what the image applies to a machine
+type FirmwareManifest struct {
+	Model      string
+	Components map[string]config.FirmwarePackage
+}
+
+// FirmwareComponentResult is how updating one component went
+type FirmwareComponentResult struct {
+	Component string
+	From      string `json:",omitempty"`
+	To        string `json:",omitempty"`
+	Passed    bool
+	Message   string `json:",omitempty"`
+}
+
+// FirmwareResult is what a firmware update image reports
+type FirmwareResult struct {
+	Components []FirmwareComponentResult
+	Message    string `json:",omitempty"`
+	Reported   time.Time
+}
+
+// What m's hardware model is to get, nil when there's nothing for it
+func (m *Machine) FirmwareManifest() *FirmwareManifest {
+	f := m.Firmware
+	if f == nil || f.Kernel == "" {
+		return nil
+	}
+	label := f.ModelLabel
+	if label == "" {
+		label = defaultFirmwareModelLabel
+	}
+	model := m.Labels[label]
+	components := f.Models[model]
+	if model == "" || len(components) == 0 {
+		return nil
+	}
+	return &FirmwareManifest{Model: model, Components: components}
+}
+
+var FirmwareStage = &PreinstallStage{
+	Name:        "firmware",
+	State:       BuildUpdatingFirmware,
+	PassedEvent: EventFirmwareUpdated,
+	Image: func(m *Machine) (stageImage, time.Duration, bool) {
+		if m.FirmwareManifest() == nil {
+			return stageImage{}, 0, false
+		}
+		f := m.Firmware
+		timeout := time.Duration(defaultFirmwareTimeoutSeconds) * time.Second
+		if f.TimeoutSeconds > 0 {
+			timeout = time.Duration(f.TimeoutSeconds) * time.Second
+		}
+		return stageImage{ImageURL: f.ImageURL, Kernel: f.Kernel, Initrd: f.Initrd, Cmdline: f.Cmdline}, timeout, true
+	},
+}
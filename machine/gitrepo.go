@@ -0,0 +1,367 @@
+package machine
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/ns1/waitron/config"
+	"gopkg.in/yaml.v2"
+)
+
+// Machine and group definitions and templates can come from a git repository.
+// Waitron keeps a bare clone under the git path, fetches it every sync_secs
+// and on POST /admin/sync, and checks every new commit out into a directory of
+// its own. A commit is only served once all its definitions parse and its
+// templates compile; the current symlink then moves over to it, so machinepath,
+// grouppath and templatepath always point at a complete, valid checkout and a
+// bad push leaves the previous commit in place:
+//
+//	<path>/repo.git
+//	<path>/checkouts/<commit>
+//	<path>/current -> checkouts/<commit>
+
+const (
+	defaultGitSyncSeconds = 300
+	gitCommandTimeout     = 5 * time.Minute
+	MaxWebhookBody        = 10 << 20
+)
+
+// GitSyncStatus is what is served from the repository and how the last sync went
+type GitSyncStatus struct {
+	Commit   string
+	Synced   time.Time `json:",omitempty"`
+	Rejected string    `json:",omitempty"` // the newest commit, when it failed validation
+	Error    string    `json:",omitempty"`
+}
+
+// A commit that can't be served
+type GitValidationError struct {
+	commit string
+	err    error
+}
+
+func (e *GitValidationError) Error() string {
+	return fmt.Sprintf("commit %s: %s", e.commit, e.err)
+}
+
+type GitRepo struct {
+	Config config.GitRepoConfig
+
+	syncing sync.Mutex // one sync at a time
+
+	mux       sync.Mutex
+	status    GitSyncStatus
+	rejectErr error
+	onChange  []func()
+}
+
+func NewGitRepo(config config.GitRepoConfig) (*GitRepo, error) {
+	if config.URL == "" || config.Path == "" {
+		return nil, fmt.Errorf("git needs a url and a path")
+	}
+	if config.MachineDir == "" {
+		config.MachineDir = "machines"
+	}
+	if config.GroupDir == "" {
+		config.GroupDir = "groups"
+	}
+	if config.TemplateDir == "" {
+		config.TemplateDir = "templates"
+	}
+	if err := os.MkdirAll(filepath.Join(config.Path, "checkouts"), 0755); err != nil {
+		return nil, err
+	}
+
+	r := &GitRepo{Config: config}
+	// Whatever was served before a restart is served until the first sync
+	if target, err := os.Readlink(r.current()); err == nil {
+		r.status.Commit = filepath.Base(target)
+	}
+	return r, nil
+}
+
+func (r *GitRepo) current() string {
+	return filepath.Join(r.Config.Path, "current")
+}
+
+// Where dir of the current checkout is, e.g. machines
+func (r *GitRepo) Dir(dir string) string {
+	return filepath.Join(r.current(), dir)
+}
+
+func (r *GitRepo) gitDir() string {
+	return filepath.Join(r.Config.Path, "repo.git")
+}
+
+// Call f after the served commit changed
+func (r *GitRepo) Subscribe(f func()) {
+	r.mux.Lock()
+	r.onChange = append(r.onChange, f)
+	r.mux.Unlock()
+}
+
+func (r *GitRepo) syncStatus() GitSyncStatus {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.status
+}
+
+func (r *GitRepo) Commit() string {
+	return r.syncStatus().Commit
+}
+
+// Sync every sync interval, until stop is closed
+func (r *GitRepo) Start(stop <-chan struct{}) {
+	if r.Config.SyncSeconds < 0 {
+		return
+	}
+	interval := config.Seconds(r.Config.SyncSeconds, defaultGitSyncSeconds)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+			if _, err := r.Sync(); err != nil {
+				logger.Error("cannot sync definitions from git", "url", r.Config.URL, "error", err)
+			}
+		}
+	}()
+}
+
+func Git(args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), gitCommandTimeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %s: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// Fetch the branch and serve its newest commit if it is valid
+func (r *GitRepo) Sync() (GitSyncStatus, error) {
+	r.syncing.Lock()
+	defer r.syncing.Unlock()
+
+	commit, err := r.fetch()
+	if err != nil {
+		return r.failed(err), err
+	}
+
+	r.mux.Lock()
+	status, rejectErr := r.status, r.rejectErr
+	r.mux.Unlock()
+	switch commit {
+	case status.Commit:
+		r.mux.Lock()
+		r.status.Synced, r.status.Rejected, r.status.Error = time.Now(), "", ""
+		status = r.status
+		r.mux.Unlock()
+		return status, nil
+	case status.Rejected:
+		// Already checked and logged
+		return status, rejectErr
+	}
+
+	previous := status.Commit
+	checkout, err := r.checkout(commit)
+	if err == nil {
+		err = validateDefinitions(checkout, r.Config)
+		if err != nil {
+			err = &GitValidationError{commit: commit, err: err}
+		}
+	}
+	if err == nil {
+		err = r.serve(commit)
+	}
+	if err != nil {
+		os.RemoveAll(checkout)
+		if verr, ok := err.(*GitValidationError); ok {
+			logger.Error("refusing to serve commit that fails validation", "commit", commit, "serving", previous, "error", verr.err)
+			r.mux.Lock()
+			r.status.Synced, r.status.Rejected, r.status.Error = time.Now(), commit, err.Error()
+			r.rejectErr = err
+			status = r.status
+			r.mux.Unlock()
+			return status, err
+		}
+		return r.failed(err), err
+	}
+	r.prune(commit, previous)
+
+	r.mux.Lock()
+	r.status = GitSyncStatus{Commit: commit, Synced: time.Now()}
+	r.rejectErr = nil
+	status = r.status
+	subscribers := append([]func(){}, r.onChange...)
+	r.mux.Unlock()
+
+	logger.Info("serving definitions from git", "commit", commit, "previous", previous)
+	for _, f := range subscribers {
+		f()
+	}
+	return status, nil
+}
+
+func (r *GitRepo) failed(err error) GitSyncStatus {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.status.Error = err.Error()
+	return r.status
+}
+
+// Clone or fetch, returning the commit the branch points at
+func (r *GitRepo) fetch() (string, error) {
+	if _, err := os.Stat(r.gitDir()); os.IsNotExist(err) {
+		args := []string{"clone", "--bare", "--quiet"}
+		if r.Config.Branch != "" {
+			args = append(args, "--branch", r.Config.Branch)
+		}
+		if _, err := Git(append(args, r.Config.URL, r.gitDir())...); err != nil {
+			os.RemoveAll(r.gitDir())
+			return "", err
+		}
+	} else if _, err := Git("--git-dir", r.gitDir(), "fetch", "--quiet", "--prune", "--force", r.Config.URL, "+refs/heads/*:refs/heads/*"); err != nil {
+		return "", err
+	}
+
+	ref := r.Config.Branch
+	if ref == "" {
+		ref = "HEAD"
+	}
+	return Git("--git-dir", r.gitDir(), "rev-parse", "--verify", "--quiet", ref+"^{commit}")
+}
+
+// Write the files of commit into a directory of their own
+func (r *GitRepo) checkout(commit string) (string, error) {
+	dir := filepath.Join(r.Config.Path, "checkouts", commit)
+	if err := os.RemoveAll(dir); err != nil {
+		return dir, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return dir, err
+	}
+	_, err := Git("--git-dir", r.gitDir(), "--work-tree", dir, "checkout", "--force", "--quiet", commit, "--", ".")
+	return dir, err
+}
+
+// Point current at the checkout of commit in one step
+func (r *GitRepo) serve(commit string) error {
+	next := r.current() + ".next"
+	os.Remove(next)
+	if err := os.Symlink(filepath.Join("checkouts", commit), next); err != nil {
+		return err
+	}
+	return os.Rename(next, r.current())
+}
+
+// Keep the served checkout and the one before it, requests may still be
+// reading from that
+func (r *GitRepo) prune(keep ...string) {
+	dirs, err := ioutil.ReadDir(filepath.Join(r.Config.Path, "checkouts"))
+	if err != nil {
+		return
+	}
+	for _, d := range dirs {
+		if !containsString(keep, d.Name()) {
+			os.RemoveAll(filepath.Join(r.Config.Path, "checkouts", d.Name()))
+		}
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Every definition has to parse and every template has to compile
+func validateDefinitions(dir string, config config.GitRepoConfig) error {
+	machines := filepath.Join(dir, config.MachineDir)
+	if info, err := os.Stat(machines); err != nil || !info.IsDir() {
+		return fmt.Errorf("no %s directory", config.MachineDir)
+	}
+
+	for _, sub := range []string{config.MachineDir, config.GroupDir} {
+		files, err := ioutil.ReadDir(filepath.Join(dir, sub))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		for _, f := range files {
+			ext := filepath.Ext(f.Name())
+			if f.IsDir() || (ext != ".yaml" && ext != ".yml") {
+				continue
+			}
+			data, err := ioutil.ReadFile(filepath.Join(dir, sub, f.Name()))
+			if err != nil {
+				return err
+			}
+			if sub == config.MachineDir && isPatternFile(f.Name()) {
+				// Only YAML once rendered for a hostname
+				if err := validatePatternDefinition(f.Name(), data); err != nil {
+					return fmt.Errorf("%s/%s", sub, err)
+				}
+				continue
+			}
+			var m Machine
+			if err := yaml.Unmarshal(data, &m); err != nil {
+				return fmt.Errorf("%s/%s: %s", sub, f.Name(), err)
+			}
+		}
+	}
+
+	pongo2.RegisterFilter("key", FilterGetValueByKey)
+	templates := filepath.Join(dir, config.TemplateDir)
+	if _, err := os.Stat(templates); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(templates, func(p string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if _, err := pongo2.FromFile(p); err != nil {
+			rel, _ := filepath.Rel(dir, p)
+			return fmt.Errorf("%s: %s", rel, err)
+		}
+		return nil
+	})
+}
+
+// A webhook from the git server: GitHub and Gitea sign the body with the
+// secret, GitLab sends the secret as is
+func ValidWebhook(secret string, request *http.Request, body []byte) bool {
+	if secret == "" {
+		return false
+	}
+	if token := request.Header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+	signature := strings.TrimPrefix(request.Header.Get("X-Hub-Signature-256"), "sha256=")
+	if signature == "" {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(strings.ToLower(signature)))
+}
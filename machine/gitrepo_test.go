@@ -0,0 +1,111 @@
+package machine
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+)
+
+// A repository to sync from, committing files on demand
+type sourceRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newSourceRepo(t *testing.T, dir string) *sourceRepo {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := &sourceRepo{t: t, dir: dir}
+	s.git("init", "--quiet")
+	s.git("config", "user.email", "test@example.com")
+	s.git("config", "user.name", "test")
+	return s
+}
+
+func (s *sourceRepo) git(args ...string) string {
+	out, err := Git(append([]string{"-C", s.dir}, args...)...)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return out
+}
+
+// Write files and commit them, returning the commit
+func (s *sourceRepo) commit(files map[string]string) string {
+	for name, content := range files {
+		p := filepath.Join(s.dir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	s.git("add", "-A")
+	s.git("commit", "--quiet", "-m", "update")
+	return s.git("rev-parse", "HEAD")
+}
+
+func TestGitRepoSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := newSourceRepo(t, filepath.Join(dir, "source"))
+	first := source.commit(map[string]string{
+		"machines/node01.example.com.yaml": `{"operatingsystem": "debian"}`,
+		"groups/example.com.yaml":          `{"finish": "finish.j2"}`,
+		"templates/preseed.j2":             "d-i debian-installer/locale string en_US",
+	})
+
+	repo, err := NewGitRepo(config.GitRepoConfig{URL: source.dir, Path: filepath.Join(dir, "served")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, err := repo.Sync(); err != nil || status.Commit != first {
+		t.Fatalf("expected %s to be served, got %+v, %v", first, status, err)
+	}
+	if _, err := os.Stat(filepath.Join(repo.Dir("templates"), "preseed.j2")); err != nil {
+		t.Errorf("expected the template to be checked out: %v", err)
+	}
+
+	// A commit that doesn't parse is never served
+	bad := source.commit(map[string]string{"machines/node02.example.com.yaml": `{"operatingsystem": `})
+	status, err := repo.Sync()
+	if _, ok := err.(*GitValidationError); !ok || status.Commit != first || status.Rejected != bad {
+		t.Errorf("expected %s to be rejected, got %+v, %v", bad, status, err)
+	}
+	if _, err := os.Stat(filepath.Join(repo.Dir("machines"), "node02.example.com.yaml")); !os.IsNotExist(err) {
+		t.Error("expected the rejected commit not to be checked out")
+	}
+
+	changed := false
+	repo.Subscribe(func() { changed = true })
+	fixed := source.commit(map[string]string{"machines/node02.example.com.yaml": `{"operatingsystem": "ubuntu"}`})
+	if status, err := repo.Sync(); err != nil || status.Commit != fixed || status.Rejected != "" || !changed {
+		t.Errorf("expected %s to be served, got %+v, %v", fixed, status, err)
+	}
+	m, err := MachineDefinition("node02.example.com", repo.Dir("machines"), config.Config{GroupPath: repo.Dir("groups")})
+	if err != nil || m.OperatingSystem != "ubuntu" || m.Finish != "finish.j2" {
+		t.Errorf("unexpected definition %+v, %v", m, err)
+	}
+
+	// Only the served and the previous checkouts are kept
+	if checkouts, _ := ioutil.ReadDir(filepath.Join(dir, "served", "checkouts")); len(checkouts) != 2 {
+		t.Errorf("expected 2 checkouts, got %d", len(checkouts))
+	}
+
+	// A restart serves the last good commit until it has synced
+	restarted, _ := NewGitRepo(config.GitRepoConfig{URL: source.dir, Path: filepath.Join(dir, "served")})
+	if restarted.Commit() != fixed {
+		t.Errorf("expected %s after a restart, got %s", fixed, restarted.Commit())
+	}
+}
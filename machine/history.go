@@ -0,0 +1,66 @@
+package machine
+
+import (
+	"time"
+)
+
+// HostHistory is how often and how a host was built. It is kept in the state
+// store apart from build records, so it outlives build_retention, and is
+// attached to the machine when it is put in build mode so templates and
+// notifiers can use it, e.g. as machine.History.Builds.
+type HostHistory struct {
+	Hostname string
+	// Builds started, this one included while it runs
+	Builds    int
+	Completed int
+	Cancelled int
+	Retries   int
+	// When a build last completed
+	LastInstalled time.Time `json:",omitempty"`
+	// The latest builds, oldest first
+	Entries []HistoryEntry
+}
+
+// HistoryEntry is one build of a host
+type HistoryEntry struct {
+	Token           string
+	Status          string
+	OperatingSystem string `json:",omitempty"`
+	Profile         string `json:",omitempty"`
+	Rescue          bool   `json:",omitempty"`
+	BuildStart      time.Time
+	BuildEnd        time.Time `json:",omitempty"`
+	Retries         int       `json:",omitempty"`
+	// The MAC address a build with the default profile was started for,
+	// its definition has none
+	MacAddress string `json:",omitempty"`
+	// What the build was armed with, see rollback.go
+	Versions   *BuildVersions `json:",omitempty"`
+	RollbackOf string         `json:",omitempty"`
+	// The certificate of the disk wipe before it, see wipe.go
+	Wipe *WipeCertificate `json:",omitempty"`
+}
+
+// The latest completed build of h that wasn't a rescue, if any
+func (h *HostHistory) LastCompleted() *HistoryEntry {
+	if h == nil {
+		return nil
+	}
+	for i := len(h.Entries) - 1; i >= 0; i-- {
+		if e := h.Entries[i]; e.Status == "Installed" && !e.Rescue {
+			return &h.Entries[i]
+		}
+	}
+	return nil
+}
+
+// The profile m is built with, if any
+func (m *Machine) ProfileName() string {
+	if m.Profile != "" {
+		return m.Profile
+	}
+	if m.DefaultProfile {
+		return "default"
+	}
+	return ""
+}
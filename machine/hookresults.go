@@ -0,0 +1,23 @@
+package machine
+
+import (
+	"time"
+)
+
+// HookResult is the outcome of a single hook execution
+type HookResult struct {
+	Hook       string
+	Stage      string
+	Attempt    int
+	Token      string `json:",omitempty"`
+	Stdout     string `json:",omitempty"`
+	Stderr     string `json:",omitempty"`
+	ExitCode   int
+	StatusCode int    `json:",omitempty"`
+	Error      string `json:",omitempty"`
+	TimedOut   bool   `json:",omitempty"`
+	DryRun     bool   `json:",omitempty"`
+	Started    time.Time
+	Finished   time.Time
+	Duration   time.Duration
+}
@@ -0,0 +1,52 @@
+package machine
+
+import (
+	"github.com/ns1/waitron/config"
+)
+
+// Points in a build's lifecycle where hooks can run. pre-hook and post-hook
+// are the original pre_hooks and post_hooks, run on preseed fetch and cancel.
+const (
+	StagePreHook     = "pre-hook"
+	StagePostHook    = "post-hook"
+	StageBuildStart  = "build-start"
+	StageTokenIssued = "token-issued"
+	StageTemplate    = "template"
+	StageDone        = "done"
+	StageCancel      = "cancel"
+	StageStale       = "stale"
+	StageFailure     = "failure"
+)
+
+// Hooks configured for a stage. The machine's merged config is used so group
+// and machine definitions can add their own.
+func (m *Machine) HooksForStage(stage string) []config.Hook {
+	switch stage {
+	case StagePreHook:
+		return m.PreHooks
+	case StagePostHook:
+		return m.PostHooks
+	}
+	return m.Hooks[stage]
+}
+
+// Find a hook by name across all of the machine's stages, or only in stage if
+// one is given. Returns the stage the hook was found in.
+func (m *Machine) FindHook(name string, stage string) (config.Hook, string, bool) {
+	stages := []string{StagePreHook, StagePostHook}
+	for s := range m.Hooks {
+		stages = append(stages, s)
+	}
+
+	for _, s := range stages {
+		if stage != "" && s != stage {
+			continue
+		}
+		for _, hook := range m.HooksForStage(s) {
+			if hook.String() == name {
+				return hook, s, true
+			}
+		}
+	}
+	return config.Hook{}, "", false
+}
@@ -0,0 +1,45 @@
+package machine
+
+import (
+	"testing"
+
+	"github.com/ns1/waitron/config"
+)
+
+func TestHooksForStage(t *testing.T) {
+	m := &Machine{Config: config.Config{
+		PreHooks:  []config.Hook{{Name: "pre.sh"}},
+		PostHooks: []config.Hook{{Name: "post.sh"}},
+		Hooks:     map[string][]config.Hook{StageDone: {{Name: "done.sh"}}},
+	}}
+
+	if h := m.HooksForStage(StagePreHook); len(h) != 1 || h[0].Name != "pre.sh" {
+		t.Errorf("unexpected pre-hook hooks %v", h)
+	}
+	if h := m.HooksForStage(StagePostHook); len(h) != 1 || h[0].Name != "post.sh" {
+		t.Errorf("unexpected post-hook hooks %v", h)
+	}
+	if h := m.HooksForStage(StageDone); len(h) != 1 || h[0].Name != "done.sh" {
+		t.Errorf("unexpected done hooks %v", h)
+	}
+	if h := m.HooksForStage(StageStale); len(h) != 0 {
+		t.Errorf("expected no stale hooks, got %v", h)
+	}
+}
+
+func TestFindHook(t *testing.T) {
+	m := &Machine{Config: config.Config{
+		PreHooks: []config.Hook{{Name: "notify-slack.sh"}},
+		Hooks:    map[string][]config.Hook{StageDone: {{Name: "register-dns", URL: "http://dns.example.com"}}},
+	}}
+
+	if _, stage, found := m.FindHook("register-dns", ""); !found || stage != StageDone {
+		t.Errorf("expected register-dns in the done stage, got %v %s", found, stage)
+	}
+	if _, stage, found := m.FindHook("notify-slack.sh", ""); !found || stage != StagePreHook {
+		t.Errorf("expected notify-slack.sh in the pre-hook stage, got %v %s", found, stage)
+	}
+	if _, _, found := m.FindHook("notify-slack.sh", StageDone); found {
+		t.Errorf("did not expect notify-slack.sh in the done stage")
+	}
+}
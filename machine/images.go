@@ -0,0 +1,16 @@
+package machine
+
+import (
+	"strings"
+)
+
+const imagePrefix = "image:"
+
+// A kernel or initrd from a machine definition as a URL: image:<name> is an
+// image from the catalog, anything else is relative to imageURL
+func (m Machine) bootAssetURL(imageURL string, asset string) string {
+	if strings.HasPrefix(asset, imagePrefix) {
+		return strings.TrimRight(m.BaseURL, "/") + "/images/" + strings.TrimPrefix(asset, imagePrefix)
+	}
+	return imageURL + asset
+}
@@ -0,0 +1,17 @@
+package machine
+
+import (
+	"testing"
+)
+
+func TestBootAssetURL(t *testing.T) {
+	m := Machine{}
+	m.BaseURL = "http://waitron.example.com:9090/"
+
+	if u := m.bootAssetURL("http://mirror/", "linux"); u != "http://mirror/linux" {
+		t.Errorf("unexpected url %s", u)
+	}
+	if u := m.bootAssetURL("http://mirror/", "image:focal-linux"); u != "http://waitron.example.com:9090/images/focal-linux" {
+		t.Errorf("unexpected url %s", u)
+	}
+}
@@ -0,0 +1,376 @@
+package machine
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"gopkg.in/yaml.v2"
+)
+
+// The inventory indexes every machine definition in machinepath by hostname,
+// MAC address and label, so listing and looking up machines doesn't read the
+// directory on every request. It only looks at the machine and group files:
+// labels are merged from the config, the group and the machine, in that
+// order, the way MachineDefinition merges everything else. The directory is
+// checked for changes every inventory_refresh_secs and only files that
+// changed, or whose group changed, are parsed again. With definitions in
+// Consul the same goes for its keys, and a change there refreshes right away.
+
+const DefaultInventoryRefreshSeconds = 10
+
+// InventoryEntry is what the inventory knows about a machine
+type InventoryEntry struct {
+	Hostname string
+	File     string
+	MACs     []string          `json:",omitempty"`
+	IPs      []string          `json:",omitempty"`
+	Labels   map[string]string `json:",omitempty"`
+
+	modTime      time.Time
+	groupModTime time.Time
+}
+
+// The parts of machine and group files the inventory cares about
+type inventoryDefinition struct {
+	Network []Interface       `yaml:"network"`
+	Labels  map[string]string `yaml:"labels"`
+}
+
+type Inventory struct {
+	config config.Config
+
+	mux        sync.RWMutex
+	files      []string
+	ByHostname map[string]*InventoryEntry
+	byMAC      map[string]*InventoryEntry
+	byIP       map[string]*InventoryEntry
+	byLabel    map[string]map[string][]*InventoryEntry
+}
+
+func NewInventory(config config.Config) *Inventory {
+	return &Inventory{
+		config:     config,
+		ByHostname: make(map[string]*InventoryEntry),
+		byMAC:      make(map[string]*InventoryEntry),
+		byIP:       make(map[string]*InventoryEntry),
+		byLabel:    make(map[string]map[string][]*InventoryEntry),
+	}
+}
+
+// Refresh every interval, until stop is closed
+func (inv *Inventory) Start(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+			if err := inv.Refresh(); err != nil {
+				logger.Error("cannot refresh inventory", "path", inv.config.MachinePath, "error", err)
+			}
+		}
+	}()
+}
+
+// The machine definitions, sorted
+func (inv *Inventory) MachineFiles() ([]config.StorageEntry, error) {
+	var files []config.StorageEntry
+	var err error
+	if inv.config.ConsulKV != nil {
+		files = inv.config.ConsulKV.MachineFiles()
+	} else if files, err = config.StorageFor(inv.config.MachinePath).List(inv.config.MachinePath); err != nil {
+		return nil, err
+	}
+	var definitions []config.StorageEntry
+	for _, file := range files {
+		ext := path.Ext(file.Name)
+		if file.Dir || (ext != ".yaml" && ext != ".yml") || isPatternFile(file.Name) {
+			continue // patterns aren't machines of their own
+		}
+		definitions = append(definitions, file)
+	}
+	sort.Slice(definitions, func(i, j int) bool { return definitions[i].Name < definitions[j].Name })
+	return definitions, nil
+}
+
+// Find a group file and its mtime, the zero time when there is none
+func (inv *Inventory) groupFile(group string) (string, time.Time) {
+	if inv.config.ConsulKV != nil {
+		if _, err := inv.config.ConsulKV.Group(group); err != nil {
+			return "", time.Time{}
+		}
+		return group, inv.config.ConsulKV.ModTime("", group)
+	}
+	for _, ext := range []string{".yaml", ".yml"} {
+		file := config.JoinLocation(inv.config.GroupPath, group+ext)
+		if modTime, err := config.StorageFor(file).ModTime(file); err == nil {
+			return file, modTime
+		}
+	}
+	return "", time.Time{}
+}
+
+func (inv *Inventory) readGroup(file string) (inventoryDefinition, error) {
+	if inv.config.ConsulKV != nil {
+		return parseInventoryDefinition(inv.config.ConsulKV.Group(file))
+	}
+	return parseInventoryDefinition(config.StorageFor(file).Read(file))
+}
+
+func (inv *Inventory) readMachine(name string) (inventoryDefinition, error) {
+	if inv.config.ConsulKV != nil {
+		return parseInventoryDefinition(inv.config.ConsulKV.Machine(strings.TrimSuffix(name, path.Ext(name))))
+	}
+	file := config.JoinLocation(inv.config.MachinePath, name)
+	return parseInventoryDefinition(config.StorageFor(file).Read(file))
+}
+
+func parseInventoryDefinition(data []byte, err error) (inventoryDefinition, error) {
+	var d inventoryDefinition
+	if err != nil {
+		return d, err
+	}
+	return d, yaml.Unmarshal(data, &d)
+}
+
+// Pick up added, changed and removed machine definitions
+func (inv *Inventory) Refresh() error {
+	files, err := inv.MachineFiles()
+	if err != nil {
+		return err
+	}
+
+	inv.mux.RLock()
+	previous := inv.ByHostname
+	inv.mux.RUnlock()
+
+	type group struct {
+		file    string
+		modTime time.Time
+		labels  map[string]string
+		loaded  bool
+	}
+	groups := make(map[string]*group)
+
+	byHostname := make(map[string]*InventoryEntry)
+	names := []string{}
+	for _, file := range files {
+		name := file.Name
+		names = append(names, name)
+		hostname := strings.ToLower(strings.TrimSuffix(name, path.Ext(name)))
+		if _, found := byHostname[hostname]; found {
+			// Both a .yaml and a .yml, MachineDefinition prefers .yaml
+			continue
+		}
+
+		domain := strings.Join(strings.Split(hostname, ".")[1:], ".")
+		g, found := groups[domain]
+		if !found {
+			g = &group{}
+			g.file, g.modTime = inv.groupFile(domain)
+			groups[domain] = g
+		}
+
+		if e, found := previous[hostname]; found && e.File == name &&
+			e.modTime.Equal(file.ModTime) && e.groupModTime.Equal(g.modTime) {
+			byHostname[hostname] = e
+			continue
+		}
+
+		if !g.loaded && g.file != "" {
+			d, err := inv.readGroup(g.file)
+			if err != nil {
+				logger.Error("cannot index group", "group", domain, "error", err)
+			}
+			g.labels = d.Labels
+		}
+		g.loaded = true
+
+		d, err := inv.readMachine(name)
+		if err != nil {
+			logger.Error("cannot index machine", "hostname", hostname, "error", err)
+			continue
+		}
+
+		e := &InventoryEntry{Hostname: hostname, File: name, modTime: file.ModTime, groupModTime: g.modTime}
+		for _, i := range d.Network {
+			if i.MacAddress != "" {
+				e.MACs = append(e.MACs, strings.ToLower(i.MacAddress))
+			}
+			for _, a := range append(append([]IPConfig(nil), i.Addresses4...), i.Addresses6...) {
+				if a.IPAddress != "" {
+					e.IPs = append(e.IPs, a.IPAddress)
+				}
+			}
+		}
+		e.Labels = make(map[string]string)
+		for _, labels := range []map[string]string{inv.config.Labels, g.labels, d.Labels} {
+			for k, v := range labels {
+				e.Labels[k] = v
+			}
+		}
+		byHostname[hostname] = e
+	}
+	sort.Strings(names)
+
+	inv.Set(names, byHostname)
+	return nil
+}
+
+// Replace the inventory with entries, indexing them by MAC, IP and label
+func (inv *Inventory) Set(files []string, byHostname map[string]*InventoryEntry) {
+	byMAC := make(map[string]*InventoryEntry)
+	byIP := make(map[string]*InventoryEntry)
+	byLabel := make(map[string]map[string][]*InventoryEntry)
+	for _, e := range byHostname {
+		for _, mac := range e.MACs {
+			byMAC[mac] = e
+		}
+		for _, ip := range e.IPs {
+			if parsed := net.ParseIP(ip); parsed != nil {
+				byIP[parsed.String()] = e
+			}
+		}
+		for k, v := range e.Labels {
+			if byLabel[k] == nil {
+				byLabel[k] = make(map[string][]*InventoryEntry)
+			}
+			byLabel[k][v] = append(byLabel[k][v], e)
+		}
+	}
+
+	inv.mux.Lock()
+	inv.files = files
+	inv.ByHostname = byHostname
+	inv.byMAC = byMAC
+	inv.byIP = byIP
+	inv.byLabel = byLabel
+	inv.mux.Unlock()
+}
+
+// The machine definition files, sorted, like Config.listMachines
+func (inv *Inventory) List() []string {
+	inv.mux.RLock()
+	defer inv.mux.RUnlock()
+	return append([]string(nil), inv.files...)
+}
+
+func (inv *Inventory) LookupHostname(hostname string) (InventoryEntry, bool) {
+	inv.mux.RLock()
+	defer inv.mux.RUnlock()
+	e, found := inv.ByHostname[strings.ToLower(hostname)]
+	if !found {
+		return InventoryEntry{}, false
+	}
+	return *e, true
+}
+
+func (inv *Inventory) LookupMAC(mac string) (InventoryEntry, bool) {
+	inv.mux.RLock()
+	defer inv.mux.RUnlock()
+	e, found := inv.byMAC[strings.ToLower(mac)]
+	if !found {
+		return InventoryEntry{}, false
+	}
+	return *e, true
+}
+
+func (inv *Inventory) LookupIP(ip net.IP) (InventoryEntry, bool) {
+	inv.mux.RLock()
+	defer inv.mux.RUnlock()
+	e, found := inv.byIP[ip.String()]
+	if !found {
+		return InventoryEntry{}, false
+	}
+	return *e, true
+}
+
+// A label selector is a comma separated list of key=value, key!=value and
+// key, which only needs the label to be set. All of them have to match.
+type labelRequirement struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+func ParseSelector(selector string) ([]labelRequirement, error) {
+	requirements := []labelRequirement{}
+	for _, term := range strings.Split(selector, ",") {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+
+		r := labelRequirement{Key: term, Op: "exists"}
+		if i := strings.Index(term, "!="); i >= 0 {
+			r = labelRequirement{Key: term[:i], Op: "!=", Value: term[i+2:]}
+		} else if i := strings.Index(term, "="); i >= 0 {
+			r = labelRequirement{Key: term[:i], Op: "=", Value: term[i+1:]}
+		}
+		r.Key = strings.TrimSpace(r.Key)
+		r.Value = strings.TrimSpace(r.Value)
+		if r.Key == "" {
+			return nil, fmt.Errorf("invalid selector term %q", term)
+		}
+		requirements = append(requirements, r)
+	}
+	return requirements, nil
+}
+
+func (r labelRequirement) matches(labels map[string]string) bool {
+	v, found := labels[r.Key]
+	switch r.Op {
+	case "=":
+		return found && v == r.Value
+	case "!=":
+		return !found || v != r.Value
+	}
+	return found
+}
+
+func (e InventoryEntry) Matches(requirements []labelRequirement) bool {
+	for _, r := range requirements {
+		if !r.matches(e.Labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// The machines matching all requirements, sorted by hostname. The first
+// key=value narrows the candidates down through the label index.
+func (inv *Inventory) Match(requirements []labelRequirement) []InventoryEntry {
+	inv.mux.RLock()
+	defer inv.mux.RUnlock()
+
+	var candidates []*InventoryEntry
+	narrowed := false
+	for _, r := range requirements {
+		if r.Op == "=" {
+			candidates = inv.byLabel[r.Key][r.Value]
+			narrowed = true
+			break
+		}
+	}
+	if !narrowed {
+		for _, e := range inv.ByHostname {
+			candidates = append(candidates, e)
+		}
+	}
+
+	entries := []InventoryEntry{}
+	for _, e := range candidates {
+		if e.Matches(requirements) {
+			entries = append(entries, *e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Hostname < entries[j].Hostname })
+	return entries
+}
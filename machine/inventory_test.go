@@ -0,0 +1,162 @@
+package machine
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+)
+
+func testInventory() *Inventory {
+	inv := NewInventory(config.Config{})
+	inv.Set([]string{"db01.example.com.yaml", "web01.example.com.yaml", "web02.example.com.yaml"},
+		map[string]*InventoryEntry{
+			"db01.example.com": {Hostname: "db01.example.com", File: "db01.example.com.yaml",
+				MACs: []string{"de:ad:c0:de:00:01"}, Labels: map[string]string{"role": "db", "rack": "r1"}},
+			"web01.example.com": {Hostname: "web01.example.com", File: "web01.example.com.yaml",
+				MACs: []string{"de:ad:c0:de:00:02"}, Labels: map[string]string{"role": "web", "rack": "r1"}},
+			"web02.example.com": {Hostname: "web02.example.com", File: "web02.example.com.yaml",
+				Labels: map[string]string{"role": "web"}},
+		})
+	return inv
+}
+
+func hostnames(entries []InventoryEntry) []string {
+	names := []string{}
+	for _, e := range entries {
+		names = append(names, e.Hostname)
+	}
+	return names
+}
+
+func TestParseSelector(t *testing.T) {
+	requirements, err := ParseSelector("role=web, rack!=r2,gpu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []labelRequirement{{"role", "=", "web"}, {"rack", "!=", "r2"}, {"gpu", "exists", ""}}
+	if len(requirements) != len(want) {
+		t.Fatalf("expected %v, got %v", want, requirements)
+	}
+	for i := range want {
+		if requirements[i] != want[i] {
+			t.Errorf("expected %v, got %v", want[i], requirements[i])
+		}
+	}
+
+	if _, err := ParseSelector("=web"); err == nil {
+		t.Error("expected a selector without key to be invalid")
+	}
+	if requirements, _ := ParseSelector(""); len(requirements) != 0 {
+		t.Errorf("expected an empty selector to match everything, got %v", requirements)
+	}
+}
+
+func TestInventoryMatch(t *testing.T) {
+	inv := testInventory()
+
+	tests := map[string]string{
+		"":                `["db01.example.com","web01.example.com","web02.example.com"]`,
+		"role=web":        `["web01.example.com","web02.example.com"]`,
+		"role=web,rack":   `["web01.example.com"]`,
+		"rack!=r1":        `["web02.example.com"]`,
+		"role=db,rack=r2": `[]`,
+		"role=none":       `[]`,
+	}
+	for selector, want := range tests {
+		requirements, _ := ParseSelector(selector)
+		got, _ := json.Marshal(hostnames(inv.Match(requirements)))
+		if string(got) != want {
+			t.Errorf("%q: expected %s, got %s", selector, want, got)
+		}
+	}
+
+	if e, found := inv.LookupMAC("DE:AD:C0:DE:00:02"); !found || e.Hostname != "web01.example.com" {
+		t.Errorf("unexpected MAC lookup %+v", e)
+	}
+	if _, found := inv.LookupHostname("missing.example.com"); found {
+		t.Error("expected an unknown hostname not to be found")
+	}
+}
+
+func TestInventoryRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("params: {}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("web01.example.com.yaml")
+	write("notes.txt")
+
+	inv := NewInventory(config.Config{MachinePath: dir, GroupPath: dir})
+	if err := inv.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if list := inv.List(); len(list) != 1 || list[0] != "web01.example.com.yaml" {
+		t.Errorf("unexpected list %v", list)
+	}
+	before, _ := inv.LookupHostname("web01.example.com")
+
+	write("web02.example.com.yml")
+	inv.Refresh()
+	if list := inv.List(); len(list) != 2 {
+		t.Errorf("expected the new machine to be picked up, got %v", list)
+	}
+	inv.mux.RLock()
+	kept := inv.ByHostname["web01.example.com"]
+	inv.mux.RUnlock()
+	if !kept.modTime.Equal(before.modTime) {
+		t.Error("expected the unchanged machine to be kept")
+	}
+
+	os.Remove(filepath.Join(dir, "web01.example.com.yaml"))
+	inv.Refresh()
+	if _, found := inv.LookupHostname("web01.example.com"); found {
+		t.Error("expected the removed machine to be dropped")
+	}
+}
+
+func TestInventoryStart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-inventory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("params: {}\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	inv := NewInventory(config.Config{MachinePath: dir, GroupPath: dir})
+	stop := make(chan struct{})
+	inv.Start(time.Millisecond, stop)
+
+	write("web01.example.com.yaml")
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, found := inv.LookupHostname("web01.example.com"); found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the machine to be picked up by a refresh")
+		}
+	}
+
+	close(stop)
+	time.Sleep(20 * time.Millisecond)
+	write("web02.example.com.yaml")
+	time.Sleep(20 * time.Millisecond)
+	if _, found := inv.LookupHostname("web02.example.com"); found {
+		t.Error("expected no refresh once stopped")
+	}
+}
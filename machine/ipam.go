@@ -0,0 +1,60 @@
+package machine
+
+import (
+	"net"
+	"strconv"
+	"time"
+)
+
+// IPAllocation is an address handed out to a machine's interface
+type IPAllocation struct {
+	Pool      string
+	Hostname  string
+	Interface string
+	IPAddress string
+	Netmask   string `json:",omitempty"`
+	Cidr      string
+	Gateway   string `json:",omitempty"`
+
+	// The address's id in phpIPAM or NetBox
+	ExternalID string `json:",omitempty"`
+
+	// Kept for the machine since a build with it was done
+	Persisted   bool
+	AllocatedAt time.Time
+}
+
+// Put the address of a in front of those of iface
+func (a IPAllocation) Assign(iface *Interface) {
+	address := IPConfig{IPAddress: a.IPAddress, Netmask: a.Netmask, Cidr: a.Cidr}
+	if ip := net.ParseIP(a.IPAddress); ip != nil && ip.To4() != nil {
+		iface.Addresses4 = append([]IPConfig{address}, iface.Addresses4...)
+		if iface.Gateway4 == "" {
+			iface.Gateway4 = a.Gateway
+		}
+	} else {
+		iface.Addresses6 = append([]IPConfig{address}, iface.Addresses6...)
+		if iface.Gateway6 == "" {
+			iface.Gateway6 = a.Gateway
+		}
+	}
+}
+
+// Give m the addresses a build of it already had allocated, to the
+// interfaces they were allocated for
+func (m *Machine) RestoreAllocations(allocations []IPAllocation) {
+	if len(allocations) == 0 {
+		return
+	}
+	network := append([]Interface(nil), m.Network...)
+	for _, a := range allocations {
+		for n := range network {
+			if network[n].Name == a.Interface || (network[n].Name == "" && strconv.Itoa(n) == a.Interface) {
+				a.Assign(&network[n])
+				break
+			}
+		}
+	}
+	m.Network = network
+	m.Allocations = allocations
+}
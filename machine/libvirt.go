@@ -0,0 +1,10 @@
+package machine
+
+// LibvirtGuest is where a VM lives on its hypervisor
+type LibvirtGuest struct {
+	// Instead of the config's, e.g. qemu:///system for the waitron host
+	URI  string `yaml:"uri"`
+	Pool string `yaml:"pool"`
+	// Sizes in GiB of the disks, the first one is booted
+	Disks []int `yaml:"disks"`
+}
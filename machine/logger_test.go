@@ -0,0 +1,37 @@
+package machine
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+)
+
+func TestLoggerJSON(t *testing.T) {
+	var buf bytes.Buffer
+	l := config.NewLogger(&buf, "json", config.LevelInfo)
+
+	m := &Machine{Hostname: "dns02.example.com", Network: []Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}}
+	l.Machine(m).With("request_id", "req-1").Error("hook failed", "error", errors.New("exit status 1"))
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("invalid JSON log line %q: %s", buf.String(), err)
+	}
+
+	expected := map[string]string{
+		"level":      "error",
+		"msg":        "hook failed",
+		"hostname":   "dns02.example.com",
+		"mac":        "de:ad:c0:de:ca:fe",
+		"request_id": "req-1",
+		"error":      "exit status 1",
+	}
+	for k, v := range expected {
+		if line[k] != v {
+			t.Errorf("expected %s=%q, got %v", k, v, line[k])
+		}
+	}
+}
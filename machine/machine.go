@@ -0,0 +1,501 @@
+package machine
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/flosch/pongo2"
+	configpkg "github.com/ns1/waitron/config"
+	"gopkg.in/yaml.v2"
+)
+
+// Machine configuration
+type Machine struct {
+	configpkg.Config `yaml:",inline"`
+	Hostname         string
+	ShortName        string
+	Domain           string
+	Token            string      // This is set by the service
+	Network          []Interface `yaml:"network"`
+	Status           string
+	BuildStart       time.Time
+	RescueMode       bool
+
+	Annotations *Annotations `yaml:"-" json:",omitempty"`
+
+	// The pattern definition the machine matched and what it captured, see
+	// patterns.go
+	Pattern  string            `yaml:"-" json:",omitempty"`
+	Captures map[string]string `yaml:"-" json:",omitempty"`
+
+	// Addresses given to interfaces with ip: auto for this build, see state/ipam.go
+	Allocations []IPAllocation `yaml:"-" json:",omitempty"`
+
+	// Nothing defines the machine, it is built with the default profile
+	DefaultProfile bool `yaml:"-" json:",omitempty"`
+
+	// The build profile the build request asked for, see server/profile.go
+	Profile string `yaml:"-" json:",omitempty"`
+
+	// The site a request for the machine came from, see site.go
+	Site string `yaml:"-" json:",omitempty"`
+
+	// What the build was armed with, and the completed build a rollback
+	// went back to, see rollback.go
+	Versions   *BuildVersions `yaml:"-" json:",omitempty"`
+	RollbackOf string         `yaml:"-" json:",omitempty"`
+
+	// When the build should be done going by earlier ones, see state/eta.go
+	ETA *BuildETA `yaml:"-" json:",omitempty"`
+
+	// What the pre-install stage images reported, see state/preinstall.go
+	FirmwareResult *FirmwareResult  `yaml:"-" json:",omitempty"`
+	RAIDResult     *RAIDResult      `yaml:"-" json:",omitempty"`
+	BurnInResult   *BurnInResult    `yaml:"-" json:",omitempty"`
+	WipeResult     *WipeCertificate `yaml:"-" json:",omitempty"`
+
+	// How the checks after /done went, see state/validate.go
+	ValidationResults *BuildValidation `yaml:"-" json:",omitempty"`
+
+	// Where the build is in its lifecycle and every move it made to get
+	// there, see buildstate.go
+	State       BuildState        `yaml:"-" json:",omitempty"`
+	Transitions []StateTransition `yaml:"-" json:",omitempty"`
+
+	// Timestamped steps this build has gone through
+	Phases []BuildPhase `yaml:"-" json:",omitempty"`
+
+	// Outcome of every hook run for this build
+	HookResults []HookResult `yaml:"-" json:",omitempty"`
+
+	// Latest and previous progress reports from the installer
+	Progress        *BuildProgress  `yaml:"-" json:",omitempty"`
+	ProgressHistory []BuildProgress `yaml:"-" json:",omitempty"`
+
+	// When the installer last sent a heartbeat, see state/stale.go
+	LastHeartbeat time.Time `yaml:"-" json:",omitempty"`
+
+	// What the host authenticates with besides its token, see state/hostauth.go
+	HostKey string `yaml:"-" json:"-"`
+
+	// The DHCP server's lease for one of the interfaces, see state/dhcp.go
+	Lease *DHCPLease `yaml:"-" json:",omitempty"`
+
+	// How often this build was retried and whether a retry is waiting on
+	// its backoff, see state/retry.go
+	Retries      int  `yaml:"-" json:",omitempty"`
+	RetryPending bool `json:"-" yaml:"-"`
+
+	// What the installer uploaded about the machine, see state/artifacts.go
+	Artifacts []ArtifactInfo `yaml:"-" json:",omitempty"`
+
+	// Kernel parameters the build request added to the cmdline, for this
+	// build only
+	ExtraCmdline string `yaml:"-" json:",omitempty"`
+
+	// Earlier builds of the host, see state/history.go
+	History *HostHistory `yaml:"-" json:"-"`
+}
+
+// // Machine configuration
+// type Machine struct {
+// 	OperatingSystem string
+// 	Finish          string
+// 	Preseed         string
+// 	ShortName       string
+// 	Domain          string
+// 	Token           string      // This is set by the service
+// 	Network         []Interface `yaml:"network"`
+// 	Status          string
+// 	BuildStart      time.Time
+// 	RescueMode      bool
+
+// 	Params   map[string]string
+// 	ImageURL string `yaml:"image_url"`
+// 	Kernel   string
+// 	Initrd   string
+// 	Cmdline  string
+// 	Roles    []string
+// 	PubKeys  []string `yaml:"pub_keys"`
+// 	Ipmi     Ipmi
+// }
+
+type Vm struct {
+	Vm []VmInstance
+}
+
+type VmInstance struct {
+	Hostname    string
+	Domain      string
+	Os          string
+	Memory      int
+	Vcpu        int
+	Image       string
+	VirtNetwork string `yaml:"virt_network"`
+	Interfaces  []VmInterface
+	Roles       []string
+	AttachDisks []string `yaml:"attach_disks"`
+	CloudInit   []string `yaml:"cloud_init"`
+
+	// Where it runs on Proxmox VE, libvirt or vSphere, see state/vm.go
+	Proxmox ProxmoxGuest `yaml:"proxmox"`
+	Libvirt LibvirtGuest `yaml:"libvirt"`
+	VSphere VSphereGuest `yaml:"vsphere"`
+}
+
+type VmInterface struct {
+	Name      string
+	IPAddress string
+	Netmask   string
+	Gateway   string
+	Vlan      int
+	Dnsname   string
+}
+
+// IPMI Configuration
+type Ipmi struct {
+	IPAddress  string
+	MacAddress string
+	Md5        string
+}
+
+type IPConfig struct {
+	IPAddress string `yaml:"ipaddress"`
+	Netmask   string `yaml:"netmask"`
+	Cidr      string `yaml:"cidr"`
+}
+
+// Interface Configuration
+type Interface struct {
+	Name       string     `yaml:"name"`
+	Addresses4 []IPConfig `yaml:"addresses4"`
+	Addresses6 []IPConfig `yaml:"addresses6"`
+	MacAddress string     `yaml:"macaddress"`
+	Gateway4   string     `yaml:"gateway4"`
+	Gateway6   string     `yaml:"gateway6"`
+
+	// auto to get an address from an ipam pool, the machine's ipam_pool
+	// unless Pool names another
+	IP   string `yaml:"ip,omitempty"`
+	Pool string `yaml:"pool,omitempty"`
+
+	// What the interface configures itself with besides its addresses, or
+	// instead, see network.go. accept_ra is router advertisements, the
+	// installer's default when unset.
+	DHCP4    bool  `yaml:"dhcp4,omitempty"`
+	DHCP6    bool  `yaml:"dhcp6,omitempty"`
+	AcceptRA *bool `yaml:"accept_ra,omitempty"`
+
+	Nameservers []string `yaml:"nameservers,omitempty"`
+
+	// Take the addresses it has none of from DNS, see config/resolver.go
+	Resolve bool `yaml:"resolve,omitempty"`
+}
+
+// PixieConfig boot configuration
+type PixieConfig struct {
+	Kernel  string   `json:"kernel" description:"The kernel file"`
+	Initrd  []string `json:"initrd"`
+	Cmdline string   `json:"cmdline"`
+}
+
+func FilterGetValueByKey(in *pongo2.Value, param *pongo2.Value) (*pongo2.Value, *pongo2.Error) {
+
+	m := in.Interface().(map[string]string)
+
+	if val, ok := m[param.String()]; ok {
+		return pongo2.AsValue(val), nil
+	} else {
+		return pongo2.AsValue(""), nil
+	}
+}
+
+func MachineDefinition(hostname string, machinePath string, config configpkg.Config) (Machine, error) {
+	return loadMachineDefinition(hostname, machinePath, config, nil)
+}
+
+// The definition of hostname, from profile when it is set and nothing
+// defines the machine
+func loadMachineDefinition(hostname string, machinePath string, config configpkg.Config, profile *configpkg.DefaultProfileConfig) (Machine, error) {
+
+	pongo2.RegisterFilter("key", FilterGetValueByKey)
+
+	hostname = strings.ToLower(hostname)
+	hostSlice := strings.Split(hostname, ".")
+
+	m := Machine{
+		Hostname:  hostname,
+		ShortName: hostSlice[0],
+		Domain:    strings.Join(hostSlice[1:], "."),
+	}
+	if m.Domain == "" && config.AttributeResolver != nil {
+		// The group comes from the domain, so it has to be known first
+		m.Domain = config.AttributeResolver.Domain(hostname)
+	}
+
+	// Merge in the "global" config.  The marshal/unmarshal combo looks funny, but it's clean and we aren't shooting for warp speed here.
+	if c, err := yaml.Marshal(config); err == nil {
+		if err = yaml.Unmarshal(c, &m); err != nil {
+			return m, err
+		}
+	} else {
+		return m, err
+	}
+
+	// Then, load the domain definition.
+	data, err := readGroupDefinition(m.Domain, config) // apc03.prod.yaml
+	if os.IsNotExist(err) {                            // We should expect the group to not exist, but if it did exist and err happened for a different reason, it should be reported.
+		logger.Machine(&m).Warn("no group file found, is that intentional?", "group", m.Domain)
+	} else if err != nil {
+		return m, err
+	} else if err = CheckDefinition(MachineSchema, "group", m.Domain, data, config); err != nil {
+		return m, err
+	}
+
+	if err = yaml.Unmarshal(data, &m); err != nil {
+		return m, err
+	}
+
+	// Then whatever inventory plugins know about the machine. JSON is YAML, so
+	// plugin definitions merge the same way the files do.
+	definitions, err := inventoryFromPlugins(config, hostname)
+	if err != nil {
+		return Machine{}, err
+	}
+	for _, d := range definitions {
+		if err = yaml.Unmarshal(d, &m); err != nil {
+			return Machine{}, err
+		}
+	}
+
+	// Then load the machine definition.
+	data, err = ReadMachineDefinition(hostname, machinePath, config) // compute01.apc03.prod.yaml
+	// Without one, maybe a pattern matches, compute-\d+\.apc03\.prod.yaml
+	if os.IsNotExist(err) {
+		var pattern string
+		if pattern, m.Captures, data, err = readPatternDefinition(hostname, machinePath, config); err == nil {
+			m.Pattern = pattern
+		}
+	}
+	if os.IsNotExist(err) && len(definitions) == 0 && profile != nil {
+		// Nothing knows the machine, see server/profile.go
+		data, err = yaml.Marshal(profile.Definition)
+		m.DefaultProfile = true
+	}
+	if os.IsNotExist(err) && len(definitions) > 0 { // A plugin knowing the machine is as good as a file.
+		resolveMachine(&m, config)
+		return m, m.checkSections()
+	} else if err != nil { // Whether the error was due to non-existence or something else, report it.  Machine definitions are must.
+		return Machine{}, err
+	}
+
+	if err = CheckDefinition(MachineSchema, "machine", hostname, data, config); err != nil {
+		return Machine{}, err
+	}
+	err = yaml.Unmarshal(data, &m)
+	if err != nil {
+		return Machine{}, err
+	}
+
+	// Last, whatever DNS and LDAP know that the definitions didn't say
+	resolveMachine(&m, config)
+
+	return m, m.checkSections()
+}
+
+// The fields logged with lines about m, its hostname and MAC address
+func (m *Machine) LogFields() []interface{} {
+	if m == nil {
+		return nil
+	}
+	kv := []interface{}{"hostname", m.Hostname}
+	if len(m.Network) > 0 && m.Network[0].MacAddress != "" {
+		kv = append(kv, "mac", m.Network[0].MacAddress)
+	}
+	return kv
+}
+
+// What the schema doesn't catch: the network and storage sections add up
+func (m *Machine) checkSections() error {
+	if err := m.checkNetwork(); err != nil {
+		return err
+	}
+	return m.checkStorageLayout()
+}
+
+// Read dir/name.yaml, or dir/name.yml when there is no .yaml, from
+// whichever storage dir is in
+func ReadDefinition(dir string, name string) ([]byte, error) {
+	storage := configpkg.StorageFor(dir)
+	data, err := storage.Read(configpkg.JoinLocation(dir, name+".yaml"))
+	if os.IsNotExist(err) {
+		data, err = storage.Read(configpkg.JoinLocation(dir, name+".yml"))
+	}
+	return data, err
+}
+
+// A group definition from grouppath or Consul, see config/consul.go
+func readGroupDefinition(group string, config configpkg.Config) ([]byte, error) {
+	if config.ConsulKV != nil {
+		return config.ConsulKV.Group(group)
+	}
+	return ReadDefinition(config.GroupPath, group)
+}
+
+// A machine definition from machinePath or Consul
+func ReadMachineDefinition(hostname string, machinePath string, config configpkg.Config) ([]byte, error) {
+	if config.ConsulKV != nil {
+		return config.ConsulKV.Machine(hostname)
+	}
+	return ReadDefinition(machinePath, hostname)
+}
+
+func VMDefinition(hostname string, config configpkg.Config) (Vm, error) {
+	var v Vm
+	data, err := ioutil.ReadFile(path.Join(config.VmPath, hostname+".yaml"))
+	if err != nil {
+		return Vm{}, err
+	}
+	if err = CheckDefinition(VMSchema, "vm", hostname, data, config); err != nil {
+		return Vm{}, err
+	}
+	err = yaml.Unmarshal(data, &v)
+	if err != nil {
+		return Vm{}, err
+	}
+	return v, nil
+}
+
+func LoadTemplate(template string, config configpkg.Config) (*pongo2.Template, error) {
+	template = configpkg.JoinLocation(config.TemplatePath, template)
+	if _, err := configpkg.StorageFor(template).ModTime(template); err != nil {
+		return nil, fmt.Errorf("template %q does not exist", template)
+	}
+	return configpkg.StorageTemplates.FromFile(template)
+}
+
+// Builds pxe config to be sent to pixiecore
+func (m Machine) PixieInit() (PixieConfig, error) {
+	pixieConfig := PixieConfig{}
+
+	var cmdline, imageURL, kernel, initrd string
+
+	if m.RescueMode {
+		cmdline = m.RescueCmdline
+		imageURL = m.RescueImageURL
+		kernel = m.RescueKernel
+		initrd = m.RescueInitrd
+	} else if stage := StageFor(m.State); stage != nil {
+		image, _, _ := stage.Image(&m)
+		cmdline = image.Cmdline
+		imageURL = image.ImageURL
+		kernel = image.Kernel
+		initrd = image.Initrd
+	} else {
+		cmdline = m.Cmdline
+		imageURL = m.ImageURL
+		kernel = m.Kernel
+		initrd = m.Initrd
+	}
+
+	tpl, err := pongo2.FromString(cmdline)
+	if err != nil {
+		return pixieConfig, err
+	}
+
+	cmdline, err = tpl.Execute(pongo2.Context{"machine": m, "BaseURL": m.BaseURL, "Hostname": m.Hostname, "Token": m.Token})
+	if err != nil {
+		return pixieConfig, err
+	}
+
+	pixieConfig.Kernel = m.bootAssetURL(imageURL, kernel)
+	pixieConfig.Initrd = []string{m.bootAssetURL(imageURL, initrd)}
+	pixieConfig.Cmdline = mergeCmdline(cmdline, m.ExtraCmdline)
+
+	return pixieConfig, nil
+}
+
+// Add the parameters in extra to cmdline, one that is already there with
+// the same name, the part before any =, is replaced instead
+func mergeCmdline(cmdline string, extra string) string {
+	params := strings.Fields(cmdline)
+	for _, e := range strings.Fields(extra) {
+		name := strings.SplitN(e, "=", 2)[0]
+		replaced := false
+		for i, p := range params {
+			if strings.SplitN(p, "=", 2)[0] == name {
+				params[i] = e
+				replaced = true
+			}
+		}
+		if !replaced {
+			params = append(params, e)
+		}
+	}
+	if extra == "" {
+		return cmdline
+	}
+	return strings.Join(params, " ")
+}
+
+// This should ensure that even commands that spawn child processes are cleaned up correctly, along with their children.
+func (m Machine) TimedCommandOutput(timeout time.Duration, command string) (out []byte, err error) {
+	cmd := exec.Command("bash", "-c", command)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	time.AfterFunc(timeout, func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	})
+
+	out, err = cmd.Output()
+
+	return out, err
+}
+
+// Run the prebuild, postbuild, cancelbuild or stale commands of m. With
+// simulate they are only logged.
+func (m Machine) RunBuildCommands(b []configpkg.BuildCommand) error {
+	for _, buildCommand := range b {
+
+		if buildCommand.TimeoutSeconds == 0 {
+			buildCommand.TimeoutSeconds = 5
+		}
+
+		tpl, err := pongo2.FromString(buildCommand.Command)
+		if err != nil {
+			return err
+		}
+
+		cmdline, err := tpl.Execute(pongo2.Context{"machine": m, "Token": m.Token})
+
+		if buildCommand.ShouldLog {
+			logger.Machine(&m).Info("running build command", "command", cmdline)
+		}
+
+		if err != nil {
+			return err
+		}
+
+		// Rendered and logged but not run, like hooks
+		if m.Simulate {
+			logger.Machine(&m).Info("simulated build command", "command", cmdline)
+			continue
+		}
+
+		// Now actually execute the command and return err if ErrorsFatal
+		out, err := m.TimedCommandOutput(time.Duration(buildCommand.TimeoutSeconds)*time.Second, cmdline)
+
+		if err != nil && buildCommand.ErrorsFatal {
+			return errors.New(err.Error() + ":" + string(out))
+		}
+	}
+
+	return nil
+}
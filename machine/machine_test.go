@@ -0,0 +1,32 @@
+package machine
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+)
+
+// The tests read config.yaml, machines, groups and templates from the top of
+// the repository
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestMachineDefinition(t *testing.T) {
+	config, _ := config.LoadConfig("config.yaml")
+	m, err := MachineDefinition("dns02.example.com", "machines", config)
+
+	if err != nil {
+		t.Errorf("Unable to load test machine definition")
+	}
+	if m.Hostname != "dns02.example.com" {
+		t.Errorf("expected hostname: dns02.example.com")
+	}
+	if m.ShortName != "dns02" {
+		t.Errorf("invalid shortname")
+	}
+}
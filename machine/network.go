@@ -0,0 +1,338 @@
+package machine
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/flosch/pongo2"
+)
+
+// A definition's network section declares the interfaces of a machine once,
+// dual-stack or not, and templates render it for whichever installer they
+// are for:
+//
+//	{{ netplan_network(4) }}  a netplan network section, which autoinstall takes too, indented
+//	{{ kickstart_network() }} kickstart network lines
+//	{{ preseed_network() }}   preseed netcfg lines for the interface the installer uses
+//
+// Every interface has any number of addresses4 and addresses6, with the
+// prefix in cidr, in the netmask or after the address, 2001:db8::10/64.
+// dhcp4, dhcp6 and accept_ra, for router advertisements, say what it
+// configures itself with besides, or instead. Without accept_ra the
+// installer's default holds. The section is checked when the definition is
+// loaded.
+
+var errNoInterfaces = errors.New("the definition has no network interfaces")
+
+// The address of a, family bits long, and its prefix length, -1 when it has
+// none
+func (a IPConfig) parse(bits int) (net.IP, int, error) {
+	family := 4
+	if bits == 128 {
+		family = 6
+	}
+	address, length := a.IPAddress, a.Cidr
+	if i := strings.Index(address, "/"); i >= 0 {
+		address, length = address[:i], address[i+1:]
+	}
+	ip := net.ParseIP(address)
+	if ip == nil || (ip.To4() != nil) != (family == 4) {
+		return nil, 0, fmt.Errorf("invalid IPv%d address %q", family, a.IPAddress)
+	}
+	switch {
+	case length != "":
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 || n > bits {
+			return nil, 0, fmt.Errorf("invalid prefix length %q for %s", length, address)
+		}
+		return ip, n, nil
+	case a.Netmask != "":
+		mask := net.ParseIP(a.Netmask)
+		if family == 4 {
+			mask = mask.To4()
+		}
+		ones, size := net.IPMask(mask).Size()
+		if mask == nil || size != bits {
+			return nil, 0, fmt.Errorf("invalid netmask %q for %s", a.Netmask, address)
+		}
+		return ip, ones, nil
+	}
+	return ip, -1, nil
+}
+
+// The address of a and its prefix length, which rendering needs
+func (a IPConfig) prefix(bits int) (net.IP, int, error) {
+	ip, n, err := a.parse(bits)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("no prefix length for %s", a.IPAddress)
+	}
+	return ip, n, err
+}
+
+// Refuse a network section that doesn't add up. An address without a prefix
+// still loads, one is only needed to render it.
+func (m *Machine) checkNetwork() error {
+	for n, i := range m.Network {
+		var err error
+		for _, a := range i.Addresses4 {
+			if _, _, e := a.parse(32); err == nil {
+				err = e
+			}
+		}
+		for _, a := range i.Addresses6 {
+			if _, _, e := a.parse(128); err == nil {
+				err = e
+			}
+		}
+		if ip := net.ParseIP(i.Gateway4); err == nil && i.Gateway4 != "" && (ip == nil || ip.To4() == nil) {
+			err = fmt.Errorf("invalid IPv4 gateway %q", i.Gateway4)
+		}
+		if ip := net.ParseIP(i.Gateway6); err == nil && i.Gateway6 != "" && (ip == nil || ip.To4() != nil) {
+			err = fmt.Errorf("invalid IPv6 gateway %q", i.Gateway6)
+		}
+		for _, ns := range i.Nameservers {
+			if err == nil && net.ParseIP(ns) == nil {
+				err = fmt.Errorf("invalid nameserver %q", ns)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("network of %s: interface %d: %s", m.Hostname, n, err)
+		}
+	}
+	return nil
+}
+
+// Every address of i in CIDR notation, IPv4 first
+func (i Interface) cidrs() ([]string, error) {
+	var list []string
+	for _, family := range []struct {
+		addresses []IPConfig
+		bits      int
+	}{{i.Addresses4, 32}, {i.Addresses6, 128}} {
+		for _, a := range family.addresses {
+			ip, n, err := a.prefix(family.bits)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, fmt.Sprintf("%s/%d", ip, n))
+		}
+	}
+	return list, nil
+}
+
+// What installers know i by, its name or else its MAC address
+func (i Interface) device() string {
+	if i.Name != "" {
+		return i.Name
+	}
+	return i.MacAddress
+}
+
+// A netplan network section for the interfaces of m, with every line
+// indented by indent spaces
+func (m Machine) netplan(indent int) (string, error) {
+	if len(m.Network) == 0 {
+		return "", errNoInterfaces
+	}
+	var b bytes.Buffer
+	prefix := strings.Repeat(" ", indent)
+	fmt.Fprintf(&b, "%snetwork:\n%s  version: 2\n%s  ethernets:\n", prefix, prefix, prefix)
+	line := func(depth int, format string, args ...interface{}) {
+		fmt.Fprintf(&b, "%s%s%s\n", prefix, strings.Repeat("  ", depth), fmt.Sprintf(format, args...))
+	}
+	for n, i := range m.Network {
+		cidrs, err := i.cidrs()
+		if err != nil {
+			return "", err
+		}
+		id := i.Name
+		if id == "" {
+			id = fmt.Sprintf("interface%d", n)
+		}
+		line(2, "%s:", id)
+		if i.MacAddress != "" {
+			line(3, "match:")
+			line(4, "macaddress: %q", strings.ToLower(i.MacAddress))
+			if i.Name != "" {
+				line(3, "set-name: %s", i.Name)
+			}
+		}
+		line(3, "dhcp4: %t", i.DHCP4)
+		line(3, "dhcp6: %t", i.DHCP6)
+		if i.AcceptRA != nil {
+			line(3, "accept-ra: %t", *i.AcceptRA)
+		}
+		if len(cidrs) > 0 {
+			line(3, "addresses: [%s]", quoteAll(cidrs))
+		}
+		var routes []string
+		for _, gateway := range []struct{ via, to string }{{i.Gateway4, "0.0.0.0/0"}, {i.Gateway6, "::/0"}} {
+			if gateway.via != "" {
+				routes = append(routes, fmt.Sprintf("{to: %q, via: %q}", gateway.to, gateway.via))
+			}
+		}
+		if len(routes) > 0 {
+			line(3, "routes:")
+			for _, r := range routes {
+				line(4, "- %s", r)
+			}
+		}
+		if len(i.Nameservers) > 0 || m.Domain != "" {
+			line(3, "nameservers:")
+			if len(i.Nameservers) > 0 {
+				line(4, "addresses: [%s]", quoteAll(i.Nameservers))
+			}
+			if m.Domain != "" {
+				line(4, "search: [%s]", m.Domain)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+func quoteAll(list []string) string {
+	quoted := make([]string, len(list))
+	for n, s := range list {
+		quoted[n] = strconv.Quote(s)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// A kickstart network line for every interface of m, which take one address
+// of each family
+func (m Machine) kickstartNetwork() (string, error) {
+	if len(m.Network) == 0 {
+		return "", errNoInterfaces
+	}
+	var b bytes.Buffer
+	for n, i := range m.Network {
+		if len(i.Addresses4) > 1 || len(i.Addresses6) > 1 {
+			return "", fmt.Errorf("kickstart takes one address of each family per interface, %s has %d and %d",
+				i.device(), len(i.Addresses4), len(i.Addresses6))
+		}
+		args := []string{"network", "--device=" + i.device(), "--onboot=yes", "--activate"}
+		switch {
+		case len(i.Addresses4) == 1:
+			ip, bits, err := i.Addresses4[0].prefix(32)
+			if err != nil {
+				return "", err
+			}
+			args = append(args, "--bootproto=static", "--ip="+ip.String(), "--netmask="+net.IP(net.CIDRMask(bits, 32)).String())
+			if i.Gateway4 != "" {
+				args = append(args, "--gateway="+i.Gateway4)
+			}
+		case i.DHCP4:
+			args = append(args, "--bootproto=dhcp")
+		default:
+			args = append(args, "--noipv4")
+		}
+		switch {
+		case len(i.Addresses6) == 1:
+			ip, bits, err := i.Addresses6[0].prefix(128)
+			if err != nil {
+				return "", err
+			}
+			args = append(args, fmt.Sprintf("--ipv6=%s/%d", ip, bits))
+			if i.Gateway6 != "" {
+				args = append(args, "--ipv6gateway="+i.Gateway6)
+			}
+		case i.DHCP6:
+			args = append(args, "--ipv6=dhcp")
+		case i.AcceptRA == nil || *i.AcceptRA:
+			args = append(args, "--ipv6=auto")
+		default:
+			args = append(args, "--noipv6")
+		}
+		if len(i.Nameservers) > 0 {
+			args = append(args, "--nameserver="+strings.Join(i.Nameservers, ","))
+		}
+		if n == 0 {
+			args = append(args, "--hostname="+m.Hostname)
+		}
+		b.WriteString(strings.Join(args, " ") + "\n")
+	}
+	return b.String(), nil
+}
+
+// preseed netcfg lines. debian-installer brings up one interface with one
+// address, the first static one, IPv4 before IPv6, and the installed system
+// gets the rest from the finish template.
+func (m Machine) preseedNetwork() (string, error) {
+	if len(m.Network) == 0 {
+		return "", errNoInterfaces
+	}
+	i := m.Network[0]
+	var address IPConfig
+	var bits int
+	for _, n := range m.Network {
+		if len(n.Addresses4) > 0 {
+			i, address, bits = n, n.Addresses4[0], 32
+			break
+		}
+		if len(n.Addresses6) > 0 && bits == 0 {
+			i, address, bits = n, n.Addresses6[0], 128
+		}
+	}
+
+	var b bytes.Buffer
+	choose := i.Name
+	if choose == "" {
+		choose = "auto"
+	}
+	fmt.Fprintf(&b, "d-i netcfg/choose_interface select %s\n", choose)
+	if bits == 0 {
+		b.WriteString("d-i netcfg/disable_autoconfig boolean false\n")
+	} else {
+		ip, n, err := address.prefix(bits)
+		if err != nil {
+			return "", err
+		}
+		gateway := i.Gateway4
+		if bits == 128 {
+			gateway = i.Gateway6
+		}
+		b.WriteString("d-i netcfg/disable_autoconfig boolean true\n")
+		fmt.Fprintf(&b, "d-i netcfg/get_ipaddress string %s\n", ip)
+		fmt.Fprintf(&b, "d-i netcfg/get_netmask string %s\n", net.IP(net.CIDRMask(n, bits)))
+		if gateway != "" {
+			fmt.Fprintf(&b, "d-i netcfg/get_gateway string %s\n", gateway)
+		} else {
+			b.WriteString("d-i netcfg/no_default_route boolean true\n")
+		}
+		b.WriteString("d-i netcfg/confirm_static boolean true\n")
+	}
+	if len(i.Nameservers) > 0 {
+		fmt.Fprintf(&b, "d-i netcfg/get_nameservers string %s\n", strings.Join(i.Nameservers, " "))
+	}
+	hostname := m.ShortName
+	if hostname == "" {
+		hostname = m.Hostname
+	}
+	fmt.Fprintf(&b, "d-i netcfg/get_hostname string %s\n", hostname)
+	fmt.Fprintf(&b, "d-i netcfg/get_domain string %s\n", m.Domain)
+	return b.String(), nil
+}
+
+// For templates: render the network section of m, see template.Vars
+func NetworkTemplateHelpers(m Machine) pongo2.Context {
+	safe := func(s string, err error) (*pongo2.Value, error) {
+		if err != nil {
+			return nil, err
+		}
+		return pongo2.AsSafeValue(s), nil
+	}
+	return pongo2.Context{
+		"netplan_network": func(indent ...int) (*pongo2.Value, error) {
+			if len(indent) == 0 {
+				indent = []int{0}
+			}
+			return safe(m.netplan(indent[0]))
+		},
+		"kickstart_network": func() (*pongo2.Value, error) { return safe(m.kickstartNetwork()) },
+		"preseed_network":   func() (*pongo2.Value, error) { return safe(m.preseedNetwork()) },
+	}
+}
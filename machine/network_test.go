@@ -0,0 +1,139 @@
+package machine
+
+import (
+	"strings"
+	"testing"
+)
+
+func testDualStackMachine() Machine {
+	no := false
+	return Machine{Hostname: "dns02.example.com", ShortName: "dns02", Domain: "example.com", Network: []Interface{
+		{
+			Name:        "eno1",
+			MacAddress:  "DE:AD:C0:DE:CA:FE",
+			Addresses4:  []IPConfig{{IPAddress: "192.0.2.10", Netmask: "255.255.255.0"}},
+			Addresses6:  []IPConfig{{IPAddress: "2001:db8::10/64"}},
+			Gateway4:    "192.0.2.1",
+			Gateway6:    "2001:db8::1",
+			AcceptRA:    &no,
+			Nameservers: []string{"192.0.2.53", "2001:db8::53"},
+		},
+		{Name: "eno2", DHCP4: true, DHCP6: true},
+	}}
+}
+
+func TestNetworkValidate(t *testing.T) {
+	m := testDualStackMachine()
+	if err := m.checkNetwork(); err != nil {
+		t.Fatal(err)
+	}
+	// Only rendering needs the prefix
+	m.Network[1].Addresses6 = []IPConfig{{IPAddress: "2001:db8::11"}}
+	if err := m.checkNetwork(); err != nil {
+		t.Errorf("expected an address without a prefix to load, got %v", err)
+	}
+
+	for problem, change := range map[string]func(i *Interface){
+		"invalid IPv4 address":  func(i *Interface) { i.Addresses4[0].IPAddress = "2001:db8::10" },
+		"invalid IPv6 address":  func(i *Interface) { i.Addresses6[0].IPAddress = "192.0.2.10/24" },
+		"invalid prefix length": func(i *Interface) { i.Addresses6[0].IPAddress = "2001:db8::10/129" },
+		"invalid netmask":       func(i *Interface) { i.Addresses4[0].Netmask = "255.0.255.0" },
+		"invalid IPv6 gateway":  func(i *Interface) { i.Gateway6 = "192.0.2.1" },
+		"invalid nameserver":    func(i *Interface) { i.Nameservers = []string{"ns1.example.com"} },
+	} {
+		m := testDualStackMachine()
+		change(&m.Network[0])
+		if err := m.checkNetwork(); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q, got %v", problem, err)
+		}
+	}
+}
+
+func TestNetworkRender(t *testing.T) {
+	m := testDualStackMachine()
+
+	netplan, err := m.netplan(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `  network:
+    version: 2
+    ethernets:
+      eno1:
+        match:
+          macaddress: "de:ad:c0:de:ca:fe"
+        set-name: eno1
+        dhcp4: false
+        dhcp6: false
+        accept-ra: false
+        addresses: ["192.0.2.10/24", "2001:db8::10/64"]
+        routes:
+          - {to: "0.0.0.0/0", via: "192.0.2.1"}
+          - {to: "::/0", via: "2001:db8::1"}
+        nameservers:
+          addresses: ["192.0.2.53", "2001:db8::53"]
+          search: [example.com]
+      eno2:
+        dhcp4: true
+        dhcp6: true
+        nameservers:
+          search: [example.com]
+`
+	if netplan != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, netplan)
+	}
+
+	kickstart, err := m.kickstartNetwork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"network --device=eno1 --onboot=yes --activate --bootproto=static --ip=192.0.2.10 --netmask=255.255.255.0 --gateway=192.0.2.1 " +
+			"--ipv6=2001:db8::10/64 --ipv6gateway=2001:db8::1 --nameserver=192.0.2.53,2001:db8::53 --hostname=dns02.example.com\n",
+		"network --device=eno2 --onboot=yes --activate --bootproto=dhcp --ipv6=dhcp\n",
+	} {
+		if !strings.Contains(kickstart, line) {
+			t.Errorf("expected %q in\n%s", line, kickstart)
+		}
+	}
+
+	preseed, err := m.preseedNetwork()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"d-i netcfg/choose_interface select eno1\n",
+		"d-i netcfg/disable_autoconfig boolean true\n",
+		"d-i netcfg/get_ipaddress string 192.0.2.10\n",
+		"d-i netcfg/get_netmask string 255.255.255.0\n",
+		"d-i netcfg/get_gateway string 192.0.2.1\n",
+		"d-i netcfg/get_nameservers string 192.0.2.53 2001:db8::53\n",
+		"d-i netcfg/get_hostname string dns02\n",
+	} {
+		if !strings.Contains(preseed, line) {
+			t.Errorf("expected %q in\n%s", line, preseed)
+		}
+	}
+
+	// IPv6 only, the installer comes up on the IPv6 address
+	m.Network[0].Addresses4, m.Network[0].Gateway4 = nil, ""
+	if preseed, err = m.preseedNetwork(); err != nil || !strings.Contains(preseed, "get_ipaddress string 2001:db8::10\n") ||
+		!strings.Contains(preseed, "get_netmask string ffff:ffff:ffff:ffff::\n") || !strings.Contains(preseed, "get_gateway string 2001:db8::1\n") {
+		t.Errorf("expected the IPv6 address, got %q %v", preseed, err)
+	}
+	if kickstart, err = m.kickstartNetwork(); err != nil || !strings.Contains(kickstart, "--activate --noipv4 --ipv6=2001:db8::10/64") {
+		t.Errorf("expected IPv4 off, got %q %v", kickstart, err)
+	}
+
+	m.Network[0].Addresses6 = append(m.Network[0].Addresses6, IPConfig{IPAddress: "2001:db8::20", Cidr: "64"})
+	if _, err := m.kickstartNetwork(); err == nil {
+		t.Error("expected kickstart to refuse two IPv6 addresses on an interface")
+	}
+	m.Network[0].Addresses6 = []IPConfig{{IPAddress: "2001:db8::10"}}
+	if _, err := m.netplan(0); err == nil {
+		t.Error("expected an address without a prefix not to render")
+	}
+	if _, err := (Machine{}).preseedNetwork(); err != errNoInterfaces {
+		t.Errorf("expected no interfaces, got %v", err)
+	}
+}
@@ -0,0 +1,39 @@
+package machine
+
+import (
+	"fmt"
+
+	"github.com/flosch/pongo2"
+)
+
+// Refuse a storage section that doesn't add up
+func (m *Machine) checkStorageLayout() error {
+	if m.StorageLayout == nil {
+		return nil
+	}
+	if err := m.StorageLayout.Validate(); err != nil {
+		return fmt.Errorf("storage of %s: %s", m.Hostname, err)
+	}
+	return nil
+}
+
+// For templates: render the storage section of m, see template.Vars
+func StorageTemplateHelpers(m Machine) pongo2.Context {
+	safe := func(s string, err error) (*pongo2.Value, error) {
+		if err != nil {
+			return nil, err
+		}
+		return pongo2.AsSafeValue(s), nil
+	}
+	l := m.StorageLayout
+	return pongo2.Context{
+		"partman_recipe":    func() (*pongo2.Value, error) { return safe(l.Partman()) },
+		"kickstart_storage": func() (*pongo2.Value, error) { return safe(l.Kickstart()) },
+		"curtin_storage": func(indent ...int) (*pongo2.Value, error) {
+			if len(indent) == 0 {
+				indent = []int{0}
+			}
+			return safe(l.Curtin(indent[0]))
+		},
+	}
+}
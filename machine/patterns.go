@@ -0,0 +1,196 @@
+package machine
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/flosch/pongo2"
+	configpkg "github.com/ns1/waitron/config"
+)
+
+// A machine definition whose name isn't a plain hostname is a pattern that
+// any hostname without a definition of its own can match, so a farm of
+// identical nodes needs one file rather than one per node:
+//
+//	*.dc1.example.com.yaml               * and ? within one label
+//	compute-\d+\.dc1\.example\.com.yaml  anything else is a regular expression
+//
+// Patterns match the whole hostname, ignoring case, and are tried longest
+// first. The definition is rendered as a template for the hostname, with
+// what the pattern captured as captures: {{ captures.node }} for a named
+// group, {{ captures|key:"1" }} for a numbered one. Templates see the same
+// as machine.Captures.
+
+var (
+	patternMux   sync.Mutex
+	patternCache = make(map[string]*regexp.Regexp)
+)
+
+// Whether name, without its extension, is a pattern rather than a hostname
+func isPatternName(name string) bool {
+	return strings.IndexFunc(name, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_')
+	}) >= 0
+}
+
+func isGlob(name string) bool {
+	return strings.IndexFunc(name, func(c rune) bool {
+		return !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '-' || c == '_' || c == '*' || c == '?')
+	}) < 0
+}
+
+// The regular expression for a pattern name, globs capture every wildcard
+func compilePattern(name string) (*regexp.Regexp, error) {
+	expr := name
+	if isGlob(name) {
+		var b strings.Builder
+		for _, c := range name {
+			switch c {
+			case '*':
+				b.WriteString(`([^.]*)`)
+			case '?':
+				b.WriteString(`([^.])`)
+			default:
+				b.WriteString(regexp.QuoteMeta(string(c)))
+			}
+		}
+		expr = b.String()
+	}
+	return regexp.Compile(`(?i)^(?:` + expr + `)$`)
+}
+
+// Compiled once per name, nil when it doesn't compile
+func cachedPattern(name string) *regexp.Regexp {
+	patternMux.Lock()
+	defer patternMux.Unlock()
+	re, found := patternCache[name]
+	if !found {
+		var err error
+		if re, err = compilePattern(name); err != nil {
+			logger.Warn("ignoring machine definition with an invalid pattern", "pattern", name, "error", err)
+		}
+		patternCache[name] = re
+	}
+	return re
+}
+
+// The longest of the patterns in files matching hostname and what it
+// captured
+func matchPattern(hostname string, files []configpkg.StorageEntry) (string, map[string]string) {
+	var names []string
+	for _, f := range files {
+		ext := path.Ext(f.Name)
+		if !f.Dir && (ext == ".yaml" || ext == ".yml") && isPatternFile(f.Name) {
+			names = append(names, f.Name)
+		}
+	}
+	// Longer patterns are likely more specific
+	sort.Slice(names, func(i, j int) bool {
+		if len(names[i]) != len(names[j]) {
+			return len(names[i]) > len(names[j])
+		}
+		return names[i] < names[j]
+	})
+
+	for _, name := range names {
+		re := cachedPattern(strings.TrimSuffix(name, path.Ext(name)))
+		if re == nil {
+			continue
+		}
+		match := re.FindStringSubmatch(hostname)
+		if match == nil {
+			continue
+		}
+		captures := make(map[string]string)
+		for i, group := range re.SubexpNames() {
+			captures[strconv.Itoa(i)] = match[i]
+			if group != "" {
+				captures[group] = match[i]
+			}
+		}
+		return name, captures
+	}
+	return "", nil
+}
+
+// The pattern definition matching hostname rendered for it, with its name
+// and captures. An os.IsNotExist error when no pattern matches.
+func readPatternDefinition(hostname string, machinePath string, config configpkg.Config) (string, map[string]string, []byte, error) {
+	var files []configpkg.StorageEntry
+	var err error
+	if config.ConsulKV != nil {
+		files = config.ConsulKV.MachineFiles()
+	} else if files, err = configpkg.StorageFor(machinePath).List(machinePath); err != nil {
+		return "", nil, nil, err
+	}
+
+	name, captures := matchPattern(hostname, files)
+	if name == "" {
+		return "", nil, nil, configpkg.NotExist(configpkg.JoinLocation(machinePath, hostname+".yaml"))
+	}
+
+	var data []byte
+	if config.ConsulKV != nil {
+		data, err = config.ConsulKV.Machine(strings.TrimSuffix(name, path.Ext(name)))
+	} else {
+		location := configpkg.JoinLocation(machinePath, name)
+		data, err = configpkg.StorageFor(location).Read(location)
+	}
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	data, err = renderPatternDefinition(name, data, hostname, captures)
+	return name, captures, data, err
+}
+
+func renderPatternDefinition(name string, data []byte, hostname string, captures map[string]string) ([]byte, error) {
+	pongo2.RegisterFilter("key", FilterGetValueByKey)
+	tpl, err := pongo2.FromString(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	out, err := tpl.Execute(pongo2.Context{"hostname": hostname, "captures": captures})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err)
+	}
+	return []byte(out), nil
+}
+
+// Check a pattern definition the way readPatternDefinition will use it
+func validatePatternDefinition(name string, data []byte) error {
+	if _, err := compilePattern(strings.TrimSuffix(name, path.Ext(name))); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	if _, err := pongo2.FromString(string(data)); err != nil {
+		return fmt.Errorf("%s: %s", name, err)
+	}
+	return nil
+}
+
+// Whether any machine definition is a pattern
+func HasPatternDefinitions(config configpkg.Config) (bool, error) {
+	var files []configpkg.StorageEntry
+	var err error
+	if config.ConsulKV != nil {
+		files = config.ConsulKV.MachineFiles()
+	} else if files, err = configpkg.StorageFor(config.MachinePath).List(config.MachinePath); err != nil {
+		return false, err
+	}
+	for _, file := range files {
+		if !file.Dir && isPatternFile(file.Name) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Whether the machine definition file name is a pattern
+func isPatternFile(name string) bool {
+	return isPatternName(strings.TrimSuffix(name, path.Ext(name)))
+}
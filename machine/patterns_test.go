@@ -0,0 +1,84 @@
+package machine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	configpkg "github.com/ns1/waitron/config"
+)
+
+func TestMatchPattern(t *testing.T) {
+	files := []configpkg.StorageEntry{
+		{Name: "node01.dc1.example.com.yaml"},
+		{Name: `compute-(?P<node>\d+)\.dc1\.example\.com.yaml`},
+		{Name: "*.dc1.example.com.yml"},
+		{Name: "broken(.yaml"},
+		{Name: "web-??.example.com"},
+	}
+	for _, c := range []struct {
+		hostname string
+		pattern  string
+		capture  string
+	}{
+		{"compute-17.dc1.example.com", `compute-(?P<node>\d+)\.dc1\.example\.com.yaml`, "17"},
+		{"Compute-17.DC1.example.com", `compute-(?P<node>\d+)\.dc1\.example\.com.yaml`, "17"},
+		{"storage-3.dc1.example.com", "*.dc1.example.com.yml", "storage-3"},
+		{"compute-17.dc2.example.com", "", ""},
+		{"rack.compute-17.dc1.example.com", "", ""},
+		{"web-01.example.com", "", ""}, // no extension, not a definition
+	} {
+		pattern, captures := matchPattern(c.hostname, files)
+		if pattern != c.pattern || captures["1"] != c.capture {
+			t.Errorf("%s: expected %q capturing %q, got %q %v", c.hostname, c.pattern, c.capture, pattern, captures)
+		}
+	}
+}
+
+func TestPatternDefinition(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-patterns")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{
+		`compute-(?P<node>\d+)\.example\.com.yaml`: `{"operatingsystem": "debian", "params": {"node": "{{ captures.node }}", "host": "{{ hostname }}"}}`,
+		"compute-1.example.com.yaml":               `{"operatingsystem": "ubuntu"}`,
+		"node01.example.com.yaml":                  `{"operatingsystem": "centos"}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := configpkg.Config{GroupPath: dir}
+
+	m, err := MachineDefinition("compute-42.example.com", dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.OperatingSystem != "debian" || m.Params["node"] != "42" || m.Params["host"] != "compute-42.example.com" {
+		t.Errorf("expected the pattern rendered for the hostname, got %s %v", m.OperatingSystem, m.Params)
+	}
+	if m.Pattern != `compute-(?P<node>\d+)\.example\.com.yaml` || m.Captures["node"] != "42" {
+		t.Errorf("expected the captures on the machine, got %q %v", m.Pattern, m.Captures)
+	}
+
+	// A definition of its own wins over any pattern
+	if m, err := MachineDefinition("compute-1.example.com", dir, config); err != nil || m.OperatingSystem != "ubuntu" || m.Pattern != "" {
+		t.Errorf("expected the machine's own definition, got %+v, %v", m, err)
+	}
+
+	if _, err := MachineDefinition("storage-1.example.com", dir, config); !os.IsNotExist(err) {
+		t.Errorf("expected no definition without a match, got %v", err)
+	}
+
+	// Patterns aren't machines of their own
+	inv := NewInventory(configpkg.Config{MachinePath: dir, GroupPath: dir})
+	if err := inv.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if files := inv.List(); len(files) != 2 {
+		t.Errorf("expected only the plain definitions indexed, got %v", files)
+	}
+}
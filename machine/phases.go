@@ -0,0 +1,65 @@
+package machine
+
+import (
+	"time"
+)
+
+// Phases recorded automatically as a build moves through Waitron
+const (
+	PhaseTokenIssued = "token-issued"
+	PhaseVMBooted    = "vm-booted"
+	PhaseBootServed  = "boot-config-served"
+	PhasePreseed     = "preseed-fetched"
+	PhaseFinish      = "finish-fetched"
+	PhaseValidating  = "validating"
+	PhasePhonedHome  = "phoned-home"
+	PhaseCloudInit   = "cloud-init-fetched"
+	PhaseDone        = "done"
+	PhaseCancelled   = "cancelled"
+	PhaseRetried     = "retried"
+)
+
+// BuildPhase is a timestamped step in a build, either recorded by Waitron or
+// reported by the installer.
+type BuildPhase struct {
+	Name      string
+	Timestamp time.Time
+	Reported  bool   `json:",omitempty"`
+	Message   string `json:",omitempty"`
+}
+
+// BuildRecord is what is kept about a build once it leaves build mode.
+type BuildRecord struct {
+	Hostname    string
+	Token       string
+	Status      string
+	State       BuildState        `json:",omitempty"`
+	Transitions []StateTransition `json:",omitempty"`
+	BuildStart  time.Time
+	BuildEnd    time.Time
+	Phases      []BuildPhase
+	Progress    *BuildProgress `json:",omitempty"`
+	HookResults []HookResult   `json:",omitempty"`
+	Artifacts   []ArtifactInfo `json:",omitempty"`
+}
+
+// Append a phase to the machine. Callers must hold state.Mux if m is in state.
+func (m *Machine) AddPhase(name string, reported bool, message string) {
+	m.Phases = append(m.Phases, BuildPhase{Name: name, Timestamp: time.Now(), Reported: reported, Message: message})
+}
+
+func (m *Machine) BuildRecord() BuildRecord {
+	return BuildRecord{
+		Hostname:    m.Hostname,
+		Token:       m.Token,
+		Status:      m.Status,
+		State:       m.State,
+		Transitions: m.Transitions,
+		BuildStart:  m.BuildStart,
+		BuildEnd:    time.Now(),
+		Phases:      m.Phases,
+		Progress:    m.Progress,
+		HookResults: m.HookResults,
+		Artifacts:   m.Artifacts,
+	}
+}
@@ -0,0 +1,109 @@
+package machine
+
+import (
+	"io/ioutil"
+	"path"
+	"strings"
+
+	configpkg "github.com/ns1/waitron/config"
+)
+
+// Plugin types
+const (
+	PluginTypeHook      = "hook"
+	pluginTypeInventory = "inventory"
+)
+
+// Plugin actions
+const (
+	pluginActionInfo    = "info"
+	pluginActionHealth  = "health"
+	PluginActionHook    = "hook"
+	pluginActionMachine = "machine"
+	pluginActionMAC     = "mac"
+)
+
+// Find the executables in dir, ask each what it is and check its health.
+// Plugins failing either are logged and left out.
+func DiscoverPlugins(dir string) ([]*configpkg.Plugin, error) {
+	plugins := make([]*configpkg.Plugin, 0)
+	if dir == "" {
+		return plugins, nil
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return plugins, err
+	}
+
+	for _, file := range files {
+		if file.IsDir() || file.Mode()&0111 == 0 {
+			continue
+		}
+
+		p := &configpkg.Plugin{Name: file.Name(), Path: path.Join(dir, file.Name())}
+
+		info, err := p.CallWithTimeout(configpkg.PluginRequest{Action: pluginActionInfo})
+		if err != nil {
+			logger.Error("cannot load plugin", "path", p.Path, "error", err)
+			continue
+		}
+		if info.Name != "" {
+			p.Name = info.Name
+		}
+		p.Types = info.Types
+
+		if _, err := p.CallWithTimeout(configpkg.PluginRequest{Action: pluginActionHealth}); err != nil {
+			logger.Error("plugin failed its health check", "plugin", p.Name, "error", err)
+			continue
+		}
+
+		logger.Info("loaded plugin", "plugin", p.Name, "types", strings.Join(p.Types, ","), "path", p.Path)
+		plugins = append(plugins, p)
+	}
+
+	return plugins, nil
+}
+
+// Ask every inventory plugin about hostname, returning the definitions of
+// those that know it, in plugin order.
+func inventoryFromPlugins(config configpkg.Config, hostname string) ([][]byte, error) {
+	var definitions [][]byte
+
+	for _, p := range config.Plugins {
+		if !p.HasType(pluginTypeInventory) {
+			continue
+		}
+
+		resp, err := p.CallWithTimeout(configpkg.PluginRequest{Action: pluginActionMachine, Hostname: hostname})
+		if err != nil {
+			return definitions, err
+		}
+		if resp.Found && len(resp.Machine) > 0 {
+			definitions = append(definitions, resp.Machine)
+		}
+	}
+
+	return definitions, nil
+}
+
+// Ask every inventory plugin whose machine has the MAC address mac, "" when
+// none of them knows it. A plugin that can't tell, one without the mac action
+// among them, is an error.
+func MachineForMACFromPlugins(config configpkg.Config, mac string) (string, error) {
+	for _, p := range config.Plugins {
+		if !p.HasType(pluginTypeInventory) {
+			continue
+		}
+
+		resp, err := p.CallWithTimeout(configpkg.PluginRequest{Action: pluginActionMAC, MacAddress: mac})
+		if err != nil {
+			return "", err
+		}
+		if resp.Found {
+			return resp.Hostname, nil
+		}
+	}
+
+	return "", nil
+}
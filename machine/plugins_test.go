@@ -0,0 +1,94 @@
+package machine
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	configpkg "github.com/ns1/waitron/config"
+)
+
+const testPlugin = `#!/bin/sh
+input=$(cat)
+case "$input" in
+  *'"Action":"info"'*) echo '{"Name":"test","Types":["hook","inventory"]}' ;;
+  *'"Action":"health"'*) echo '{}' ;;
+  *'"Action":"machine"'*'"Hostname":"dns02.example.com"'*) echo '{"Found":true,"Machine":{"params":{"rack":"r1"}}}' ;;
+  *'"Action":"machine"'*) echo '{"Found":false}' ;;
+  *'"Action":"mac"'*'"MacAddress":"de:ad:c0:de:ca:fe"'*) echo '{"Found":true,"Hostname":"dns02.example.com"}' ;;
+  *'"Action":"mac"'*) echo '{"Found":false}' ;;
+  *'"Action":"hook"'*) echo '{"Output":"hooked"}' ;;
+esac
+`
+
+const unhealthyPlugin = `#!/bin/sh
+input=$(cat)
+case "$input" in
+  *'"Action":"info"'*) echo '{"Name":"broken","Types":["hook"]}' ;;
+  *) echo '{"Error":"backend unreachable"}' ;;
+esac
+`
+
+func pluginDir(t *testing.T) string {
+	dir, _ := ioutil.TempDir("", "waitron-plugins")
+	ioutil.WriteFile(path.Join(dir, "test-plugin"), []byte(testPlugin), 0700)
+	ioutil.WriteFile(path.Join(dir, "broken-plugin"), []byte(unhealthyPlugin), 0700)
+	ioutil.WriteFile(path.Join(dir, "README"), []byte("not a plugin"), 0600)
+	return dir
+}
+
+func TestDiscoverPlugins(t *testing.T) {
+	dir := pluginDir(t)
+	defer os.RemoveAll(dir)
+
+	plugins, err := DiscoverPlugins(dir)
+	if err != nil {
+		t.Fatalf("discovery failed: %s", err)
+	}
+	if len(plugins) != 1 || plugins[0].Name != "test" {
+		t.Fatalf("expected only the healthy test plugin, got %+v", plugins)
+	}
+	if !plugins[0].HasType(PluginTypeHook) || !plugins[0].HasType(pluginTypeInventory) {
+		t.Errorf("expected hook and inventory types, got %v", plugins[0].Types)
+	}
+}
+
+func TestInventoryFromPlugins(t *testing.T) {
+	dir := pluginDir(t)
+	defer os.RemoveAll(dir)
+
+	plugins, _ := DiscoverPlugins(dir)
+	config := configpkg.Config{Plugins: plugins}
+
+	definitions, err := inventoryFromPlugins(config, "dns02.example.com")
+	if err != nil || len(definitions) != 1 {
+		t.Fatalf("expected one definition, got %v, %v", definitions, err)
+	}
+
+	definitions, _ = inventoryFromPlugins(config, "unknown.example.com")
+	if len(definitions) != 0 {
+		t.Errorf("expected no definitions for an unknown host, got %d", len(definitions))
+	}
+}
+
+func TestMachineForMACFromPlugins(t *testing.T) {
+	dir := pluginDir(t)
+	defer os.RemoveAll(dir)
+
+	plugins, _ := DiscoverPlugins(dir)
+	config := configpkg.Config{Plugins: plugins}
+
+	if hostname, err := MachineForMACFromPlugins(config, "de:ad:c0:de:ca:fe"); err != nil || hostname != "dns02.example.com" {
+		t.Errorf("expected the plugin's machine, got %q %v", hostname, err)
+	}
+	if hostname, err := MachineForMACFromPlugins(config, "aa:bb:cc:dd:ee:ff"); err != nil || hostname != "" {
+		t.Errorf("expected no machine, got %q %v", hostname, err)
+	}
+
+	// A plugin from before the mac action can't tell
+	config.Plugins = append(config.Plugins, &configpkg.Plugin{Name: "old", Path: path.Join(dir, "README"), Types: []string{pluginTypeInventory}})
+	if _, err := MachineForMACFromPlugins(config, "aa:bb:cc:dd:ee:ff"); err == nil {
+		t.Error("expected a plugin that doesn't answer to be an error")
+	}
+}
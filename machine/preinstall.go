@@ -0,0 +1,81 @@
+package machine
+
+import (
+	"time"
+)
+
+// stageImage is what a pre-install stage boots
+type stageImage struct {
+	ImageURL string
+	Kernel   string
+	Initrd   string
+	Cmdline  string
+}
+
+type PreinstallStage struct {
+	// In phases and messages, <name>-passed and <name>-failed are the
+	// phases it ends with
+	Name  string
+	State BuildState
+
+	// Emitted when a build passes the stage
+	PassedEvent string
+
+	// What m boots for the stage and how long it has to report, ok is
+	// false when m doesn't go through it
+	Image func(m *Machine) (image stageImage, timeout time.Duration, ok bool)
+}
+
+// In the order builds go through them
+var PreinstallStages = []*PreinstallStage{FirmwareStage, RAIDStage, BurnInStage, WipeStage}
+
+// The stage a build in s is in, nil when it isn't in one
+func StageFor(s BuildState) *PreinstallStage {
+	for _, stage := range PreinstallStages {
+		if stage.State == s {
+			return stage
+		}
+	}
+	return nil
+}
+
+// The first stage m has after the one it is in, nil when there is none
+func (m *Machine) NextStage() *PreinstallStage {
+	if m.RescueMode {
+		return nil
+	}
+	current := StageFor(m.State)
+	for _, stage := range PreinstallStages {
+		if current != nil {
+			if stage == current {
+				current = nil
+			}
+			continue
+		}
+		if _, _, ok := stage.Image(m); ok {
+			return stage
+		}
+	}
+	return nil
+}
+
+// Whether a stage failed the build of m
+func (m *Machine) FailedStage() bool {
+	for _, t := range m.Transitions {
+		if t.To == BuildFailed && StageFor(t.From) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// Move m into stage. Callers must hold state.Mux if m is in state, and call
+// state.startStage once they let go of it.
+func (m *Machine) EnterStage(stage *PreinstallStage) (*StateTransition, error) {
+	t, err := m.SetState(stage.State, "")
+	if err != nil {
+		return nil, err
+	}
+	m.AddPhase(stage.Name, false, "")
+	return t, nil
+}
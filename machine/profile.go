@@ -0,0 +1,61 @@
+package machine
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ns1/waitron/config"
+	"gopkg.in/yaml.v2"
+)
+
+// A build stage's hooks failed
+type HookStageError struct {
+	Stage string
+	Err   error
+}
+
+func (e *HookStageError) Error() string {
+	return e.Stage + " hooks: " + e.Err.Error()
+}
+
+// Only one build is started for an unknown MAC address however often
+// pixiecore asks
+var UnknownBootMux sync.Mutex
+
+// The definition to build hostname with, the default profile when nothing
+// defines it. mac goes on the first interface of those when it is set.
+func BuildDefinition(hostname string, mac string, config config.Config) (Machine, error) {
+	m, err := loadMachineDefinition(hostname, config.MachinePath, config, config.DefaultProfile)
+	if err != nil || !m.DefaultProfile {
+		return m, err
+	}
+	if len(m.Network) == 0 {
+		m.Network = []Interface{{}}
+	}
+	if mac != "" && m.Network[0].MacAddress == "" {
+		m.Network[0].MacAddress = mac
+	}
+	logger.Machine(&m).Info("no definition found, building with the default profile")
+	return m, nil
+}
+
+// Merge the build profile called name over the definition of m
+func (m *Machine) ApplyProfile(name string, config config.Config) error {
+	definition, found := config.BuildProfiles[name]
+	if !found {
+		return fmt.Errorf("no build profile %s", name)
+	}
+	data, err := yaml.Marshal(definition)
+	if err != nil {
+		return err
+	}
+	if err = CheckDefinition(MachineSchema, "profile", name, data, config); err != nil {
+		return err
+	}
+	if err = yaml.Unmarshal(data, m); err != nil {
+		return err
+	}
+	m.Profile = name
+	logger.Machine(m).Info("building with a build profile", "profile", name)
+	return nil
+}
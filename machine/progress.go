@@ -0,0 +1,24 @@
+package machine
+
+import (
+	"errors"
+	"time"
+)
+
+// BuildProgress is what an installer reports while it works through a build.
+type BuildProgress struct {
+	Phase     string
+	Percent   int
+	Message   string `json:",omitempty"`
+	Timestamp time.Time
+}
+
+func (p BuildProgress) Validate() error {
+	if p.Phase == "" {
+		return errors.New("phase is required")
+	}
+	if p.Percent < 0 || p.Percent > 100 {
+		return errors.New("percent must be between 0 and 100")
+	}
+	return nil
+}
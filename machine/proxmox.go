@@ -0,0 +1,11 @@
+package machine
+
+// ProxmoxGuest is where a VM lives on Proxmox
+type ProxmoxGuest struct {
+	Node string `yaml:"node"`
+	// Found by name, or the next free one for a new guest, when unset
+	VMID    int    `yaml:"vmid"`
+	Storage string `yaml:"storage"`
+	// Sizes in GiB of the disks a new guest gets, the first one is booted
+	Disks []int `yaml:"disks"`
+}
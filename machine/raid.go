@@ -0,0 +1,41 @@
+package machine
+
+import (
+	"time"
+)
+
+// A build with raid is configuring-raid after any firmware update, see
+// state/preinstall.go. Its machine boots a config ramdisk, which gets a script for
+// its RAID controller from /raid/<hostname>/<token>, runs it, posts how
+// it went to the same URL and reboots. The script clears the controller's
+// virtual disks and creates the arrays the machine's definition declares.
+// It is rendered for perccli, storcli or ssacli, or from a template of the
+// machine's own, which sees machine.RAID like preseeds do.
+
+const defaultRAIDTimeoutSeconds = 1800
+
+// RAIDResult is what a config ramdisk reports
+type RAIDResult struct {
+	Passed  bool
+	Message string `json:",omitempty"`
+	// What the script printed
+	Output   string `json:",omitempty"`
+	Reported time.Time
+}
+
+var RAIDStage = &PreinstallStage{
+	Name:        "raid",
+	State:       BuildConfiguringRAID,
+	PassedEvent: EventRAIDConfigured,
+	Image: func(m *Machine) (stageImage, time.Duration, bool) {
+		s := m.RAID
+		if s == nil || s.Kernel == "" {
+			return stageImage{}, 0, false
+		}
+		timeout := time.Duration(defaultRAIDTimeoutSeconds) * time.Second
+		if s.TimeoutSeconds > 0 {
+			timeout = time.Duration(s.TimeoutSeconds) * time.Second
+		}
+		return stageImage{ImageURL: s.ImageURL, Kernel: s.Kernel, Initrd: s.Initrd, Cmdline: s.Cmdline}, timeout, true
+	},
+}
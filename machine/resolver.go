@@ -0,0 +1,161 @@
+package machine
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+
+	configpkg "github.com/ns1/waitron/config"
+)
+
+func NewMachineResolver(config configpkg.ResolverConfig) *configpkg.MachineResolver {
+	if len(config.TXTKeys) == 0 {
+		config.TXTKeys = []string{"location"}
+	}
+	if config.LDAP != nil {
+		l := *config.LDAP
+		if l.Attribute == "" {
+			l.Attribute = "cn"
+		}
+		if len(l.Params) == 0 {
+			l.Params = map[string]string{"owner": "owner"}
+		}
+		config.LDAP = &l
+	}
+
+	dns := net.DefaultResolver
+	if config.Nameserver != "" {
+		nameserver := configpkg.HostWithPort(config.Nameserver, "53")
+		dns = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, nameserver)
+			},
+		}
+	}
+
+	r := &configpkg.MachineResolver{
+		Config:      config,
+		TTL:         configpkg.Seconds(config.CacheSeconds, configpkg.DefaultResolverCacheSeconds),
+		Timeout:     configpkg.Seconds(config.TimeoutSeconds, configpkg.DefaultResolverTimeoutSeconds),
+		LookupCNAME: dns.LookupCNAME,
+		LookupIP:    dns.LookupIPAddr,
+		LookupTXT:   dns.LookupTXT,
+		Cache:       make(map[string]configpkg.ResolverEntry),
+	}
+	r.LookupLDAP = r.SearchLDAP
+	return r
+}
+
+// Fill in what the definition of m left out
+func fill(r *configpkg.MachineResolver, m *Machine) {
+	name := m.Hostname
+	if !strings.Contains(name, ".") && m.Domain != "" {
+		name += "." + m.Domain
+	}
+
+	if r.Config.DNS {
+		fillAddresses(r, m, name)
+		fillTXT(r, m, name)
+	}
+	if r.Config.LDAP != nil {
+		fillLDAP(r, m, name)
+	}
+}
+
+func fillAddresses(r *configpkg.MachineResolver, m *Machine, name string) {
+	var i *Interface
+	for n := range m.Network {
+		if m.Network[n].Resolve {
+			i = &m.Network[n]
+			break
+		}
+	}
+	if i == nil {
+		return
+	}
+	want4 := len(i.Addresses4) == 0 && !i.DHCP4
+	want6 := len(i.Addresses6) == 0 && !i.DHCP6
+	if !want4 && !want6 {
+		return
+	}
+
+	addresses, _ := r.Cached("ip:"+name, func() (interface{}, error) {
+		ctx, cancel := r.Context()
+		defer cancel()
+		addresses, err := r.LookupIP(ctx, name)
+		return addresses, configpkg.DNSFailure(err)
+	}).([]net.IPAddr)
+
+	for _, a := range addresses {
+		v4 := a.IP.To4() != nil
+		if (v4 && !want4) || (!v4 && !want6) {
+			continue
+		}
+		subnet, prefix, found := r.SubnetOf(a.IP)
+		if !found {
+			logger.Warn("resolved address is in no resolver subnet", "hostname", m.Hostname, "address", a.IP)
+			continue
+		}
+		address := IPConfig{IPAddress: a.IP.String(), Cidr: strconv.Itoa(prefix)}
+		if v4 {
+			i.Addresses4 = append(i.Addresses4, address)
+			if i.Gateway4 == "" {
+				i.Gateway4 = subnet.Gateway
+			}
+		} else {
+			i.Addresses6 = append(i.Addresses6, address)
+			if i.Gateway6 == "" {
+				i.Gateway6 = subnet.Gateway
+			}
+		}
+	}
+}
+
+func fillTXT(r *configpkg.MachineResolver, m *Machine, name string) {
+	records, _ := r.Cached("txt:"+name, func() (interface{}, error) {
+		ctx, cancel := r.Context()
+		defer cancel()
+		records, err := r.LookupTXT(ctx, name)
+		return records, configpkg.DNSFailure(err)
+	}).([]string)
+
+	for _, record := range records {
+		kv := strings.SplitN(record, "=", 2)
+		if len(kv) != 2 || !containsString(r.Config.TXTKeys, kv[0]) {
+			continue
+		}
+		setMissingParam(m, kv[0], kv[1])
+	}
+}
+
+func fillLDAP(r *configpkg.MachineResolver, m *Machine, name string) {
+	attributes, _ := r.Cached("ldap:"+name, func() (interface{}, error) {
+		return r.LookupLDAP(name)
+	}).(map[string][]string)
+
+	for param, attribute := range r.Config.LDAP.Params {
+		if values := attributes[attribute]; len(values) > 0 {
+			setMissingParam(m, param, values[0])
+		}
+	}
+}
+
+func setMissingParam(m *Machine, key string, value string) {
+	if _, found := m.Params[key]; found {
+		return
+	}
+	if m.Params == nil {
+		m.Params = make(map[string]string)
+	}
+	m.Params[key] = value
+}
+
+// Fill in m from DNS and LDAP when a resolver is configured
+func resolveMachine(m *Machine, config configpkg.Config) {
+	if config.AttributeResolver != nil {
+		fill(config.AttributeResolver, m)
+	}
+}
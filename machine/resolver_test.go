@@ -0,0 +1,226 @@
+package machine
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+)
+
+func fakeResolver(config config.ResolverConfig) (*config.MachineResolver, map[string]int) {
+	calls := make(map[string]int)
+	r := NewMachineResolver(config)
+	r.LookupCNAME = func(_ context.Context, host string) (string, error) {
+		calls["cname"]++
+		if host == "node01" {
+			return "node01.example.com.", nil
+		}
+		return "", &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	r.LookupIP = func(_ context.Context, host string) ([]net.IPAddr, error) {
+		calls["ip"]++
+		if host != "node01.example.com" {
+			return nil, errors.New("server misbehaving")
+		}
+		return []net.IPAddr{{IP: net.ParseIP("192.0.2.10")}, {IP: net.ParseIP("2001:db8::10")}}, nil
+	}
+	r.LookupTXT = func(_ context.Context, host string) ([]string, error) {
+		calls["txt"]++
+		return []string{"location=dc1/r12", "v=spf1 -all", "owner=dns"}, nil
+	}
+	r.LookupLDAP = func(hostname string) (map[string][]string, error) {
+		calls["ldap"]++
+		return map[string][]string{"owner": {"team-storage"}}, nil
+	}
+	return r, calls
+}
+
+func TestResolveMachine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-resolver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "node01.yaml"), []byte(`{"operatingsystem": "debian", "network": [{"name": "eno1", "resolve": true}]}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "node02.example.com.yaml"), []byte(`{"params": {"owner": "team-db"}, "network": [{"addresses4": [{"ipaddress": "192.0.2.20"}]}]}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "example.com.yaml"), []byte(`{"finish": "finish.j2"}`), 0644)
+
+	r, calls := fakeResolver(config.ResolverConfig{DNS: true, LDAP: &config.LDAPResolverConfig{URL: "ldap://ldap.example.com"}, Subnets: resolverTestSubnets})
+	config := config.Config{GroupPath: dir, AttributeResolver: r}
+
+	m, err := MachineDefinition("node01", dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Domain != "example.com" || m.Finish != "finish.j2" {
+		t.Errorf("expected the domain and its group from DNS, got %q and %q", m.Domain, m.Finish)
+	}
+	if len(m.Network) != 1 || len(m.Network[0].Addresses4) != 1 || m.Network[0].Addresses4[0] != (IPConfig{IPAddress: "192.0.2.10", Cidr: "24"}) ||
+		len(m.Network[0].Addresses6) != 1 || m.Network[0].Addresses6[0] != (IPConfig{IPAddress: "2001:db8::10", Cidr: "64"}) ||
+		m.Network[0].Gateway4 != "192.0.2.1" || m.Network[0].Gateway6 != "fe80::1" {
+		t.Errorf("unexpected network %+v", m.Network)
+	}
+	if m.Params["location"] != "dc1/r12" || m.Params["owner"] != "team-storage" {
+		t.Errorf("unexpected params %v", m.Params)
+	}
+	if _, found := m.Params["v"]; found {
+		t.Error("expected only the configured TXT keys to be taken")
+	}
+
+	// What definitions set is kept
+	m, err = MachineDefinition("node02.example.com", dir, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Params["owner"] != "team-db" || len(m.Network[0].Addresses4) != 1 || m.Network[0].Addresses4[0].IPAddress != "192.0.2.20" {
+		t.Errorf("expected the definition to win, got %v and %+v", m.Params, m.Network)
+	}
+
+	// Lookups are cached, failures included
+	MachineDefinition("node01", dir, config)
+	MachineDefinition("node02.example.com", dir, config)
+	if calls["cname"] != 1 || calls["txt"] != 2 || calls["ldap"] != 2 {
+		t.Errorf("expected cached lookups, got %v", calls)
+	}
+}
+
+var resolverTestSubnets = []config.ResolverSubnet{
+	{CIDR: "192.0.0.0/16", Gateway: "192.0.0.1"},
+	{CIDR: "192.0.2.0/24", Gateway: "192.0.2.1"},
+	{CIDR: "2001:db8::/64", Gateway: "fe80::1"},
+}
+
+func TestResolveAddresses(t *testing.T) {
+	r, _ := fakeResolver(config.ResolverConfig{DNS: true, Subnets: resolverTestSubnets})
+	resolve := func(network ...Interface) Machine {
+		m := Machine{Hostname: "node01.example.com", Domain: "example.com", Network: network}
+		fill(r, &m)
+		return m
+	}
+
+	// Rendered like addresses the definition sets
+	m := resolve(Interface{Name: "eno1", DHCP4: true}, Interface{Name: "eno2", Resolve: true})
+	netplan, err := m.netplan(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(netplan, `addresses: ["192.0.2.10/24", "2001:db8::10/64"]`) || !strings.Contains(netplan, `{to: "::/0", via: "fe80::1"}`) {
+		t.Errorf("expected the resolved addresses with their prefix and gateway, got\n%s", netplan)
+	}
+	if len(m.Network[0].Addresses4) != 0 {
+		t.Errorf("expected an interface without resolve to be left alone, got %+v", m.Network[0])
+	}
+	if _, err := m.kickstartNetwork(); err != nil {
+		t.Error(err)
+	}
+
+	// Not over DHCP, nor without resolve
+	m = resolve(Interface{Name: "eno1", Resolve: true, DHCP4: true, Gateway6: "2001:db8::1"})
+	if i := m.Network[0]; len(i.Addresses4) != 0 || len(i.Addresses6) != 1 || i.Gateway6 != "2001:db8::1" {
+		t.Errorf("expected only the IPv6 address and the interface's gateway, got %+v", i)
+	}
+	if m = resolve(); len(m.Network) != 0 {
+		t.Errorf("expected no interface to be added, got %+v", m.Network)
+	}
+
+	// Outside every subnet there is no prefix to render it with
+	r.Config.Subnets = resolverTestSubnets[2:]
+	r.Cache = make(map[string]config.ResolverEntry)
+	m = resolve(Interface{Name: "eno1", Resolve: true})
+	if i := m.Network[0]; len(i.Addresses4) != 0 || len(i.Addresses6) != 1 {
+		t.Errorf("expected the IPv4 address left out, got %+v", i)
+	}
+
+	if err := config.ValidateResolver(config.ResolverConfig{Subnets: []config.ResolverSubnet{{CIDR: "192.0.2.0/24", Gateway: "2001:db8::1"}}}); err == nil {
+		t.Error("expected a gateway of the other family to be refused")
+	}
+}
+
+// Answer one bind and one search the way an LDAP server would
+func fakeLDAPServer(t *testing.T, entries map[string]map[string][]string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reply := func(id int, op []byte) {
+			conn.Write(config.BerEncode(config.BerSequence, config.BerInt(config.BerInteger, id), op))
+		}
+		result := func(tag byte, code int) []byte {
+			return config.BerEncode(tag, config.BerInt(config.BerEnumerated, code), config.BerString(config.BerOctetString, ""), config.BerString(config.BerOctetString, ""))
+		}
+		for {
+			message, err := config.BerRead(conn)
+			if err != nil || len(message.Children) < 2 {
+				return
+			}
+			id, op := message.Children[0].Int(), message.Children[1]
+			switch op.Tag {
+			case config.LDAPBindRequest:
+				code := config.LDAPSuccess
+				if string(op.Children[2].Content) != "secret" {
+					code = 49 // invalidCredentials
+				}
+				reply(id, result(config.LDAPBindResponse, code))
+			case config.LDAPSearchRequest:
+				// (&(objectClass=device)(cn=value))
+				value := string(op.Children[6].Children[1].Children[1].Content)
+				if entry, found := entries[value]; found {
+					var attributes [][]byte
+					for name, values := range entry {
+						var vals [][]byte
+						for _, v := range values {
+							vals = append(vals, config.BerString(config.BerOctetString, v))
+						}
+						attributes = append(attributes, config.BerEncode(config.BerSequence, config.BerString(config.BerOctetString, name), config.BerEncode(config.BerSet, vals...)))
+					}
+					reply(id, config.BerEncode(config.LDAPSearchResultEntry, config.BerString(config.BerOctetString, "cn="+value), config.BerEncode(config.BerSequence, attributes...)))
+				}
+				reply(id, result(config.LDAPSearchResultDone, config.LDAPSuccess))
+			case config.LDAPUnbindRequest:
+				return
+			}
+		}
+	}()
+	return "ldap://" + l.Addr().String()
+}
+
+func TestSearchLDAP(t *testing.T) {
+	url := fakeLDAPServer(t, map[string]map[string][]string{
+		"node01.example.com": {"owner": {"uid=alice,ou=people,dc=example,dc=com"}},
+	})
+	r := NewMachineResolver(config.ResolverConfig{LDAP: &config.LDAPResolverConfig{
+		URL: url, BindDN: "cn=waitron,dc=example,dc=com", BindPassword: "secret",
+		BaseDN: "ou=hosts,dc=example,dc=com", ObjectClass: "device",
+	}})
+
+	m := Machine{Hostname: "node01.example.com"}
+	fill(r, &m)
+	if m.Params["owner"] != "uid=alice,ou=people,dc=example,dc=com" {
+		t.Errorf("expected the owner from LDAP, got %v", m.Params)
+	}
+
+	url = fakeLDAPServer(t, nil)
+	r.Config.LDAP.URL = url
+	if _, err := r.SearchLDAP("node02.example.com"); err != nil {
+		t.Errorf("expected no entry to be no error, got %v", err)
+	}
+
+	r.Config.LDAP.URL = fakeLDAPServer(t, nil)
+	r.Config.LDAP.BindPassword = "wrong"
+	if _, err := r.SearchLDAP("node01.example.com"); err == nil {
+		t.Error("expected a failed bind to fail the lookup")
+	}
+}
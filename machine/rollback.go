@@ -0,0 +1,69 @@
+package machine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Every build records what it was armed with next to its build profile in
+// the host history: the checksum of the config, the commit of the git
+// definitions and the SHA256 of the host's rendered config and of its preseed
+// and finish templates. POST
+// /api/v1/build/<hostname>/rollback builds the host again with the profile
+// of its last completed build before the latest one, to back out a bad
+// profile or OS bump. A rollback remembers the build it went back to, so
+// rolling back again goes further back. Templates and definitions are the
+// ones served now, so a rollback that would keep what changed since that
+// build is refused unless forced, see State.RollbackChanges.
+
+var errNoRollbackTarget = errors.New("no earlier completed build to roll back to")
+
+// BuildVersions is what a build was armed with, besides its profile
+type BuildVersions struct {
+	ConfigChecksum    string `json:",omitempty"`
+	DefinitionsCommit string `json:",omitempty"`
+	// SHA256 of the host's config as GET /config/<hostname> renders it
+	Definition string `json:",omitempty"`
+	// SHA256 of the templates the build renders, by name
+	Templates map[string]string `json:",omitempty"`
+}
+
+// The SHA256 of m's rendered config, leaving out what only this build has
+func (m Machine) DefinitionChecksum() string {
+	m.Token, m.Status, m.BuildStart, m.RescueMode = "", "", time.Time{}, false
+	m.ExtraCmdline, m.RollbackOf, m.Versions = "", "", nil
+	// A git checkout of its own moves these on every commit
+	m.TemplatePath, m.GroupPath, m.MachinePath = "", "", ""
+	data, err := json.Marshal(m)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// The completed build to roll back to: the latest one before the latest
+// build, or before the build the latest build rolled back to
+func (h *HostHistory) RollbackTarget() (*HistoryEntry, error) {
+	if h == nil || len(h.Entries) == 0 {
+		return nil, errNoRollbackTarget
+	}
+	before := len(h.Entries) - 1
+	if latest := h.Entries[before]; latest.RollbackOf != "" {
+		before = -1
+		for i, e := range h.Entries {
+			if e.Token == latest.RollbackOf {
+				before = i
+			}
+		}
+	}
+	for i := before - 1; i >= 0; i-- {
+		if e := h.Entries[i]; e.Status == "Installed" && !e.Rescue {
+			return &h.Entries[i], nil
+		}
+	}
+	return nil, errNoRollbackTarget
+}
@@ -0,0 +1,32 @@
+package machine
+
+import (
+	"testing"
+)
+
+func TestRollbackTarget(t *testing.T) {
+	h := &HostHistory{Entries: []HistoryEntry{
+		{Token: "a", Status: "Installed", Profile: "ubuntu-22.04"},
+		{Token: "b", Status: "Installed", Rescue: true},
+		{Token: "c", Status: "Terminated", Profile: "ubuntu-24.04"},
+		{Token: "d", Status: "Installed", Profile: "ubuntu-24.04"},
+		{Token: "e", Status: "Installed", Profile: "ubuntu-24.04"},
+	}}
+	if target, err := h.RollbackTarget(); err != nil || target.Token != "d" {
+		t.Errorf("expected the completed build before the latest, got %+v %v", target, err)
+	}
+
+	h.Entries = append(h.Entries, HistoryEntry{Token: "f", Status: "Installed", Profile: "ubuntu-24.04", RollbackOf: "d"})
+	if target, err := h.RollbackTarget(); err != nil || target.Token != "a" {
+		t.Errorf("expected a second rollback to go further back, skipping rescues, got %+v %v", target, err)
+	}
+
+	h.Entries = append(h.Entries, HistoryEntry{Token: "g", Status: "Installed", RollbackOf: "a"})
+	if _, err := h.RollbackTarget(); err != errNoRollbackTarget {
+		t.Errorf("expected nothing before the first build, got %v", err)
+	}
+	var none *HostHistory
+	if _, err := none.RollbackTarget(); err != errNoRollbackTarget {
+		t.Errorf("expected nothing without history, got %v", err)
+	}
+}
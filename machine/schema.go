@@ -0,0 +1,38 @@
+package machine
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/ns1/waitron/config"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	MachineSchema = config.NewJSONSchema("Waitron machine definition", reflect.TypeOf(Machine{}))
+	VMSchema      = config.NewJSONSchema("Waitron VM definition", reflect.TypeOf(Vm{}))
+)
+
+// Problems with a definition file against s
+func ValidateDefinition(s *config.JSONSchema, data []byte) ([]string, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	return s.Validate(document), nil
+}
+
+// Check a definition as it is loaded: the problems are logged, and an error
+// with strict_definitions
+func CheckDefinition(s *config.JSONSchema, kind string, name string, data []byte, config config.Config) error {
+	problems, err := ValidateDefinition(s, data)
+	if err != nil || len(problems) == 0 {
+		return nil // unmarshalling it reports what is wrong
+	}
+	if config.StrictDefinitions {
+		return fmt.Errorf("%s definition %s: %s", kind, name, strings.Join(problems, "; "))
+	}
+	logger.Warn("definition doesn't match the schema", "kind", kind, "name", name, "problems", strings.Join(problems, "; "))
+	return nil
+}
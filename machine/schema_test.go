@@ -0,0 +1,63 @@
+package machine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+)
+
+func TestMachineSchema(t *testing.T) {
+	for definition, expected := range map[string]string{
+		`{"operatingsystem": "ubuntu", "params": {"port": 8080}, "network": [{"name": "eth0", "macaddress": "de:ad:be:ef:00:01"}]}`: "",
+		`{"pre_hooks": ["notify.sh", {"command": "ipmi.sh", "timeout_seconds": 30}]}`:                                               "",
+		`{"puppet": {"classes": ["ntp"]}}`:                                  "",
+		`{"puppet": {"classes": {"ntp": {"servers": ["pool.ntp.org"]}}}}`:   "",
+		`{"operatingsytem": "ubuntu"}`:                                      "operatingsytem: unknown field",
+		`{"network": [{"name": "eth0", "macadress": "de:ad:be:ef:00:01"}]}`: "network[0].macadress: unknown field",
+		`{"network": {"name": "eth0"}}`:                                     "network: expected array, got object",
+		`{"stale_build_threshold_secs": "soon"}`:                            "stale_build_threshold_secs: expected integer, got string",
+		`{"template_cache": "yes"}`:                                         "template_cache: expected boolean, got string",
+		`{"pre_hooks": [["notify.sh"]]}`:                                    "pre_hooks[0]: expected string or object",
+		`{"puppet": {"classes": "ntp"}}`:                                    "puppet.classes: expected array of string or object",
+		`["eth0"]`:                                                          "the definition: expected object, got array",
+	} {
+		problems, err := ValidateDefinition(MachineSchema, []byte(definition))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(problems, "; ") != expected {
+			t.Errorf("expected %q for %s, got %q", expected, definition, problems)
+		}
+	}
+
+	for _, field := range []string{"annotations", "allocations", "phases", "checksum"} {
+		if _, found := MachineSchema.Properties[field]; found {
+			t.Errorf("expected %s, which definitions can't set, not to be in the schema", field)
+		}
+	}
+
+	problems, _ := ValidateDefinition(VMSchema, []byte(`{"vm": [{"hostname": "vm01", "vpcu": 6, "interfaces": [{"name": "eth0", "vlan": 10}]}]}`))
+	if strings.Join(problems, "; ") != "vm[0].vpcu: unknown field" {
+		t.Errorf("unexpected problems %v", problems)
+	}
+}
+
+func TestStrictDefinitions(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-schema")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "node01.example.com.yaml"), []byte(`{"operatingsytem": "ubuntu"}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "example.com.yaml"), []byte(`{}`), 0644)
+
+	config := config.Config{MachinePath: dir, GroupPath: dir}
+	if _, err := MachineDefinition("node01.example.com", dir, config); err != nil {
+		t.Errorf("expected a problem only to be logged, got %v", err)
+	}
+	config.StrictDefinitions = true
+	if _, err := MachineDefinition("node01.example.com", dir, config); err == nil || !strings.Contains(err.Error(), "operatingsytem: unknown field") {
+		t.Errorf("expected the definition to be refused, got %v", err)
+	}
+}
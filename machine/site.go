@@ -0,0 +1,136 @@
+package machine
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"sort"
+
+	configpkg "github.com/ns1/waitron/config"
+	"gopkg.in/yaml.v2"
+)
+
+// Check the subnets of every site and that their definitions only set
+// what a machine has
+func ValidateSites(config configpkg.Config) error {
+	for name, site := range config.Sites {
+		if err := ValidateSite(site, config); err != nil {
+			return fmt.Errorf("site %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
+func ValidateSite(site configpkg.SiteConfig, config configpkg.Config) error {
+	if len(site.Subnets) == 0 {
+		return fmt.Errorf("no subnets")
+	}
+	for _, subnet := range site.Subnets {
+		if _, _, err := net.ParseCIDR(subnet); err != nil {
+			return err
+		}
+	}
+	for key := range site.Definition {
+		if _, found := configpkg.ConfigFieldIndex(reflect.TypeOf(Machine{}), []string{key}); !found {
+			return fmt.Errorf("machines have no %s", key)
+		}
+	}
+	data, err := yaml.Marshal(site.Definition)
+	if err != nil {
+		return err
+	}
+	return CheckDefinition(MachineSchema, "site", "definition", data, config)
+}
+
+// The site with the most specific subnet that has ip, ties go to the first
+// name
+func SiteFor(ip net.IP, sites map[string]configpkg.SiteConfig) (string, bool) {
+	names := make([]string, 0, len(sites))
+	for name := range sites {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	site, longest := "", -1
+	for _, name := range names {
+		for _, subnet := range sites[name].Subnets {
+			_, network, err := net.ParseCIDR(subnet)
+			if err != nil || !network.Contains(ip) {
+				continue
+			}
+			if ones, _ := network.Mask.Size(); ones > longest {
+				site, longest = name, ones
+			}
+		}
+	}
+	return site, longest >= 0
+}
+
+// The site of a request for m, by the address it came from or else by the
+// addresses of m
+func (m *Machine) siteOf(request *http.Request, config configpkg.Config) (string, bool) {
+	host, _, err := net.SplitHostPort(request.RemoteAddr)
+	if err != nil {
+		host = request.RemoteAddr
+	}
+	addresses := []string{host}
+	if m.Lease != nil {
+		addresses = append(addresses, m.Lease.IPAddress)
+	}
+	for _, i := range m.Network {
+		for _, a := range append(append([]IPConfig(nil), i.Addresses4...), i.Addresses6...) {
+			addresses = append(addresses, a.IPAddress)
+		}
+	}
+	for _, address := range addresses {
+		if ip := net.ParseIP(address); ip != nil {
+			if site, found := SiteFor(ip, config.Sites); found {
+				return site, true
+			}
+		}
+	}
+	return "", false
+}
+
+// m as it is rendered for request, with the definition of its site merged
+// over it. m itself is left alone, it is shared with every other request of
+// the build.
+func (m *Machine) AtSite(request *http.Request, config configpkg.Config) (*Machine, error) {
+	name, found := m.siteOf(request, config)
+	if !found {
+		return m, nil
+	}
+	at := *m
+	v := reflect.ValueOf(&at).Elem()
+	for key, value := range config.Sites[name].Definition {
+		index, found := configpkg.ConfigFieldIndex(v.Type(), []string{key})
+		if !found {
+			continue // validateSites refuses those
+		}
+		field := configpkg.ConfigField(v, index)
+		if s, ok := value.(string); ok && field.Kind() == reflect.String {
+			field.SetString(s)
+			continue
+		}
+		// Through a fresh value of the field, so maps and sections it merges
+		// into aren't those of m
+		merged := reflect.New(field.Type())
+		if current, err := yaml.Marshal(field.Interface()); err != nil {
+			return nil, err
+		} else if err = yaml.Unmarshal(current, merged.Interface()); err != nil {
+			return nil, err
+		}
+		data, err := yaml.Marshal(value)
+		if err != nil {
+			return nil, err
+		}
+		if err = yaml.Unmarshal(data, merged.Interface()); err != nil {
+			return nil, fmt.Errorf("site %s: %s: %s", name, key, err)
+		}
+		field.Set(merged.Elem())
+	}
+	at.Site = name
+	logger.Machine(m).Debug("rendering with site settings", "site", name)
+	return &at, nil
+}
@@ -0,0 +1,70 @@
+package machine
+
+import (
+	"time"
+)
+
+// How a build is stale
+const (
+	StaleOverdue = "overdue"
+	StaleSilent  = "silent"
+	StaleSlow    = "slow"
+)
+
+// When the installer of m was last heard from: a heartbeat, a progress
+// report or a template fetch. Zero until it fetched its preseed or
+// cloud-init. Callers must hold state.Mux if m is in state.
+func (m *Machine) LastHeard() time.Time {
+	var heard time.Time
+	started := false
+	for _, p := range m.Phases {
+		switch {
+		case p.Name == PhasePreseed || p.Name == PhaseCloudInit:
+			started = true
+		case p.Name != PhaseFinish && !p.Reported:
+			continue
+		}
+		if p.Timestamp.After(heard) {
+			heard = p.Timestamp
+		}
+	}
+	if !started {
+		return time.Time{}
+	}
+	if m.Progress != nil && m.Progress.Timestamp.After(heard) {
+		heard = m.Progress.Timestamp
+	}
+	if m.LastHeartbeat.After(heard) {
+		heard = m.LastHeartbeat
+	}
+	return heard
+}
+
+// How the build of m is stale at now, "" if it isn't, and when that should
+// be looked at again, zero if it needn't be. Callers must hold state.Mux if
+// m is in state.
+func (m *Machine) Staleness(now time.Time) (string, time.Time) {
+	threshold := m.BuildStart.Add(time.Duration(m.StaleBuildThresholdSeconds) * time.Second)
+	heard := m.LastHeard()
+	if m.StaleSilenceSeconds <= 0 || heard.IsZero() {
+		if now.Before(threshold) {
+			return "", threshold
+		}
+		return StaleOverdue, time.Time{}
+	}
+
+	silent := heard.Add(time.Duration(m.StaleSilenceSeconds) * time.Second)
+	if !now.Before(silent) {
+		return StaleSilent, time.Time{}
+	}
+	if m.StaleActiveThresholdSeconds > 0 {
+		threshold = m.BuildStart.Add(time.Duration(m.StaleActiveThresholdSeconds) * time.Second)
+	}
+	if !now.Before(threshold) {
+		return StaleSlow, silent
+	}
+	if threshold.Before(silent) {
+		return "", threshold
+	}
+	return "", silent
+}
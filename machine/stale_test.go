@@ -0,0 +1,44 @@
+package machine
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStaleness(t *testing.T) {
+	now := time.Now()
+	m := &Machine{BuildStart: now.Add(-2 * time.Hour)}
+	m.StaleBuildThresholdSeconds = 3600
+	if kind, _ := m.Staleness(now); kind != StaleOverdue {
+		t.Errorf("expected a build past its threshold to be overdue, got %q", kind)
+	}
+
+	m.StaleSilenceSeconds = 600
+	m.Phases = []BuildPhase{{Name: PhaseBootServed, Timestamp: now.Add(-110 * time.Minute)}}
+	if kind, _ := m.Staleness(now); kind != StaleOverdue {
+		t.Errorf("expected a build whose installer never started to be overdue, got %q", kind)
+	}
+
+	m.Phases = append(m.Phases, BuildPhase{Name: PhasePreseed, Timestamp: now.Add(-100 * time.Minute)})
+	if kind, _ := m.Staleness(now); kind != StaleSilent {
+		t.Errorf("expected a build not heard from since its preseed fetch to be silent, got %q", kind)
+	}
+
+	m.LastHeartbeat = now.Add(-time.Minute)
+	if kind, next := m.Staleness(now); kind != StaleSlow || !next.Equal(m.LastHeartbeat.Add(10*time.Minute)) {
+		t.Errorf("expected a build still heartbeating past its threshold to be slow, got %q %s", kind, next)
+	}
+
+	m.StaleActiveThresholdSeconds = 3 * 3600
+	if kind, next := m.Staleness(now); kind != "" || !next.Equal(m.LastHeartbeat.Add(10*time.Minute)) {
+		t.Errorf("expected the active threshold to hold a working build, got %q %s", kind, next)
+	}
+	m.LastHeartbeat = time.Time{}
+	m.Progress = &BuildProgress{Phase: "packages", Percent: 60, Timestamp: now.Add(-time.Minute)}
+	if kind, _ := m.Staleness(now); kind != "" {
+		t.Errorf("expected a progress report to count as being heard from, got %q", kind)
+	}
+	if kind, _ := m.Staleness(now.Add(11 * time.Minute)); kind != StaleSilent {
+		t.Errorf("expected the build to go silent, got %q", kind)
+	}
+}
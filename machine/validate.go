@@ -0,0 +1,120 @@
+package machine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A build with validation isn't complete when the installer calls /done.
+// The machine stops being served its boot config so it boots what was
+// installed, and the build is validating until its checks pass: ssh, the
+// machine's ssh port answers with an SSH banner; callback, the machine posts
+// to /validate/<hostname>/<token> on its first boot; kernel, the kernel it
+// posts matches a regular expression; phone_home, cloud-init's phone_home
+// module on the installed system posts to /phone-home/<hostname>/<token>.
+// Then it is done like any other build, or booted when it phoned home, so an
+// install that finished but never came up is told apart from one that did.
+// A build whose checks don't all pass within timeout_secs is failed: the
+// failure hooks run and build-failed is emitted, which opens an incident
+// with alerting notifiers. It isn't retried, it is left for a person to look
+// at. /done completes it without validating again and /cancel cancels it.
+
+const (
+	DefaultValidationTimeoutSeconds = 1800
+	defaultValidationSSHPort        = 22
+	ValidationDialTimeout           = 5 * time.Second
+)
+
+// ValidationReport is what a machine posts on its first boot
+type ValidationReport struct {
+	Kernel string `json:",omitempty"`
+}
+
+// PhoneHomeReport is what cloud-init's phone_home module posts, its public
+// host keys by type, e.g. ed25519
+type PhoneHomeReport struct {
+	InstanceID string            `json:",omitempty"`
+	Hostname   string            `json:",omitempty"`
+	FQDN       string            `json:",omitempty"`
+	PublicKeys map[string]string `json:",omitempty"`
+}
+
+// The body may be left out
+func (r *ValidationReport) DecodeRequest(request *http.Request) error {
+	if err := json.NewDecoder(request.Body).Decode(r); err != nil && err != io.EOF {
+		return err
+	}
+	return nil
+}
+
+// Posted as a form
+func (r *PhoneHomeReport) DecodeRequest(request *http.Request) error {
+	if err := request.ParseForm(); err != nil {
+		return err
+	}
+	r.InstanceID = request.PostForm.Get("instance_id")
+	r.Hostname = request.PostForm.Get("hostname")
+	r.FQDN = request.PostForm.Get("fqdn")
+	for field := range request.PostForm {
+		if key := strings.TrimPrefix(field, "pub_key_"); key != field && request.PostForm.Get(field) != "" {
+			if r.PublicKeys == nil {
+				r.PublicKeys = make(map[string]string)
+			}
+			r.PublicKeys[key] = strings.TrimSpace(request.PostForm.Get(field))
+		}
+	}
+	return nil
+}
+
+// BuildValidation is how the validation of a build went so far
+type BuildValidation struct {
+	Started  time.Time
+	Finished time.Time `json:",omitempty"`
+
+	// What the machine posted and when, nil until it does
+	Report   *ValidationReport `json:",omitempty"`
+	Reported time.Time         `json:",omitempty"`
+
+	// What the installed system phoned home with and when
+	PhoneHome  *PhoneHomeReport `json:",omitempty"`
+	PhonedHome time.Time        `json:",omitempty"`
+
+	// The outcome of every check the last time they ran
+	Checks []ValidationCheck `json:",omitempty"`
+}
+
+type ValidationCheck struct {
+	Name    string
+	Passed  bool
+	Message string `json:",omitempty"`
+}
+
+// The state a build of m ends in once out of build mode, booted if its
+// installed system phoned home. Callers must hold state.Mux if m is in state.
+func (m *Machine) CompletedState() BuildState {
+	if m.ValidationResults != nil && m.ValidationResults.PhoneHome != nil {
+		return BuildBooted
+	}
+	return BuildDone
+}
+
+// Where m's ssh server should be, its first address or else its hostname
+func (m *Machine) SSHAddress(port int) string {
+	if port <= 0 {
+		port = defaultValidationSSHPort
+	}
+	host := m.Hostname
+	if len(m.Network) > 0 {
+		if addresses := m.Network[0].Addresses4; len(addresses) > 0 && addresses[0].IPAddress != "" {
+			host = addresses[0].IPAddress
+		} else if addresses := m.Network[0].Addresses6; len(addresses) > 0 && addresses[0].IPAddress != "" {
+			host = addresses[0].IPAddress
+		}
+	}
+	return net.JoinHostPort(host, fmt.Sprintf("%d", port))
+}
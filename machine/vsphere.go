@@ -0,0 +1,14 @@
+package machine
+
+// VSphereGuest is where a VM lives in vCenter
+type VSphereGuest struct {
+	// The VM's name in vCenter, the hostname by default
+	Name string `yaml:"name"`
+	// Delete the VM and make it again from the definition on every build
+	Recreate     bool   `yaml:"recreate"`
+	Folder       string `yaml:"folder"`
+	ResourcePool string `yaml:"resource_pool"`
+	Datastore    string `yaml:"datastore"`
+	// Sizes in GiB of the disks a recreated VM gets, the first one is booted
+	Disks []int `yaml:"disks"`
+}
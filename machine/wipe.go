@@ -0,0 +1,51 @@
+package machine
+
+import (
+	"time"
+)
+
+// A build with wipe is wiping after any other pre-install stage and before
+// it is installed, see state/preinstall.go. Its machine boots a wipe image, which
+// gets machine.Wipe.Method through its cmdline, wipes every disk, posts how
+// each went to /wipe/<hostname>/<token> and reboots. The report is the
+// build's wipe certificate, and is also kept in the host's history, which
+// outlives build records, for decommission and compliance audits.
+
+// Wiping large disks takes a while
+const defaultWipeTimeoutSeconds = 86400
+
+// WipedDisk is how wiping one disk went
+type WipedDisk struct {
+	Device          string
+	Serial          string `json:",omitempty"`
+	Model           string `json:",omitempty"`
+	SizeBytes       int64  `json:",omitempty"`
+	Method          string
+	DurationSeconds int
+	Passed          bool
+	Message         string `json:",omitempty"`
+}
+
+// WipeCertificate is what a wipe image reports
+type WipeCertificate struct {
+	Disks    []WipedDisk
+	Message  string `json:",omitempty"`
+	Reported time.Time
+}
+
+var WipeStage = &PreinstallStage{
+	Name:        "wipe",
+	State:       BuildWiping,
+	PassedEvent: EventDisksWiped,
+	Image: func(m *Machine) (stageImage, time.Duration, bool) {
+		w := m.Wipe
+		if w == nil || w.Kernel == "" {
+			return stageImage{}, 0, false
+		}
+		timeout := time.Duration(defaultWipeTimeoutSeconds) * time.Second
+		if w.TimeoutSeconds > 0 {
+			timeout = time.Duration(w.TimeoutSeconds) * time.Second
+		}
+		return stageImage{ImageURL: w.ImageURL, Kernel: w.Kernel, Initrd: w.Initrd, Cmdline: w.Cmdline}, timeout, true
+	},
+}
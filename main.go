@@ -1,520 +1,213 @@
-package main
+package waitron
 
-// @APITitle Waitron
-// @APIDescription Templates for server provisioning
-// @License BSD
-// @LicenseUrl http://opensource.org/licenses/BSD-2-Clause
 import (
-	"encoding/json"
 	"flag"
-	"fmt"
-	"log"
 	"net/http"
 	"os"
-	"path"
-	"sync"
-	"time"
+	"os/signal"
+	"path/filepath"
+	"syscall"
 
-	"github.com/gorilla/handlers"
-	"github.com/julienschmidt/httprouter"
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/server"
+	statepkg "github.com/ns1/waitron/state"
 )
 
-type result struct {
-	Token string `json:",omitempty"`
-	Error string `json:",omitempty"`
-	State string `json:",omitempty"`
-}
-
-type HttpResponse struct {
-	Message    string
-	StatusCode int
-}
-
-// @Title templateHandler
-// @Description Render either the finish or the preseed template
-// @Param hostname    path    string    true    "Hostname"
-// @Param template    path    string    true    "The template to be rendered"
-// @Param token        path    string    true    "Token"
-// @Success 200    {object} string "Rendered template"
-// @Failure 400    {object} string "Not in build mode or definition does not exist"
-// @Failure 400    {object} string "Unable to render template"
-// @Failure 401    {object} string "Invalid token"
-// @Router /template/{template}/{hostname}/{token} [GET]
-func templateHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, config Config, state State) {
-
-	hostname := ps.ByName("hostname")
+// Main runs the waitron command: the server, or import, check and ctl
+func Main() {
 
-	if ps.ByName("token") != state.Tokens[hostname] {
-		http.Error(response, "Invalid Token", 401)
-		log.Println(ps.ByName("token"))
-		return
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		os.Exit(importCommand(os.Args[2:]))
 	}
-
-	// Get machine
-	state.Mux.Lock()
-	m, found := state.MachineByUUID[ps.ByName("token")]
-	state.Mux.Unlock()
-
-	if !found {
-		http.Error(response, "Not in build mode or definition does not exist", 400)
-		log.Println(m)
-		return
+	if len(os.Args) > 1 && os.Args[1] == "check" {
+		os.Exit(checkCommand(os.Args[2:]))
 	}
-
-	// Render preseed as default
-	var template string
-
-	switch ps.ByName("template") {
-	case "preseed":
-		template = path.Join(config.TemplatePath, m.Preseed)
-
-		hookType := "pre-hook"
-		err := executeHooks(hookType, m, config)
-		if err != nil {
-			log.Println(err)
-			http.Error(response, fmt.Sprintf("Cannot execute pre hooks"), 500)
-			return
-		}
-
-	case "finish":
-		template = path.Join(config.TemplatePath, m.Finish)
-	case "cloud-init":
-		template = path.Join(config.MachinePath, hostname+".cloud-init")
+	if filepath.Base(os.Args[0]) == "waitronctl" {
+		os.Exit(ctlCommand(os.Args[1:]))
 	}
-
-	renderedTemplate, err := m.renderTemplate(template, config)
-	if err != nil {
-		log.Println(err)
-		http.Error(response, "Unable to render template", http.StatusInternalServerError)
-		return
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		os.Exit(ctlCommand(os.Args[2:]))
 	}
 
-	fmt.Fprintf(response, renderedTemplate)
-}
-
-// @Title hostConfigHandler
-// @Description Renders the host configuration
-// @Param hostname  path  string  true  "Hostname"
-// @Success 200 {object} string "Rendered template"
-// @Failure 400 {object} string "Unable to find host definition for hostname"
-// @Router /config/{hostname} [GET]
-func hostConfigHandler(response http.ResponseWriter, request *http.Request,
-	ps httprouter.Params,
-	config Config) {
-
-	hostname := ps.ByName("hostname")
+	config := flag.String("config", "", "Path to config file.")
+	address := flag.String("address", "", "Address to listen for requests.")
+	port := flag.String("port", "9090", "Port to listen for requests.")
+	adminAddress := flag.String("admin-address", "", "Loopback address:port for the pprof and debug endpoints. Overrides admin_address in the config.")
+	managementAddress := flag.String("management-address", "", "Address:port for the management APIs, keeping them off the main listener. Overrides management_address in the config.")
+	handoverFrom := flag.String("handover-from", "", "Management URL of a running waitron to take builds in progress over from. Overrides handover_from in the config.")
+	hookDryRun := flag.Bool("hook-dry-run", false, "Render and log hooks without executing them.")
+	agentOf := flag.String("agent", "", "Base URL of a central waitron to proxy and cache for. Overrides agent.central in the config.")
+	simulate := flag.Bool("simulate", false, "Stub hooks and external integrations and play the installer of every build. Overrides simulate in the config.")
+	logFormat := flag.String("log-format", "", "Log format: text, logfmt or json. Overrides log_format in the config.")
+	logLevel := flag.String("log-level", "", "Log level: debug, info, warn or error. Overrides log_level in the config.")
+	flag.Parse()
 
-	m, err := machineDefinition(hostname, config.MachinePath, config)
+	activated, err := server.SystemdListeners()
 	if err != nil {
-		log.Println(err)
-		http.Error(response, "", http.StatusNotFound)
-		return
+		logger.Fatal("cannot use the sockets passed by systemd", "error", err)
 	}
 
-	response.Header().Set("content-type", "application/json")
-	result, _ := json.Marshal(m)
-	response.Write(result)
-}
-
-// @Title hostConfigVmHandler
-// @Description Renders the host configuration
-// @Param hostname  path  string  true  "Hostname"
-// @Success 200 {object} string "Config"
-// @Failure 400 {object} string "Unable to find vm definition for hostname"
-// @Router /config/{hostname}/vm [GET]
-func hostConfigVmHandler(response http.ResponseWriter, request *http.Request,
-	ps httprouter.Params,
-	config Config) {
-
-	hostname := ps.ByName("hostname")
+	configFile := *config
 
-	m, err := vmDefinition(hostname, config.VmPath)
-	if err != nil {
-		log.Println(err)
-		http.Error(response, "", http.StatusNotFound)
-		return
+	if configFile == "" {
+		if configFile = os.Getenv("CONFIG_FILE"); configFile == "" && !configpkg.HasConfigEnv(os.Environ()) && *agentOf == "" {
+			logger.Fatal("environment variables CONFIG_FILE or WAITRON_* must be set or use -config")
+		}
 	}
 
-	response.Header().Set("content-type", "application/json")
-	result, _ := json.Marshal(m)
-	response.Write(result)
-}
-
-// @Title buildHandler
-// @Description Put the server in build mode
-// @Param hostname    path    string    true    "Hostname"
-// @Success 200    {object} string "{"State": "OK", "Token": <UUID of the build>}"
-// @Failure 500    {object} string "Unable to find host definition for hostname"
-// @Failure 500    {object} string "Failed to set build mode on hostname"
-// @Router build/{hostname} [PUT]
-func buildHandler(response http.ResponseWriter, request *http.Request,
-	ps httprouter.Params, config Config, state State) {
-	hostname := ps.ByName("hostname")
-
-	m, err := machineDefinition(hostname, config.MachinePath, config)
+	configuration, err := configpkg.LoadConfig(configFile)
 	if err != nil {
-		log.Println(err)
-		http.Error(response, fmt.Sprintf("Unable to find host definition for %s", hostname), http.StatusNotFound)
-		return
+		logger.Fatal("cannot load config", "path", configFile, "error", err)
 	}
 
-	token, err := m.setBuildMode(config, state)
-	if err != nil {
-		log.Println(err)
-		http.Error(response, fmt.Sprintf("Failed to set build mode on %s", hostname), http.StatusInternalServerError)
-		return
+	if *logFormat != "" {
+		configuration.LogFormat = *logFormat
 	}
-
-	result, _ := json.Marshal(&result{State: "OK", Token: token})
-
-	fmt.Fprintf(response, string(result))
-}
-
-// @Title rescueHandler
-// @Description Put the server in build mode for a rescue boot
-// @Param hostname    path    string    true    "Hostname"
-// @Success 200    {object} string "{"State": "OK", "Token": <UUID of the build>}"
-// @Failure 500    {object} string "Unable to find host definition for hostname"
-// @Failure 500    {object} string "Failed to set build mode for rescue on hostname"
-// @Router rescue/{hostname} [PUT]
-func rescueHandler(response http.ResponseWriter, request *http.Request,
-	ps httprouter.Params, config Config, state State) {
-	hostname := ps.ByName("hostname")
-
-	m, err := machineDefinition(hostname, config.MachinePath, config)
-	if err != nil {
-		log.Println(err)
-		http.Error(response, fmt.Sprintf("Unable to find host definition for %s", hostname), 500)
-		return
+	if *logLevel != "" {
+		configuration.LogLevel = *logLevel
 	}
-
-	m.RescueMode = true
-
-	token, err := m.setBuildMode(config, state)
-	if err != nil {
-		log.Println(err)
-		http.Error(response, fmt.Sprintf("Failed to set build mode for rescue on %s", hostname), 500)
-		return
+	if err := configpkg.ConfigureLogging(configuration.LogFormat, configuration.LogLevel); err != nil {
+		logger.Fatal("invalid logging config", "error", err)
 	}
 
-	result, _ := json.Marshal(&result{State: "OK", Token: token})
-
-	fmt.Fprintf(response, string(result))
-}
-
-// @Title doneHandler
-// @Description Remove the server from build mode
-// @Param hostname    path    string    true    "Hostname"
-// @Param token        path    string    true    "Token"
-// @Success 200    {object} string "{"State": "OK"}"
-// @Failure 500    {object} string "Failed to finish build mode"
-// @Failure 400    {object} string "Not in build mode or definition does not exist"
-// @Failure 401    {object} string "Invalid token"
-// @Router /done/{hostname}/{token} [GET]
-func doneHandler(response http.ResponseWriter, request *http.Request,
-	ps httprouter.Params, config Config, state State) {
-	hostname := ps.ByName("hostname")
-
-	if ps.ByName("token") != state.Tokens[hostname] {
-		http.Error(response, "Invalid Token", 401)
-		return
+	if *agentOf != "" {
+		if configuration.Agent == nil {
+			configuration.Agent = &configpkg.AgentConfig{}
+		}
+		configuration.Agent.Central = *agentOf
 	}
-
-	// Get machine
-	state.Mux.Lock()
-	m, found := state.MachineByUUID[ps.ByName("token")]
-	state.Mux.Unlock()
-
-	if !found {
-		http.Error(response, "Not in build mode or definition does not exist", 400)
+	if configuration.Agent != nil {
+		if err := server.ServeAgent(configuration, *address+":"+*port, activated); err != nil {
+			logger.Fatal("agent stopped", "error", err)
+		}
 		return
 	}
 
-	err := m.doneBuildMode(config, state)
-	if err != nil {
-		log.Println(err)
-		http.Error(response, "Failed to finish build mode", 500)
-		return
+	if *hookDryRun {
+		configuration.HookDryRun = true
+		logger.Info("hooks will be rendered and logged but not executed")
 	}
-
-	result, _ := json.Marshal(&result{State: "OK"})
-
-	fmt.Fprintf(response, string(result))
-}
-
-// @Title cancelHandler
-// @Description Remove the server from build mode
-// @Param hostname    path    string    true    "Hostname"
-// @Param token        path    string    true    "Token"
-// @Success 200    {object} string "{"State": "OK"}"
-// @Failure 500    {object} string "Failed to cancel build mode"
-// @Failure 400    {object} string "Not in build mode or definition does not exist"
-// @Failure 401    {object} string "Invalid token"
-// @Router /cancel/{hostname}/{token} [GET]
-func cancelHandler(response http.ResponseWriter, request *http.Request,
-	ps httprouter.Params, config Config, state State) {
-	hostname := ps.ByName("hostname")
-
-	if ps.ByName("token") != state.Tokens[hostname] {
-		http.Error(response, "Invalid Token", 401)
-		return
+	if *simulate {
+		configuration.Simulate = true
+	}
+	if configuration.Simulate {
+		logger.Warn("simulating, builds are walked through a fake installer and nothing outside waitron is touched")
 	}
 
-	// Get machine
-	state.Mux.Lock()
-	m, found := state.MachineByUUID[ps.ByName("token")]
-	state.Mux.Unlock()
-
-	if !found {
-		http.Error(response, "Not in build mode or definition does not exist", 400)
-		return
+	if *adminAddress != "" {
+		configuration.AdminAddress = *adminAddress
+	}
+	if *managementAddress != "" {
+		configuration.ManagementAddress = *managementAddress
 	}
 
-	err := m.cancelBuildMode(config, state)
+	state, err := NewState(&configuration)
 	if err != nil {
-		log.Println(err)
-		http.Error(response, "Failed to cancel build mode", 500)
-		return
+		logger.Fatal("cannot set up", "error", err)
 	}
 
-	hookType := "post-hook"
-	err = executeHooks(hookType, m, config)
-	if err != nil {
-		log.Println(err)
-		http.Error(response, fmt.Sprintf("Cannot execute post hooks"), 500)
-		return
+	if configuration.AdminAddress != "" {
+		if err := server.StartAdmin(configuration.AdminAddress, state); err != nil {
+			logger.Fatal("cannot start admin server", "error", err)
+		}
 	}
 
-	response.Header().Set("content-type", "application/json")
-	result, _ := json.Marshal(&result{State: "OK"})
-	fmt.Fprintf(response, string(result))
-}
+	r := server.NewHandler(configuration, state)
 
-// @Title hostStatus
-// @Description Build status of the server
-// @Param hostname    path    string    true    "Hostname"
-// @Success 200    {object} string "The status: (installing or installed)"
-// @Failure 500    {object} string "Unknown state"
-// @Router /status/{hostname} [GET]
-func hostStatus(response http.ResponseWriter, request *http.Request,
-	ps httprouter.Params, config Config, state State) {
-	m, found := state.MachineByHostname[ps.ByName("hostname")]
-	if !found || m.Status == "" {
-		http.Error(response, "Unknown state", 500)
-		return
+	if configuration.Metadata != nil {
+		if err := server.StartMetadata(configuration, state); err != nil {
+			logger.Fatal("cannot start metadata server", "error", err)
+		}
 	}
-	fmt.Fprintf(response, m.Status)
-}
 
-// @Title listMachinesHandler
-// @Description List machines handled by waitron
-// @Success 200    {array} string "List of machines"
-// @Failure 500    {object} string "Unable to list machines"
-// @Router /list [GET]
-func listMachinesHandler(response http.ResponseWriter, request *http.Request,
-	_ httprouter.Params, config Config, state State) {
-	machines, err := config.listMachines()
-	if err != nil {
-		log.Println(err)
-		http.Error(response, "Unable to list machines", 500)
-		return
+	managementSocket := server.TakeListener(&activated, "management")
+
+	var routes http.Handler = r
+	if configuration.ManagementAddress != "" || managementSocket != nil {
+		routes = server.ManagementHandler(r, state)
 	}
-	js, _ := json.Marshal(machines)
-	response.Header().Set("content-type", "application/json")
-	response.Write(js)
-}
 
-// @Title listHooksHandler
-// @Description List all available pre- and post hooks
-// @Success 200 {array} string "List of hooks"
-// @Failure 500 {object} string "Unable to list hooks"
-// @Router /hooks [GET]
-func listHooksHandler(response http.ResponseWriter, request *http.Request,
-	_ httprouter.Params, config Config) {
-	hooks, err := config.listHooks()
+	handler, err := server.AccessLogHandler(configuration.AccessLog, routes)
 	if err != nil {
-		log.Println(err)
-		http.Error(response, "Unable to list hooks", 500)
-		return
+		logger.Fatal("cannot set up the access log", "error", err)
 	}
-	js, _ := json.Marshal(hooks)
-	response.Header().Set("content-type", "application/json")
-	response.Write(js)
-}
-
-// @Title status
-// @Description Dictionary with machines and its status
-// @Success 200    {object} string "Dictionary with machines and its status"
-// @Router /status [GET]
-func status(response http.ResponseWriter, request *http.Request,
-	ps httprouter.Params, config Config, state State) {
-	result, _ := json.Marshal(&state.MachineByHostname)
-	response.Write(result)
-}
-
-// @Title pixieHandler
-// @Description Dictionary with kernel, intrd(s) and commandline for pixiecore
-// @Param macaddr    path    string    true    "MacAddress"
-// @Success 200    {object} string "Dictionary with kernel, intrd(s) and commandline for pixiecore"
-// @Failure 404    {object} string "Not in build mode"
-// @Failure 500    {object} string "Unable to find host definition for hostname"
-// @Router /v1/boot/{macaddr} [GET]
-func pixieHandler(response http.ResponseWriter, request *http.Request,
-	ps httprouter.Params, config Config, state State) {
-
-	macaddr := ps.ByName("macaddr")
-
-	state.Mux.Lock()
-	m, found := state.MachineByMAC[macaddr]
-	state.Mux.Unlock()
-
-	if found == false {
-		log.Println(found)
-		http.Error(response, "Not in build mode or definition does not exist", 404)
-		return
+	if configuration.Statsd != nil {
+		sink, err := statepkg.NewStatsdSink(*configuration.Statsd)
+		if err != nil {
+			logger.Fatal("cannot set up statsd", "error", err)
+		}
+		statepkg.StartMetrics(sink, state)
+		handler = server.MetricsHandler(sink, handler)
 	}
 
-	pxeconfig, _ := m.pixieInit()
-	result, _ := json.Marshal(pxeconfig)
-	response.Write(result)
-}
-
-// @Title healthHandler
-// @Description Check that Waitron is running
-// @Success 200    {object} string "{"State": "OK"}"
-// @Router /health [GET]
-func healthHandler(response http.ResponseWriter, request *http.Request,
-	ps httprouter.Params, config Config, state State) {
+	handler = server.RequestIDHandler(handler)
 
-	result, _ := json.Marshal(&result{State: "OK"})
-
-	fmt.Fprintf(response, string(result))
-}
-
-func checkForStaleBuilds(state State) {
-
-	staleBuilds := make([]*Machine, 0)
-
-	state.Mux.Lock()
-
-	for _, m := range state.MachineByMAC {
-		if int(time.Now().Sub(m.BuildStart).Seconds()) >= m.StaleBuildThresholdSeconds {
-			staleBuilds = append(staleBuilds, m)
+	srv := server.NewHTTPServer(*address+":"+*port, handler, configuration.Server)
+	l := server.TakeListener(&activated, "")
+	if l == nil {
+		if l, err = server.Listen(srv.Addr, configuration.Server); err != nil {
+			logger.Fatal("cannot listen", "address", srv.Addr, "error", err)
 		}
 	}
-
-	state.Mux.Unlock()
-
-	for _, m := range staleBuilds {
-		go func() {
-			if err := m.RunBuildCommands(m.StaleBuildCommands); err != nil {
-				log.Print(err)
-			}
-		}()
+	for _, extra := range activated {
+		logger.Warn("ignoring socket passed by systemd", "name", extra.Name, "address", extra.Addr().String())
+		extra.Close()
 	}
-}
-
-func main() {
-
-	config := flag.String("config", "", "Path to config file.")
-	address := flag.String("address", "", "Address to listen for requests.")
-	port := flag.String("port", "9090", "Port to listen for requests.")
-	flag.Parse()
-
-	configFile := *config
 
-	if configFile == "" {
-		if configFile = os.Getenv("CONFIG_FILE"); configFile == "" {
-			log.Fatal("environment variables CONFIG_FILE must be set or use -config")
-		}
+	// Take over from the process we are replacing, now that we can accept its
+	// connections
+	if *handoverFrom != "" {
+		configuration.HandoverFrom = *handoverFrom
 	}
-
-	configuration, err := loadConfig(configFile)
-	if err != nil {
-		log.Fatal(err)
+	if configuration.HandoverFrom != "" {
+		if len(configuration.AdminTokens) == 0 {
+			logger.Warn("handover_from needs admin_tokens, starting without taking over builds")
+		} else if builds, err := server.FetchHandover(configuration.HandoverFrom, configuration.AdminTokens[0]); err != nil {
+			logger.Warn("nothing to take over, starting fresh", "from", configuration.HandoverFrom, "error", err)
+		} else {
+			imported := state.ImportBuilds(builds, configuration)
+			logger.Info("took over builds", "from", configuration.HandoverFrom, "builds", imported, "skipped", len(builds)-imported)
+		}
 	}
 
-	state := loadState()
-
-	r := httprouter.New()
-	r.GET("/list",
-		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
-			listMachinesHandler(response, request, ps, configuration, state)
-		})
-	r.GET("/hooks",
-		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
-			listHooksHandler(response, request, ps, configuration)
-		})
-	r.PUT("/build/:hostname",
-		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
-			buildHandler(response, request, ps, configuration, state)
-		})
-	r.GET("/rescue/:hostname",
-		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
-			rescueHandler(response, request, ps, configuration, state)
-		})
-	r.GET("/status/:hostname",
-		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
-			hostStatus(response, request, ps, configuration, state)
-		})
-	r.GET("/config/:hostname",
-		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
-			hostConfigHandler(response, request, ps, configuration)
-		})
-	r.GET("/config/:hostname/vm",
-		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
-			hostConfigVmHandler(response, request, ps, configuration)
-		})
-	r.GET("/status",
-		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
-			status(response, request, ps, configuration, state)
-		})
-	r.GET("/done/:hostname/:token",
-		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
-			doneHandler(response, request, ps, configuration, state)
-		})
-	r.GET("/cancel/:hostname/:token",
-		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
-			cancelHandler(response, request, ps, configuration, state)
-		})
-	r.GET("/template/:template/:hostname/:token",
-		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
-			templateHandler(response, request, ps, configuration, state)
-		})
-	r.GET("/v1/boot/:macaddr",
-		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
-			pixieHandler(response, request, ps, configuration, state)
-		})
-	r.GET("/health",
-		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
-			healthHandler(response, request, ps, configuration, state)
-		})
-
-	if configuration.StaticFilesPath != "" {
-		fs := http.FileServer(http.Dir(configuration.StaticFilesPath))
-		r.Handler("GET", "/files/:filename", http.StripPrefix("/files/", fs))
-		log.Println("Serving static files from " + configuration.StaticFilesPath)
+	var mgmt *http.Server
+	if configuration.ManagementAddress != "" || managementSocket != nil {
+		if mgmt, err = server.StartManagement(configuration.ManagementAddress, managementSocket, handler, configuration.Server); err != nil {
+			logger.Fatal("cannot start management server", "error", err)
+		}
 	}
 
-	if configuration.StaleBuildCheckFrequency <= 0 {
-		configuration.StaleBuildCheckFrequency = 300
+	logger.Info("starting server", "address", l.Addr().String(), "tls", configuration.Server.TLSCertFile != "")
+	if err := server.SDNotify("READY=1\nSTATUS=Serving on " + l.Addr().String()); err != nil {
+		logger.Warn("cannot notify systemd", "error", err)
 	}
 
-	ticker := time.NewTicker(time.Duration(configuration.StaleBuildCheckFrequency) * time.Second)
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-
+	stopped := make(chan error, 1)
 	go func() {
-		defer wg.Done()
-		for _ = range ticker.C {
-			checkForStaleBuilds(state)
-		}
+		stopped <- server.Serve(srv, l, configuration.Server)
 	}()
 
-	log.Println("Starting Server on " + *address + ":" + *port)
-	log.Fatal(http.ListenAndServe(*address+":"+*port, handlers.LoggingHandler(os.Stdout, r)))
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
-	ticker.Stop()
-	wg.Wait()
+	var reason string
+	select {
+	case err := <-stopped:
+		logger.Fatal("server stopped", "error", err)
+	case sig := <-signals:
+		reason = sig.String()
+	case reason = <-state.Shutdown:
+	}
+
+	// Let in-flight requests, template fetches in particular, finish
+	logger.Info("draining", "reason", reason)
+	server.SDNotify("STOPPING=1")
+	if mgmt != nil {
+		go server.Shutdown(mgmt, configuration.Server)
+	}
+	if err := server.Shutdown(srv, configuration.Server); err != nil {
+		logger.Warn("requests still in flight at shutdown", "error", err)
+	}
+	state.Close()
+	logger.Info("stopped")
 }
@@ -0,0 +1,426 @@
+// Command netbox is a waitron inventory plugin that looks machines up in
+// NetBox. Put it in waitron's pluginpath; it is configured through the
+// environment waitron runs in:
+//
+//	NETBOX_URL    base URL of NetBox, e.g. https://netbox.example.com
+//	NETBOX_TOKEN  API token with read access to dcim and ipam
+//
+// A device is found by its name, either the machine's full hostname or, if
+// no device has that name, its short name. Its interfaces, MAC addresses and
+// IP addresses become the machine's network, with the interface holding the
+// primary IP first so it is the one waitron boots. Site, rack, role, platform
+// and tenant become labels, and they and the custom fields are available as
+// params.netbox_*. Management only interfaces are left out.
+//
+// Asked about a MAC address, it answers with the name of the device that has
+// an interface with it, so waitron doesn't take the device for unknown
+// hardware.
+//
+// What the plugin returns is merged before the machine's YAML file, so the
+// file only needs what NetBox doesn't know, or what should be overridden.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const protocolVersion = 1
+
+type request struct {
+	Version    int
+	Action     string
+	Hostname   string `json:",omitempty"`
+	MacAddress string `json:",omitempty"`
+}
+
+type response struct {
+	Error    string          `json:",omitempty"`
+	Name     string          `json:",omitempty"`
+	Types    []string        `json:",omitempty"`
+	Found    bool            `json:",omitempty"`
+	Machine  json.RawMessage `json:",omitempty"`
+	Hostname string          `json:",omitempty"`
+}
+
+// What is returned, using the machine YAML field names
+type ipConfig struct {
+	IPAddress string `json:"ipaddress"`
+	Netmask   string `json:"netmask"`
+	Cidr      string `json:"cidr"`
+}
+
+type machineInterface struct {
+	Name       string     `json:"name"`
+	MacAddress string     `json:"macaddress,omitempty"`
+	Addresses4 []ipConfig `json:"addresses4,omitempty"`
+	Addresses6 []ipConfig `json:"addresses6,omitempty"`
+}
+
+type machine struct {
+	Network []machineInterface `json:"network,omitempty"`
+	Params  map[string]string  `json:"params,omitempty"`
+	Labels  map[string]string  `json:"labels,omitempty"`
+}
+
+// The parts of the NetBox API used here
+type nested struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	Slug    string `json:"slug"`
+	Address string `json:"address"`
+}
+
+type device struct {
+	ID           int                    `json:"id"`
+	Name         string                 `json:"name"`
+	Site         *nested                `json:"site"`
+	Rack         *nested                `json:"rack"`
+	Role         *nested                `json:"role"`
+	DeviceRole   *nested                `json:"device_role"` // before NetBox 3.6
+	Platform     *nested                `json:"platform"`
+	Tenant       *nested                `json:"tenant"`
+	Serial       string                 `json:"serial"`
+	PrimaryIP4   *nested                `json:"primary_ip4"`
+	PrimaryIP6   *nested                `json:"primary_ip6"`
+	CustomFields map[string]interface{} `json:"custom_fields"`
+}
+
+type iface struct {
+	ID         int     `json:"id"`
+	Name       string  `json:"name"`
+	MacAddress string  `json:"mac_address"`
+	MgmtOnly   bool    `json:"mgmt_only"`
+	Device     *nested `json:"device"`
+}
+
+type ipAddress struct {
+	ID                 int    `json:"id"`
+	Address            string `json:"address"`
+	AssignedObjectType string `json:"assigned_object_type"`
+	AssignedObjectID   int    `json:"assigned_object_id"`
+}
+
+type client struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+func newClient() (*client, error) {
+	u := strings.TrimRight(os.Getenv("NETBOX_URL"), "/")
+	if u == "" {
+		return nil, errors.New("NETBOX_URL is not set")
+	}
+	return &client{url: u, token: os.Getenv("NETBOX_TOKEN"), http: &http.Client{Timeout: 8 * time.Second}}, nil
+}
+
+func (c *client) get(path string, query url.Values, v interface{}) error {
+	u := c.url + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Token "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// Every page of a list endpoint, each page's results are passed to add
+func (c *client) list(path string, query url.Values, add func(results json.RawMessage) (int, error)) error {
+	query.Set("limit", "1000")
+	for offset := 0; ; {
+		query.Set("offset", strconv.Itoa(offset))
+		var page struct {
+			Count   int             `json:"count"`
+			Results json.RawMessage `json:"results"`
+		}
+		if err := c.get(path, query, &page); err != nil {
+			return err
+		}
+		n, err := add(page.Results)
+		if err != nil {
+			return err
+		}
+		offset += n
+		if n == 0 || offset >= page.Count {
+			return nil
+		}
+	}
+}
+
+func (c *client) devices(name string) ([]device, error) {
+	var all []device
+	err := c.list("/api/dcim/devices/", url.Values{"name": {name}}, func(results json.RawMessage) (int, error) {
+		var page []device
+		err := json.Unmarshal(results, &page)
+		all = append(all, page...)
+		return len(page), err
+	})
+	return all, err
+}
+
+func (c *client) interfaces(deviceID int) ([]iface, error) {
+	var all []iface
+	err := c.list("/api/dcim/interfaces/", url.Values{"device_id": {strconv.Itoa(deviceID)}}, func(results json.RawMessage) (int, error) {
+		var page []iface
+		err := json.Unmarshal(results, &page)
+		all = append(all, page...)
+		return len(page), err
+	})
+	return all, err
+}
+
+// The name of the device with an interface that has mac, "" when there is none
+func (c *client) deviceWithMAC(mac string) (string, error) {
+	var all []iface
+	err := c.list("/api/dcim/interfaces/", url.Values{"mac_address": {mac}}, func(results json.RawMessage) (int, error) {
+		var page []iface
+		err := json.Unmarshal(results, &page)
+		all = append(all, page...)
+		return len(page), err
+	})
+	if err != nil || len(all) == 0 {
+		return "", err
+	}
+	if all[0].Device == nil {
+		return "", fmt.Errorf("interface %d with %s has no device", all[0].ID, mac)
+	}
+	return all[0].Device.Name, nil
+}
+
+func (c *client) addresses(deviceID int) ([]ipAddress, error) {
+	var all []ipAddress
+	err := c.list("/api/ipam/ip-addresses/", url.Values{"device_id": {strconv.Itoa(deviceID)}}, func(results json.RawMessage) (int, error) {
+		var page []ipAddress
+		err := json.Unmarshal(results, &page)
+		all = append(all, page...)
+		return len(page), err
+	})
+	return all, err
+}
+
+func (c *client) findDevice(hostname string) (*device, error) {
+	names := []string{hostname}
+	if short := strings.Split(hostname, ".")[0]; short != hostname {
+		names = append(names, short)
+	}
+	for _, name := range names {
+		devices, err := c.devices(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(devices) > 1 {
+			return nil, fmt.Errorf("%d devices are named %s", len(devices), name)
+		}
+		if len(devices) == 1 {
+			return &devices[0], nil
+		}
+	}
+	return nil, nil
+}
+
+func ipConfigOf(address string) (ipConfig, bool, error) {
+	ip, network, err := net.ParseCIDR(address)
+	if err != nil {
+		return ipConfig{}, false, err
+	}
+	ones, _ := network.Mask.Size()
+	c := ipConfig{IPAddress: ip.String(), Cidr: strconv.Itoa(ones), Netmask: net.IP(network.Mask).String()}
+	return c, ip.To4() != nil, nil
+}
+
+func addLabel(m *machine, key string, value *nested) {
+	if value == nil {
+		return
+	}
+	v := value.Slug
+	if v == "" {
+		v = value.Name
+	}
+	m.Labels[key] = v
+	m.Params["netbox_"+key] = value.Name
+}
+
+func (c *client) machine(hostname string) (*machine, error) {
+	d, err := c.findDevice(hostname)
+	if err != nil || d == nil {
+		return nil, err
+	}
+
+	interfaces, err := c.interfaces(d.ID)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := c.addresses(d.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &machine{Params: map[string]string{"netbox_id": strconv.Itoa(d.ID)}, Labels: map[string]string{}}
+	addLabel(m, "site", d.Site)
+	addLabel(m, "rack", d.Rack)
+	if d.Role == nil {
+		d.Role = d.DeviceRole
+	}
+	addLabel(m, "role", d.Role)
+	addLabel(m, "platform", d.Platform)
+	addLabel(m, "tenant", d.Tenant)
+	if d.Serial != "" {
+		m.Params["netbox_serial"] = d.Serial
+	}
+	for k, v := range d.CustomFields {
+		if v == nil {
+			continue
+		}
+		if s, ok := v.(string); ok {
+			m.Params["netbox_cf_"+k] = s
+		} else if js, err := json.Marshal(v); err == nil {
+			m.Params["netbox_cf_"+k] = string(js)
+		}
+	}
+
+	primary := map[string]bool{}
+	for _, ip := range []*nested{d.PrimaryIP4, d.PrimaryIP6} {
+		if ip != nil {
+			primary[ip.Address] = true
+		}
+	}
+
+	byInterface := map[int][]ipAddress{}
+	for _, a := range addresses {
+		if a.AssignedObjectType == "" || a.AssignedObjectType == "dcim.interface" {
+			byInterface[a.AssignedObjectID] = append(byInterface[a.AssignedObjectID], a)
+		}
+	}
+
+	type ranked struct {
+		machineInterface
+		primary bool
+	}
+	var network []ranked
+	for _, i := range interfaces {
+		if i.MgmtOnly {
+			continue
+		}
+		r := ranked{machineInterface: machineInterface{Name: i.Name, MacAddress: strings.ToLower(i.MacAddress)}}
+		for _, a := range byInterface[i.ID] {
+			c, v4, err := ipConfigOf(a.Address)
+			if err != nil {
+				continue
+			}
+			if v4 {
+				r.Addresses4 = append(r.Addresses4, c)
+			} else {
+				r.Addresses6 = append(r.Addresses6, c)
+			}
+			r.primary = r.primary || primary[a.Address]
+		}
+		if r.MacAddress == "" && len(r.Addresses4) == 0 && len(r.Addresses6) == 0 {
+			continue
+		}
+		network = append(network, r)
+	}
+	// Primary IP first, then interfaces with a MAC, then by name
+	sort.SliceStable(network, func(i, j int) bool {
+		a, b := network[i], network[j]
+		if a.primary != b.primary {
+			return a.primary
+		}
+		if (a.MacAddress != "") != (b.MacAddress != "") {
+			return a.MacAddress != ""
+		}
+		return a.Name < b.Name
+	})
+	for _, r := range network {
+		m.Network = append(m.Network, r.machineInterface)
+	}
+	return m, nil
+}
+
+func handle(req request) response {
+	if req.Version != protocolVersion {
+		return response{Error: fmt.Sprintf("unsupported protocol version %d", req.Version)}
+	}
+
+	switch req.Action {
+	case "info":
+		return response{Name: "netbox", Types: []string{"inventory"}}
+	case "health":
+		c, err := newClient()
+		if err != nil {
+			return response{Error: err.Error()}
+		}
+		var status map[string]interface{}
+		if err := c.get("/api/status/", nil, &status); err != nil {
+			return response{Error: err.Error()}
+		}
+		return response{}
+	case "machine":
+		c, err := newClient()
+		if err != nil {
+			return response{Error: err.Error()}
+		}
+		m, err := c.machine(strings.ToLower(req.Hostname))
+		if err != nil {
+			return response{Error: err.Error()}
+		}
+		if m == nil {
+			return response{Found: false}
+		}
+		js, err := json.Marshal(m)
+		if err != nil {
+			return response{Error: err.Error()}
+		}
+		return response{Found: true, Machine: js}
+	case "mac":
+		c, err := newClient()
+		if err != nil {
+			return response{Error: err.Error()}
+		}
+		name, err := c.deviceWithMAC(strings.ToLower(req.MacAddress))
+		if err != nil {
+			return response{Error: err.Error()}
+		}
+		return response{Found: name != "", Hostname: name}
+	}
+	return response{Error: "unsupported action " + req.Action}
+}
+
+func main() {
+	var req request
+	var resp response
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		resp = response{Error: "invalid request: " + err.Error()}
+	} else {
+		resp = handle(req)
+	}
+	json.NewEncoder(os.Stdout).Encode(resp)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func fakeNetbox(t *testing.T) *httptest.Server {
+	pages := map[string]map[string]string{
+		"/api/dcim/devices/": {
+			"node01": `{"count":1,"results":[{"id":7,"name":"node01",
+				"site":{"id":1,"name":"Amsterdam 1","slug":"ams1"},
+				"rack":{"id":2,"name":"R12"},
+				"device_role":{"id":3,"name":"Compute","slug":"compute"},
+				"serial":"ABC123",
+				"primary_ip4":{"id":11,"address":"10.0.0.5/24"},
+				"custom_fields":{"raid":"raid10","disks":4,"unset":null}}]}`,
+		},
+		"/api/dcim/interfaces/": {
+			"7": `{"count":3,"results":[
+				{"id":21,"name":"eth0","mac_address":"AA:BB:CC:00:00:01"},
+				{"id":22,"name":"eth1","mac_address":"AA:BB:CC:00:00:02"},
+				{"id":23,"name":"ipmi","mac_address":"AA:BB:CC:00:00:03","mgmt_only":true}]}`,
+		},
+		"/api/ipam/ip-addresses/": {
+			"7": `{"count":3,"results":[
+				{"id":10,"address":"192.168.1.5/24","assigned_object_type":"dcim.interface","assigned_object_id":21},
+				{"id":11,"address":"10.0.0.5/24","assigned_object_type":"dcim.interface","assigned_object_id":22},
+				{"id":12,"address":"2001:db8::5/64","assigned_object_type":"dcim.interface","assigned_object_id":22}]}`,
+		},
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Header.Get("Authorization") != "Token secret" {
+			http.Error(response, `{"detail":"Invalid token"}`, http.StatusForbidden)
+			return
+		}
+		if request.URL.Path == "/api/status/" {
+			response.Write([]byte(`{"netbox-version":"3.7.0"}`))
+			return
+		}
+		key := request.URL.Query().Get("name")
+		if key == "" {
+			key = request.URL.Query().Get("device_id")
+		}
+		if mac := request.URL.Query().Get("mac_address"); mac == "aa:bb:cc:00:00:02" {
+			response.Write([]byte(`{"count":1,"results":[{"id":22,"name":"eth1","mac_address":"AA:BB:CC:00:00:02","device":{"id":7,"name":"node01"}}]}`))
+			return
+		}
+		if page, ok := pages[request.URL.Path][key]; ok {
+			response.Write([]byte(page))
+			return
+		}
+		response.Write([]byte(`{"count":0,"results":[]}`))
+	}))
+}
+
+func withNetbox(url, token string) {
+	os.Setenv("NETBOX_URL", url)
+	os.Setenv("NETBOX_TOKEN", token)
+}
+
+func TestInfo(t *testing.T) {
+	r := handle(request{Version: protocolVersion, Action: "info"})
+	if r.Error != "" || r.Name != "netbox" || len(r.Types) != 1 || r.Types[0] != "inventory" {
+		t.Errorf("unexpected info %+v", r)
+	}
+	if r := handle(request{Version: 2, Action: "info"}); r.Error == "" {
+		t.Error("expected an unsupported version to fail")
+	}
+}
+
+func TestHealth(t *testing.T) {
+	ts := fakeNetbox(t)
+	defer ts.Close()
+
+	withNetbox(ts.URL, "secret")
+	if r := handle(request{Version: protocolVersion, Action: "health"}); r.Error != "" {
+		t.Errorf("expected netbox to be healthy, got %s", r.Error)
+	}
+	withNetbox(ts.URL, "wrong")
+	if r := handle(request{Version: protocolVersion, Action: "health"}); r.Error == "" {
+		t.Error("expected a bad token to fail the health check")
+	}
+	withNetbox("", "")
+	if r := handle(request{Version: protocolVersion, Action: "health"}); r.Error == "" {
+		t.Error("expected a missing NETBOX_URL to fail the health check")
+	}
+}
+
+func TestMachine(t *testing.T) {
+	ts := fakeNetbox(t)
+	defer ts.Close()
+	withNetbox(ts.URL+"/", "secret")
+
+	r := handle(request{Version: protocolVersion, Action: "machine", Hostname: "node01.example.com"})
+	if r.Error != "" || !r.Found {
+		t.Fatalf("expected the device to be found by its short name, got %+v", r)
+	}
+
+	var m machine
+	if err := json.Unmarshal(r.Machine, &m); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Network) != 2 {
+		t.Fatalf("expected the management interface to be left out, got %+v", m.Network)
+	}
+	primary := m.Network[0]
+	if primary.Name != "eth1" || primary.MacAddress != "aa:bb:cc:00:00:02" {
+		t.Errorf("expected the interface with the primary IP first, got %+v", m.Network)
+	}
+	if len(primary.Addresses4) != 1 || primary.Addresses4[0] != (ipConfig{IPAddress: "10.0.0.5", Netmask: "255.255.255.0", Cidr: "24"}) {
+		t.Errorf("unexpected IPv4 addresses %+v", primary.Addresses4)
+	}
+	if len(primary.Addresses6) != 1 || primary.Addresses6[0].IPAddress != "2001:db8::5" || primary.Addresses6[0].Cidr != "64" {
+		t.Errorf("unexpected IPv6 addresses %+v", primary.Addresses6)
+	}
+
+	if m.Labels["site"] != "ams1" || m.Labels["rack"] != "R12" || m.Labels["role"] != "compute" {
+		t.Errorf("unexpected labels %v", m.Labels)
+	}
+	for k, v := range map[string]string{
+		"netbox_id":       "7",
+		"netbox_site":     "Amsterdam 1",
+		"netbox_serial":   "ABC123",
+		"netbox_cf_raid":  "raid10",
+		"netbox_cf_disks": "4",
+	} {
+		if m.Params[k] != v {
+			t.Errorf("expected params[%s] to be %q, got %q", k, v, m.Params[k])
+		}
+	}
+	if _, ok := m.Params["netbox_cf_unset"]; ok {
+		t.Error("expected unset custom fields to be left out")
+	}
+}
+
+func TestMachineNotFound(t *testing.T) {
+	ts := fakeNetbox(t)
+	defer ts.Close()
+	withNetbox(ts.URL, "secret")
+
+	r := handle(request{Version: protocolVersion, Action: "machine", Hostname: "unknown.example.com"})
+	if r.Error != "" || r.Found || r.Machine != nil {
+		t.Errorf("expected an unknown device not to be found, got %+v", r)
+	}
+}
+
+func TestMAC(t *testing.T) {
+	ts := fakeNetbox(t)
+	defer ts.Close()
+	withNetbox(ts.URL, "secret")
+
+	if r := handle(request{Version: protocolVersion, Action: "mac", MacAddress: "AA:BB:CC:00:00:02"}); r.Error != "" || !r.Found || r.Hostname != "node01" {
+		t.Errorf("expected the device with the interface, got %+v", r)
+	}
+	if r := handle(request{Version: protocolVersion, Action: "mac", MacAddress: "de:ad:c0:de:ca:fe"}); r.Error != "" || r.Found {
+		t.Errorf("expected an unknown MAC address not to be found, got %+v", r)
+	}
+}
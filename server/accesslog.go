@@ -0,0 +1,192 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/handlers"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/state"
+)
+
+// Wrap h in the configured access logger
+func AccessLogHandler(config *config.AccessLogConfig, h http.Handler) (http.Handler, error) {
+	if config == nil {
+		return handlers.LoggingHandler(os.Stdout, h), nil
+	}
+
+	var every time.Duration
+	if config.RotateEvery != "" {
+		var err error
+		if every, err = time.ParseDuration(config.RotateEvery); err != nil {
+			return nil, fmt.Errorf("access_log rotate_every: %s", err)
+		}
+	}
+
+	var out io.Writer = os.Stdout
+	if config.Path != "" && config.Path != "-" {
+		f, err := newRotatingFile(config.Path, int64(config.RotateSizeMB)*1024*1024, every, config.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+
+	switch config.Format {
+	case "", "common":
+		return handlers.LoggingHandler(out, h), nil
+	case "combined":
+		return handlers.CombinedLoggingHandler(out, h), nil
+	case "json":
+		return jsonLoggingHandler(out, h), nil
+	}
+	return nil, fmt.Errorf("unknown access_log format %q", config.Format)
+}
+
+type accessLogEntry struct {
+	Time      string  `json:"time"`
+	RemoteIP  string  `json:"remote_ip"`
+	Method    string  `json:"method"`
+	URI       string  `json:"uri"`
+	Proto     string  `json:"proto"`
+	Status    int     `json:"status"`
+	Size      int     `json:"size"`
+	Duration  float64 `json:"duration_ms"`
+	Referer   string  `json:"referer,omitempty"`
+	UserAgent string  `json:"user_agent,omitempty"`
+	RequestID string  `json:"request_id,omitempty"`
+}
+
+func jsonLoggingHandler(out io.Writer, h http.Handler) http.Handler {
+	var mux sync.Mutex
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := &state.StatusRecorder{ResponseWriter: response, Status: http.StatusOK}
+		h.ServeHTTP(recorder, request)
+
+		host, _, err := net.SplitHostPort(request.RemoteAddr)
+		if err != nil {
+			host = request.RemoteAddr
+		}
+
+		js, _ := json.Marshal(accessLogEntry{
+			Time:      start.Format(time.RFC3339Nano),
+			RemoteIP:  host,
+			Method:    request.Method,
+			URI:       request.RequestURI,
+			Proto:     request.Proto,
+			Status:    recorder.Status,
+			Size:      recorder.Size,
+			Duration:  float64(time.Since(start)) / float64(time.Millisecond),
+			Referer:   request.Referer(),
+			UserAgent: request.UserAgent(),
+			RequestID: config.RequestID(request),
+		})
+
+		mux.Lock()
+		out.Write(append(js, '\n'))
+		mux.Unlock()
+	})
+}
+
+// A log file that moves itself aside to path.<timestamp> when it gets too
+// big or too old
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	every      time.Duration
+	maxBackups int
+
+	mux    sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func newRotatingFile(path string, maxSize int64, every time.Duration, maxBackups int) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize, every: every, maxBackups: maxBackups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f, r.size, r.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+
+	tooBig := r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize
+	tooOld := r.every > 0 && time.Since(r.opened) >= r.every
+	if tooBig || tooOld {
+		if err := r.rotate(); err != nil {
+			logger.Error("cannot rotate access log", "path", r.path, "error", err)
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+
+	backup := r.path + "." + time.Now().Format("20060102-150405.000")
+	if err := os.Rename(r.path, backup); err != nil {
+		// Keep writing to the old file rather than losing lines
+		if oerr := r.open(); oerr != nil {
+			return oerr
+		}
+		return err
+	}
+
+	if err := r.open(); err != nil {
+		return err
+	}
+	return r.prune()
+}
+
+// Remove the oldest backups beyond maxBackups, if there is a limit
+func (r *rotatingFile) prune() error {
+	if r.maxBackups <= 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(r.path + ".*")
+	if err != nil {
+		return err
+	}
+	rotated := backups
+	sort.Strings(rotated)
+
+	for len(rotated) > r.maxBackups {
+		if err := os.Remove(rotated[0]); err != nil {
+			return err
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
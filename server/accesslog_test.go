@@ -0,0 +1,115 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+)
+
+func TestJSONAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	h := jsonLoggingHandler(&buf, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("not here"))
+	}))
+
+	request := httptest.NewRequest("GET", "/status/foo.example.com", nil)
+	request.Header.Set("User-Agent", "test")
+	h.ServeHTTP(httptest.NewRecorder(), request)
+
+	var entry accessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatalf("access log line is not JSON: %s: %q", err, buf.String())
+	}
+	if entry.Method != "GET" || entry.URI != "/status/foo.example.com" {
+		t.Errorf("wrong request in %+v", entry)
+	}
+	if entry.Status != http.StatusNotFound || entry.Size != len("not here") {
+		t.Errorf("wrong response in %+v", entry)
+	}
+	if entry.UserAgent != "test" || entry.RemoteIP != "192.0.2.1" {
+		t.Errorf("wrong client in %+v", entry)
+	}
+}
+
+func TestAccessLogUnknownFormat(t *testing.T) {
+	if _, err := AccessLogHandler(&config.AccessLogConfig{Format: "xml"}, http.NotFoundHandler()); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	if _, err := AccessLogHandler(&config.AccessLogConfig{RotateEvery: "daily"}, http.NotFoundHandler()); err == nil {
+		t.Error("expected an error for an invalid rotate_every")
+	}
+}
+
+func TestRotatingFileSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	f, err := newRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := f.Write([]byte("12345678\n")); err != nil {
+			t.Fatal(err)
+		}
+		// Backups are named by time, keep them apart
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	current, _ := ioutil.ReadFile(path)
+	if string(current) != "12345678\n" {
+		t.Errorf("expected one line in the current file, got %q", current)
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Errorf("expected 2 backups, got %v", backups)
+	}
+}
+
+func TestRotatingFileAge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-accesslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	f, err := newRotatingFile(path, 0, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte("old\n"))
+	f.opened = time.Now().Add(-2 * time.Hour)
+	f.Write([]byte("new\n"))
+
+	current, _ := ioutil.ReadFile(path)
+	if string(current) != "new\n" {
+		t.Errorf("expected the file to be rotated, got %q", current)
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 1 {
+		t.Fatalf("expected 1 backup, got %v", backups)
+	}
+	old, _ := ioutil.ReadFile(backups[0])
+	if !strings.Contains(string(old), "old") {
+		t.Errorf("backup has %q", old)
+	}
+}
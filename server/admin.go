@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+// The admin listener serves debugging endpoints that have no business on the
+// provisioning network, so it only ever binds to loopback:
+//
+//	/debug/pprof/  profiles, see net/http/pprof
+//	/debug/vars    expvar, including waitron's own counters
+//	/debug/state   goroutine count, memory and the builds in progress
+
+// Refuse anything but a loopback address, an empty host means 127.0.0.1
+func adminListenAddress(address string) (string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", fmt.Errorf("admin_address %q: %s", address, err)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return "", fmt.Errorf("admin_address %q is not a loopback address", address)
+		}
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+type adminBuild struct {
+	Hostname   string
+	MAC        string `json:",omitempty"`
+	Status     string
+	BuildStart time.Time
+	Phase      string `json:",omitempty"`
+}
+
+type adminState struct {
+	Goroutines    int
+	HeapAlloc     uint64
+	HeapObjects   uint64
+	NumGC         uint32
+	Version       uint64
+	Tokens        int
+	HooksQueued   int
+	BuildRecords  int
+	TemplatesWarm bool
+	Builds        []adminBuild
+	RecentEvents  []statepkg.Event
+}
+
+func collectAdminState(state *statepkg.State) adminState {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	s := adminState{
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    mem.HeapAlloc,
+		HeapObjects:  mem.HeapObjects,
+		NumGC:        mem.NumGC,
+		HooksQueued:  state.Workers.Queued(),
+		BuildRecords: state.Retention.Size(),
+		RecentEvents: state.Events.List(),
+		Builds:       []adminBuild{},
+	}
+
+	state.Mux.Lock()
+	s.Version = state.Version
+	s.Tokens = len(state.Tokens)
+	s.TemplatesWarm = state.TemplatesWarm
+	for _, m := range state.MachineByHostname {
+		b := adminBuild{Hostname: m.Hostname, Status: m.Status, BuildStart: m.BuildStart}
+		if len(m.Network) > 0 {
+			b.MAC = m.Network[0].MacAddress
+		}
+		if len(m.Phases) > 0 {
+			b.Phase = m.Phases[len(m.Phases)-1].Name
+		}
+		s.Builds = append(s.Builds, b)
+	}
+	state.Mux.Unlock()
+
+	sort.Slice(s.Builds, func(i, j int) bool { return s.Builds[i].Hostname < s.Builds[j].Hostname })
+	return s
+}
+
+func adminStateHandler(state *statepkg.State) http.HandlerFunc {
+	return func(response http.ResponseWriter, request *http.Request) {
+		js, err := json.MarshalIndent(collectAdminState(state), "", "  ")
+		if err != nil {
+			logRequest(request, err)
+			httpError(response, request, "Unable to dump state", 500)
+			return
+		}
+		response.Header().Set("content-type", "application/json")
+		fmt.Fprintf(response, "%s\n", js)
+	}
+}
+
+// The admin endpoints, on their own mux so nothing leaks onto the main router
+func adminHandler(state *statepkg.State) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/state", adminStateHandler(state))
+	return mux
+}
+
+var expvarsOnce sync.Once
+
+// Publish waitron's counters to expvar. expvar is global, so only the first
+// call does anything.
+func publishExpvars(state *statepkg.State) {
+	expvarsOnce.Do(func() { doPublishExpvars(state) })
+}
+
+func doPublishExpvars(state *statepkg.State) {
+	expvar.Publish("builds_in_progress", expvar.Func(func() interface{} {
+		state.Mux.Lock()
+		defer state.Mux.Unlock()
+		return len(state.MachineByHostname)
+	}))
+	expvar.Publish("hooks_queued", expvar.Func(func() interface{} {
+		return state.Workers.Queued()
+	}))
+	expvar.Publish("build_records", expvar.Func(func() interface{} {
+		return state.Retention.Size()
+	}))
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+
+	events := expvar.NewMap("events")
+	state.Events.Subscribe(func(e statepkg.Event) {
+		events.Add(e.Type, 1)
+	})
+}
+
+// Serve the admin endpoints on address in the background
+func StartAdmin(address string, state *statepkg.State) error {
+	addr, err := adminListenAddress(address)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	publishExpvars(state)
+
+	logger.Info("starting admin server", "address", l.Addr().String())
+	go func() {
+		err := NewHTTPServer(addr, adminHandler(state), config.ServerConfig{}).Serve(l)
+		logger.Error("admin server stopped", "error", err)
+	}()
+	return nil
+}
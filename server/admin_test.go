@@ -0,0 +1,75 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/state"
+)
+
+func TestAdminListenAddress(t *testing.T) {
+	tests := []struct {
+		address string
+		want    string
+		ok      bool
+	}{
+		{":6060", "127.0.0.1:6060", true},
+		{"127.0.0.1:6060", "127.0.0.1:6060", true},
+		{"localhost:6060", "localhost:6060", true},
+		{"[::1]:6060", "[::1]:6060", true},
+		{"0.0.0.0:6060", "", false},
+		{"10.0.0.1:6060", "", false},
+		{"example.com:6060", "", false},
+		{"6060", "", false},
+	}
+
+	for _, test := range tests {
+		got, err := adminListenAddress(test.address)
+		if test.ok && (err != nil || got != test.want) {
+			t.Errorf("%s: expected %s, got %s, %v", test.address, test.want, got, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("%s: expected an error, got %s", test.address, got)
+		}
+	}
+}
+
+func TestAdminStateHandler(t *testing.T) {
+	state := state.New()
+	m := &machine.Machine{Hostname: "dns02.example.com", Status: "Installing", BuildStart: time.Now()}
+	m.Network = []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}
+	m.Phases = []machine.BuildPhase{{Name: "preseed"}}
+	state.Tokens["token"] = m.Hostname
+	state.MachineByHostname[m.Hostname] = m
+
+	response := httptest.NewRecorder()
+	adminHandler(state).ServeHTTP(response, httptest.NewRequest("GET", "/debug/state", nil))
+
+	if response.Code != http.StatusOK {
+		t.Fatalf("Response code is %d, should be 200", response.Code)
+	}
+
+	var s adminState
+	if err := json.Unmarshal(response.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Goroutines == 0 || s.Tokens != 1 {
+		t.Errorf("unexpected state %+v", s)
+	}
+	if len(s.Builds) != 1 || s.Builds[0].MAC != "de:ad:c0:de:ca:fe" || s.Builds[0].Phase != "preseed" {
+		t.Errorf("unexpected builds %+v", s.Builds)
+	}
+}
+
+func TestAdminPprof(t *testing.T) {
+	response := httptest.NewRecorder()
+	adminHandler(state.New()).ServeHTTP(response, httptest.NewRequest("GET", "/debug/pprof/goroutine?debug=1", nil))
+
+	if response.Code != http.StatusOK {
+		t.Errorf("Response code is %d, should be 200", response.Code)
+	}
+}
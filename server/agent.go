@@ -0,0 +1,464 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/state"
+	"github.com/ns1/waitron/template"
+)
+
+// With agent in the config, or -agent, waitron is the agent of a central
+// instance at a remote site rather than a server of its own. It keeps no
+// state and reads no definitions: what installers, pixiecore and the
+// machines being built ask for goes on to the central waitron, which builds,
+// renders and records as usual. The API and everything else that
+// administers the central waitron is answered 404, it isn't to be reached
+// from the sites' networks through the agent. What is slow to fetch
+// across sites is kept at the agent. Images and static files are cached on
+// disk, revalidated with their ETag on every request and served from the
+// cache, Range requests included, with a 304 or while the central waitron
+// can't be reached. Rendered templates are served from memory when the
+// central waitron fails or can't be reached, so an installer half way through
+// carries on.
+//
+// Installers find the agent by baseurl. A site on the central waitron for the
+// agent's subnets, see machine/site.go, sets it to the agent's URL. The central
+// waitron sees requests come from the agent, so its address is what puts them
+// in the site.
+
+const (
+	defaultAgentCacheMaxBytes = 10 << 30
+	agentCacheMeta            = ".json"
+
+	// How long the central waitron has to start answering, its long route
+	// deadline
+	agentTimeout = config.DefaultLongTimeoutSeconds * time.Second
+)
+
+// What the agent passes on, by prefix, and the paths it passes on as they are
+var (
+	agentPathPrefixes = []string{"/v1/boot/", "/template/", "/done/", "/cancel/", "/status/", "/heartbeat/",
+		"/firmware/", "/raid/", "/burnin/", "/wipe/", "/artifacts/", "/validate/", "/phone-home/", "/files/", "/images/"}
+	agentPaths = []string{"/status", "/health", "/livez", "/readyz"}
+)
+
+type agent struct {
+	config  config.AgentConfig
+	central *url.URL
+	proxy   *httputil.ReverseProxy
+	client  *http.Client
+
+	mux       sync.Mutex
+	fetching  map[string]*sync.Mutex
+	templates map[string]agentTemplate
+}
+
+// A rendered template as the central waitron answered it
+type agentTemplate struct {
+	Body        []byte
+	ContentType string
+}
+
+// What the cache keeps next to a file
+type agentCacheEntry struct {
+	Path         string
+	ETag         string
+	LastModified string
+	ContentType  string
+}
+
+func newAgent(config config.AgentConfig) (*agent, error) {
+	central, err := url.Parse(strings.TrimRight(config.Central, "/"))
+	if err != nil {
+		return nil, err
+	}
+	if central.Scheme != "http" && central.Scheme != "https" {
+		return nil, fmt.Errorf("central must be an http or https URL, got %q", config.Central)
+	}
+	if config.CachePath == "" {
+		if config.CachePath, err = ioutil.TempDir("", "waitron-agent"); err != nil {
+			return nil, err
+		}
+	} else if err := os.MkdirAll(config.CachePath, 0755); err != nil {
+		return nil, err
+	}
+	if config.CacheMaxBytes == 0 {
+		config.CacheMaxBytes = defaultAgentCacheMaxBytes
+	}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: agentTimeout,
+		IdleConnTimeout:       90 * time.Second,
+	}
+	proxy := httputil.NewSingleHostReverseProxy(central)
+	proxy.Transport = transport
+	return &agent{
+		config:    config,
+		central:   central,
+		proxy:     proxy,
+		client:    &http.Client{Transport: transport, Timeout: state.ImageDownloadTimeout},
+		fetching:  make(map[string]*sync.Mutex),
+		templates: make(map[string]agentTemplate),
+	}, nil
+}
+
+func (a *agent) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	path := request.URL.Path
+	cacheable := request.Method == "GET" || request.Method == "HEAD"
+	switch {
+	case !agentProxies(path):
+		http.NotFound(response, request)
+	case cacheable && (strings.HasPrefix(path, "/images/") || strings.HasPrefix(path, "/files/")):
+		a.serveCached(response, request)
+	case request.Method == "GET" && strings.HasPrefix(path, "/template/"):
+		a.serveTemplate(response, request)
+	default:
+		a.proxy.ServeHTTP(response, request)
+	}
+}
+
+// Whether the agent passes requests for p on. Paths with . or .. in them
+// aren't, they could be made to mean another.
+func agentProxies(p string) bool {
+	if clean := path.Clean(p); clean != p && clean+"/" != p {
+		return false
+	}
+	for _, exact := range agentPaths {
+		if p == exact {
+			return true
+		}
+	}
+	for _, prefix := range agentPathPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// The request to the central waitron for what request asks the agent
+func (a *agent) centralRequest(request *http.Request) (*http.Request, error) {
+	u := *a.central
+	u.Path = a.central.Path + request.URL.Path
+	u.RawQuery = request.URL.RawQuery
+	r, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	r = r.WithContext(request.Context())
+	for _, name := range []string{"Authorization", config.RequestIDHeader, "User-Agent"} {
+		if v := request.Header.Get(name); v != "" {
+			r.Header.Set(name, v)
+		}
+	}
+	if host, _, err := net.SplitHostPort(request.RemoteAddr); err == nil {
+		if prior := request.Header.Get("X-Forwarded-For"); prior != "" {
+			host = prior + ", " + host
+		}
+		r.Header.Set("X-Forwarded-For", host)
+	}
+	return r, nil
+}
+
+// Pass the rendered template on and keep it, or serve the one kept when the
+// central waitron can't render it
+func (a *agent) serveTemplate(response http.ResponseWriter, request *http.Request) {
+	key := request.URL.Path
+	r, err := a.centralRequest(request)
+	if err != nil {
+		httpError(response, request, "Bad request", http.StatusBadRequest)
+		return
+	}
+	resp, err := a.client.Do(r)
+	if err == nil && resp.StatusCode < 500 {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err == nil {
+			a.mux.Lock()
+			if resp.StatusCode == http.StatusOK {
+				if _, found := a.templates[key]; !found && len(a.templates) >= template.MaxRenderCacheEntries {
+					// Make room, any entry will do
+					for k := range a.templates {
+						delete(a.templates, k)
+						break
+					}
+				}
+				a.templates[key] = agentTemplate{Body: body, ContentType: resp.Header.Get("Content-Type")}
+			} else {
+				// The build is over or never was
+				delete(a.templates, key)
+			}
+			a.mux.Unlock()
+			copyHeader(response.Header(), resp.Header)
+			response.WriteHeader(resp.StatusCode)
+			response.Write(body)
+			return
+		}
+	} else if err == nil {
+		err = fmt.Errorf("central answered %s", resp.Status)
+		resp.Body.Close()
+	}
+
+	a.mux.Lock()
+	t, found := a.templates[key]
+	a.mux.Unlock()
+	if !found {
+		logRequest(request, err)
+		httpError(response, request, "Unable to reach the central waitron", http.StatusBadGateway)
+		return
+	}
+	config.RequestLogger(request).Warn("central waitron failed, serving the template rendered before", "error", err)
+	if t.ContentType != "" {
+		response.Header().Set("Content-Type", t.ContentType)
+	}
+	response.Write(t.Body)
+}
+
+// Replace the headers of to with those in from
+func copyHeader(to http.Header, from http.Header) {
+	for name, values := range from {
+		to[name] = values
+	}
+}
+
+// Serve an image or static file from the cache, fetching it first if the
+// central waitron has a newer one
+func (a *agent) serveCached(response http.ResponseWriter, request *http.Request) {
+	key := agentCacheKey(request.URL.Path)
+	entry, status, err := a.refresh(request, key)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, http.StatusText(status), status)
+		return
+	}
+
+	// A newer file replaces this one by rename, what is open stays whole
+	f, err := os.Open(filepath.Join(a.config.CachePath, key))
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to read cached file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to read cached file", http.StatusInternalServerError)
+		return
+	}
+	modTime := info.ModTime()
+	if t, err := http.ParseTime(entry.LastModified); err == nil {
+		modTime = t
+	}
+	if entry.ContentType != "" {
+		response.Header().Set("Content-Type", entry.ContentType)
+	}
+	if entry.ETag != "" {
+		response.Header().Set("ETag", entry.ETag)
+	}
+	http.ServeContent(response, request, path.Base(request.URL.Path), modTime, f)
+}
+
+// Bring the cached copy of what request asks for up to date with the
+// central waitron, one request for it at a time. Failing that, the cached
+// copy there is will do. On error the status is what to answer.
+func (a *agent) refresh(request *http.Request, key string) (agentCacheEntry, int, error) {
+	a.mux.Lock()
+	lock, found := a.fetching[key]
+	if !found {
+		lock = &sync.Mutex{}
+		a.fetching[key] = lock
+	}
+	a.mux.Unlock()
+	lock.Lock()
+	defer lock.Unlock()
+
+	file := filepath.Join(a.config.CachePath, key)
+	var entry agentCacheEntry
+	cached := false
+	if data, err := ioutil.ReadFile(file + agentCacheMeta); err == nil && json.Unmarshal(data, &entry) == nil {
+		_, err := os.Stat(file)
+		cached = err == nil
+	}
+
+	r, err := a.centralRequest(request)
+	if err != nil {
+		return entry, http.StatusBadRequest, err
+	}
+	if cached && entry.ETag != "" {
+		r.Header.Set("If-None-Match", entry.ETag)
+	} else if cached && entry.LastModified != "" {
+		r.Header.Set("If-Modified-Since", entry.LastModified)
+	}
+	resp, err := a.client.Do(r)
+	if err != nil {
+		if cached {
+			config.RequestLogger(request).Warn("central waitron unreachable, serving the cached file", "error", err)
+			return entry, 0, nil
+		}
+		return entry, http.StatusBadGateway, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached:
+		now := time.Now()
+		os.Chtimes(file, now, now)
+		return entry, 0, nil
+	case resp.StatusCode == http.StatusOK:
+		entry = agentCacheEntry{
+			Path:         request.URL.Path,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			ContentType:  resp.Header.Get("Content-Type"),
+		}
+		if err := a.store(key, entry, resp.Body); err != nil {
+			return entry, http.StatusBadGateway, err
+		}
+		a.prune(key)
+		return entry, 0, nil
+	case resp.StatusCode >= 500 && cached:
+		config.RequestLogger(request).Warn("central waitron failed, serving the cached file", "status", resp.Status)
+		return entry, 0, nil
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		os.Remove(file)
+		os.Remove(file + agentCacheMeta)
+	}
+	status := resp.StatusCode
+	if status < 400 {
+		status = http.StatusBadGateway
+	}
+	return entry, status, fmt.Errorf("central answered %s for %s", resp.Status, request.URL.Path)
+}
+
+// Write body and entry to the cache as key, replacing what is there
+func (a *agent) store(key string, entry agentCacheEntry, body io.Reader) error {
+	tmp, err := ioutil.TempFile(a.config.CachePath, ".fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, body); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	meta, _ := json.Marshal(entry)
+	file := filepath.Join(a.config.CachePath, key)
+	if err := ioutil.WriteFile(file+agentCacheMeta, meta, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// Remove the least recently served files until the cache fits, never keep,
+// the file just fetched
+func (a *agent) prune(keep string) {
+	files, err := ioutil.ReadDir(a.config.CachePath)
+	if err != nil {
+		return
+	}
+	var cached []os.FileInfo
+	var total int64
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") || strings.HasSuffix(f.Name(), agentCacheMeta) {
+			continue
+		}
+		cached = append(cached, f)
+		total += f.Size()
+	}
+	sort.Slice(cached, func(i, j int) bool { return cached[i].ModTime().Before(cached[j].ModTime()) })
+	for _, f := range cached {
+		if total <= a.config.CacheMaxBytes {
+			return
+		}
+		if f.Name() == keep {
+			continue
+		}
+		file := filepath.Join(a.config.CachePath, f.Name())
+		if os.Remove(file) == nil {
+			os.Remove(file + agentCacheMeta)
+			total -= f.Size()
+			logger.Debug("evicted from the agent cache", "file", f.Name())
+		}
+	}
+}
+
+func agentCacheKey(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:])
+}
+
+// Run as the agent of config.Agent.Central on address until told to stop
+func ServeAgent(config config.Config, address string, activated []activatedListener) error {
+	a, err := newAgent(*config.Agent)
+	if err != nil {
+		return fmt.Errorf("invalid agent config: %s", err)
+	}
+
+	handler, err := AccessLogHandler(config.AccessLog, a)
+	if err != nil {
+		return fmt.Errorf("cannot set up the access log: %s", err)
+	}
+	srv := NewHTTPServer(address, RequestIDHandler(handler), config.Server)
+	l := TakeListener(&activated, "")
+	if l == nil {
+		if l, err = Listen(srv.Addr, config.Server); err != nil {
+			return fmt.Errorf("cannot listen on %s: %s", srv.Addr, err)
+		}
+	}
+	for _, extra := range activated {
+		logger.Warn("ignoring socket passed by systemd", "name", extra.Name, "address", extra.Addr().String())
+		extra.Close()
+	}
+
+	logger.Info("starting agent", "address", l.Addr().String(), "central", a.central.String(), "cache", a.config.CachePath)
+	if err := SDNotify("READY=1\nSTATUS=Agent of " + a.central.String() + " on " + l.Addr().String()); err != nil {
+		logger.Warn("cannot notify systemd", "error", err)
+	}
+
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- Serve(srv, l, config.Server)
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-stopped:
+		return err
+	case sig := <-signals:
+		logger.Info("draining", "reason", sig.String())
+	}
+	SDNotify("STOPPING=1")
+	if err := Shutdown(srv, config.Server); err != nil {
+		logger.Warn("requests still in flight at shutdown", "error", err)
+	}
+	logger.Info("stopped")
+	return nil
+}
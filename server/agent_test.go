@@ -0,0 +1,169 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+)
+
+func TestAgent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-agent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mux sync.Mutex
+	fetched := make(map[string]int)
+	var forwardedFor string
+	files := map[string]string{"/files/ubuntu/vmlinuz": "kernel image", "/files/ubuntu/initrd": "initial ramdisk"}
+	central := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		fetched[r.URL.Path+" "+r.Header.Get("If-None-Match")]++
+		mux.Unlock()
+		switch {
+		case files[r.URL.Path] != "":
+			w.Header().Set("ETag", `"`+agentCacheKey(files[r.URL.Path])+`"`)
+			w.Header().Set("Content-Type", "application/octet-stream")
+			http.ServeContent(w, r, "", time.Unix(1700000000, 0), strings.NewReader(files[r.URL.Path]))
+		case r.URL.Path == "/template/preseed/dns02.example.com/token":
+			mux.Lock()
+			forwardedFor = r.Header.Get("X-Forwarded-For")
+			mux.Unlock()
+			w.Header().Set("Content-Type", "text/plain")
+			w.Write([]byte("d-i netcfg/get_hostname string dns02"))
+		case r.URL.Path == "/v1/boot/de:ad:c0:de:ca:fe":
+			w.Write([]byte(`{"kernel": "http://agent.ams1.example.com:9090/files/ubuntu/vmlinuz"}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer central.Close()
+
+	a, err := newAgent(config.AgentConfig{Central: central.URL + "/", CachePath: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(path string, header ...string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("GET", path, nil)
+		request.RemoteAddr = "10.1.2.3:41234"
+		for i := 0; i+1 < len(header); i += 2 {
+			request.Header.Set(header[i], header[i+1])
+		}
+		response := httptest.NewRecorder()
+		a.ServeHTTP(response, request)
+		return response
+	}
+	etag := `"` + agentCacheKey("kernel image") + `"`
+
+	if response := get("/files/ubuntu/vmlinuz"); response.Code != 200 || response.Body.String() != "kernel image" ||
+		response.Header().Get("ETag") != etag {
+		t.Fatalf("expected the file from the central waitron, got %d %q %v", response.Code, response.Body.String(), response.Header())
+	}
+	if response := get("/files/ubuntu/vmlinuz", "Range", "bytes=0-5"); response.Code != http.StatusPartialContent || response.Body.String() != "kernel" {
+		t.Errorf("expected the range from the cache, got %d %q", response.Code, response.Body.String())
+	}
+	if response := get("/files/ubuntu/missing"); response.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for a file the central waitron doesn't have, got %d", response.Code)
+	}
+	mux.Lock()
+	if fetched["/files/ubuntu/vmlinuz "] != 1 || fetched["/files/ubuntu/vmlinuz "+etag] != 1 {
+		t.Errorf("expected one fetch and one revalidation, got %v", fetched)
+	}
+	mux.Unlock()
+
+	if response := get("/template/preseed/dns02.example.com/token"); response.Code != 200 || response.Body.String() != "d-i netcfg/get_hostname string dns02" {
+		t.Errorf("expected the rendered template, got %d %q", response.Code, response.Body.String())
+	}
+	mux.Lock()
+	if forwardedFor != "10.1.2.3" {
+		t.Errorf("expected the installer's address forwarded, got %q", forwardedFor)
+	}
+	mux.Unlock()
+	if response := get("/v1/boot/de:ad:c0:de:ca:fe"); response.Code != 200 || !strings.Contains(response.Body.String(), "agent.ams1") {
+		t.Errorf("expected the boot config from the central waitron, got %d %q", response.Code, response.Body.String())
+	}
+
+	// Only what installers and pixiecore ask for goes to the central waitron
+	mux.Lock()
+	before := len(fetched)
+	mux.Unlock()
+	for _, path := range []string{"/api/v1/handover", "/api/v2/machines", "/build/dns02.example.com", "/admin/sync", "/list",
+		"/template/../api/v1/handover", "/files/./../export/inventory"} {
+		if response := get(path); response.Code != http.StatusNotFound {
+			t.Errorf("expected 404 for %s, got %d", path, response.Code)
+		}
+	}
+	mux.Lock()
+	if len(fetched) != before {
+		t.Errorf("expected nothing to reach the central waitron, got %v", fetched)
+	}
+	mux.Unlock()
+
+	// Fetching the initrd makes room by evicting the kernel, served longest ago
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(dir, agentCacheKey("/files/ubuntu/vmlinuz")), old, old)
+	a.config.CacheMaxBytes = int64(len("initial ramdisk"))
+	if response := get("/files/ubuntu/initrd"); response.Code != 200 {
+		t.Fatalf("expected the initrd, got %d", response.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, agentCacheKey("/files/ubuntu/vmlinuz"))); !os.IsNotExist(err) {
+		t.Errorf("expected the kernel to be evicted, got %v", err)
+	}
+
+	// Without the central waitron, what is cached is still served
+	central.Close()
+	if response := get("/files/ubuntu/initrd"); response.Code != 200 || response.Body.String() != "initial ramdisk" {
+		t.Errorf("expected the cached file, got %d %q", response.Code, response.Body.String())
+	}
+	if response := get("/template/preseed/dns02.example.com/token"); response.Code != 200 || response.Body.String() != "d-i netcfg/get_hostname string dns02" ||
+		response.Header().Get("Content-Type") != "text/plain" {
+		t.Errorf("expected the template rendered before, got %d %q", response.Code, response.Body.String())
+	}
+	for _, path := range []string{"/files/ubuntu/vmlinuz", "/template/finish/dns02.example.com/token", "/v1/boot/de:ad:c0:de:ca:fe"} {
+		if response := get(path); response.Code != http.StatusBadGateway {
+			t.Errorf("expected 502 for %s, got %d", path, response.Code)
+		}
+	}
+}
+
+func TestAgentTimeout(t *testing.T) {
+	release := make(chan struct{})
+	central := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer central.Close()
+	defer close(release)
+
+	a, err := newAgent(config.AgentConfig{Central: central.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(a.config.CachePath)
+	a.client.Transport.(*http.Transport).ResponseHeaderTimeout = 50 * time.Millisecond
+
+	for _, path := range []string{"/template/preseed/dns02.example.com/token", "/files/ubuntu/vmlinuz", "/done/dns02.example.com/token"} {
+		response := httptest.NewRecorder()
+		done := make(chan struct{})
+		go func() {
+			a.ServeHTTP(response, httptest.NewRequest("GET", path, nil))
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected %s to time out", path)
+		}
+		if response.Code != http.StatusBadGateway {
+			t.Errorf("expected 502 for %s, got %d", path, response.Code)
+		}
+	}
+}
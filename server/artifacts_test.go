@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestArtifacts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-artifacts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := configpkg.Config{Artifacts: configpkg.ArtifactConfig{MaxBytes: 64, MaxPerBuild: 2}}
+	state := statepkg.New()
+	if state.Retention, err = statepkg.NewBuildRetention(configpkg.BuildRetentionConfig{MaxAgeSeconds: 60, HistoryPath: dir}, state.Store, false); err != nil {
+		t.Fatal(err)
+	}
+	m := machine.Machine{Hostname: "dns02.example.com", Network: []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}}
+	token, err := state.SetBuildMode(m, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upload := func(token string, name string, contentType string, body string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest("POST", "/artifacts/dns02.example.com/"+token+"?name="+name, strings.NewReader(body))
+		request.Header.Set("Content-Type", contentType)
+		response := httptest.NewRecorder()
+		artifactHandler(response, request, httprouter.Params{{Key: "hostname", Value: "dns02.example.com"}, {Key: "token", Value: token}}, config, state)
+		return response
+	}
+
+	response := upload(token, "packages.txt", "text/plain; charset=utf-8", "bind9 1:9.18\n")
+	var info machine.ArtifactInfo
+	if response.Code != 200 || json.Unmarshal(response.Body.Bytes(), &info) != nil || info.ContentType != "text/plain" || info.Size != 13 ||
+		info.SHA256 == "" {
+		t.Fatalf("expected the artifact to be stored, got %d %s", response.Code, response.Body.String())
+	}
+	if response := upload(token, "packages.txt", "text/plain", "bind9 1:9.20\n"); response.Code != 200 {
+		t.Errorf("expected an artifact to be replaced, got %d", response.Code)
+	}
+	upload(token, "hostkeys.json", "application/json", `{"ed25519": "SHA256:abc"}`)
+
+	for problem, r := range map[int]struct{ token, name, contentType, body string }{
+		http.StatusUnauthorized:          {"wrong", "lshw.json", "application/json", "{}"},
+		http.StatusBadRequest:            {token, "../lshw.json", "application/json", "{}"},
+		http.StatusConflict:              {token, "lshw.json", "application/json", "{}"},
+		http.StatusRequestEntityTooLarge: {token, "packages.txt", "text/plain", strings.Repeat("x", 65)},
+		http.StatusUnsupportedMediaType:  {token, "packages.txt", "text/html", "<p>"},
+	} {
+		if response := upload(r.token, r.name, r.contentType, r.body); response.Code != problem {
+			t.Errorf("expected %d for %+v, got %d %s", problem, r, response.Code, response.Body.String())
+		}
+	}
+
+	if err := state.DoneBuildMode(*state.MachineByToken(token), config); err != nil {
+		t.Fatal(err)
+	}
+	b, err := state.BuildByToken(token)
+	if err != nil || b == nil || len(b.Artifacts) != 2 || b.Artifacts[0].Name != "packages.txt" || b.Artifacts[1].Name != "hostkeys.json" {
+		t.Fatalf("expected the artifacts in the build record, got %+v %v", b, err)
+	}
+
+	download := func(name string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		getArtifactHandler(response, httptest.NewRequest("GET", "/api/v1/builds/"+token+"/artifacts/"+name, nil),
+			httprouter.Params{{Key: "token", Value: token}, {Key: "name", Value: name}}, config, state)
+		return response
+	}
+	response = download("packages.txt")
+	if response.Code != 200 || response.Body.String() != "bind9 1:9.20\n" || response.Header().Get("content-type") != "text/plain" {
+		t.Errorf("expected the replaced artifact, got %d %s %v", response.Code, response.Body.String(), response.Header())
+	}
+	if response := download("lshw.json"); response.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an artifact never uploaded, got %d", response.Code)
+	}
+
+	// Evicted with the build record, still there in history
+	if err := state.Retention.Sweep(time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	var a statepkg.Artifact
+	if found, _ := state.Store.Get(configpkg.ArtifactsBucket, statepkg.ArtifactKey(token, "hostkeys.json"), &a); found {
+		t.Error("expected the artifact to leave the store with its build record")
+	}
+	if response := download("hostkeys.json"); response.Code != 200 || response.Body.String() != `{"ed25519": "SHA256:abc"}` {
+		t.Errorf("expected the artifact from history, got %d %s", response.Code, response.Body.String())
+	}
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/state"
+)
+
+// Endpoints that change what waitron serves need one of the admin_tokens as
+// a bearer token. They are disabled when no tokens are configured.
+
+func isAdmin(config config.Config, request *http.Request) bool {
+	token := state.BearerToken(request)
+	if token == "" {
+		return false
+	}
+
+	admin := false
+	for _, t := range config.AdminTokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			admin = true
+		}
+	}
+	return admin
+}
+
+// Only let requests with an admin token through to h
+func requireAdmin(config config.Config, h httprouter.Handle) httprouter.Handle {
+	return func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+		if len(config.AdminTokens) == 0 {
+			httpError(response, request, "No admin_tokens configured", http.StatusForbidden)
+			return
+		}
+		if !isAdmin(config, request) {
+			logRequest(request, "invalid or missing admin token")
+			response.Header().Set("WWW-Authenticate", `Bearer realm="waitron"`)
+			httpError(response, request, "Invalid admin token", http.StatusUnauthorized)
+			return
+		}
+		h(response, request, ps)
+	}
+}
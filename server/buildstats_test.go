@@ -0,0 +1,31 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestBuildStatsHandler(t *testing.T) {
+	state := statepkg.New()
+	m := &machine.Machine{Hostname: "dns02.example.com", Domain: "example.com", BuildStart: time.Now().Add(-time.Minute)}
+	state.Events.Emit(statepkg.Event{Type: machine.EventBuildCompleted, Machine: m})
+
+	response := httptest.NewRecorder()
+	request := httptest.NewRequest("GET", "/stats/builds?group=example.com", nil)
+	buildStatsHandler(response, request, httprouter.Params{}, config.Config{}, state)
+
+	var stats []statepkg.BuildStats
+	if err := json.Unmarshal(response.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 1 || stats[0].Completed != 1 || stats[0].P50 < 60 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+}
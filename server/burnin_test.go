@@ -0,0 +1,73 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestBurnIn(t *testing.T) {
+	build := func() (*statepkg.State, *machine.Machine, *[]statepkg.Event) {
+		return preinstallBuild(t, machine.EventBurnInPassed, func(m *machine.Machine) {
+			m.BurnIn = &config.BurnInConfig{ImageURL: "http://images.example.com/burnin/", Kernel: "vmlinuz", Initrd: "initrd.img",
+				Cmdline: "duration={{ machine.BurnIn.DurationSeconds }}", DurationSeconds: 3600}
+		})
+	}
+
+	state, m, events := build()
+	if m.State != machine.BuildBurningIn {
+		t.Fatalf("expected the build to start burning in, got %s", m.State)
+	}
+	if boot, _ := m.PixieInit(); boot.Kernel != "http://images.example.com/burnin/vmlinuz" || boot.Cmdline != "duration=3600" {
+		t.Errorf("expected the burn-in image to be served, got %+v", boot)
+	}
+	started := m.BuildStart
+	if err := state.ReportBurnIn(m.Token, machine.BurnInResult{Passed: true, Message: "memtest clean"}, config.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if m.State != machine.BuildPending || !m.BuildStart.After(started) || len(*events) != 1 || (*events)[0].Type != machine.EventBurnInPassed {
+		t.Errorf("expected a passed burn-in to go on to the install, got %s %+v", m.State, *events)
+	}
+	if boot, _ := m.PixieInit(); boot.Kernel != "linux" {
+		t.Errorf("expected the installer to be served, got %+v", boot)
+	}
+	if err := state.ReportBurnIn(m.Token, machine.BurnInResult{Passed: true}, config.Config{}); err != statepkg.ErrNotInStage {
+		t.Errorf("expected results after burn-in to be refused, got %v", err)
+	}
+
+	state, m, events = build()
+	response := httptest.NewRecorder()
+	burnInHandler(response, httptest.NewRequest("POST", "/burnin/dns02.example.com/"+m.Token,
+		strings.NewReader(`{"Passed": false, "Message": "2 memory errors", "Results": {"dimm": "B2"}}`)),
+		httprouter.Params{{Key: "hostname", Value: "dns02.example.com"}, {Key: "token", Value: m.Token}}, config.Config{}, state)
+	if response.Code != 200 {
+		t.Fatalf("unexpected response %d %s", response.Code, response.Body.String())
+	}
+	if m.State != machine.BuildFailed || m.BurnInResult.Results["dimm"] != "B2" || len(state.MachineByMAC) != 0 {
+		t.Errorf("expected a failed burn-in to fail the build, got %s %+v", m.State, m.BurnInResult)
+	}
+	if len(*events) != 1 || (*events)[0].Message != "burn-in failed: 2 memory errors" {
+		t.Errorf("expected build-failed, got %+v", *events)
+	}
+	if state.RetryBuild(m, config.Config{BuildRetries: 3}, "burn-in") {
+		t.Error("expected a failed burn-in not to be retried")
+	}
+
+	state, m, events = build()
+	_, timeout, _ := machine.BurnInStage.Image(m)
+	state.FailStage(m, config.Config{}, machine.BurnInStage, "no results within "+timeout.String())
+	if m.State != machine.BuildFailed || len(*events) != 1 || !strings.Contains((*events)[0].Message, "no results within 2h0m0s") {
+		t.Errorf("expected a burn-in without results to fail, got %+v", *events)
+	}
+
+	m = &machine.Machine{Hostname: "dns03.example.com", RescueMode: true}
+	m.BurnIn = &config.BurnInConfig{Kernel: "vmlinuz"}
+	if m.NextStage() != nil {
+		t.Error("expected rescue builds to skip burn-in")
+	}
+}
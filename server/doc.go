@@ -0,0 +1,7 @@
+// Package server is the HTTP API of Waitron. NewHandler returns the handler
+// serving it for a config and a state.State.
+package server
+
+import "github.com/ns1/waitron/config"
+
+var logger = config.Log
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestConfigDrift(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-drift")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	define := func(release string) {
+		ioutil.WriteFile(filepath.Join(dir, "node01.example.com.yaml"),
+			[]byte(`{"preseed": "preseed.j2", "params": {"release": "`+release+`"}, "network": [{"macaddress": "de:ad:be:ef:00:01"}]}`), 0644)
+	}
+	define("jammy")
+	ioutil.WriteFile(filepath.Join(dir, "node02.example.com.yaml"), []byte(`{"network": [{"macaddress": "de:ad:be:ef:00:02"}]}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "preseed.j2"), []byte("d-i mirror/suite string {{ machine.Params.release }}"), 0644)
+
+	config := config.Config{MachinePath: dir, GroupPath: dir, TemplatePath: dir}
+	state := statepkg.New()
+	state.Drift = statepkg.NewDriftDetector(config, state)
+
+	build := func() string {
+		m, err := machine.BuildDefinition("node01.example.com", "", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := state.SetBuildMode(m, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := state.DoneBuildMode(*state.MachineByToken(token), config); err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	if drift, err := state.Drift.Check("node01.example.com"); err != nil || drift != nil {
+		t.Errorf("expected a host never built not to drift, got %+v %v", drift, err)
+	}
+	token := build()
+	if drift, err := state.Drift.Check("node01.example.com"); err != nil || drift != nil {
+		t.Errorf("expected no drift right after the build, got %+v %v", drift, err)
+	}
+
+	define("noble")
+	ioutil.WriteFile(filepath.Join(dir, "preseed.j2"), []byte("d-i mirror/suite string {{ machine.Params.release }}\n"), 0644)
+	drifted, err := state.Drift.CheckAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	drift := drifted["node01.example.com"]
+	if len(drifted) != 1 || drift == nil || drift.Token != token || drift.Installed.IsZero() ||
+		!reflect.DeepEqual(drift.Changes, []string{"definition", "template preseed.j2"}) {
+		t.Fatalf("expected node01 to drift, got %+v", drifted)
+	}
+
+	response := httptest.NewRecorder()
+	status(response, httptest.NewRequest("GET", "/status?drift=true", nil), httprouter.Params{}, config, state)
+	var served map[string]*statepkg.ConfigDrift
+	if response.Code != 200 || json.Unmarshal(response.Body.Bytes(), &served) != nil || served["node01.example.com"] == nil {
+		t.Errorf("expected the drift in /status, got %d %s", response.Code, response.Body.String())
+	}
+
+	build()
+	response = httptest.NewRecorder()
+	driftCheckHandler(response, httptest.NewRequest("POST", "/api/v1/drift-checks?hostname=node01.example.com", nil),
+		httprouter.Params{}, config, state)
+	if response.Code != 200 || response.Body.String() != "{}" {
+		t.Errorf("expected no drift once rebuilt, got %d %s", response.Code, response.Body.String())
+	}
+	if drifted := state.Drift.List(); len(drifted) != 0 {
+		t.Errorf("expected the drift to be cleared, got %+v", drifted)
+	}
+}
+
+func TestConfigDriftDefaultProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-drift")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := config.Config{MachinePath: dir, GroupPath: dir, TemplatePath: dir, DefaultProfile: &config.DefaultProfileConfig{
+		Definition: map[string]interface{}{"operatingsystem": "debian"},
+	}}
+	state := statepkg.New()
+	state.Drift = statepkg.NewDriftDetector(config, state)
+
+	m, err := machine.BuildDefinition("unknown-aa-bb-cc-dd-ee-ff", "aa:bb:cc:dd:ee:ff", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := state.SetBuildMode(m, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.DoneBuildMode(*state.MachineByToken(token), config); err != nil {
+		t.Fatal(err)
+	}
+	if drift, err := state.Drift.Check("unknown-aa-bb-cc-dd-ee-ff"); err != nil || drift != nil {
+		t.Errorf("expected a default-profile build not to drift from its own MAC address, got %+v %v", drift, err)
+	}
+}
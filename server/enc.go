@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"gopkg.in/yaml.v2"
+)
+
+// What the node classifier gets
+type encNode struct {
+	Environment string                 `yaml:"environment,omitempty"`
+	Classes     map[string]interface{} `yaml:"classes"`
+	Parameters  map[string]interface{} `yaml:"parameters"`
+}
+
+func newENCNode(m machine.Machine) encNode {
+	node := encNode{
+		Environment: m.Puppet.Environment,
+		Classes:     map[string]interface{}{},
+		Parameters:  map[string]interface{}{},
+	}
+	for name, params := range m.Puppet.Classes {
+		node.Classes[name] = params
+	}
+	for k, v := range m.Params {
+		node.Parameters[k] = v
+	}
+	for k, v := range m.Puppet.Parameters {
+		node.Parameters[k] = v
+	}
+	return node
+}
+
+// @Title encHandler
+// @Description Classifies a node for Puppet's external node classifier
+// @Param hostname  path  string  true  "Hostname"
+// @Success 200 {object} string "environment, classes and parameters as YAML"
+// @Failure 404 {object} string "Unable to find host definition for hostname"
+// @Failure 500 {object} string "Unable to classify the node"
+// @Router /enc/{hostname} [GET]
+func encHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params,
+	config config.Config) {
+
+	hostname := ps.ByName("hostname")
+
+	m, err := machine.MachineDefinition(hostname, config.MachinePath, config)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "", http.StatusNotFound)
+		return
+	}
+
+	result, err := yaml.Marshal(newENCNode(m))
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to classify the node", http.StatusInternalServerError)
+		return
+	}
+
+	response.Header().Set("content-type", "application/x-yaml")
+	response.Write(result)
+}
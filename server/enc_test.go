@@ -0,0 +1,70 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"gopkg.in/yaml.v2"
+)
+
+func TestENCHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-enc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "node01.example.com.yaml"), []byte(`{"params": {"role": "web"}}`), 0644)
+
+	config := config.Config{MachinePath: dir, GroupPath: dir}
+	classify := func(hostname string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		encHandler(response, httptest.NewRequest("GET", "/enc/"+hostname, nil),
+			httprouter.Params{httprouter.Param{Key: "hostname", Value: hostname}}, config)
+		return response
+	}
+
+	response := classify("node01.example.com")
+	if response.Code != http.StatusOK {
+		t.Fatalf("expected the node to be classified, got %d %s", response.Code, response.Body.String())
+	}
+	var node encNode
+	if err := yaml.Unmarshal(response.Body.Bytes(), &node); err != nil {
+		t.Fatal(err)
+	}
+	if node.Parameters["role"] != "web" || node.Classes == nil {
+		t.Errorf("expected the machine's params as parameters, got %s", response.Body.String())
+	}
+
+	if response := classify("node02.example.com"); response.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown node not to be classified, got %d", response.Code)
+	}
+}
+
+// The group's classes and parameters are merged with the machine's
+func TestENCNode(t *testing.T) {
+	var p config.PuppetConfig
+	for _, d := range []string{
+		`{"environment": "production", "classes": {"ntp": null}, "parameters": {"datacenter": "ams1"}}`,
+		`{"classes": {"apache": {"default_vhost": false}}, "parameters": {"rack": "r12"}}`,
+	} {
+		if err := yaml.Unmarshal([]byte(d), &p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	m := machine.Machine{Config: config.Config{Params: map[string]string{"datacenter": "dc1", "role": "web"}, Puppet: p}}
+	node := newENCNode(m)
+	if _, ok := node.Classes["ntp"]; !ok || node.Classes["apache"] == nil || node.Environment != "production" {
+		t.Errorf("expected both classes, got %+v", node)
+	}
+	if node.Parameters["role"] != "web" || node.Parameters["datacenter"] != "ams1" || node.Parameters["rack"] != "r12" {
+		t.Errorf("expected params with the puppet parameters over them, got %+v", node.Parameters)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// Strong ETag for an already rendered response body
+func bodyETag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// Reports whether the request's If-None-Match header matches etag.
+func etagMatches(request *http.Request, etag string) bool {
+	inm := request.Header.Get("If-None-Match")
+	if inm == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(inm, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the ETag header and, if the client already has this version, answers
+// with 304 Not Modified. Returns true when the caller should not write a body.
+func checkNotModified(response http.ResponseWriter, request *http.Request, etag string) bool {
+	response.Header().Set("ETag", etag)
+	if etagMatches(request, etag) {
+		response.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// Writes a JSON body with an ETag derived from its content.
+func writeJSONWithETag(response http.ResponseWriter, request *http.Request, body []byte) {
+	response.Header().Set("content-type", "application/json")
+	if checkNotModified(response, request, bodyETag(body)) {
+		return
+	}
+	response.Write(body)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+// @Title exportInventoryHandler
+// @Description The inventory with the last build and status of every machine, as CSV or JSON
+// @Param format    query  string  false  "csv or json, json by default"
+// @Param columns   query  string  false  "Comma separated hostname, macs, ips, labels, last_build, status and label.<key>, all but label.<key> by default"
+// @Param selector  query  string  false  "Only machines with matching labels, e.g. rack=r12,role!=db"
+// @Success 200 {array} string "The machines"
+// @Failure 400 {object} string "Invalid format, columns or selector"
+// @Failure 500 {object} string "Unable to export inventory"
+// @Router /export/inventory [GET]
+func exportInventoryHandler(response http.ResponseWriter, request *http.Request,
+	_ httprouter.Params, config config.Config, state *statepkg.State) {
+	query := request.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		format = "json"
+	}
+	if format != "json" && format != "csv" {
+		httpError(response, request, "format must be csv or json", http.StatusBadRequest)
+		return
+	}
+	columns, err := statepkg.ParseExportColumns(query.Get("columns"))
+	if err != nil {
+		httpError(response, request, err.Error(), http.StatusBadRequest)
+		return
+	}
+	requirements, err := machine.ParseSelector(query.Get("selector"))
+	if err != nil {
+		httpError(response, request, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	inv, err := state.InventoryFor(config)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to export inventory", http.StatusInternalServerError)
+		return
+	}
+	rows, err := state.ExportRows(inv.Match(requirements))
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to export inventory", http.StatusInternalServerError)
+		return
+	}
+
+	if format == "csv" {
+		response.Header().Set("content-type", "text/csv")
+		response.Header().Set("Content-Disposition", `attachment; filename="inventory.csv"`)
+		w := csv.NewWriter(response)
+		w.Write(columns)
+		for _, r := range rows {
+			record := make([]string, len(columns))
+			for n, c := range columns {
+				record[n] = r.CSV(c)
+			}
+			w.Write(record)
+		}
+		w.Flush()
+		return
+	}
+
+	objects := make([]map[string]interface{}, 0, len(rows))
+	for _, r := range rows {
+		o := make(map[string]interface{})
+		for _, c := range columns {
+			o[c] = r.JSON(c)
+		}
+		objects = append(objects, o)
+	}
+	js, _ := json.Marshal(objects)
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestExportInventoryHandler(t *testing.T) {
+	state := statepkg.New()
+	state.Inventory = testInventory()
+	state.Inventory.ByHostname["db01.example.com"].IPs = []string{"192.0.2.10", "2001:db8::10"}
+
+	end := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	state.Store.Put(statepkg.BuildsBucket, "old", machine.BuildRecord{Hostname: "db01.example.com", Token: "old", Status: "Terminated", BuildEnd: end.Add(-time.Hour)})
+	state.Store.Put(statepkg.BuildsBucket, "new", machine.BuildRecord{Hostname: "db01.example.com", Token: "new", Status: "Installed", BuildEnd: end})
+	state.Store.Put(statepkg.BuildsBucket, "web", machine.BuildRecord{Hostname: "web01.example.com", Token: "web", Status: "Installed", BuildEnd: end})
+	state.MachineByHostname["web01.example.com"] = &machine.Machine{Hostname: "web01.example.com", Status: "Installing"}
+
+	export := func(query string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		exportInventoryHandler(response, httptest.NewRequest("GET", "/export/inventory?"+query, nil), nil, config.Config{}, state)
+		return response
+	}
+
+	response := export("format=csv&columns=hostname,ips,labels,label.rack,last_build,status")
+	if response.Code != http.StatusOK || response.Header().Get("content-type") != "text/csv" {
+		t.Fatalf("unexpected response %d %s", response.Code, response.Body.String())
+	}
+	records, err := csv.NewReader(strings.NewReader(response.Body.String())).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := [][]string{
+		{"hostname", "ips", "labels", "label.rack", "last_build", "status"},
+		{"db01.example.com", "192.0.2.10 2001:db8::10", "rack=r1;role=db", "r1", "2020-01-02T03:04:05Z", "Installed"},
+		{"web01.example.com", "", "rack=r1;role=web", "r1", "2020-01-02T03:04:05Z", "Installing"},
+		{"web02.example.com", "", "role=web", "", "", ""},
+	}
+	if len(records) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, records)
+	}
+	for n := range expected {
+		if strings.Join(records[n], "|") != strings.Join(expected[n], "|") {
+			t.Errorf("expected %v, got %v", expected[n], records[n])
+		}
+	}
+
+	response = export("selector=role=db")
+	var rows []map[string]interface{}
+	if err := json.Unmarshal(response.Body.Bytes(), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || len(rows[0]) != len(statepkg.ExportColumns) || rows[0]["last_build"].(map[string]interface{})["token"] != "new" ||
+		len(rows[0]["macs"].([]interface{})) != 1 {
+		t.Errorf("unexpected rows %s", response.Body.String())
+	}
+
+	for _, query := range []string{"format=xml", "columns=hostname,serial", "selector==db"} {
+		if code := export(query).Code; code != http.StatusBadRequest {
+			t.Errorf("expected %s to be refused, got %d", query, code)
+		}
+	}
+}
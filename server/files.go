@@ -0,0 +1,176 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/template"
+)
+
+// @Title staticFileHandler
+// @Description Serve a file from the static files directory, supporting Range and If-Range requests so interrupted downloads can resume. The ETag is the file's SHA256, <file>.sha256 returns it in sha256sum format.
+// @Param filepath  path  string  true  "Path of the file, may contain directories"
+// @Success 200 {object} string "File contents"
+// @Success 206 {object} string "The requested range of the file"
+// @Success 304 {object} string "Not modified"
+// @Failure 404 {object} string "File not found"
+// @Failure 416 {object} string "Range not satisfiable"
+// @Router /files/{filepath} [GET]
+func staticFileHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config) {
+	name := strings.TrimPrefix(ps.ByName("filepath"), "/")
+
+	f, info, err := template.OpenStaticFile(config.StaticFilesPath, name)
+	if os.IsNotExist(err) && strings.HasSuffix(name, ".sha256") {
+		checksumFileHandler(response, request, strings.TrimSuffix(name, ".sha256"), config)
+		return
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(response, request)
+			return
+		}
+		logRequest(request, err)
+		httpError(response, request, "Unable to open file", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	full := filepath.Join(config.StaticFilesPath, path.Clean("/"+name))
+	if sum, err := template.Checksums.SumOpen(full, f, info); err == nil {
+		response.Header().Set("ETag", `"`+sum+`"`)
+	} else {
+		logRequest(request, err)
+	}
+
+	// ServeContent deals with Range, If-Range and the conditional headers
+	http.ServeContent(response, request, info.Name(), info.ModTime(), f)
+}
+
+// Serve the SHA256 of name in the format sha256sum -c reads
+func checksumFileHandler(response http.ResponseWriter, request *http.Request, name string, config configpkg.Config) {
+	sum, err := template.Checksums.Sum(config.StaticFilesPath, name)
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(response, request)
+			return
+		}
+		logRequest(request, err)
+		httpError(response, request, "Unable to checksum file", http.StatusInternalServerError)
+		return
+	}
+
+	response.Header().Set("content-type", "text/plain; charset=utf-8")
+	fmt.Fprintf(response, "%s  %s\n", sum, path.Base(name))
+}
+
+type uploadResult struct {
+	State  string
+	Path   string
+	SHA256 string
+	Size   int64
+}
+
+// @Title uploadFileHandler
+// @Description Store a file in the static files directory, replacing any file at that path. The SHA256 of the body must be given and is checked before the file is put in place.
+// @Param filepath         path    string  true   "Path of the file, may contain directories"
+// @Param X-Checksum-SHA256 header string  false  "Hex SHA256 of the body, or use the sha256 query parameter"
+// @Param sha256           query   string  false  "Hex SHA256 of the body"
+// @Success 200 {object} string "{"State": "OK", "Path": <path>, "SHA256": <sum>, "Size": <bytes>} when a file was replaced"
+// @Success 201 {object} string "{"State": "OK", "Path": <path>, "SHA256": <sum>, "Size": <bytes>} when the file is new"
+// @Failure 400 {object} string "Missing or mismatching checksum, or invalid path"
+// @Failure 401 {object} string "Invalid admin token"
+// @Failure 403 {object} string "No admin_tokens configured"
+// @Router /api/v1/files/{filepath} [PUT]
+func uploadFileHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config) {
+	if config.StaticFilesPath == "" {
+		httpError(response, request, "No staticspath configured", http.StatusNotFound)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+ps.ByName("filepath")), "/")
+	if name == "" || strings.HasSuffix(name, ".sha256") {
+		httpError(response, request, "Invalid path", http.StatusBadRequest)
+		return
+	}
+
+	expected := strings.ToLower(request.Header.Get("X-Checksum-SHA256"))
+	if expected == "" {
+		expected = strings.ToLower(request.URL.Query().Get("sha256"))
+	}
+	if !configpkg.SHA256Re.MatchString(expected) {
+		httpError(response, request, "The SHA256 of the file is required in X-Checksum-SHA256 or ?sha256=", http.StatusBadRequest)
+		return
+	}
+
+	dest := filepath.Join(config.StaticFilesPath, filepath.FromSlash(name))
+	info, err := os.Stat(dest)
+	if err == nil && info.IsDir() {
+		httpError(response, request, "Invalid path, it is a directory", http.StatusBadRequest)
+		return
+	}
+	created := os.IsNotExist(err)
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to create directory", http.StatusInternalServerError)
+		return
+	}
+
+	// Write next to the destination and move it in place once verified, so
+	// a partial or corrupt upload never replaces a good file
+	tmp, err := ioutil.TempFile(filepath.Dir(dest), "."+filepath.Base(dest)+".")
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to store file", http.StatusInternalServerError)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), request.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to store file", http.StatusInternalServerError)
+		return
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if sum != expected {
+		configpkg.RequestLogger(request).Warn("upload checksum mismatch", "path", name, "sha256", sum, "expected", expected)
+		httpError(response, request, fmt.Sprintf("Checksum mismatch, received %s", sum), http.StatusBadRequest)
+		return
+	}
+
+	if err := os.Chmod(tmp.Name(), 0644); err == nil {
+		err = os.Rename(tmp.Name(), dest)
+	}
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to store file", http.StatusInternalServerError)
+		return
+	}
+	configpkg.RequestLogger(request).Info("stored uploaded file", "path", name, "size", size, "sha256", sum)
+
+	js, _ := json.Marshal(uploadResult{State: "OK", Path: name, SHA256: sum, Size: size})
+	response.Header().Set("content-type", "application/json")
+	if created {
+		response.WriteHeader(http.StatusCreated)
+	}
+	response.Write(js)
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/template"
+)
+
+func staticFilesDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "waitron-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "ubuntu", "focal"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "ubuntu", "focal", "linux"), []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func serveStaticFile(config config.Config, name string, headers map[string]string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("GET", "/files/"+name, nil)
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	response := httptest.NewRecorder()
+	staticFileHandler(response, request, httprouter.Params{{Key: "filepath", Value: "/" + name}}, config)
+	return response
+}
+
+func TestStaticFileNested(t *testing.T) {
+	dir := staticFilesDir(t)
+	defer os.RemoveAll(dir)
+	config := config.Config{StaticFilesPath: dir}
+
+	response := serveStaticFile(config, "ubuntu/focal/linux", nil)
+	if response.Code != http.StatusOK || response.Body.String() != "0123456789" {
+		t.Errorf("unexpected response %d %q", response.Code, response.Body.String())
+	}
+	if response.Header().Get("Accept-Ranges") != "bytes" {
+		t.Error("expected Accept-Ranges: bytes")
+	}
+
+	for _, name := range []string{"ubuntu/focal", "ubuntu/missing", "../" + filepath.Base(dir) + "/ubuntu/focal/linux/.."} {
+		if response := serveStaticFile(config, name, nil); response.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", name, response.Code)
+		}
+	}
+}
+
+func TestStaticFileRange(t *testing.T) {
+	dir := staticFilesDir(t)
+	defer os.RemoveAll(dir)
+	config := config.Config{StaticFilesPath: dir}
+
+	response := serveStaticFile(config, "ubuntu/focal/linux", map[string]string{"Range": "bytes=4-"})
+	if response.Code != http.StatusPartialContent || response.Body.String() != "456789" {
+		t.Errorf("unexpected response %d %q", response.Code, response.Body.String())
+	}
+
+	// The file changed since the client's copy, so start over
+	old := time.Now().Add(-24 * time.Hour).UTC().Format(http.TimeFormat)
+	response = serveStaticFile(config, "ubuntu/focal/linux", map[string]string{"Range": "bytes=4-", "If-Range": old})
+	if response.Code != http.StatusOK || response.Body.String() != "0123456789" {
+		t.Errorf("unexpected response to a stale If-Range %d %q", response.Code, response.Body.String())
+	}
+
+	response = serveStaticFile(config, "ubuntu/focal/linux", map[string]string{"Range": "bytes=20-"})
+	if response.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("expected 416, got %d", response.Code)
+	}
+}
+
+func TestStaticFileChecksum(t *testing.T) {
+	dir := staticFilesDir(t)
+	defer os.RemoveAll(dir)
+	config := config.Config{StaticFilesPath: dir}
+
+	// sha256 of 0123456789
+	const sum = "84d89877f0d4041efb6bf91a16f0248f2fd573e6af05c19f96bedb9f882f7882"
+
+	response := serveStaticFile(config, "ubuntu/focal/linux", nil)
+	if etag := response.Header().Get("ETag"); etag != `"`+sum+`"` {
+		t.Errorf("unexpected ETag %s", etag)
+	}
+
+	response = serveStaticFile(config, "ubuntu/focal/linux", map[string]string{"If-None-Match": `"` + sum + `"`})
+	if response.Code != http.StatusNotModified {
+		t.Errorf("expected 304 for a matching ETag, got %d", response.Code)
+	}
+
+	response = serveStaticFile(config, "ubuntu/focal/linux.sha256", nil)
+	if response.Code != http.StatusOK || response.Body.String() != sum+"  linux\n" {
+		t.Errorf("unexpected checksum response %d %q", response.Code, response.Body.String())
+	}
+
+	if response := serveStaticFile(config, "ubuntu/focal.sha256", nil); response.Code != http.StatusNotFound {
+		t.Errorf("expected no checksum for a directory, got %d", response.Code)
+	}
+
+	if got := template.TemplateChecksum(config)("ubuntu/focal/linux"); got != sum {
+		t.Errorf("unexpected template checksum %q", got)
+	}
+
+	// A changed file gets a new sum
+	later := time.Now().Add(time.Minute)
+	ioutil.WriteFile(filepath.Join(dir, "ubuntu", "focal", "linux"), []byte("changed"), 0644)
+	os.Chtimes(filepath.Join(dir, "ubuntu", "focal", "linux"), later, later)
+	if got := template.TemplateChecksum(config)("ubuntu/focal/linux"); got == sum || got == "" {
+		t.Errorf("expected a new checksum, got %q", got)
+	}
+}
+
+func uploadStaticFile(config config.Config, name string, body string, sum string, token string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest("PUT", "/api/v1/files/"+name, strings.NewReader(body))
+	if sum != "" {
+		request.Header.Set("X-Checksum-SHA256", sum)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response := httptest.NewRecorder()
+	h := requireAdmin(config, func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+		uploadFileHandler(response, request, ps, config)
+	})
+	h(response, request, httprouter.Params{{Key: "filepath", Value: "/" + name}})
+	return response
+}
+
+func TestUploadFile(t *testing.T) {
+	dir := staticFilesDir(t)
+	defer os.RemoveAll(dir)
+	config := config.Config{StaticFilesPath: dir, AdminTokens: []string{"secret"}}
+
+	sum := sha256Hex([]byte("new kernel"))
+	response := uploadStaticFile(config, "ubuntu/jammy/linux", "new kernel", sum, "secret")
+	if response.Code != http.StatusCreated {
+		t.Fatalf("expected 201, got %d: %s", response.Code, response.Body.String())
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "ubuntu", "jammy", "linux")); string(data) != "new kernel" {
+		t.Errorf("unexpected file contents %q", data)
+	}
+
+	// Replacing is a 200
+	sum = sha256Hex([]byte("newer kernel"))
+	if response := uploadStaticFile(config, "ubuntu/jammy/linux", "newer kernel", sum, "secret"); response.Code != http.StatusOK {
+		t.Errorf("expected 200, got %d: %s", response.Code, response.Body.String())
+	}
+
+	// A mismatch leaves the old file alone
+	if response := uploadStaticFile(config, "ubuntu/jammy/linux", "corrupt", sum, "secret"); response.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a mismatch, got %d", response.Code)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "ubuntu", "jammy", "linux")); string(data) != "newer kernel" {
+		t.Errorf("expected the file to be untouched, got %q", data)
+	}
+	if files, _ := ioutil.ReadDir(filepath.Join(dir, "ubuntu", "jammy")); len(files) != 1 {
+		t.Errorf("expected temporary files to be cleaned up, got %d files", len(files))
+	}
+
+	if response := uploadStaticFile(config, "ubuntu/jammy/initrd", "initrd", "", "secret"); response.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 without a checksum, got %d", response.Code)
+	}
+	if response := uploadStaticFile(config, "ubuntu/focal", "dir", sha256Hex([]byte("dir")), "secret"); response.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for a directory, got %d", response.Code)
+	}
+
+	// Paths stay inside staticspath
+	traversal := "../../escaped"
+	if response := uploadStaticFile(config, traversal, "x", sha256Hex([]byte("x")), "secret"); response.Code != http.StatusCreated {
+		t.Fatalf("expected the path to be cleaned, got %d", response.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); err != nil {
+		t.Errorf("expected the file under staticspath: %s", err)
+	}
+}
+
+func TestUploadFileAuth(t *testing.T) {
+	dir := staticFilesDir(t)
+	defer os.RemoveAll(dir)
+	sum := sha256Hex([]byte("x"))
+
+	config := config.Config{StaticFilesPath: dir, AdminTokens: []string{"secret"}}
+	for _, token := range []string{"", "wrong"} {
+		response := uploadStaticFile(config, "linux", "x", sum, token)
+		if response.Code != http.StatusUnauthorized || response.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("token %q: expected 401, got %d", token, response.Code)
+		}
+	}
+
+	config.AdminTokens = nil
+	if response := uploadStaticFile(config, "linux", "x", sum, "secret"); response.Code != http.StatusForbidden {
+		t.Errorf("expected 403 without admin tokens, got %d", response.Code)
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestFirmware(t *testing.T) {
+	build := func(model string) (*statepkg.State, *machine.Machine, *[]statepkg.Event) {
+		return preinstallBuild(t, machine.EventFirmwareUpdated, func(m *machine.Machine) {
+			m.Labels = map[string]string{"model": model}
+			m.Firmware = &config.FirmwareConfig{ImageURL: "http://images.example.com/firmware/", Kernel: "vmlinuz", Initrd: "initrd.img",
+				Models: map[string]map[string]config.FirmwarePackage{
+					"r640": {
+						"bios": {Version: "2.19.1", URL: "http://files.example.com/r640/bios-2.19.1.bin"},
+						"bmc":  {Version: "7.00.00", URL: "http://files.example.com/r640/idrac-7.00.00.bin"},
+					},
+				}}
+			m.BurnIn = &config.BurnInConfig{Kernel: "memtest"}
+		})
+	}
+	params := func(m *machine.Machine) httprouter.Params {
+		return httprouter.Params{{Key: "hostname", Value: m.Hostname}, {Key: "token", Value: m.Token}}
+	}
+
+	state, m, events := build("r640")
+	if m.State != machine.BuildUpdatingFirmware {
+		t.Fatalf("expected the build to start updating firmware, got %s", m.State)
+	}
+	if boot, _ := m.PixieInit(); boot.Kernel != "http://images.example.com/firmware/vmlinuz" {
+		t.Errorf("expected the firmware image to be served, got %+v", boot)
+	}
+
+	response := httptest.NewRecorder()
+	firmwareHandler(response, httptest.NewRequest("GET", "/firmware/dns02.example.com/"+m.Token, nil), params(m), config.Config{}, state)
+	var manifest machine.FirmwareManifest
+	if err := json.Unmarshal(response.Body.Bytes(), &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Model != "r640" || manifest.Components["bios"].Version != "2.19.1" {
+		t.Errorf("expected the r640 packages, got %+v", manifest)
+	}
+
+	response = httptest.NewRecorder()
+	firmwareResultHandler(response, httptest.NewRequest("POST", "/firmware/dns02.example.com/"+m.Token,
+		strings.NewReader(`{"Components": [{"Component": "bios", "From": "2.12.2", "To": "2.19.1", "Passed": true},
+			{"Component": "bmc", "From": "6.10.30", "To": "7.00.00", "Passed": true}]}`)), params(m), config.Config{}, state)
+	if response.Code != 200 {
+		t.Fatalf("unexpected response %d %s", response.Code, response.Body.String())
+	}
+	if m.State != machine.BuildBurningIn || len(*events) != 1 || (*events)[0].Type != machine.EventFirmwareUpdated {
+		t.Errorf("expected updated firmware to go on to burn-in, got %s %+v", m.State, *events)
+	}
+	if boot, _ := m.PixieInit(); boot.Kernel != "memtest" {
+		t.Errorf("expected the burn-in image to be served, got %+v", boot)
+	}
+	response = httptest.NewRecorder()
+	firmwareHandler(response, httptest.NewRequest("GET", "/firmware/dns02.example.com/"+m.Token, nil), params(m), config.Config{}, state)
+	if response.Code != 409 {
+		t.Errorf("expected the manifest to be refused after the update, got %d", response.Code)
+	}
+
+	state, m, events = build("r640")
+	err := state.ReportFirmware(m.Token, machine.FirmwareResult{Components: []machine.FirmwareComponentResult{
+		{Component: "bios", Passed: false, Message: "checksum mismatch"}}}, config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.State != machine.BuildFailed || len(*events) != 1 ||
+		(*events)[0].Message != "firmware failed: bios: checksum mismatch, bmc: no result" {
+		t.Errorf("expected a failed update to fail the build, got %s %+v", m.State, *events)
+	}
+	if state.RetryBuild(m, config.Config{BuildRetries: 3}, "firmware") {
+		t.Error("expected a failed firmware update not to be retried")
+	}
+
+	_, m, _ = build("r750")
+	if m.State != machine.BuildBurningIn {
+		t.Errorf("expected a model without firmware to skip the update, got %s", m.State)
+	}
+}
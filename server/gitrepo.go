@@ -0,0 +1,55 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/state"
+)
+
+// @Title gitSyncHandler
+// @Description Fetch the git repository and serve its newest commit if it passes validation, for push webhooks. Takes an admin token or a webhook signed with webhook_secret.
+// @Success 200 {object} string "{"Commit": <served commit>, "Synced": <time>}"
+// @Failure 401 {object} string "Invalid admin token or webhook signature"
+// @Failure 404 {object} string "No git repository configured"
+// @Failure 422 {object} string "{"Commit": <served commit>, "Rejected": <commit>, "Error": <why>}"
+// @Failure 502 {object} string "Unable to sync"
+// @Router /admin/sync [POST]
+func gitSyncHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config config.Config, state *state.State) {
+	if state.Repo == nil {
+		httpError(response, request, "No git repository configured", http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(request.Body, machine.MaxWebhookBody))
+	if err != nil {
+		httpError(response, request, "Unable to read request", http.StatusBadRequest)
+		return
+	}
+	if !isAdmin(config, request) && !machine.ValidWebhook(state.Repo.Config.WebhookSecret, request, body) {
+		logRequest(request, "invalid admin token or webhook signature")
+		httpError(response, request, "Invalid admin token or webhook signature", http.StatusUnauthorized)
+		return
+	}
+
+	status, err := state.Repo.Sync()
+	code := http.StatusOK
+	if err != nil {
+		logRequest(request, err)
+		code = http.StatusBadGateway
+		if _, ok := err.(*machine.GitValidationError); ok {
+			code = http.StatusUnprocessableEntity
+		}
+	}
+
+	js, _ := json.Marshal(status)
+	response.Header().Set("content-type", "application/json")
+	response.WriteHeader(code)
+	response.Write(js)
+}
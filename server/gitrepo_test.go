@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+// A repository to sync from, committing files on demand
+type sourceRepo struct {
+	t   *testing.T
+	dir string
+}
+
+func newSourceRepo(t *testing.T, dir string) *sourceRepo {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	s := &sourceRepo{t: t, dir: dir}
+	s.git("init", "--quiet")
+	s.git("config", "user.email", "test@example.com")
+	s.git("config", "user.name", "test")
+	return s
+}
+
+func (s *sourceRepo) git(args ...string) string {
+	out, err := machine.Git(append([]string{"-C", s.dir}, args...)...)
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return out
+}
+
+// Write files and commit them, returning the commit
+func (s *sourceRepo) commit(files map[string]string) string {
+	for name, content := range files {
+		p := filepath.Join(s.dir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	s.git("add", "-A")
+	s.git("commit", "--quiet", "-m", "update")
+	return s.git("rev-parse", "HEAD")
+}
+
+func TestGitSyncHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-git")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	source := newSourceRepo(t, filepath.Join(dir, "source"))
+	commit := source.commit(map[string]string{"machines/node01.example.com.yaml": `{}`})
+
+	state := statepkg.New()
+	state.Repo, _ = machine.NewGitRepo(configpkg.GitRepoConfig{URL: source.dir, Path: filepath.Join(dir, "served"), WebhookSecret: "hush"})
+	config := configpkg.Config{AdminTokens: []string{"admin"}}
+
+	body := []byte(`{"ref": "refs/heads/master"}`)
+	mac := hmac.New(sha256.New, []byte("hush"))
+	mac.Write(body)
+
+	for _, c := range []struct {
+		header string
+		value  string
+		code   int
+	}{
+		{"X-Hub-Signature-256", "sha256=" + hex.EncodeToString(mac.Sum(nil)), http.StatusOK},
+		{"X-Hub-Signature-256", "sha256=0000", http.StatusUnauthorized},
+		{"X-Gitlab-Token", "hush", http.StatusOK},
+		{"Authorization", "Bearer admin", http.StatusOK},
+		{"Authorization", "Bearer wrong", http.StatusUnauthorized},
+	} {
+		request := httptest.NewRequest("POST", "/admin/sync", bytes.NewReader(body))
+		request.Header.Set(c.header, c.value)
+		response := httptest.NewRecorder()
+		gitSyncHandler(response, request, nil, config, state)
+		if response.Code != c.code {
+			t.Errorf("%s %s: expected %d, got %d %s", c.header, c.value, c.code, response.Code, response.Body.String())
+		}
+	}
+
+	response := httptest.NewRecorder()
+	versionHandler(response, httptest.NewRequest("GET", "/version", nil), nil, config, state)
+	var v configpkg.VersionInfo
+	json.Unmarshal(response.Body.Bytes(), &v)
+	if v.DefinitionsCommit != commit {
+		t.Errorf("expected /version to report %s, got %q", commit, response.Body.String())
+	}
+
+	response = httptest.NewRecorder()
+	gitSyncHandler(response, httptest.NewRequest("POST", "/admin/sync", strings.NewReader("")), nil, config, statepkg.New())
+	if response.Code != http.StatusNotFound {
+		t.Errorf("expected 404 without a repository, got %d", response.Code)
+	}
+}
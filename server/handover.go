@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	configpkg "github.com/ns1/waitron/config"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+// Fetch the builds in progress from the waitron at url, which then shuts
+// down
+func FetchHandover(url string, token string) ([]statepkg.HandoverBuild, error) {
+	request, err := http.NewRequest("POST", strings.TrimRight(url, "/")+"/api/v1/handover", nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	client := http.Client{Timeout: statepkg.HandoverTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("handover from %s: %s", url, response.Status)
+	}
+
+	var result statepkg.HandoverResult
+	if err := json.NewDecoder(response.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("handover from %s: %s", url, err)
+	}
+	return result.Builds, nil
+}
+
+// @Title handoverHandler
+// @Description Hand the builds in progress over to a new waitron process and shut down
+// @Success 200    {object} state.HandoverResult "The builds in progress"
+// @Failure 401    {object} string "Invalid admin token"
+// @Failure 403    {object} string "No admin_tokens configured"
+// @Router /api/v1/handover [POST]
+func handoverHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+
+	js, err := json.Marshal(statepkg.HandoverResult{Builds: state.ExportBuilds()})
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to export builds", 500)
+		return
+	}
+
+	configpkg.RequestLogger(request).Info("handing over builds", "remote", request.RemoteAddr)
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+
+	state.RequestShutdown("handover to " + request.RemoteAddr)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/state"
+)
+
+func TestHandover(t *testing.T) {
+	config := config.Config{MachinePath: "machines", GroupPath: "groups", AdminTokens: []string{"secret"}}
+
+	old := state.New()
+	m := &machine.Machine{Hostname: "dns02.example.com", Token: "token", Status: "Installing", BuildStart: time.Now()}
+	m.Network = []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}
+	m.Phases = []machine.BuildPhase{{Name: machine.PhaseTokenIssued}}
+	old.Tokens[m.Hostname] = m.Token
+	old.MachineByUUID[m.Token] = m
+	old.MachineByMAC["de:ad:c0:de:ca:fe"] = m
+	old.MachineByHostname[m.Hostname] = m
+	gone := &machine.Machine{Hostname: "gone.example.com", Token: "other", Status: "Installing"}
+	old.MachineByHostname[gone.Hostname] = gone
+
+	server := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		requireAdmin(config, func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			handoverHandler(response, request, ps, config, old)
+		})(response, request, nil)
+	}))
+	defer server.Close()
+
+	if _, err := FetchHandover(server.URL, "wrong"); err == nil {
+		t.Error("expected the handover to need an admin token")
+	}
+	select {
+	case reason := <-old.Shutdown:
+		t.Fatalf("expected a refused handover not to shut down, got %s", reason)
+	default:
+	}
+
+	builds, err := FetchHandover(server.URL, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(builds) != 2 {
+		t.Fatalf("expected both builds, got %+v", builds)
+	}
+	select {
+	case <-old.Shutdown:
+	default:
+		t.Error("expected the old process to be asked to shut down")
+	}
+
+	state := state.New()
+	if imported := state.ImportBuilds(builds, config); imported != 1 {
+		t.Errorf("expected only the build with a definition to be taken over, got %d", imported)
+	}
+	taken := state.MachineByToken("token")
+	if taken == nil {
+		t.Fatal("expected the build to be found by its token")
+	}
+	if taken.Status != "Installing" || len(taken.Phases) != 1 || state.Tokens["dns02.example.com"] != "token" {
+		t.Errorf("unexpected build %+v", taken)
+	}
+	if state.MachineByMAC["de:ad:c0:de:ca:fe"] != taken || state.Version == 0 {
+		t.Error("expected the machine tables to be updated")
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/state"
+)
+
+type readiness struct {
+	State  string
+	Checks map[string]string `json:",omitempty"`
+}
+
+// Parse every template under TemplatePath once so syntax errors surface before
+// an installer asks for them, and so /readyz can report when we're warm.
+func WarmTemplates(config configpkg.Config, state *state.State) {
+	err := configpkg.WalkLocation(config.TemplatePath, func(p string) error {
+		if _, err := configpkg.StorageTemplates.FromFile(p); err != nil {
+			return fmt.Errorf("template %q: %s", p, err)
+		}
+		return nil
+	})
+
+	if err != nil {
+		logger.Error("cannot warm templates", "error", err)
+	}
+
+	state.Mux.Lock()
+	state.TemplatesWarm = true
+	state.TemplatesError = err
+	state.Mux.Unlock()
+}
+
+// The state lock should never be held for long, so if we can't get it quickly
+// something is wedged.
+func checkStateReachable(state *state.State, timeout time.Duration) error {
+	acquired := make(chan struct{})
+	go func() {
+		state.Mux.Lock()
+		state.Mux.Unlock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		return state.Store.Ping()
+	case <-time.After(timeout):
+		return errors.New("timed out waiting for state lock")
+	}
+}
+
+func checkTemplatesWarm(state *state.State) error {
+	state.Mux.Lock()
+	defer state.Mux.Unlock()
+
+	if !state.TemplatesWarm {
+		return errors.New("templates not parsed yet")
+	}
+	return state.TemplatesError
+}
+
+// Run all readiness checks, returning whether all passed and a per-check result.
+func readinessChecks(config configpkg.Config, state *state.State) (bool, map[string]string) {
+	results := make(map[string]string)
+	ready := true
+
+	record := func(name string, err error) {
+		if err != nil {
+			results[name] = err.Error()
+			ready = false
+			return
+		}
+		results[name] = "OK"
+	}
+
+	record("templatepath", configpkg.CheckLocationReadable(config.TemplatePath))
+	if config.ConsulKV != nil {
+		record("consul", config.ConsulKV.Healthy())
+	} else {
+		record("machinepath", configpkg.CheckLocationReadable(config.MachinePath))
+		if config.GroupPath != "" {
+			record("grouppath", configpkg.CheckLocationReadable(config.GroupPath))
+		}
+	}
+	if config.HookPath != "" {
+		record("hookpath", configpkg.CheckPathReadable(config.HookPath))
+	}
+	record("state", checkStateReachable(state, time.Second))
+	record("templates", checkTemplatesWarm(state))
+
+	return ready, results
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestHostHistory(t *testing.T) {
+	state := statepkg.New()
+	config := config.Config{}
+
+	first := machine.Machine{Hostname: "dns02.example.com", Token: "first", Status: "Installing", Network: []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}}
+	first.OperatingSystem = "ubuntu-22.04"
+	if h := state.RecordHistory(&first); h == nil || h.Builds != 1 || h.Entries[0].Status != "Installing" {
+		t.Fatalf("expected the started build in the history, got %+v", h)
+	}
+	first.Retries = 2
+	if err := state.DoneBuildMode(first, config); err != nil {
+		t.Fatal(err)
+	}
+
+	second := machine.Machine{Hostname: "dns02.example.com", Token: "second", Status: "Installing", DefaultProfile: true, Network: first.Network}
+	second.OperatingSystem = "ubuntu-24.04"
+	state.RecordHistory(&second)
+	if err := state.CancelBuildMode(second, config, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := statepkg.LoadHostHistory(state.Store, "dns02.example.com")
+	if err != nil || h == nil {
+		t.Fatalf("expected a history, got %v", err)
+	}
+	if h.Builds != 2 || h.Completed != 1 || h.Cancelled != 1 || h.Retries != 2 || h.LastInstalled.IsZero() {
+		t.Errorf("unexpected counters %+v", h)
+	}
+	if len(h.Entries) != 2 || h.Entries[0].Status != "Installed" || h.Entries[0].OperatingSystem != "ubuntu-22.04" || h.Entries[0].Retries != 2 ||
+		h.Entries[1].Status != "Terminated" || h.Entries[1].Profile != "default" || h.Entries[1].BuildEnd.IsZero() {
+		t.Errorf("unexpected entries %+v", h.Entries)
+	}
+
+	response := httptest.NewRecorder()
+	hostHistoryHandler(response, httptest.NewRequest("GET", "/history/DNS02.example.com", nil),
+		httprouter.Params{{Key: "hostname", Value: "DNS02.example.com"}}, config, state)
+	var served machine.HostHistory
+	if response.Code != 200 || json.Unmarshal(response.Body.Bytes(), &served) != nil || served.Builds != 2 {
+		t.Errorf("unexpected response %d %s", response.Code, response.Body.String())
+	}
+
+	response = httptest.NewRecorder()
+	hostHistoryHandler(response, httptest.NewRequest("GET", "/history/new.example.com", nil),
+		httprouter.Params{{Key: "hostname", Value: "new.example.com"}}, config, state)
+	if response.Code != 404 {
+		t.Errorf("expected 404 for a host never built, got %d", response.Code)
+	}
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestHostIdentity(t *testing.T) {
+	state := statepkg.New()
+	build := func() *machine.Machine {
+		m := machine.Machine{Hostname: "dns02.example.com", Network: []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}}
+		token, err := state.SetBuildMode(m, config.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return state.MachineByToken(token)
+	}
+	params := httprouter.Params{{Key: "hostname", Value: "dns02.example.com"}}
+
+	m := build()
+	if len(m.HostKey) != 2*statepkg.HostKeyBytes {
+		t.Fatalf("expected the build to get a host key, got %q", m.HostKey)
+	}
+
+	for _, key := range []string{"", m.Token, "wrong"} {
+		request := httptest.NewRequest("POST", "/done/dns02.example.com", nil)
+		if key != "" {
+			request.Header.Set("Authorization", "Bearer "+key)
+		}
+		response := httptest.NewRecorder()
+		doneHandler(response, request, params, config.Config{}, state)
+		if response.Code != 401 {
+			t.Errorf("expected /done with %q to be refused, got %d", key, response.Code)
+		}
+	}
+
+	request := httptest.NewRequest("POST", "/done/dns02.example.com", nil)
+	request.Header.Set("Authorization", "Bearer "+m.HostKey)
+	response := httptest.NewRecorder()
+	doneHandler(response, request, params, config.Config{}, state)
+	if response.Code != 200 || state.MachineByToken(m.Token) != nil {
+		t.Errorf("expected the host key to complete the build, got %d %s", response.Code, response.Body.String())
+	}
+
+	m = build()
+	certFor := func(name string) *tls.ConnectionState {
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: "host"}, DNSNames: []string{name}}
+		return &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+	}
+	request = httptest.NewRequest("POST", "/cancel/dns02.example.com", nil)
+	request.TLS = certFor("dns03.example.com")
+	response = httptest.NewRecorder()
+	cancelHandler(response, request, params, config.Config{}, state)
+	if response.Code != 401 {
+		t.Errorf("expected a certificate for another host to be refused, got %d", response.Code)
+	}
+
+	request.TLS = certFor("DNS02.example.com")
+	response = httptest.NewRecorder()
+	cancelHandler(response, request, params, config.Config{}, state)
+	if response.Code != 200 || state.MachineByToken(m.Token) != nil {
+		t.Errorf("expected the client certificate to cancel the build, got %d %s", response.Code, response.Body.String())
+	}
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func imageServer(t *testing.T, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		if r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("kernel"))
+	}))
+}
+
+func imageDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "waitron-images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestImageHandler(t *testing.T) {
+	var hits int32
+	server := imageServer(t, &hits)
+	defer server.Close()
+	dir := imageDir(t)
+	defer os.RemoveAll(dir)
+
+	config := config.Config{ImagePath: dir, Images: []config.BootImage{{Name: "linux", URL: server.URL}}}
+	state := statepkg.New()
+	state.Images, _ = statepkg.NewImageCatalog(config)
+
+	serve := func(name string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/images/"+name, nil)
+		imageHandler(response, request, httprouter.Params{{Key: "name", Value: name}}, config, state)
+		return response
+	}
+
+	if response := serve("linux"); response.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected 503 before the sync, got %d", response.Code)
+	}
+
+	state.Images.Sync("linux")
+	if response := serve("linux"); response.Code != http.StatusOK || response.Body.String() != "kernel" {
+		t.Errorf("unexpected response %d %q", response.Code, response.Body.String())
+	}
+	if response := serve("other"); response.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown image, got %d", response.Code)
+	}
+}
@@ -0,0 +1,51 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/state"
+)
+
+func testInventory() *machine.Inventory {
+	inv := machine.NewInventory(config.Config{})
+	inv.Set([]string{"db01.example.com.yaml", "web01.example.com.yaml", "web02.example.com.yaml"},
+		map[string]*machine.InventoryEntry{
+			"db01.example.com": {Hostname: "db01.example.com", File: "db01.example.com.yaml",
+				MACs: []string{"de:ad:c0:de:00:01"}, Labels: map[string]string{"role": "db", "rack": "r1"}},
+			"web01.example.com": {Hostname: "web01.example.com", File: "web01.example.com.yaml",
+				MACs: []string{"de:ad:c0:de:00:02"}, Labels: map[string]string{"role": "web", "rack": "r1"}},
+			"web02.example.com": {Hostname: "web02.example.com", File: "web02.example.com.yaml",
+				Labels: map[string]string{"role": "web"}},
+		})
+	return inv
+}
+
+func TestListMachinesSelector(t *testing.T) {
+	state := state.New()
+	state.Inventory = testInventory()
+
+	response := httptest.NewRecorder()
+	listMachinesHandler(response, httptest.NewRequest("GET", "/list?selector=role%3Dweb", nil), nil, config.Config{}, state)
+	if body := response.Body.String(); body != `["web01.example.com.yaml","web02.example.com.yaml"]` {
+		t.Errorf("unexpected list %s", body)
+	}
+
+	response = httptest.NewRecorder()
+	listMachinesHandler(response, httptest.NewRequest("GET", "/list?selector=%3Dweb", nil), nil, config.Config{}, state)
+	if response.Code != http.StatusBadRequest {
+		t.Errorf("expected 400 for an invalid selector, got %d", response.Code)
+	}
+
+	response = httptest.NewRecorder()
+	inventoryHandler(response, httptest.NewRequest("GET", "/api/v1/inventory?mac=de:ad:c0:de:00:01", nil), nil, config.Config{}, state)
+	var entries []machine.InventoryEntry
+	json.Unmarshal(response.Body.Bytes(), &entries)
+	if len(entries) != 1 || entries[0].Hostname != "db01.example.com" {
+		t.Errorf("unexpected entries %s", response.Body.String())
+	}
+}
@@ -0,0 +1,61 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+// @Title ipamHandler
+// @Description Address pools with their size, usage and allocations
+// @Success 200 {array} state.IPPoolUsage "The pools"
+// @Failure 500 {object} string "Unable to read allocations"
+// @Router /ipam [GET]
+func ipamHandler(response http.ResponseWriter, request *http.Request,
+	_ httprouter.Params, config config.Config, state *statepkg.State) {
+	usage := []statepkg.IPPoolUsage{}
+	if state.IPAM != nil {
+		var err error
+		if usage, err = state.IPAM.Usage(); err != nil {
+			logRequest(request, err)
+			httpError(response, request, "Unable to read allocations", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	js, _ := json.Marshal(usage)
+	writeJSONWithETag(response, request, js)
+}
+
+// @Title ipamReleaseHandler
+// @Description Give an address kept for a machine back to its pool
+// @Param pool     path  string  true  "Pool name"
+// @Param address  path  string  true  "The address"
+// @Success 200 {object} string "{"State": "OK"}"
+// @Failure 404 {object} string "Address not allocated"
+// @Failure 500 {object} string "Unable to release address"
+// @Router /api/v1/ipam/{pool}/{address} [DELETE]
+func ipamReleaseHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config config.Config, state *statepkg.State) {
+	if state.IPAM == nil {
+		httpError(response, request, "Address not allocated", http.StatusNotFound)
+		return
+	}
+	released, err := state.IPAM.Release(ps.ByName("pool"), ps.ByName("address"))
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to release address", http.StatusInternalServerError)
+		return
+	}
+	if !released {
+		httpError(response, request, "Address not allocated", http.StatusNotFound)
+		return
+	}
+
+	js, _ := json.Marshal(Result{State: "OK"})
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestIPAMHandlers(t *testing.T) {
+	state := statepkg.New()
+	response := httptest.NewRecorder()
+	ipamHandler(response, httptest.NewRequest("GET", "/ipam", nil), nil, config.Config{}, state)
+	if response.Body.String() != "[]" {
+		t.Errorf("expected no pools, got %s", response.Body.String())
+	}
+
+	state.IPAM, _ = statepkg.NewIPAM(config.IPAMConfig{Pools: []config.IPPoolConfig{{Name: "prod", Subnet: "192.0.2.0/29"}}}, state.Store)
+	m := &machine.Machine{Hostname: "node01.example.com", Network: []machine.Interface{{Name: "eth0", IP: statepkg.IPAuto}}}
+	state.AllocateAddresses(m)
+	state.KeepAddresses(m)
+
+	response = httptest.NewRecorder()
+	ipamHandler(response, httptest.NewRequest("GET", "/ipam", nil), nil, config.Config{}, state)
+	var usage []statepkg.IPPoolUsage
+	json.Unmarshal(response.Body.Bytes(), &usage)
+	if len(usage) != 1 || usage[0].Size != 6 || usage[0].Used != 1 || usage[0].Allocations[0].IPAddress != "192.0.2.1" {
+		t.Errorf("unexpected usage %s", response.Body.String())
+	}
+
+	release := func(address string) int {
+		response := httptest.NewRecorder()
+		ipamReleaseHandler(response, httptest.NewRequest("DELETE", "/api/v1/ipam/prod/"+address, nil),
+			httprouter.Params{{Key: "pool", Value: "prod"}, {Key: "address", Value: address}}, config.Config{}, state)
+		return response.Code
+	}
+	if code := release("192.0.2.1"); code != http.StatusOK {
+		t.Errorf("expected the address to be released, got %d", code)
+	}
+	if code := release("192.0.2.1"); code != http.StatusNotFound {
+		t.Errorf("expected an address that isn't allocated to be 404, got %d", code)
+	}
+}
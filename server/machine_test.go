@@ -0,0 +1,33 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ns1/waitron/machine"
+)
+
+func TestExtraCmdline(t *testing.T) {
+	for extra, expected := range map[string]string{
+		"":                       "console=tty0 auto=true",
+		"debug":                  "console=tty0 auto=true debug",
+		"console=ttyS1,115200n8": "console=ttyS1,115200n8 auto=true",
+		"mirror/http/proxy=http://proxy:3128 auto=false": "console=tty0 auto=false mirror/http/proxy=http://proxy:3128",
+	} {
+		m := machine.Machine{ExtraCmdline: extra}
+		m.Cmdline = "console=tty0 auto=true"
+		pixie, err := m.PixieInit()
+		if err != nil || pixie.Cmdline != expected {
+			t.Errorf("expected %q with %q, got %q %v", expected, extra, pixie.Cmdline, err)
+		}
+	}
+
+	request := httptest.NewRequest("PUT", "/build/dns02.example.com?cmdline=debug&cmdline=+console%3DttyS1++", nil)
+	if extra, err := requestCmdline(request); err != nil || extra != "debug console=ttyS1" {
+		t.Errorf("unexpected cmdline %q %v", extra, err)
+	}
+	request = httptest.NewRequest("PUT", "/build/dns02.example.com?cmdline=debug%0Ainit%3D/bin/sh", nil)
+	if _, err := requestCmdline(request); err == nil {
+		t.Error("expected a cmdline with a newline to be refused")
+	}
+}
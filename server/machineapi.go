@@ -0,0 +1,554 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+	"gopkg.in/yaml.v2"
+)
+
+// /api/v2/machines manages machine definition files for tools such as a
+// Terraform provider. Unlike the rest of the API its schema is stable:
+// fields are snake_case and always present, strings are never null, maps
+// are {} and lists [] when empty, and errors are JSON with a code to act on.
+// A machine is its definition file alone, what groups and the config add is
+// not part of it. Every machine has a resource_version, also its ETag, which
+// PUT and DELETE check against If-Match (or resource_version in the body)
+// when one is given, answering 412 when the file changed since.
+//
+// Only definitions in a local machinepath can be written. Keys of the file
+// the schema doesn't cover, such as hooks, are kept on updates, and the
+// result has to match the machine definition schema, see config/schema.go.
+
+// apiMachine is a machine definition file as /api/v2 sees it
+type apiMachine struct {
+	Hostname        string            `json:"hostname"`
+	OperatingSystem string            `json:"operating_system"`
+	Preseed         string            `json:"preseed"`
+	Finish          string            `json:"finish"`
+	ImageURL        string            `json:"image_url"`
+	Kernel          string            `json:"kernel"`
+	Initrd          string            `json:"initrd"`
+	Cmdline         string            `json:"cmdline"`
+	Params          map[string]string `json:"params"`
+	Labels          map[string]string `json:"labels"`
+	Network         []apiInterface    `json:"network"`
+	ResourceVersion string            `json:"resource_version"`
+}
+
+type apiInterface struct {
+	Name        string       `json:"name"`
+	MACAddress  string       `json:"mac_address"`
+	Addresses4  []apiAddress `json:"addresses4"`
+	Addresses6  []apiAddress `json:"addresses6"`
+	Gateway4    string       `json:"gateway4"`
+	Gateway6    string       `json:"gateway6"`
+	IP          string       `json:"ip"`
+	Pool        string       `json:"pool"`
+	DHCP4       bool         `json:"dhcp4"`
+	DHCP6       bool         `json:"dhcp6"`
+	AcceptRA    *bool        `json:"accept_ra"`
+	Nameservers []string     `json:"nameservers"`
+	Resolve     bool         `json:"resolve"`
+}
+
+type apiAddress struct {
+	IPAddress string `json:"ip_address"`
+	Netmask   string `json:"netmask"`
+	CIDR      string `json:"cidr"`
+}
+
+// Codes in apiError
+const (
+	apiErrorInvalid         = "invalid"
+	apiErrorNotFound        = "not_found"
+	apiErrorConflict        = "already_exists"
+	apiErrorVersionMismatch = "version_mismatch"
+	apiErrorReadOnly        = "read_only"
+	apiErrorInternal        = "internal"
+)
+
+type apiError struct {
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+func apiErrorResponse(response http.ResponseWriter, request *http.Request, code string, message string, status int) {
+	js, _ := json.Marshal(apiError{Error: message, Code: code, RequestID: configpkg.RequestID(request)})
+	response.Header().Set("content-type", "application/json")
+	response.WriteHeader(status)
+	response.Write(js)
+}
+
+func writeAPIMachine(response http.ResponseWriter, m apiMachine, status int) {
+	js, _ := json.Marshal(m)
+	response.Header().Set("content-type", "application/json")
+	response.Header().Set("ETag", `"`+m.ResourceVersion+`"`)
+	response.WriteHeader(status)
+	response.Write(js)
+}
+
+// The definition file of hostname, the .yaml one when it doesn't exist yet
+func machineFile(machinePath string, hostname string) (string, []byte, error) {
+	file := filepath.Join(machinePath, hostname+".yaml")
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		if yml, ymlErr := ioutil.ReadFile(filepath.Join(machinePath, hostname+".yml")); ymlErr == nil {
+			return filepath.Join(machinePath, hostname+".yml"), yml, nil
+		}
+	}
+	return file, data, err
+}
+
+func resourceVersion(data []byte) string {
+	return strings.Trim(bodyETag(data), `"`)
+}
+
+// Why machine definitions can't be written, nil when they can
+func definitionsReadOnly(config configpkg.Config, state *statepkg.State) error {
+	switch {
+	case config.ConsulKV != nil:
+		return fmt.Errorf("machine definitions come from consul")
+	case state.Repo != nil:
+		return fmt.Errorf("machine definitions come from git")
+	case configpkg.IsRemote(config.MachinePath):
+		return fmt.Errorf("machine definitions come from %s", config.MachinePath)
+	}
+	return nil
+}
+
+func newAPIMachine(hostname string, data []byte) (apiMachine, error) {
+	var m machine.Machine
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		return apiMachine{}, err
+	}
+	a := apiMachine{
+		Hostname:        hostname,
+		OperatingSystem: m.OperatingSystem,
+		Preseed:         m.Preseed,
+		Finish:          m.Finish,
+		ImageURL:        m.ImageURL,
+		Kernel:          m.Kernel,
+		Initrd:          m.Initrd,
+		Cmdline:         m.Cmdline,
+		Params:          m.Params,
+		Labels:          m.Labels,
+		Network:         newAPIInterfaces(m.Network),
+		ResourceVersion: resourceVersion(data),
+	}
+	if a.Params == nil {
+		a.Params = map[string]string{}
+	}
+	if a.Labels == nil {
+		a.Labels = map[string]string{}
+	}
+	return a, nil
+}
+
+func newAPIInterfaces(network []machine.Interface) []apiInterface {
+	addresses := func(ips []machine.IPConfig) []apiAddress {
+		list := []apiAddress{}
+		for _, ip := range ips {
+			list = append(list, apiAddress{IPAddress: ip.IPAddress, Netmask: ip.Netmask, CIDR: ip.Cidr})
+		}
+		return list
+	}
+	interfaces := []apiInterface{}
+	for _, i := range network {
+		interfaces = append(interfaces, apiInterface{
+			Name:        i.Name,
+			MACAddress:  i.MacAddress,
+			Addresses4:  addresses(i.Addresses4),
+			Addresses6:  addresses(i.Addresses6),
+			Gateway4:    i.Gateway4,
+			Gateway6:    i.Gateway6,
+			IP:          i.IP,
+			Pool:        i.Pool,
+			DHCP4:       i.DHCP4,
+			DHCP6:       i.DHCP6,
+			AcceptRA:    i.AcceptRA,
+			Nameservers: i.Nameservers,
+			Resolve:     i.Resolve,
+		})
+	}
+	return interfaces
+}
+
+// The first problem with a, "" when there is none
+func (a apiMachine) invalid() string {
+	if !statepkg.ValidHostname.MatchString(a.Hostname) {
+		return fmt.Sprintf("invalid hostname %q", a.Hostname)
+	}
+	for n, i := range a.Network {
+		if i.MACAddress != "" {
+			if _, err := net.ParseMAC(i.MACAddress); err != nil {
+				return fmt.Sprintf("network[%d].mac_address: %s", n, err)
+			}
+		}
+		if i.IP != "" && i.IP != statepkg.IPAuto {
+			return fmt.Sprintf("network[%d].ip: must be empty or %s", n, statepkg.IPAuto)
+		}
+		for _, ip := range append(append([]string{i.Gateway4, i.Gateway6}, i.Nameservers...), apiIPs(i.Addresses4, i.Addresses6)...) {
+			if ip != "" && net.ParseIP(strings.SplitN(ip, "/", 2)[0]) == nil {
+				return fmt.Sprintf("network[%d]: invalid address %q", n, ip)
+			}
+		}
+	}
+	return ""
+}
+
+func apiIPs(lists ...[]apiAddress) []string {
+	var ips []string
+	for _, list := range lists {
+		for _, a := range list {
+			ips = append(ips, a.IPAddress)
+		}
+	}
+	return ips
+}
+
+// The definition file for a, keeping whatever the schema doesn't cover from
+// the previous one
+func (a apiMachine) definition(previous []byte) ([]byte, error) {
+	d := make(map[string]interface{})
+	if err := yaml.Unmarshal(previous, &d); err != nil {
+		return nil, err
+	}
+	set := func(key string, value interface{}, empty bool) {
+		if empty {
+			delete(d, key) // the group or the config decide
+		} else {
+			d[key] = value
+		}
+	}
+	set("operatingsystem", a.OperatingSystem, a.OperatingSystem == "")
+	set("preseed", a.Preseed, a.Preseed == "")
+	set("finish", a.Finish, a.Finish == "")
+	set("image_url", a.ImageURL, a.ImageURL == "")
+	set("kernel", a.Kernel, a.Kernel == "")
+	set("initrd", a.Initrd, a.Initrd == "")
+	set("cmdline", a.Cmdline, a.Cmdline == "")
+	set("params", a.Params, len(a.Params) == 0)
+	set("labels", a.Labels, len(a.Labels) == 0)
+
+	var network []machine.Interface
+	ipConfigs := func(list []apiAddress) []machine.IPConfig {
+		var ips []machine.IPConfig
+		for _, ip := range list {
+			ips = append(ips, machine.IPConfig{IPAddress: ip.IPAddress, Netmask: ip.Netmask, Cidr: ip.CIDR})
+		}
+		return ips
+	}
+	for _, i := range a.Network {
+		network = append(network, machine.Interface{
+			Name:        i.Name,
+			MacAddress:  i.MACAddress,
+			Addresses4:  ipConfigs(i.Addresses4),
+			Addresses6:  ipConfigs(i.Addresses6),
+			Gateway4:    i.Gateway4,
+			Gateway6:    i.Gateway6,
+			IP:          i.IP,
+			Pool:        i.Pool,
+			DHCP4:       i.DHCP4,
+			DHCP6:       i.DHCP6,
+			AcceptRA:    i.AcceptRA,
+			Nameservers: i.Nameservers,
+			Resolve:     i.Resolve,
+		})
+	}
+	set("network", network, len(network) == 0)
+
+	return yaml.Marshal(d)
+}
+
+// Replace file with data in one step
+func writeDefinition(file string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), ".waitron-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// Whether the version the client expects, from If-Match or the body, is
+// current. No expectation matches anything.
+func versionMatches(request *http.Request, body string, current string) bool {
+	expected := strings.Trim(strings.TrimPrefix(request.Header.Get("If-Match"), "W/"), `"`)
+	if expected == "" {
+		expected = body
+	}
+	return expected == "" || expected == "*" || expected == current
+}
+
+func decodeAPIMachine(request *http.Request) (apiMachine, error) {
+	var a apiMachine
+	decoder := json.NewDecoder(request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&a); err != nil {
+		return a, err
+	}
+	a.Hostname = strings.ToLower(a.Hostname)
+	return a, nil
+}
+
+// @Title apiListMachinesHandler
+// @Description Machine definition files in the stable v2 schema
+// @Success 200 {array} apiMachine "Machines, sorted by hostname"
+// @Failure 500 {object} apiError "Unable to list machines"
+// @Router /api/v2/machines [GET]
+func apiListMachinesHandler(response http.ResponseWriter, request *http.Request,
+	_ httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	inv, err := state.InventoryFor(config)
+	if err != nil {
+		logRequest(request, err)
+		apiErrorResponse(response, request, apiErrorInternal, "Unable to list machines", http.StatusInternalServerError)
+		return
+	}
+
+	machines := []apiMachine{}
+	seen := make(map[string]bool)
+	for _, name := range inv.List() {
+		hostname := strings.ToLower(strings.TrimSuffix(name, filepath.Ext(name)))
+		if seen[hostname] {
+			continue
+		}
+		seen[hostname] = true
+		data, err := machine.ReadMachineDefinition(hostname, config.MachinePath, config)
+		if err != nil {
+			continue // removed since the index was refreshed
+		}
+		a, err := newAPIMachine(hostname, data)
+		if err != nil {
+			logRequest(request, err)
+			continue
+		}
+		machines = append(machines, a)
+	}
+
+	js, _ := json.Marshal(machines)
+	writeJSONWithETag(response, request, js)
+}
+
+// @Title apiGetMachineHandler
+// @Description A machine definition file, also for importing it by hostname
+// @Param hostname  path  string  true  "Hostname"
+// @Success 200 {object} apiMachine "The machine, with its resource_version as ETag"
+// @Failure 404 {object} apiError "No definition for hostname"
+// @Failure 500 {object} apiError "Unable to read the definition"
+// @Router /api/v2/machines/{hostname} [GET]
+func apiGetMachineHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := strings.ToLower(ps.ByName("hostname"))
+
+	data, err := machine.ReadMachineDefinition(hostname, config.MachinePath, config)
+	if os.IsNotExist(err) {
+		apiErrorResponse(response, request, apiErrorNotFound, fmt.Sprintf("No definition for %s", hostname), http.StatusNotFound)
+		return
+	}
+	var a apiMachine
+	if err == nil {
+		a, err = newAPIMachine(hostname, data)
+	}
+	if err != nil {
+		logRequest(request, err)
+		apiErrorResponse(response, request, apiErrorInternal, "Unable to read the definition", http.StatusInternalServerError)
+		return
+	}
+
+	if checkNotModified(response, request, `"`+a.ResourceVersion+`"`) {
+		return
+	}
+	writeAPIMachine(response, a, http.StatusOK)
+}
+
+// @Title apiCreateMachineHandler
+// @Description Write the definition file of a new machine
+// @Param body  body  apiMachine  true  "The machine"
+// @Success 201 {object} apiMachine "The machine as written"
+// @Failure 400 {object} apiError "Invalid machine"
+// @Failure 409 {object} apiError "The machine already exists"
+// @Failure 501 {object} apiError "Machine definitions are read-only"
+// @Router /api/v2/machines [POST]
+func apiCreateMachineHandler(response http.ResponseWriter, request *http.Request,
+	_ httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	if err := definitionsReadOnly(config, state); err != nil {
+		apiErrorResponse(response, request, apiErrorReadOnly, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	a, err := decodeAPIMachine(request)
+	if err != nil {
+		apiErrorResponse(response, request, apiErrorInvalid, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if problem := a.invalid(); problem != "" {
+		apiErrorResponse(response, request, apiErrorInvalid, problem, http.StatusBadRequest)
+		return
+	}
+
+	state.DefinitionsMux.Lock()
+	defer state.DefinitionsMux.Unlock()
+
+	file, _, err := machineFile(config.MachinePath, a.Hostname)
+	if err == nil {
+		apiErrorResponse(response, request, apiErrorConflict, fmt.Sprintf("%s already exists", a.Hostname), http.StatusConflict)
+		return
+	}
+	data, err := a.definition(nil)
+	if err == nil {
+		if problems, _ := machine.ValidateDefinition(machine.MachineSchema, data); len(problems) > 0 {
+			apiErrorResponse(response, request, apiErrorInvalid, strings.Join(problems, "; "), http.StatusBadRequest)
+			return
+		}
+		err = writeDefinition(file, data)
+	}
+	if err != nil {
+		logRequest(request, err)
+		apiErrorResponse(response, request, apiErrorInternal, "Unable to write the definition", http.StatusInternalServerError)
+		return
+	}
+	configpkg.RequestLogger(request).Info("machine definition created", "hostname", a.Hostname)
+	state.DefinitionChanged(a.Hostname)
+
+	created, _ := newAPIMachine(a.Hostname, data)
+	response.Header().Set("Location", "/api/v2/machines/"+a.Hostname)
+	writeAPIMachine(response, created, http.StatusCreated)
+}
+
+// @Title apiUpdateMachineHandler
+// @Description Replace what the schema covers in a machine definition file
+// @Param hostname  path    string      true   "Hostname"
+// @Param If-Match  header  string      false  "The resource_version the change is based on"
+// @Param body      body    apiMachine  true   "The machine"
+// @Success 200 {object} apiMachine "The machine as written"
+// @Failure 400 {object} apiError "Invalid machine"
+// @Failure 404 {object} apiError "No definition for hostname"
+// @Failure 412 {object} apiError "The definition changed since resource_version"
+// @Failure 501 {object} apiError "Machine definitions are read-only"
+// @Router /api/v2/machines/{hostname} [PUT]
+func apiUpdateMachineHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := strings.ToLower(ps.ByName("hostname"))
+	if err := definitionsReadOnly(config, state); err != nil {
+		apiErrorResponse(response, request, apiErrorReadOnly, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	a, err := decodeAPIMachine(request)
+	if err != nil {
+		apiErrorResponse(response, request, apiErrorInvalid, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if a.Hostname == "" {
+		a.Hostname = hostname
+	}
+	if a.Hostname != hostname {
+		apiErrorResponse(response, request, apiErrorInvalid, "hostname can't be changed", http.StatusBadRequest)
+		return
+	}
+	if problem := a.invalid(); problem != "" {
+		apiErrorResponse(response, request, apiErrorInvalid, problem, http.StatusBadRequest)
+		return
+	}
+
+	state.DefinitionsMux.Lock()
+	defer state.DefinitionsMux.Unlock()
+
+	file, previous, err := machineFile(config.MachinePath, hostname)
+	if os.IsNotExist(err) {
+		apiErrorResponse(response, request, apiErrorNotFound, fmt.Sprintf("No definition for %s", hostname), http.StatusNotFound)
+		return
+	}
+	if err == nil && !versionMatches(request, a.ResourceVersion, resourceVersion(previous)) {
+		apiErrorResponse(response, request, apiErrorVersionMismatch, fmt.Sprintf("%s changed since that version", hostname), http.StatusPreconditionFailed)
+		return
+	}
+	var data []byte
+	if err == nil {
+		data, err = a.definition(previous)
+	}
+	if err == nil {
+		if problems, _ := machine.ValidateDefinition(machine.MachineSchema, data); len(problems) > 0 {
+			apiErrorResponse(response, request, apiErrorInvalid, strings.Join(problems, "; "), http.StatusBadRequest)
+			return
+		}
+		err = writeDefinition(file, data)
+	}
+	if err != nil {
+		logRequest(request, err)
+		apiErrorResponse(response, request, apiErrorInternal, "Unable to write the definition", http.StatusInternalServerError)
+		return
+	}
+	configpkg.RequestLogger(request).Info("machine definition updated", "hostname", hostname)
+	state.DefinitionChanged(hostname)
+
+	updated, _ := newAPIMachine(hostname, data)
+	writeAPIMachine(response, updated, http.StatusOK)
+}
+
+// @Title apiDeleteMachineHandler
+// @Description Remove a machine definition file
+// @Param hostname  path    string  true   "Hostname"
+// @Param If-Match  header  string  false  "The resource_version the removal is based on"
+// @Success 204 {object} string "Removed"
+// @Failure 404 {object} apiError "No definition for hostname"
+// @Failure 412 {object} apiError "The definition changed since resource_version"
+// @Failure 501 {object} apiError "Machine definitions are read-only"
+// @Router /api/v2/machines/{hostname} [DELETE]
+func apiDeleteMachineHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := strings.ToLower(ps.ByName("hostname"))
+	if err := definitionsReadOnly(config, state); err != nil {
+		apiErrorResponse(response, request, apiErrorReadOnly, err.Error(), http.StatusNotImplemented)
+		return
+	}
+	if !statepkg.ValidHostname.MatchString(hostname) {
+		apiErrorResponse(response, request, apiErrorInvalid, fmt.Sprintf("invalid hostname %q", hostname), http.StatusBadRequest)
+		return
+	}
+
+	state.DefinitionsMux.Lock()
+	defer state.DefinitionsMux.Unlock()
+
+	file, previous, err := machineFile(config.MachinePath, hostname)
+	if os.IsNotExist(err) {
+		apiErrorResponse(response, request, apiErrorNotFound, fmt.Sprintf("No definition for %s", hostname), http.StatusNotFound)
+		return
+	}
+	if err == nil && !versionMatches(request, "", resourceVersion(previous)) {
+		apiErrorResponse(response, request, apiErrorVersionMismatch, fmt.Sprintf("%s changed since that version", hostname), http.StatusPreconditionFailed)
+		return
+	}
+	if err == nil {
+		err = os.Remove(file)
+	}
+	if err != nil {
+		logRequest(request, err)
+		apiErrorResponse(response, request, apiErrorInternal, "Unable to remove the definition", http.StatusInternalServerError)
+		return
+	}
+	configpkg.RequestLogger(request).Info("machine definition removed", "hostname", hostname)
+	state.DefinitionChanged(hostname)
+
+	response.WriteHeader(http.StatusNoContent)
+}
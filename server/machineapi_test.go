@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+	"gopkg.in/yaml.v2"
+)
+
+func TestMachineAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := configpkg.Config{MachinePath: dir, GroupPath: dir}
+	state := statepkg.New()
+	host := httprouter.Params{httprouter.Param{Key: "hostname", Value: "node01.example.com"}}
+
+	call := func(handler func(http.ResponseWriter, *http.Request, httprouter.Params, configpkg.Config, *statepkg.State),
+		method string, body string, ps httprouter.Params, header ...string) (*httptest.ResponseRecorder, apiMachine) {
+		request := httptest.NewRequest(method, "/api/v2/machines", strings.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			request.Header.Set(header[i], header[i+1])
+		}
+		response := httptest.NewRecorder()
+		handler(response, request, ps, config, state)
+		var a apiMachine
+		json.Unmarshal(response.Body.Bytes(), &a)
+		return response, a
+	}
+	code := func(response *httptest.ResponseRecorder) string {
+		var e apiError
+		json.Unmarshal(response.Body.Bytes(), &e)
+		return e.Code
+	}
+
+	response, _ := call(apiGetMachineHandler, "GET", "", host)
+	if response.Code != http.StatusNotFound || code(response) != apiErrorNotFound {
+		t.Errorf("expected not_found, got %d %s", response.Code, response.Body.String())
+	}
+
+	created := `{"hostname": "node01.example.com", "operating_system": "debian",
+		"network": [{"name": "eth0", "mac_address": "de:ad:be:ef:00:01", "addresses4": [{"ip_address": "192.0.2.1", "cidr": "24"}]}]}`
+	response, a := call(apiCreateMachineHandler, "POST", created, nil)
+	if response.Code != http.StatusCreated || a.ResourceVersion == "" || response.Header().Get("ETag") != `"`+a.ResourceVersion+`"` {
+		t.Fatalf("expected the machine to be created, got %d %s", response.Code, response.Body.String())
+	}
+	first := a.ResourceVersion
+
+	response, _ = call(apiCreateMachineHandler, "POST", created, nil)
+	if response.Code != http.StatusConflict || code(response) != apiErrorConflict {
+		t.Errorf("expected already_exists, got %d %s", response.Code, response.Body.String())
+	}
+
+	// Everything is there with a stable type, empty or not
+	response, a = call(apiGetMachineHandler, "GET", "", host)
+	var raw map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &raw)
+	if _, ok := raw["params"].(map[string]interface{}); !ok || raw["preseed"] != "" {
+		t.Errorf("expected empty values rather than nulls, got %s", response.Body.String())
+	}
+	if a.OperatingSystem != "debian" || len(a.Network) != 1 || a.Network[0].MACAddress != "de:ad:be:ef:00:01" ||
+		a.Network[0].Addresses4[0].IPAddress != "192.0.2.1" || a.ResourceVersion != first {
+		t.Errorf("unexpected machine %+v", a)
+	}
+	if m, err := machine.MachineDefinition("node01.example.com", dir, config); err != nil || m.OperatingSystem != "debian" || m.Network[0].MacAddress != "de:ad:be:ef:00:01" {
+		t.Errorf("expected the file to be a machine definition, got %+v, %v", m, err)
+	}
+
+	updated := `{"operating_system": "ubuntu", "params": {"role": "web"}}`
+	response, a = call(apiUpdateMachineHandler, "PUT", updated, host, "If-Match", `"`+first+`"`)
+	if response.Code != http.StatusOK || a.OperatingSystem != "ubuntu" || a.Params["role"] != "web" || len(a.Network) != 0 || a.ResourceVersion == first {
+		t.Fatalf("expected the machine to be updated, got %d %s", response.Code, response.Body.String())
+	}
+
+	// Changes based on an old version are refused
+	response, _ = call(apiUpdateMachineHandler, "PUT", `{"resource_version": "`+first+`"}`, host)
+	if response.Code != http.StatusPreconditionFailed || code(response) != apiErrorVersionMismatch {
+		t.Errorf("expected version_mismatch, got %d %s", response.Code, response.Body.String())
+	}
+	response, _ = call(apiDeleteMachineHandler, "DELETE", "", host, "If-Match", `"`+first+`"`)
+	if response.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected a stale delete to be refused, got %d", response.Code)
+	}
+
+	for _, body := range []string{
+		`{"operating_system": "debian", "typo": true}`,
+		`{"network": [{"mac_address": "not a mac"}]}`,
+		`{"hostname": "node02.example.com"}`,
+	} {
+		if response, _ := call(apiUpdateMachineHandler, "PUT", body, host); response.Code != http.StatusBadRequest || code(response) != apiErrorInvalid {
+			t.Errorf("%s: expected invalid, got %d %s", body, response.Code, response.Body.String())
+		}
+	}
+	if response, _ := call(apiCreateMachineHandler, "POST", `{"hostname": "compute-*.example.com"}`, nil); response.Code != http.StatusBadRequest {
+		t.Errorf("expected a pattern not to be created, got %d", response.Code)
+	}
+
+	response, _ = call(apiListMachinesHandler, "GET", "", nil)
+	var list []apiMachine
+	json.Unmarshal(response.Body.Bytes(), &list)
+	if len(list) != 1 || list[0].Hostname != "node01.example.com" {
+		t.Errorf("unexpected list %s", response.Body.String())
+	}
+
+	response, _ = call(apiDeleteMachineHandler, "DELETE", "", host, "If-Match", `"`+a.ResourceVersion+`"`)
+	if response.Code != http.StatusNoContent {
+		t.Errorf("expected the machine to be removed, got %d %s", response.Code, response.Body.String())
+	}
+	if _, err := os.Stat(filepath.Join(dir, "node01.example.com.yaml")); !os.IsNotExist(err) {
+		t.Error("expected the file to be gone")
+	}
+	if response, _ := call(apiDeleteMachineHandler, "DELETE", "", host); response.Code != http.StatusNotFound {
+		t.Errorf("expected not_found, got %d", response.Code)
+	}
+
+	config.MachinePath = "https://example.com/machines"
+	if response, _ := call(apiCreateMachineHandler, "POST", created, nil); response.Code != http.StatusNotImplemented || code(response) != apiErrorReadOnly {
+		t.Errorf("expected read_only, got %d %s", response.Code, response.Body.String())
+	}
+}
+
+// Keys the schema doesn't cover survive an update
+func TestMachineAPIKeepsOtherKeys(t *testing.T) {
+	a := apiMachine{Hostname: "node01.example.com", OperatingSystem: "ubuntu"}
+	data, err := a.definition([]byte(`{"operatingsystem": "debian", "preseed": "old.j2", "hooks": {"done": [{"name": "notify.sh"}]}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m machine.Machine
+	if err := yaml.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if m.OperatingSystem != "ubuntu" || m.Preseed != "" || len(m.Hooks["done"]) != 1 {
+		t.Errorf("unexpected definition %s", data)
+	}
+}
+
+// Keys kept from the file still have to match the definition schema
+func TestMachineAPIRefusesSchemaProblems(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-api")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "node01.example.com.yaml"), []byte(`{"operatingsystem": "debian", "stale_build_threshold_sec": 600}`), 0644)
+
+	request := httptest.NewRequest("PUT", "/api/v2/machines/node01.example.com", strings.NewReader(`{"operating_system": "ubuntu"}`))
+	response := httptest.NewRecorder()
+	apiUpdateMachineHandler(response, request, httprouter.Params{httprouter.Param{Key: "hostname", Value: "node01.example.com"}},
+		configpkg.Config{MachinePath: dir, GroupPath: dir}, statepkg.New())
+	var e apiError
+	json.Unmarshal(response.Body.Bytes(), &e)
+	if response.Code != http.StatusBadRequest || e.Code != apiErrorInvalid || e.Error != "stale_build_threshold_sec: unknown field" {
+		t.Errorf("expected the misspelt field to be refused, got %d %s", response.Code, response.Body.String())
+	}
+}
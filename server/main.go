@@ -0,0 +1,1842 @@
+package server
+
+// @APITitle Waitron
+// @APIDescription Templates for server provisioning
+// @License BSD
+// @LicenseUrl http://opensource.org/licenses/BSD-2-Clause
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/julienschmidt/httprouter"
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/hooks"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+	templatepkg "github.com/ns1/waitron/template"
+)
+
+type Result struct {
+	Token string `json:",omitempty"`
+	Error string `json:",omitempty"`
+	State string `json:",omitempty"`
+}
+
+type HttpResponse struct {
+	Message    string
+	StatusCode int
+}
+
+// Respond to a failed hook stage, timeouts being reported distinctly
+func hookError(response http.ResponseWriter, request *http.Request, stage string, err error) {
+	logRequest(request, err)
+	if _, ok := err.(*hooks.HookTimeoutError); ok {
+		httpError(response, request, fmt.Sprintf("Timed out executing %s hooks", stage), http.StatusGatewayTimeout)
+		return
+	}
+	httpError(response, request, fmt.Sprintf("Cannot execute %s hooks", stage), 500)
+}
+
+// Answer to a build request whose VM didn't boot
+func vmBootError(response http.ResponseWriter, request *http.Request, hostname string, err error) {
+	logRequest(request, err)
+	if err == statepkg.ErrUnknownBuild {
+		httpError(response, request, fmt.Sprintf("The build of %s is no longer in progress", hostname), http.StatusConflict)
+		return
+	}
+	httpError(response, request, fmt.Sprintf("Unable to boot the VM %s", hostname), http.StatusBadGateway)
+}
+
+// Answer to a build request for a host that is already being built
+type buildConflict struct {
+	State string
+	Error string
+	Build *machine.BuildRecord
+}
+
+// Respond with a 409 and what the build in progress, current, is up to
+func buildConflictError(response http.ResponseWriter, request *http.Request, current *machine.Machine, state *statepkg.State) {
+	build, err := state.BuildByToken(current.Token)
+	if err != nil {
+		logRequest(request, err)
+	}
+	js, _ := json.Marshal(buildConflict{
+		State: "BUILDING",
+		Error: fmt.Sprintf("%s is already being built, add force=true to cancel that build", current.Hostname),
+		Build: build,
+	})
+	response.Header().Set("content-type", "application/json")
+	response.WriteHeader(http.StatusConflict)
+	response.Write(js)
+}
+
+// Make way for a new build of hostname: with force the build in progress is
+// taken out of build mode and returned, for finishReplacedBuild to run its
+// cancel commands and hooks once the new build is armed. It is refused
+// otherwise. false when the request has been answered. Callers hold
+// state.BuildRequestMux.
+func makeWayForBuild(response http.ResponseWriter, request *http.Request, hostname string, force bool,
+	state *statepkg.State) (*machine.Machine, bool) {
+	current := state.BuildInProgress(hostname)
+	if current == nil {
+		return nil, true
+	}
+	if !force {
+		buildConflictError(response, request, current, state)
+		return nil, false
+	}
+
+	configpkg.RequestLogger(request).Warn("cancelling the build in progress for a forced build", "hostname", hostname, "token", current.Token)
+	replaced := *current
+	state.TakeOutOfBuildMode(&replaced, "replaced by a forced build")
+	return &replaced, true
+}
+
+// Run the cancel commands and the post and cancel hooks of the build a
+// forced one replaced, without holding state.BuildRequestMux. The new build is
+// already armed, failures are only logged.
+func finishReplacedBuild(request *http.Request, replaced *machine.Machine, config configpkg.Config, state *statepkg.State) {
+	if replaced == nil {
+		return
+	}
+	if err := replaced.RunBuildCommands(replaced.CancelBuildCommands); err != nil {
+		configpkg.RequestLogger(request).Error("cancel commands of the replaced build failed", "hostname", replaced.Hostname, "error", err)
+	}
+	for _, stage := range []string{machine.StagePostHook, machine.StageCancel} {
+		if err := hooks.ExecuteHooks(stage, replaced, config, state, request); err != nil {
+			configpkg.RequestLogger(request).Error("hooks of the replaced build failed", "hostname", replaced.Hostname, "stage", stage, "error", err)
+			return
+		}
+	}
+}
+
+// @Title templateHandler
+// @Description Render either the finish or the preseed template
+// @Param hostname    path    string    true    "Hostname"
+// @Param template    path    string    true    "The template to be rendered"
+// @Param token        path    string    true    "Token"
+// @Success 200    {object} string "Rendered template"
+// @Failure 400    {object} string "Not in build mode or definition does not exist"
+// @Failure 400    {object} string "Unable to render template"
+// @Failure 401    {object} string "Invalid token"
+// @Failure 504    {object} string "Timed out executing pre or template hooks"
+// @Router /template/{template}/{hostname}/{token} [GET]
+func templateHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+
+	hostname := ps.ByName("hostname")
+
+	if ps.ByName("token") != state.Tokens[hostname] {
+		httpError(response, request, "Invalid Token", 401)
+		logRequest(request, ps.ByName("token"))
+		return
+	}
+
+	// Get machine, rendering from a snapshot of it since the build keeps
+	// changing
+	state.Mux.Lock()
+	live, found := state.MachineByUUID[ps.ByName("token")]
+	var m *machine.Machine
+	if found {
+		snapshot := *live
+		m = &snapshot
+	}
+	state.Mux.Unlock()
+
+	if !found {
+		httpError(response, request, "Not in build mode or definition does not exist", 400)
+		logRequest(request, ps.ByName("token"))
+		return
+	}
+
+	// Render preseed as default
+	var template string
+
+	switch ps.ByName("template") {
+	case "preseed":
+		template = m.Preseed
+
+		if err := hooks.ExecuteHooks(machine.StagePreHook, m, config, state, request); err != nil {
+			hookError(response, request, "pre", err)
+			return
+		}
+
+		state.RecordPhase(live, machine.PhasePreseed)
+
+	case "finish":
+		template = m.Finish
+		state.RecordPhase(live, machine.PhaseFinish)
+	case "cloud-init":
+		// Next to the machine definition rather than with the templates
+		template = hostname + ".cloud-init"
+		config.TemplatePath = config.MachinePath
+		state.RecordPhase(live, machine.PhaseCloudInit)
+	}
+
+	if err := hooks.ExecuteHooks(machine.StageTemplate, m, config, state, request); err != nil {
+		hookError(response, request, machine.StageTemplate, err)
+		return
+	}
+
+	m, err := m.AtSite(request, config)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to render template", http.StatusInternalServerError)
+		return
+	}
+
+	out := newRenderWriter(response, maxBufferedRender)
+	if m.TemplateCache {
+		var rendered string
+		if rendered, err = state.RenderCache.Render(m, template, config); err == nil {
+			_, err = io.WriteString(out, rendered)
+		}
+	} else {
+		err = templatepkg.RenderTo(*m, out, template, config)
+	}
+	if err != nil {
+		logRequest(request, err)
+		if out.streaming {
+			// Part of it is out already, cut the connection so the
+			// installer doesn't take it for the whole thing
+			panic(http.ErrAbortHandler)
+		}
+		httpError(response, request, "Unable to render template", http.StatusInternalServerError)
+		return
+	}
+
+	if err := out.finish(); err != nil {
+		logRequest(request, err)
+	}
+}
+
+// @Title hostConfigHandler
+// @Description Renders the host configuration
+// @Param hostname  path  string  true  "Hostname"
+// @Success 200 {object} string "Rendered template"
+// @Success 304 {object} string "Not modified since the ETag given in If-None-Match"
+// @Failure 400 {object} string "Unable to find host definition for hostname"
+// @Router /config/{hostname} [GET]
+func hostConfigHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params,
+	config configpkg.Config) {
+
+	hostname := ps.ByName("hostname")
+
+	m, err := machine.MachineDefinition(hostname, config.MachinePath, config)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "", http.StatusNotFound)
+		return
+	}
+
+	result, _ := json.Marshal(m)
+	writeJSONWithETag(response, request, result)
+}
+
+// @Title hostConfigVmHandler
+// @Description Renders the host configuration
+// @Param hostname  path  string  true  "Hostname"
+// @Success 200 {object} string "Config"
+// @Failure 400 {object} string "Unable to find vm definition for hostname"
+// @Router /config/{hostname}/vm [GET]
+func hostConfigVmHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params,
+	config configpkg.Config) {
+
+	hostname := ps.ByName("hostname")
+
+	m, err := machine.VMDefinition(hostname, config)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "", http.StatusNotFound)
+		return
+	}
+
+	response.Header().Set("content-type", "application/json")
+	result, _ := json.Marshal(m)
+	response.Write(result)
+}
+
+// The kernel parameters a build request asks for with cmdline, which can be
+// given more than once
+func requestCmdline(request *http.Request) (string, error) {
+	extra := strings.Join(request.URL.Query()["cmdline"], " ")
+	for _, r := range extra {
+		if unicode.IsControl(r) {
+			return "", fmt.Errorf("control character in cmdline %q", extra)
+		}
+	}
+	return strings.Join(strings.Fields(extra), " "), nil
+}
+
+// @Title buildHandler
+// @Description Put the server in build mode
+// @Param hostname    path    string    true    "Hostname"
+// @Param mac         query   string    false   "MAC address of a machine built with the default profile"
+// @Param cmdline     query   string    false   "Kernel parameters to add to the cmdline of this build, can be repeated"
+// @Param profile     query   string    false   "Build profile to merge over the machine definition"
+// @Param force       query   bool      false   "Cancel a build of the host in progress instead of refusing"
+// @Success 200    {object} string "{"State": "OK", "Token": <UUID of the build>}"
+// @Failure 400    {object} string "Invalid cmdline"
+// @Failure 400    {object} string "Unable to use the build profile"
+// @Failure 500    {object} string "Unable to find host definition for hostname"
+// @Failure 500    {object} string "Failed to set build mode on hostname"
+// @Failure 409    {object} string "{"State": "BUILDING", "Error": <why>, "Build": <the build in progress>}"
+// @Failure 502    {object} string "Unable to boot the VM"
+// @Failure 504    {object} string "Timed out executing build-start or token-issued hooks"
+// @Router build/{hostname} [PUT]
+func buildHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := ps.ByName("hostname")
+
+	extra, err := requestCmdline(request)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Invalid cmdline", http.StatusBadRequest)
+		return
+	}
+
+	m, err := machine.BuildDefinition(hostname, request.URL.Query().Get("mac"), config)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, fmt.Sprintf("Unable to find host definition for %s", hostname), http.StatusNotFound)
+		return
+	}
+	m.ExtraCmdline = extra
+
+	if profile := request.URL.Query().Get("profile"); profile != "" {
+		if err := m.ApplyProfile(profile, config); err != nil {
+			logRequest(request, err)
+			httpError(response, request, fmt.Sprintf("Unable to use the build profile %s", profile), http.StatusBadRequest)
+			return
+		}
+	}
+
+	force, _ := strconv.ParseBool(request.URL.Query().Get("force"))
+	// Refused before any hooks run, checked again once it comes to arming
+	if current := state.BuildInProgress(m.Hostname); current != nil && !force {
+		buildConflictError(response, request, current, state)
+		return
+	}
+
+	if err := hooks.ExecuteHooks(machine.StageBuildStart, &m, config, state, request); err != nil {
+		hookError(response, request, machine.StageBuildStart, err)
+		return
+	}
+
+	state.BuildRequestMux.Lock()
+	replaced, ok := makeWayForBuild(response, request, m.Hostname, force, state)
+	if !ok {
+		state.BuildRequestMux.Unlock()
+		return
+	}
+	token, err := state.SetBuildMode(m, config)
+	state.BuildRequestMux.Unlock()
+	finishReplacedBuild(request, replaced, config, state)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, fmt.Sprintf("Failed to set build mode on %s", hostname), http.StatusInternalServerError)
+		return
+	}
+
+	if err := hooks.ExecuteHooks(machine.StageTokenIssued, state.MachineByToken(token), config, state, request); err != nil {
+		hookError(response, request, machine.StageTokenIssued, err)
+		return
+	}
+
+	if err := state.BootBuildVM(token, config); err != nil {
+		vmBootError(response, request, hostname, err)
+		return
+	}
+
+	result, _ := json.Marshal(&Result{State: "OK", Token: token})
+
+	fmt.Fprintf(response, string(result))
+}
+
+// @Title rollbackHandler
+// @Description Build the server again with the profile of its last completed build before the latest one
+// @Param hostname    path    string    true    "Hostname"
+// @Param cmdline     query   string    false   "Kernel parameters to add to the cmdline of this build, can be repeated"
+// @Param force       query   bool      false   "Cancel a build of the host in progress and roll back despite changed templates or definitions instead of refusing"
+// @Success 200    {object} string "{"State": "OK", "Token": <UUID of the build>, "RollbackOf": <token of the build rolled back to>, "Profile": <profile>, "Changed": <what changed since that build>}"
+// @Failure 400    {object} string "Invalid cmdline"
+// @Failure 400    {object} string "Unable to use the build profile"
+// @Failure 404    {object} string "Unable to find host definition for hostname"
+// @Failure 409    {object} string "No earlier completed build of hostname to roll back to"
+// @Failure 409    {object} string "The build of hostname to roll back to has the default profile and no MAC address"
+// @Failure 409    {object} string "Rolling back hostname keeps what changed since that build: <changes>"
+// @Failure 409    {object} string "{"State": "BUILDING", "Error": <why>, "Build": <the build in progress>}"
+// @Failure 500    {object} string "Unable to load history"
+// @Failure 502    {object} string "Unable to boot the VM"
+// @Failure 504    {object} string "Timed out executing build-start or token-issued hooks"
+// @Router /api/v1/build/{hostname}/rollback [POST]
+func rollbackHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := strings.ToLower(ps.ByName("hostname"))
+
+	extra, err := requestCmdline(request)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Invalid cmdline", http.StatusBadRequest)
+		return
+	}
+
+	h, err := statepkg.LoadHostHistory(state.Store, hostname)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to load history", http.StatusInternalServerError)
+		return
+	}
+	target, err := h.RollbackTarget()
+	if err != nil {
+		httpError(response, request, fmt.Sprintf("No earlier completed build of %s to roll back to", hostname), http.StatusConflict)
+		return
+	}
+
+	// A build with the default profile only had the MAC address it was
+	// started for
+	if target.Profile == "default" && target.MacAddress == "" {
+		httpError(response, request, fmt.Sprintf("The build of %s to roll back to has the default profile and no MAC address", hostname), http.StatusConflict)
+		return
+	}
+	m, err := machine.BuildDefinition(hostname, target.MacAddress, config)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, fmt.Sprintf("Unable to find host definition for %s", hostname), http.StatusNotFound)
+		return
+	}
+	m.ExtraCmdline = extra
+	// Builds with the default profile get it from machine.BuildDefinition again
+	if target.Profile != "" && target.Profile != "default" {
+		if err := m.ApplyProfile(target.Profile, config); err != nil {
+			logRequest(request, err)
+			httpError(response, request, fmt.Sprintf("Unable to use the build profile %s", target.Profile), http.StatusBadRequest)
+			return
+		}
+	}
+	m.RollbackOf = target.Token
+
+	force, _ := strconv.ParseBool(request.URL.Query().Get("force"))
+	changed := state.RollbackChanges(target, &m, config)
+	if len(changed) > 0 && !force {
+		httpError(response, request, fmt.Sprintf("Rolling back %s keeps what changed since that build: %s", hostname, strings.Join(changed, ", ")), http.StatusConflict)
+		return
+	}
+	if current := state.BuildInProgress(m.Hostname); current != nil && !force {
+		buildConflictError(response, request, current, state)
+		return
+	}
+
+	if err := hooks.ExecuteHooks(machine.StageBuildStart, &m, config, state, request); err != nil {
+		hookError(response, request, machine.StageBuildStart, err)
+		return
+	}
+
+	state.BuildRequestMux.Lock()
+	replaced, ok := makeWayForBuild(response, request, m.Hostname, force, state)
+	if !ok {
+		state.BuildRequestMux.Unlock()
+		return
+	}
+	token, err := state.SetBuildMode(m, config)
+	state.BuildRequestMux.Unlock()
+	finishReplacedBuild(request, replaced, config, state)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, fmt.Sprintf("Failed to set build mode on %s", hostname), http.StatusInternalServerError)
+		return
+	}
+	logger.Machine(&m).Info("rolling back", "rollback_of", target.Token, "profile", target.Profile, "changed", strings.Join(changed, ", "))
+
+	if err := hooks.ExecuteHooks(machine.StageTokenIssued, state.MachineByToken(token), config, state, request); err != nil {
+		hookError(response, request, machine.StageTokenIssued, err)
+		return
+	}
+
+	if err := state.BootBuildVM(token, config); err != nil {
+		vmBootError(response, request, hostname, err)
+		return
+	}
+
+	js, _ := json.Marshal(&statepkg.RollbackResult{State: "OK", Token: token, RollbackOf: target.Token, Profile: target.Profile, Changed: changed})
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title rescueHandler
+// @Description Put the server in build mode for a rescue boot
+// @Param hostname    path    string    true    "Hostname"
+// @Param cmdline     query   string    false   "Kernel parameters to add to the rescue cmdline of this build, can be repeated"
+// @Param force       query   bool      false   "Cancel a build of the host in progress instead of refusing"
+// @Success 200    {object} string "{"State": "OK", "Token": <UUID of the build>}"
+// @Failure 400    {object} string "Invalid cmdline"
+// @Failure 500    {object} string "Unable to find host definition for hostname"
+// @Failure 500    {object} string "Failed to set build mode for rescue on hostname"
+// @Failure 409    {object} string "{"State": "BUILDING", "Error": <why>, "Build": <the build in progress>}"
+// @Failure 502    {object} string "Unable to boot the VM"
+// @Failure 504    {object} string "Timed out executing build-start or token-issued hooks"
+// @Router rescue/{hostname} [PUT]
+func rescueHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := ps.ByName("hostname")
+
+	extra, err := requestCmdline(request)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Invalid cmdline", http.StatusBadRequest)
+		return
+	}
+
+	m, err := machine.MachineDefinition(hostname, config.MachinePath, config)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, fmt.Sprintf("Unable to find host definition for %s", hostname), 500)
+		return
+	}
+
+	m.RescueMode = true
+	m.ExtraCmdline = extra
+
+	force, _ := strconv.ParseBool(request.URL.Query().Get("force"))
+	// Refused before any hooks run, checked again once it comes to arming
+	if current := state.BuildInProgress(m.Hostname); current != nil && !force {
+		buildConflictError(response, request, current, state)
+		return
+	}
+
+	if err := hooks.ExecuteHooks(machine.StageBuildStart, &m, config, state, request); err != nil {
+		hookError(response, request, machine.StageBuildStart, err)
+		return
+	}
+
+	state.BuildRequestMux.Lock()
+	replaced, ok := makeWayForBuild(response, request, m.Hostname, force, state)
+	if !ok {
+		state.BuildRequestMux.Unlock()
+		return
+	}
+	token, err := state.SetBuildMode(m, config)
+	state.BuildRequestMux.Unlock()
+	finishReplacedBuild(request, replaced, config, state)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, fmt.Sprintf("Failed to set build mode for rescue on %s", hostname), 500)
+		return
+	}
+
+	if err := hooks.ExecuteHooks(machine.StageTokenIssued, state.MachineByToken(token), config, state, request); err != nil {
+		hookError(response, request, machine.StageTokenIssued, err)
+		return
+	}
+
+	if err := state.BootBuildVM(token, config); err != nil {
+		vmBootError(response, request, hostname, err)
+		return
+	}
+
+	result, _ := json.Marshal(&Result{State: "OK", Token: token})
+
+	fmt.Fprintf(response, string(result))
+}
+
+// @Title doneHandler
+// @Description Remove the server from build mode
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Success 200    {object} string "{"State": "OK"}"
+// @Failure 500    {object} string "Failed to finish build mode"
+// @Failure 400    {object} string "Not in build mode or definition does not exist"
+// @Failure 401    {object} string "Invalid token"
+// @Failure 504    {object} string "Timed out executing done hooks"
+// @Router /done/{hostname}/{token} [GET]
+// @Router /done/{hostname} [POST]
+func doneHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	token, valid := state.RequestToken(request, ps)
+	if !valid {
+		httpError(response, request, "Invalid Token", 401)
+		return
+	}
+
+	// Get machine
+	state.Mux.Lock()
+	m, found := state.MachineByUUID[token]
+	state.Mux.Unlock()
+
+	if !found {
+		httpError(response, request, "Not in build mode or definition does not exist", 400)
+		return
+	}
+
+	err := state.CompleteBuild(m, config)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Failed to finish build mode", 500)
+		return
+	}
+
+	if err := hooks.ExecuteHooks(machine.StageDone, m, config, state, request); err != nil {
+		hookError(response, request, machine.StageDone, err)
+		return
+	}
+
+	result, _ := json.Marshal(&Result{State: "OK"})
+
+	fmt.Fprintf(response, string(result))
+}
+
+// @Title cancelHandler
+// @Description Remove the server from build mode
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Success 200    {object} string "{"State": "OK"}"
+// @Failure 500    {object} string "Failed to cancel build mode"
+// @Failure 400    {object} string "Not in build mode or definition does not exist"
+// @Failure 401    {object} string "Invalid token"
+// @Failure 504    {object} string "Timed out executing post or cancel hooks"
+// @Router /cancel/{hostname}/{token} [GET]
+// @Router /cancel/{hostname} [POST]
+func cancelHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	token, valid := state.RequestToken(request, ps)
+	if !valid {
+		httpError(response, request, "Invalid Token", 401)
+		return
+	}
+
+	// Get machine
+	state.Mux.Lock()
+	m, found := state.MachineByUUID[token]
+	state.Mux.Unlock()
+
+	if !found {
+		httpError(response, request, "Not in build mode or definition does not exist", 400)
+		return
+	}
+
+	err := state.CancelBuildMode(*m, config, "")
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Failed to cancel build mode", 500)
+		return
+	}
+
+	if err := hooks.ExecuteHooks(machine.StagePostHook, m, config, state, request); err != nil {
+		hookError(response, request, "post", err)
+		return
+	}
+
+	if err := hooks.ExecuteHooks(machine.StageCancel, m, config, state, request); err != nil {
+		hookError(response, request, machine.StageCancel, err)
+		return
+	}
+
+	response.Header().Set("content-type", "application/json")
+	result, _ := json.Marshal(&Result{State: "OK"})
+	fmt.Fprintf(response, string(result))
+}
+
+// @Title hostStatus
+// @Description Build status of the server
+// @Param hostname    path    string    true    "Hostname"
+// @Success 200    {object} string "The status: (installing or installed)"
+// @Failure 500    {object} string "Unknown state"
+// @Router /status/{hostname} [GET]
+func hostStatus(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	m, found := state.MachineByHostname[ps.ByName("hostname")]
+	if !found || m.Status == "" {
+		httpError(response, request, "Unknown state", 500)
+		return
+	}
+	fmt.Fprintf(response, m.Status)
+}
+
+// @Title hostProgressHandler
+// @Description Report installer progress for a server in build mode
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Param body        body    string    true    "{"Phase": <phase>, "Percent": <0-100>, "Message": <message>}"
+// @Success 200    {object} string "{"State": "OK"}"
+// @Failure 400    {object} string "Invalid progress report"
+// @Failure 400    {object} string "Not in build mode or definition does not exist"
+// @Failure 401    {object} string "Invalid token"
+// @Router /status/{hostname}/{token} [POST]
+func hostProgressHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := ps.ByName("hostname")
+	token := ps.ByName("token")
+
+	state.Mux.Lock()
+	valid := token == state.Tokens[hostname]
+	state.Mux.Unlock()
+
+	if !valid {
+		httpError(response, request, "Invalid Token", 401)
+		return
+	}
+
+	var p machine.BuildProgress
+	if err := json.NewDecoder(request.Body).Decode(&p); err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Invalid progress report", 400)
+		return
+	}
+
+	if err := state.ReportProgress(token, p); err != nil {
+		logRequest(request, err)
+		if err == statepkg.ErrUnknownBuild {
+			httpError(response, request, "Not in build mode or definition does not exist", 400)
+		} else {
+			httpError(response, request, fmt.Sprintf("Invalid progress report: %s", err), 400)
+		}
+		return
+	}
+
+	result, _ := json.Marshal(&Result{State: "OK"})
+	response.Header().Set("content-type", "application/json")
+	response.Write(result)
+}
+
+// @Title heartbeatHandler
+// @Description Tell Waitron the installer of a server in build mode is still working
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Success 200    {object} string "{"State": "OK"}"
+// @Failure 400    {object} string "Not in build mode or definition does not exist"
+// @Failure 401    {object} string "Invalid token"
+// @Router /heartbeat/{hostname}/{token} [PUT]
+func heartbeatHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := ps.ByName("hostname")
+	token := ps.ByName("token")
+
+	state.Mux.Lock()
+	valid := token == state.Tokens[hostname]
+	state.Mux.Unlock()
+
+	if !valid {
+		httpError(response, request, "Invalid Token", 401)
+		return
+	}
+
+	if err := state.Heartbeat(token); err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Not in build mode or definition does not exist", 400)
+		return
+	}
+
+	result, _ := json.Marshal(&Result{State: "OK"})
+	response.Header().Set("content-type", "application/json")
+	response.Write(result)
+}
+
+// @Title validateHandler
+// @Description Report the first boot of a server being validated
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Param body        body    string    false    "{"Kernel": <uname -r>}"
+// @Success 200    {object} string "{"State": "OK"}"
+// @Failure 400    {object} string "Invalid validation report"
+// @Failure 400    {object} string "Not in build mode or definition does not exist"
+// @Failure 401    {object} string "Invalid token"
+// @Failure 409    {object} string "Build is not validating"
+// @Router /validate/{hostname}/{token} [POST]
+func validateHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	var r machine.ValidationReport
+	stageReportHandler(response, request, ps, state, &r, func(token string) error {
+		return state.ReportValidation(token, r)
+	}, "Invalid validation report", "Build is not validating")
+}
+
+// @Title phoneHomeHandler
+// @Description Report the first boot of an installed system, as cloud-init's phone_home module posts it
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Param body        body    string    false    "instance_id=<id>&hostname=<hostname>&fqdn=<fqdn>&pub_key_ed25519=<key>"
+// @Success 200    {object} string "{"State": "OK"}"
+// @Failure 400    {object} string "Invalid phone home"
+// @Failure 400    {object} string "Not in build mode or definition does not exist"
+// @Failure 401    {object} string "Invalid token"
+// @Failure 409    {object} string "Build is not validating"
+// @Router /phone-home/{hostname}/{token} [POST]
+func phoneHomeHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	var r machine.PhoneHomeReport
+	stageReportHandler(response, request, ps, state, &r, func(token string) error {
+		return state.ReportPhoneHome(token, r)
+	}, "Invalid phone home", "Build is not validating")
+}
+
+// @Title firmwareHandler
+// @Description Firmware packages a server updating its firmware is to apply
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Success 200    {object} string "{"Model": <model>, "Components": {<component>: {"Version": <version>, "URL": <url>, "SHA256": <sha256>}}}"
+// @Failure 400    {object} string "Not in build mode or definition does not exist"
+// @Failure 401    {object} string "Invalid token"
+// @Failure 409    {object} string "Build is not updating firmware"
+// @Router /firmware/{hostname}/{token} [GET]
+func firmwareHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := ps.ByName("hostname")
+	token := ps.ByName("token")
+
+	state.Mux.Lock()
+	valid := token == state.Tokens[hostname]
+	state.Mux.Unlock()
+
+	if !valid {
+		httpError(response, request, "Invalid Token", 401)
+		return
+	}
+
+	manifest, err := state.FirmwareFor(token)
+	if err != nil {
+		logRequest(request, err)
+		if err == statepkg.ErrUnknownBuild {
+			httpError(response, request, "Not in build mode or definition does not exist", 400)
+		} else {
+			httpError(response, request, "Build is not updating firmware", http.StatusConflict)
+		}
+		return
+	}
+
+	result, _ := json.Marshal(manifest)
+	response.Header().Set("content-type", "application/json")
+	response.Write(result)
+}
+
+// @Title firmwareResultHandler
+// @Description Report how updating the firmware of a server went
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Param body        body    string    true    "{"Components": [{"Component": <component>, "From": <version>, "To": <version>, "Passed": <bool>, "Message": <message>}], "Message": <message>}"
+// @Success 200    {object} string "{"State": "OK"}"
+// @Failure 400    {object} string "Invalid firmware results"
+// @Failure 400    {object} string "Not in build mode or definition does not exist"
+// @Failure 401    {object} string "Invalid token"
+// @Failure 409    {object} string "Build is not updating firmware"
+// @Router /firmware/{hostname}/{token} [POST]
+func firmwareResultHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	var r machine.FirmwareResult
+	stageReportHandler(response, request, ps, state, &r, func(token string) error {
+		return state.ReportFirmware(token, r, config)
+	}, "Invalid firmware results", "Build is not updating firmware")
+}
+
+// @Title raidHandler
+// @Description The script that configures the RAID controller of a server
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Success 200    {object} string "Rendered script"
+// @Failure 400    {object} string "Not in build mode or definition does not exist"
+// @Failure 400    {object} string "Unable to render RAID script"
+// @Failure 401    {object} string "Invalid token"
+// @Failure 409    {object} string "Build is not configuring RAID"
+// @Router /raid/{hostname}/{token} [GET]
+func raidHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := ps.ByName("hostname")
+	token := ps.ByName("token")
+
+	state.Mux.Lock()
+	valid := token == state.Tokens[hostname]
+	state.Mux.Unlock()
+
+	if !valid {
+		httpError(response, request, "Invalid Token", 401)
+		return
+	}
+
+	script, err := state.RAIDScriptFor(token, config)
+	if err != nil {
+		logRequest(request, err)
+		switch err {
+		case statepkg.ErrUnknownBuild:
+			httpError(response, request, "Not in build mode or definition does not exist", 400)
+		case statepkg.ErrNotInStage:
+			httpError(response, request, "Build is not configuring RAID", http.StatusConflict)
+		default:
+			httpError(response, request, "Unable to render RAID script", 400)
+		}
+		return
+	}
+
+	response.Header().Set("content-type", "text/x-shellscript")
+	io.WriteString(response, script)
+}
+
+// @Title raidResultHandler
+// @Description Report how configuring the RAID controller of a server went
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Param body        body    string    true    "{"Passed": <bool>, "Message": <message>, "Output": <output>}"
+// @Success 200    {object} string "{"State": "OK"}"
+// @Failure 400    {object} string "Invalid RAID results"
+// @Failure 400    {object} string "Not in build mode or definition does not exist"
+// @Failure 401    {object} string "Invalid token"
+// @Failure 409    {object} string "Build is not configuring RAID"
+// @Router /raid/{hostname}/{token} [POST]
+func raidResultHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	var r machine.RAIDResult
+	stageReportHandler(response, request, ps, state, &r, func(token string) error {
+		return state.ReportRAID(token, r, config)
+	}, "Invalid RAID results", "Build is not configuring RAID")
+}
+
+// @Title burnInHandler
+// @Description Report the results of burning in a server
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Param body        body    string    true    "{"Passed": <bool>, "Message": <message>, "Results": {<name>: <value>}}"
+// @Success 200    {object} string "{"State": "OK"}"
+// @Failure 400    {object} string "Invalid burn-in results"
+// @Failure 400    {object} string "Not in build mode or definition does not exist"
+// @Failure 401    {object} string "Invalid token"
+// @Failure 409    {object} string "Build is not burning in"
+// @Router /burnin/{hostname}/{token} [POST]
+func burnInHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	var r machine.BurnInResult
+	stageReportHandler(response, request, ps, state, &r, func(token string) error {
+		return state.ReportBurnIn(token, r, config)
+	}, "Invalid burn-in results", "Build is not burning in")
+}
+
+// @Title wipeHandler
+// @Description Report how wiping the disks of a server went, its wipe certificate
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Param body        body    string    true    "{"Disks": [{"Device": <device>, "Serial": <serial>, "Method": <method>, "DurationSeconds": <seconds>, "Passed": <bool>, "Message": <message>}], "Message": <message>}"
+// @Success 200    {object} string "{"State": "OK"}"
+// @Failure 400    {object} string "Invalid wipe certificate"
+// @Failure 400    {object} string "Not in build mode or definition does not exist"
+// @Failure 401    {object} string "Invalid token"
+// @Failure 409    {object} string "Build is not wiping"
+// @Router /wipe/{hostname}/{token} [POST]
+func wipeHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	var c machine.WipeCertificate
+	stageReportHandler(response, request, ps, state, &c, func(token string) error {
+		return state.ReportWipe(token, c, config)
+	}, "Invalid wipe certificate", "Build is not wiping")
+}
+
+// @Title artifactHandler
+// @Description Upload an artifact of the build, e.g. a hardware report or the installed packages
+// @Param hostname    path    string    true    "Hostname"
+// @Param token        path    string    true    "Token"
+// @Param name        query   string    true    "Artifact name"
+// @Param body        body    string    true    "The artifact, with its Content-Type"
+// @Success 200    {object} string "{"Name": <name>, "ContentType": <type>, "Size": <bytes>, "SHA256": <sha256>, "Uploaded": <time>}"
+// @Failure 400    {object} string "Invalid artifact name"
+// @Failure 400    {object} string "Not in build mode or definition does not exist"
+// @Failure 401    {object} string "Invalid token"
+// @Failure 409    {object} string "Build has too many artifacts"
+// @Failure 413    {object} string "Artifact is too large"
+// @Failure 415    {object} string "Artifact content type is not accepted"
+// @Router /artifacts/{hostname}/{token} [POST]
+func artifactHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := ps.ByName("hostname")
+	token := ps.ByName("token")
+
+	state.Mux.Lock()
+	valid := token == state.Tokens[hostname]
+	state.Mux.Unlock()
+
+	if !valid {
+		httpError(response, request, "Invalid Token", 401)
+		return
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(request.Body, config.Artifacts.ByteLimit()+1))
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to read artifact", 400)
+		return
+	}
+
+	info, err := state.StoreArtifact(token, request.URL.Query().Get("name"), request.Header.Get("Content-Type"), data, config)
+	if err != nil {
+		logRequest(request, err)
+		switch err {
+		case statepkg.ErrUnknownBuild:
+			httpError(response, request, "Not in build mode or definition does not exist", 400)
+		case statepkg.ErrInvalidArtifactName:
+			httpError(response, request, "Invalid artifact name", 400)
+		case statepkg.ErrTooManyArtifacts:
+			httpError(response, request, "Build has too many artifacts", http.StatusConflict)
+		case statepkg.ErrArtifactTooLarge:
+			httpError(response, request, "Artifact is too large", http.StatusRequestEntityTooLarge)
+		case configpkg.ErrArtifactContentType:
+			httpError(response, request, "Artifact content type is not accepted", http.StatusUnsupportedMediaType)
+		default:
+			httpError(response, request, "Unable to store artifact", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	js, _ := json.Marshal(info)
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title getArtifactHandler
+// @Description An artifact a build uploaded, with the content type it was uploaded with
+// @Param token        path    string    true    "Token"
+// @Param name        path    string    true    "Artifact name"
+// @Success 200    {object} string "The artifact"
+// @Failure 404    {object} string "Unknown artifact"
+// @Failure 500    {object} string "Unable to load artifact"
+// @Router /api/v1/builds/{token}/artifacts/{name} [GET]
+func getArtifactHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	a, err := state.Artifact(ps.ByName("token"), ps.ByName("name"))
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to load artifact", http.StatusInternalServerError)
+		return
+	}
+	if a == nil {
+		httpError(response, request, "Unknown artifact", http.StatusNotFound)
+		return
+	}
+
+	response.Header().Set("content-type", a.ContentType)
+	response.Header().Set("X-Checksum-SHA256", a.SHA256)
+	response.Write(a.Data)
+}
+
+// @Title buildPhasesHandler
+// @Description Phases a build has gone through, with timestamps
+// @Param token        path    string    true    "Token"
+// @Success 200    {object} string "Build record with its phases"
+// @Failure 404    {object} string "Unknown build"
+// @Failure 500    {object} string "Unable to load build"
+// @Router /api/v1/builds/{token} [GET]
+func buildPhasesHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	token := ps.ByName("token")
+
+	b, err := state.BuildByToken(token)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to load build", http.StatusInternalServerError)
+		return
+	}
+	if b == nil {
+		httpError(response, request, "Unknown build", http.StatusNotFound)
+		return
+	}
+
+	result, _ := json.Marshal(b)
+	response.Header().Set("content-type", "application/json")
+	response.Write(result)
+}
+
+// @Title listMachinesHandler
+// @Description List machines handled by waitron
+// @Param selector  query  string  false  "Only machines with matching labels, e.g. rack=r12,role!=db"
+// @Success 200    {array} string "List of machines"
+// @Success 304    {object} string "Not modified since the ETag given in If-None-Match"
+// @Failure 400    {object} string "Invalid selector"
+// @Failure 500    {object} string "Unable to list machines"
+// @Router /list [GET]
+func listMachinesHandler(response http.ResponseWriter, request *http.Request,
+	_ httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	requirements, err := machine.ParseSelector(request.URL.Query().Get("selector"))
+	if err != nil {
+		httpError(response, request, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	inv, err := state.InventoryFor(config)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to list machines", 500)
+		return
+	}
+
+	machines := inv.List()
+	if len(requirements) > 0 {
+		machines = []string{}
+		for _, e := range inv.Match(requirements) {
+			machines = append(machines, e.File)
+		}
+	}
+	js, _ := json.Marshal(machines)
+	writeJSONWithETag(response, request, js)
+}
+
+// @Title inventoryHandler
+// @Description Indexed machine definitions with their MAC addresses and labels
+// @Param selector  query  string  false  "Only machines with matching labels, e.g. rack=r12,role!=db"
+// @Param mac       query  string  false  "Only the machine with this MAC address"
+// @Param hostname  query  string  false  "Only the machine with this hostname"
+// @Success 200    {array} machine.InventoryEntry "Matching machines"
+// @Failure 400    {object} string "Invalid selector"
+// @Failure 500    {object} string "Unable to list machines"
+// @Router /api/v1/inventory [GET]
+func inventoryHandler(response http.ResponseWriter, request *http.Request,
+	_ httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	query := request.URL.Query()
+	requirements, err := machine.ParseSelector(query.Get("selector"))
+	if err != nil {
+		httpError(response, request, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	inv, err := state.InventoryFor(config)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to list machines", 500)
+		return
+	}
+
+	var entries []machine.InventoryEntry
+	if mac, hostname := query.Get("mac"), query.Get("hostname"); mac != "" || hostname != "" {
+		e, found := inv.LookupMAC(mac)
+		if mac == "" {
+			e, found = inv.LookupHostname(hostname)
+		} else if hostname != "" && e.Hostname != strings.ToLower(hostname) {
+			found = false
+		}
+		entries = []machine.InventoryEntry{}
+		if found && e.Matches(requirements) {
+			entries = append(entries, e)
+		}
+	} else {
+		entries = inv.Match(requirements)
+	}
+
+	js, _ := json.Marshal(entries)
+	writeJSONWithETag(response, request, js)
+}
+
+// @Title listHooksHandler
+// @Description List all available pre- and post hooks
+// @Success 200 {array} string "List of hooks"
+// @Failure 500 {object} string "Unable to list hooks"
+// @Router /hooks [GET]
+func listHooksHandler(response http.ResponseWriter, request *http.Request,
+	_ httprouter.Params, config configpkg.Config) {
+	hooks, err := config.ListHooks()
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to list hooks", 500)
+		return
+	}
+	js, _ := json.Marshal(hooks)
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title hookResultsHandler
+// @Description Output, exit code and timing of recent hook executions for a machine
+// @Param hostname  path  string  true  "Hostname"
+// @Success 200 {array} string "List of hook results"
+// @Failure 500 {object} string "Unable to load hook results"
+// @Router /hooks/results/{hostname} [GET]
+func hookResultsHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := strings.ToLower(ps.ByName("hostname"))
+
+	results, err := hooks.LoadHookResults(state.Store, hostname)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to load hook results", 500)
+		return
+	}
+
+	js, _ := json.Marshal(results)
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title runHookHandler
+// @Description Run a single hook for a machine on demand, e.g. to retry a failed one
+// @Param name      path   string  true   "Hook name"
+// @Param hostname  query  string  true   "Hostname"
+// @Param stage     query  string  false  "Stage to look the hook up in"
+// @Param dry_run   query  bool    false  "Render and log the hook without executing it"
+// @Success 200 {object} string "Hook result"
+// @Failure 400 {object} string "hostname is required"
+// @Failure 404 {object} string "Unable to find host definition for hostname"
+// @Failure 404 {object} string "No such hook for hostname"
+// @Failure 500 {object} string "Hook result of the failed execution"
+// @Router /api/v1/hooks/{name}/run [POST]
+func runHookHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	name := ps.ByName("name")
+	hostname := strings.ToLower(request.URL.Query().Get("hostname"))
+
+	if hostname == "" {
+		httpError(response, request, "hostname is required", http.StatusBadRequest)
+		return
+	}
+
+	// Prefer the machine in build mode so the hook sees its token
+	state.Mux.Lock()
+	m, found := state.MachineByHostname[hostname]
+	state.Mux.Unlock()
+
+	if !found {
+		def, err := machine.MachineDefinition(hostname, config.MachinePath, config)
+		if err != nil {
+			logRequest(request, err)
+			httpError(response, request, fmt.Sprintf("Unable to find host definition for %s", hostname), http.StatusNotFound)
+			return
+		}
+		m = &def
+	}
+
+	hook, stage, found := m.FindHook(name, request.URL.Query().Get("stage"))
+	if !found {
+		httpError(response, request, fmt.Sprintf("No such hook %s for %s", name, hostname), http.StatusNotFound)
+		return
+	}
+
+	hc := hooks.NewHookContext(stage, request)
+	hc.DryRun = hc.DryRun || config.HookDryRun
+
+	result, err := hooks.ExecuteHook(hook, m, config, hc)
+	result.Stage = stage
+	result.Attempt = 1
+	hooks.RecordHookResult(state, m, result)
+
+	js, _ := json.Marshal(result)
+	response.Header().Set("content-type", "application/json")
+	if err != nil {
+		logRequest(request, err)
+		response.WriteHeader(http.StatusInternalServerError)
+	}
+	response.Write(js)
+}
+
+// @Title bulkBuildHandler
+// @Description Build many servers, holding each until the ones it comes after are done
+// @Param body  body  string  true  "{"Hosts": [{"Hostname": <hostname>, "After": [<hostname>]}], "Profile": <profile>, "DomainLabel": <label>, "MaxPerDomain": <n>, "MaxFailures": <n>}"
+// @Success 200 {object} string "The bulk build"
+// @Failure 400 {object} string "Invalid bulk build"
+// @Router /api/v1/bulk-builds [POST]
+func bulkBuildHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	var r statepkg.BulkBuildRequest
+	if err := json.NewDecoder(request.Body).Decode(&r); err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Invalid bulk build", http.StatusBadRequest)
+		return
+	}
+
+	b, err := state.Bulk.Submit(r)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, fmt.Sprintf("Invalid bulk build: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	js, _ := json.Marshal(b)
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title listBulkBuildsHandler
+// @Description Bulk builds, newest first
+// @Success 200 {array} string "List of bulk builds"
+// @Router /api/v1/bulk-builds [GET]
+func listBulkBuildsHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	js, _ := json.Marshal(state.Bulk.List())
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title getBulkBuildHandler
+// @Description A bulk build with how far along each of its hosts is
+// @Param id  path  string  true  "Bulk build id"
+// @Success 200 {object} string "The bulk build"
+// @Failure 404 {object} string "No such bulk build"
+// @Router /api/v1/bulk-builds/{id} [GET]
+func getBulkBuildHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	b, err := state.Bulk.Get(ps.ByName("id"))
+	if err != nil {
+		httpError(response, request, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	js, _ := json.Marshal(b)
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title resumeBulkBuildHandler
+// @Description Let a bulk build paused after too many failed builds start hosts again
+// @Param id  path  string  true  "Bulk build id"
+// @Success 200 {object} string "The bulk build"
+// @Failure 404 {object} string "No such bulk build"
+// @Failure 409 {object} string "Bulk build is not paused"
+// @Router /api/v1/bulk-builds/{id}/resume [POST]
+func resumeBulkBuildHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	b, err := state.Bulk.Resume(ps.ByName("id"))
+	if err == statepkg.ErrBulkBuildNotPaused {
+		httpError(response, request, "Bulk build is not paused", http.StatusConflict)
+		return
+	} else if err != nil {
+		httpError(response, request, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	js, _ := json.Marshal(b)
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title groupRebuildHandler
+// @Description Rebuild the servers with matching labels in waves, canaries first
+// @Param body  body  string  true  "{"Selector": <selector>, "Canary": <n>, "WaveSize": <n>, "MaxFailures": <n>, "Profile": <profile>}"
+// @Success 200 {object} string "The bulk build rolling out the rebuild"
+// @Failure 400 {object} string "Invalid group rebuild"
+// @Router /api/v1/group-rebuilds [POST]
+func groupRebuildHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	var r statepkg.GroupRebuildRequest
+	if err := json.NewDecoder(request.Body).Decode(&r); err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Invalid group rebuild", http.StatusBadRequest)
+		return
+	}
+
+	b, err := state.Bulk.SubmitGroupRebuild(r)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, fmt.Sprintf("Invalid group rebuild: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	js, _ := json.Marshal(b)
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title listDeadLettersHandler
+// @Description Hooks that failed every attempt, oldest first
+// @Success 200 {array} string "List of dead letters"
+// @Failure 500 {object} string "Unable to load dead letters"
+// @Router /api/v1/dead-letters [GET]
+func listDeadLettersHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	letters, err := hooks.LoadDeadLetters(state.Store)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to load dead letters", 500)
+		return
+	}
+
+	js, _ := json.Marshal(letters)
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title getDeadLetterHandler
+// @Description A single dead letter with the hook, machine and last error
+// @Param id  path  string  true  "Dead letter id"
+// @Success 200 {object} string "Dead letter"
+// @Failure 404 {object} string "No such dead letter"
+// @Failure 500 {object} string "Unable to load dead letter"
+// @Router /api/v1/dead-letters/{id} [GET]
+func getDeadLetterHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	d, err := hooks.LoadDeadLetter(state.Store, ps.ByName("id"))
+	if err == hooks.ErrUnknownDeadLetter {
+		httpError(response, request, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to load dead letter", 500)
+		return
+	}
+
+	js, _ := json.Marshal(d)
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title deleteDeadLetterHandler
+// @Description Drop a dead letter without replaying it
+// @Param id  path  string  true  "Dead letter id"
+// @Success 200 {object} string "OK"
+// @Failure 500 {object} string "Unable to delete dead letter"
+// @Router /api/v1/dead-letters/{id} [DELETE]
+func deleteDeadLetterHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	if err := state.Store.Delete(hooks.DeadLetterBucket, ps.ByName("id")); err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to delete dead letter", 500)
+		return
+	}
+
+	js, _ := json.Marshal(Result{State: "OK"})
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title replayDeadLetterHandler
+// @Description Run a dead-lettered hook again, removing it from the list when it succeeds
+// @Param id       path   string  true   "Dead letter id"
+// @Param dry_run  query  bool    false  "Render and log the hook without executing it"
+// @Success 200 {object} string "Hook result"
+// @Failure 404 {object} string "No such dead letter"
+// @Failure 500 {object} string "Hook result of the failed execution"
+// @Router /api/v1/dead-letters/{id}/replay [POST]
+func replayDeadLetterHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hc := hooks.NewHookContext("", request)
+	hc.DryRun = hc.DryRun || config.HookDryRun
+
+	hookResult, err := hooks.ReplayDeadLetter(state, ps.ByName("id"), config, hc)
+	if err == hooks.ErrUnknownDeadLetter {
+		httpError(response, request, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	js, _ := json.Marshal(hookResult)
+	response.Header().Set("content-type", "application/json")
+	if err != nil {
+		logRequest(request, err)
+		response.WriteHeader(http.StatusInternalServerError)
+	}
+	response.Write(js)
+}
+
+// @Title status
+// @Description Dictionary with machines and its status
+// @Param drift  query  bool  false  "Hosts whose definition drifted since their last completed build instead"
+// @Success 200    {object} string "Dictionary with machines and its status"
+// @Success 200    {object} string "{<hostname>: {"Hostname": <hostname>, "Token": <token>, "Installed": <time>, "Checked": <time>, "Changes": [<change>]}}"
+// @Success 304    {object} string "Not modified since the ETag given in If-None-Match"
+// @Router /status [GET]
+func status(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	if drift, _ := strconv.ParseBool(request.URL.Query().Get("drift")); drift {
+		drifted := map[string]*statepkg.ConfigDrift{}
+		if state.Drift != nil {
+			drifted = state.Drift.List()
+		}
+		js, _ := json.Marshal(drifted)
+		response.Header().Set("content-type", "application/json")
+		response.Write(js)
+		return
+	}
+
+	state.Mux.Lock()
+	// Only re-marshal when the state has changed since the last request
+	if state.StatusCache == nil || state.StatusCacheVersion != state.Version {
+		state.StatusCache, _ = json.Marshal(&state.MachineByHostname)
+		state.StatusCacheVersion = state.Version
+	}
+	result := state.StatusCache
+	state.Mux.Unlock()
+
+	// The version starts over with every waitron, the body doesn't
+	writeJSONWithETag(response, request, result)
+}
+
+// @Title driftCheckHandler
+// @Description Check hosts for drift since their last completed build right away
+// @Param hostname  query  string  false  "Only check this host"
+// @Success 200 {object} string "{<hostname>: {"Hostname": <hostname>, "Token": <token>, "Installed": <time>, "Checked": <time>, "Changes": [<change>]}}"
+// @Failure 500 {object} string "Unable to check for drift"
+// @Router /api/v1/drift-checks [POST]
+func driftCheckHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	drifted := map[string]*statepkg.ConfigDrift{}
+	var err error
+	if hostname := request.URL.Query().Get("hostname"); hostname != "" {
+		var drift *statepkg.ConfigDrift
+		if drift, err = state.Drift.CheckHost(hostname); drift != nil {
+			drifted[drift.Hostname] = drift
+		}
+	} else {
+		drifted, err = state.Drift.CheckAll()
+	}
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to check for drift", http.StatusInternalServerError)
+		return
+	}
+
+	js, _ := json.Marshal(drifted)
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title hostHistoryHandler
+// @Description How often a host was built, and its latest builds
+// @Param hostname  path  string  true  "Hostname"
+// @Success 200 {object} string "{"Hostname": <hostname>, "Builds": <n>, "Completed": <n>, "Cancelled": <n>, "Retries": <n>, "LastInstalled": <time>, "Entries": [{"Token": <token>, "Status": <status>, "OperatingSystem": <os>, "Profile": <profile>, "BuildStart": <time>, "BuildEnd": <time>, "Retries": <n>, "Versions": <versions>, "RollbackOf": <token>}]}"
+// @Failure 404 {object} string "No history for hostname"
+// @Failure 500 {object} string "Unable to load history"
+// @Router /history/{hostname} [GET]
+func hostHistoryHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := strings.ToLower(ps.ByName("hostname"))
+
+	h, err := statepkg.LoadHostHistory(state.Store, hostname)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to load history", http.StatusInternalServerError)
+		return
+	}
+	if h == nil {
+		httpError(response, request, fmt.Sprintf("No history for %s", hostname), http.StatusNotFound)
+		return
+	}
+
+	result, _ := json.Marshal(h)
+	response.Header().Set("content-type", "application/json")
+	response.Write(result)
+}
+
+// @Title getAnnotationsHandler
+// @Description Operator notes and annotations for a machine
+// @Param hostname  path  string  true  "Hostname"
+// @Success 200 {object} string "{"Notes": <notes>, "Annotations": {...}, "UpdatedAt": <time>}"
+// @Failure 404 {object} string "No annotations for hostname"
+// @Failure 500 {object} string "Unable to load annotations"
+// @Router /api/v1/machines/{hostname}/annotations [GET]
+func getAnnotationsHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := strings.ToLower(ps.ByName("hostname"))
+
+	a, err := statepkg.LoadAnnotations(state.Store, hostname)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to load annotations", http.StatusInternalServerError)
+		return
+	}
+	if a == nil {
+		httpError(response, request, fmt.Sprintf("No annotations for %s", hostname), http.StatusNotFound)
+		return
+	}
+
+	result, _ := json.Marshal(a)
+	response.Header().Set("content-type", "application/json")
+	response.Write(result)
+}
+
+// @Title putAnnotationsHandler
+// @Description Store operator notes and annotations for a machine
+// @Param hostname  path  string  true  "Hostname"
+// @Param body      body  string  true  "{"Notes": <notes>, "Annotations": {<key>: <value>}}"
+// @Success 200 {object} string "{"State": "OK"}"
+// @Failure 400 {object} string "Invalid annotations"
+// @Failure 500 {object} string "Unable to store annotations"
+// @Router /api/v1/machines/{hostname}/annotations [PUT]
+func putAnnotationsHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := strings.ToLower(ps.ByName("hostname"))
+
+	var a machine.Annotations
+	if err := json.NewDecoder(request.Body).Decode(&a); err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Invalid annotations", http.StatusBadRequest)
+		return
+	}
+
+	if err := state.SetAnnotations(hostname, &a); err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to store annotations", http.StatusInternalServerError)
+		return
+	}
+
+	result, _ := json.Marshal(&Result{State: "OK"})
+	response.Header().Set("content-type", "application/json")
+	response.Write(result)
+}
+
+// @Title deleteAnnotationsHandler
+// @Description Remove operator notes and annotations for a machine
+// @Param hostname  path  string  true  "Hostname"
+// @Success 200 {object} string "{"State": "OK"}"
+// @Failure 500 {object} string "Unable to delete annotations"
+// @Router /api/v1/machines/{hostname}/annotations [DELETE]
+func deleteAnnotationsHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	hostname := strings.ToLower(ps.ByName("hostname"))
+
+	if err := state.DeleteAnnotations(hostname); err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to delete annotations", http.StatusInternalServerError)
+		return
+	}
+
+	result, _ := json.Marshal(&Result{State: "OK"})
+	response.Header().Set("content-type", "application/json")
+	response.Write(result)
+}
+
+// @Title templateCacheDeleteHandler
+// @Description Drop cached template renders, for one machine or all of them
+// @Param hostname  query  string  false  "Only drop the renders of this machine"
+// @Success 200 {object} string "{"State": "OK", "Dropped": <count>}"
+// @Router /api/v1/template-cache [DELETE]
+func templateCacheDeleteHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	dropped := state.RenderCache.Invalidate(request.URL.Query().Get("hostname"))
+
+	js, _ := json.Marshal(struct {
+		State   string
+		Dropped int
+	}{"OK", dropped})
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title imageHandler
+// @Description Serve a boot image from the catalog, supporting Range and If-Range requests
+// @Param name  path  string  true  "Image name"
+// @Success 200 {object} string "Image contents"
+// @Success 206 {object} string "The requested range of the image"
+// @Failure 404 {object} string "Unknown image"
+// @Failure 503 {object} string "Image not downloaded yet"
+// @Router /images/{name} [GET]
+func imageHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	name := ps.ByName("name")
+
+	if state.Images == nil {
+		http.NotFound(response, request)
+		return
+	}
+	ready, err := state.Images.Ready(name)
+	if err == statepkg.ErrUnknownImage {
+		http.NotFound(response, request)
+		return
+	}
+	if !ready {
+		httpError(response, request, "Image not downloaded yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	f, info, err := templatepkg.OpenStaticFile(config.ImagePath, name)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to open image", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	if sum, err := templatepkg.Checksums.SumOpen(state.Images.File(name), f, info); err == nil {
+		response.Header().Set("ETag", `"`+sum+`"`)
+	}
+	http.ServeContent(response, request, name, info.ModTime(), f)
+}
+
+// @Title imagesHandler
+// @Description List the boot images in the catalog and how their last sync went
+// @Success 200 {array} string "[{"Name": <name>, "URL": <url>, "SHA256": <sum>, "Size": <bytes>, "Ready": <bool>, "Synced": <time>, "Error": <error>}]"
+// @Router /api/v1/images [GET]
+func imagesHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	images := []statepkg.ImageStatus{}
+	if state.Images != nil {
+		images = state.Images.List()
+	}
+
+	js, _ := json.Marshal(images)
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title syncImageHandler
+// @Description Download a boot image again if the local copy is missing or outdated
+// @Param name  path  string  true  "Image name"
+// @Success 200 {object} string "{"State": "OK"}"
+// @Failure 404 {object} string "Unknown image"
+// @Failure 502 {object} string "Unable to sync image"
+// @Router /api/v1/images/{name}/sync [POST]
+func syncImageHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+	if state.Images == nil {
+		httpError(response, request, "Unknown image", http.StatusNotFound)
+		return
+	}
+
+	if err := state.Images.Sync(ps.ByName("name")); err != nil {
+		if err == statepkg.ErrUnknownImage {
+			httpError(response, request, "Unknown image", http.StatusNotFound)
+			return
+		}
+		logRequest(request, err)
+		httpError(response, request, "Unable to sync image: "+err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	js, _ := json.Marshal(&Result{State: "OK"})
+	response.Header().Set("content-type", "application/json")
+	response.Write(js)
+}
+
+// @Title pixieHandler
+// @Description Dictionary with kernel, intrd(s) and commandline for pixiecore
+// @Param macaddr    path    string    true    "MacAddress"
+// @Success 200    {object} string "Dictionary with kernel, intrd(s) and commandline for pixiecore"
+// @Failure 404    {object} string "Not in build mode"
+// @Failure 500    {object} string "Unable to find host definition for hostname"
+// @Failure 504    {object} string "Timed out executing build-start or token-issued hooks of a default profile build"
+// @Router /v1/boot/{macaddr} [GET]
+func pixieHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+
+	macaddr := ps.ByName("macaddr")
+
+	state.Mux.Lock()
+	m, found := state.MachineByMAC[macaddr]
+	state.Mux.Unlock()
+
+	if !found && config.DefaultProfile != nil && config.DefaultProfile.BootUnknown {
+		var err error
+		if m, err = bootUnknown(macaddr, config, state, request); err != nil {
+			if e, ok := err.(*machine.HookStageError); ok {
+				hookError(response, request, e.Stage, e.Err)
+				return
+			}
+			logRequest(request, err)
+			httpError(response, request, "Unable to build with the default profile", 500)
+			return
+		}
+		found = m != nil
+	}
+
+	if found == false {
+		logRequest(request, found)
+		httpError(response, request, "Not in build mode or definition does not exist", 404)
+		return
+	}
+
+	at, err := m.AtSite(request, config)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to find host definition for hostname", 500)
+		return
+	}
+	pxeconfig, _ := at.PixieInit()
+	state.RecordPhase(m, machine.PhaseBootServed)
+	result, _ := json.Marshal(pxeconfig)
+	response.Write(result)
+}
+
+// @Title healthHandler
+// @Description Check that Waitron is running
+// @Success 200    {object} string "{"State": "OK"}"
+// @Router /health [GET]
+func healthHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+
+	result, _ := json.Marshal(&Result{State: "OK"})
+
+	fmt.Fprintf(response, string(result))
+}
+
+// @Title livezHandler
+// @Description Liveness probe, succeeds as long as Waitron is serving requests
+// @Success 200    {object} string "{"State": "OK"}"
+// @Router /livez [GET]
+func livezHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+
+	result, _ := json.Marshal(&Result{State: "OK"})
+
+	response.Header().Set("content-type", "application/json")
+	response.Write(result)
+}
+
+// @Title readyzHandler
+// @Description Readiness probe, verifies configured paths, state and templates
+// @Success 200    {object} string "{"State": "OK", "Checks": {...}}"
+// @Failure 503    {object} string "{"State": "NOT READY", "Checks": {...}}"
+// @Router /readyz [GET]
+func readyzHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+
+	ready, checks := readinessChecks(config, state)
+
+	r := readiness{State: "OK", Checks: checks}
+	code := http.StatusOK
+	if !ready {
+		r.State = "NOT READY"
+		code = http.StatusServiceUnavailable
+	}
+
+	result, _ := json.Marshal(&r)
+
+	response.Header().Set("content-type", "application/json")
+	response.WriteHeader(code)
+	response.Write(result)
+}
+
+// @Title eventsHandler
+// @Description Recent build and hook events
+// @Success 200    {array} string "List of events"
+// @Router /events [GET]
+func eventsHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+
+	result, _ := json.Marshal(state.Events.List())
+
+	response.Header().Set("content-type", "application/json")
+	response.Write(result)
+}
+
+// @Title buildStatsHandler
+// @Description Build counts and durations per operating system and group
+// @Param os       query string false "Only this operating system"
+// @Param group    query string false "Only this group"
+// @Success 200    {array} string "[{"OperatingSystem": <os>, "Group": <group>, "Completed": <n>, "Failed": <n>, "Cancelled": <n>, "Stale": <n>, "P50": <secs>, "P95": <secs>, "Max": <secs>, "Mean": <secs>}]"
+// @Router /stats/builds [GET]
+func buildStatsHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+
+	query := request.URL.Query()
+	result, _ := json.Marshal(state.Stats.List(query.Get("os"), query.Get("group")))
+
+	response.Header().Set("content-type", "application/json")
+	response.Write(result)
+}
+
+// @Title versionHandler
+// @Description Version, build metadata and checksum of the loaded configuration
+// @Success 200    {object} string "{"Version": <version>, "GitCommit": <commit>, "BuildDate": <date>, "ConfigChecksum": <sha256>, "DefinitionsCommit": <commit>}"
+// @Router /version [GET]
+func versionHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config, state *statepkg.State) {
+
+	info := configpkg.VersionInfo{
+		Version:        configpkg.Version,
+		GitCommit:      configpkg.GitCommit,
+		BuildDate:      configpkg.BuildDate,
+		ConfigChecksum: config.Checksum,
+	}
+	if state.Repo != nil {
+		info.DefinitionsCommit = state.Repo.Commit()
+	}
+	result, _ := json.Marshal(&info)
+
+	response.Header().Set("content-type", "application/json")
+	response.Write(result)
+}
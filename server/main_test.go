@@ -0,0 +1,344 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+// The tests read config.yaml, machines, groups and templates from the top of
+// the repository
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestPixieHandlerNotInBuildMode(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/boot/11:22:33:44:51", nil)
+	response := httptest.NewRecorder()
+	configuration, _ := config.LoadConfig("config.yaml")
+	ps := httprouter.Params{httprouter.Param{Key: "macaddr", Value: "1"}}
+
+	state := statepkg.New()
+
+	pixieHandler(response, request, ps, configuration, state)
+
+	expected := "Not in build mode"
+	if !strings.Contains(response.Body.String(), expected) {
+		t.Errorf("Reponse body is %s, expected %s", response.Body, expected)
+	}
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Response code is %v, should be 404", response.Code)
+	}
+}
+
+func TestPixieHandler(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/boot/de:ad:c0:de:ca:fe", nil)
+	response := httptest.NewRecorder()
+	configuration, _ := config.LoadConfig("config.yaml")
+	state := statepkg.New()
+
+	m, _ := machine.MachineDefinition("dns02.example.com", "machines", configuration)
+
+	ps := httprouter.Params{httprouter.Param{Key: "macaddr", Value: "de:ad:c0:de:ca:fe"}}
+	state.MachineByMAC["de:ad:c0:de:ca:fe"] = &m
+
+	pixieHandler(response, request, ps, configuration, state)
+	expected := "hostname=dns02.example.com"
+	if !strings.Contains(response.Body.String(), expected) {
+		t.Errorf("Reponse body is %s, expected %s", response.Body, expected)
+	}
+	if response.Code != http.StatusOK {
+		t.Errorf("Response code is %v, should be 200", response.Code)
+	}
+}
+
+func TestPixieHandlerNoMachineDefinition(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/boot/de:ad:c0:de:ca:fe", nil)
+	response := httptest.NewRecorder()
+	configuration, _ := config.LoadConfig("config.yaml")
+	ps := httprouter.Params{httprouter.Param{Key: "macaddr", Value: "de:ad:c0:de:ca:fe"}}
+
+	state := statepkg.New()
+
+	pixieHandler(response, request, ps, configuration, state)
+	expected := "Not in build mode or definition does not exist"
+	if !strings.Contains(response.Body.String(), expected) {
+		t.Errorf("Reponse body is %s, expected %s", response.Body, expected)
+	}
+	if response.Code != http.StatusNotFound {
+		t.Errorf("Response code is %v, should be 404", response.Code)
+	}
+}
+
+func TestMachinesHandlerList(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/list", nil)
+	response := httptest.NewRecorder()
+	configuration, _ := config.LoadConfig("config.yaml")
+	state := statepkg.New()
+
+	listMachinesHandler(response, request, nil, configuration, state)
+	expected := `["dns02.example.com.yaml"]`
+	if !strings.Contains(response.Body.String(), expected) {
+		t.Errorf("Reponse body is %s, expected %s", response.Body, expected)
+	}
+	if response.Code != http.StatusOK {
+		t.Errorf("Response code is %v, should be 200", response.Code)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/version", nil)
+	response := httptest.NewRecorder()
+	configuration := config.Config{Checksum: "abc123"}
+
+	versionHandler(response, request, nil, configuration, statepkg.New())
+	expected := `"ConfigChecksum":"abc123"`
+	if !strings.Contains(response.Body.String(), expected) {
+		t.Errorf("Reponse body is %s, expected %s", response.Body, expected)
+	}
+	if response.Code != http.StatusOK {
+		t.Errorf("Response code is %v, should be 200", response.Code)
+	}
+}
+
+func TestReadyzHandlerNotWarm(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/readyz", nil)
+	response := httptest.NewRecorder()
+	configuration, _ := config.LoadConfig("config.yaml")
+	state := statepkg.New()
+
+	readyzHandler(response, request, nil, configuration, state)
+	expected := "templates not parsed yet"
+	if !strings.Contains(response.Body.String(), expected) {
+		t.Errorf("Reponse body is %s, expected %s", response.Body, expected)
+	}
+	if response.Code != http.StatusServiceUnavailable {
+		t.Errorf("Response code is %v, should be 503", response.Code)
+	}
+}
+
+func TestReadyzHandler(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/readyz", nil)
+	response := httptest.NewRecorder()
+	configuration, _ := config.LoadConfig("config.yaml")
+	state := statepkg.New()
+
+	WarmTemplates(configuration, state)
+
+	readyzHandler(response, request, nil, configuration, state)
+	if response.Code != http.StatusOK {
+		t.Errorf("Response code is %v, should be 200: %s", response.Code, response.Body)
+	}
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	var seen string
+	h := RequestIDHandler(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		seen = config.RequestID(request)
+	}))
+
+	request, _ := http.NewRequest("GET", "/health", nil)
+	request.Header.Set("X-Request-ID", "abc-123")
+	response := httptest.NewRecorder()
+	h.ServeHTTP(response, request)
+
+	if seen != "abc-123" {
+		t.Errorf("Request ID is %q, expected abc-123", seen)
+	}
+	if response.Header().Get("X-Request-ID") != "abc-123" {
+		t.Errorf("Response X-Request-ID is %q, expected abc-123", response.Header().Get("X-Request-ID"))
+	}
+
+	request, _ = http.NewRequest("GET", "/health", nil)
+	response = httptest.NewRecorder()
+	h.ServeHTTP(response, request)
+
+	if seen == "" || response.Header().Get("X-Request-ID") != seen {
+		t.Errorf("Expected a generated request ID, got %q", seen)
+	}
+}
+
+func TestStatusETag(t *testing.T) {
+	configuration, _ := config.LoadConfig("config.yaml")
+	state := statepkg.New()
+
+	request, _ := http.NewRequest("GET", "/status", nil)
+	response := httptest.NewRecorder()
+	status(response, request, nil, configuration, state)
+
+	etag := response.Header().Get("ETag")
+	if etag == "" {
+		t.Fatalf("Expected an ETag on /status")
+	}
+
+	request.Header.Set("If-None-Match", etag)
+	response = httptest.NewRecorder()
+	status(response, request, nil, configuration, state)
+	if response.Code != http.StatusNotModified {
+		t.Errorf("Response code is %v, should be 304", response.Code)
+	}
+
+	// Another waitron, or this one restarted, counts its versions from 0 again
+	response = httptest.NewRecorder()
+	status(response, request, nil, configuration, statepkg.New())
+	if response.Code != http.StatusNotModified {
+		t.Errorf("Response code is %v, should be 304 from a waitron with the same machines", response.Code)
+	}
+
+	state.MachineByHostname["dns02.example.com"] = &machine.Machine{Hostname: "dns02.example.com"}
+	state.Version++
+	response = httptest.NewRecorder()
+	status(response, request, nil, configuration, state)
+	if response.Code != http.StatusOK {
+		t.Errorf("Response code is %v, should be 200 after a state change", response.Code)
+	}
+
+	request.Header.Set("If-None-Match", response.Header().Get("ETag"))
+	restarted := statepkg.New()
+	restarted.Version = state.Version
+	response = httptest.NewRecorder()
+	status(response, request, nil, configuration, restarted)
+	if response.Code != http.StatusOK {
+		t.Errorf("Response code is %v, should be 200 from a waitron with other machines at the same version", response.Code)
+	}
+}
+
+func TestAnnotationsHandlers(t *testing.T) {
+	configuration, _ := config.LoadConfig("config.yaml")
+	state := statepkg.New()
+	ps := httprouter.Params{httprouter.Param{Key: "hostname", Value: "dns02.example.com"}}
+
+	body := strings.NewReader(`{"Notes": "awaiting disk RMA", "Annotations": {"ticket": "OPS-1"}}`)
+	request, _ := http.NewRequest("PUT", "/api/v1/machines/dns02.example.com/annotations", body)
+	response := httptest.NewRecorder()
+	putAnnotationsHandler(response, request, ps, configuration, state)
+	if response.Code != http.StatusOK {
+		t.Errorf("Response code is %v, should be 200", response.Code)
+	}
+
+	request, _ = http.NewRequest("GET", "/api/v1/machines/dns02.example.com/annotations", nil)
+	response = httptest.NewRecorder()
+	getAnnotationsHandler(response, request, ps, configuration, state)
+	expected := "awaiting disk RMA"
+	if !strings.Contains(response.Body.String(), expected) {
+		t.Errorf("Reponse body is %s, expected %s", response.Body, expected)
+	}
+}
+
+func TestBuildConflict(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-build")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "node01.example.com.yaml"),
+		[]byte(`{"operatingsystem": "ubuntu", "network": [{"name": "eth0", "macaddress": "de:ad:be:ef:00:01"}]}`), 0644)
+	config := config.Config{MachinePath: dir, GroupPath: dir}
+	state := statepkg.New()
+	var cancelled []statepkg.Event
+	state.Events.Subscribe(func(e statepkg.Event) {
+		if e.Type == machine.EventBuildCancelled {
+			cancelled = append(cancelled, e)
+		}
+	})
+
+	build := func(query string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		buildHandler(response, httptest.NewRequest("PUT", "/build/node01.example.com"+query, nil),
+			httprouter.Params{httprouter.Param{Key: "hostname", Value: "node01.example.com"}}, config, state)
+		return response
+	}
+
+	if response := build(""); response.Code != http.StatusOK {
+		t.Fatalf("expected the build to start, got %d %s", response.Code, response.Body.String())
+	}
+	first := state.MachineByHostname["node01.example.com"]
+
+	response := build("")
+	var conflict buildConflict
+	if response.Code != http.StatusConflict || json.Unmarshal(response.Body.Bytes(), &conflict) != nil ||
+		conflict.Build == nil || conflict.Build.Hostname != "node01.example.com" || conflict.Build.Status != "Installing" {
+		t.Fatalf("expected a conflict with the build in progress, got %d %s", response.Code, response.Body.String())
+	}
+	if state.MachineByHostname["node01.example.com"] != first || len(cancelled) != 0 {
+		t.Error("expected the build in progress to be left alone")
+	}
+
+	if response := build("?force=true"); response.Code != http.StatusOK {
+		t.Fatalf("expected the forced build to start, got %d %s", response.Code, response.Body.String())
+	}
+	if len(cancelled) != 1 || cancelled[0].Message != "replaced by a forced build" {
+		t.Errorf("expected the build in progress to be cancelled, got %+v", cancelled)
+	}
+	if second := state.MachineByHostname["node01.example.com"]; second == nil || second == first || second.Status != "Installing" {
+		t.Errorf("expected a new build, got %+v", second)
+	}
+}
+
+func TestForcedBuildCancelsUnlocked(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-build")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "node01.example.com.yaml"),
+		[]byte(`{"operatingsystem": "ubuntu", "network": [{"name": "eth0", "macaddress": "de:ad:be:ef:00:01"}]}`), 0644)
+	// The cancel command of the replaced build waits for the test to let it finish
+	release, cancelled := filepath.Join(dir, "release"), filepath.Join(dir, "cancelled")
+	config := config.Config{MachinePath: dir, GroupPath: dir, CancelBuildCommands: []config.BuildCommand{{
+		Command:        "sh -c 'while [ ! -e " + release + " ]; do sleep 0.01; done; touch " + cancelled + "'",
+		TimeoutSeconds: 10,
+	}}}
+	state := statepkg.New()
+
+	build := func(query string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		buildHandler(response, httptest.NewRequest("PUT", "/build/node01.example.com"+query, nil),
+			httprouter.Params{httprouter.Param{Key: "hostname", Value: "node01.example.com"}}, config, state)
+		return response
+	}
+	if response := build(""); response.Code != http.StatusOK {
+		t.Fatalf("expected the build to start, got %d %s", response.Code, response.Body.String())
+	}
+	first := state.BuildInProgress("node01.example.com")
+
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() { done <- build("?force=true") }()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if current := state.BuildInProgress("node01.example.com"); current != nil && current != first {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected the forced build to be armed before the cancel command finishes")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		state.BuildRequestMux.Lock()
+		state.BuildRequestMux.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected build requests not to wait for the cancel command of the replaced build")
+	}
+
+	ioutil.WriteFile(release, nil, 0644)
+	if response := <-done; response.Code != http.StatusOK {
+		t.Fatalf("expected the forced build to start, got %d %s", response.Code, response.Body.String())
+	}
+	if _, err := os.Stat(cancelled); err != nil {
+		t.Error("expected the cancel command of the replaced build to run")
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/state"
+)
+
+// With management_address set, the main listener only serves what machines
+// need while they are being provisioned: boot parameters, templates, build
+// status, files and images, and the health probes. Everything else, the
+// machine and hook APIs, events, stats and the debug endpoints, is only
+// served on the management listener, which also serves everything the main
+// listener does.
+
+var provisioningPrefixes = []string{
+	"/v1/boot/",
+	"/template/",
+	"/done/",
+	"/validate/",
+	"/phone-home/",
+	"/artifacts/",
+	"/firmware/",
+	"/raid/",
+	"/burnin/",
+	"/wipe/",
+	"/cancel/",
+	"/heartbeat/",
+	"/status/",
+	"/files/",
+	"/images/",
+}
+
+var provisioningPaths = map[string]bool{
+	"/status": true,
+	"/health": true,
+	"/livez":  true,
+	"/readyz": true,
+}
+
+func isProvisioningPath(p string) bool {
+	p = path.Clean("/" + p)
+	if provisioningPaths[p] {
+		return true
+	}
+	for _, prefix := range provisioningPrefixes {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+type managementKey struct{}
+
+// Mark requests that came in on the management listener
+func managementListener(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		ctx := context.WithValue(request.Context(), managementKey{}, true)
+		h.ServeHTTP(response, request.WithContext(ctx))
+	})
+}
+
+func fromManagement(request *http.Request) bool {
+	management, _ := request.Context().Value(managementKey{}).(bool)
+	return management
+}
+
+// Only let requests from the management listener reach the management
+// endpoints, everything else gets a 404 like an unknown route would
+func splitListeners(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if !fromManagement(request) && !isProvisioningPath(request.URL.Path) {
+			http.NotFound(response, request)
+			return
+		}
+		h.ServeHTTP(response, request)
+	})
+}
+
+// The router plus the debug endpoints, behind the split between listeners
+func ManagementHandler(router http.Handler, state *state.State) http.Handler {
+	publishExpvars(state)
+
+	mux := http.NewServeMux()
+	mux.Handle("/debug/", adminHandler(state))
+	mux.Handle("/", router)
+	return splitListeners(mux)
+}
+
+// Serve handler on l, or address when l is nil, in the background, marking
+// its requests as management requests
+func StartManagement(address string, l net.Listener, handler http.Handler, config config.ServerConfig) (*http.Server, error) {
+	if l == nil {
+		var err error
+		if l, err = Listen(address, config); err != nil {
+			return nil, err
+		}
+	}
+	logger.Info("starting management server", "address", l.Addr().String(), "tls", config.TLSCertFile != "")
+
+	srv := NewHTTPServer(address, managementListener(handler), config)
+	go func() {
+		if err := Serve(srv, l, config); err != http.ErrServerClosed {
+			logger.Fatal("management server stopped", "error", err)
+		}
+	}()
+	return srv, nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ns1/waitron/state"
+)
+
+func TestIsProvisioningPath(t *testing.T) {
+	for _, p := range []string{"/v1/boot/00:11:22:33:44:55", "/template/preseed/host/token", "/done/host/token",
+		"/status", "/status/host", "/files/linux", "/images/linux", "/readyz"} {
+		if !isProvisioningPath(p) {
+			t.Errorf("expected %s to be served to machines", p)
+		}
+	}
+	for _, p := range []string{"/list", "/build/host", "/api/v1/images", "/debug/vars", "/events",
+		"/stats/builds", "/files/../list", "/statuses"} {
+		if isProvisioningPath(p) {
+			t.Errorf("expected %s to be management only", p)
+		}
+	}
+}
+
+func TestSplitListeners(t *testing.T) {
+	handler := splitListeners(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		response.Write([]byte("ok"))
+	}))
+
+	serve := func(h http.Handler, path string) int {
+		response := httptest.NewRecorder()
+		h.ServeHTTP(response, httptest.NewRequest("GET", path, nil))
+		return response.Code
+	}
+
+	if code := serve(handler, "/list"); code != http.StatusNotFound {
+		t.Errorf("expected /list to be hidden from the main listener, got %d", code)
+	}
+	if code := serve(handler, "/status"); code != http.StatusOK {
+		t.Errorf("expected /status on the main listener, got %d", code)
+	}
+	if code := serve(managementListener(handler), "/list"); code != http.StatusOK {
+		t.Errorf("expected /list on the management listener, got %d", code)
+	}
+	if code := serve(managementListener(handler), "/status"); code != http.StatusOK {
+		t.Errorf("expected /status on the management listener, got %d", code)
+	}
+}
+
+func TestManagementHandlerDebug(t *testing.T) {
+	handler := ManagementHandler(http.NotFoundHandler(), state.New())
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest("GET", "/debug/state", nil))
+	if response.Code != http.StatusNotFound {
+		t.Errorf("expected /debug/state to be hidden from the main listener, got %d", response.Code)
+	}
+
+	response = httptest.NewRecorder()
+	managementListener(handler).ServeHTTP(response, httptest.NewRequest("GET", "/debug/state", nil))
+	if response.Code != http.StatusOK {
+		t.Errorf("expected /debug/state on the management listener, got %d", response.Code)
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/state"
+	templatepkg "github.com/ns1/waitron/template"
+	uuid "github.com/satori/go.uuid"
+)
+
+// The versions listed at /, any other date is taken as well
+var metadataVersions = []string{"1.0", "2009-04-04", "2016-09-02", "2018-09-24", "2021-03-23", "latest"}
+
+var metadataVersion = regexp.MustCompile(`^(latest|1\.0|\d{4}-\d{2}-\d{2})$`)
+
+// Stable across builds so cloud-init only runs its per instance modules on a
+// new install
+func metadataInstanceID(hostname string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(hostname)))
+	return "i-" + hex.EncodeToString(sum[:])[:17]
+}
+
+// The name a key goes by in public-keys/, its comment when it has one
+func publicKeyName(key string, n int) string {
+	if fields := strings.Fields(key); len(fields) > 2 {
+		return strings.Join(fields[2:], " ")
+	}
+	return fmt.Sprintf("key-%d", n)
+}
+
+// The meta-data of m by path, the directories are made up from the paths
+func machineMetadata(m *machine.Machine, ip net.IP) map[string]string {
+	md := map[string]string{
+		"instance-id":    metadataInstanceID(m.Hostname),
+		"hostname":       m.Hostname,
+		"local-hostname": m.Hostname,
+	}
+	if ip.To4() != nil {
+		md["local-ipv4"] = ip.String()
+	}
+	for _, i := range m.Network {
+		if i.MacAddress != "" {
+			md["mac"] = strings.ToLower(i.MacAddress)
+			break
+		}
+	}
+	for n, key := range m.PublicKeys {
+		md[fmt.Sprintf("public-keys/%d/openssh-key", n)] = strings.TrimSpace(key)
+	}
+	return md
+}
+
+// The entries of dir, subdirectories with a trailing slash. EC2 lists public
+// keys as index=name.
+func metadataListing(md map[string]string, dir string, m *machine.Machine) ([]string, bool) {
+	prefix := dir + "/"
+	if dir == "" {
+		prefix = ""
+	}
+	entries := make(map[string]bool)
+	for p := range md {
+		if !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(p, prefix)
+		if i := strings.Index(rest, "/"); i >= 0 {
+			rest = rest[:i+1]
+		}
+		entries[rest] = true
+	}
+	if len(entries) == 0 {
+		return nil, false
+	}
+
+	if dir == "public-keys" {
+		var keys []string
+		for n, key := range m.PublicKeys {
+			keys = append(keys, fmt.Sprintf("%d=%s", n, publicKeyName(key, n)))
+		}
+		return keys, true
+	}
+	var list []string
+	for e := range entries {
+		list = append(list, e)
+	}
+	sort.Strings(list)
+	return list, true
+}
+
+func metadataText(response http.ResponseWriter, text string) {
+	response.Header().Set("content-type", "text/plain")
+	io.WriteString(response, text)
+}
+
+// The metadata service, on its own mux so nothing else is reachable through
+// 169.254.169.254
+func metadataHandler(config configpkg.Config, state *state.State) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		parts := strings.SplitN(strings.Trim(request.URL.Path, "/"), "/", 3)
+		if parts[0] == "" {
+			metadataText(response, strings.Join(metadataVersions, "\n"))
+			return
+		}
+		if !metadataVersion.MatchString(parts[0]) || len(parts) < 2 {
+			httpError(response, request, "Not found", http.StatusNotFound)
+			return
+		}
+
+		if parts[1] == "api" && len(parts) == 3 && parts[2] == "token" {
+			if request.Method != "PUT" {
+				httpError(response, request, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			token, err := uuid.NewV4()
+			if err != nil {
+				logRequest(request, err)
+				httpError(response, request, "Unable to create token", http.StatusInternalServerError)
+				return
+			}
+			response.Header().Set("X-aws-ec2-metadata-token-ttl-seconds", request.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"))
+			metadataText(response, token.String())
+			return
+		}
+		if request.Method != "GET" && request.Method != "HEAD" {
+			httpError(response, request, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		host, _, err := net.SplitHostPort(request.RemoteAddr)
+		if err != nil {
+			host = request.RemoteAddr
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			httpError(response, request, "Not found", http.StatusNotFound)
+			return
+		}
+		m, building, err := state.MachineByAddress(ip, config)
+		if err != nil {
+			logRequest(request, err)
+			httpError(response, request, "Unable to find the machine", http.StatusInternalServerError)
+			return
+		}
+		if m == nil {
+			configpkg.RequestLogger(request).Warn("metadata request from an unknown address", "remote", ip.String())
+			httpError(response, request, "No machine with this address", http.StatusNotFound)
+			return
+		}
+
+		switch parts[1] {
+		case "meta-data":
+			serveMachineMetadata(response, request, m, ip, parts)
+		case "user-data":
+			if len(parts) > 2 {
+				httpError(response, request, "Not found", http.StatusNotFound)
+				return
+			}
+			serveUserData(response, request, m, building, config, state)
+		default:
+			httpError(response, request, "Not found", http.StatusNotFound)
+		}
+	})
+}
+
+func serveMachineMetadata(response http.ResponseWriter, request *http.Request, m *machine.Machine, ip net.IP, parts []string) {
+	md := machineMetadata(m, ip)
+	p := ""
+	if len(parts) > 2 {
+		p = strings.Trim(parts[2], "/")
+	}
+	if value, found := md[p]; found {
+		metadataText(response, value)
+		return
+	}
+	// public-keys/0 is also public-keys/0=name
+	if i := strings.Index(p, "="); i >= 0 && strings.HasPrefix(p, "public-keys/") {
+		p = p[:i]
+	}
+	list, found := metadataListing(md, p, m)
+	if !found {
+		httpError(response, request, "Not found", http.StatusNotFound)
+		return
+	}
+	metadataText(response, strings.Join(list, "\n"))
+}
+
+// The cloud-init template of m, which EC2 answers with 404 when there is none
+func serveUserData(response http.ResponseWriter, request *http.Request, m *machine.Machine, building bool, config configpkg.Config, state *state.State) {
+	template := m.Hostname + ".cloud-init"
+	file := configpkg.JoinLocation(config.MachinePath, template)
+	if _, err := configpkg.StorageFor(file).ModTime(file); err != nil {
+		httpError(response, request, "No user data", http.StatusNotFound)
+		return
+	}
+	config.TemplatePath = config.MachinePath
+
+	at, err := m.AtSite(request, config)
+	var rendered string
+	if err == nil && at.TemplateCache {
+		rendered, err = state.RenderCache.Render(at, template, config)
+	} else if err == nil {
+		rendered, err = templatepkg.Render(*at, template, config)
+	}
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to render user data", http.StatusInternalServerError)
+		return
+	}
+	if building {
+		// On the build, m is a snapshot of it
+		if live := state.MachineByToken(m.Token); live != nil {
+			state.RecordPhase(live, machine.PhaseCloudInit)
+		}
+	}
+	response.Header().Set("content-type", "application/octet-stream")
+	io.WriteString(response, rendered)
+}
+
+// Serve the metadata service on config.Metadata.Address in the background
+func StartMetadata(config configpkg.Config, state *state.State) error {
+	l, err := net.Listen("tcp", config.Metadata.Address)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("starting metadata server", "address", l.Addr().String())
+	go func() {
+		err := NewHTTPServer(config.Metadata.Address, metadataHandler(config, state), configpkg.ServerConfig{}).Serve(l)
+		logger.Error("metadata server stopped", "error", err)
+	}()
+	return nil
+}
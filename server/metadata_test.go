@@ -0,0 +1,91 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/state"
+)
+
+func TestMetadataHandler(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-metadata")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "node02.example.com.yaml"),
+		[]byte(`{"network": [{"name": "eth0", "addresses4": [{"ipaddress": "192.0.2.20", "cidr": "24"}]}]}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "node02.example.com.cloud-init"), []byte("#cloud-config\nfqdn: {{ machine.Hostname }}\n"), 0644)
+
+	state := state.New()
+	state.MachineByHostname["node01.example.com"] = &machine.Machine{
+		Hostname: "node01.example.com",
+		Network:  []machine.Interface{{Name: "eth0", MacAddress: "DE:AD:BE:EF:00:01", Addresses4: []machine.IPConfig{{IPAddress: "192.0.2.10"}}}},
+		Config:   config.Config{PublicKeys: []string{"ssh-ed25519 AAAAC3Nza ops@example.com", "ssh-rsa AAAAB3Nza"}},
+	}
+	handler := metadataHandler(config.Config{MachinePath: dir, GroupPath: dir}, state)
+
+	get := func(method string, path string, remote string, header ...string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, path, nil)
+		request.RemoteAddr = remote
+		for i := 0; i+1 < len(header); i += 2 {
+			request.Header.Set(header[i], header[i+1])
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	for path, expected := range map[string]string{
+		"/latest/meta-data/":                               "hostname\ninstance-id\nlocal-hostname\nlocal-ipv4\nmac\npublic-keys/",
+		"/2009-04-04/meta-data/instance-id":                metadataInstanceID("node01.example.com"),
+		"/latest/meta-data/local-hostname":                 "node01.example.com",
+		"/latest/meta-data/local-ipv4":                     "192.0.2.10",
+		"/latest/meta-data/mac":                            "de:ad:be:ef:00:01",
+		"/latest/meta-data/public-keys/":                   "0=ops@example.com\n1=key-1",
+		"/latest/meta-data/public-keys/1/":                 "openssh-key",
+		"/latest/meta-data/public-keys/0/openssh-key":      "ssh-ed25519 AAAAC3Nza ops@example.com",
+		"/latest/meta-data/public-keys/0=ops@example.com/": "openssh-key",
+	} {
+		response := get("GET", path, "192.0.2.10:40000")
+		if response.Code != http.StatusOK || response.Body.String() != expected {
+			t.Errorf("%s: expected %q, got %d %q", path, expected, response.Code, response.Body.String())
+		}
+	}
+	if id := metadataInstanceID("node01.example.com"); !strings.HasPrefix(id, "i-") || len(id) != 19 {
+		t.Errorf("unexpected instance id %s", id)
+	}
+
+	// Not being built, found through the inventory
+	response := get("GET", "/latest/user-data", "192.0.2.20:40000")
+	if response.Code != http.StatusOK || response.Body.String() != "#cloud-config\nfqdn: node02.example.com\n" {
+		t.Errorf("unexpected user data %d %q", response.Code, response.Body.String())
+	}
+	if response := get("GET", "/latest/meta-data/public-keys/", "192.0.2.20:40000"); response.Code != http.StatusNotFound {
+		t.Errorf("expected no public keys, got %d %q", response.Code, response.Body.String())
+	}
+	if response := get("GET", "/latest/user-data", "192.0.2.10:40000"); response.Code != http.StatusNotFound {
+		t.Errorf("expected no user data without a cloud-init template, got %d", response.Code)
+	}
+
+	for _, path := range []string{"/latest/meta-data/instance-id", "/latest/user-data"} {
+		if response := get("GET", path, "198.51.100.1:40000"); response.Code != http.StatusNotFound {
+			t.Errorf("%s: expected an unknown address to get 404, got %d", path, response.Code)
+		}
+	}
+	if response := get("GET", "/v2/meta-data/instance-id", "192.0.2.10:40000"); response.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown version to get 404, got %d", response.Code)
+	}
+
+	response = get("PUT", "/latest/api/token", "192.0.2.10:40000", "X-aws-ec2-metadata-token-ttl-seconds", "21600")
+	if response.Code != http.StatusOK || response.Header().Get("X-aws-ec2-metadata-token-ttl-seconds") != "21600" {
+		t.Errorf("expected an IMDSv2 token, got %d", response.Code)
+	}
+	if response := get("GET", "/latest/api/token", "192.0.2.10:40000"); response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected tokens to take a PUT, got %d", response.Code)
+	}
+}
@@ -0,0 +1,22 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ns1/waitron/state"
+)
+
+// Count and time every request
+func MetricsHandler(sink state.MetricSink, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		start := time.Now()
+		recorder := &state.StatusRecorder{ResponseWriter: response, Status: http.StatusOK}
+		h.ServeHTTP(recorder, request)
+
+		tags := []state.MetricTag{{Name: "method", Value: request.Method}, {Name: "status", Value: strconv.Itoa(recorder.Status)}}
+		sink.Count("http.requests", 1, tags...)
+		sink.Timing("http.duration", time.Since(start), tags...)
+	})
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/state"
+)
+
+type fakeMetricSink struct {
+	mux     sync.Mutex
+	counts  map[string]int64
+	timings map[string]int
+	tags    map[string][]state.MetricTag
+}
+
+func newFakeMetricSink() *fakeMetricSink {
+	return &fakeMetricSink{counts: map[string]int64{}, timings: map[string]int{}, tags: map[string][]state.MetricTag{}}
+}
+
+func (s *fakeMetricSink) Count(name string, value int64, tags ...state.MetricTag) {
+	s.mux.Lock()
+	s.counts[name] += value
+	s.tags[name] = tags
+	s.mux.Unlock()
+}
+
+func (s *fakeMetricSink) Gauge(name string, value float64, tags ...state.MetricTag) {}
+
+func (s *fakeMetricSink) Timing(name string, d time.Duration, tags ...state.MetricTag) {
+	s.mux.Lock()
+	s.timings[name]++
+	s.mux.Unlock()
+}
+
+func TestMetricsHandler(t *testing.T) {
+	sink := newFakeMetricSink()
+	h := MetricsHandler(sink, http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		http.Error(response, "nope", http.StatusNotFound)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/status/unknown", nil))
+
+	if sink.counts["http.requests"] != 1 || sink.timings["http.duration"] != 1 {
+		t.Errorf("expected the request to be counted and timed")
+	}
+	if tags := sink.tags["http.requests"]; tags[1].Value != "404" {
+		t.Errorf("expected the status tag to be 404, got %v", tags)
+	}
+}
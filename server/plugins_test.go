@@ -0,0 +1,36 @@
+package server
+
+import (
+	"io/ioutil"
+	"path"
+	"testing"
+)
+
+const testPlugin = `#!/bin/sh
+input=$(cat)
+case "$input" in
+  *'"Action":"info"'*) echo '{"Name":"test","Types":["hook","inventory"]}' ;;
+  *'"Action":"health"'*) echo '{}' ;;
+  *'"Action":"machine"'*'"Hostname":"dns02.example.com"'*) echo '{"Found":true,"Machine":{"params":{"rack":"r1"}}}' ;;
+  *'"Action":"machine"'*) echo '{"Found":false}' ;;
+  *'"Action":"mac"'*'"MacAddress":"de:ad:c0:de:ca:fe"'*) echo '{"Found":true,"Hostname":"dns02.example.com"}' ;;
+  *'"Action":"mac"'*) echo '{"Found":false}' ;;
+  *'"Action":"hook"'*) echo '{"Output":"hooked"}' ;;
+esac
+`
+
+const unhealthyPlugin = `#!/bin/sh
+input=$(cat)
+case "$input" in
+  *'"Action":"info"'*) echo '{"Name":"broken","Types":["hook"]}' ;;
+  *) echo '{"Error":"backend unreachable"}' ;;
+esac
+`
+
+func pluginDir(t *testing.T) string {
+	dir, _ := ioutil.TempDir("", "waitron-plugins")
+	ioutil.WriteFile(path.Join(dir, "test-plugin"), []byte(testPlugin), 0700)
+	ioutil.WriteFile(path.Join(dir, "broken-plugin"), []byte(unhealthyPlugin), 0700)
+	ioutil.WriteFile(path.Join(dir, "README"), []byte("not a plugin"), 0600)
+	return dir
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+// Take a report the host posts about a stage of its build: the body is
+// decoded into target and report is called with the build's token. invalid
+// is the answer to a body that can't be decoded, notInStage the one to a
+// build that isn't in the stage.
+func stageReportHandler(response http.ResponseWriter, request *http.Request, ps httprouter.Params, state *statepkg.State,
+	target interface{}, report func(token string) error, invalid string, notInStage string) {
+	hostname := ps.ByName("hostname")
+	token := ps.ByName("token")
+
+	state.Mux.Lock()
+	valid := token == state.Tokens[hostname]
+	state.Mux.Unlock()
+
+	if !valid {
+		httpError(response, request, "Invalid Token", 401)
+		return
+	}
+
+	var err error
+	if d, ok := target.(statepkg.RequestDecoder); ok {
+		err = d.DecodeRequest(request)
+	} else {
+		err = json.NewDecoder(request.Body).Decode(target)
+	}
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, invalid, 400)
+		return
+	}
+
+	if err := report(token); err != nil {
+		logRequest(request, err)
+		if err == statepkg.ErrUnknownBuild {
+			httpError(response, request, "Not in build mode or definition does not exist", 400)
+		} else {
+			httpError(response, request, notInStage, http.StatusConflict)
+		}
+		return
+	}
+
+	result, _ := json.Marshal(&Result{State: "OK"})
+	response.Header().Set("content-type", "application/json")
+	response.Write(result)
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+// Put dns02.example.com in build mode with the pre-install stages stages
+// gives it, keeping the events of eventType and EventBuildFailed
+func preinstallBuild(t *testing.T, eventType string, stages func(m *machine.Machine)) (*statepkg.State, *machine.Machine, *[]statepkg.Event) {
+	state := statepkg.New()
+	var events []statepkg.Event
+	state.Events.Subscribe(func(e statepkg.Event) {
+		if e.Type == eventType || e.Type == machine.EventBuildFailed {
+			events = append(events, e)
+		}
+	})
+	m := machine.Machine{Hostname: "dns02.example.com", Network: []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}}
+	m.Kernel, m.Cmdline = "linux", "auto=true"
+	stages(&m)
+	token, err := state.SetBuildMode(m, config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return state, state.MachineByToken(token), &events
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/hooks"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+// Start a build with the default profile for a MAC address pixiecore asked
+// about. nil when the MAC address belongs to a machine that has a definition,
+// those are only built when asked to, and when that can't be ruled out:
+// pattern definitions don't have the MAC addresses of the machines they
+// match, and inventory plugins are asked but may not know or answer.
+func bootUnknown(mac string, config config.Config, state *statepkg.State, request *http.Request) (*machine.Machine, error) {
+	machine.UnknownBootMux.Lock()
+	defer machine.UnknownBootMux.Unlock()
+
+	state.Mux.Lock()
+	building, found := state.MachineByMAC[mac]
+	state.Mux.Unlock()
+	if found {
+		return building, nil
+	}
+
+	inv, err := state.InventoryFor(config)
+	if err != nil {
+		return nil, err
+	}
+	if _, found := inv.LookupMAC(mac); found {
+		return nil, nil
+	}
+	if hostname, err := machine.MachineForMACFromPlugins(config, mac); err != nil || hostname != "" {
+		if err != nil {
+			logger.Warn("not building an unknown MAC address, inventory plugins can't tell whose it is", "macaddress", mac, "error", err)
+		}
+		return nil, nil
+	}
+	if patterns, err := machine.HasPatternDefinitions(config); err != nil || patterns {
+		logger.Warn("not building an unknown MAC address, it may be that of a machine a pattern defines", "macaddress", mac, "error", err)
+		return nil, nil
+	}
+
+	hostname, err := config.DefaultProfile.HostnameFor(mac)
+	if err != nil {
+		return nil, err
+	}
+	m, err := machine.BuildDefinition(hostname, mac, config)
+	if err != nil {
+		return nil, err
+	}
+	if !m.DefaultProfile {
+		// The hostname has a definition after all, without this MAC address
+		return nil, nil
+	}
+
+	if err := hooks.ExecuteHooks(machine.StageBuildStart, &m, config, state, request); err != nil {
+		return nil, &machine.HookStageError{Stage: machine.StageBuildStart, Err: err}
+	}
+	state.BuildRequestMux.Lock()
+	if state.BuildInProgress(m.Hostname) != nil {
+		// A build request for the hostname got there first
+		state.BuildRequestMux.Unlock()
+		return nil, nil
+	}
+	token, err := state.SetBuildMode(m, config)
+	state.BuildRequestMux.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	built := state.MachineByToken(token)
+	if err := hooks.ExecuteHooks(machine.StageTokenIssued, built, config, state, request); err != nil {
+		return nil, &machine.HookStageError{Stage: machine.StageTokenIssued, Err: err}
+	}
+	return built, nil
+}
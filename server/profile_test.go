@@ -0,0 +1,156 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestDefaultProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "node01.example.com.yaml"),
+		[]byte(`{"operatingsystem": "ubuntu", "network": [{"name": "eth0", "macaddress": "de:ad:be:ef:00:01"}]}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "discovery.example.com.yaml"), []byte(`{"params": {"group": "discovery"}}`), 0644)
+
+	config := config.Config{MachinePath: dir, GroupPath: dir, DefaultProfile: &config.DefaultProfileConfig{
+		BootUnknown: true,
+		Hostname:    "{{ mac }}.discovery.example.com",
+		Definition:  map[string]interface{}{"operatingsystem": "debian", "cmdline": "discover"},
+	}}
+	state := statepkg.New()
+
+	boot := func(mac string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		pixieHandler(response, httptest.NewRequest("GET", "/v1/boot/"+mac, nil),
+			httprouter.Params{httprouter.Param{Key: "macaddr", Value: mac}}, config, state)
+		return response
+	}
+
+	if response := boot("aa:bb:cc:dd:ee:ff"); response.Code != http.StatusOK {
+		t.Fatalf("expected an unknown MAC address to boot, got %d %s", response.Code, response.Body.String())
+	}
+	m := state.MachineByMAC["aa:bb:cc:dd:ee:ff"]
+	if m == nil || m.Hostname != "aa-bb-cc-dd-ee-ff.discovery.example.com" || !m.DefaultProfile ||
+		m.OperatingSystem != "debian" || m.Params["group"] != "discovery" {
+		t.Fatalf("unexpected machine %+v", m)
+	}
+	token := m.Token
+
+	// Asking again boots the same build
+	boot("aa:bb:cc:dd:ee:ff")
+	if state.MachineByMAC["aa:bb:cc:dd:ee:ff"].Token != token || len(state.Tokens) != 1 {
+		t.Errorf("expected a single build, got tokens %v", state.Tokens)
+	}
+
+	// Machines with a definition are only built when asked to
+	if response := boot("de:ad:be:ef:00:01"); response.Code != http.StatusNotFound {
+		t.Errorf("expected a known MAC address not to boot, got %d", response.Code)
+	}
+
+	response := httptest.NewRecorder()
+	buildHandler(response, httptest.NewRequest("PUT", "/build/new01.example.com?mac=aa:bb:cc:dd:ee:01", nil),
+		httprouter.Params{httprouter.Param{Key: "hostname", Value: "new01.example.com"}}, config, state)
+	var r Result
+	json.Unmarshal(response.Body.Bytes(), &r)
+	if built := state.MachineByToken(r.Token); built == nil || !built.DefaultProfile || built.Network[0].MacAddress != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("expected a default profile build, got %+v %s", built, response.Body.String())
+	}
+
+	config.DefaultProfile = nil
+	response = httptest.NewRecorder()
+	buildHandler(response, httptest.NewRequest("PUT", "/build/new02.example.com", nil),
+		httprouter.Params{httprouter.Param{Key: "hostname", Value: "new02.example.com"}}, config, state)
+	if response.Code != http.StatusNotFound {
+		t.Errorf("expected no build without a default profile, got %d", response.Code)
+	}
+}
+
+func TestBootUnknownRefused(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	plugins := pluginDir(t)
+	defer os.RemoveAll(plugins)
+	found, _ := machine.DiscoverPlugins(plugins)
+
+	config := config.Config{MachinePath: dir, GroupPath: dir, Plugins: found, DefaultProfile: &config.DefaultProfileConfig{
+		BootUnknown: true,
+		Definition:  map[string]interface{}{"operatingsystem": "debian"},
+	}}
+	state := statepkg.New()
+
+	// Known to an inventory plugin
+	if m, err := bootUnknown("de:ad:c0:de:ca:fe", config, state, httptest.NewRequest("GET", "/", nil)); m != nil || err != nil {
+		t.Errorf("expected the plugin's machine not to be built, got %+v %v", m, err)
+	}
+
+	// A pattern could define it
+	ioutil.WriteFile(filepath.Join(dir, "node*.example.com.yaml"), []byte(`{"operatingsystem": "ubuntu"}`), 0644)
+	if m, err := bootUnknown("aa:bb:cc:dd:ee:ff", config, state, httptest.NewRequest("GET", "/", nil)); m != nil || err != nil {
+		t.Errorf("expected no build while patterns are defined, got %+v %v", m, err)
+	}
+	if len(state.Tokens) != 0 {
+		t.Errorf("expected no builds, got %v", state.Tokens)
+	}
+}
+
+func TestBuildProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "node01.example.com.yaml"), []byte(`{"operatingsystem": "ubuntu-22.04", "preseed": "ubuntu.j2",
+		"params": {"rack": "r1"}, "network": [{"name": "eth0", "macaddress": "de:ad:be:ef:00:01"}]}`), 0644)
+
+	config := config.Config{MachinePath: dir, GroupPath: dir, BuildProfiles: map[string]map[string]interface{}{
+		"rocky-9": {"operatingsystem": "rocky-9", "preseed": "kickstart.j2", "params": map[string]interface{}{"release": "9"}},
+		"broken":  {"network": "eth0"},
+	}}
+	state := statepkg.New()
+
+	build := func(query string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		buildHandler(response, httptest.NewRequest("PUT", "/build/node01.example.com"+query, nil),
+			httprouter.Params{httprouter.Param{Key: "hostname", Value: "node01.example.com"}}, config, state)
+		return response
+	}
+
+	if response := build("?profile=rocky-9"); response.Code != http.StatusOK {
+		t.Fatalf("expected the build to start, got %d %s", response.Code, response.Body.String())
+	}
+	m := state.MachineByHostname["node01.example.com"]
+	if m == nil || m.Profile != "rocky-9" || m.OperatingSystem != "rocky-9" || m.Preseed != "kickstart.j2" ||
+		m.Params["rack"] != "r1" || m.Params["release"] != "9" || len(m.Network) != 1 {
+		t.Fatalf("unexpected machine %+v", m)
+	}
+	if h, _ := statepkg.LoadHostHistory(state.Store, "node01.example.com"); h == nil || h.Entries[0].Profile != "rocky-9" {
+		t.Errorf("expected the profile in the history, got %+v", h)
+	}
+
+	// The machine's file is left as it was for the next build
+	if d, _ := machine.MachineDefinition("node01.example.com", dir, config); d.OperatingSystem != "ubuntu-22.04" || d.Profile != "" {
+		t.Errorf("expected the definition to be unchanged, got %+v", d)
+	}
+
+	for _, query := range []string{"?profile=windows", "?profile=broken"} {
+		if response := build(query); response.Code != http.StatusBadRequest {
+			t.Errorf("expected %s to be refused, got %d", query, response.Code)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestRAID(t *testing.T) {
+	build := func() (*statepkg.State, *machine.Machine, *[]statepkg.Event) {
+		return preinstallBuild(t, machine.EventRAIDConfigured, func(m *machine.Machine) {
+			m.RAID = &config.RAIDConfig{ImageURL: "http://images.example.com/raid/", Kernel: "vmlinuz", Initrd: "initrd.img",
+				Controller: "storcli", Arrays: []config.RAIDArray{{Name: "os", Level: "1", Drives: "252:0-1"}}}
+		})
+	}
+	params := func(m *machine.Machine) httprouter.Params {
+		return httprouter.Params{{Key: "hostname", Value: m.Hostname}, {Key: "token", Value: m.Token}}
+	}
+
+	state, m, events := build()
+	if m.State != machine.BuildConfiguringRAID {
+		t.Fatalf("expected the build to start configuring RAID, got %s", m.State)
+	}
+	if boot, _ := m.PixieInit(); boot.Kernel != "http://images.example.com/raid/vmlinuz" {
+		t.Errorf("expected the config ramdisk to be served, got %+v", boot)
+	}
+	response := httptest.NewRecorder()
+	raidHandler(response, httptest.NewRequest("GET", "/raid/dns02.example.com/"+m.Token, nil), params(m), config.Config{}, state)
+	if response.Code != 200 || !strings.Contains(response.Body.String(), "storcli64 /c0 add vd type=raid1 size=all name=os drives=252:0-1") {
+		t.Errorf("unexpected script %d %s", response.Code, response.Body.String())
+	}
+
+	response = httptest.NewRecorder()
+	raidResultHandler(response, httptest.NewRequest("POST", "/raid/dns02.example.com/"+m.Token,
+		strings.NewReader(`{"Passed": true, "Output": "Add VD Succeeded"}`)), params(m), config.Config{}, state)
+	if response.Code != 200 {
+		t.Fatalf("unexpected response %d %s", response.Code, response.Body.String())
+	}
+	if m.State != machine.BuildPending || m.RAIDResult.Output != "Add VD Succeeded" || len(*events) != 1 || (*events)[0].Type != machine.EventRAIDConfigured {
+		t.Errorf("expected configured RAID to go on to the install, got %s %+v", m.State, *events)
+	}
+
+	state, m, events = build()
+	state.ReportRAID(m.Token, machine.RAIDResult{Output: "Controller 0\nStatus = Failure\nDescription = drives are not unconfigured good"}, config.Config{})
+	if m.State != machine.BuildFailed || len(*events) != 1 ||
+		(*events)[0].Message != "raid failed: Description = drives are not unconfigured good" {
+		t.Errorf("expected a failed script to fail the build, got %s %+v", m.State, *events)
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ns1/waitron/config"
+	"github.com/satori/go.uuid"
+)
+
+// Honors an incoming X-Request-ID or generates one, makes it available to
+// handlers via the request context and echoes it back on the response.
+func RequestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		id := request.Header.Get(config.RequestIDHeader)
+		if id == "" {
+			if u, err := uuid.NewV4(); err == nil {
+				id = u.String()
+			}
+			request.Header.Set(config.RequestIDHeader, id)
+		}
+
+		response.Header().Set(config.RequestIDHeader, id)
+		h.ServeHTTP(response, request.WithContext(context.WithValue(request.Context(), config.RequestIDKey, id)))
+	})
+}
+
+// Log an error with the request ID and route so it can be correlated with the client.
+func logRequest(request *http.Request, v ...interface{}) {
+	config.RequestLogger(request).Error(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+// Like http.Error, but carries the request ID in the body as well so it shows
+// up in installer logs that never look at response headers.
+func httpError(response http.ResponseWriter, request *http.Request, message string, code int) {
+	if id := config.RequestID(request); id != "" {
+		message = message + " (request id: " + id + ")"
+	}
+	http.Error(response, message, code)
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "node01.example.com.yaml"),
+		[]byte(`{"operatingsystem": "ubuntu", "network": [{"name": "eth0", "macaddress": "de:ad:be:ef:00:01"}]}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "jammy.j2"), []byte("jammy"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "noble.j2"), []byte("noble"), 0644)
+
+	config := config.Config{MachinePath: dir, GroupPath: dir, TemplatePath: dir, Checksum: "c0ffee", BuildProfiles: map[string]map[string]interface{}{
+		"ubuntu-22.04": {"operatingsystem": "ubuntu-22.04", "preseed": "jammy.j2"},
+		"ubuntu-24.04": {"operatingsystem": "ubuntu-24.04", "preseed": "noble.j2"},
+	}}
+	state := statepkg.New()
+
+	build := func(profile string) string {
+		m, err := machine.BuildDefinition("node01.example.com", "", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.ApplyProfile(profile, config); err != nil {
+			t.Fatal(err)
+		}
+		token, err := state.SetBuildMode(m, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := state.DoneBuildMode(*state.MachineByToken(token), config); err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	rollback := func() *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		rollbackHandler(response, httptest.NewRequest("POST", "/api/v1/build/node01.example.com/rollback", nil),
+			httprouter.Params{httprouter.Param{Key: "hostname", Value: "node01.example.com"}}, config, state)
+		return response
+	}
+
+	good := build("ubuntu-22.04")
+	if response := rollback(); response.Code != http.StatusConflict {
+		t.Errorf("expected nothing to roll back to after one build, got %d %s", response.Code, response.Body.String())
+	}
+	build("ubuntu-24.04")
+
+	h, _ := statepkg.LoadHostHistory(state.Store, "node01.example.com")
+	if v := h.Entries[1].Versions; v == nil || v.ConfigChecksum != "c0ffee" || len(v.Templates) != 1 ||
+		v.Templates["noble.j2"] != "d3a61c684446b22fbc324502c1ad80e4387f0ed707feec1f1ab81a8b3fc65539" {
+		t.Errorf("expected the template versions in the history, got %+v", v)
+	}
+
+	response := rollback()
+	var r statepkg.RollbackResult
+	if response.Code != http.StatusOK || json.Unmarshal(response.Body.Bytes(), &r) != nil || r.RollbackOf != good || r.Profile != "ubuntu-22.04" {
+		t.Fatalf("expected a rollback to the first build, got %d %s", response.Code, response.Body.String())
+	}
+	m := state.MachineByToken(r.Token)
+	if m == nil || m.Profile != "ubuntu-22.04" || m.Preseed != "jammy.j2" || m.RollbackOf != good {
+		t.Fatalf("expected the build armed with the earlier profile, got %+v", m)
+	}
+
+	if response := rollback(); response.Code != http.StatusConflict {
+		t.Errorf("expected the rollback in progress to refuse another, got %d", response.Code)
+	}
+	if err := state.DoneBuildMode(*m, config); err != nil {
+		t.Fatal(err)
+	}
+	if response := rollback(); response.Code != http.StatusConflict {
+		t.Errorf("expected nothing before the build rolled back to, got %d %s", response.Code, response.Body.String())
+	}
+}
+
+func TestRollbackDefaultProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := config.Config{MachinePath: dir, GroupPath: dir, TemplatePath: dir, DefaultProfile: &config.DefaultProfileConfig{
+		Definition: map[string]interface{}{"operatingsystem": "debian"},
+	}}
+	state := statepkg.New()
+	for i := 0; i < 2; i++ {
+		m, err := machine.BuildDefinition("unknown-aa-bb-cc-dd-ee-ff", "aa:bb:cc:dd:ee:ff", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := state.SetBuildMode(m, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := state.DoneBuildMode(*state.MachineByToken(token), config); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	response := httptest.NewRecorder()
+	rollbackHandler(response, httptest.NewRequest("POST", "/api/v1/build/unknown-aa-bb-cc-dd-ee-ff/rollback", nil),
+		httprouter.Params{httprouter.Param{Key: "hostname", Value: "unknown-aa-bb-cc-dd-ee-ff"}}, config, state)
+	var r statepkg.RollbackResult
+	if response.Code != http.StatusOK || json.Unmarshal(response.Body.Bytes(), &r) != nil {
+		t.Fatalf("expected a rollback, got %d %s", response.Code, response.Body.String())
+	}
+	state.Mux.Lock()
+	m := state.MachineByMAC["aa:bb:cc:dd:ee:ff"]
+	state.Mux.Unlock()
+	if m == nil || m.Token != r.Token {
+		t.Errorf("expected the rollback to be bootable from the MAC address it was built for, got %+v", m)
+	}
+}
+
+func TestRollbackChangedTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-rollback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "node01.example.com.yaml"),
+		[]byte(`{"operatingsystem": "ubuntu", "network": [{"name": "eth0", "macaddress": "de:ad:be:ef:00:01"}]}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "jammy.j2"), []byte("jammy"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "noble.j2"), []byte("noble"), 0644)
+
+	config := config.Config{MachinePath: dir, GroupPath: dir, TemplatePath: dir, BuildProfiles: map[string]map[string]interface{}{
+		"ubuntu-22.04": {"operatingsystem": "ubuntu-22.04", "preseed": "jammy.j2"},
+		"ubuntu-24.04": {"operatingsystem": "ubuntu-24.04", "preseed": "noble.j2"},
+	}}
+	state := statepkg.New()
+	for _, profile := range []string{"ubuntu-22.04", "ubuntu-24.04"} {
+		m, err := machine.BuildDefinition("node01.example.com", "", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := m.ApplyProfile(profile, config); err != nil {
+			t.Fatal(err)
+		}
+		token, err := state.SetBuildMode(m, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := state.DoneBuildMode(*state.MachineByToken(token), config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ioutil.WriteFile(filepath.Join(dir, "jammy.j2"), []byte("jammy, fixed"), 0644)
+
+	rollback := func(url string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		rollbackHandler(response, httptest.NewRequest("POST", url, nil),
+			httprouter.Params{httprouter.Param{Key: "hostname", Value: "node01.example.com"}}, config, state)
+		return response
+	}
+
+	if response := rollback("/api/v1/build/node01.example.com/rollback"); response.Code != http.StatusConflict ||
+		!strings.Contains(response.Body.String(), "template jammy.j2") {
+		t.Errorf("expected a changed template to refuse the rollback, got %d %s", response.Code, response.Body.String())
+	}
+	if state.BuildInProgress("node01.example.com") != nil {
+		t.Error("expected no build after the refused rollback")
+	}
+
+	response := rollback("/api/v1/build/node01.example.com/rollback?force=true")
+	var r statepkg.RollbackResult
+	if response.Code != http.StatusOK || json.Unmarshal(response.Body.Bytes(), &r) != nil ||
+		len(r.Changed) != 1 || r.Changed[0] != "template jammy.j2" {
+		t.Errorf("expected the forced rollback to list the changed template, got %d %s", response.Code, response.Body.String())
+	}
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/state"
+	"gopkg.in/yaml.v2"
+)
+
+// The pillar of a minion
+type saltPillar struct {
+	Waitron saltMachine `json:"waitron"`
+}
+
+type saltMachine struct {
+	Hostname        string            `json:"hostname"`
+	ShortName       string            `json:"short_name"`
+	Domain          string            `json:"domain"`
+	OperatingSystem string            `json:"operating_system"`
+	Params          map[string]string `json:"params"`
+	Labels          map[string]string `json:"labels"`
+	Network         []apiInterface    `json:"network"`
+}
+
+// A salt-ssh roster entry
+type saltTarget struct {
+	Host string `yaml:"host"`
+	User string `yaml:"user,omitempty"`
+	Port int    `yaml:"port,omitempty"`
+	Sudo bool   `yaml:"sudo,omitempty"`
+	Priv string `yaml:"priv,omitempty"`
+}
+
+func newSaltPillar(m machine.Machine) saltPillar {
+	s := saltMachine{
+		Hostname:        m.Hostname,
+		ShortName:       m.ShortName,
+		Domain:          m.Domain,
+		OperatingSystem: m.OperatingSystem,
+		Params:          m.Params,
+		Labels:          m.Labels,
+		Network:         newAPIInterfaces(m.Network),
+	}
+	if s.Params == nil {
+		s.Params = map[string]string{}
+	}
+	if s.Labels == nil {
+		s.Labels = map[string]string{}
+	}
+	return saltPillar{Waitron: s}
+}
+
+// Where salt-ssh reaches m: its first address, or its hostname when it has
+// none
+func newSaltTarget(m machine.Machine) saltTarget {
+	t := saltTarget{
+		Host: m.Hostname,
+		User: m.SaltSSH.User,
+		Port: m.SaltSSH.Port,
+		Sudo: m.SaltSSH.Sudo,
+		Priv: m.SaltSSH.Priv,
+	}
+	for _, i := range m.Network {
+		if len(i.Addresses4) > 0 {
+			t.Host = i.Addresses4[0].IPAddress
+			return t
+		}
+	}
+	for _, i := range m.Network {
+		if len(i.Addresses6) > 0 {
+			t.Host = i.Addresses6[0].IPAddress
+			return t
+		}
+	}
+	return t
+}
+
+// @Title saltPillarHandler
+// @Description Pillar data of a minion for Salt's http_json ext_pillar
+// @Param minion  path  string  true  "Minion id, the hostname"
+// @Success 200 {object} saltPillar "The machine under the waitron key"
+// @Failure 404 {object} string "Unable to find host definition for minion"
+// @Router /salt/pillar/{minion} [GET]
+func saltPillarHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params,
+	config config.Config) {
+
+	minion := ps.ByName("minion")
+
+	m, err := machine.MachineDefinition(minion, config.MachinePath, config)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "", http.StatusNotFound)
+		return
+	}
+
+	result, _ := json.Marshal(newSaltPillar(m))
+	writeJSONWithETag(response, request, result)
+}
+
+// @Title saltRosterHandler
+// @Description A salt-ssh roster of the machines, keyed by minion id
+// @Param selector  query  string  false  "Only machines with matching labels, e.g. rack=r12,role!=db"
+// @Success 200 {object} string "Roster as YAML"
+// @Failure 400 {object} string "Invalid selector"
+// @Failure 500 {object} string "Unable to list machines"
+// @Router /salt/roster [GET]
+func saltRosterHandler(response http.ResponseWriter, request *http.Request,
+	_ httprouter.Params, config config.Config, state *state.State) {
+	requirements, err := machine.ParseSelector(request.URL.Query().Get("selector"))
+	if err != nil {
+		httpError(response, request, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	inv, err := state.InventoryFor(config)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to list machines", 500)
+		return
+	}
+
+	roster := make(map[string]saltTarget)
+	for _, e := range inv.Match(requirements) {
+		m, err := machine.MachineDefinition(e.Hostname, config.MachinePath, config)
+		if err != nil {
+			continue // removed since the index was refreshed
+		}
+		roster[e.Hostname] = newSaltTarget(m)
+	}
+
+	result, err := yaml.Marshal(roster)
+	if err != nil {
+		logRequest(request, err)
+		httpError(response, request, "Unable to list machines", 500)
+		return
+	}
+
+	response.Header().Set("content-type", "application/x-yaml")
+	response.Write(result)
+}
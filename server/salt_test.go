@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/state"
+	"gopkg.in/yaml.v2"
+)
+
+func TestSaltHandlers(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-salt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "node01.example.com.yaml"), []byte(`{"params": {"role": "web"}, "labels": {"rack": "r12"},
+		"network": [{"name": "eth0", "macaddress": "de:ad:be:ef:00:01", "addresses4": [{"ipaddress": "192.0.2.1", "cidr": "24"}]}]}`), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "node02.example.com.yaml"), []byte(`{"labels": {"rack": "r13"}}`), 0644)
+
+	config := config.Config{MachinePath: dir, GroupPath: dir, SaltSSH: config.SaltSSHConfig{User: "root", Port: 2222}}
+	state := state.New()
+
+	response := httptest.NewRecorder()
+	saltPillarHandler(response, httptest.NewRequest("GET", "/salt/pillar/node01.example.com", nil),
+		httprouter.Params{httprouter.Param{Key: "minion", Value: "node01.example.com"}}, config)
+	var pillar saltPillar
+	json.Unmarshal(response.Body.Bytes(), &pillar)
+	if response.Code != http.StatusOK || pillar.Waitron.Params["role"] != "web" || pillar.Waitron.Labels["rack"] != "r12" ||
+		len(pillar.Waitron.Network) != 1 || pillar.Waitron.Network[0].Addresses4[0].IPAddress != "192.0.2.1" {
+		t.Errorf("unexpected pillar %d %s", response.Code, response.Body.String())
+	}
+
+	response = httptest.NewRecorder()
+	saltPillarHandler(response, httptest.NewRequest("GET", "/salt/pillar/node03.example.com", nil),
+		httprouter.Params{httprouter.Param{Key: "minion", Value: "node03.example.com"}}, config)
+	if response.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown minion to have no pillar, got %d", response.Code)
+	}
+
+	roster := func(url string) map[string]saltTarget {
+		response := httptest.NewRecorder()
+		saltRosterHandler(response, httptest.NewRequest("GET", url, nil), nil, config, state)
+		if response.Code != http.StatusOK {
+			t.Fatalf("expected a roster, got %d %s", response.Code, response.Body.String())
+		}
+		targets := map[string]saltTarget{}
+		if err := yaml.Unmarshal(response.Body.Bytes(), &targets); err != nil {
+			t.Fatal(err)
+		}
+		return targets
+	}
+
+	targets := roster("/salt/roster")
+	if len(targets) != 2 || targets["node01.example.com"].Host != "192.0.2.1" || targets["node02.example.com"].Host != "node02.example.com" {
+		t.Errorf("unexpected roster %+v", targets)
+	}
+	if targets["node01.example.com"].User != "root" || targets["node01.example.com"].Port != 2222 {
+		t.Errorf("expected salt_ssh in the roster, got %+v", targets["node01.example.com"])
+	}
+
+	if targets := roster("/salt/roster?selector=rack=r13"); len(targets) != 1 {
+		t.Errorf("expected the selector to narrow the roster down, got %+v", targets)
+	}
+}
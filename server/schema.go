@@ -0,0 +1,33 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// @Title schemaHandler
+// @Description JSON Schema of machine or VM definition files
+// @Param kind  path  string  true  "machine or vm"
+// @Success 200 {object} string "The schema"
+// @Failure 404 {object} string "No such schema"
+// @Router /schema/{kind} [GET]
+func schemaHandler(response http.ResponseWriter, request *http.Request,
+	ps httprouter.Params, config configpkg.Config) {
+	var s *configpkg.JSONSchema
+	switch ps.ByName("kind") {
+	case "machine":
+		s = machine.MachineSchema
+	case "vm":
+		s = machine.VMSchema
+	default:
+		httpError(response, request, "No such schema", http.StatusNotFound)
+		return
+	}
+
+	js, _ := json.Marshal(s)
+	writeJSONWithETag(response, request, js)
+}
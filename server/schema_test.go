@@ -0,0 +1,39 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+)
+
+func TestSchemaHandler(t *testing.T) {
+	response := httptest.NewRecorder()
+	schemaHandler(response, httptest.NewRequest("GET", "/schema/machine", nil), httprouter.Params{{Key: "kind", Value: "machine"}}, config.Config{})
+	var s struct {
+		Schema     string `json:"$schema"`
+		Properties map[string]struct {
+			Type  string
+			Items struct {
+				Properties map[string]interface{}
+			}
+		}
+		AdditionalProperties bool
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Schema != config.JSONSchemaDraft || s.AdditionalProperties || s.Properties["network"].Type != "array" ||
+		s.Properties["network"].Items.Properties["macaddress"] == nil {
+		t.Errorf("unexpected schema %s", response.Body.String())
+	}
+
+	response = httptest.NewRecorder()
+	schemaHandler(response, httptest.NewRequest("GET", "/schema/group", nil), httprouter.Params{{Key: "kind", Value: "group"}}, config.Config{})
+	if response.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown schema to be 404, got %d", response.Code)
+	}
+}
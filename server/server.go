@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/state"
+)
+
+const (
+	defaultReadHeaderTimeoutSeconds = 10
+	defaultIdleTimeoutSeconds       = 120
+	defaultMaxHeaderBytes           = 64 * 1024
+	defaultShutdownTimeoutSeconds   = 30
+)
+
+func NewHTTPServer(addr string, handler http.Handler, config configpkg.ServerConfig) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: configpkg.Seconds(config.ReadHeaderTimeoutSeconds, defaultReadHeaderTimeoutSeconds),
+		ReadTimeout:       time.Duration(config.ReadTimeoutSeconds) * time.Second,
+		WriteTimeout:      time.Duration(config.WriteTimeoutSeconds) * time.Second,
+		IdleTimeout:       configpkg.Seconds(config.IdleTimeoutSeconds, defaultIdleTimeoutSeconds),
+		MaxHeaderBytes:    config.MaxHeaderBytes,
+	}
+	if srv.MaxHeaderBytes <= 0 {
+		srv.MaxHeaderBytes = defaultMaxHeaderBytes
+	}
+	if config.DisableKeepAlives {
+		srv.SetKeepAlivesEnabled(false)
+	}
+	if config.DisableHTTP2 {
+		// A non-nil, empty map keeps net/http from setting up HTTP/2
+		srv.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+	}
+	return srv
+}
+
+// Serve on l, over TLS when a certificate is configured
+func Serve(srv *http.Server, l net.Listener, config configpkg.ServerConfig) error {
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		if config.TLSClientCAFile != "" {
+			tlsConfig, err := state.ClientCertConfig(config.TLSClientCAFile)
+			if err != nil {
+				return fmt.Errorf("cannot load tls_client_ca_file: %s", err)
+			}
+			srv.TLSConfig = tlsConfig
+		}
+		return srv.ServeTLS(l, config.TLSCertFile, config.TLSKeyFile)
+	}
+	return srv.Serve(l)
+}
+
+// Bind a TCP listener on address, with SO_REUSEPORT when configured
+func Listen(address string, config configpkg.ServerConfig) (net.Listener, error) {
+	lc := net.ListenConfig{}
+	if config.ReusePort {
+		lc.Control = func(network, address string, c syscall.RawConn) error {
+			var err error
+			cerr := c.Control(func(fd uintptr) {
+				err = setReusePort(fd)
+			})
+			if cerr != nil {
+				return cerr
+			}
+			return err
+		}
+	}
+	return lc.Listen(context.Background(), "tcp", address)
+}
+
+// Stop accepting connections and wait for in-flight requests to finish
+func Shutdown(srv *http.Server, config configpkg.ServerConfig) error {
+	timeout := configpkg.Seconds(config.ShutdownTimeoutSeconds, defaultShutdownTimeoutSeconds)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return srv.Shutdown(ctx)
+}
@@ -0,0 +1,29 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"testing"
+
+	"github.com/ns1/waitron/config"
+)
+
+func TestListenReusePort(t *testing.T) {
+	first, err := Listen("127.0.0.1:0", config.ServerConfig{ReusePort: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	second, err := Listen(first.Addr().String(), config.ServerConfig{ReusePort: true})
+	if err != nil {
+		t.Fatalf("expected a second listener on %s, got %s", first.Addr(), err)
+	}
+	second.Close()
+
+	if l, err := Listen(first.Addr().String(), config.ServerConfig{}); err == nil {
+		l.Close()
+		t.Error("expected the port to be taken without reuse_port")
+	}
+}
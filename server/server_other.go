@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import "errors"
+
+func setReusePort(fd uintptr) error {
+	return errors.New("reuse_port is only supported on Linux")
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+)
+
+func TestListenReusePortUnsupported(t *testing.T) {
+	if l, err := Listen("127.0.0.1:0", config.ServerConfig{ReusePort: true}); err == nil || !strings.Contains(err.Error(), "only supported on Linux") {
+		if l != nil {
+			l.Close()
+		}
+		t.Errorf("expected reuse_port to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+)
+
+func TestNewHTTPServerDefaults(t *testing.T) {
+	srv := NewHTTPServer(":9090", http.NotFoundHandler(), config.ServerConfig{})
+
+	if srv.ReadHeaderTimeout != defaultReadHeaderTimeoutSeconds*time.Second {
+		t.Errorf("unexpected ReadHeaderTimeout %s", srv.ReadHeaderTimeout)
+	}
+	if srv.IdleTimeout != defaultIdleTimeoutSeconds*time.Second {
+		t.Errorf("unexpected IdleTimeout %s", srv.IdleTimeout)
+	}
+	if srv.ReadTimeout != 0 || srv.WriteTimeout != 0 {
+		t.Errorf("expected bodies not to be time limited, got %s and %s", srv.ReadTimeout, srv.WriteTimeout)
+	}
+	if srv.MaxHeaderBytes != defaultMaxHeaderBytes {
+		t.Errorf("unexpected MaxHeaderBytes %d", srv.MaxHeaderBytes)
+	}
+	if srv.TLSNextProto != nil {
+		t.Error("expected HTTP/2 to be left on")
+	}
+}
+
+func TestNewHTTPServerConfigured(t *testing.T) {
+	srv := NewHTTPServer(":9090", http.NotFoundHandler(), config.ServerConfig{
+		ReadHeaderTimeoutSeconds: 2,
+		ReadTimeoutSeconds:       30,
+		WriteTimeoutSeconds:      60,
+		IdleTimeoutSeconds:       5,
+		MaxHeaderBytes:           4096,
+		DisableHTTP2:             true,
+	})
+
+	if srv.ReadHeaderTimeout != 2*time.Second || srv.ReadTimeout != 30*time.Second ||
+		srv.WriteTimeout != time.Minute || srv.IdleTimeout != 5*time.Second {
+		t.Errorf("unexpected timeouts %+v", srv)
+	}
+	if srv.MaxHeaderBytes != 4096 {
+		t.Errorf("unexpected MaxHeaderBytes %d", srv.MaxHeaderBytes)
+	}
+	if srv.TLSNextProto == nil || len(srv.TLSNextProto) != 0 {
+		t.Error("expected HTTP/2 to be turned off")
+	}
+}
+
+func TestSlowHeadersAreCutOff(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := NewHTTPServer(l.Addr().String(), http.NotFoundHandler(), config.ServerConfig{ReadHeaderTimeoutSeconds: 1})
+	go srv.Serve(l)
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Start a request and never finish the headers
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: waitron\r\n"))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	start := time.Now()
+	bufio.NewReader(conn).ReadString('\n')
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("connection was held open for %s", elapsed)
+	}
+}
+
+func TestShutdownWaitsForRequests(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	srv := NewHTTPServer(l.Addr().String(), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	}), config.ServerConfig{})
+	go srv.Serve(l)
+
+	body := make(chan string, 1)
+	go func() {
+		response, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer response.Body.Close()
+		data, _ := ioutil.ReadAll(response.Body)
+		body <- string(data)
+	}()
+	<-started
+
+	if err := Shutdown(srv, config.ServerConfig{ShutdownTimeoutSeconds: 5}); err != nil {
+		t.Fatal(err)
+	}
+	if b := <-body; b != "done" {
+		t.Errorf("expected the in-flight request to finish, got %q", b)
+	}
+}
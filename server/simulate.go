@@ -0,0 +1,233 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/state"
+)
+
+// With simulate, or -simulate, waitron touches nothing outside itself and
+// plays the installer of every build it starts, so dashboards, notifications
+// and automation can be tried against builds that behave like real ones
+// without any hardware. Hooks are rendered and logged but not run, as with
+// hook_dry_run, and so are the IPMI or Redfish power cycles in them and the
+// prebuild, postbuild, cancelbuild and stale build commands. VMs
+// aren't created, DNS records aren't published and ipam hands out addresses
+// from its pools without asking phpipam or netbox. Notifiers and event
+// publishing work as usual.
+//
+// Every simulate_step_secs a build takes the next step its installer would:
+// it fetches its boot config, passing the pre-install stages it has one boot
+// at a time, fetches its preseed, or cloud-init without one, reports
+// progress, fetches its finish template and calls /done. The requests go
+// through the same handlers as real ones, so templates are rendered and
+// phases, states and events are what a real build makes. A build whose
+// request fails, e.g. for a template that doesn't render, is left where it
+// is and goes stale. Validation checks a machine that doesn't exist, builds
+// with it fail once it times out.
+
+const DefaultSimulateStepSeconds = 5
+
+// What the simulated installer does, in order
+const (
+	simulateBoot     = "boot"
+	simulateInstall  = "install"
+	simulateProgress = "progress"
+	simulateFinish   = "finish"
+	simulateDone     = "done"
+)
+
+var simulateSteps = []string{simulateBoot, simulateInstall, simulateProgress, simulateFinish, simulateDone}
+
+// Stand in for the drivers that reach outside waitron
+func SimulateIntegrations(state *state.State) {
+	if state.VMs != nil {
+		state.VMs = simulatedVMs{}
+	}
+	if state.DNS != nil {
+		state.DNS.Driver = simulatedDNS{}
+	}
+	if state.IPAM != nil {
+		state.IPAM.Driver = nil
+	}
+}
+
+type simulatedVMs struct{}
+
+func (simulatedVMs) Boot(m *machine.Machine, vm machine.VmInstance, hypervisor string) (string, error) {
+	logger.Machine(m).Info("simulated vm boot", "hypervisor", hypervisor)
+	return vm.Hostname, nil
+}
+
+type simulatedDNS struct{}
+
+func (simulatedDNS) Replace(zone config.DNSZone, name string, rrtype string, ttl int, values []string) error {
+	logger.Info("simulated dns update", "zone", zone.Name, "name", name, "type", rrtype, "values", strings.Join(values, ","))
+	return nil
+}
+
+func (simulatedDNS) Remove(zone config.DNSZone, name string, rrtype string, value string) error {
+	logger.Info("simulated dns removal", "zone", zone.Name, "name", name, "type", rrtype, "value", value)
+	return nil
+}
+
+type simulator struct {
+	config config.Config
+	state  *state.State
+	step   time.Duration
+
+	mux    sync.Mutex
+	builds map[string]*simulatedBuild // by token
+}
+
+// A walk of a build through the steps, replaced when the build is retried
+type simulatedBuild struct {
+	timer *time.Timer
+}
+
+func NewSimulator(config config.Config, state *state.State) *simulator {
+	return &simulator{
+		config: config,
+		state:  state,
+		step:   time.Duration(config.SimulateStepSeconds) * time.Second,
+		builds: make(map[string]*simulatedBuild),
+	}
+}
+
+// Walk every build started or retried from now on
+func (s *simulator) Start() {
+	s.state.Events.Subscribe(func(e state.Event) {
+		switch e.Type {
+		case machine.EventBuildStarted, machine.EventBuildRetried:
+			s.walk(e.Token)
+		case machine.EventBuildCompleted, machine.EventBuildCancelled:
+			s.forget(e.Token)
+		}
+	})
+}
+
+// Start the build with token over from the first step
+func (s *simulator) walk(token string) {
+	b := &simulatedBuild{}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if old := s.builds[token]; old != nil {
+		old.timer.Stop()
+	}
+	s.builds[token] = b
+	s.schedule(b, token, 0)
+}
+
+// Callers must hold s.mux
+func (s *simulator) schedule(b *simulatedBuild, token string, step int) {
+	b.timer = time.AfterFunc(s.step, func() { s.take(b, token, step) })
+}
+
+func (s *simulator) forget(token string) {
+	s.mux.Lock()
+	if b := s.builds[token]; b != nil {
+		b.timer.Stop()
+		delete(s.builds, token)
+	}
+	s.mux.Unlock()
+}
+
+// Take step of the walk b of the build with token and schedule the next one
+func (s *simulator) take(b *simulatedBuild, token string, step int) {
+	state := s.state
+
+	state.Mux.Lock()
+	m, found := state.MachineByUUID[token]
+	var snapshot machine.Machine
+	if found {
+		snapshot = *m
+	}
+	state.Mux.Unlock()
+	if !found {
+		s.forget(token)
+		return
+	}
+
+	hostname := snapshot.Hostname
+	ps := httprouter.Params{{Key: "hostname", Value: hostname}, {Key: "token", Value: token}}
+	next := step + 1
+	var err error
+	switch simulateSteps[step] {
+	case simulateBoot:
+		mac := snapshot.Network[0].MacAddress
+		err = s.call(pixieHandler, "GET", "/v1/boot/"+mac, nil, httprouter.Params{{Key: "macaddr", Value: mac}})
+		if stage := machine.StageFor(snapshot.State); err == nil && stage != nil {
+			// Booted into the stage, its image passes it and reboots
+			err = state.PassStage(m, s.config, stage, "simulated")
+			next = step
+		}
+	case simulateInstall:
+		template := "preseed"
+		if snapshot.Preseed == "" {
+			template = "cloud-init"
+		}
+		err = s.call(templateHandler, "GET", "/template/"+template+"/"+hostname+"/"+token, nil,
+			append(ps, httprouter.Param{Key: "template", Value: template}))
+	case simulateProgress:
+		body, _ := json.Marshal(machine.BuildProgress{Phase: "installing packages", Percent: 50})
+		err = s.call(hostProgressHandler, "POST", "/status/"+hostname+"/"+token, body, ps)
+	case simulateFinish:
+		if snapshot.Finish != "" {
+			err = s.call(templateHandler, "GET", "/template/finish/"+hostname+"/"+token, nil,
+				append(ps, httprouter.Param{Key: "template", Value: "finish"}))
+		}
+	case simulateDone:
+		err = s.call(doneHandler, "GET", "/done/"+hostname+"/"+token, nil, ps)
+	}
+	if err != nil {
+		logger.Machine(&snapshot).Warn("simulated installer stopped", "step", simulateSteps[step], "error", err)
+		s.forget(token)
+		return
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if s.builds[token] != b {
+		// Retried or gone meanwhile
+		return
+	}
+	if next < len(simulateSteps) {
+		s.schedule(b, token, next)
+	} else {
+		delete(s.builds, token)
+	}
+}
+
+// Make the installer's request of handle, an error unless it is answered
+// with 200
+func (s *simulator) call(handle func(http.ResponseWriter, *http.Request, httprouter.Params, config.Config, *state.State),
+	method string, path string, body []byte, ps httprouter.Params) (err error) {
+	defer func() {
+		// What a template that fails halfway through streaming does
+		if r := recover(); r != nil {
+			if r != http.ErrAbortHandler {
+				panic(r)
+			}
+			err = fmt.Errorf("%s %s aborted", method, path)
+		}
+	}()
+
+	request := httptest.NewRequest(method, path, bytes.NewReader(body))
+	response := httptest.NewRecorder()
+	handle(response, request, ps, s.config, s.state)
+	if response.Code != http.StatusOK {
+		return fmt.Errorf("%s %s: %d %s", method, path, response.Code, strings.TrimSpace(response.Body.String()))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestSimulator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-simulate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "preseed.j2"), []byte("d-i netcfg/get_hostname string {{ machine.Hostname }}"), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "finish.j2"), []byte("#!/bin/sh"), 0644)
+
+	config := configpkg.Config{TemplatePath: dir, Simulate: true}
+	state := statepkg.New()
+	completed := make(chan statepkg.Event, 1)
+	state.Events.Subscribe(func(e statepkg.Event) {
+		if e.Type == machine.EventBuildCompleted {
+			completed <- e
+		}
+	})
+	s := NewSimulator(config, state)
+	s.step = time.Millisecond
+	s.Start()
+
+	m := machine.Machine{Hostname: "dns02.example.com", Network: []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}}
+	m.Kernel, m.Cmdline = "linux", "auto=true"
+	m.Preseed, m.Finish = "preseed.j2", "finish.j2"
+	m.BurnIn = &configpkg.BurnInConfig{Kernel: "memtest"}
+	token, err := state.SetBuildMode(m, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case e := <-completed:
+		if e.Token != token {
+			t.Errorf("expected the build to complete, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the simulated installer to finish the build")
+	}
+
+	b, err := state.BuildByToken(token)
+	if err != nil || b == nil {
+		t.Fatalf("expected a build record, got %v", err)
+	}
+	var phases []string
+	for _, p := range b.Phases {
+		phases = append(phases, p.Name)
+	}
+	for _, want := range []string{"burn-in-passed", machine.PhaseBootServed, machine.PhasePreseed, machine.PhaseFinish, machine.PhaseDone} {
+		found := false
+		for _, p := range phases {
+			found = found || p == want
+		}
+		if !found {
+			t.Errorf("expected phase %s, got %v", want, phases)
+		}
+	}
+	if b.State != machine.BuildDone || b.Progress == nil || b.Progress.Percent != 50 {
+		t.Errorf("expected a done build that reported progress, got %+v", b)
+	}
+	s.mux.Lock()
+	if len(s.builds) != 0 {
+		t.Errorf("expected the walk to be over, got %v", s.builds)
+	}
+	s.mux.Unlock()
+}
+
+func TestSimulateIntegrations(t *testing.T) {
+	state := statepkg.New()
+	state.VMs = statepkg.NewLibvirt(configpkg.LibvirtConfig{})
+	state.DNS = &statepkg.DNSUpdater{Driver: &statepkg.RFC2136Driver{}}
+	state.IPAM = &statepkg.IPAM{Driver: statepkg.NewPHPIPAMDriver(configpkg.PHPIPAMConfig{})}
+	SimulateIntegrations(state)
+	if _, ok := state.VMs.(simulatedVMs); !ok {
+		t.Errorf("expected simulated vms, got %T", state.VMs)
+	}
+	if _, ok := state.DNS.Driver.(simulatedDNS); !ok {
+		t.Errorf("expected simulated dns, got %T", state.DNS.Driver)
+	}
+	if state.IPAM.Driver != nil {
+		t.Errorf("expected the builtin ipam, got %T", state.IPAM.Driver)
+	}
+}
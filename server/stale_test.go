@@ -0,0 +1,87 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func staleTestBuild(state *statepkg.State, token string, threshold int, started time.Time) *machine.Machine {
+	m := &machine.Machine{Hostname: token + ".example.com", Token: token, BuildStart: started}
+	m.StaleBuildThresholdSeconds = threshold
+	m.StaleBuildJitterSeconds = -1
+	m.Network = []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}
+
+	state.Mux.Lock()
+	state.MachineByUUID[token] = m
+	state.MachineByHostname[m.Hostname] = m
+	state.Mux.Unlock()
+	return m
+}
+
+func TestStaleWatcherSlowBuilds(t *testing.T) {
+	state := statepkg.New()
+	stale := make(chan statepkg.Event, 2)
+	cancelled := make(chan statepkg.Event, 2)
+	state.Events.Subscribe(func(e statepkg.Event) {
+		switch e.Type {
+		case machine.EventBuildStale:
+			stale <- e
+		case machine.EventBuildCancelled:
+			cancelled <- e
+		}
+	})
+
+	w := statepkg.NewStaleWatcher(config.Config{}, state)
+	build := func(token string, mac string, heard time.Time) *machine.Machine {
+		m := staleTestBuild(state, token, 60, time.Now().Add(-time.Hour))
+		m.Network = []machine.Interface{{MacAddress: mac}}
+		m.StaleSilenceSeconds = 600
+		m.CancelStaleBuilds = true
+		m.Phases = []machine.BuildPhase{{Name: machine.PhasePreseed, Timestamp: time.Now().Add(-50 * time.Minute)}}
+		m.LastHeartbeat = heard
+		return m
+	}
+	build("working", "de:ad:c0:de:ca:fe", time.Now())
+	build("silent", "de:ad:c0:de:ca:ff", time.Now().Add(-20*time.Minute))
+	w.Sweep()
+
+	messages := make(map[string]string)
+	for i := 0; i < 2; i++ {
+		select {
+		case e := <-stale:
+			messages[e.Token] = e.Message
+		case <-time.After(time.Second):
+			t.Fatal("expected both builds to be reported stale")
+		}
+	}
+	if !strings.HasPrefix(messages["working"], "still working") || !strings.HasPrefix(messages["silent"], "silent since") {
+		t.Errorf("expected one slow and one silent build, got %v", messages)
+	}
+
+	select {
+	case e := <-cancelled:
+		if e.Token != "silent" {
+			t.Errorf("expected only the silent build to be cancelled, got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the silent build to be cancelled")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if state.MachineByToken("working") == nil {
+		t.Error("expected the slow build to be left to its installer")
+	}
+
+	response := httptest.NewRecorder()
+	heartbeatHandler(response, httptest.NewRequest("PUT", "/heartbeat/working.example.com/wrong", nil),
+		httprouter.Params{{Key: "hostname", Value: "working.example.com"}, {Key: "token", Value: "wrong"}}, config.Config{}, state)
+	if response.Code != 401 {
+		t.Errorf("expected a heartbeat with the wrong token to be refused, got %d", response.Code)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+)
+
+// Rendered output up to this size is buffered so it can be sent with a
+// Content-Length, and a failed render can still turn into a clean error.
+// Anything bigger is streamed to the client as it is rendered.
+const maxBufferedRender = 1 << 20
+
+type renderWriter struct {
+	response  http.ResponseWriter
+	buf       bytes.Buffer
+	limit     int
+	streaming bool
+}
+
+func newRenderWriter(response http.ResponseWriter, limit int) *renderWriter {
+	return &renderWriter{response: response, limit: limit}
+}
+
+func (w *renderWriter) Write(p []byte) (int, error) {
+	if w.streaming {
+		return w.response.Write(p)
+	}
+
+	w.buf.Write(p)
+	if w.buf.Len() > w.limit {
+		w.streaming = true
+		if _, err := w.response.Write(w.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		w.buf.Reset()
+	}
+	return len(p), nil
+}
+
+// Send what is still buffered, with its length
+func (w *renderWriter) finish() error {
+	if w.streaming {
+		return nil
+	}
+	w.response.Header().Set("Content-Length", strconv.Itoa(w.buf.Len()))
+	_, err := w.response.Write(w.buf.Bytes())
+	return err
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/template"
+)
+
+func TestRenderWriterBuffered(t *testing.T) {
+	response := httptest.NewRecorder()
+	w := newRenderWriter(response, 16)
+	w.Write([]byte("small"))
+
+	if response.Body.Len() != 0 {
+		t.Errorf("expected nothing written before finish, got %q", response.Body.String())
+	}
+	if err := w.finish(); err != nil {
+		t.Fatal(err)
+	}
+	if response.Body.String() != "small" || response.Header().Get("Content-Length") != "5" {
+		t.Errorf("unexpected response %q, Content-Length %q", response.Body.String(), response.Header().Get("Content-Length"))
+	}
+}
+
+func TestRenderWriterStreaming(t *testing.T) {
+	response := httptest.NewRecorder()
+	w := newRenderWriter(response, 16)
+
+	big := strings.Repeat("x", 20)
+	w.Write([]byte(big))
+	if !w.streaming || response.Body.String() != big {
+		t.Errorf("expected output past the limit to be streamed, got %q", response.Body.String())
+	}
+
+	w.Write([]byte("more"))
+	w.finish()
+	if response.Body.String() != big+"more" {
+		t.Errorf("unexpected response %q", response.Body.String())
+	}
+	if response.Header().Get("Content-Length") != "" {
+		t.Error("expected no Content-Length when streaming")
+	}
+}
+
+func TestRenderTemplateToPercent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeTemplate(t, filepath.Join(dir, "preseed.j2"), "d-i passwd/root-password-crypted password $6$x%y", time.Now())
+
+	response := httptest.NewRecorder()
+	w := newRenderWriter(response, maxBufferedRender)
+	m := machine.Machine{Hostname: "dns02.example.com"}
+	if err := template.RenderTo(m, w, "preseed.j2", config.Config{TemplatePath: dir}); err != nil {
+		t.Fatal(err)
+	}
+	w.finish()
+
+	if !strings.HasSuffix(response.Body.String(), "$6$x%y") {
+		t.Errorf("template output was altered: %q", response.Body.String())
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Socket activation and readiness notification, see sd_listen_fds(3) and
+// sd_notify(3). With a .socket unit, the sockets named "management" (with
+// FileDescriptorName=management) serve the management listener and the first
+// other socket the main one.
+
+// The first file descriptor passed by systemd
+const listenFdsStart = 3
+
+type activatedListener struct {
+	Name string
+	net.Listener
+}
+
+// The listeners systemd passed to this process, if any. The environment is
+// cleared so hooks and build commands don't think they were passed sockets.
+func SystemdListeners() ([]activatedListener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", os.Getenv("LISTEN_FDS"))
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	listeners := []activatedListener{}
+	for i := 0; i < n; i++ {
+		fd := listenFdsStart + i
+		syscall.CloseOnExec(fd)
+
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket %d (%s): %s", fd, name, err)
+		}
+		listeners = append(listeners, activatedListener{Name: name, Listener: l})
+	}
+	return listeners, nil
+}
+
+// Take the first listener named name, or the first one left when name is
+// empty
+func TakeListener(listeners *[]activatedListener, name string) net.Listener {
+	for i, l := range *listeners {
+		if name == "" || l.Name == name {
+			*listeners = append((*listeners)[:i], (*listeners)[i+1:]...)
+			return l.Listener
+		}
+	}
+	return nil
+}
+
+// Tell systemd about a change, e.g. "READY=1". Does nothing when not run by
+// systemd with Type=notify.
+func SDNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// A leading @ is an abstract socket
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
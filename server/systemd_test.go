@@ -0,0 +1,78 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSystemdListenersNotActivated(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+
+	listeners, err := SystemdListeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("expected sockets for another process to be ignored, got %v, %v", listeners, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("expected the environment to be cleared")
+	}
+}
+
+func TestTakeListener(t *testing.T) {
+	main, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer main.Close()
+	management, _ := net.Listen("tcp", "127.0.0.1:0")
+	defer management.Close()
+
+	listeners := []activatedListener{{Name: "unknown", Listener: main}, {Name: "management", Listener: management}}
+	if l := TakeListener(&listeners, "management"); l != management {
+		t.Errorf("expected the management socket, got %v", l)
+	}
+	if l := TakeListener(&listeners, "management"); l != nil {
+		t.Errorf("expected the management socket to be taken, got %v", l)
+	}
+	if l := TakeListener(&listeners, ""); l != main {
+		t.Errorf("expected the remaining socket, got %v", l)
+	}
+	if len(listeners) != 0 {
+		t.Errorf("expected no sockets left, got %v", listeners)
+	}
+}
+
+func TestSdNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	if err := SDNotify("READY=1"); err != nil {
+		t.Errorf("expected nothing to happen without NOTIFY_SOCKET, got %s", err)
+	}
+
+	dir, err := ioutil.TempDir("", "waitron-notify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	if err := SDNotify("READY=1"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 64)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buf)
+	if err != nil || string(buf[:n]) != "READY=1" {
+		t.Errorf("unexpected notification %q, %v", buf[:n], err)
+	}
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+)
+
+const defaultFileQueueTimeoutSeconds = 30
+
+// Bytes written between checks against the rate limits
+const throttleChunkSize = 16 * 1024
+
+// Limits the rate to a number of bytes per second, with up to a second worth
+// of burst. Callers going over sleep off the debt.
+type rateLimiter struct {
+	mux       sync.Mutex
+	rate      float64
+	allowance float64
+	last      time.Time
+}
+
+func newRateLimiter(bytesPerSec int) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSec), last: time.Now()}
+}
+
+func (l *rateLimiter) wait(n int) {
+	l.mux.Lock()
+	now := time.Now()
+	l.allowance += now.Sub(l.last).Seconds() * l.rate
+	if l.allowance > l.rate {
+		l.allowance = l.rate
+	}
+	l.last = now
+	l.allowance -= float64(n)
+
+	var delay time.Duration
+	if l.allowance < 0 {
+		delay = time.Duration(-l.allowance / l.rate * float64(time.Second))
+	}
+	l.mux.Unlock()
+
+	time.Sleep(delay)
+}
+
+type throttledResponse struct {
+	http.ResponseWriter
+	limiters []*rateLimiter
+}
+
+func (w *throttledResponse) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > throttleChunkSize {
+			chunk = chunk[:throttleChunkSize]
+		}
+		for _, l := range w.limiters {
+			l.wait(len(chunk))
+		}
+
+		n, err := w.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+type fileClient struct {
+	slots   chan struct{}
+	limiter *rateLimiter
+	refs    int
+}
+
+type fileLimiter struct {
+	config       config.FileLimitsConfig
+	queueTimeout time.Duration
+	slots        chan struct{}
+	limiter      *rateLimiter
+
+	mux     sync.Mutex
+	clients map[string]*fileClient
+}
+
+func newFileLimiter(config config.FileLimitsConfig) *fileLimiter {
+	l := &fileLimiter{
+		config:       config,
+		queueTimeout: time.Duration(config.QueueTimeoutSeconds) * time.Second,
+		clients:      make(map[string]*fileClient),
+	}
+	if l.queueTimeout <= 0 {
+		l.queueTimeout = defaultFileQueueTimeoutSeconds * time.Second
+	}
+	if config.MaxDownloads > 0 {
+		l.slots = make(chan struct{}, config.MaxDownloads)
+	}
+	if config.MaxBytesPerSec > 0 {
+		l.limiter = newRateLimiter(config.MaxBytesPerSec)
+	}
+	return l
+}
+
+func (l *fileLimiter) client(addr string) *fileClient {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	c, found := l.clients[addr]
+	if !found {
+		c = &fileClient{}
+		if l.config.MaxClientDownloads > 0 {
+			c.slots = make(chan struct{}, l.config.MaxClientDownloads)
+		}
+		if l.config.MaxClientBytesPerSec > 0 {
+			c.limiter = newRateLimiter(l.config.MaxClientBytesPerSec)
+		}
+		l.clients[addr] = c
+	}
+	c.refs++
+	return c
+}
+
+func (l *fileLimiter) release(addr string, c *fileClient) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	if c.refs--; c.refs == 0 {
+		delete(l.clients, addr)
+	}
+}
+
+// Take a slot from slots, a nil channel has no limit
+func acquireSlot(slots chan struct{}, request *http.Request, timeout <-chan time.Time) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-request.Context().Done():
+	case <-timeout:
+	}
+	return false
+}
+
+func releaseSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// Apply the limits to h
+func (l *fileLimiter) handle(h httprouter.Handle) httprouter.Handle {
+	return func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+		addr, _, err := net.SplitHostPort(request.RemoteAddr)
+		if err != nil {
+			addr = request.RemoteAddr
+		}
+		c := l.client(addr)
+		defer l.release(addr, c)
+
+		timeout := time.NewTimer(l.queueTimeout)
+		defer timeout.Stop()
+
+		if !acquireSlot(c.slots, request, timeout.C) {
+			l.busy(response, request, "Too many downloads from this client")
+			return
+		}
+		defer releaseSlot(c.slots)
+
+		if !acquireSlot(l.slots, request, timeout.C) {
+			l.busy(response, request, "Too many downloads")
+			return
+		}
+		defer releaseSlot(l.slots)
+
+		var limiters []*rateLimiter
+		if c.limiter != nil {
+			limiters = append(limiters, c.limiter)
+		}
+		if l.limiter != nil {
+			limiters = append(limiters, l.limiter)
+		}
+		if len(limiters) > 0 {
+			response = &throttledResponse{ResponseWriter: response, limiters: limiters}
+		}
+
+		h(response, request, ps)
+	}
+}
+
+func (l *fileLimiter) busy(response http.ResponseWriter, request *http.Request, msg string) {
+	config.RequestLogger(request).Warn("download refused", "reason", msg, "remote", request.RemoteAddr)
+	response.Header().Set("Retry-After", strconv.Itoa(int(l.queueTimeout.Seconds())))
+	httpError(response, request, msg, http.StatusServiceUnavailable)
+}
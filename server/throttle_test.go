@@ -0,0 +1,106 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(10000)
+	start := time.Now()
+	l.wait(1000)
+	l.wait(1000)
+
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("2000 bytes at 10000/s took %s", elapsed)
+	}
+}
+
+func TestThrottledResponse(t *testing.T) {
+	response := httptest.NewRecorder()
+	w := &throttledResponse{ResponseWriter: response, limiters: []*rateLimiter{newRateLimiter(1 << 20)}}
+
+	payload := bytes.Repeat([]byte("x"), 3*throttleChunkSize+1)
+	if n, err := w.Write(payload); err != nil || n != len(payload) {
+		t.Fatalf("wrote %d, %v", n, err)
+	}
+	if !bytes.Equal(response.Body.Bytes(), payload) {
+		t.Error("payload arrived altered")
+	}
+}
+
+func TestFileLimiterConcurrency(t *testing.T) {
+	l := newFileLimiter(config.FileLimitsConfig{MaxClientDownloads: 1})
+	l.queueTimeout = 50 * time.Millisecond
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := l.handle(func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+		started <- struct{}{}
+		<-release
+	})
+
+	first := make(chan struct{})
+	go func() {
+		h(httptest.NewRecorder(), httptest.NewRequest("GET", "/files/linux", nil), nil)
+		close(first)
+	}()
+	<-started
+
+	// Same client, over the limit
+	response := httptest.NewRecorder()
+	h(response, httptest.NewRequest("GET", "/files/linux", nil), nil)
+	if response.Code != http.StatusServiceUnavailable || response.Header().Get("Retry-After") == "" {
+		t.Errorf("expected a 503 with Retry-After, got %d", response.Code)
+	}
+
+	// Another client is fine
+	other := httptest.NewRequest("GET", "/files/linux", nil)
+	other.RemoteAddr = "192.0.2.2:1234"
+	done := make(chan struct{})
+	go func() {
+		h(httptest.NewRecorder(), other, nil)
+		close(done)
+	}()
+	<-started
+	release <- struct{}{}
+	release <- struct{}{}
+	<-first
+	<-done
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if len(l.clients) != 0 {
+		t.Errorf("expected finished clients to be forgotten, got %v", l.clients)
+	}
+}
+
+func TestFileLimiterQueues(t *testing.T) {
+	l := newFileLimiter(config.FileLimitsConfig{MaxDownloads: 1})
+	l.queueTimeout = time.Second
+
+	release := make(chan struct{})
+	h := l.handle(func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+		<-release
+	})
+
+	go h(httptest.NewRecorder(), httptest.NewRequest("GET", "/files/linux", nil), nil)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		release <- struct{}{}
+		release <- struct{}{}
+	}()
+
+	// Waits for the first download rather than failing
+	response := httptest.NewRecorder()
+	h(response, httptest.NewRequest("GET", "/files/linux", nil), nil)
+	if response.Code != http.StatusOK {
+		t.Errorf("expected the queued download to go through, got %d", response.Code)
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+)
+
+type timeoutResult struct {
+	State          string
+	Error          string
+	TimeoutSeconds float64
+	RequestID      string `json:",omitempty"`
+}
+
+// timeoutWriter holds the handler's headers back until it starts answering,
+// so a timeout can still answer instead
+type timeoutWriter struct {
+	response http.ResponseWriter
+	header   http.Header
+
+	mux       sync.Mutex
+	committed bool
+	timedOut  bool
+}
+
+func (w *timeoutWriter) Header() http.Header {
+	return w.header
+}
+
+// Callers hold w.mux
+func (w *timeoutWriter) commit(code int) {
+	if w.committed {
+		return
+	}
+	for k, v := range w.header {
+		w.response.Header()[k] = v
+	}
+	w.response.WriteHeader(code)
+	w.committed = true
+}
+
+func (w *timeoutWriter) WriteHeader(code int) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if !w.timedOut {
+		w.commit(code)
+	}
+}
+
+func (w *timeoutWriter) Write(p []byte) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	w.commit(http.StatusOK)
+	return w.response.Write(p)
+}
+
+func (w *timeoutWriter) Flush() {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.timedOut {
+		return
+	}
+	w.commit(http.StatusOK)
+	if f, ok := w.response.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Answer with a 503 unless the handler already started answering
+func (w *timeoutWriter) timeout(request *http.Request, timeout time.Duration) bool {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if w.committed {
+		return false
+	}
+	w.timedOut = true
+
+	js, _ := json.Marshal(timeoutResult{
+		State:          "TIMEOUT",
+		Error:          fmt.Sprintf("%s %s did not finish within %s", request.Method, request.URL.Path, timeout),
+		TimeoutSeconds: timeout.Seconds(),
+		RequestID:      config.RequestID(request),
+	})
+	w.response.Header().Set("content-type", "application/json")
+	w.response.Header().Set("Retry-After", "5")
+	w.response.WriteHeader(http.StatusServiceUnavailable)
+	w.response.Write(js)
+	return true
+}
+
+// Give h until timeout to start answering, 0 means no limit
+func withTimeout(timeout time.Duration, h httprouter.Handle) httprouter.Handle {
+	if timeout <= 0 {
+		return h
+	}
+	return func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+		ctx, cancel := context.WithTimeout(request.Context(), timeout)
+		defer cancel()
+		request = request.WithContext(ctx)
+
+		w := &timeoutWriter{response: response, header: make(http.Header)}
+		finished := make(chan interface{}, 1)
+		go func() {
+			defer func() { finished <- recover() }()
+			h(w, request, ps)
+		}()
+
+		select {
+		case p := <-finished:
+			if p != nil {
+				panic(p)
+			}
+			return
+		case <-ctx.Done():
+		}
+
+		if ctx.Err() == context.DeadlineExceeded && w.timeout(request, timeout) {
+			logRequest(request, fmt.Sprintf("timed out after %s", timeout))
+			return
+		}
+
+		// Already answering, or the client went away: let it finish
+		if p := <-finished; p != nil {
+			panic(p)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestWithTimeoutFast(t *testing.T) {
+	h := withTimeout(time.Second, func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+		if _, ok := request.Context().Deadline(); !ok {
+			t.Error("expected the request to carry a deadline")
+		}
+		response.Header().Set("content-type", "application/json")
+		response.WriteHeader(http.StatusCreated)
+		response.Write([]byte(`{"State":"OK"}`))
+	})
+
+	response := httptest.NewRecorder()
+	h(response, httptest.NewRequest("GET", "/status", nil), nil)
+	if response.Code != http.StatusCreated || response.Body.String() != `{"State":"OK"}` ||
+		response.Header().Get("content-type") != "application/json" {
+		t.Errorf("unexpected response %d %q %v", response.Code, response.Body.String(), response.Header())
+	}
+}
+
+func TestWithTimeoutSlow(t *testing.T) {
+	release := make(chan struct{})
+	h := withTimeout(50*time.Millisecond, func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+		<-release
+		response.Header().Set("X-Late", "yes")
+		if _, err := response.Write([]byte("late")); err != http.ErrHandlerTimeout {
+			t.Errorf("expected writes after the timeout to fail, got %v", err)
+		}
+		close(release)
+	})
+
+	response := httptest.NewRecorder()
+	h(response, httptest.NewRequest("GET", "/template/preseed/host/token", nil), nil)
+	release <- struct{}{}
+	<-release
+
+	if response.Code != http.StatusServiceUnavailable || response.Header().Get("X-Late") != "" {
+		t.Errorf("unexpected response %d %v", response.Code, response.Header())
+	}
+	var r timeoutResult
+	if err := json.Unmarshal(response.Body.Bytes(), &r); err != nil || r.State != "TIMEOUT" || r.TimeoutSeconds != 0.05 {
+		t.Errorf("unexpected body %q", response.Body.String())
+	}
+}
+
+func TestWithTimeoutAlreadyAnswering(t *testing.T) {
+	h := withTimeout(20*time.Millisecond, func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+		response.Write([]byte("first"))
+		time.Sleep(60 * time.Millisecond)
+		response.Write([]byte(" second"))
+	})
+
+	response := httptest.NewRecorder()
+	h(response, httptest.NewRequest("GET", "/template/preseed/host/token", nil), nil)
+	if response.Code != http.StatusOK || response.Body.String() != "first second" {
+		t.Errorf("expected a started response to finish, got %d %q", response.Code, response.Body.String())
+	}
+}
+
+func TestWithTimeoutPanics(t *testing.T) {
+	h := withTimeout(time.Second, func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+		panic(http.ErrAbortHandler)
+	})
+
+	defer func() {
+		if p := recover(); p != http.ErrAbortHandler {
+			t.Errorf("expected the panic to reach the caller, got %v", p)
+		}
+	}()
+	h(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), nil)
+}
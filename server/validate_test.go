@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestPhoneHome(t *testing.T) {
+	interval := statepkg.ValidationInterval
+	statepkg.ValidationInterval = 10 * time.Millisecond
+	defer func() { statepkg.ValidationInterval = interval }()
+
+	state := statepkg.New()
+	outcomes := make(chan statepkg.Event, 10)
+	state.Events.Subscribe(func(e statepkg.Event) {
+		if e.Type == machine.EventBuildCompleted || e.Type == machine.EventBuildFailed {
+			outcomes <- e
+		}
+	})
+	m := machine.Machine{Hostname: "dns02.example.com", Network: []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}}
+	m.Validation = &config.ValidationConfig{PhoneHome: true, TimeoutSeconds: 5}
+	token, err := state.SetBuildMode(m, config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	phoneHome := func() int {
+		form := url.Values{
+			"instance_id":     {"i-0123"},
+			"hostname":        {"dns02"},
+			"fqdn":            {"dns02.example.com"},
+			"pub_key_ed25519": {"ssh-ed25519 AAAAC3Nza root@dns02\n"},
+			"pub_key_rsa":     {""},
+		}
+		request := httptest.NewRequest("POST", "/phone-home/dns02.example.com/"+token, strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		response := httptest.NewRecorder()
+		phoneHomeHandler(response, request, httprouter.Params{{Key: "hostname", Value: "dns02.example.com"}, {Key: "token", Value: token}}, config.Config{}, state)
+		return response.Code
+	}
+
+	if code := phoneHome(); code != 409 {
+		t.Errorf("expected a phone home before /done to be refused, got %d", code)
+	}
+	building := state.MachineByToken(token)
+	if err := state.CompleteBuild(building, config.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if code := phoneHome(); code != 200 {
+		t.Fatalf("expected the phone home to be accepted, got %d", code)
+	}
+
+	select {
+	case e := <-outcomes:
+		r := e.Machine.ValidationResults.PhoneHome
+		if e.Type != machine.EventBuildCompleted || e.Machine.State != machine.BuildBooted || e.Machine.Status != "Installed" || r == nil ||
+			r.InstanceID != "i-0123" || r.FQDN != "dns02.example.com" || len(r.PublicKeys) != 1 ||
+			r.PublicKeys["ed25519"] != "ssh-ed25519 AAAAC3Nza root@dns02" {
+			t.Errorf("expected the build to end booted, got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the validation to finish")
+	}
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/state"
+	"github.com/ns1/waitron/template"
+)
+
+// NewHandler routes waitron's API to the handlers serving config and state.
+// Access logging, metrics, request IDs and keeping the management APIs off
+// the main listener are left to whoever serves it.
+func NewHandler(config config.Config, state *state.State) http.Handler {
+	timeouts := config.RequestTimeouts
+	r := httprouter.New()
+	r.GET("/list", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			listMachinesHandler(response, request, ps, config, state)
+		}))
+	r.GET("/api/v1/inventory", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			inventoryHandler(response, request, ps, config, state)
+		}))
+	r.GET("/export/inventory", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			exportInventoryHandler(response, request, ps, config, state)
+		}))
+	r.GET("/hooks", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			listHooksHandler(response, request, ps, config)
+		}))
+	r.GET("/hooks/results/:hostname", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			hookResultsHandler(response, request, ps, config, state)
+		}))
+	r.POST("/api/v1/hooks/:name/run", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			runHookHandler(response, request, ps, config, state)
+		}))
+	r.POST("/api/v1/bulk-builds", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			bulkBuildHandler(response, request, ps, config, state)
+		}))
+	r.GET("/api/v1/bulk-builds", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			listBulkBuildsHandler(response, request, ps, config, state)
+		}))
+	r.GET("/api/v1/bulk-builds/:id", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			getBulkBuildHandler(response, request, ps, config, state)
+		}))
+	r.POST("/api/v1/bulk-builds/:id/resume", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			resumeBulkBuildHandler(response, request, ps, config, state)
+		}))
+	r.POST("/api/v1/group-rebuilds", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			groupRebuildHandler(response, request, ps, config, state)
+		}))
+	r.GET("/api/v1/dead-letters", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			listDeadLettersHandler(response, request, ps, config, state)
+		}))
+	r.GET("/api/v1/dead-letters/:id", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			getDeadLetterHandler(response, request, ps, config, state)
+		}))
+	r.DELETE("/api/v1/dead-letters/:id", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			deleteDeadLetterHandler(response, request, ps, config, state)
+		}))
+	r.POST("/api/v1/dead-letters/:id/replay", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			replayDeadLetterHandler(response, request, ps, config, state)
+		}))
+	r.PUT("/build/:hostname", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			buildHandler(response, request, ps, config, state)
+		}))
+	r.POST("/api/v1/build/:hostname/rollback", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			rollbackHandler(response, request, ps, config, state)
+		}))
+	r.GET("/rescue/:hostname", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			rescueHandler(response, request, ps, config, state)
+		}))
+	r.GET("/status/:hostname", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			hostStatus(response, request, ps, config, state)
+		}))
+	r.POST("/status/:hostname/:token", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			hostProgressHandler(response, request, ps, config, state)
+		}))
+	r.PUT("/heartbeat/:hostname/:token", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			heartbeatHandler(response, request, ps, config, state)
+		}))
+	r.GET("/config/:hostname", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			hostConfigHandler(response, request, ps, config)
+		}))
+	r.GET("/config/:hostname/vm", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			hostConfigVmHandler(response, request, ps, config)
+		}))
+	r.GET("/enc/:hostname", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			encHandler(response, request, ps, config)
+		}))
+	r.GET("/salt/pillar/:minion", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			saltPillarHandler(response, request, ps, config)
+		}))
+	r.GET("/salt/roster", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			saltRosterHandler(response, request, ps, config, state)
+		}))
+	r.GET("/schema/:kind", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			schemaHandler(response, request, ps, config)
+		}))
+	r.GET("/status", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			status(response, request, ps, config, state)
+		}))
+	r.GET("/done/:hostname/:token", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			doneHandler(response, request, ps, config, state)
+		}))
+	r.POST("/done/:hostname", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			doneHandler(response, request, ps, config, state)
+		}))
+	r.GET("/firmware/:hostname/:token", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			firmwareHandler(response, request, ps, config, state)
+		}))
+	r.POST("/firmware/:hostname/:token", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			firmwareResultHandler(response, request, ps, config, state)
+		}))
+	r.GET("/raid/:hostname/:token", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			raidHandler(response, request, ps, config, state)
+		}))
+	r.POST("/raid/:hostname/:token", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			raidResultHandler(response, request, ps, config, state)
+		}))
+	r.POST("/burnin/:hostname/:token", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			burnInHandler(response, request, ps, config, state)
+		}))
+	r.POST("/wipe/:hostname/:token", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			wipeHandler(response, request, ps, config, state)
+		}))
+	r.POST("/artifacts/:hostname/:token", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			artifactHandler(response, request, ps, config, state)
+		}))
+	r.POST("/validate/:hostname/:token", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			validateHandler(response, request, ps, config, state)
+		}))
+	r.POST("/phone-home/:hostname/:token", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			phoneHomeHandler(response, request, ps, config, state)
+		}))
+	r.GET("/cancel/:hostname/:token", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			cancelHandler(response, request, ps, config, state)
+		}))
+	r.POST("/cancel/:hostname", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			cancelHandler(response, request, ps, config, state)
+		}))
+	r.GET("/template/:template/:hostname/:token", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			templateHandler(response, request, ps, config, state)
+		}))
+	r.POST("/api/v1/drift-checks", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			driftCheckHandler(response, request, ps, config, state)
+		}))
+	r.GET("/history/:hostname", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			hostHistoryHandler(response, request, ps, config, state)
+		}))
+	r.GET("/api/v1/machines/:hostname/annotations", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			getAnnotationsHandler(response, request, ps, config, state)
+		}))
+	r.PUT("/api/v1/machines/:hostname/annotations", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			putAnnotationsHandler(response, request, ps, config, state)
+		}))
+	r.DELETE("/api/v1/machines/:hostname/annotations", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			deleteAnnotationsHandler(response, request, ps, config, state)
+		}))
+	r.GET("/api/v2/machines", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			apiListMachinesHandler(response, request, ps, config, state)
+		}))
+	r.POST("/api/v2/machines", requireAdmin(config, withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			apiCreateMachineHandler(response, request, ps, config, state)
+		})))
+	r.GET("/api/v2/machines/:hostname", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			apiGetMachineHandler(response, request, ps, config, state)
+		}))
+	r.PUT("/api/v2/machines/:hostname", requireAdmin(config, withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			apiUpdateMachineHandler(response, request, ps, config, state)
+		})))
+	r.DELETE("/api/v2/machines/:hostname", requireAdmin(config, withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			apiDeleteMachineHandler(response, request, ps, config, state)
+		})))
+	r.DELETE("/api/v1/template-cache", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			templateCacheDeleteHandler(response, request, ps, config, state)
+		}))
+	r.GET("/ipam", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			ipamHandler(response, request, ps, config, state)
+		}))
+	r.DELETE("/api/v1/ipam/:pool/:address", requireAdmin(config, withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			ipamReleaseHandler(response, request, ps, config, state)
+		})))
+	r.GET("/api/v1/images", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			imagesHandler(response, request, ps, config, state)
+		}))
+	r.POST("/api/v1/images/:name/sync", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			syncImageHandler(response, request, ps, config, state)
+		}))
+	r.POST("/admin/sync", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			gitSyncHandler(response, request, ps, config, state)
+		}))
+	r.POST("/api/v1/handover", requireAdmin(config,
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			handoverHandler(response, request, ps, config, state)
+		}))
+	r.GET("/api/v1/builds/:token", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			buildPhasesHandler(response, request, ps, config, state)
+		}))
+	r.GET("/api/v1/builds/:token/artifacts/:name", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			getArtifactHandler(response, request, ps, config, state)
+		}))
+	r.GET("/v1/boot/:macaddr", withTimeout(timeouts.Long(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			pixieHandler(response, request, ps, config, state)
+		}))
+	r.GET("/health", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			healthHandler(response, request, ps, config, state)
+		}))
+	r.GET("/livez", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			livezHandler(response, request, ps, config, state)
+		}))
+	r.GET("/readyz", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			readyzHandler(response, request, ps, config, state)
+		}))
+	r.GET("/events",
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			eventsHandler(response, request, ps, config, state)
+		})
+	r.GET("/stats/builds", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			buildStatsHandler(response, request, ps, config, state)
+		}))
+	r.GET("/version", withTimeout(timeouts.Short(),
+		func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			versionHandler(response, request, ps, config, state)
+		}))
+
+	var limiter *fileLimiter
+	if config.FileLimits != nil {
+		limiter = newFileLimiter(*config.FileLimits)
+	}
+
+	if state.Images != nil {
+		var images httprouter.Handle = func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			imageHandler(response, request, ps, config, state)
+		}
+		if limiter != nil {
+			images = limiter.handle(images)
+		}
+		r.GET("/images/:name", images)
+		r.HEAD("/images/:name", images)
+	}
+
+	if config.StaticFilesPath != "" {
+		var files httprouter.Handle = func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+			staticFileHandler(response, request, ps, config)
+		}
+		if limiter != nil {
+			files = limiter.handle(files)
+		}
+		r.GET("/files/*filepath", files)
+		r.HEAD("/files/*filepath", files)
+		r.PUT("/api/v1/files/*filepath", requireAdmin(config,
+			func(response http.ResponseWriter, request *http.Request, ps httprouter.Params) {
+				uploadFileHandler(response, request, ps, config)
+			}))
+		logger.Info("serving static files", "path", config.StaticFilesPath)
+		go template.Checksums.Warm(config.StaticFilesPath)
+	}
+
+	return r
+}
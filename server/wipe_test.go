@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+func TestWipe(t *testing.T) {
+	build := func() (*statepkg.State, *machine.Machine, *[]statepkg.Event) {
+		return preinstallBuild(t, machine.EventDisksWiped, func(m *machine.Machine) {
+			m.BurnIn = &config.BurnInConfig{Kernel: "memtest"}
+			m.Wipe = &config.WipeConfig{ImageURL: "http://images.example.com/wipe/", Kernel: "vmlinuz", Initrd: "initrd.img",
+				Cmdline: "wipe.method={{ machine.Wipe.Method }}", Method: "nist-purge"}
+		})
+	}
+
+	state, m, events := build()
+	if err := state.ReportBurnIn(m.Token, machine.BurnInResult{Passed: true}, config.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if m.State != machine.BuildWiping {
+		t.Fatalf("expected the build to wipe after burn-in, got %s", m.State)
+	}
+	if boot, _ := m.PixieInit(); boot.Kernel != "http://images.example.com/wipe/vmlinuz" || boot.Cmdline != "wipe.method=nist-purge" {
+		t.Errorf("expected the wipe image to be served, got %+v", boot)
+	}
+	response := httptest.NewRecorder()
+	wipeHandler(response, httptest.NewRequest("POST", "/wipe/dns02.example.com/"+m.Token,
+		strings.NewReader(`{"Disks": [{"Device": "/dev/sda", "Serial": "S3Z9NX0K", "Method": "nist-purge", "DurationSeconds": 5400, "Passed": true},
+			{"Device": "/dev/nvme0n1", "Method": "nvme-format", "DurationSeconds": 12, "Passed": true}]}`)),
+		httprouter.Params{{Key: "hostname", Value: "dns02.example.com"}, {Key: "token", Value: m.Token}}, config.Config{}, state)
+	if response.Code != 200 {
+		t.Fatalf("unexpected response %d %s", response.Code, response.Body.String())
+	}
+	if m.State != machine.BuildPending || len(*events) != 1 || (*events)[0].Type != machine.EventDisksWiped {
+		t.Errorf("expected a wipe to go on to the install, got %s %+v", m.State, *events)
+	}
+	h, err := statepkg.LoadHostHistory(state.Store, "dns02.example.com")
+	if err != nil || h == nil || len(h.Entries) != 1 || h.Entries[0].Wipe == nil || len(h.Entries[0].Wipe.Disks) != 2 ||
+		h.Entries[0].Wipe.Disks[0].Serial != "S3Z9NX0K" {
+		t.Errorf("expected the wipe certificate in the host history, got %+v %v", h, err)
+	}
+
+	state, m, events = build()
+	state.ReportBurnIn(m.Token, machine.BurnInResult{Passed: true}, config.Config{})
+	err = state.ReportWipe(m.Token, machine.WipeCertificate{Disks: []machine.WipedDisk{
+		{Device: "/dev/sda", Method: "secure-erase", Passed: false, Message: "frozen"}}}, config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.State != machine.BuildFailed || len(*events) != 1 || (*events)[0].Message != "wipe failed: /dev/sda: frozen" {
+		t.Errorf("expected a failed wipe to fail the build, got %s %+v", m.State, *events)
+	}
+
+	state, m, events = build()
+	state.ReportBurnIn(m.Token, machine.BurnInResult{Passed: true}, config.Config{})
+	state.ReportWipe(m.Token, machine.WipeCertificate{}, config.Config{})
+	if m.State != machine.BuildFailed || len(*events) != 1 || !strings.Contains((*events)[0].Message, "no disks reported") {
+		t.Errorf("expected a wipe without disks to fail the build, got %s %+v", m.State, *events)
+	}
+}
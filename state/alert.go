@@ -0,0 +1,209 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	neturl "net/url"
+	"sync"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Alerting notifiers open an incident when a build goes stale, fails or
+// dead-letters a hook, and resolve it when the build completes or is
+// cancelled. Incidents are keyed by hostname and build token, so everything
+// going wrong with one build ends up in one incident and it is only opened
+// once. Open incidents are only known in memory, an incident open across a
+// restart has to be resolved by hand.
+
+var alertTriggers = map[string]bool{
+	machine.EventBuildStale:     true,
+	machine.EventBuildFailed:    true,
+	machine.EventHookDeadLetter: true,
+}
+
+var alertResolves = map[string]bool{
+	machine.EventBuildCompleted: true,
+	machine.EventBuildCancelled: true,
+}
+
+const pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+const opsgenieURL = "https://api.opsgenie.com/v2/alerts"
+
+func isAlertNotifier(notifierType string) bool {
+	return notifierType == "pagerduty" || notifierType == "opsgenie"
+}
+
+type alertNotifier struct {
+	config config.NotifierConfig
+	client *http.Client
+
+	mux  sync.Mutex
+	open map[string]bool
+}
+
+func newAlertNotifier(nc config.NotifierConfig) (Notifier, error) {
+	switch nc.Type {
+	case "pagerduty":
+		if nc.RoutingKey == "" {
+			return nil, fmt.Errorf("notifier %s needs a routing_key", nc)
+		}
+		if nc.URL == "" {
+			nc.URL = pagerDutyURL
+		}
+	case "opsgenie":
+		if nc.APIKey == "" {
+			return nil, fmt.Errorf("notifier %s needs an api_key", nc)
+		}
+		if nc.URL == "" {
+			nc.URL = opsgenieURL
+		}
+	}
+	if nc.Severity == "" {
+		nc.Severity = "error"
+	}
+
+	return &alertNotifier{
+		config: nc,
+		client: &http.Client{Timeout: notifierTimeout},
+		open:   map[string]bool{},
+	}, nil
+}
+
+func alertKey(e Event) string {
+	return fmt.Sprintf("waitron/%s/%s", e.Hostname, e.Token)
+}
+
+func (n *alertNotifier) Notify(e Event) error {
+	key := alertKey(e)
+
+	n.mux.Lock()
+	open := n.open[key]
+	n.mux.Unlock()
+
+	switch {
+	case alertTriggers[e.Type] && !open:
+		summary, err := message(n.config, e)
+		if err != nil {
+			return err
+		}
+		if err := n.trigger(key, summary, e); err != nil {
+			return err
+		}
+		open = true
+	case alertResolves[e.Type] && open:
+		if err := n.resolve(key); err != nil {
+			return err
+		}
+		open = false
+	default:
+		return nil
+	}
+
+	n.mux.Lock()
+	if open {
+		n.open[key] = true
+	} else {
+		delete(n.open, key)
+	}
+	n.mux.Unlock()
+	return nil
+}
+
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+type pagerDutyPayload struct {
+	Summary       string      `json:"summary"`
+	Source        string      `json:"source"`
+	Severity      string      `json:"severity"`
+	CustomDetails interface{} `json:"custom_details,omitempty"`
+}
+
+type opsgenieAlert struct {
+	Message     string            `json:"message"`
+	Alias       string            `json:"alias"`
+	Description string            `json:"description,omitempty"`
+	Priority    string            `json:"priority,omitempty"`
+	Details     map[string]string `json:"details,omitempty"`
+}
+
+// Opsgenie has priorities instead of severities
+var opsgeniePriorities = map[string]string{
+	"critical": "P1",
+	"error":    "P2",
+	"warning":  "P3",
+	"info":     "P5",
+}
+
+func (n *alertNotifier) trigger(key string, summary string, e Event) error {
+	if n.config.Type == "opsgenie" {
+		return n.post(n.config.URL, opsgenieAlert{
+			Message:     summary,
+			Alias:       key,
+			Description: e.Message,
+			Priority:    opsgeniePriorities[n.config.Severity],
+			Details:     map[string]string{"hostname": e.Hostname, "token": e.Token, "event": e.Type},
+		})
+	}
+
+	return n.post(n.config.URL, pagerDutyEvent{
+		RoutingKey:  n.config.RoutingKey,
+		EventAction: "trigger",
+		DedupKey:    key,
+		Payload: &pagerDutyPayload{
+			Summary:       summary,
+			Source:        e.Hostname,
+			Severity:      n.config.Severity,
+			CustomDetails: e,
+		},
+	})
+}
+
+func (n *alertNotifier) resolve(key string) error {
+	if n.config.Type == "opsgenie" {
+		url := fmt.Sprintf("%s/%s/close?identifierType=alias", n.config.URL, neturl.PathEscape(key))
+		return n.post(url, map[string]string{"source": "waitron"})
+	}
+
+	return n.post(n.config.URL, pagerDutyEvent{
+		RoutingKey:  n.config.RoutingKey,
+		EventAction: "resolve",
+		DedupKey:    key,
+	})
+}
+
+func (n *alertNotifier) post(url string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.config.Type == "opsgenie" {
+		req.Header.Set("Authorization", "GenieKey "+n.config.APIKey)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", n.config, resp.Status)
+	}
+	return nil
+}
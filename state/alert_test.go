@@ -0,0 +1,78 @@
+package state
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestPagerDutyDedup(t *testing.T) {
+	var received []pagerDutyEvent
+	ts := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		var e pagerDutyEvent
+		json.NewDecoder(request.Body).Decode(&e)
+		received = append(received, e)
+		response.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	n, err := NewNotifier(config.NotifierConfig{Type: "pagerduty", URL: ts.URL, RoutingKey: "key"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	build := Event{Hostname: "dns02.example.com", Token: "token"}
+	for _, eventType := range []string{machine.EventBuildStale, machine.EventHookDeadLetter, machine.EventBuildFailed, machine.EventBuildCompleted, machine.EventBuildCancelled} {
+		e := build
+		e.Type = eventType
+		if err := n.Notify(e); err != nil {
+			t.Fatalf("%s: unexpected error: %s", eventType, err)
+		}
+	}
+
+	if len(received) != 2 {
+		t.Fatalf("expected one trigger and one resolve, got %+v", received)
+	}
+	if received[0].EventAction != "trigger" || received[1].EventAction != "resolve" {
+		t.Errorf("unexpected actions %s, %s", received[0].EventAction, received[1].EventAction)
+	}
+	if received[0].DedupKey != "waitron/dns02.example.com/token" || received[0].DedupKey != received[1].DedupKey {
+		t.Errorf("expected both to use the build's dedup key, got %s and %s", received[0].DedupKey, received[1].DedupKey)
+	}
+}
+
+func TestOpsgenieResolve(t *testing.T) {
+	var paths []string
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		paths = append(paths, request.URL.RequestURI())
+		auth = request.Header.Get("Authorization")
+	}))
+	defer ts.Close()
+
+	n, err := NewNotifier(config.NotifierConfig{Type: "opsgenie", URL: ts.URL, APIKey: "secret"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	n.Notify(Event{Type: machine.EventBuildFailed, Hostname: "dns02.example.com", Token: "token"})
+	n.Notify(Event{Type: machine.EventBuildCancelled, Hostname: "dns02.example.com", Token: "token"})
+
+	if len(paths) != 2 || paths[1] != "/waitron%2Fdns02.example.com%2Ftoken/close?identifierType=alias" {
+		t.Errorf("unexpected requests %v", paths)
+	}
+	if auth != "GenieKey secret" {
+		t.Errorf("unexpected authorization %q", auth)
+	}
+}
+
+func TestAlertNotifierDefaultEvents(t *testing.T) {
+	nc := config.NotifierConfig{Type: "pagerduty"}
+	if !wants(nc, machine.EventHookDeadLetter) || !wants(nc, machine.EventBuildCompleted) || wants(nc, machine.EventBuildStarted) {
+		t.Errorf("unexpected default events for alerting notifiers")
+	}
+}
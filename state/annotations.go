@@ -0,0 +1,51 @@
+package state
+
+import (
+	"time"
+
+	"github.com/ns1/waitron/machine"
+)
+
+const annotationsBucket = "annotations"
+
+func LoadAnnotations(store Store, hostname string) (*machine.Annotations, error) {
+	var a machine.Annotations
+	found, err := store.Get(annotationsBucket, hostname, &a)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &a, nil
+}
+
+// Persist annotations for hostname and attach them to the machine if it is
+// currently building so they show up in /status.
+func (state *State) SetAnnotations(hostname string, a *machine.Annotations) error {
+	a.UpdatedAt = time.Now()
+	if err := state.Store.Put(annotationsBucket, hostname, a); err != nil {
+		return err
+	}
+
+	state.Mux.Lock()
+	if m, found := state.MachineByHostname[hostname]; found {
+		m.Annotations = a
+		state.Version++
+	}
+	state.Mux.Unlock()
+
+	return nil
+}
+
+func (state *State) DeleteAnnotations(hostname string) error {
+	if err := state.Store.Delete(annotationsBucket, hostname); err != nil {
+		return err
+	}
+
+	state.Mux.Lock()
+	if m, found := state.MachineByHostname[hostname]; found {
+		m.Annotations = nil
+		state.Version++
+	}
+	state.Mux.Unlock()
+
+	return nil
+}
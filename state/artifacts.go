@@ -0,0 +1,129 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+var (
+	artifactNamePattern    = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+	ErrInvalidArtifactName = errors.New("artifact names are letters, digits, dots, dashes and underscores")
+	ErrArtifactTooLarge    = errors.New("artifact is too large")
+	ErrTooManyArtifacts    = errors.New("build has too many artifacts")
+)
+
+// Artifact is an uploaded artifact as it is stored
+type Artifact struct {
+	machine.ArtifactInfo
+	Data []byte
+}
+
+func ArtifactKey(token string, name string) string {
+	return token + "." + name
+}
+
+// Keep data as the artifact name of the build with token
+func (state *State) StoreArtifact(token string, name string, contentType string, data []byte, config configpkg.Config) (*machine.ArtifactInfo, error) {
+	if !artifactNamePattern.MatchString(name) {
+		return nil, ErrInvalidArtifactName
+	}
+	if int64(len(data)) > config.Artifacts.ByteLimit() {
+		return nil, ErrArtifactTooLarge
+	}
+	contentType, err := config.Artifacts.Accept(contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	info := machine.ArtifactInfo{
+		Name:        name,
+		ContentType: contentType,
+		Size:        int64(len(data)),
+		SHA256:      hex.EncodeToString(sum[:]),
+		Uploaded:    time.Now(),
+	}
+
+	state.Mux.Lock()
+	m, found := state.MachineByUUID[token]
+	if !found {
+		state.Mux.Unlock()
+		return nil, ErrUnknownBuild
+	}
+	if m.ArtifactIndex(name) < 0 && len(m.Artifacts) >= config.Artifacts.PerBuildLimit() {
+		state.Mux.Unlock()
+		return nil, ErrTooManyArtifacts
+	}
+	state.Mux.Unlock()
+
+	// Stored before the build lists it, so a listed artifact can be fetched
+	if err := state.Store.Put(configpkg.ArtifactsBucket, ArtifactKey(token, name), Artifact{ArtifactInfo: info, Data: data}); err != nil {
+		return nil, err
+	}
+
+	state.Mux.Lock()
+	if i := m.ArtifactIndex(name); i >= 0 {
+		m.Artifacts[i] = info
+	} else {
+		m.Artifacts = append(m.Artifacts, info)
+	}
+	state.Version++
+	state.Mux.Unlock()
+
+	logger.Machine(m).Info("artifact uploaded", "artifact", name, "content_type", contentType, "size", info.Size)
+	return &info, nil
+}
+
+// The artifact name of the build with token, nil if it has none by that
+// name
+func (state *State) Artifact(token string, name string) (*Artifact, error) {
+	if !artifactNamePattern.MatchString(name) {
+		return nil, nil
+	}
+	var a Artifact
+	found, err := state.Store.Get(configpkg.ArtifactsBucket, ArtifactKey(token, name), &a)
+	if err != nil {
+		return nil, err
+	}
+	if !found && state.Retention != nil && state.Retention.history != nil {
+		found, err = state.Retention.history.Get(configpkg.ArtifactsBucket, ArtifactKey(token, name), &a)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	return &a, nil
+}
+
+// Move the artifacts of an evicted build record out of the store, to
+// history if there is one
+func (r *buildRetention) evictArtifacts(b machine.BuildRecord) error {
+	for _, info := range b.Artifacts {
+		key := ArtifactKey(b.Token, info.Name)
+		if r.history != nil {
+			var a Artifact
+			found, err := r.store.Get(configpkg.ArtifactsBucket, key, &a)
+			if err != nil {
+				return err
+			}
+			if found {
+				if err := r.history.Put(configpkg.ArtifactsBucket, key, a); err != nil {
+					return fmt.Errorf("cannot move artifact %s to history: %s", info.Name, err)
+				}
+			}
+		}
+		if err := r.store.Delete(configpkg.ArtifactsBucket, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
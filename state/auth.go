@@ -0,0 +1,15 @@
+package state
+
+import (
+	"net/http"
+	"strings"
+)
+
+// The bearer token request carries, "" without one
+func BearerToken(request *http.Request) string {
+	auth := request.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
@@ -0,0 +1,201 @@
+package state
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/satori/go.uuid"
+)
+
+// Runs the hooks of a build stage for the state, see State.Hooks. hooks.Runner
+// is the one waitron uses.
+type hookRunner interface {
+	// The hooks of stage for m, request being what led to them, nil when
+	// nothing did
+	RunHooks(stage string, m *machine.Machine, config config.Config, state *State, request *http.Request) error
+
+	// The hooks of stage for m, from the worker of m
+	RunWorkerHooks(stage string, m *machine.Machine, config config.Config, state *State) error
+}
+
+// Run the hooks of stage for m with state.Hooks
+func (state *State) runHooks(stage string, m *machine.Machine, config config.Config, request *http.Request) error {
+	if state.Hooks == nil {
+		return nil
+	}
+	return state.Hooks.RunHooks(stage, m, config, state, request)
+}
+
+// Run the hooks of stage for m with state.Hooks, from the worker of m
+func (state *State) runWorkerHooks(stage string, m *machine.Machine, config config.Config) error {
+	if state.Hooks == nil {
+		return nil
+	}
+	return state.Hooks.RunWorkerHooks(stage, m, config, state)
+}
+
+func (state *State) SetBuildMode(m machine.Machine, config config.Config) (string, error) {
+
+	// Generate a random token used to authenticate requests
+	uuid, err := uuid.NewV4()
+
+	if err != nil {
+		return "", err
+	}
+
+	if m.HostKey, err = newHostKey(); err != nil {
+		return "", err
+	}
+
+	// Taken before addresses are allocated so it is what /config renders
+	m.Versions = state.buildVersions(&m, config)
+
+	// Addresses for interfaces with ip: auto, see ipam.go
+	if err := state.AllocateAddresses(&m); err != nil {
+		return "", err
+	}
+
+	// Perform any desired operations needed prior to setting build mode.
+	if err := m.RunBuildCommands(m.PreBuildCommands); err != nil {
+		state.releaseAddresses(&m)
+		return "", err
+	}
+
+	state.Mux.Lock()
+
+	state.Tokens[m.Hostname] = uuid.String()
+	logger.Machine(&m).Info("issued installation token", "token", state.Tokens[m.Hostname])
+
+	// Add token to machine struct
+	m.Token = state.Tokens[m.Hostname]
+
+	// Operator annotations follow the machine into /status
+	if a, err := LoadAnnotations(state.Store, m.Hostname); err == nil {
+		m.Annotations = a
+	} else {
+		logger.Machine(&m).Error("cannot load annotations", "error", err)
+	}
+
+	//Add to the Machine* tables
+	state.MachineByUUID[uuid.String()] = &m
+	state.MachineByMAC[fmt.Sprintf("%s", m.Network[0].MacAddress)] = &m
+	state.MachineByHostname[m.Hostname] = &m
+	m.BuildStart = time.Now()
+	m.ETA = state.Stats.estimate(&m)
+	m.AddPhase(machine.PhaseTokenIssued, false, "")
+	//Change machine state
+	pending, _ := m.SetState(machine.BuildPending, "")
+	var stageEntered *machine.StateTransition
+	stage := m.NextStage()
+	if stage != nil {
+		stageEntered, _ = m.EnterStage(stage)
+	}
+	state.Version++
+	snapshot := m
+
+	state.Mux.Unlock()
+
+	// Counted before build-started goes out so notifiers see this build
+	if h := state.RecordHistory(&snapshot); h != nil {
+		state.Mux.Lock()
+		m.History = h
+		state.Mux.Unlock()
+	}
+
+	// Whatever was rendered for a previous build of this machine is stale
+	state.RenderCache.Invalidate(m.Hostname)
+	state.Emit(machine.EventBuildStarted, &m, "")
+	state.emitTransition(&m, pending)
+	if stage != nil {
+		state.startStage(&m, config, stage, stageEntered)
+	}
+
+	return m.Token, nil
+}
+
+func (state *State) MachineByToken(token string) *machine.Machine {
+	state.Mux.Lock()
+	defer state.Mux.Unlock()
+	return state.MachineByUUID[token]
+}
+
+/*
+should remove the machines mac address from the MachineBy* maps
+which stops waitron from serving the PixieConfig used by pixiecore.
+Runs any configured commands for normal build completion.
+*/
+func (state *State) DoneBuildMode(m machine.Machine, config config.Config) error {
+
+	state.Mux.Lock()
+	//Delete mac from the building map
+	delete(state.MachineByHostname, fmt.Sprintf("%s", m.Hostname))
+	delete(state.MachineByMAC, fmt.Sprintf("%s", m.Network[0].MacAddress))
+	delete(state.MachineByUUID, m.Token)
+
+	//Change machine state
+	done, err := m.SetState(m.CompletedState(), "")
+	m.AddPhase(machine.PhaseDone, false, "")
+	state.Version++
+	state.Mux.Unlock()
+
+	if err != nil {
+		logger.Machine(&m).Warn("refused build state change", "error", err)
+	}
+
+	state.KeepAddresses(&m)
+	state.publishDNS(&m)
+
+	state.saveBuildRecord(&m)
+	m.History = state.RecordHistory(&m)
+	state.RenderCache.InvalidateToken(m.Token)
+	state.Emit(machine.EventBuildCompleted, &m, "")
+	state.emitTransition(&m, done)
+
+	// Perform any desired operations needed after a machine has been taken out of build mode because install has completed.
+	err = m.RunBuildCommands(m.PostBuildCommands)
+
+	return err
+}
+
+/*
+Should remove the machines mac address from the MachineBuild map
+which stops waitron from serving the PixieConfig used by pixiecore.
+Runs any configured commands for requested cancellations. reason, if any,
+goes with the phase and the event.
+*/
+func (state *State) CancelBuildMode(m machine.Machine, config config.Config, reason string) error {
+	state.TakeOutOfBuildMode(&m, reason)
+
+	// Perform any desired operations needed after a machine has been taken out of build mode by request.
+	return m.RunBuildCommands(m.CancelBuildCommands)
+}
+
+// Everything cancelling the build of m does but running its cancel commands
+func (state *State) TakeOutOfBuildMode(m *machine.Machine, reason string) {
+	state.Mux.Lock()
+	//Delete mac from the building map
+	delete(state.MachineByHostname, fmt.Sprintf("%s", m.Hostname))
+	delete(state.MachineByMAC, fmt.Sprintf("%s", m.Network[0].MacAddress))
+	delete(state.MachineByUUID, m.Token)
+
+	//Change machine state
+	cancelled, err := m.SetState(machine.BuildCancelled, reason)
+	m.AddPhase(machine.PhaseCancelled, false, reason)
+	state.Version++
+	state.Mux.Unlock()
+
+	if err != nil {
+		logger.Machine(m).Warn("refused build state change", "error", err)
+	}
+
+	state.releaseAddresses(m)
+
+	state.saveBuildRecord(m)
+	m.History = state.RecordHistory(m)
+	state.RenderCache.InvalidateToken(m.Token)
+	state.Emit(machine.EventBuildCancelled, m, reason)
+	state.emitTransition(m, cancelled)
+}
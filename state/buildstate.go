@@ -0,0 +1,49 @@
+package state
+
+import (
+	"github.com/ns1/waitron/machine"
+)
+
+// Move m to state to and emit the transition. A build that already left
+// build mode, e.g. one whose async post hooks fail after it is done, stays
+// as it left. Must not be called with state.Mux held.
+func (state *State) Transition(m *machine.Machine, to machine.BuildState, reason string) error {
+	state.Mux.Lock()
+	if state.MachineByUUID[m.Token] != m {
+		state.Mux.Unlock()
+		return nil
+	}
+	t, err := m.SetState(to, reason)
+	if t != nil {
+		state.Version++
+	}
+	state.Mux.Unlock()
+
+	if err != nil {
+		logger.Machine(m).Warn("refused build state change", "error", err)
+		return err
+	}
+	state.emitTransition(m, t)
+	return nil
+}
+
+// Emit t, if any, as a build-state-changed event. Must not be called with
+// state.Mux held.
+func (state *State) emitTransition(m *machine.Machine, t *machine.StateTransition) {
+	if t == nil {
+		return
+	}
+	state.Emit(machine.EventBuildStateChanged, m, t.Message())
+}
+
+// The state a build taken over from a Waitron that predates BuildState is
+// in, going by its phases
+func stateFromPhases(phases []machine.BuildPhase) machine.BuildState {
+	s := machine.BuildPending
+	for _, p := range phases {
+		if to, found := machine.PhaseStates[p.Name]; found && s.CanMoveTo(to) {
+			s = to
+		}
+	}
+	return s
+}
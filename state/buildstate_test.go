@@ -0,0 +1,89 @@
+package state
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestBuildStateTransitions(t *testing.T) {
+	m := machine.Machine{Hostname: "dns02.example.com"}
+	for _, to := range []machine.BuildState{machine.BuildPending, machine.BuildBooting, machine.BuildInstalling, machine.BuildStale, machine.BuildFailed, machine.BuildPending} {
+		if _, err := m.SetState(to, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(m.Transitions) != 6 || m.Transitions[0].From != "" || m.Transitions[5].From != machine.BuildFailed || m.Status != "Installing" {
+		t.Errorf("unexpected transitions %+v", m.Transitions)
+	}
+
+	if tr, err := m.SetState(machine.BuildPending, ""); tr != nil || err != nil {
+		t.Errorf("expected staying pending to do nothing, got %+v %v", tr, err)
+	}
+	m.SetState(machine.BuildFinishing, "")
+	if _, err := m.SetState(machine.BuildBooting, ""); err == nil || !strings.Contains(err.Error(), "cannot go from finishing to booting") {
+		t.Errorf("expected going back to be refused, got %v", err)
+	}
+	if m.Advance(machine.PhaseBootServed) != nil || m.State != machine.BuildFinishing {
+		t.Errorf("expected a boot config served again to leave the state alone, got %s", m.State)
+	}
+
+	m.SetState(machine.BuildDone, "")
+	if m.Status != "Installed" {
+		t.Errorf("expected the done build to be Installed, got %s", m.Status)
+	}
+	for _, to := range []machine.BuildState{machine.BuildPending, machine.BuildFailed, machine.BuildCancelled} {
+		if _, err := m.SetState(to, ""); err == nil {
+			t.Errorf("expected done to be final, went to %s", to)
+		}
+	}
+
+	phases := []machine.BuildPhase{{Name: machine.PhaseTokenIssued}, {Name: machine.PhaseBootServed}, {Name: machine.PhasePreseed}, {Name: machine.PhaseBootServed}}
+	if s := stateFromPhases(phases); s != machine.BuildInstalling {
+		t.Errorf("expected the build to be installing going by its phases, got %s", s)
+	}
+}
+
+func TestBuildStateLifecycle(t *testing.T) {
+	state := New()
+	var changes []string
+	var completed *machine.Machine
+	state.Events.Subscribe(func(e Event) {
+		switch e.Type {
+		case machine.EventBuildStateChanged:
+			changes = append(changes, e.Message)
+		case machine.EventBuildCompleted:
+			completed = e.Machine
+		}
+	})
+
+	m := machine.Machine{Hostname: "dns03.example.com", Network: []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}}
+	token, err := state.SetBuildMode(m, config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	building := state.MachineByToken(token)
+	state.RecordPhase(building, machine.PhaseBootServed)
+	if err := state.ReportProgress(token, machine.BuildProgress{Phase: "partitioning", Percent: 10}); err != nil {
+		t.Fatal(err)
+	}
+	state.RecordPhase(building, machine.PhaseBootServed)
+	state.RecordPhase(building, machine.PhaseFinish)
+	if err := state.DoneBuildMode(*building, config.Config{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(changes, ", ") != "pending, pending -> booting, booting -> installing, installing -> finishing, finishing -> done" {
+		t.Errorf("unexpected state changes %v", changes)
+	}
+	if r := completed.BuildRecord(); r.State != machine.BuildDone || r.Status != "Installed" || len(r.Transitions) != 5 || r.Transitions[4].Timestamp.IsZero() {
+		t.Errorf("unexpected build record %+v", r)
+	}
+
+	// A build that left build mode stays as it left
+	if err := state.Transition(building, machine.BuildFailed, "post hooks failed"); err != nil || len(changes) != 5 {
+		t.Errorf("expected a finished build to be left alone, got %v %v", err, changes)
+	}
+}
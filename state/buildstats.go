@@ -0,0 +1,168 @@
+package state
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ns1/waitron/machine"
+)
+
+// Durations kept per os and group to compute percentiles from
+const maxBuildDurations = 1000
+
+type buildStatsKey struct {
+	OperatingSystem string
+	Group           string
+}
+
+type buildStatsEntry struct {
+	durations []time.Duration // most recent last
+	completed int
+	failed    int
+	cancelled int
+	stale     int
+}
+
+// BuildStats summarizes the builds of one os and group. Durations are in
+// seconds, from the token being issued to done.
+type BuildStats struct {
+	OperatingSystem string
+	Group           string
+	Completed       int
+	Failed          int
+	Cancelled       int
+	Stale           int
+	P50             float64
+	P95             float64
+	Max             float64
+	Mean            float64
+}
+
+// buildStats follows the event bus and aggregates builds per os and group
+type buildStats struct {
+	mux     sync.Mutex
+	entries map[buildStatsKey]*buildStatsEntry
+
+	// Durations per os and profile for ETAs, see eta.go
+	profiles map[etaKey][]time.Duration
+}
+
+func newBuildStats() *buildStats {
+	return &buildStats{entries: make(map[buildStatsKey]*buildStatsEntry), profiles: make(map[etaKey][]time.Duration)}
+}
+
+func statsKey(m *machine.Machine) buildStatsKey {
+	if m == nil {
+		return buildStatsKey{}
+	}
+	return buildStatsKey{OperatingSystem: m.OperatingSystem, Group: m.Domain}
+}
+
+func (s *buildStats) entry(k buildStatsKey) *buildStatsEntry {
+	e, found := s.entries[k]
+	if !found {
+		e = &buildStatsEntry{}
+		s.entries[k] = e
+	}
+	return e
+}
+
+func (s *buildStats) record(e Event) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	switch e.Type {
+	case machine.EventBuildCompleted:
+		entry := s.entry(statsKey(e.Machine))
+		entry.completed++
+		if e.Machine != nil && !e.Machine.BuildStart.IsZero() {
+			entry.durations = append(entry.durations, e.Timestamp.Sub(e.Machine.BuildStart))
+			if len(entry.durations) > maxBuildDurations {
+				entry.durations = entry.durations[len(entry.durations)-maxBuildDurations:]
+			}
+			s.addDuration(etaKeyFor(e.Machine), e.Timestamp.Sub(e.Machine.BuildStart))
+		}
+	case machine.EventBuildFailed:
+		s.entry(statsKey(e.Machine)).failed++
+	case machine.EventBuildCancelled:
+		s.entry(statsKey(e.Machine)).cancelled++
+	case machine.EventBuildStale:
+		s.entry(statsKey(e.Machine)).stale++
+	}
+}
+
+// Nearest rank percentile p of sorted
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(p*float64(len(sorted))+0.999999) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+func (e *buildStatsEntry) summary(k buildStatsKey) BuildStats {
+	bs := BuildStats{
+		OperatingSystem: k.OperatingSystem,
+		Group:           k.Group,
+		Completed:       e.completed,
+		Failed:          e.failed,
+		Cancelled:       e.cancelled,
+		Stale:           e.stale,
+	}
+	if len(e.durations) == 0 {
+		return bs
+	}
+
+	sorted := append([]time.Duration(nil), e.durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	var total time.Duration
+	for _, d := range sorted {
+		total += d
+	}
+	bs.P50 = percentile(sorted, 0.50).Seconds()
+	bs.P95 = percentile(sorted, 0.95).Seconds()
+	bs.Max = sorted[len(sorted)-1].Seconds()
+	bs.Mean = (total / time.Duration(len(sorted))).Seconds()
+	return bs
+}
+
+// Summaries sorted by os and group, limited to os and group when not empty
+func (s *buildStats) List(os string, group string) []BuildStats {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	stats := []BuildStats{}
+	for k, e := range s.entries {
+		if (os != "" && k.OperatingSystem != os) || (group != "" && k.Group != group) {
+			continue
+		}
+		stats = append(stats, e.summary(k))
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].OperatingSystem != stats[j].OperatingSystem {
+			return stats[i].OperatingSystem < stats[j].OperatingSystem
+		}
+		return stats[i].Group < stats[j].Group
+	})
+	return stats
+}
+
+// Report the percentiles as gauges, tagged like the build counters
+func (s *buildStats) report(sink MetricSink) {
+	for _, bs := range s.List("", "") {
+		if bs.Completed == 0 {
+			continue
+		}
+		tags := osGroupTags(bs.OperatingSystem, bs.Group)
+		sink.Gauge("builds.duration.p50", bs.P50, tags...)
+		sink.Gauge("builds.duration.p95", bs.P95, tags...)
+	}
+}
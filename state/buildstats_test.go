@@ -0,0 +1,89 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/machine"
+)
+
+func TestPercentile(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Second)
+	}
+
+	if p := percentile(sorted, 0.50); p != 50*time.Second {
+		t.Errorf("p50 is %s", p)
+	}
+	if p := percentile(sorted, 0.95); p != 95*time.Second {
+		t.Errorf("p95 is %s", p)
+	}
+	if p := percentile(sorted[:1], 0.95); p != time.Second {
+		t.Errorf("p95 of one is %s", p)
+	}
+	if p := percentile(nil, 0.5); p != 0 {
+		t.Errorf("p50 of none is %s", p)
+	}
+}
+
+func TestBuildStats(t *testing.T) {
+	state := New()
+	now := time.Now()
+
+	build := func(os string, group string, minutes int) *machine.Machine {
+		m := &machine.Machine{Hostname: "host." + group, Domain: group, BuildStart: now.Add(-time.Duration(minutes) * time.Minute)}
+		m.OperatingSystem = os
+		return m
+	}
+
+	for _, minutes := range []int{10, 20, 30, 40} {
+		state.Events.Emit(Event{Type: machine.EventBuildCompleted, Machine: build("ubuntu", "example.com", minutes), Timestamp: now})
+	}
+	state.Events.Emit(Event{Type: machine.EventBuildFailed, Machine: build("ubuntu", "example.com", 5), Timestamp: now})
+	state.Events.Emit(Event{Type: machine.EventBuildCancelled, Machine: build("debian", "example.org", 5), Timestamp: now})
+
+	stats := state.Stats.List("", "")
+	if len(stats) != 2 {
+		t.Fatalf("expected 2 entries, got %+v", stats)
+	}
+
+	debian, ubuntu := stats[0], stats[1]
+	if debian.OperatingSystem != "debian" || debian.Cancelled != 1 || debian.Completed != 0 {
+		t.Errorf("unexpected debian stats %+v", debian)
+	}
+	if ubuntu.Completed != 4 || ubuntu.Failed != 1 {
+		t.Errorf("unexpected ubuntu counts %+v", ubuntu)
+	}
+	if ubuntu.P50 != 20*60 || ubuntu.P95 != 40*60 || ubuntu.Max != 40*60 || ubuntu.Mean != 25*60 {
+		t.Errorf("unexpected ubuntu durations %+v", ubuntu)
+	}
+
+	if only := state.Stats.List("", "example.org"); len(only) != 1 || only[0].Group != "example.org" {
+		t.Errorf("group filter returned %+v", only)
+	}
+}
+
+func TestBuildStatsReport(t *testing.T) {
+	state := New()
+	m := &machine.Machine{Hostname: "dns02.example.com", Domain: "example.com", BuildStart: time.Now().Add(-time.Minute)}
+	state.Events.Emit(Event{Type: machine.EventBuildCompleted, Machine: m})
+
+	sink := &gaugeSink{gauges: map[string]float64{}}
+	state.Stats.report(sink)
+	if sink.gauges["builds.duration.p95"] < 60 {
+		t.Errorf("unexpected gauges %v", sink.gauges)
+	}
+}
+
+type gaugeSink struct {
+	gauges map[string]float64
+}
+
+func (s *gaugeSink) Count(name string, value int64, tags ...MetricTag) {}
+
+func (s *gaugeSink) Timing(name string, d time.Duration, tags ...MetricTag) {}
+
+func (s *gaugeSink) Gauge(name string, value float64, tags ...MetricTag) {
+	s.gauges[name] = value
+}
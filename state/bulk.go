@@ -0,0 +1,508 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	uuid "github.com/satori/go.uuid"
+)
+
+// A bulk build, POST /api/v1/bulk-builds, builds many hosts as PUT /build
+// would, holding each host until the hosts it comes after are done, e.g.
+// storage heads before the compute nodes using them. With a domain_label,
+// at most max_per_domain hosts with the same value of that label build at
+// once, e.g. one node per Ceph failure domain. A host whose build fails
+// keeps its place, so it holds up what comes after it and its domain until
+// it is retried, completed or cancelled. Hosts after a cancelled one, or one
+// that couldn't be started, are skipped. With max_failures, failed hosts
+// don't hold anything up, but once more than max_failures of them failed the
+// bulk build is paused: no more hosts start until it is resumed.
+
+// What a host of a bulk build is up to
+const (
+	bulkWaiting   = "waiting"
+	bulkBuilding  = "building"
+	bulkDone      = "done"
+	bulkCancelled = "cancelled"
+	bulkSkipped   = "skipped"
+	bulkError     = "error"
+	bulkFailed    = "failed"
+)
+
+// Finished bulk builds kept for GET /api/v1/bulk-builds
+const maxFinishedBulkBuilds = 100
+
+// BulkBuildRequest is what POST /api/v1/bulk-builds takes
+type BulkBuildRequest struct {
+	Hosts []BulkHost
+	// Build profile to merge over every host's definition
+	Profile string `json:",omitempty"`
+	// The label whose value is a host's failure domain
+	DomainLabel string `json:",omitempty"`
+	// How many hosts of a failure domain build at once, 1 by default
+	MaxPerDomain int `json:",omitempty"`
+	// How many failed builds to go on after before pausing, never by default
+	MaxFailures *int `json:",omitempty"`
+}
+
+type BulkHost struct {
+	Hostname string
+	// Hosts of the same bulk build that have to be done first
+	After []string `json:",omitempty"`
+}
+
+// BulkBuild is a bulk build and how far along it is
+type BulkBuild struct {
+	ID           string
+	Created      time.Time
+	Finished     time.Time `json:",omitempty"`
+	Profile      string    `json:",omitempty"`
+	DomainLabel  string    `json:",omitempty"`
+	MaxPerDomain int       `json:",omitempty"`
+	MaxFailures  *int      `json:",omitempty"`
+	Failures     int       `json:",omitempty"`
+	Paused       bool      `json:",omitempty"`
+	// The labels selecting the hosts of a group rebuild, see grouprebuild.go
+	Selector string `json:",omitempty"`
+	Hosts    []*BulkBuildHost
+}
+
+type BulkBuildHost struct {
+	Hostname string
+	After    []string `json:",omitempty"`
+	Domain   string   `json:",omitempty"`
+	Status   string
+	// Which wave of a group rebuild it is in, counting from 1
+	Wave  int    `json:",omitempty"`
+	Token string `json:",omitempty"`
+	// The state of its build while it is building
+	State   machine.BuildState `json:",omitempty"`
+	Message string             `json:",omitempty"`
+}
+
+var (
+	errUnknownBulkBuild   = errors.New("no such bulk build")
+	ErrBulkBuildNotPaused = errors.New("bulk build is not paused")
+)
+
+type bulkScheduler struct {
+	config config.Config
+	state  *State
+
+	mux    sync.Mutex
+	builds map[string]*BulkBuild
+	// Hosts of bulk builds that are building or failed, by hostname
+	building map[string]*BulkBuildHost
+	// Which bulk build a building host is in, by hostname
+	buildOf map[string]*BulkBuild
+}
+
+func NewBulkScheduler(config config.Config, state *State) *bulkScheduler {
+	return &bulkScheduler{
+		config:   config,
+		state:    state,
+		builds:   make(map[string]*BulkBuild),
+		building: make(map[string]*BulkBuildHost),
+		buildOf:  make(map[string]*BulkBuild),
+	}
+}
+
+// Follow the builds of hosts on the event bus
+func (s *bulkScheduler) Start() {
+	s.state.Events.Subscribe(func(e Event) {
+		var status string
+		switch e.Type {
+		case machine.EventBuildCompleted:
+			status = bulkDone
+		case machine.EventBuildCancelled:
+			status = bulkCancelled
+		case machine.EventBuildFailed:
+			status = bulkFailed
+		case machine.EventBuildRetried:
+			status = bulkBuilding
+		default:
+			return
+		}
+
+		s.mux.Lock()
+		h, found := s.building[e.Hostname]
+		if !found || h.Token != e.Token || h.Status == status {
+			s.mux.Unlock()
+			return
+		}
+		b := s.buildOf[e.Hostname]
+		h.Status = status
+		h.Message = e.Message
+		paused := ""
+		switch status {
+		case bulkFailed:
+			b.Failures++
+			if b.MaxFailures != nil && b.Failures > *b.MaxFailures && !b.Paused {
+				b.Paused = true
+				paused = fmt.Sprintf("bulk build %s paused after %d failed builds, the last of %s", b.ID, b.Failures, e.Hostname)
+			}
+		case bulkDone, bulkCancelled:
+			delete(s.building, e.Hostname)
+			delete(s.buildOf, e.Hostname)
+			s.finishIfDone(b)
+		}
+		s.mux.Unlock()
+
+		// Starting builds runs hooks, sinks must not block
+		go func() {
+			if paused != "" {
+				s.state.Emit(machine.EventBulkBuildPaused, nil, paused)
+			}
+			s.schedule(b)
+		}()
+	})
+}
+
+// Check r and start the hosts of it that can start
+func (s *bulkScheduler) Submit(r BulkBuildRequest) (*BulkBuild, error) {
+	b, err := s.prepare(r)
+	if err != nil {
+		return nil, err
+	}
+	return s.run(b)
+}
+
+// The bulk build r asks for, once it checks out
+func (s *bulkScheduler) prepare(r BulkBuildRequest) (*BulkBuild, error) {
+	if len(r.Hosts) == 0 {
+		return nil, errors.New("no hosts")
+	}
+	max := r.MaxPerDomain
+	if max <= 0 {
+		max = 1
+	}
+	if r.MaxFailures != nil && *r.MaxFailures < 0 {
+		return nil, errors.New("max failures can't be negative")
+	}
+	b := &BulkBuild{Created: time.Now(), Profile: r.Profile, DomainLabel: r.DomainLabel, MaxPerDomain: max, MaxFailures: r.MaxFailures}
+
+	after := make(map[string][]string)
+	for _, host := range r.Hosts {
+		hostname := strings.ToLower(host.Hostname)
+		if _, found := after[hostname]; found || hostname == "" {
+			return nil, fmt.Errorf("host %q is missing or listed twice", host.Hostname)
+		}
+		after[hostname] = nil
+		for _, a := range host.After {
+			after[hostname] = append(after[hostname], strings.ToLower(a))
+		}
+		b.Hosts = append(b.Hosts, &BulkBuildHost{Hostname: hostname, After: after[hostname], Status: bulkWaiting})
+	}
+	if err := checkBulkOrder(after); err != nil {
+		return nil, err
+	}
+
+	for _, h := range b.Hosts {
+		m, err := machine.BuildDefinition(h.Hostname, "", s.config)
+		if err != nil || m.DefaultProfile {
+			return nil, fmt.Errorf("unable to find host definition for %s", h.Hostname)
+		}
+		if r.Profile != "" {
+			if err := m.ApplyProfile(r.Profile, s.config); err != nil {
+				return nil, err
+			}
+		}
+		if r.DomainLabel != "" {
+			h.Domain = m.Labels[r.DomainLabel]
+		}
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, err
+	}
+	b.ID = id.String()
+	return b, nil
+}
+
+// Start the hosts of b that can start
+func (s *bulkScheduler) run(b *BulkBuild) (*BulkBuild, error) {
+	s.mux.Lock()
+	s.builds[b.ID] = b
+	s.mux.Unlock()
+
+	s.schedule(b)
+	return s.Get(b.ID)
+}
+
+// Refuse hosts after hosts that aren't in the bulk build, and cycles
+func checkBulkOrder(after map[string][]string) error {
+	for hostname, prerequisites := range after {
+		for _, p := range prerequisites {
+			if _, found := after[p]; !found {
+				return fmt.Errorf("%s comes after %s, which isn't in the bulk build", hostname, p)
+			}
+		}
+	}
+	visited := make(map[string]int) // 1 while its prerequisites are looked at, 2 once they are fine
+	var visit func(hostname string) error
+	visit = func(hostname string) error {
+		switch visited[hostname] {
+		case 1:
+			return fmt.Errorf("%s comes after itself", hostname)
+		case 2:
+			return nil
+		}
+		visited[hostname] = 1
+		for _, p := range after[hostname] {
+			if err := visit(p); err != nil {
+				return err
+			}
+		}
+		visited[hostname] = 2
+		return nil
+	}
+	var hostnames []string
+	for hostname := range after {
+		hostnames = append(hostnames, hostname)
+	}
+	sort.Strings(hostnames)
+	for _, hostname := range hostnames {
+		if err := visit(hostname); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Start whatever hosts of b can start now, until none can or the state is
+// closed
+func (s *bulkScheduler) schedule(b *BulkBuild) {
+	for {
+		select {
+		case <-s.state.Stopped():
+			return
+		default:
+		}
+
+		s.mux.Lock()
+		ready := s.ready(b)
+		if len(ready) == 0 {
+			s.finishIfDone(b)
+			s.mux.Unlock()
+			return
+		}
+		s.mux.Unlock()
+
+		for _, h := range ready {
+			token, err := s.startBuild(b, h.Hostname)
+
+			s.mux.Lock()
+			if err != nil {
+				h.Status = bulkError
+				h.Message = err.Error()
+			} else {
+				h.Token = token
+				s.building[h.Hostname] = h
+				s.buildOf[h.Hostname] = b
+			}
+			s.mux.Unlock()
+
+			if err != nil {
+				logger.Error("cannot start host of bulk build", "bulk_build", b.ID, "hostname", h.Hostname, "error", err)
+			}
+		}
+	}
+}
+
+// The hosts of b that can start now, marked building. Hosts that never will
+// are skipped. Callers must hold s.mux.
+func (s *bulkScheduler) ready(b *BulkBuild) []*BulkBuildHost {
+	if b.Paused {
+		return nil
+	}
+	// Without max_failures a failed host holds its place until it is retried
+	holding := func(h *BulkBuildHost) bool {
+		return h.Status == bulkBuilding || (h.Status == bulkFailed && b.MaxFailures == nil)
+	}
+
+	status := make(map[string]*BulkBuildHost)
+	building := make(map[string]int) // by domain
+	for _, h := range b.Hosts {
+		status[h.Hostname] = h
+		if holding(h) {
+			building[h.Domain]++
+		}
+	}
+
+	var ready []*BulkBuildHost
+	for changed := true; changed; {
+		changed = false
+		for _, h := range b.Hosts {
+			if h.Status != bulkWaiting {
+				continue
+			}
+			blocked := false
+			for _, p := range h.After {
+				prerequisite := status[p].Status
+				if prerequisite == bulkDone || (prerequisite == bulkFailed && !holding(status[p])) {
+					continue
+				}
+				blocked = true
+				if prerequisite == bulkCancelled || prerequisite == bulkSkipped || prerequisite == bulkError {
+					h.Status = bulkSkipped
+					h.Message = fmt.Sprintf("%s was %s", p, prerequisite)
+					changed = true
+				}
+				break
+			}
+			if blocked {
+				continue
+			}
+			if b.DomainLabel != "" && building[h.Domain] >= b.MaxPerDomain {
+				continue
+			}
+			h.Status = bulkBuilding
+			building[h.Domain]++
+			ready = append(ready, h)
+		}
+	}
+
+	return ready
+}
+
+// Mark b finished once none of its hosts is waiting, building or failed.
+// Callers must hold s.mux.
+func (s *bulkScheduler) finishIfDone(b *BulkBuild) {
+	if !b.Finished.IsZero() {
+		return
+	}
+	for _, h := range b.Hosts {
+		if h.Status == bulkWaiting || h.Status == bulkBuilding || h.Status == bulkFailed {
+			return
+		}
+	}
+	b.Finished = time.Now()
+	s.forgetFinished()
+}
+
+// Drop the oldest finished bulk builds beyond maxFinishedBulkBuilds. Callers
+// must hold s.mux.
+func (s *bulkScheduler) forgetFinished() {
+	var finished []*BulkBuild
+	for _, b := range s.builds {
+		if !b.Finished.IsZero() {
+			finished = append(finished, b)
+		}
+	}
+	if len(finished) <= maxFinishedBulkBuilds {
+		return
+	}
+	sort.Slice(finished, func(i, j int) bool { return finished[i].Finished.Before(finished[j].Finished) })
+	for _, b := range finished[:len(finished)-maxFinishedBulkBuilds] {
+		delete(s.builds, b.ID)
+	}
+}
+
+// Build hostname for b the way PUT /build does, returns its token
+func (s *bulkScheduler) startBuild(b *BulkBuild, hostname string) (string, error) {
+	config, state := s.config, s.state
+
+	m, err := machine.BuildDefinition(hostname, "", config)
+	if err != nil {
+		return "", err
+	}
+	if b.Profile != "" {
+		if err := m.ApplyProfile(b.Profile, config); err != nil {
+			return "", err
+		}
+	}
+
+	if err := state.runHooks(machine.StageBuildStart, &m, config, nil); err != nil {
+		return "", err
+	}
+
+	state.BuildRequestMux.Lock()
+	if state.BuildInProgress(m.Hostname) != nil {
+		state.BuildRequestMux.Unlock()
+		return "", errors.New("already building")
+	}
+	token, err := state.SetBuildMode(m, config)
+	state.BuildRequestMux.Unlock()
+	if err != nil {
+		return "", err
+	}
+
+	if err := state.runHooks(machine.StageTokenIssued, state.MachineByToken(token), config, nil); err != nil {
+		return token, err
+	}
+	if err := state.BootBuildVM(token, config); err != nil {
+		return token, err
+	}
+	return token, nil
+}
+
+// Let a paused bulk build start hosts again, until the next failed build
+func (s *bulkScheduler) Resume(id string) (*BulkBuild, error) {
+	s.mux.Lock()
+	b, found := s.builds[id]
+	if !found {
+		s.mux.Unlock()
+		return nil, errUnknownBulkBuild
+	}
+	if !b.Paused {
+		s.mux.Unlock()
+		return nil, ErrBulkBuildNotPaused
+	}
+	b.Paused = false
+	s.mux.Unlock()
+
+	s.schedule(b)
+	return s.Get(id)
+}
+
+// A copy of the bulk build id, with the states of the builds of its hosts
+func (s *bulkScheduler) Get(id string) (*BulkBuild, error) {
+	s.mux.Lock()
+	b, found := s.builds[id]
+	if !found {
+		s.mux.Unlock()
+		return nil, errUnknownBulkBuild
+	}
+	c := s.copy(b)
+	s.mux.Unlock()
+
+	s.state.Mux.Lock()
+	for _, h := range c.Hosts {
+		if m, found := s.state.MachineByUUID[h.Token]; found && (h.Status == bulkBuilding || h.Status == bulkFailed) && m.Hostname == h.Hostname {
+			h.State = m.State
+		}
+	}
+	s.state.Mux.Unlock()
+	return c, nil
+}
+
+// Copies of every bulk build, newest first
+func (s *bulkScheduler) List() []*BulkBuild {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var builds []*BulkBuild
+	for _, b := range s.builds {
+		builds = append(builds, s.copy(b))
+	}
+	sort.Slice(builds, func(i, j int) bool { return builds[i].Created.After(builds[j].Created) })
+	return builds
+}
+
+// Callers must hold s.mux
+func (s *bulkScheduler) copy(b *BulkBuild) *BulkBuild {
+	c := *b
+	c.Hosts = nil
+	for _, h := range b.Hosts {
+		hc := *h
+		c.Hosts = append(c.Hosts, &hc)
+	}
+	return &c
+}
@@ -0,0 +1,135 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestBulkBuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-bulk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, host := range []struct{ hostname, domain string }{
+		{"stor01.example.com", "rack1"},
+		{"stor02.example.com", "rack1"},
+		{"stor03.example.com", "rack2"},
+		{"compute01.example.com", "rack1"},
+	} {
+		definition := fmt.Sprintf(`{"labels": {"failure_domain": %q}, "network": [{"macaddress": "de:ad:c0:de:ca:0%d"}]}`, host.domain, i)
+		ioutil.WriteFile(filepath.Join(dir, host.hostname+".yaml"), []byte(definition), 0644)
+	}
+	config := config.Config{MachinePath: dir, GroupPath: dir}
+
+	state := New()
+	state.Bulk = NewBulkScheduler(config, state)
+	state.Bulk.Start()
+
+	hosts := func(b *BulkBuild) map[string]*BulkBuildHost {
+		byHostname := make(map[string]*BulkBuildHost)
+		for _, h := range b.Hosts {
+			byHostname[h.Hostname] = h
+		}
+		return byHostname
+	}
+	// Wait for the scheduler to catch up with the build of hostname leaving
+	wait := func(id string, hostname string, status string) map[string]*BulkBuildHost {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			b, err := state.Bulk.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h := hosts(b); h[hostname].Status == status || time.Now().After(deadline) {
+				return h
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	finish := func(hostname string) {
+		m := state.BuildInProgress(hostname)
+		if m == nil {
+			t.Fatalf("expected %s to be building", hostname)
+		}
+		if err := state.DoneBuildMode(*m, config); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b, err := state.Bulk.Submit(BulkBuildRequest{
+		Hosts: []BulkHost{
+			{Hostname: "stor01.example.com"},
+			{Hostname: "stor02.example.com"},
+			{Hostname: "stor03.example.com"},
+			{Hostname: "compute01.example.com", After: []string{"stor01.example.com", "stor02.example.com", "stor03.example.com"}},
+		},
+		DomainLabel: "failure_domain",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := hosts(b)
+	if h["stor01.example.com"].Status != bulkBuilding || h["stor02.example.com"].Status != bulkWaiting ||
+		h["stor03.example.com"].Status != bulkBuilding || h["compute01.example.com"].Status != bulkWaiting {
+		t.Fatalf("expected one host per failure domain to start, got %+v %+v %+v %+v",
+			h["stor01.example.com"], h["stor02.example.com"], h["stor03.example.com"], h["compute01.example.com"])
+	}
+	if h["stor01.example.com"].Token == "" || h["stor01.example.com"].State != machine.BuildPending || h["stor03.example.com"].Domain != "rack2" {
+		t.Errorf("expected the build of stor01 in the bulk build, got %+v", h["stor01.example.com"])
+	}
+
+	finish("stor01.example.com")
+	h = wait(b.ID, "stor02.example.com", bulkBuilding)
+	if h["stor01.example.com"].Status != bulkDone || h["stor02.example.com"].Status != bulkBuilding || h["compute01.example.com"].Status != bulkWaiting {
+		t.Fatalf("expected stor02 to start once stor01 is done, got %+v %+v", h["stor02.example.com"], h["compute01.example.com"])
+	}
+
+	finish("stor03.example.com")
+	finish("stor02.example.com")
+	h = wait(b.ID, "compute01.example.com", bulkBuilding)
+	if h["compute01.example.com"].Status != bulkBuilding {
+		t.Fatalf("expected compute01 to start after the storage hosts, got %+v", h["compute01.example.com"])
+	}
+	finish("compute01.example.com")
+	wait(b.ID, "compute01.example.com", bulkDone)
+	if b, _ := state.Bulk.Get(b.ID); b.Finished.IsZero() {
+		t.Error("expected the bulk build to be finished")
+	}
+
+	b, err = state.Bulk.Submit(BulkBuildRequest{Hosts: []BulkHost{
+		{Hostname: "stor01.example.com"},
+		{Hostname: "compute01.example.com", After: []string{"stor01.example.com"}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.CancelBuildMode(*state.BuildInProgress("stor01.example.com"), config, ""); err != nil {
+		t.Fatal(err)
+	}
+	h = wait(b.ID, "compute01.example.com", bulkSkipped)
+	if h["stor01.example.com"].Status != bulkCancelled || h["compute01.example.com"].Status != bulkSkipped ||
+		h["compute01.example.com"].Message != "stor01.example.com was cancelled" {
+		t.Errorf("expected compute01 to be skipped after stor01 was cancelled, got %+v", h["compute01.example.com"])
+	}
+
+	for problem, r := range map[string]BulkBuildRequest{
+		"no hosts":            {},
+		"listed twice":        {Hosts: []BulkHost{{Hostname: "stor01.example.com"}, {Hostname: "STOR01.example.com"}}},
+		"isn't in the bulk":   {Hosts: []BulkHost{{Hostname: "stor01.example.com", After: []string{"stor02.example.com"}}}},
+		"comes after itself":  {Hosts: []BulkHost{{Hostname: "stor01.example.com", After: []string{"stor02.example.com"}}, {Hostname: "stor02.example.com", After: []string{"stor01.example.com"}}}},
+		"unable to find host": {Hosts: []BulkHost{{Hostname: "web01.example.com"}}},
+	} {
+		if _, err := state.Bulk.Submit(r); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q, got %v", problem, err)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package state
+
+import (
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Record the results of the burn-in of the build identified by token and
+// let it go on or fail it
+func (state *State) ReportBurnIn(token string, r machine.BurnInResult, config config.Config) error {
+	r.Reported = time.Now()
+
+	state.Mux.Lock()
+	m, err := state.machineInStage(token, machine.BurnInStage)
+	if err != nil {
+		state.Mux.Unlock()
+		return err
+	}
+	m.BurnInResult = &r
+	state.Version++
+	state.Mux.Unlock()
+
+	if !r.Passed {
+		state.FailStage(m, config, machine.BurnInStage, r.Message)
+		return nil
+	}
+	return state.PassStage(m, config, machine.BurnInStage, r.Message)
+}
@@ -0,0 +1,312 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Waitron can read the DHCP server's leases to show in /status the address a
+// building machine got and when it last renewed it, which tells an
+// installer that got an address but never fetched its preseed from one that
+// never got that far. Leases come from a dnsmasq lease file, a Kea memfile
+// (CSV) or the Kea API, and are matched to machines by the MAC addresses of
+// their interfaces, the most recent lease winning. They are read every
+// interval_secs; while reading fails the last leases read are kept.
+//
+// dnsmasq only writes when a lease expires, renewals are known with
+// lease_secs set to the lease time it hands out.
+
+const (
+	defaultDHCPLeaseInterval = 30
+	dhcpLeaseTimeout         = 10 * time.Second
+)
+
+type leaseWatcher struct {
+	config config.DHCPLeaseConfig
+	state  *State
+	client *http.Client
+	leases map[string]machine.DHCPLease // by MAC
+}
+
+func NewLeaseWatcher(config config.DHCPLeaseConfig, state *State) (*leaseWatcher, error) {
+	switch config.Source {
+	case "dnsmasq", "kea":
+		if config.Path == "" {
+			return nil, fmt.Errorf("dhcp lease source %s needs a path", config.Source)
+		}
+	case "kea-api":
+		if config.URL == "" {
+			return nil, fmt.Errorf("dhcp lease source kea-api needs a url")
+		}
+		if len(config.Services) == 0 {
+			config.Services = []string{"dhcp4"}
+		}
+	default:
+		return nil, fmt.Errorf("unknown dhcp lease source %q, expected dnsmasq, kea or kea-api", config.Source)
+	}
+	if config.IntervalSeconds <= 0 {
+		config.IntervalSeconds = defaultDHCPLeaseInterval
+	}
+	return &leaseWatcher{config: config, state: state, client: &http.Client{Timeout: dhcpLeaseTimeout}}, nil
+}
+
+func (w *leaseWatcher) Start() {
+	w.refresh()
+	go func() {
+		ticker := time.NewTicker(time.Duration(w.config.IntervalSeconds) * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.state.Stopped():
+				return
+			case <-ticker.C:
+				w.refresh()
+			}
+		}
+	}()
+}
+
+// Read the leases and put them on the machines being built
+func (w *leaseWatcher) refresh() {
+	if leases, err := w.read(); err != nil {
+		logger.Warn("cannot read dhcp leases", "source", w.config.Source, "error", err)
+	} else {
+		w.leases = leases
+	}
+	w.apply()
+}
+
+func (w *leaseWatcher) apply() {
+	w.state.Mux.Lock()
+	defer w.state.Mux.Unlock()
+
+	changed := false
+	for _, m := range w.state.MachineByHostname {
+		var lease *machine.DHCPLease
+		for _, i := range m.Network {
+			if l, found := w.leases[strings.ToLower(i.MacAddress)]; found && (lease == nil || l.Newer(*lease)) {
+				l := l
+				lease = &l
+			}
+		}
+		if !lease.Same(m.Lease) {
+			m.Lease = lease
+			changed = true
+		}
+	}
+	if changed {
+		w.state.Version++
+	}
+}
+
+func (w *leaseWatcher) read() (map[string]machine.DHCPLease, error) {
+	var leases []machine.DHCPLease
+	var err error
+	switch w.config.Source {
+	case "kea-api":
+		leases, err = w.readKeaAPI()
+	default:
+		var f *os.File
+		if f, err = os.Open(w.config.Path); err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		if w.config.Source == "dnsmasq" {
+			leases, err = parseDnsmasqLeases(f, w.config.LeaseSeconds)
+		} else {
+			leases, err = parseKeaLeases(f)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	byMAC := make(map[string]machine.DHCPLease)
+	for _, l := range leases {
+		l.MacAddress = strings.ToLower(l.MacAddress)
+		if current, found := byMAC[l.MacAddress]; !found || l.Newer(current) {
+			byMAC[l.MacAddress] = l
+		}
+	}
+	return byMAC, nil
+}
+
+func unixTime(s string) (time.Time, bool) {
+	seconds, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || seconds <= 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(seconds, 0).UTC(), true
+}
+
+// dnsmasq's lease file: "<expiry> <mac> <ip> <hostname> <client id>" per
+// lease. DHCPv6 leases have an IAID rather than a MAC and are skipped.
+func parseDnsmasqLeases(r io.Reader, leaseSeconds int) ([]machine.DHCPLease, error) {
+	var leases []machine.DHCPLease
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] == "duid" {
+			continue
+		}
+		if _, err := net.ParseMAC(fields[1]); err != nil {
+			continue
+		}
+		l := machine.DHCPLease{MacAddress: fields[1], IPAddress: fields[2]}
+		if fields[3] != "*" {
+			l.Hostname = fields[3]
+		}
+		if expires, ok := unixTime(fields[0]); ok {
+			l.Expires = expires
+			if leaseSeconds > 0 {
+				renewed := expires.Add(-time.Duration(leaseSeconds) * time.Second)
+				l.Renewed = &renewed
+			}
+		}
+		leases = append(leases, l)
+	}
+	return leases, scanner.Err()
+}
+
+// Kea's memfile, DHCPv4 or DHCPv6. Kea appends to it, so a later line for an
+// address replaces the one before; released and expired leases are dropped.
+func parseKeaLeases(r io.Reader) ([]machine.DHCPLease, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, err
+	}
+	column := make(map[string]int)
+	for n, name := range header {
+		column[name] = n
+	}
+	for _, name := range []string{"address", "hwaddr", "valid_lifetime", "expire"} {
+		if _, found := column[name]; !found {
+			return nil, fmt.Errorf("lease file has no %s column", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		if n, found := column[name]; found && n < len(record) {
+			return record[n]
+		}
+		return ""
+	}
+
+	byAddress := make(map[string]machine.DHCPLease)
+	seen := make(map[string]bool)
+	var order []string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		address := field(record, "address")
+		if !seen[address] {
+			seen[address] = true
+			order = append(order, address)
+		}
+		lifetime, _ := strconv.Atoi(field(record, "valid_lifetime"))
+		expires, _ := unixTime(field(record, "expire"))
+		state := field(record, "state")
+		if lifetime == 0 || (state != "" && state != "0") || field(record, "hwaddr") == "" {
+			delete(byAddress, address)
+			continue
+		}
+		renewed := expires.Add(-time.Duration(lifetime) * time.Second)
+		byAddress[address] = machine.DHCPLease{
+			MacAddress: field(record, "hwaddr"),
+			IPAddress:  address,
+			Hostname:   strings.TrimSuffix(field(record, "hostname"), "."),
+			Renewed:    &renewed,
+			Expires:    expires,
+		}
+	}
+
+	var leases []machine.DHCPLease
+	for _, address := range order {
+		if l, found := byAddress[address]; found {
+			leases = append(leases, l)
+		}
+	}
+	return leases, nil
+}
+
+// lease4-get-all, or lease6-get-all for dhcp6, through the control agent
+func (w *leaseWatcher) readKeaAPI() ([]machine.DHCPLease, error) {
+	var leases []machine.DHCPLease
+	for _, service := range w.config.Services {
+		command := "lease4-get-all"
+		if service == "dhcp6" {
+			command = "lease6-get-all"
+		}
+		body, _ := json.Marshal(map[string]interface{}{"command": command, "service": []string{service}})
+		response, err := w.client.Post(w.config.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		data, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		if response.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("kea %s: %s", command, response.Status)
+		}
+
+		var answers []struct {
+			Result    int    `json:"result"`
+			Text      string `json:"text"`
+			Arguments struct {
+				Leases []struct {
+					HWAddress string `json:"hw-address"`
+					IPAddress string `json:"ip-address"`
+					Hostname  string `json:"hostname"`
+					CLTT      int64  `json:"cltt"`
+					ValidLft  int64  `json:"valid-lft"`
+					State     int    `json:"state"`
+				} `json:"leases"`
+			} `json:"arguments"`
+		}
+		if err := json.Unmarshal(data, &answers); err != nil {
+			return nil, fmt.Errorf("kea %s: %s", command, err)
+		}
+		for _, a := range answers {
+			// 3 is no leases
+			if a.Result != 0 && a.Result != 3 {
+				return nil, fmt.Errorf("kea %s: %s", command, a.Text)
+			}
+			for _, l := range a.Arguments.Leases {
+				if l.HWAddress == "" || l.State != 0 {
+					continue
+				}
+				renewed := time.Unix(l.CLTT, 0).UTC()
+				leases = append(leases, machine.DHCPLease{
+					MacAddress: l.HWAddress,
+					IPAddress:  l.IPAddress,
+					Hostname:   strings.TrimSuffix(l.Hostname, "."),
+					Renewed:    &renewed,
+					Expires:    renewed.Add(time.Duration(l.ValidLft) * time.Second),
+				})
+			}
+		}
+	}
+	return leases, nil
+}
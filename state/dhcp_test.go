@@ -0,0 +1,134 @@
+package state
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestParseDnsmasqLeases(t *testing.T) {
+	leases, err := parseDnsmasqLeases(strings.NewReader(`1600000000 DE:AD:BE:EF:00:01 192.0.2.10 node01 01:de:ad:be:ef:00:01
+0 de:ad:be:ef:00:02 192.0.2.11 * *
+duid 00:01:00:01:26:2b:1a:7e:de:ad:be:ef:00:01
+1600000000 1234567 2001:db8::10 node01 00:01:00:01:26:2b:1a:7e
+`), 3600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 2 {
+		t.Fatalf("expected the DHCPv6 lease to be skipped, got %+v", leases)
+	}
+	if l := leases[0]; l.IPAddress != "192.0.2.10" || l.Hostname != "node01" || l.Expires.Unix() != 1600000000 || l.Renewed.Unix() != 1600000000-3600 {
+		t.Errorf("unexpected lease %+v", l)
+	}
+	if l := leases[1]; l.Hostname != "" || !l.Expires.IsZero() || l.Renewed != nil {
+		t.Errorf("expected a lease that doesn't expire, got %+v", l)
+	}
+}
+
+func TestParseKeaLeases(t *testing.T) {
+	leases, err := parseKeaLeases(strings.NewReader(`address,hwaddr,client_id,valid_lifetime,expire,subnet_id,fqdn_fwd,fqdn_rev,hostname,state,user_context
+192.0.2.10,de:ad:be:ef:00:01,,3600,1600000000,1,0,0,node01.example.com.,0,
+192.0.2.11,de:ad:be:ef:00:02,,3600,1600000000,1,0,0,,0,
+192.0.2.10,de:ad:be:ef:00:01,,3600,1600001800,1,0,0,node01.example.com.,0,
+192.0.2.11,de:ad:be:ef:00:02,,0,1600000100,1,0,0,,0,
+192.0.2.12,de:ad:be:ef:00:03,,3600,1600000000,1,0,0,,1,
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 1 {
+		t.Fatalf("expected released and declined leases to be dropped, got %+v", leases)
+	}
+	if l := leases[0]; l.Hostname != "node01.example.com" || l.Expires.Unix() != 1600001800 || l.Renewed.Unix() != 1600001800-3600 {
+		t.Errorf("expected the last line for the address, got %+v", l)
+	}
+
+	if _, err := parseKeaLeases(strings.NewReader("address,duid\n")); err == nil {
+		t.Error("expected a file without hwaddr to be refused")
+	}
+}
+
+func TestLeaseWatcher(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-leases")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dnsmasq.leases")
+	ioutil.WriteFile(path, []byte("1600000000 de:ad:be:ef:00:02 192.0.2.11 node01 *\n"), 0644)
+
+	state := New()
+	m := &machine.Machine{Hostname: "node01.example.com", Network: []machine.Interface{
+		{Name: "eth0", MacAddress: "de:ad:be:ef:00:01"},
+		{Name: "eth1", MacAddress: "DE:AD:BE:EF:00:02"},
+	}}
+	state.MachineByHostname[m.Hostname] = m
+
+	w, err := NewLeaseWatcher(config.DHCPLeaseConfig{Source: "dnsmasq", Path: path}, state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	version := state.Version
+	w.refresh()
+	if m.Lease == nil || m.Lease.IPAddress != "192.0.2.11" || state.Version == version {
+		t.Fatalf("expected the lease of the second interface, got %+v", m.Lease)
+	}
+	version = state.Version
+	w.refresh()
+	if state.Version != version {
+		t.Error("expected the version to stay when the leases didn't change")
+	}
+
+	// Reading fails, the last leases stay
+	os.Remove(path)
+	w.refresh()
+	if m.Lease == nil {
+		t.Error("expected the lease to be kept")
+	}
+
+	if _, err := NewLeaseWatcher(config.DHCPLeaseConfig{Source: "isc"}, state); err == nil {
+		t.Error("expected an unknown source to be refused")
+	}
+}
+
+func TestKeaAPILeases(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var command struct {
+			Command string
+			Service []string
+		}
+		json.NewDecoder(r.Body).Decode(&command)
+		if command.Command != "lease4-get-all" || command.Service[0] != "dhcp4" {
+			io.WriteString(w, `[{"result": 1, "text": "unknown command"}]`)
+			return
+		}
+		io.WriteString(w, `[{"result": 0, "text": "2 IPv4 lease(s) found.", "arguments": {"leases": [
+			{"hw-address": "de:ad:be:ef:00:01", "ip-address": "192.0.2.10", "hostname": "node01.example.com.", "cltt": 1600000000, "valid-lft": 3600, "state": 0},
+			{"hw-address": "de:ad:be:ef:00:01", "ip-address": "192.0.2.20", "cltt": 1500000000, "valid-lft": 3600, "state": 0}
+		]}}]`)
+	}))
+	defer server.Close()
+
+	w, _ := NewLeaseWatcher(config.DHCPLeaseConfig{Source: "kea-api", URL: server.URL}, New())
+	leases, err := w.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := leases["de:ad:be:ef:00:01"]
+	if l.IPAddress != "192.0.2.10" || !l.Renewed.Equal(time.Unix(1600000000, 0)) || !l.Expires.Equal(time.Unix(1600003600, 0)) {
+		t.Errorf("expected the most recent lease, got %+v", l)
+	}
+
+	w.config.Services = []string{"dhcp6"}
+	if _, err := w.read(); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("expected Kea's error, got %v", err)
+	}
+}
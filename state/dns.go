@@ -0,0 +1,232 @@
+package state
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Waitron can keep DNS in step with the machines it builds instead of hook
+// scripts doing it. When a build is done the machine's A and AAAA records are
+// replaced with its addresses, and every address gets a PTR record. A family
+// it has no lasting addresses of, on DHCP say, keeps its records, only those
+// published for a previous build go. PTR
+// records of addresses the machine had at its previous build and no longer
+// has are removed, as long as they still point at it. Records are only
+// written in the zones listed, the one a name falls in being the longest
+// matching; list reverse zones for PTR records. What was published for a
+// machine is kept in the state store.
+//
+// 	dns:
+// 	  driver: rfc2136
+// 	  zones:
+// 	    - name: example.com
+// 	    - name: 2.0.192.in-addr.arpa
+// 	  rfc2136:
+// 	    server: ns1.example.com:53
+// 	    tsig_name: waitron
+// 	    tsig_secret: <base64>
+//
+// Failing to update DNS is logged and doesn't fail the build.
+
+const (
+	dnsBucket     = "dns"
+	defaultDNSTTL = 300
+	dnsTimeout    = 10 * time.Second
+)
+
+// A DNS server to publish records with
+type dnsDriver interface {
+	// Make values the records of rrtype at name, none deletes them
+	Replace(zone config.DNSZone, name string, rrtype string, ttl int, values []string) error
+	// Remove the record of rrtype at name with value, when there is one
+	Remove(zone config.DNSZone, name string, rrtype string, value string) error
+}
+
+// What was published for a machine
+type dnsPublished struct {
+	Addresses []string
+	UpdatedAt time.Time
+}
+
+type DNSUpdater struct {
+	config config.DNSConfig
+	Driver dnsDriver
+	store  Store
+}
+
+func NewDNSUpdater(config config.DNSConfig, store Store) (*DNSUpdater, error) {
+	if config.TTL <= 0 {
+		config.TTL = defaultDNSTTL
+	}
+	for n, z := range config.Zones {
+		config.Zones[n].Name = dnsName(z.Name)
+	}
+
+	u := &DNSUpdater{config: config, store: store}
+	var err error
+	switch config.Driver {
+	case "rfc2136":
+		u.Driver, err = newRFC2136Driver(config.RFC2136)
+	case "route53":
+		for _, z := range config.Zones {
+			if z.ID == "" {
+				return nil, fmt.Errorf("dns zone %s has no route53 id", z.Name)
+			}
+		}
+		u.Driver = newRoute53Driver(config.Route53)
+	default:
+		err = fmt.Errorf("unknown dns driver %q, expected rfc2136 or route53", config.Driver)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// name fully qualified, lower case and with the trailing dot
+func dnsName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+}
+
+// The zone name falls in, the longest that matches
+func (u *DNSUpdater) zone(name string) (config.DNSZone, bool) {
+	var zone config.DNSZone
+	found := false
+	for _, z := range u.config.Zones {
+		if (name == z.Name || strings.HasSuffix(name, "."+z.Name)) && len(z.Name) > len(zone.Name) {
+			zone, found = z, true
+		}
+	}
+	return zone, found
+}
+
+// The in-addr.arpa or ip6.arpa name of address
+func reverseName(address string) string {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return ""
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa.", v4[3], v4[2], v4[1], v4[0])
+	}
+	var b strings.Builder
+	for n := len(ip) - 1; n >= 0; n-- {
+		fmt.Fprintf(&b, "%x.%x.", ip[n]&0xf, ip[n]>>4)
+	}
+	return b.String() + "ip6.arpa."
+}
+
+// Records for m's current addresses, and no PTR for the ones it had before
+func (u *DNSUpdater) publish(m *machine.Machine, addresses []string) error {
+	hostname := dnsName(m.Hostname)
+	var v4, v6 []string
+	for _, address := range addresses {
+		if net.ParseIP(address).To4() != nil {
+			v4 = append(v4, address)
+		} else {
+			v6 = append(v6, address)
+		}
+	}
+
+	var errs []string
+	fail := func(err error) {
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	var previous dnsPublished
+	if _, err := u.store.Get(dnsBucket, m.Hostname, &previous); err != nil {
+		fail(err)
+	}
+	current := make(map[string]bool)
+	for _, address := range addresses {
+		current[address] = true
+	}
+
+	// A family without lasting addresses, DHCP or only lent ones, keeps the
+	// records it has, less what was published for a previous build
+	if zone, found := u.zone(hostname); found {
+		for _, family := range []struct {
+			rrtype string
+			values []string
+		}{{"A", v4}, {"AAAA", v6}} {
+			if len(family.values) > 0 {
+				fail(u.Driver.Replace(zone, hostname, family.rrtype, u.config.TTL, family.values))
+				continue
+			}
+			for _, address := range previous.Addresses {
+				if !current[address] && (net.ParseIP(address).To4() != nil) == (family.rrtype == "A") {
+					fail(u.Driver.Remove(zone, hostname, family.rrtype, address))
+				}
+			}
+		}
+	}
+	for _, address := range addresses {
+		reverse := reverseName(address)
+		if zone, found := u.zone(reverse); found {
+			fail(u.Driver.Replace(zone, reverse, "PTR", u.config.TTL, []string{hostname}))
+		}
+	}
+
+	for _, address := range previous.Addresses {
+		if current[address] {
+			continue
+		}
+		reverse := reverseName(address)
+		if zone, found := u.zone(reverse); found {
+			fail(u.Driver.Remove(zone, reverse, "PTR", hostname))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("%s", strings.Join(errs, "; "))
+	}
+	return u.store.Put(dnsBucket, m.Hostname, dnsPublished{Addresses: addresses, UpdatedAt: time.Now()})
+}
+
+// The addresses of m that outlive its build, without the ones its build was
+// only lent
+func (state *State) lastingAddresses(m *machine.Machine) []string {
+	lent := make(map[string]bool)
+	if state.IPAM != nil {
+		for _, a := range m.Allocations {
+			if p, found := state.IPAM.byName[a.Pool]; found && p.config.ReleaseOnDone {
+				lent[a.IPAddress] = true
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	var addresses []string
+	for _, i := range m.Network {
+		for _, ip := range append(append([]machine.IPConfig(nil), i.Addresses4...), i.Addresses6...) {
+			address := ip.IPAddress
+			if parsed := net.ParseIP(address); parsed != nil {
+				address = parsed.String()
+			} else {
+				continue
+			}
+			if !lent[address] && !seen[address] {
+				seen[address] = true
+				addresses = append(addresses, address)
+			}
+		}
+	}
+	return addresses
+}
+
+// For a build that is done
+func (state *State) publishDNS(m *machine.Machine) {
+	if state.DNS == nil {
+		return
+	}
+	if err := state.DNS.publish(m, state.lastingAddresses(m)); err != nil {
+		logger.Machine(m).Error("cannot update dns", "error", err)
+		return
+	}
+	logger.Machine(m).Info("updated dns")
+}
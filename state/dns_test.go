@@ -0,0 +1,350 @@
+package state
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestReverseName(t *testing.T) {
+	for address, expected := range map[string]string{
+		"192.0.2.10":  "10.2.0.192.in-addr.arpa.",
+		"2001:db8::1": "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa.",
+		"bogus":       "",
+	} {
+		if name := reverseName(address); name != expected {
+			t.Errorf("expected %s for %s, got %s", expected, address, name)
+		}
+	}
+}
+
+// Records as a driver was asked to leave them, by "name type"
+type fakeDNSDriver struct {
+	records map[string][]string
+}
+
+func (d *fakeDNSDriver) Replace(zone config.DNSZone, name string, rrtype string, ttl int, values []string) error {
+	if len(values) == 0 {
+		delete(d.records, name+" "+rrtype)
+	} else {
+		d.records[name+" "+rrtype] = values
+	}
+	return nil
+}
+
+func (d *fakeDNSDriver) Remove(zone config.DNSZone, name string, rrtype string, value string) error {
+	var rest []string
+	for _, v := range d.records[name+" "+rrtype] {
+		if v != value {
+			rest = append(rest, v)
+		}
+	}
+	d.Replace(zone, name, rrtype, 0, rest)
+	return nil
+}
+
+func TestPublishDNS(t *testing.T) {
+	state := New()
+	driver := &fakeDNSDriver{records: make(map[string][]string)}
+	state.DNS = &DNSUpdater{config: config.DNSConfig{TTL: 60, Zones: []config.DNSZone{
+		{Name: "example.com."}, {Name: "2.0.192.in-addr.arpa."}, {Name: "8.b.d.0.1.0.0.2.ip6.arpa."},
+	}}, Driver: driver, store: state.Store}
+
+	m := &machine.Machine{Hostname: "node01.example.com", Network: []machine.Interface{
+		{Name: "eth0", Addresses4: []machine.IPConfig{{IPAddress: "192.0.2.10"}}, Addresses6: []machine.IPConfig{{IPAddress: "2001:db8::1"}}},
+		{Name: "eth1", Addresses4: []machine.IPConfig{{IPAddress: "198.51.100.10"}}},
+	}}
+	state.publishDNS(m)
+	expected := map[string][]string{
+		"node01.example.com. A":             {"192.0.2.10", "198.51.100.10"},
+		"node01.example.com. AAAA":          {"2001:db8::1"},
+		"10.2.0.192.in-addr.arpa. PTR":      {"node01.example.com."},
+		reverseName("2001:db8::1") + " PTR": {"node01.example.com."},
+	}
+	if len(driver.records) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, driver.records)
+	}
+	for k, v := range expected {
+		if strings.Join(driver.records[k], ",") != strings.Join(v, ",") {
+			t.Errorf("expected %s to be %v, got %v", k, v, driver.records[k])
+		}
+	}
+
+	// Reprovisioned with another address, the old PTR goes unless something
+	// else has taken it
+	driver.records["10.2.0.192.in-addr.arpa. PTR"] = []string{"node01.example.com.", "node02.example.com."}
+	m.Network = []machine.Interface{{Name: "eth0", Addresses4: []machine.IPConfig{{IPAddress: "192.0.2.11"}}}}
+	state.publishDNS(m)
+	if a := driver.records["node01.example.com. A"]; len(a) != 1 || a[0] != "192.0.2.11" {
+		t.Errorf("expected the new address, got %v", a)
+	}
+	if _, found := driver.records["node01.example.com. AAAA"]; found {
+		t.Error("expected the AAAA record to be deleted")
+	}
+	if ptr := driver.records["10.2.0.192.in-addr.arpa. PTR"]; len(ptr) != 1 || ptr[0] != "node02.example.com." {
+		t.Errorf("expected only the other host's PTR to be left, got %v", ptr)
+	}
+	if _, found := driver.records[reverseName("2001:db8::1")+" PTR"]; found {
+		t.Error("expected the old IPv6 PTR to be removed")
+	}
+	if ptr := driver.records["11.2.0.192.in-addr.arpa. PTR"]; len(ptr) != 1 {
+		t.Errorf("expected a PTR for the new address, got %v", ptr)
+	}
+
+	// On DHCP its records are left to whatever set them
+	driver.records["node02.example.com. A"] = []string{"192.0.2.20"}
+	driver.records["node02.example.com. AAAA"] = []string{"2001:db8::20"}
+	state.publishDNS(&machine.Machine{Hostname: "node02.example.com", Network: []machine.Interface{{Name: "eth0", DHCP4: true, Addresses6: []machine.IPConfig{{IPAddress: "2001:db8::21"}}}}})
+	if a := driver.records["node02.example.com. A"]; len(a) != 1 || a[0] != "192.0.2.20" {
+		t.Errorf("expected the A record to be kept, got %v", a)
+	}
+	if aaaa := driver.records["node02.example.com. AAAA"]; len(aaaa) != 1 || aaaa[0] != "2001:db8::21" {
+		t.Errorf("expected the static IPv6 address, got %v", aaaa)
+	}
+}
+
+// An update as a server got it
+type receivedUpdate struct {
+	zone    string
+	records []string
+	signed  bool
+}
+
+func readWireName(message []byte, offset int) (string, int) {
+	var labels []string
+	for message[offset] != 0 {
+		n := int(message[offset])
+		labels = append(labels, string(message[offset+1:offset+1+n]))
+		offset += n + 1
+	}
+	return strings.Join(labels, ".") + ".", offset + 1
+}
+
+// A DNS server taking one UPDATE per connection, checking its TSIG with
+// secret when there is one
+func fakeDNSServer(t *testing.T, secret []byte, received chan<- receivedUpdate) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			length := make([]byte, 2)
+			io.ReadFull(conn, length)
+			message := make([]byte, binary.BigEndian.Uint16(length))
+			io.ReadFull(conn, message)
+
+			var u receivedUpdate
+			updates := int(binary.BigEndian.Uint16(message[8:]))
+			additional := int(binary.BigEndian.Uint16(message[10:]))
+			rcode := byte(0)
+			if message[2]>>3 != dnsOpcodeUpdate || binary.BigEndian.Uint16(message[4:]) != 1 {
+				rcode = 1
+			}
+			var offset int
+			u.zone, offset = readWireName(message, 12)
+			offset += 4
+			for n := 0; n < updates; n++ {
+				var name string
+				name, offset = readWireName(message, offset)
+				class := binary.BigEndian.Uint16(message[offset+2:])
+				rdlength := int(binary.BigEndian.Uint16(message[offset+8:]))
+				rdata := message[offset+10 : offset+10+rdlength]
+				value := net.IP(rdata).String()
+				if binary.BigEndian.Uint16(message[offset:]) == dnsTypePTR {
+					value, _ = readWireName(rdata, 0)
+				}
+				if rdlength == 0 {
+					value = ""
+				}
+				u.records = append(u.records, strings.TrimSpace(map[uint16]string{dnsClassIN: "add", dnsClassANY: "delete", dnsClassNONE: "remove"}[class]+" "+name+" "+value))
+				offset += 10 + rdlength
+			}
+			if additional == 1 {
+				_, variables := readWireName(message, offset)
+				rdata := variables + 10
+				_, macOffset := readWireName(message, rdata)
+				macOffset += 8
+				macSize := int(binary.BigEndian.Uint16(message[macOffset:]))
+				unsigned := append([]byte(nil), message[:offset]...)
+				binary.BigEndian.PutUint16(unsigned[10:], 0)
+				mac := hmac.New(sha256.New, secret)
+				mac.Write(unsigned)
+				mac.Write(message[offset:variables])
+				mac.Write(message[variables+2 : variables+8])
+				mac.Write(message[rdata:macOffset])
+				mac.Write(message[macOffset+2+macSize+2 : macOffset+2+macSize+6])
+				u.signed = hmac.Equal(mac.Sum(nil), message[macOffset+2:macOffset+2+macSize])
+				if !u.signed {
+					rcode = 9
+				}
+			}
+			received <- u
+
+			answer := make([]byte, 12)
+			copy(answer, message[:2])
+			answer[2] = 0x80 | dnsOpcodeUpdate<<3
+			answer[3] = rcode
+			binary.BigEndian.PutUint16(length, 12)
+			conn.Write(append(length, answer...))
+			conn.Close()
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String()
+}
+
+func TestRFC2136Driver(t *testing.T) {
+	secret := []byte("0123456789abcdef")
+	received := make(chan receivedUpdate, 1)
+	server := fakeDNSServer(t, secret, received)
+
+	if _, err := newRFC2136Driver(config.RFC2136Config{Server: server, TSIGName: "waitron", TSIGSecret: "not base64!"}); err == nil {
+		t.Error("expected a secret that isn't base64 to be refused")
+	}
+	if _, err := newRFC2136Driver(config.RFC2136Config{Server: server, TSIGName: "waitron", TSIGSecret: "c2VjcmV0", TSIGAlgorithm: "hmac-md5"}); err == nil {
+		t.Error("expected an unknown algorithm to be refused")
+	}
+	d, err := newRFC2136Driver(config.RFC2136Config{Server: server, TSIGName: "Waitron.", TSIGSecret: base64.StdEncoding.EncodeToString(secret)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zone := config.DNSZone{Name: "example.com."}
+	if err := d.Replace(zone, "node01.example.com.", "A", 300, []string{"192.0.2.10", "192.0.2.11"}); err != nil {
+		t.Fatal(err)
+	}
+	u := <-received
+	if !u.signed || u.zone != "example.com." || strings.Join(u.records, "|") != "delete node01.example.com.|add node01.example.com. 192.0.2.10|add node01.example.com. 192.0.2.11" {
+		t.Errorf("unexpected update %+v", u)
+	}
+
+	reverse := config.DNSZone{Name: "2.0.192.in-addr.arpa."}
+	if err := d.Remove(reverse, "10.2.0.192.in-addr.arpa.", "PTR", "node01.example.com."); err != nil {
+		t.Fatal(err)
+	}
+	if u := <-received; strings.Join(u.records, "|") != "remove 10.2.0.192.in-addr.arpa. node01.example.com." {
+		t.Errorf("unexpected update %+v", u)
+	}
+
+	if err := d.Replace(zone, "node01.example.com.", "AAAA", 300, []string{"192.0.2.10"}); err == nil {
+		t.Error("expected an IPv4 address in an AAAA record to be refused")
+	}
+
+	// A key the server doesn't know
+	d.secret = []byte("wrong")
+	if err := d.Replace(zone, "node01.example.com.", "A", 300, nil); err == nil || !strings.Contains(err.Error(), "NOTAUTH") {
+		t.Errorf("expected the server's refusal, got %v", err)
+	}
+	<-received
+}
+
+func TestRoute53Driver(t *testing.T) {
+	var mux sync.Mutex
+	sets := map[string]route53RecordSet{}
+	var actions []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") ||
+			!strings.Contains(r.Header.Get("Authorization"), "/us-east-1/route53/aws4_request") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/2013-04-01/hostedzone/Z123/rrset") {
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `<ErrorResponse><Error><Code>NoSuchHostedZone</Code><Message>No hosted zone found</Message></Error></ErrorResponse>`)
+			return
+		}
+		if r.Method == "GET" {
+			var list struct {
+				XMLName xml.Name           `xml:"ListResourceRecordSetsResponse"`
+				Sets    []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+			}
+			var keys []string
+			for k := range sets {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			for _, k := range keys {
+				if k >= r.URL.Query().Get("name")+" "+r.URL.Query().Get("type") {
+					list.Sets = append(list.Sets, sets[k])
+					break
+				}
+			}
+			data, _ := xml.Marshal(list)
+			w.Write(data)
+			return
+		}
+		var change route53ChangeRequest
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := xml.Unmarshal(body, &change); err != nil || len(change.Changes) != 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		c := change.Changes[0]
+		key := c.Set.Name + " " + c.Set.Type
+		actions = append(actions, c.Action+" "+key)
+		if c.Action == "DELETE" {
+			delete(sets, key)
+		} else {
+			sets[key] = c.Set
+		}
+		io.WriteString(w, `<ChangeResourceRecordSetsResponse><ChangeInfo><Status>PENDING</Status></ChangeInfo></ChangeResourceRecordSetsResponse>`)
+	}))
+	defer server.Close()
+
+	d := newRoute53Driver(config.Route53Config{Endpoint: server.URL, AccessKey: "AKID", SecretKey: "secret"})
+	d.now = func() time.Time { return time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC) }
+	zone := config.DNSZone{Name: "example.com.", ID: "/hostedzone/Z123"}
+	reverse := config.DNSZone{Name: "2.0.192.in-addr.arpa.", ID: "Z123"}
+
+	if err := d.Replace(zone, "node01.example.com.", "A", 300, []string{"192.0.2.10"}); err != nil {
+		t.Fatal(err)
+	}
+	if s := sets["node01.example.com. A"]; s.TTL != 300 || len(s.Records) != 1 || s.Records[0].Value != "192.0.2.10" {
+		t.Errorf("unexpected record set %+v", s)
+	}
+	// Nothing to delete, and only the name asked for is
+	if err := d.Replace(zone, "node00.example.com.", "A", 300, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Replace(zone, "node01.example.com.", "A", 300, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sets["10.2.0.192.in-addr.arpa. PTR"] = route53RecordSet{Name: "10.2.0.192.in-addr.arpa.", Type: "PTR", TTL: 60,
+		Records: []route53Record{{Value: "node01.example.com."}, {Value: "node02.example.com."}}}
+	d.Remove(reverse, "10.2.0.192.in-addr.arpa.", "PTR", "node01.example.com.")
+	d.Remove(reverse, "10.2.0.192.in-addr.arpa.", "PTR", "node03.example.com.")
+	d.Remove(reverse, "10.2.0.192.in-addr.arpa.", "PTR", "node02.example.com.")
+
+	expected := "UPSERT node01.example.com. A|DELETE node01.example.com. A|UPSERT 10.2.0.192.in-addr.arpa. PTR|DELETE 10.2.0.192.in-addr.arpa. PTR"
+	if strings.Join(actions, "|") != expected {
+		t.Errorf("expected %s, got %s", expected, strings.Join(actions, "|"))
+	}
+
+	if err := d.Replace(config.DNSZone{Name: "example.org.", ID: "Z999"}, "node01.example.org.", "A", 300, []string{"192.0.2.10"}); err == nil ||
+		!strings.Contains(err.Error(), "NoSuchHostedZone") {
+		t.Errorf("expected Route 53's error, got %v", err)
+	}
+}
@@ -0,0 +1,9 @@
+// Package state is what Waitron keeps about builds: build mode and its
+// stages, the store and history, and the integrations (IPAM, DNS, VMs,
+// notifiers, metrics) that follow builds. New returns an empty one, which is
+// enough for tests.
+package state
+
+import "github.com/ns1/waitron/config"
+
+var logger = config.Log
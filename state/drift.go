@@ -0,0 +1,173 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// A host drifted when what it would be built with now isn't what its last
+// completed build was armed with, see machine/rollback.go: its rendered config
+// changed, with the profile of that build merged over it as it was then, or
+// one of its templates did. Every drift_check_secs (an hour by default, -1
+// turns it off) every host in the inventory is checked, and POST
+// /api/v1/drift-checks checks right away. GET /status?drift=true lists the
+// hosts that drifted. Builds from before versions were recorded, and hosts
+// never built, can't drift.
+
+const DefaultDriftCheckSeconds = 3600
+
+// ConfigDrift is how a host moved on since its last completed build
+type ConfigDrift struct {
+	Hostname string
+	// The completed build it was compared with, and when it was done
+	Token     string
+	Installed time.Time
+	Checked   time.Time
+	// What changed: definition, template <name>, or profile <name> when
+	// the profile can't be used anymore
+	Changes []string
+}
+
+type driftDetector struct {
+	config config.Config
+	state  *State
+
+	mux sync.Mutex
+	// Hosts that drifted as of the last check, by hostname
+	drifted map[string]*ConfigDrift
+}
+
+func NewDriftDetector(config config.Config, state *State) *driftDetector {
+	return &driftDetector{
+		config:  config,
+		state:   state,
+		drifted: make(map[string]*ConfigDrift),
+	}
+}
+
+// Check every interval, and hosts again as their builds complete, until the
+// state is closed
+func (d *driftDetector) Start(interval time.Duration) {
+	d.state.Events.Subscribe(func(e Event) {
+		if e.Type != machine.EventBuildCompleted {
+			return
+		}
+		// Reads definitions and templates, sinks must not block
+		go func() {
+			if _, err := d.CheckHost(e.Hostname); err != nil {
+				logger.Warn("cannot check host for drift", "hostname", e.Hostname, "error", err)
+			}
+		}()
+	})
+	go func() {
+		for {
+			if _, err := d.CheckAll(); err != nil {
+				logger.Error("cannot check hosts for drift", "error", err)
+			}
+			select {
+			case <-d.state.Stopped():
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+// Check every host in the inventory, returns the ones that drifted
+func (d *driftDetector) CheckAll() (map[string]*ConfigDrift, error) {
+	inv, err := d.state.InventoryFor(d.config)
+	if err != nil {
+		return nil, err
+	}
+	drifted := make(map[string]*ConfigDrift)
+	for _, e := range inv.Match(nil) {
+		drift, err := d.Check(e.Hostname)
+		if err != nil {
+			logger.Warn("cannot check host for drift", "hostname", e.Hostname, "error", err)
+			continue
+		}
+		if drift != nil {
+			drifted[e.Hostname] = drift
+		}
+	}
+
+	d.mux.Lock()
+	d.drifted = drifted
+	d.mux.Unlock()
+	return drifted, nil
+}
+
+// Check hostname and keep the outcome, nil when it didn't drift
+func (d *driftDetector) CheckHost(hostname string) (*ConfigDrift, error) {
+	drift, err := d.Check(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	d.mux.Lock()
+	if drift != nil {
+		d.drifted[drift.Hostname] = drift
+	} else {
+		delete(d.drifted, strings.ToLower(hostname))
+	}
+	d.mux.Unlock()
+	return drift, nil
+}
+
+// How hostname drifted since its last completed build, nil if it didn't or
+// there is nothing to compare with
+func (d *driftDetector) Check(hostname string) (*ConfigDrift, error) {
+	h, err := LoadHostHistory(d.state.Store, hostname)
+	if err != nil {
+		return nil, err
+	}
+	built := h.LastCompleted()
+	if built == nil || built.Versions == nil {
+		return nil, nil
+	}
+	// The MAC address is part of the config of a build with the default
+	// profile, one from before it was kept can't be rebuilt to compare
+	if built.Profile == "default" && built.MacAddress == "" {
+		return nil, nil
+	}
+
+	m, err := machine.BuildDefinition(hostname, built.MacAddress, d.config)
+	if err != nil {
+		return nil, err
+	}
+	drift := &ConfigDrift{Hostname: m.Hostname, Token: built.Token, Installed: built.BuildEnd, Checked: time.Now()}
+	if built.Profile != "" && built.Profile != "default" {
+		if err := m.ApplyProfile(built.Profile, d.config); err != nil {
+			drift.Changes = append(drift.Changes, fmt.Sprintf("profile %s", built.Profile))
+			return drift, nil
+		}
+	}
+	now := d.state.buildVersions(&m, d.config)
+
+	if now.Definition != built.Versions.Definition {
+		drift.Changes = append(drift.Changes, "definition")
+	}
+	drift.Changes = append(drift.Changes, templateChanges(built.Versions, now)...)
+
+	if len(drift.Changes) == 0 {
+		return nil, nil
+	}
+	return drift, nil
+}
+
+// The hosts that drifted as of the last check
+func (d *driftDetector) List() map[string]*ConfigDrift {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	drifted := make(map[string]*ConfigDrift, len(d.drifted))
+	for hostname, drift := range d.drifted {
+		drifted[hostname] = drift
+	}
+	return drifted
+}
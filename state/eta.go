@@ -0,0 +1,125 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ns1/waitron/machine"
+)
+
+// A build gets an ETA when it starts, or starts over on a retry, from how
+// long earlier builds of its os and profile took: the median for when it
+// should be done and the 95th percentile for when it takes longer than
+// usual. The durations are those of completed builds since startup, plus
+// those in the host histories in the state store. Once a build runs
+// build_overdue_percent past that 95th percentile it is flagged overdue and
+// build-overdue is emitted, well before a stale threshold would fire. A
+// build whose stale threshold comes first is left to the stale watcher.
+
+// Completed builds of an os and profile needed before estimating
+const minETASamples = 5
+
+type etaKey struct {
+	OperatingSystem string
+	Profile         string
+}
+
+func etaKeyFor(m *machine.Machine) etaKey {
+	if m == nil {
+		return etaKey{}
+	}
+	return etaKey{OperatingSystem: m.OperatingSystem, Profile: m.ProfileName()}
+}
+
+// Keep d for builds like k. Callers must hold s.mux.
+func (s *buildStats) addDuration(k etaKey, d time.Duration) {
+	s.profiles[k] = append(s.profiles[k], d)
+	if len(s.profiles[k]) > maxBuildDurations {
+		s.profiles[k] = s.profiles[k][len(s.profiles[k])-maxBuildDurations:]
+	}
+}
+
+// The ETA of the build of m if it started now, nil without enough earlier
+// builds like it
+func (s *buildStats) estimate(m *machine.Machine) *machine.BuildETA {
+	s.mux.Lock()
+	durations := s.profiles[etaKeyFor(m)]
+	if len(durations) < minETASamples {
+		s.mux.Unlock()
+		return nil
+	}
+	sorted := append([]time.Duration(nil), durations...)
+	s.mux.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return &machine.BuildETA{
+		Estimated: m.BuildStart.Add(percentile(sorted, 0.50)),
+		P95:       m.BuildStart.Add(percentile(sorted, 0.95)),
+		Samples:   len(sorted),
+	}
+}
+
+// Take the durations of completed builds from the host histories in store
+func (s *buildStats) Seed(store Store) error {
+	hostnames, err := store.List(historyBucket)
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for _, hostname := range hostnames {
+		h, err := LoadHostHistory(store, hostname)
+		if err != nil {
+			return err
+		}
+		if h == nil {
+			continue
+		}
+		for _, e := range h.Entries {
+			if e.Status != "Installed" || e.BuildStart.IsZero() || e.BuildEnd.Before(e.BuildStart) {
+				continue
+			}
+			s.addDuration(etaKey{OperatingSystem: e.OperatingSystem, Profile: e.Profile}, e.BuildEnd.Sub(e.BuildStart))
+		}
+	}
+	return nil
+}
+
+// Set a timer for builds with an ETA as they start or start over, an
+// EventSink
+func (state *State) watchOverdue(e Event) {
+	if (e.Type != machine.EventBuildStarted && e.Type != machine.EventBuildRetried && !isStagePassed(e.Type)) || e.Machine == nil {
+		return
+	}
+	due := e.Machine.OverdueAt()
+	if due.IsZero() {
+		return
+	}
+	m := state.MachineByToken(e.Token)
+	if m == nil {
+		return
+	}
+	start := e.Machine.BuildStart
+	time.AfterFunc(time.Until(due), func() { state.markOverdue(m, start) })
+}
+
+// Flag the build of m that started at start overdue, unless it is gone or
+// started over since
+func (state *State) markOverdue(m *machine.Machine, start time.Time) {
+	state.Mux.Lock()
+	if state.MachineByUUID[m.Token] != m || !m.BuildStart.Equal(start) || m.ETA == nil || m.ETA.Overdue {
+		state.Mux.Unlock()
+		return
+	}
+	// Events hold snapshots that share the old ETA
+	eta := *m.ETA
+	eta.Overdue = true
+	m.ETA = &eta
+	state.Version++
+	state.Mux.Unlock()
+
+	state.Emit(machine.EventBuildOverdue, m, fmt.Sprintf("building for %s, 95%% of %d earlier builds took %s or less",
+		time.Since(start).Round(time.Second), eta.Samples, eta.P95.Sub(start).Round(time.Second)))
+}
@@ -0,0 +1,77 @@
+package state
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestBuildETA(t *testing.T) {
+	state := New()
+	var overdue []Event
+	state.Events.Subscribe(func(e Event) {
+		if e.Type == machine.EventBuildOverdue {
+			overdue = append(overdue, e)
+		}
+	})
+
+	now := time.Now()
+	for i := 1; i <= 10; i++ {
+		earlier := &machine.Machine{Hostname: "dns01.example.com"}
+		earlier.OperatingSystem = "ubuntu-24.04"
+		earlier.BuildStart = now.Add(-time.Duration(i) * time.Minute)
+		state.Stats.record(Event{Type: machine.EventBuildCompleted, Machine: earlier, Timestamp: now})
+	}
+	state.Store.Put(historyBucket, "dns01.example.com", machine.HostHistory{Hostname: "dns01.example.com", Entries: []machine.HistoryEntry{
+		{Status: "Installed", OperatingSystem: "rocky-9", BuildStart: now.Add(-time.Hour), BuildEnd: now},
+		{Status: "Terminated", OperatingSystem: "rocky-9", BuildStart: now.Add(-time.Hour), BuildEnd: now},
+	}})
+	if err := state.Stats.Seed(state.Store); err != nil {
+		t.Fatal(err)
+	}
+	if d := state.Stats.profiles[etaKey{OperatingSystem: "rocky-9"}]; len(d) != 1 || d[0] != time.Hour {
+		t.Errorf("expected the completed build from the history, got %v", d)
+	}
+
+	m := machine.Machine{Hostname: "dns02.example.com", Network: []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}}
+	m.OperatingSystem = "ubuntu-24.04"
+	token, err := state.SetBuildMode(m, config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	building := state.MachineByToken(token)
+	eta := building.ETA
+	if eta == nil || eta.Samples != 10 || eta.Estimated.Sub(building.BuildStart) != 5*time.Minute || eta.P95.Sub(building.BuildStart) != 10*time.Minute {
+		t.Fatalf("unexpected eta %+v", eta)
+	}
+	if due := building.OverdueAt(); due.Sub(building.BuildStart) != 12*time.Minute {
+		t.Errorf("expected the build to be overdue 20%% past p95, got %s", due.Sub(building.BuildStart))
+	}
+	building.StaleBuildThresholdSeconds = 600
+	if due := building.OverdueAt(); !due.IsZero() {
+		t.Errorf("expected the stale threshold to come first, got %s", due)
+	}
+
+	state.markOverdue(building, building.BuildStart.Add(time.Second))
+	if len(overdue) != 0 {
+		t.Error("expected a build that started over not to be flagged")
+	}
+	state.markOverdue(building, building.BuildStart)
+	state.markOverdue(building, building.BuildStart)
+	if len(overdue) != 1 || !strings.Contains(overdue[0].Message, "95% of 10 earlier builds took 10m0s or less") {
+		t.Errorf("expected one build-overdue event, got %+v", overdue)
+	}
+	if !building.ETA.Overdue || eta.Overdue {
+		t.Error("expected the build to be flagged overdue")
+	}
+
+	other := machine.Machine{Hostname: "web01.example.com", Network: []machine.Interface{{MacAddress: "de:ad:c0:de:ca:01"}}}
+	other.OperatingSystem = "rocky-9"
+	token, _ = state.SetBuildMode(other, config.Config{})
+	if state.MachineByToken(token).ETA != nil {
+		t.Error("expected no eta without enough earlier builds")
+	}
+}
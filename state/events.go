@@ -0,0 +1,83 @@
+package state
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ns1/waitron/machine"
+)
+
+// How many events are kept in memory for GET /events
+const maxRecentEvents = 500
+
+// Event is something that happened to a build
+type Event struct {
+	Type      string
+	Hostname  string `json:",omitempty"`
+	Token     string `json:",omitempty"`
+	Message   string `json:",omitempty"`
+	Timestamp time.Time
+
+	// The machine as it was when the event was emitted, for notifiers
+	Machine *machine.Machine `json:"-"`
+}
+
+// EventSink receives every event emitted. Sinks must not block.
+type EventSink func(Event)
+
+type eventBus struct {
+	mux    sync.Mutex
+	recent []Event
+	sinks  []EventSink
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{}
+}
+
+func (b *eventBus) Subscribe(sink EventSink) {
+	b.mux.Lock()
+	b.sinks = append(b.sinks, sink)
+	b.mux.Unlock()
+}
+
+func (b *eventBus) Emit(e Event) {
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+
+	b.mux.Lock()
+	b.recent = append(b.recent, e)
+	if len(b.recent) > maxRecentEvents {
+		b.recent = b.recent[len(b.recent)-maxRecentEvents:]
+	}
+	sinks := b.sinks
+	b.mux.Unlock()
+
+	logger.Info("event", "type", e.Type, "hostname", e.Hostname, "message", e.Message)
+
+	for _, sink := range sinks {
+		sink(e)
+	}
+}
+
+func (b *eventBus) List() []Event {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return append([]Event(nil), b.recent...)
+}
+
+// Emit an event about machine m. Must not be called with state.Mux held.
+func (state *State) Emit(eventType string, m *machine.Machine, message string) {
+	e := Event{Type: eventType, Message: message}
+	if m != nil {
+		state.Mux.Lock()
+		snapshot := *m
+		state.Mux.Unlock()
+
+		e.Hostname = m.Hostname
+		e.Token = m.Token
+		e.Machine = &snapshot
+	}
+	state.Events.Emit(e)
+}
@@ -0,0 +1,38 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/ns1/waitron/machine"
+)
+
+func TestEventBus(t *testing.T) {
+	b := newEventBus()
+
+	var received []Event
+	b.Subscribe(func(e Event) {
+		received = append(received, e)
+	})
+
+	b.Emit(Event{Type: machine.EventHookFailed, Hostname: "dns02.example.com"})
+
+	if len(received) != 1 || received[0].Type != machine.EventHookFailed {
+		t.Errorf("expected the sink to receive the event, got %+v", received)
+	}
+	if received[0].Timestamp.IsZero() {
+		t.Errorf("expected emit to timestamp the event")
+	}
+	if len(b.List()) != 1 {
+		t.Errorf("expected one recent event, got %d", len(b.List()))
+	}
+}
+
+func TestEventBusBounded(t *testing.T) {
+	b := newEventBus()
+	for i := 0; i < maxRecentEvents+10; i++ {
+		b.Emit(Event{Type: machine.EventHookFailed})
+	}
+	if len(b.List()) != maxRecentEvents {
+		t.Errorf("expected %d recent events, got %d", maxRecentEvents, len(b.List()))
+	}
+}
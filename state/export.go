@@ -0,0 +1,139 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ns1/waitron/machine"
+)
+
+// GET /export/inventory dumps the inventory for CMDBs, spreadsheets and
+// audits, as CSV or as JSON objects keyed by column. A column label.<key> is
+// that one label, for CSV readers that want a column per label. In CSV, MAC
+// and IP addresses are separated by spaces and labels are key=value pairs
+// separated by semicolons.
+
+var ExportColumns = []string{"hostname", "macs", "ips", "labels", "last_build", "status"}
+
+// The last build of a machine as exported
+type exportBuild struct {
+	Token      string    `json:"token"`
+	Status     string    `json:"status"`
+	BuildStart time.Time `json:"build_start"`
+	BuildEnd   time.Time `json:"build_end"`
+}
+
+type exportRow struct {
+	entry     machine.InventoryEntry
+	lastBuild *exportBuild
+	status    string
+}
+
+func ParseExportColumns(columns string) ([]string, error) {
+	if columns == "" {
+		return ExportColumns, nil
+	}
+	var parsed []string
+	for _, c := range strings.Split(columns, ",") {
+		c = strings.TrimSpace(c)
+		known := strings.HasPrefix(c, "label.") && len(c) > len("label.")
+		for _, e := range ExportColumns {
+			known = known || c == e
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown column %q, expected %s or label.<key>", c, strings.Join(ExportColumns, ", "))
+		}
+		parsed = append(parsed, c)
+	}
+	return parsed, nil
+}
+
+// The most recent finished build of every hostname from the state store
+func (state *State) lastBuilds() (map[string]machine.BuildRecord, error) {
+	keys, err := state.Store.List(BuildsBucket)
+	if err != nil {
+		return nil, err
+	}
+	last := make(map[string]machine.BuildRecord)
+	for _, key := range keys {
+		var b machine.BuildRecord
+		if found, err := state.Store.Get(BuildsBucket, key, &b); err != nil || !found {
+			continue
+		}
+		hostname := strings.ToLower(b.Hostname)
+		if l, found := last[hostname]; !found || b.BuildEnd.After(l.BuildEnd) {
+			last[hostname] = b
+		}
+	}
+	return last, nil
+}
+
+// A machine being built is Installing, others have the status of their last
+// build
+func (state *State) ExportRows(entries []machine.InventoryEntry) ([]exportRow, error) {
+	last, err := state.lastBuilds()
+	if err != nil {
+		return nil, err
+	}
+
+	state.Mux.Lock()
+	defer state.Mux.Unlock()
+	rows := make([]exportRow, 0, len(entries))
+	for _, e := range entries {
+		row := exportRow{entry: e}
+		if b, found := last[e.Hostname]; found {
+			row.lastBuild = &exportBuild{Token: b.Token, Status: b.Status, BuildStart: b.BuildStart, BuildEnd: b.BuildEnd}
+			row.status = b.Status
+		}
+		if m, found := state.MachineByHostname[e.Hostname]; found && m.Status != "" {
+			row.status = m.Status
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func (r exportRow) JSON(column string) interface{} {
+	switch column {
+	case "hostname":
+		return r.entry.Hostname
+	case "macs":
+		return append([]string{}, r.entry.MACs...)
+	case "ips":
+		return append([]string{}, r.entry.IPs...)
+	case "labels":
+		if r.entry.Labels == nil {
+			return map[string]string{}
+		}
+		return r.entry.Labels
+	case "last_build":
+		return r.lastBuild
+	case "status":
+		return r.status
+	}
+	return r.entry.Labels[strings.TrimPrefix(column, "label.")]
+}
+
+func (r exportRow) CSV(column string) string {
+	switch column {
+	case "macs":
+		return strings.Join(r.entry.MACs, " ")
+	case "ips":
+		return strings.Join(r.entry.IPs, " ")
+	case "labels":
+		var pairs []string
+		for k, v := range r.entry.Labels {
+			pairs = append(pairs, k+"="+v)
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ";")
+	case "last_build":
+		if r.lastBuild == nil {
+			return ""
+		}
+		return r.lastBuild.BuildEnd.UTC().Format(time.RFC3339)
+	}
+	return fmt.Sprint(r.JSON(column))
+}
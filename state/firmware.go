@@ -0,0 +1,64 @@
+package state
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// What the build identified by token is to apply
+func (state *State) FirmwareFor(token string) (*machine.FirmwareManifest, error) {
+	state.Mux.Lock()
+	defer state.Mux.Unlock()
+
+	m, err := state.machineInStage(token, machine.FirmwareStage)
+	if err != nil {
+		return nil, err
+	}
+	return m.FirmwareManifest(), nil
+}
+
+// Record how the firmware update of the build identified by token went and
+// let it go on or fail it. It passes when every component in its manifest
+// was updated.
+func (state *State) ReportFirmware(token string, r machine.FirmwareResult, config config.Config) error {
+	r.Reported = time.Now()
+
+	state.Mux.Lock()
+	m, err := state.machineInStage(token, machine.FirmwareStage)
+	if err != nil {
+		state.Mux.Unlock()
+		return err
+	}
+	m.FirmwareResult = &r
+	manifest := m.FirmwareManifest()
+	state.Version++
+	state.Mux.Unlock()
+
+	reported := make(map[string]bool)
+	var failed []string
+	for _, c := range r.Components {
+		reported[c.Component] = true
+		if !c.Passed {
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Component, c.Message))
+		}
+	}
+	var missing []string
+	for component := range manifest.Components {
+		if !reported[component] {
+			missing = append(missing, component+": no result")
+		}
+	}
+	sort.Strings(missing)
+	failed = append(failed, missing...)
+
+	if len(failed) > 0 {
+		state.FailStage(m, config, machine.FirmwareStage, strings.Join(failed, ", "))
+		return nil
+	}
+	return state.PassStage(m, config, machine.FirmwareStage, r.Message)
+}
@@ -0,0 +1,103 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ns1/waitron/machine"
+)
+
+// A group rebuild, POST /api/v1/group-rebuilds, rebuilds the hosts whose
+// labels match a selector in waves: first canary hosts, then wave_size hosts
+// at a time. Every host of a wave comes after all the hosts of the wave
+// before it, and a build with validation is done once its checks pass, so a
+// wave only starts once the one before it installed and validated. It is a
+// bulk build with max_failures, 0 unless asked for: a failed build lets the
+// rollout go on until there are more than max_failures of them, then it is
+// paused until POST /api/v1/bulk-builds/<id>/resume.
+
+// GroupRebuildRequest is what POST /api/v1/group-rebuilds takes
+type GroupRebuildRequest struct {
+	// Which hosts to rebuild, e.g. role=web,site=ams1
+	Selector string
+	// How many hosts go first on their own, 1 by default
+	Canary int `json:",omitempty"`
+	// How many hosts build at once after the canaries, the rest by default
+	WaveSize    int `json:",omitempty"`
+	MaxFailures int `json:",omitempty"`
+
+	Profile      string `json:",omitempty"`
+	DomainLabel  string `json:",omitempty"`
+	MaxPerDomain int    `json:",omitempty"`
+}
+
+// The hostnames of every wave of a group rebuild of hostnames
+func groupRebuildWaves(hostnames []string, canary int, waveSize int) [][]string {
+	if canary <= 0 {
+		canary = 1
+	}
+	var waves [][]string
+	for size := canary; len(hostnames) > 0; size = waveSize {
+		if size <= 0 || size > len(hostnames) {
+			size = len(hostnames)
+		}
+		waves = append(waves, hostnames[:size])
+		hostnames = hostnames[size:]
+	}
+	return waves
+}
+
+// Roll out a rebuild of the hosts matching r.Selector as a bulk build
+func (s *bulkScheduler) SubmitGroupRebuild(r GroupRebuildRequest) (*BulkBuild, error) {
+	requirements, err := machine.ParseSelector(r.Selector)
+	if err != nil {
+		return nil, err
+	}
+	if len(requirements) == 0 {
+		return nil, errors.New("a selector is needed, not rebuilding every host")
+	}
+	if r.Canary < 0 || r.WaveSize < 0 {
+		return nil, errors.New("canary and wave size can't be negative")
+	}
+
+	inv, err := s.state.InventoryFor(s.config)
+	if err != nil {
+		return nil, err
+	}
+	var hostnames []string
+	for _, e := range inv.Match(requirements) {
+		hostnames = append(hostnames, e.Hostname)
+	}
+	if len(hostnames) == 0 {
+		return nil, fmt.Errorf("no hosts match %s", r.Selector)
+	}
+
+	bulk := BulkBuildRequest{
+		Profile:      r.Profile,
+		DomainLabel:  r.DomainLabel,
+		MaxPerDomain: r.MaxPerDomain,
+		MaxFailures:  &r.MaxFailures,
+	}
+	waves := groupRebuildWaves(hostnames, r.Canary, r.WaveSize)
+	wave := make(map[string]int)
+	for i, hostnames := range waves {
+		for _, hostname := range hostnames {
+			host := BulkHost{Hostname: hostname}
+			if i > 0 {
+				host.After = waves[i-1]
+			}
+			bulk.Hosts = append(bulk.Hosts, host)
+			wave[hostname] = i + 1
+		}
+	}
+
+	b, err := s.prepare(bulk)
+	if err != nil {
+		return nil, err
+	}
+	b.Selector = r.Selector
+	for _, h := range b.Hosts {
+		h.Wave = wave[h.Hostname]
+	}
+	return s.run(b)
+}
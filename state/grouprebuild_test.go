@@ -0,0 +1,150 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestGroupRebuildWaves(t *testing.T) {
+	hostnames := []string{"a", "b", "c", "d", "e"}
+	for _, c := range []struct {
+		canary, waveSize int
+		expected         [][]string
+	}{
+		{0, 0, [][]string{{"a"}, {"b", "c", "d", "e"}}},
+		{2, 2, [][]string{{"a", "b"}, {"c", "d"}, {"e"}}},
+		{1, 10, [][]string{{"a"}, {"b", "c", "d", "e"}}},
+		{10, 1, [][]string{{"a", "b", "c", "d", "e"}}},
+	} {
+		if waves := groupRebuildWaves(hostnames, c.canary, c.waveSize); !reflect.DeepEqual(waves, c.expected) {
+			t.Errorf("expected %v for canary %d and waves of %d, got %v", c.expected, c.canary, c.waveSize, waves)
+		}
+	}
+}
+
+func TestGroupRebuild(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-group-rebuild")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for i, host := range []struct{ hostname, role string }{
+		{"web01.example.com", "web"},
+		{"web02.example.com", "web"},
+		{"web03.example.com", "web"},
+		{"web04.example.com", "web"},
+		{"db01.example.com", "db"},
+	} {
+		definition := fmt.Sprintf(`{"labels": {"role": %q}, "network": [{"macaddress": "de:ad:c0:de:ca:0%d"}]}`, host.role, i)
+		ioutil.WriteFile(filepath.Join(dir, host.hostname+".yaml"), []byte(definition), 0644)
+	}
+	config := config.Config{MachinePath: dir, GroupPath: dir}
+
+	state := New()
+	state.Bulk = NewBulkScheduler(config, state)
+	state.Bulk.Start()
+
+	hosts := func(b *BulkBuild) map[string]*BulkBuildHost {
+		byHostname := make(map[string]*BulkBuildHost)
+		for _, h := range b.Hosts {
+			byHostname[h.Hostname] = h
+		}
+		return byHostname
+	}
+	wait := func(id string, hostname string, status string) (*BulkBuild, map[string]*BulkBuildHost) {
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			b, err := state.Bulk.Get(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if h := hosts(b); h[hostname].Status == status || time.Now().After(deadline) {
+				return b, h
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	building := func(hostname string) *machine.Machine {
+		m := state.BuildInProgress(hostname)
+		if m == nil {
+			t.Fatalf("expected %s to be building", hostname)
+		}
+		return m
+	}
+
+	b, err := state.Bulk.SubmitGroupRebuild(GroupRebuildRequest{Selector: "role=web", WaveSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := hosts(b)
+	if len(b.Hosts) != 4 || b.Selector != "role=web" || h["web01.example.com"].Status != bulkBuilding ||
+		h["web02.example.com"].Status != bulkWaiting || h["web02.example.com"].Wave != 2 || h["web04.example.com"].Wave != 3 {
+		t.Fatalf("expected the canary web01 to start on its own, got %+v", b)
+	}
+
+	if err := state.DoneBuildMode(*building("web01.example.com"), config); err != nil {
+		t.Fatal(err)
+	}
+	_, h = wait(b.ID, "web03.example.com", bulkBuilding)
+	if h["web02.example.com"].Status != bulkBuilding || h["web03.example.com"].Status != bulkBuilding || h["web04.example.com"].Status != bulkWaiting {
+		t.Fatalf("expected the second wave to start after the canary, got %+v %+v", h["web02.example.com"], h["web03.example.com"])
+	}
+
+	state.Emit(machine.EventBuildFailed, building("web02.example.com"), "install hooks failed")
+	if err := state.DoneBuildMode(*building("web03.example.com"), config); err != nil {
+		t.Fatal(err)
+	}
+	b, h = wait(b.ID, "web03.example.com", bulkDone)
+	if !b.Paused || b.Failures != 1 || h["web02.example.com"].Status != bulkFailed || h["web04.example.com"].Status != bulkWaiting {
+		t.Fatalf("expected the rebuild to pause after web02 failed, got %+v %+v", b, h["web04.example.com"])
+	}
+	// The event is emitted once the sink that paused the rebuild returned
+	paused := false
+	for deadline := time.Now().Add(5 * time.Second); !paused && time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		for _, e := range state.Events.List() {
+			paused = paused || e.Type == machine.EventBulkBuildPaused
+		}
+	}
+	if !paused {
+		t.Error("expected a bulk-build-paused event")
+	}
+
+	if b, err = state.Bulk.Resume(b.ID); err != nil {
+		t.Fatal(err)
+	}
+	if h = hosts(b); b.Paused || h["web04.example.com"].Status != bulkBuilding {
+		t.Fatalf("expected web04 to start once resumed, got %+v", h["web04.example.com"])
+	}
+	if _, err := state.Bulk.Resume(b.ID); err != ErrBulkBuildNotPaused {
+		t.Errorf("expected a running bulk build not to resume, got %v", err)
+	}
+
+	if err := state.DoneBuildMode(*building("web04.example.com"), config); err != nil {
+		t.Fatal(err)
+	}
+	if err := state.CancelBuildMode(*building("web02.example.com"), config, ""); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ = wait(b.ID, "web02.example.com", bulkCancelled); b.Finished.IsZero() {
+		t.Error("expected the group rebuild to be finished")
+	}
+
+	for problem, r := range map[string]GroupRebuildRequest{
+		"selector is needed": {},
+		"no hosts match":     {Selector: "role=mail"},
+		"can't be negative":  {Selector: "role=db", WaveSize: -1},
+	} {
+		if _, err := state.Bulk.SubmitGroupRebuild(r); err == nil || !strings.Contains(err.Error(), problem) {
+			t.Errorf("expected %q, got %v", problem, err)
+		}
+	}
+}
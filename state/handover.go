@@ -0,0 +1,153 @@
+package state
+
+import (
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// A restart without dropping builds: the new process binds next to the old
+// one (reuse_port, or sockets from systemd), then POSTs to the old one's
+// /api/v1/handover with an admin token. The old process answers with the
+// builds in progress, stops accepting connections and exits once its
+// in-flight requests are done. The new one takes over the builds and starts
+// serving. Whatever the old process records after answering, like a build
+// being marked done while it drains, is not carried over.
+
+// HandoverBuild is what moves from the old process to the new one about a
+// build in progress. The machine itself is loaded again from its definition,
+// or the default profile with the MAC address it was built for, and gets the
+// build profile, cmdline and addresses of the build again.
+type HandoverBuild struct {
+	Hostname        string
+	Token           string
+	MacAddress      string                 `json:",omitempty"`
+	Profile         string                 `json:",omitempty"`
+	ExtraCmdline    string                 `json:",omitempty"`
+	Retries         int                    `json:",omitempty"`
+	Allocations     []machine.IPAllocation `json:",omitempty"`
+	Status          string
+	State           machine.BuildState        `json:",omitempty"`
+	Transitions     []machine.StateTransition `json:",omitempty"`
+	BuildStart      time.Time
+	RescueMode      bool
+	Phases          []machine.BuildPhase     `json:",omitempty"`
+	HookResults     []machine.HookResult     `json:",omitempty"`
+	Progress        *machine.BuildProgress   `json:",omitempty"`
+	ProgressHistory []machine.BuildProgress  `json:",omitempty"`
+	Validation      *machine.BuildValidation `json:",omitempty"`
+	HostKey         string                   `json:",omitempty"`
+}
+
+type HandoverResult struct {
+	Builds []HandoverBuild
+}
+
+const HandoverTimeout = 30 * time.Second
+
+func (state *State) ExportBuilds() []HandoverBuild {
+	state.Mux.Lock()
+	defer state.Mux.Unlock()
+
+	builds := []HandoverBuild{}
+	for _, m := range state.MachineByHostname {
+		builds = append(builds, HandoverBuild{
+			Hostname:        m.Hostname,
+			Token:           m.Token,
+			MacAddress:      m.Network[0].MacAddress,
+			Profile:         m.Profile,
+			ExtraCmdline:    m.ExtraCmdline,
+			Retries:         m.Retries,
+			Allocations:     append([]machine.IPAllocation(nil), m.Allocations...),
+			Status:          m.Status,
+			State:           m.State,
+			Transitions:     append([]machine.StateTransition(nil), m.Transitions...),
+			BuildStart:      m.BuildStart,
+			RescueMode:      m.RescueMode,
+			Phases:          append([]machine.BuildPhase(nil), m.Phases...),
+			HookResults:     append([]machine.HookResult(nil), m.HookResults...),
+			Progress:        m.Progress,
+			ProgressHistory: append([]machine.BuildProgress(nil), m.ProgressHistory...),
+			Validation:      m.ValidationResults,
+			HostKey:         m.HostKey,
+		})
+	}
+	return builds
+}
+
+// Put builds from another process in build mode under their existing
+// tokens. No build commands, hooks or events are run, as far as anyone else
+// is concerned they never stopped. Builds whose machine or build profile
+// can't be loaded any more are skipped.
+func (state *State) ImportBuilds(builds []HandoverBuild, config config.Config) int {
+	imported := 0
+	for _, b := range builds {
+		m, err := machine.BuildDefinition(b.Hostname, b.MacAddress, config)
+		if err == nil {
+			m.ExtraCmdline = b.ExtraCmdline
+			if b.Profile != "" {
+				err = m.ApplyProfile(b.Profile, config)
+			}
+		}
+		if err != nil {
+			logger.Error("cannot take over build", "hostname", b.Hostname, "error", err)
+			continue
+		}
+		if len(m.Network) == 0 || b.Token == "" {
+			logger.Error("cannot take over build", "hostname", b.Hostname, "error", "no network interface or token")
+			continue
+		}
+		m.RestoreAllocations(b.Allocations)
+
+		m.Token = b.Token
+		m.Retries = b.Retries
+		m.Status = b.Status
+		m.State = b.State
+		m.Transitions = b.Transitions
+		if m.State == "" {
+			// From a Waitron that predates build states
+			m.State = stateFromPhases(b.Phases)
+		}
+		m.BuildStart = b.BuildStart
+		m.RescueMode = b.RescueMode
+		m.Phases = b.Phases
+		m.HookResults = b.HookResults
+		m.Progress = b.Progress
+		m.ProgressHistory = b.ProgressHistory
+		m.ValidationResults = b.Validation
+		m.HostKey = b.HostKey
+		if a, err := LoadAnnotations(state.Store, m.Hostname); err == nil {
+			m.Annotations = a
+		} else {
+			logger.Machine(&m).Error("cannot load annotations", "error", err)
+		}
+
+		state.Mux.Lock()
+		state.Tokens[m.Hostname] = m.Token
+		state.MachineByUUID[m.Token] = &m
+		if m.State != machine.BuildValidating {
+			state.MachineByMAC[m.Network[0].MacAddress] = &m
+		}
+		state.MachineByHostname[m.Hostname] = &m
+		state.Version++
+		state.Mux.Unlock()
+
+		if m.State == machine.BuildValidating && m.ValidationResults != nil && m.Validation != nil {
+			// Its checks pick up where the old process left them
+			go state.validate(&m, config)
+		}
+
+		logger.Machine(&m).Info("took over build", "token", m.Token)
+		imported++
+	}
+	return imported
+}
+
+// Ask waitron to drain and exit
+func (state *State) RequestShutdown(reason string) {
+	select {
+	case state.Shutdown <- reason:
+	default:
+	}
+}
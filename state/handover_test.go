@@ -0,0 +1,61 @@
+package state
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestImportBuilds(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-handover")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "node01.example.com.yaml"),
+		[]byte(`{"operatingsystem": "ubuntu", "network": [{"name": "eth0", "macaddress": "de:ad:be:ef:00:01", "ip": "auto"}]}`), 0644)
+	config := config.Config{MachinePath: dir, GroupPath: dir,
+		BuildProfiles:  map[string]map[string]interface{}{"rocky-9": {"operatingsystem": "rocky-9"}},
+		DefaultProfile: &config.DefaultProfileConfig{Definition: map[string]interface{}{"operatingsystem": "debian"}},
+	}
+
+	old := New()
+	for _, m := range []*machine.Machine{
+		{Hostname: "node01.example.com", Token: "profiled", Profile: "rocky-9", ExtraCmdline: "debug", Retries: 2,
+			Network:     []machine.Interface{{Name: "eth0", MacAddress: "de:ad:be:ef:00:01"}},
+			Allocations: []machine.IPAllocation{{Pool: "prod", Interface: "eth0", IPAddress: "192.0.2.10", Cidr: "24", Gateway: "192.0.2.1"}}},
+		{Hostname: "unknown-aa-bb-cc-dd-ee-ff", Token: "unknown", DefaultProfile: true,
+			Network: []machine.Interface{{MacAddress: "aa:bb:cc:dd:ee:ff"}}},
+	} {
+		old.MachineByHostname[m.Hostname] = m
+	}
+	data, _ := json.Marshal(HandoverResult{Builds: old.ExportBuilds()})
+	var result HandoverResult
+	if err := json.Unmarshal(data, &result); err != nil {
+		t.Fatal(err)
+	}
+
+	state := New()
+	if imported := state.ImportBuilds(result.Builds, config); imported != 2 {
+		t.Fatalf("expected both builds to be taken over, got %d", imported)
+	}
+	m := state.MachineByToken("profiled")
+	if m.Profile != "rocky-9" || m.OperatingSystem != "rocky-9" || m.ExtraCmdline != "debug" || m.Retries != 2 {
+		t.Errorf("expected the build's profile, cmdline and retries, got %+v", m)
+	}
+	if len(m.Allocations) != 1 || len(m.Network[0].Addresses4) != 1 || m.Network[0].Addresses4[0].IPAddress != "192.0.2.10" || m.Network[0].Gateway4 != "192.0.2.1" {
+		t.Errorf("expected the build's addresses, got %+v %+v", m.Allocations, m.Network)
+	}
+	unknown := state.MachineByToken("unknown")
+	if unknown == nil || !unknown.DefaultProfile || unknown.OperatingSystem != "debian" || state.MachineByMAC["aa:bb:cc:dd:ee:ff"] != unknown {
+		t.Errorf("expected the default profile build with its MAC address, got %+v", unknown)
+	}
+
+	// A build profile that is gone can't be built on
+	delete(config.BuildProfiles, "rocky-9")
+	if imported := New().ImportBuilds(result.Builds, config); imported != 1 {
+		t.Errorf("expected only the build without a profile to be taken over, got %d", imported)
+	}
+}
@@ -0,0 +1,86 @@
+package state
+
+import (
+	"time"
+
+	"github.com/ns1/waitron/machine"
+)
+
+const historyBucket = "host-history"
+
+// How many builds of a host are listed, the counters go on regardless
+const maxHostHistory = 100
+
+func LoadHostHistory(store Store, hostname string) (*machine.HostHistory, error) {
+	var h machine.HostHistory
+	found, err := store.Get(historyBucket, hostname, &h)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &h, nil
+}
+
+// Add the build of m to the history of its host, or update the entry it
+// already has once it finished. Returns the history as it is now.
+func (state *State) RecordHistory(m *machine.Machine) *machine.HostHistory {
+	state.historyMux.Lock()
+	defer state.historyMux.Unlock()
+
+	h, err := LoadHostHistory(state.Store, m.Hostname)
+	if err != nil {
+		logger.Machine(m).Error("cannot load host history", "error", err)
+		return nil
+	}
+	if h == nil {
+		h = &machine.HostHistory{Hostname: m.Hostname}
+	}
+
+	var entry *machine.HistoryEntry
+	for i := range h.Entries {
+		if h.Entries[i].Token == m.Token {
+			entry = &h.Entries[i]
+		}
+	}
+	if entry == nil {
+		h.Builds++
+		h.Entries = append(h.Entries, machine.HistoryEntry{
+			Token:           m.Token,
+			OperatingSystem: m.OperatingSystem,
+			Profile:         m.ProfileName(),
+			Rescue:          m.RescueMode,
+			BuildStart:      m.BuildStart,
+			Versions:        m.Versions,
+			RollbackOf:      m.RollbackOf,
+		})
+		if m.DefaultProfile && len(m.Network) > 0 {
+			h.Entries[len(h.Entries)-1].MacAddress = m.Network[0].MacAddress
+		}
+		if len(h.Entries) > maxHostHistory {
+			h.Entries = h.Entries[len(h.Entries)-maxHostHistory:]
+		}
+		entry = &h.Entries[len(h.Entries)-1]
+	}
+
+	entry.Status = m.Status
+	if m.WipeResult != nil {
+		entry.Wipe = m.WipeResult
+	}
+	switch m.Status {
+	case "Installed":
+		h.Completed++
+		h.LastInstalled = time.Now()
+		entry.BuildEnd = h.LastInstalled
+	case "Terminated":
+		h.Cancelled++
+		entry.BuildEnd = time.Now()
+	}
+	if m.Status != "Installing" {
+		h.Retries += m.Retries
+		entry.Retries = m.Retries
+	}
+
+	if err := state.Store.Put(historyBucket, m.Hostname, h); err != nil {
+		logger.Machine(m).Error("cannot store host history", "error", err)
+	}
+	return h
+}
@@ -0,0 +1,21 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestHostHistoryOnMachine(t *testing.T) {
+	state := New()
+	m := machine.Machine{Hostname: "dns03.example.com", Network: []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}}
+	token, err := state.SetBuildMode(m, config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	building := state.MachineByToken(token)
+	if building.History == nil || building.History.Builds != 1 {
+		t.Errorf("expected the history on the machine being built, got %+v", building.History)
+	}
+}
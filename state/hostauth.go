@@ -0,0 +1,91 @@
+package state
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// The finish script, and whatever runs on the installed system, can call
+// /done and /cancel without the token: POST /done/<hostname> and POST
+// /cancel/<hostname> take the identity of the host instead. That is a client
+// certificate for the hostname, verified against the listener's
+// tls_client_ca_file, or the host key of the build as a bearer token. Every
+// build gets a random host key, which templates write to the installed
+// system as {{ machine.HostKey }}, so it never shows up in a URL, the kernel
+// cmdline or the access log.
+
+const HostKeyBytes = 32
+
+func newHostKey() (string, error) {
+	key := make([]byte, HostKeyBytes)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// The token of the build of the hostname in ps if request authenticates as
+// it, by the token in its path or, without one, by host identity
+func (state *State) RequestToken(request *http.Request, ps httprouter.Params) (string, bool) {
+	hostname := ps.ByName("hostname")
+
+	state.Mux.Lock()
+	token := state.Tokens[hostname]
+	var hostKey string
+	if m, found := state.MachineByUUID[token]; found {
+		hostKey = m.HostKey
+	}
+	state.Mux.Unlock()
+
+	if t := ps.ByName("token"); t != "" {
+		return token, t == token
+	}
+	if hostKey == "" {
+		return "", false
+	}
+	if clientCertFor(request, hostname) {
+		return token, true
+	}
+	key := BearerToken(request)
+	return token, key != "" && subtle.ConstantTimeCompare([]byte(key), []byte(hostKey)) == 1
+}
+
+// Whether request came with a verified client certificate for hostname
+func clientCertFor(request *http.Request, hostname string) bool {
+	if request.TLS == nil || len(request.TLS.VerifiedChains) == 0 || len(request.TLS.VerifiedChains[0]) == 0 {
+		return false
+	}
+	cert := request.TLS.VerifiedChains[0][0]
+	if strings.EqualFold(cert.Subject.CommonName, hostname) {
+		return true
+	}
+	for _, name := range cert.DNSNames {
+		if strings.EqualFold(name, hostname) {
+			return true
+		}
+	}
+	return false
+}
+
+// Ask for client certificates signed by the CAs in file, without requiring
+// one
+func ClientCertConfig(file string) (*tls.Config, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %s", file)
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}, nil
+}
@@ -0,0 +1,224 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/template"
+)
+
+// Boot images declared in the config are downloaded into imagepath, checked
+// against their SHA256 and served as /images/<name>. Machine definitions use
+// them with an image: prefix, e.g. kernel: image:focal-linux, which pixie
+// responses turn into <baseurl>/images/focal-linux. Images are synced at
+// startup and every image_sync_secs.
+
+const DefaultImageSyncSeconds = 24 * 60 * 60
+
+// Longest a download may take, a stalled mirror would otherwise hold the
+// image's sync forever
+const ImageDownloadTimeout = time.Hour
+
+// ImageStatus is how the download of an image went
+type ImageStatus struct {
+	Name   string
+	URL    string
+	SHA256 string `json:",omitempty"`
+	Size   int64
+	Ready  bool
+	Synced time.Time `json:",omitempty"`
+	Error  string    `json:",omitempty"`
+}
+
+var ErrUnknownImage = errors.New("unknown image")
+
+type imageCatalog struct {
+	path   string
+	images map[string]configpkg.BootImage
+	client *http.Client
+
+	mux    sync.Mutex
+	status map[string]*ImageStatus
+
+	// One sync at a time per image
+	syncing map[string]*sync.Mutex
+}
+
+func NewImageCatalog(config configpkg.Config) (*imageCatalog, error) {
+	if config.ImagePath == "" {
+		return nil, errors.New("images need an imagepath to be downloaded to")
+	}
+	if err := os.MkdirAll(config.ImagePath, 0755); err != nil {
+		return nil, err
+	}
+
+	c := &imageCatalog{
+		path:    config.ImagePath,
+		images:  make(map[string]configpkg.BootImage),
+		client:  &http.Client{Timeout: ImageDownloadTimeout},
+		status:  make(map[string]*ImageStatus),
+		syncing: make(map[string]*sync.Mutex),
+	}
+	for _, img := range config.Images {
+		img.SHA256 = strings.ToLower(img.SHA256)
+		c.images[img.Name] = img
+		c.status[img.Name] = &ImageStatus{Name: img.Name, URL: img.URL, SHA256: img.SHA256}
+		c.syncing[img.Name] = &sync.Mutex{}
+	}
+	return c, nil
+}
+
+// Sync all images now and then every interval, until stop is closed
+func (c *imageCatalog) Start(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		for {
+			c.syncAll()
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+func (c *imageCatalog) syncAll() {
+	for name := range c.images {
+		if err := c.Sync(name); err != nil {
+			logger.Error("cannot sync image", "image", name, "error", err)
+		}
+	}
+}
+
+// Where the image is kept
+func (c *imageCatalog) File(name string) string {
+	return filepath.Join(c.path, name)
+}
+
+// Make sure the local copy of image name is there and current
+func (c *imageCatalog) Sync(name string) error {
+	img, found := c.images[name]
+	if !found {
+		return ErrUnknownImage
+	}
+
+	c.syncing[name].Lock()
+	defer c.syncing[name].Unlock()
+
+	size, err := c.fetch(img)
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	status := c.status[name]
+	status.Synced = time.Now()
+	if err != nil {
+		status.Error = err.Error()
+		return err
+	}
+	status.Error = ""
+	status.Ready = true
+	status.Size = size
+	return nil
+}
+
+// Download img unless the local copy is good, returning its size
+func (c *imageCatalog) fetch(img configpkg.BootImage) (int64, error) {
+	local := c.File(img.Name)
+	info, err := os.Stat(local)
+	if err == nil && img.SHA256 != "" {
+		if sum, err := template.Checksums.Sum(c.path, img.Name); err == nil && sum == img.SHA256 {
+			return info.Size(), nil
+		}
+	}
+
+	req, err := http.NewRequest("GET", img.URL, nil)
+	if err != nil {
+		return 0, err
+	}
+	if info != nil && img.SHA256 == "" {
+		req.Header.Set("If-Modified-Since", info.ModTime().UTC().Format(http.TimeFormat))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && info != nil {
+		return info.Size(), nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s returned %s", img.URL, resp.Status)
+	}
+
+	// Download next to the image and move it in place once verified, so a
+	// half downloaded image is never served
+	tmp, err := ioutil.TempFile(c.path, "."+img.Name+".")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), resp.Body)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	if img.SHA256 != "" && sum != img.SHA256 {
+		return 0, fmt.Errorf("%s has sha256 %s, expected %s", img.URL, sum, img.SHA256)
+	}
+
+	if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		os.Chtimes(tmp.Name(), lm, lm)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(tmp.Name(), local); err != nil {
+		return 0, err
+	}
+
+	logger.Info("downloaded image", "image", img.Name, "url", img.URL, "size", size, "sha256", sum)
+	return size, nil
+}
+
+func (c *imageCatalog) List() []ImageStatus {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	images := []ImageStatus{}
+	for _, s := range c.status {
+		images = append(images, *s)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	return images
+}
+
+func (c *imageCatalog) Ready(name string) (bool, error) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	s, found := c.status[name]
+	if !found {
+		return false, ErrUnknownImage
+	}
+	return s.Ready, nil
+}
@@ -0,0 +1,138 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+)
+
+// Not the sha256 of anything served here
+const wrongSum = "0000000000000000000000000000000000000000000000000000000000000000"
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func imageServer(t *testing.T, hits *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(hits, 1)
+		if r.Header.Get("If-Modified-Since") != "" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte("kernel"))
+	}))
+}
+
+func imageDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "waitron-images")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestImageSyncVerified(t *testing.T) {
+	var hits int32
+	server := imageServer(t, &hits)
+	defer server.Close()
+	dir := imageDir(t)
+	defer os.RemoveAll(dir)
+
+	sum := sha256Hex([]byte("kernel"))
+	c, err := NewImageCatalog(config.Config{ImagePath: dir, Images: []config.BootImage{
+		{Name: "good", URL: server.URL, SHA256: sum},
+		{Name: "bad", URL: server.URL, SHA256: wrongSum},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Sync("good"); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "good")); string(data) != "kernel" {
+		t.Errorf("unexpected image contents %q", data)
+	}
+
+	// Already there and matching, no download
+	c.Sync("good")
+	if hits != 1 {
+		t.Errorf("expected one download, got %d", hits)
+	}
+
+	if err := c.Sync("bad"); err == nil {
+		t.Error("expected a checksum mismatch")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "bad")); !os.IsNotExist(err) {
+		t.Error("expected a mismatching image not to be kept")
+	}
+	if ready, _ := c.Ready("bad"); ready {
+		t.Error("expected the bad image not to be ready")
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("expected temporary files to be cleaned up, got %d files", len(files))
+	}
+
+	if err := c.Sync("missing"); err != ErrUnknownImage {
+		t.Errorf("expected errUnknownImage, got %v", err)
+	}
+}
+
+func TestImageSyncUnverified(t *testing.T) {
+	var hits int32
+	server := imageServer(t, &hits)
+	defer server.Close()
+	dir := imageDir(t)
+	defer os.RemoveAll(dir)
+
+	c, _ := NewImageCatalog(config.Config{ImagePath: dir, Images: []config.BootImage{{Name: "linux", URL: server.URL}}})
+	if err := c.Sync("linux"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Asks whether it changed and keeps the copy on a 304
+	if err := c.Sync("linux"); err != nil {
+		t.Fatal(err)
+	}
+	if hits != 2 {
+		t.Errorf("expected a conditional request, got %d requests", hits)
+	}
+	if list := c.List(); len(list) != 1 || !list[0].Ready || list[0].Size != 6 {
+		t.Errorf("unexpected status %+v", list)
+	}
+}
+
+func TestImageSyncStalled(t *testing.T) {
+	stall := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "6")
+		w.Write([]byte("ker"))
+		w.(http.Flusher).Flush()
+		<-stall
+	}))
+	defer server.Close()
+	defer close(stall)
+	dir := imageDir(t)
+	defer os.RemoveAll(dir)
+
+	c, _ := NewImageCatalog(config.Config{ImagePath: dir, Images: []config.BootImage{{Name: "linux", URL: server.URL}}})
+	c.client.Timeout = 50 * time.Millisecond
+	if err := c.Sync("linux"); err == nil {
+		t.Fatal("expected a stalled download to fail")
+	}
+	if list := c.List(); list[0].Ready || list[0].Error == "" {
+		t.Errorf("unexpected status %+v", list)
+	}
+}
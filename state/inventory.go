@@ -0,0 +1,15 @@
+package state
+
+import (
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// The inventory, or when none was set up, one read from disk right away
+func (state *State) InventoryFor(config config.Config) (*machine.Inventory, error) {
+	if state.Inventory != nil {
+		return state.Inventory, nil
+	}
+	inv := machine.NewInventory(config)
+	return inv, inv.Refresh()
+}
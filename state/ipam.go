@@ -0,0 +1,528 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Machines can get their addresses from pools instead of their definitions.
+// An interface with ip: auto is given an address from its pool when its
+// build starts, ahead of the addresses it already has, so templates see it
+// in machine.Network like any other and in machine.Allocations with the
+// pool it came from. A rebuild gets the same address again.
+//
+// Cancelling a build releases what it was given. Once a build is done its
+// addresses are kept for the machine, unless the pool has release_on_done,
+// e.g. for a provisioning network; kept ones are given back with
+// DELETE /api/v1/ipam/{pool}/{address}. Allocations are kept in the state
+// store, one key per pool.
+//
+// With driver set to phpipam or netbox the addresses come from that system
+// instead: the subnet or prefix matching a pool's subnet gives out its first
+// free address, reserved with the machine's hostname, which is marked used
+// once the build is done and deleted when it is given back. start, end and
+// exclude are up to that system then.
+//
+// 	ipam:
+// 	  pools:
+// 	    - name: prod
+// 	      subnet: 192.0.2.0/24
+// 	      start: 192.0.2.100
+// 	      gateway: 192.0.2.1
+//
+// 	network:
+// 	  - name: eth0
+// 	    macaddress: de:ad:be:ef:00:01
+// 	    ip: auto
+// 	    pool: prod
+
+const (
+	ipamBucket = "ipam"
+	IPAuto     = "auto"
+
+	ipamDriverTimeout = 30 * time.Second
+)
+
+type ipPool struct {
+	config  config.IPPoolConfig
+	network *net.IPNet
+	start   net.IP
+	end     net.IP
+	exclude map[string]bool
+}
+
+// An IPAM addresses are taken from rather than the pools' own ranges
+type ipamDriver interface {
+	// Reserve the first free address of p's subnet for hostname's iface,
+	// returns it with its id
+	reserve(p *ipPool, hostname string, iface string) (net.IP, string, error)
+	// The build with a is done
+	keep(a machine.IPAllocation) error
+	// Give a back, nothing to do when it's gone already
+	free(a machine.IPAllocation) error
+}
+
+type IPAM struct {
+	mux    sync.Mutex
+	store  Store
+	pools  []*ipPool
+	byName map[string]*ipPool
+	// nil for builtin
+	Driver ipamDriver
+}
+
+func NewIPAM(config config.IPAMConfig, store Store) (*IPAM, error) {
+	i := &IPAM{store: store, byName: make(map[string]*ipPool)}
+	switch config.Driver {
+	case "", "builtin":
+	case "phpipam":
+		i.Driver = NewPHPIPAMDriver(config.PHPIPAM)
+	case "netbox":
+		i.Driver = newNetBoxIPAMDriver(config.NetBox)
+	default:
+		return nil, fmt.Errorf("unknown ipam driver %q, expected builtin, phpipam or netbox", config.Driver)
+	}
+	for _, c := range config.Pools {
+		p, err := newIPPool(c)
+		if err != nil {
+			return nil, fmt.Errorf("ipam pool %q: %s", c.Name, err)
+		}
+		if i.byName[c.Name] != nil {
+			return nil, fmt.Errorf("ipam pool %q is defined twice", c.Name)
+		}
+		i.pools = append(i.pools, p)
+		i.byName[c.Name] = p
+	}
+	return i, nil
+}
+
+func newIPPool(c config.IPPoolConfig) (*ipPool, error) {
+	if c.Name == "" || !ValidHostname.MatchString(c.Name) {
+		return nil, fmt.Errorf("invalid name")
+	}
+	_, network, err := net.ParseCIDR(c.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	p := &ipPool{config: c, network: network, exclude: make(map[string]bool)}
+
+	first, last := ipRange(network)
+	if ones, bits := network.Mask.Size(); bits == 32 && ones < 31 {
+		first, last = nextIP(first, 1), nextIP(last, -1)
+	}
+	p.start, p.end = first, last
+	if c.Start != "" {
+		if p.start, err = poolAddress(c.Start, network); err != nil {
+			return nil, err
+		}
+	}
+	if c.End != "" {
+		if p.end, err = poolAddress(c.End, network); err != nil {
+			return nil, err
+		}
+	}
+	if bytes.Compare(p.start.To16(), p.end.To16()) > 0 {
+		return nil, fmt.Errorf("start %s is after end %s", p.start, p.end)
+	}
+
+	for _, address := range append([]string{c.Gateway}, c.Exclude...) {
+		if address == "" {
+			continue
+		}
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", address)
+		}
+		p.exclude[ip.String()] = true
+	}
+	return p, nil
+}
+
+func poolAddress(address string, network *net.IPNet) (net.IP, error) {
+	ip := net.ParseIP(address)
+	if ip == nil || !network.Contains(ip) {
+		return nil, fmt.Errorf("%s is not an address in %s", address, network)
+	}
+	return ip, nil
+}
+
+// The first and last address of network
+func ipRange(network *net.IPNet) (net.IP, net.IP) {
+	first := network.IP.Mask(network.Mask)
+	last := make(net.IP, len(first))
+	for n := range first {
+		last[n] = first[n] | ^network.Mask[n]
+	}
+	return first, last
+}
+
+// ip moved by delta, which is 1 or -1
+func nextIP(ip net.IP, delta int) net.IP {
+	next := append(net.IP(nil), ip...)
+	for n := len(next) - 1; n >= 0; n-- {
+		next[n] += byte(delta)
+		if (delta > 0 && next[n] != 0) || (delta < 0 && next[n] != 0xff) {
+			break
+		}
+	}
+	return next
+}
+
+func (p *ipPool) ipv4() bool {
+	return p.network.IP.To4() != nil
+}
+
+// How many addresses the pool hands out at most
+func (p *ipPool) size() uint64 {
+	size := new(big.Int).Sub(new(big.Int).SetBytes(p.end.To16()), new(big.Int).SetBytes(p.start.To16()))
+	size.Add(size, big.NewInt(1))
+	for address := range p.exclude {
+		if p.contains(net.ParseIP(address)) {
+			size.Sub(size, big.NewInt(1))
+		}
+	}
+	if !size.IsUint64() {
+		return ^uint64(0)
+	}
+	return size.Uint64()
+}
+
+func (p *ipPool) contains(ip net.IP) bool {
+	return bytes.Compare(ip.To16(), p.start.To16()) >= 0 && bytes.Compare(ip.To16(), p.end.To16()) <= 0
+}
+
+func (p *ipPool) allocation(ip net.IP, hostname string, iface string) machine.IPAllocation {
+	ones, _ := p.network.Mask.Size()
+	a := machine.IPAllocation{
+		Pool:        p.config.Name,
+		Hostname:    hostname,
+		Interface:   iface,
+		IPAddress:   ip.String(),
+		Cidr:        strconv.Itoa(ones),
+		Gateway:     p.config.Gateway,
+		AllocatedAt: time.Now(),
+	}
+	if p.ipv4() {
+		a.Netmask = net.IP(p.network.Mask).String()
+	}
+	return a
+}
+
+// The allocations of a pool by address
+func (i *IPAM) load(p *ipPool) (map[string]machine.IPAllocation, error) {
+	allocations := make(map[string]machine.IPAllocation)
+	if _, err := i.store.Get(ipamBucket, p.config.Name, &allocations); err != nil {
+		return nil, err
+	}
+	return allocations, nil
+}
+
+func (i *IPAM) save(p *ipPool, allocations map[string]machine.IPAllocation) error {
+	return i.store.Put(ipamBucket, p.config.Name, allocations)
+}
+
+// The pool of an interface: its own, the machine's ipam_pool or the first
+func (i *IPAM) pool(names ...string) (*ipPool, error) {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if p, found := i.byName[name]; found {
+			return p, nil
+		}
+		return nil, fmt.Errorf("no ipam pool %q", name)
+	}
+	if len(i.pools) == 0 {
+		return nil, fmt.Errorf("no ipam pools configured")
+	}
+	return i.pools[0], nil
+}
+
+// The address of hostname's iface in p, the one it had before when there is
+// one, otherwise the lowest free one
+func (i *IPAM) allocateFrom(p *ipPool, hostname string, iface string) (machine.IPAllocation, error) {
+	allocations, err := i.load(p)
+	if err != nil {
+		return machine.IPAllocation{}, err
+	}
+	for _, a := range allocations {
+		if a.Hostname == hostname && a.Interface == iface {
+			return a, nil
+		}
+	}
+
+	if i.Driver != nil {
+		ip, id, err := i.Driver.reserve(p, hostname, iface)
+		if err != nil {
+			return machine.IPAllocation{}, fmt.Errorf("ipam pool %q: %s", p.config.Name, err)
+		}
+		a := p.allocation(ip, hostname, iface)
+		a.ExternalID = id
+		if !p.network.Contains(ip) {
+			i.Driver.free(a)
+			return machine.IPAllocation{}, fmt.Errorf("ipam pool %q: got %s, which isn't in %s", p.config.Name, ip, p.network)
+		}
+		allocations[a.IPAddress] = a
+		return a, i.save(p, allocations)
+	}
+
+	for ip := p.start; p.contains(ip); ip = nextIP(ip, 1) {
+		address := ip.String()
+		if _, taken := allocations[address]; taken || p.exclude[address] {
+			continue
+		}
+		a := p.allocation(ip, hostname, iface)
+		allocations[address] = a
+		return a, i.save(p, allocations)
+	}
+	return machine.IPAllocation{}, fmt.Errorf("ipam pool %q is exhausted", p.config.Name)
+}
+
+// The allocation ip belongs to, found is false when no pool lent it
+func (i *IPAM) lookup(ip net.IP) (machine.IPAllocation, bool, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	for _, p := range i.pools {
+		if !p.network.Contains(ip) {
+			continue
+		}
+		allocations, err := i.load(p)
+		if err != nil {
+			return machine.IPAllocation{}, false, err
+		}
+		if a, found := allocations[ip.String()]; found {
+			return a, true, nil
+		}
+	}
+	return machine.IPAllocation{}, false, nil
+}
+
+// Give every interface of m with ip: auto an address
+func (i *IPAM) allocate(m *machine.Machine) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	network := append([]machine.Interface(nil), m.Network...)
+	var allocations []machine.IPAllocation
+	for n := range network {
+		iface := &network[n]
+		if iface.IP != IPAuto {
+			continue
+		}
+		name := iface.Name
+		if name == "" {
+			name = strconv.Itoa(n)
+		}
+		var a machine.IPAllocation
+		p, err := i.pool(iface.Pool, m.IPAMPool)
+		if err == nil {
+			a, err = i.allocateFrom(p, m.Hostname, name)
+		}
+		if err != nil {
+			// Don't keep half of what the build needed
+			if releaseErr := i.releaseLocked(allocations, false); releaseErr != nil {
+				logger.Machine(m).Error("cannot release addresses", "error", releaseErr)
+			}
+			return err
+		}
+		allocations = append(allocations, a)
+		a.Assign(iface)
+	}
+	if len(allocations) > 0 {
+		m.Network = network
+		m.Allocations = allocations
+		logger.Machine(m).Info("allocated addresses", "count", len(allocations))
+	}
+	return nil
+}
+
+// Release allocations, all of them or only those no finished build kept
+func (i *IPAM) releaseLocked(allocations []machine.IPAllocation, persisted bool) error {
+	for _, a := range allocations {
+		p, found := i.byName[a.Pool]
+		if !found {
+			continue
+		}
+		current, err := i.load(p)
+		if err != nil {
+			return err
+		}
+		c, found := current[a.IPAddress]
+		if !found || c.Hostname != a.Hostname || (c.Persisted && !persisted) {
+			continue
+		}
+		if i.Driver != nil {
+			if err := i.Driver.free(c); err != nil {
+				return err
+			}
+		}
+		delete(current, a.IPAddress)
+		if err := i.save(p, current); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The build of m is done: keep its addresses, or give them back for pools
+// with release_on_done
+func (i *IPAM) done(m *machine.Machine) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	for _, a := range m.Allocations {
+		p, found := i.byName[a.Pool]
+		if !found {
+			continue
+		}
+		if p.config.ReleaseOnDone {
+			if err := i.releaseLocked([]machine.IPAllocation{a}, true); err != nil {
+				return err
+			}
+			continue
+		}
+		current, err := i.load(p)
+		if err != nil {
+			return err
+		}
+		if c, found := current[a.IPAddress]; found && c.Hostname == a.Hostname {
+			if i.Driver != nil && !c.Persisted {
+				if err := i.Driver.keep(c); err != nil {
+					return err
+				}
+			}
+			c.Persisted = true
+			current[a.IPAddress] = c
+			if err := i.save(p, current); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// The build of m was cancelled, what it was given and no earlier build kept
+// goes back to the pools
+func (i *IPAM) cancel(m *machine.Machine) error {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+	return i.releaseLocked(m.Allocations, false)
+}
+
+// Give an address back, false when it isn't allocated
+func (i *IPAM) Release(pool string, address string) (bool, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	p, found := i.byName[pool]
+	if !found {
+		return false, nil
+	}
+	if ip := net.ParseIP(address); ip != nil {
+		address = ip.String()
+	}
+	current, err := i.load(p)
+	if err != nil {
+		return false, err
+	}
+	a, found := current[address]
+	if !found {
+		return false, nil
+	}
+	if i.Driver != nil {
+		if err := i.Driver.free(a); err != nil {
+			return false, err
+		}
+	}
+	delete(current, address)
+	return true, i.save(p, current)
+}
+
+func (state *State) AllocateAddresses(m *machine.Machine) error {
+	if state.IPAM != nil {
+		return state.IPAM.allocate(m)
+	}
+	for _, i := range m.Network {
+		if i.IP == IPAuto {
+			return fmt.Errorf("interface %s has ip: auto but there are no ipam pools", i.Name)
+		}
+	}
+	return nil
+}
+
+// For a build that is done
+func (state *State) KeepAddresses(m *machine.Machine) {
+	if state.IPAM == nil || len(m.Allocations) == 0 {
+		return
+	}
+	if err := state.IPAM.done(m); err != nil {
+		logger.Machine(m).Error("cannot keep allocated addresses", "error", err)
+	}
+}
+
+// For a build that was cancelled or didn't start
+func (state *State) releaseAddresses(m *machine.Machine) {
+	if state.IPAM == nil || len(m.Allocations) == 0 {
+		return
+	}
+	if err := state.IPAM.cancel(m); err != nil {
+		logger.Machine(m).Error("cannot release allocated addresses", "error", err)
+	}
+}
+
+// How a pool is used, as shown by /ipam
+type IPPoolUsage struct {
+	Name        string
+	Subnet      string
+	Start       string
+	End         string
+	Gateway     string `json:",omitempty"`
+	Size        uint64
+	Used        int
+	Free        uint64
+	Allocations []machine.IPAllocation
+}
+
+func (i *IPAM) Usage() ([]IPPoolUsage, error) {
+	i.mux.Lock()
+	defer i.mux.Unlock()
+
+	usage := []IPPoolUsage{}
+	for _, p := range i.pools {
+		allocations, err := i.load(p)
+		if err != nil {
+			return nil, err
+		}
+		u := IPPoolUsage{
+			Name:        p.config.Name,
+			Subnet:      p.network.String(),
+			Start:       p.start.String(),
+			End:         p.end.String(),
+			Gateway:     p.config.Gateway,
+			Size:        p.size(),
+			Used:        len(allocations),
+			Allocations: []machine.IPAllocation{},
+		}
+		if u.Size > uint64(u.Used) {
+			u.Free = u.Size - uint64(u.Used)
+		}
+		for _, a := range allocations {
+			u.Allocations = append(u.Allocations, a)
+		}
+		sort.Slice(u.Allocations, func(x, y int) bool {
+			return bytes.Compare(net.ParseIP(u.Allocations[x].IPAddress).To16(), net.ParseIP(u.Allocations[y].IPAddress).To16()) < 0
+		})
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
@@ -0,0 +1,233 @@
+package state
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestIPAMConfig(t *testing.T) {
+	for _, pools := range [][]config.IPPoolConfig{
+		{{Name: "prod", Subnet: "192.0.2.0/33"}},
+		{{Name: "prod", Subnet: "192.0.2.0/24", Start: "198.51.100.1"}},
+		{{Name: "prod", Subnet: "192.0.2.0/24", Start: "192.0.2.200", End: "192.0.2.100"}},
+		{{Name: "prod", Subnet: "192.0.2.0/24"}, {Name: "prod", Subnet: "198.51.100.0/24"}},
+		{{Name: "no/slashes", Subnet: "192.0.2.0/24"}},
+	} {
+		if _, err := NewIPAM(config.IPAMConfig{Pools: pools}, NewMemoryStore()); err == nil {
+			t.Errorf("expected %+v to be refused", pools)
+		}
+	}
+
+	i, err := NewIPAM(config.IPAMConfig{Pools: []config.IPPoolConfig{
+		{Name: "all", Subnet: "192.0.2.0/24", Gateway: "192.0.2.1"},
+		{Name: "v6", Subnet: "2001:db8::/64"},
+	}}, NewMemoryStore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p := i.byName["all"]; p.start.String() != "192.0.2.1" || p.end.String() != "192.0.2.254" || p.size() != 253 {
+		t.Errorf("expected the subnet without network, broadcast and gateway, got %s-%s %d", p.start, p.end, p.size())
+	}
+	if p := i.byName["v6"]; p.start.String() != "2001:db8::" || p.end.String() != "2001:db8::ffff:ffff:ffff:ffff" {
+		t.Errorf("unexpected IPv6 range %s-%s", p.start, p.end)
+	}
+}
+
+func TestIPAMAllocation(t *testing.T) {
+	state := New()
+	var err error
+	state.IPAM, err = NewIPAM(config.IPAMConfig{Pools: []config.IPPoolConfig{
+		{Name: "prod", Subnet: "192.0.2.0/24", Start: "192.0.2.10", End: "192.0.2.12", Gateway: "192.0.2.1", Exclude: []string{"192.0.2.10"}},
+		{Name: "provisioning", Subnet: "198.51.100.0/24", ReleaseOnDone: true},
+	}}, state.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := func(hostname string, pool string) *machine.Machine {
+		return &machine.Machine{Hostname: hostname, Config: config.Config{IPAMPool: "prod"}, Network: []machine.Interface{
+			{Name: "eth0", MacAddress: "de:ad:be:ef:00:01", IP: IPAuto, Pool: pool},
+		}}
+	}
+
+	m := machine("node01.example.com", "")
+	if err := state.AllocateAddresses(m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Allocations) != 1 || m.Network[0].Addresses4[0].IPAddress != "192.0.2.11" || m.Network[0].Addresses4[0].Cidr != "24" ||
+		m.Network[0].Addresses4[0].Netmask != "255.255.255.0" || m.Network[0].Gateway4 != "192.0.2.1" {
+		t.Fatalf("expected the first free address, got %+v %+v", m.Network, m.Allocations)
+	}
+
+	// A rebuild gets the same address, other machines the next one
+	again := machine("node01.example.com", "")
+	state.AllocateAddresses(again)
+	other := machine("node02.example.com", "")
+	state.AllocateAddresses(other)
+	if again.Allocations[0].IPAddress != "192.0.2.11" || other.Allocations[0].IPAddress != "192.0.2.12" {
+		t.Errorf("unexpected addresses %+v %+v", again.Allocations, other.Allocations)
+	}
+	if err := state.AllocateAddresses(machine("node03.example.com", "")); err == nil {
+		t.Error("expected the pool to be exhausted")
+	}
+
+	// Cancelled builds give their address back, done ones keep it
+	state.KeepAddresses(m)
+	state.releaseAddresses(other)
+	state.releaseAddresses(again)
+	usage, _ := state.IPAM.Usage()
+	if usage[0].Used != 1 || usage[0].Free != 1 || !usage[0].Allocations[0].Persisted || usage[0].Allocations[0].Hostname != "node01.example.com" {
+		t.Errorf("expected only the done build's address, got %+v", usage[0])
+	}
+
+	p := machine("node04.example.com", "provisioning")
+	state.AllocateAddresses(p)
+	if p.Allocations[0].IPAddress != "198.51.100.1" {
+		t.Errorf("expected the interface's own pool, got %+v", p.Allocations)
+	}
+	state.KeepAddresses(p)
+	if usage, _ := state.IPAM.Usage(); usage[1].Used != 0 {
+		t.Errorf("expected release_on_done to give the address back, got %+v", usage[1])
+	}
+
+	if err := state.AllocateAddresses(machine("node05.example.com", "missing")); err == nil {
+		t.Error("expected an unknown pool to fail")
+	}
+	state.IPAM = nil
+	if err := state.AllocateAddresses(machine("node05.example.com", "")); err == nil {
+		t.Error("expected ip: auto without ipam to fail")
+	}
+}
+
+func TestIPAMDrivers(t *testing.T) {
+	var mux sync.Mutex
+	var requests []string
+	netbox := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		if r.Header.Get("Authorization") != "Token nbtoken" {
+			w.WriteHeader(http.StatusForbidden)
+			io.WriteString(w, `{"detail": "Invalid token"}`)
+			return
+		}
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, strings.TrimSpace(r.Method+" "+r.URL.RequestURI()+" "+body["status"]+" "+body["dns_name"]))
+		switch {
+		case r.URL.Path == "/api/ipam/prefixes/" && r.URL.Query().Get("prefix") == "192.0.2.0/24":
+			io.WriteString(w, `{"count": 1, "results": [{"id": 7, "prefix": "192.0.2.0/24"}]}`)
+		case r.URL.Path == "/api/ipam/prefixes/":
+			io.WriteString(w, `{"count": 0, "results": []}`)
+		case r.Method == "POST":
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, `{"id": 42, "address": "192.0.2.5/24", "status": {"value": "reserved"}}`)
+		case r.Method == "DELETE":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			io.WriteString(w, `{"id": 42, "address": "192.0.2.5/24"}`)
+		}
+	}))
+	defer netbox.Close()
+
+	state := New()
+	var err error
+	state.IPAM, err = NewIPAM(config.IPAMConfig{Driver: "netbox", NetBox: config.NetBoxIPAMConfig{URL: netbox.URL, Token: "nbtoken"}, Pools: []config.IPPoolConfig{
+		{Name: "prod", Subnet: "192.0.2.0/24", Gateway: "192.0.2.1"},
+		{Name: "missing", Subnet: "198.51.100.0/24"},
+	}}, state.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	machine := func(pool string) *machine.Machine {
+		return &machine.Machine{Hostname: "node01.example.com", Network: []machine.Interface{{Name: "eth0", IP: IPAuto, Pool: pool}}}
+	}
+
+	m := machine("prod")
+	if err := state.AllocateAddresses(m); err != nil {
+		t.Fatal(err)
+	}
+	if m.Network[0].Addresses4[0].IPAddress != "192.0.2.5" || m.Network[0].Gateway4 != "192.0.2.1" || m.Allocations[0].ExternalID != "42" {
+		t.Errorf("expected NetBox's address, got %+v %+v", m.Network, m.Allocations)
+	}
+	// A rebuild reuses it without asking NetBox again
+	state.AllocateAddresses(machine("prod"))
+	state.KeepAddresses(m)
+	if released, err := state.IPAM.Release("prod", "192.0.2.5"); !released || err != nil {
+		t.Errorf("expected the address to be released, got %v %v", released, err)
+	}
+	if err := state.AllocateAddresses(machine("missing")); err == nil || !strings.Contains(err.Error(), "no netbox prefix") {
+		t.Errorf("expected a pool without a prefix to fail, got %v", err)
+	}
+
+	expected := []string{
+		"GET /api/ipam/prefixes/?prefix=192.0.2.0%2F24",
+		"POST /api/ipam/prefixes/7/available-ips/ reserved node01.example.com",
+		"PATCH /api/ipam/ip-addresses/42/ active",
+		"DELETE /api/ipam/ip-addresses/42/",
+		"GET /api/ipam/prefixes/?prefix=198.51.100.0%2F24",
+	}
+	if strings.Join(requests, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected %v, got %v", expected, requests)
+	}
+
+	requests = nil
+	phpipam := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		defer mux.Unlock()
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		requests = append(requests, strings.TrimSpace(r.Method+" "+r.URL.Path+" "+r.Header.Get("token")))
+		switch {
+		case r.URL.Path == "/api/waitron/subnets/cidr/198.51.100.0/24/":
+			io.WriteString(w, `{"code": 200, "success": true, "data": [{"id": "3", "subnet": "198.51.100.0"}]}`)
+		case r.Method == "POST" && body["hostname"] == "node01.example.com":
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, `{"code": 201, "success": true, "message": "Address created", "id": "17", "data": "198.51.100.9"}`)
+		case r.Method == "DELETE":
+			w.WriteHeader(http.StatusNotFound)
+			io.WriteString(w, `{"code": 404, "success": false, "message": "Address does not exist"}`)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"code": 400, "success": false, "message": "Bad request"}`)
+		}
+	}))
+	defer phpipam.Close()
+
+	state.IPAM, err = NewIPAM(config.IPAMConfig{Driver: "phpipam", PHPIPAM: config.PHPIPAMConfig{URL: phpipam.URL, App: "waitron", Token: "apptoken"}, Pools: []config.IPPoolConfig{
+		{Name: "provisioning", Subnet: "198.51.100.0/24", ReleaseOnDone: true},
+	}}, state.Store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := machine("")
+	if err := state.AllocateAddresses(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Allocations[0].IPAddress != "198.51.100.9" || p.Allocations[0].ExternalID != "17" {
+		t.Errorf("expected phpIPAM's address, got %+v", p.Allocations)
+	}
+	// Released on done, and already gone from phpIPAM is as good as deleted
+	state.KeepAddresses(p)
+	if usage, _ := state.IPAM.Usage(); usage[0].Used != 0 {
+		t.Errorf("expected the address to be released, got %+v", usage[0])
+	}
+	expected = []string{
+		"GET /api/waitron/subnets/cidr/198.51.100.0/24/ apptoken",
+		"POST /api/waitron/addresses/first_free/3/ apptoken",
+		"DELETE /api/waitron/addresses/17/ apptoken",
+	}
+	if strings.Join(requests, "|") != strings.Join(expected, "|") {
+		t.Errorf("expected %v, got %v", expected, requests)
+	}
+
+	if _, err := NewIPAM(config.IPAMConfig{Driver: "infoblox"}, state.Store); err == nil {
+		t.Error("expected an unknown driver to be refused")
+	}
+}
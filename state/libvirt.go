@@ -0,0 +1,287 @@
+package state
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// The libvirt driver for VMs, see vm.go, for plain KVM hosts. It runs virsh
+// against the hypervisor, over ssh by default, so the host running waitron
+// needs virsh and a key the hypervisors take. The domain is made from the
+// definition every time: an existing one is destroyed and undefined first.
+// Its disks are volumes called after the hostname in a storage pool, made
+// when they don't exist yet and kept otherwise. NICs are on the bridge,
+// virt_network or libvirt.bridge, with the MAC address of the interface of
+// the same name in the machine definition. A VLAN tag needs an Open vSwitch
+// bridge. The domain boots from the network first, so it fetches its boot
+// config from waitron while it is in build mode and boots from its disk
+// otherwise.
+
+const (
+	libvirtTimeout = 2 * time.Minute
+
+	defaultLibvirtURI    = "qemu+ssh://root@{host}/system"
+	defaultLibvirtBridge = "br0"
+	defaultLibvirtPool   = "default"
+	defaultLibvirtMemory = 1024
+)
+
+type libvirt struct {
+	config config.LibvirtConfig
+	// Run virsh with args against uri, returns what it printed
+	virsh func(uri string, args ...string) (string, error)
+}
+
+type libvirtDomain struct {
+	XMLName  xml.Name        `xml:"domain"`
+	Type     string          `xml:"type,attr"`
+	Name     string          `xml:"name"`
+	Memory   libvirtMemory   `xml:"memory"`
+	VCPU     int             `xml:"vcpu"`
+	OS       libvirtOS       `xml:"os"`
+	Features libvirtFeatures `xml:"features"`
+	Devices  libvirtDevices  `xml:"devices"`
+}
+
+type libvirtMemory struct {
+	Unit  string `xml:"unit,attr"`
+	Value int    `xml:",chardata"`
+}
+
+type libvirtOS struct {
+	Type string `xml:"type"`
+	Boot []struct {
+		Dev string `xml:"dev,attr"`
+	} `xml:"boot"`
+}
+
+type libvirtFeatures struct {
+	ACPI struct{} `xml:"acpi"`
+	APIC struct{} `xml:"apic"`
+}
+
+type libvirtDevices struct {
+	Disks      []libvirtDisk      `xml:"disk"`
+	Interfaces []libvirtInterface `xml:"interface"`
+	Serial     libvirtPTY         `xml:"serial"`
+	Console    libvirtPTY         `xml:"console"`
+	Graphics   libvirtPTY         `xml:"graphics"`
+}
+
+type libvirtDisk struct {
+	Type   string `xml:"type,attr"`
+	Device string `xml:"device,attr"`
+	Driver struct {
+		Name string `xml:"name,attr"`
+		Type string `xml:"type,attr"`
+	} `xml:"driver"`
+	Source struct {
+		File string `xml:"file,attr,omitempty"`
+		Dev  string `xml:"dev,attr,omitempty"`
+	} `xml:"source"`
+	Target struct {
+		Dev string `xml:"dev,attr"`
+		Bus string `xml:"bus,attr"`
+	} `xml:"target"`
+}
+
+type libvirtInterface struct {
+	Type string `xml:"type,attr"`
+	MAC  *struct {
+		Address string `xml:"address,attr"`
+	} `xml:"mac"`
+	Source struct {
+		Bridge string `xml:"bridge,attr"`
+	} `xml:"source"`
+	VirtualPort *libvirtPTY `xml:"virtualport"`
+	Vlan        *struct {
+		Tag struct {
+			ID int `xml:"id,attr"`
+		} `xml:"tag"`
+	} `xml:"vlan"`
+	Model struct {
+		Type string `xml:"type,attr"`
+	} `xml:"model"`
+}
+
+// Devices that only have a type
+type libvirtPTY struct {
+	Type string `xml:"type,attr"`
+}
+
+func NewLibvirt(config config.LibvirtConfig) *libvirt {
+	if config.URI == "" {
+		config.URI = defaultLibvirtURI
+	}
+	if config.Bridge == "" {
+		config.Bridge = defaultLibvirtBridge
+	}
+	if config.Pool == "" {
+		config.Pool = defaultLibvirtPool
+	}
+	if config.Virsh == "" {
+		config.Virsh = "virsh"
+	}
+	l := &libvirt{config: config}
+	l.virsh = l.runVirsh
+	return l
+}
+
+func (l *libvirt) runVirsh(uri string, args ...string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), libvirtTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, l.config.Virsh, append([]string{"-c", uri}, args...)...).CombinedOutput()
+	if err != nil {
+		return string(out), fmt.Errorf("virsh %s: %s", args[0], strings.TrimSpace(string(out)))
+	}
+	return string(out), nil
+}
+
+// The domain XML of m with its disks at paths
+func (l *libvirt) domain(m *machine.Machine, vm machine.VmInstance, nics []vmNIC, paths []string) libvirtDomain {
+	d := libvirtDomain{Type: "kvm", Name: m.Hostname, VCPU: vm.Vcpu}
+	d.Memory = libvirtMemory{Unit: "MiB", Value: vm.Memory}
+	if d.Memory.Value <= 0 {
+		d.Memory.Value = defaultLibvirtMemory
+	}
+	if d.VCPU <= 0 {
+		d.VCPU = 1
+	}
+	d.OS.Type = "hvm"
+	for _, dev := range []string{"network", "hd"} {
+		d.OS.Boot = append(d.OS.Boot, struct {
+			Dev string `xml:"dev,attr"`
+		}{dev})
+	}
+
+	for n, p := range paths {
+		var disk libvirtDisk
+		disk.Device = "disk"
+		disk.Driver.Name = "qemu"
+		disk.Driver.Type = "raw"
+		// Logical and disk pools hand out block devices
+		if strings.HasPrefix(p, "/dev/") {
+			disk.Type = "block"
+			disk.Source.Dev = p
+		} else {
+			disk.Type = "file"
+			disk.Source.File = p
+		}
+		disk.Target.Dev = "vd" + string(rune('a'+n))
+		disk.Target.Bus = "virtio"
+		d.Devices.Disks = append(d.Devices.Disks, disk)
+	}
+
+	bridge := vm.VirtNetwork
+	if bridge == "" {
+		bridge = l.config.Bridge
+	}
+	for _, nic := range nics {
+		i := libvirtInterface{Type: "bridge"}
+		if nic.MAC != "" {
+			i.MAC = &struct {
+				Address string `xml:"address,attr"`
+			}{nic.MAC}
+		}
+		i.Source.Bridge = bridge
+		if nic.Vlan > 0 {
+			i.VirtualPort = &libvirtPTY{Type: "openvswitch"}
+			i.Vlan = &struct {
+				Tag struct {
+					ID int `xml:"id,attr"`
+				} `xml:"tag"`
+			}{}
+			i.Vlan.Tag.ID = nic.Vlan
+		}
+		i.Model.Type = "virtio"
+		d.Devices.Interfaces = append(d.Devices.Interfaces, i)
+	}
+	d.Devices.Serial = libvirtPTY{Type: "pty"}
+	d.Devices.Console = libvirtPTY{Type: "pty"}
+	d.Devices.Graphics = libvirtPTY{Type: "vnc"}
+	return d
+}
+
+// The paths of the disks of m, made when they don't exist yet
+func (l *libvirt) volumes(uri string, m *machine.Machine, vm machine.VmInstance) ([]string, error) {
+	pool := vm.Libvirt.Pool
+	if pool == "" {
+		pool = l.config.Pool
+	}
+	var paths []string
+	for n, size := range vm.Libvirt.Disks {
+		volume := fmt.Sprintf("%s-%d", m.Hostname, n)
+		p, err := l.virsh(uri, "vol-path", "--pool", pool, volume)
+		if err != nil {
+			if _, err := l.virsh(uri, "vol-create-as", pool, volume, fmt.Sprintf("%dG", size)); err != nil {
+				return nil, err
+			}
+			if p, err = l.virsh(uri, "vol-path", "--pool", pool, volume); err != nil {
+				return nil, err
+			}
+		}
+		paths = append(paths, strings.TrimSpace(p))
+	}
+	return paths, nil
+}
+
+// Define the domain of m afresh on hypervisor and start it, the guest is
+// the domain's name
+func (l *libvirt) Boot(m *machine.Machine, vm machine.VmInstance, hypervisor string) (string, error) {
+	nics, err := vmNICs(m, vm)
+	if err != nil {
+		return m.Hostname, err
+	}
+	uri := vm.Libvirt.URI
+	if uri == "" {
+		uri = strings.Replace(l.config.URI, "{host}", hypervisor, -1)
+	}
+
+	state, err := l.virsh(uri, "domstate", m.Hostname)
+	if err == nil {
+		if strings.TrimSpace(state) != "shut off" {
+			if _, err := l.virsh(uri, "destroy", m.Hostname); err != nil {
+				return m.Hostname, err
+			}
+		}
+		if _, err := l.virsh(uri, "undefine", m.Hostname); err != nil {
+			return m.Hostname, err
+		}
+	} else if !strings.Contains(state, "failed to get domain") {
+		return m.Hostname, err
+	}
+
+	paths, err := l.volumes(uri, m, vm)
+	if err != nil {
+		return m.Hostname, err
+	}
+	domain, _ := xml.MarshalIndent(l.domain(m, vm, nics, paths), "", "  ")
+
+	f, err := ioutil.TempFile("", "waitron-domain")
+	if err != nil {
+		return m.Hostname, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(domain)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return m.Hostname, err
+	}
+
+	if _, err := l.virsh(uri, "define", f.Name()); err != nil {
+		return m.Hostname, err
+	}
+	_, err = l.virsh(uri, "start", m.Hostname)
+	return m.Hostname, err
+}
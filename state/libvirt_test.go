@@ -0,0 +1,99 @@
+package state
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestLibvirtBootVM(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-libvirt")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "kvm1.example.com.yaml"), []byte(`{"vm": [
+		{"hostname": "vm01", "domain": "example.com", "memory": 2048, "vcpu": 2,
+		 "interfaces": [{"name": "eth0", "vlan": 10}], "libvirt": {"disks": [32]}}]}`), 0644)
+	config := configpkg.Config{VmPath: dir}
+
+	var calls []string
+	var defined libvirtDomain
+	domstate := "error: failed to get domain 'vm01.example.com'"
+	volumes := make(map[string]bool)
+	l := NewLibvirt(configpkg.LibvirtConfig{})
+	l.virsh = func(uri string, args ...string) (string, error) {
+		if uri != "qemu+ssh://root@kvm1.example.com/system" {
+			t.Errorf("unexpected uri %s", uri)
+		}
+		calls = append(calls, args[0])
+		switch args[0] {
+		case "domstate":
+			if strings.HasPrefix(domstate, "error") {
+				return domstate, fmt.Errorf("virsh domstate: %s", domstate)
+			}
+			return domstate + "\n", nil
+		case "vol-path":
+			if !volumes[args[3]] {
+				return "error: failed to get vol", fmt.Errorf("virsh vol-path: no volume")
+			}
+			return "/var/lib/libvirt/images/" + args[3] + "\n", nil
+		case "vol-create-as":
+			if args[1] != "default" || args[3] != "32G" {
+				t.Errorf("unexpected volume %v", args)
+			}
+			volumes[args[2]] = true
+		case "define":
+			data, _ := ioutil.ReadFile(args[1])
+			if err := xml.Unmarshal(data, &defined); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return "", nil
+	}
+	state := New()
+	state.VMs = l
+	m := &machine.Machine{Hostname: "vm01.example.com", Network: []machine.Interface{{Name: "eth0", MacAddress: "DE:AD:BE:EF:00:01"}}}
+
+	if err := state.bootVM(m, config); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(calls, ", ") != "domstate, vol-path, vol-create-as, vol-path, define, start" {
+		t.Errorf("unexpected calls %v", calls)
+	}
+	d := defined
+	if d.Name != "vm01.example.com" || d.Memory.Value != 2048 || d.Memory.Unit != "MiB" || d.VCPU != 2 ||
+		len(d.OS.Boot) != 2 || d.OS.Boot[0].Dev != "network" || d.OS.Boot[1].Dev != "hd" {
+		t.Errorf("unexpected domain %+v", d)
+	}
+	if len(d.Devices.Disks) != 1 || d.Devices.Disks[0].Source.File != "/var/lib/libvirt/images/vm01.example.com-0" || d.Devices.Disks[0].Target.Dev != "vda" {
+		t.Errorf("unexpected disks %+v", d.Devices.Disks)
+	}
+	if i := d.Devices.Interfaces; len(i) != 1 || i[0].MAC.Address != "de:ad:be:ef:00:01" || i[0].Source.Bridge != "br0" ||
+		i[0].Vlan.Tag.ID != 10 || i[0].VirtualPort.Type != "openvswitch" {
+		t.Errorf("unexpected interfaces %+v", i)
+	}
+
+	// A running domain is recreated and keeps its disk
+	calls = nil
+	domstate = "running"
+	if err := state.bootVM(m, config); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(calls, ", ") != "domstate, destroy, undefine, vol-path, define, start" {
+		t.Errorf("unexpected calls %v", calls)
+	}
+
+	domstate = "error: failed to connect to the hypervisor"
+	if err := state.bootVM(m, config); err == nil || !strings.Contains(err.Error(), "failed to connect") {
+		t.Errorf("expected the connection error, got %v", err)
+	}
+
+	if _, err := NewVMDriver(configpkg.Config{Proxmox: &configpkg.ProxmoxConfig{URL: "https://pve1:8006"}, Libvirt: &configpkg.LibvirtConfig{}}); err == nil {
+		t.Error("expected only one vm driver to be allowed")
+	}
+}
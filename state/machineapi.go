@@ -0,0 +1,17 @@
+package state
+
+import (
+	"regexp"
+)
+
+var ValidHostname = regexp.MustCompile(`^[a-z0-9]([a-z0-9_-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9_-]*[a-z0-9])?)*$`)
+
+// Definitions changed, drop what was derived from them
+func (state *State) DefinitionChanged(hostname string) {
+	if state.Inventory != nil {
+		if err := state.Inventory.Refresh(); err != nil {
+			logger.Error("cannot index machines", "error", err)
+		}
+	}
+	state.RenderCache.Invalidate(hostname)
+}
@@ -0,0 +1,12 @@
+package state
+
+import (
+	"github.com/ns1/waitron/machine"
+)
+
+// The build of hostname in progress, nil when there is none
+func (state *State) BuildInProgress(hostname string) *machine.Machine {
+	state.Mux.Lock()
+	defer state.Mux.Unlock()
+	return state.MachineByHostname[hostname]
+}
@@ -0,0 +1,63 @@
+package state
+
+import (
+	"net"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func machineHasAddress(m *machine.Machine, ip net.IP) bool {
+	if m.Lease != nil && ip.Equal(net.ParseIP(m.Lease.IPAddress)) {
+		return true
+	}
+	for _, i := range m.Network {
+		for _, a := range append(append([]machine.IPConfig(nil), i.Addresses4...), i.Addresses6...) {
+			if ip.Equal(net.ParseIP(a.IPAddress)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// The machine with address ip and whether it is being built, nil when no
+// machine has it. A machine being built is a snapshot, the build itself keeps
+// changing.
+func (state *State) MachineByAddress(ip net.IP, config config.Config) (*machine.Machine, bool, error) {
+	state.Mux.Lock()
+	for _, m := range state.MachineByHostname {
+		if machineHasAddress(m, ip) {
+			snapshot := *m
+			state.Mux.Unlock()
+			return &snapshot, true, nil
+		}
+	}
+	state.Mux.Unlock()
+
+	inv, err := state.InventoryFor(config)
+	if err != nil {
+		return nil, false, err
+	}
+	var hostname string
+	if e, found := inv.LookupIP(ip); found {
+		hostname = e.Hostname
+	} else if state.IPAM != nil {
+		a, found, err := state.IPAM.lookup(ip)
+		if err != nil {
+			return nil, false, err
+		}
+		if found {
+			hostname = a.Hostname
+		}
+	}
+	if hostname == "" {
+		return nil, false, nil
+	}
+
+	m, err := machine.MachineDefinition(hostname, config.MachinePath, config)
+	if err != nil {
+		return nil, false, err
+	}
+	return &m, false, nil
+}
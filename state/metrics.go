@@ -0,0 +1,184 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// The metric set, in one place so every sink reports the same thing:
+//
+//	builds.started, builds.completed, builds.cancelled, builds.failed,
+//	builds.stale, builds.retried  counters, tagged with the machine's os and group
+//	builds.duration     timing from token issued to done
+//	builds.duration.p50, builds.duration.p95  gauges in seconds, tagged like
+//	                    the counters, over the last builds, see buildstats.go
+//	builds.in_progress  gauge
+//	hooks.failed, hooks.timeout, hooks.dead_lettered  counters
+//	hooks.queued        gauge of jobs waiting on the worker pool
+//	http.requests       counter tagged with method and status
+//	http.duration       timing tagged with method and status
+
+// How often gauges are reported
+const metricsGaugeInterval = 10 * time.Second
+
+type MetricTag struct {
+	Name  string
+	Value string
+}
+
+// MetricSink receives metrics, e.g. to send them to statsd
+type MetricSink interface {
+	Count(name string, value int64, tags ...MetricTag)
+	Gauge(name string, value float64, tags ...MetricTag)
+	Timing(name string, d time.Duration, tags ...MetricTag)
+}
+
+var eventCounters = map[string]string{
+	machine.EventBuildStarted:    "builds.started",
+	machine.EventBuildCompleted:  "builds.completed",
+	machine.EventBuildCancelled:  "builds.cancelled",
+	machine.EventBuildFailed:     "builds.failed",
+	machine.EventBuildStale:      "builds.stale",
+	machine.EventBuildRetried:    "builds.retried",
+	machine.EventBuildOverdue:    "builds.overdue",
+	machine.EventFirmwareUpdated: "builds.firmware_updated",
+	machine.EventRAIDConfigured:  "builds.raid_configured",
+	machine.EventBurnInPassed:    "builds.burn_in_passed",
+	machine.EventDisksWiped:      "builds.disks_wiped",
+	machine.EventBulkBuildPaused: "bulk_builds.paused",
+	machine.EventHookFailed:      "hooks.failed",
+	machine.EventHookTimeout:     "hooks.timeout",
+	machine.EventHookDeadLetter:  "hooks.dead_lettered",
+}
+
+func machineTags(m *machine.Machine) []MetricTag {
+	if m == nil {
+		return nil
+	}
+	return osGroupTags(m.OperatingSystem, m.Domain)
+}
+
+func osGroupTags(os string, group string) []MetricTag {
+	var tags []MetricTag
+	if os != "" {
+		tags = append(tags, MetricTag{"os", os})
+	}
+	if group != "" {
+		tags = append(tags, MetricTag{"group", group})
+	}
+	return tags
+}
+
+// Feed sink from the event bus and report gauges periodically
+func StartMetrics(sink MetricSink, state *State) {
+	state.Events.Subscribe(func(e Event) {
+		if name, found := eventCounters[e.Type]; found {
+			sink.Count(name, 1, machineTags(e.Machine)...)
+		}
+		if e.Type == machine.EventBuildCompleted && e.Machine != nil && !e.Machine.BuildStart.IsZero() {
+			sink.Timing("builds.duration", e.Timestamp.Sub(e.Machine.BuildStart), machineTags(e.Machine)...)
+		}
+	})
+
+	go func() {
+		ticker := time.NewTicker(metricsGaugeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-state.Stopped():
+				return
+			case <-ticker.C:
+			}
+			state.Mux.Lock()
+			building := len(state.MachineByHostname)
+			tokens := len(state.Tokens)
+			state.Mux.Unlock()
+
+			sink.Gauge("builds.in_progress", float64(building))
+			sink.Gauge("state.tokens", float64(tokens))
+			sink.Gauge("hooks.queued", float64(state.Workers.Queued()))
+			state.Stats.report(sink)
+			state.Retention.report(sink)
+		}
+	}()
+}
+
+type StatusRecorder struct {
+	http.ResponseWriter
+	Status int
+	Size   int
+}
+
+func (r *StatusRecorder) WriteHeader(status int) {
+	r.Status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *StatusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.Size += n
+	return n, err
+}
+
+// Metrics are sent over UDP as they happen, a lost packet is a lost data point
+type statsdSink struct {
+	config config.StatsdConfig
+	mux    sync.Mutex
+	conn   net.Conn
+}
+
+func NewStatsdSink(config config.StatsdConfig) (*statsdSink, error) {
+	if config.Address == "" {
+		config.Address = "127.0.0.1:8125"
+	}
+	if config.Prefix == "" {
+		config.Prefix = "waitron."
+	}
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &statsdSink{config: config, conn: conn}, nil
+}
+
+// Characters that mean something in the statsd line protocol
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", ",", "_", "#", "_", " ", "_")
+
+func (s *statsdSink) send(name string, value string, kind string, tags []MetricTag) {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s%s:%s|%s", s.config.Prefix, statsdReplacer.Replace(name), value, kind)
+	if s.config.DogStatsd && len(tags) > 0 {
+		buf.WriteString("|#")
+		for i, t := range tags {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(&buf, "%s:%s", statsdReplacer.Replace(t.Name), statsdReplacer.Replace(t.Value))
+		}
+	}
+
+	s.mux.Lock()
+	s.conn.Write(buf.Bytes())
+	s.mux.Unlock()
+}
+
+func (s *statsdSink) Count(name string, value int64, tags ...MetricTag) {
+	s.send(name, strconv.FormatInt(value, 10), "c", tags)
+}
+
+func (s *statsdSink) Gauge(name string, value float64, tags ...MetricTag) {
+	s.send(name, strconv.FormatFloat(value, 'f', -1, 64), "g", tags)
+}
+
+func (s *statsdSink) Timing(name string, d time.Duration, tags ...MetricTag) {
+	s.send(name, strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64), "ms", tags)
+}
@@ -0,0 +1,87 @@
+package state
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+type fakeMetricSink struct {
+	mux     sync.Mutex
+	counts  map[string]int64
+	timings map[string]int
+	tags    map[string][]MetricTag
+}
+
+func newFakeMetricSink() *fakeMetricSink {
+	return &fakeMetricSink{counts: map[string]int64{}, timings: map[string]int{}, tags: map[string][]MetricTag{}}
+}
+
+func (s *fakeMetricSink) Count(name string, value int64, tags ...MetricTag) {
+	s.mux.Lock()
+	s.counts[name] += value
+	s.tags[name] = tags
+	s.mux.Unlock()
+}
+
+func (s *fakeMetricSink) Gauge(name string, value float64, tags ...MetricTag) {}
+
+func (s *fakeMetricSink) Timing(name string, d time.Duration, tags ...MetricTag) {
+	s.mux.Lock()
+	s.timings[name]++
+	s.mux.Unlock()
+}
+
+func TestMetricsFromEvents(t *testing.T) {
+	sink := newFakeMetricSink()
+	state := New()
+	StartMetrics(sink, state)
+
+	m := &machine.Machine{Hostname: "dns02.example.com", Domain: "example.com", BuildStart: time.Now().Add(-time.Minute)}
+	m.OperatingSystem = "ubuntu"
+	state.Emit(machine.EventBuildStarted, m, "")
+	state.Emit(machine.EventBuildCompleted, m, "")
+
+	if sink.counts["builds.started"] != 1 || sink.counts["builds.completed"] != 1 {
+		t.Errorf("unexpected counts %v", sink.counts)
+	}
+	if sink.timings["builds.duration"] != 1 {
+		t.Errorf("expected a build duration, got %v", sink.timings)
+	}
+	if tags := sink.tags["builds.completed"]; len(tags) != 2 || tags[0].Value != "ubuntu" || tags[1].Value != "example.com" {
+		t.Errorf("unexpected tags %v", tags)
+	}
+}
+
+func TestStatsdSink(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := NewStatsdSink(config.StatsdConfig{Address: conn.LocalAddr().String(), DogStatsd: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	sink.Count("builds.started", 1, MetricTag{"os", "ubuntu"}, MetricTag{"group", "example.com"})
+	sink.Timing("builds.duration", 1500*time.Millisecond)
+
+	expected := []string{"waitron.builds.started:1|c|#os:ubuntu,group:example.com", "waitron.builds.duration:1500|ms"}
+	buf := make([]byte, 1024)
+	for _, e := range expected {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("expected %q: %s", e, err)
+		}
+		if string(buf[:n]) != e {
+			t.Errorf("expected %q, got %q", e, buf[:n])
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ns1/waitron/config"
+)
+
+// Just enough MQTT 3.1.1 to publish at QoS 1, see
+// http://docs.oasis-open.org/mqtt/mqtt/v3.1.1/mqtt-v3.1.1.html
+// Every event for a machine goes to its own topic as a retained message, so
+// a client subscribing later still gets the machine's last state.
+
+const defaultMQTTTopic = "waitron/{{ Hostname }}"
+
+const mqttKeepAlive = 60
+
+const (
+	mqttConnect = 0x10
+	mqttConnack = 0x20
+	mqttPublish = 0x30
+	mqttPuback  = 0x40
+)
+
+type mqttPublisher struct {
+	config   config.NotifierConfig
+	server   *url.URL
+	clientID string
+
+	mux      sync.Mutex
+	conn     net.Conn
+	r        *bufio.Reader
+	packetID uint16
+}
+
+func newMQTTPublisher(nc config.NotifierConfig) (Notifier, error) {
+	if nc.URL == "" {
+		nc.URL = "mqtt://127.0.0.1:1883"
+	}
+	if nc.Topic == "" {
+		nc.Topic = defaultMQTTTopic
+	}
+
+	u, err := url.Parse(nc.URL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "mqtt":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "1883")
+		}
+	case "mqtts":
+		if u.Port() == "" {
+			u.Host = net.JoinHostPort(u.Hostname(), "8883")
+		}
+	default:
+		return nil, fmt.Errorf("notifier %s url must be mqtt:// or mqtts://", nc)
+	}
+
+	host, _ := os.Hostname()
+	return &mqttPublisher{config: nc, server: u, clientID: "waitron-" + host}, nil
+}
+
+func mqttString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+func mqttPacket(packetType byte, body []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(packetType)
+
+	// Remaining length, 7 bits at a time
+	n := len(body)
+	for {
+		b := byte(n % 128)
+		if n /= 128; n > 0 {
+			b |= 0x80
+		}
+		buf.WriteByte(b)
+		if n == 0 {
+			break
+		}
+	}
+
+	buf.Write(body)
+	return buf.Bytes()
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	packetType, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	n, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed MQTT packet length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, n)
+	_, err = io.ReadFull(r, body)
+	return packetType, body, err
+}
+
+func (p *mqttPublisher) connect() error {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: notifierTimeout}
+	if p.server.Scheme == "mqtts" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.server.Host, &tls.Config{ServerName: p.server.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", p.server.Host)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(notifierTimeout))
+
+	var body bytes.Buffer
+	mqttString(&body, "MQTT")
+	body.WriteByte(4) // protocol level 3.1.1
+
+	flags := byte(0x02) // clean session
+	var user, pass string
+	if p.server.User != nil {
+		user = p.server.User.Username()
+		pass, _ = p.server.User.Password()
+		flags |= 0x80
+		if pass != "" {
+			flags |= 0x40
+		}
+	}
+	body.WriteByte(flags)
+	binary.Write(&body, binary.BigEndian, uint16(mqttKeepAlive))
+
+	mqttString(&body, p.clientID)
+	if flags&0x80 != 0 {
+		mqttString(&body, user)
+	}
+	if flags&0x40 != 0 {
+		mqttString(&body, pass)
+	}
+
+	if _, err := conn.Write(mqttPacket(mqttConnect, body.Bytes())); err != nil {
+		conn.Close()
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	packetType, ack, err := readMQTTPacket(r)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if packetType&0xf0 != mqttConnack || len(ack) != 2 {
+		conn.Close()
+		return fmt.Errorf("unexpected reply to CONNECT from %s", p.server.Host)
+	}
+	if ack[1] != 0 {
+		conn.Close()
+		return fmt.Errorf("%s refused the connection, return code %d", p.server.Host, ack[1])
+	}
+
+	p.conn, p.r = conn, r
+	return nil
+}
+
+func (p *mqttPublisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn, p.r = nil, nil
+	}
+}
+
+// Publish a retained message at QoS 1 and wait for the PUBACK
+func (p *mqttPublisher) publish(topic string, payload []byte) error {
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	p.conn.SetDeadline(time.Now().Add(notifierTimeout))
+
+	if p.packetID++; p.packetID == 0 {
+		p.packetID = 1
+	}
+
+	var body bytes.Buffer
+	mqttString(&body, topic)
+	binary.Write(&body, binary.BigEndian, p.packetID)
+	body.Write(payload)
+
+	if _, err := p.conn.Write(mqttPacket(mqttPublish|0x02|0x01, body.Bytes())); err != nil {
+		return err
+	}
+
+	for {
+		packetType, ack, err := readMQTTPacket(p.r)
+		if err != nil {
+			return err
+		}
+		if packetType&0xf0 == mqttPuback && len(ack) == 2 && binary.BigEndian.Uint16(ack) == p.packetID {
+			return nil
+		}
+	}
+}
+
+func (p *mqttPublisher) Notify(e Event) error {
+	topic, err := renderNotification(p.config.Topic, e)
+	if err != nil {
+		return err
+	}
+	if topic == "" {
+		return fmt.Errorf("empty MQTT topic for %s event", e.Type)
+	}
+
+	payload, err := marshalEvent(e)
+	if err != nil {
+		return err
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	// The broker drops clients that stay quiet for longer than the keep
+	// alive, so retry once on a fresh connection.
+	if err = p.publish(topic, payload); err != nil {
+		p.close()
+		if err = p.publish(topic, payload); err != nil {
+			p.close()
+		}
+	}
+	return err
+}
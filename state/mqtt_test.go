@@ -0,0 +1,86 @@
+package state
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+type mqttMessage struct {
+	retained bool
+	topic    string
+	payload  []byte
+}
+
+// Accepts one client, acks its CONNECT and PUBLISH and hands back the message
+func fakeMQTTBroker(t *testing.T) (string, chan mqttMessage) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan mqttMessage, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		for {
+			packetType, body, err := readMQTTPacket(r)
+			if err != nil {
+				return
+			}
+
+			switch packetType & 0xf0 {
+			case mqttConnect:
+				conn.Write(mqttPacket(mqttConnack, []byte{0, 0}))
+			case mqttPublish:
+				n := binary.BigEndian.Uint16(body)
+				topic := string(body[2 : 2+n])
+				id := body[2+n : 4+n]
+				conn.Write(mqttPacket(mqttPuback, id))
+				received <- mqttMessage{retained: packetType&0x01 != 0, topic: topic, payload: body[4+n:]}
+			}
+		}
+	}()
+
+	return "mqtt://" + l.Addr().String(), received
+}
+
+func TestMQTTPublisher(t *testing.T) {
+	addr, received := fakeMQTTBroker(t)
+
+	p, err := NewNotifier(config.NotifierConfig{Type: "mqtt", URL: addr})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := p.Notify(Event{Type: machine.EventBuildCompleted, Hostname: "dns02.example.com"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	msg := <-received
+	if msg.topic != "waitron/dns02.example.com" || !msg.retained {
+		t.Errorf("expected a retained message on the machine's topic, got %s retained=%v", msg.topic, msg.retained)
+	}
+
+	var e eventEnvelope
+	if err := json.Unmarshal(msg.payload, &e); err != nil || e.Type != machine.EventBuildCompleted {
+		t.Errorf("unexpected payload %s", msg.payload)
+	}
+}
+
+func TestMQTTPacketLength(t *testing.T) {
+	packet := mqttPacket(mqttPublish, make([]byte, 321))
+	if packet[1] != 0xc1 || packet[2] != 0x02 {
+		t.Errorf("unexpected remaining length encoding % x", packet[1:3])
+	}
+}
@@ -0,0 +1,126 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+type netboxIPAMDriver struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+type netboxIPAddress struct {
+	ID      int    `json:"id"`
+	Address string `json:"address"`
+}
+
+func newNetBoxIPAMDriver(config config.NetBoxIPAMConfig) *netboxIPAMDriver {
+	if config.URL == "" {
+		config.URL = os.Getenv("NETBOX_URL")
+	}
+	if config.Token == "" {
+		config.Token = os.Getenv("NETBOX_TOKEN")
+	}
+	return &netboxIPAMDriver{
+		url:    strings.TrimRight(config.URL, "/") + "/api/ipam",
+		token:  config.Token,
+		client: &http.Client{Timeout: ipamDriverTimeout},
+	}
+}
+
+func (d *netboxIPAMDriver) do(method string, path string, body interface{}, result interface{}) (int, error) {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	request, err := http.NewRequest(method, d.url+path, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	token, err := config.ResolveSecret(d.token)
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Authorization", "Token "+token)
+	request.Header.Set("Accept", "application/json")
+	request.Header.Set("Content-Type", "application/json")
+	response, err := d.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	data, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return response.StatusCode, err
+	}
+	if response.StatusCode/100 != 2 {
+		var e struct {
+			Detail string `json:"detail"`
+		}
+		if json.Unmarshal(data, &e) == nil && e.Detail != "" {
+			return response.StatusCode, fmt.Errorf("netbox %s %s: %s", method, path, e.Detail)
+		}
+		return response.StatusCode, fmt.Errorf("netbox %s %s: %s", method, path, response.Status)
+	}
+	if result == nil {
+		return response.StatusCode, nil
+	}
+	return response.StatusCode, json.Unmarshal(data, result)
+}
+
+func (d *netboxIPAMDriver) reserve(p *ipPool, hostname string, iface string) (net.IP, string, error) {
+	var prefixes struct {
+		Results []struct {
+			ID int `json:"id"`
+		} `json:"results"`
+	}
+	if _, err := d.do("GET", "/prefixes/?prefix="+url.QueryEscape(p.network.String()), nil, &prefixes); err != nil {
+		return nil, "", err
+	}
+	if len(prefixes.Results) == 0 {
+		return nil, "", fmt.Errorf("no netbox prefix %s", p.network)
+	}
+
+	var address netboxIPAddress
+	if _, err := d.do("POST", "/prefixes/"+strconv.Itoa(prefixes.Results[0].ID)+"/available-ips/", map[string]string{
+		"status":      "reserved",
+		"dns_name":    hostname,
+		"description": "waitron " + iface,
+	}, &address); err != nil {
+		return nil, "", err
+	}
+	ip, _, err := net.ParseCIDR(address.Address)
+	if err != nil {
+		return nil, "", fmt.Errorf("netbox gave out %s, which isn't an address", address.Address)
+	}
+	return ip, strconv.Itoa(address.ID), nil
+}
+
+func (d *netboxIPAMDriver) keep(a machine.IPAllocation) error {
+	_, err := d.do("PATCH", "/ip-addresses/"+a.ExternalID+"/", map[string]string{"status": "active"}, nil)
+	return err
+}
+
+func (d *netboxIPAMDriver) free(a machine.IPAllocation) error {
+	if a.ExternalID == "" {
+		return nil
+	}
+	code, err := d.do("DELETE", "/ip-addresses/"+a.ExternalID+"/", nil, nil)
+	if code == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
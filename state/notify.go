@@ -0,0 +1,329 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// How many events a notifier can fall behind before new ones are dropped
+const notifierQueueSize = 100
+
+const notifierTimeout = 10 * time.Second
+
+// Notifier tells people about build events
+type Notifier interface {
+	Notify(e Event) error
+}
+
+func NewNotifier(nc config.NotifierConfig) (Notifier, error) {
+	switch nc.Type {
+	case "slack", "mattermost":
+		if nc.URL == "" {
+			return nil, fmt.Errorf("notifier %s needs a url", nc)
+		}
+		return &slackNotifier{config: nc, client: &http.Client{Timeout: notifierTimeout}}, nil
+	case "webhook":
+		if nc.URL == "" {
+			return nil, fmt.Errorf("notifier %s needs a url", nc)
+		}
+		return &webhookNotifier{config: nc, client: &http.Client{Timeout: notifierTimeout}}, nil
+	case "pagerduty", "opsgenie":
+		return newAlertNotifier(nc)
+	case "nats":
+		return newNATSPublisher(nc)
+	case "kafka":
+		return newKafkaPublisher(nc)
+	case "mqtt":
+		return newMQTTPublisher(nc)
+	case "redis":
+		return newRedisPublisher(nc)
+	case "email":
+		if nc.SMTPServer == "" || nc.From == "" {
+			return nil, fmt.Errorf("notifier %s needs smtp_server and from", nc)
+		}
+		return &emailNotifier{config: nc}, nil
+	}
+	return nil, fmt.Errorf("notifier %s has unknown type %q", nc, nc.Type)
+}
+
+var defaultNotifyTemplates = map[string]string{
+	machine.EventBuildStarted:    "Build started for {{ Hostname }}",
+	machine.EventBuildCompleted:  "Build completed for {{ Hostname }}",
+	machine.EventBuildCancelled:  "Build cancelled for {{ Hostname }}",
+	machine.EventBuildFailed:     "Build failed for {{ Hostname }}: {{ Message }}",
+	machine.EventBuildStale:      "Build for {{ Hostname }} is stale, started {{ machine.BuildStart }}",
+	machine.EventBuildRetried:    "Retrying the build of {{ Hostname }}, {{ Message }}",
+	machine.EventFirmwareUpdated: "Firmware updated on {{ Hostname }}",
+	machine.EventRAIDConfigured:  "RAID configured on {{ Hostname }}",
+	machine.EventBurnInPassed:    "Burn-in passed for {{ Hostname }}",
+	machine.EventDisksWiped:      "Disks of {{ Hostname }} wiped",
+	machine.EventBuildOverdue:    "Build for {{ Hostname }} is taking longer than usual, {{ Message }}",
+	machine.EventBulkBuildPaused: "Bulk build paused, {{ Message }}",
+}
+
+const defaultNotifySubject = "[waitron] {{ Type }} {{ Hostname }}"
+
+func wants(nc config.NotifierConfig, eventType string) bool {
+	if len(nc.Events) == 0 {
+		if isPublisher(nc.Type) {
+			return true
+		}
+		if isAlertNotifier(nc.Type) {
+			return alertTriggers[eventType] || alertResolves[eventType]
+		}
+		_, found := defaultNotifyTemplates[eventType]
+		return found
+	}
+	for _, t := range nc.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Render the message for e from the notifier's template for its type
+func message(nc config.NotifierConfig, e Event) (string, error) {
+	tpl, found := nc.Templates[e.Type]
+	if !found {
+		if tpl, found = defaultNotifyTemplates[e.Type]; !found {
+			tpl = "{{ Type }} {{ Hostname }} {{ Message }}"
+		}
+	}
+	return renderNotification(tpl, e)
+}
+
+func subject(nc config.NotifierConfig, e Event) (string, error) {
+	tpl, found := nc.Subjects[e.Type]
+	if !found {
+		tpl = defaultNotifySubject
+	}
+	return renderNotification(tpl, e)
+}
+
+func renderNotification(tpl string, e Event) (string, error) {
+	t, err := pongo2.FromString(tpl)
+	if err != nil {
+		return "", err
+	}
+	return t.Execute(notifyContext(e))
+}
+
+func notifyContext(e Event) pongo2.Context {
+	return pongo2.Context{
+		"event":    e,
+		"machine":  e.Machine,
+		"Type":     e.Type,
+		"Hostname": e.Hostname,
+		"Token":    e.Token,
+		"Message":  e.Message,
+	}
+}
+
+// Slack incoming webhooks; Mattermost accepts the same payload
+type slackNotifier struct {
+	config config.NotifierConfig
+	client *http.Client
+}
+
+type slackMessage struct {
+	Text     string `json:"text"`
+	Channel  string `json:"channel,omitempty"`
+	Username string `json:"username,omitempty"`
+}
+
+func (n *slackNotifier) Notify(e Event) error {
+	text, err := message(n.config, e)
+	if err != nil {
+		return err
+	}
+
+	body, err := json.Marshal(slackMessage{Text: text, Channel: n.config.Channel, Username: n.config.Username})
+	if err != nil {
+		return err
+	}
+
+	resp, err := n.client.Post(n.config.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", n.config, resp.Status)
+	}
+	return nil
+}
+
+// Any HTTP endpoint, e.g. a ticketing system or an internal event bus
+type webhookNotifier struct {
+	config config.NotifierConfig
+	client *http.Client
+}
+
+func (n *webhookNotifier) body(e Event) ([]byte, error) {
+	tpl, found := n.config.Templates[e.Type]
+	if !found {
+		tpl = n.config.Body
+	}
+	if tpl == "" {
+		return json.Marshal(webhookEvent{Event: e, Machine: e.Machine})
+	}
+
+	body, err := renderNotification(tpl, e)
+	return []byte(body), err
+}
+
+// The default payload, Event leaves the machine out of its JSON
+type webhookEvent struct {
+	Event
+	Machine *machine.Machine `json:",omitempty"`
+}
+
+func (n *webhookNotifier) Notify(e Event) error {
+	url, err := renderNotification(n.config.URL, e)
+	if err != nil {
+		return err
+	}
+	body, err := n.body(e)
+	if err != nil {
+		return err
+	}
+
+	method := n.config.Method
+	if method == "" {
+		method = "POST"
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range n.config.Headers {
+		rendered, err := renderNotification(v, e)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(k, rendered)
+	}
+
+	if req.Header.Get("Content-Type") == "application/json" && !json.Valid(body) {
+		return fmt.Errorf("%s event body for %s is not valid JSON: %s", e.Type, e.Hostname, body)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", n.config, resp.Status)
+	}
+	return nil
+}
+
+type emailNotifier struct {
+	config config.NotifierConfig
+}
+
+func (n *emailNotifier) recipients(e Event) []string {
+	to := append([]string(nil), n.config.To...)
+	if e.Machine != nil {
+		to = append(to, e.Machine.NotifyEmail...)
+	}
+	return to
+}
+
+func (n *emailNotifier) Notify(e Event) error {
+	to := n.recipients(e)
+	if len(to) == 0 {
+		return nil
+	}
+
+	subject, err := subject(n.config, e)
+	if err != nil {
+		return err
+	}
+	body, err := message(n.config, e)
+	if err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", n.config.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", e.Timestamp.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(body)
+
+	var auth smtp.Auth
+	if n.config.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(n.config.SMTPServer)
+		auth = smtp.PlainAuth("", n.config.SMTPUsername, n.config.SMTPPassword, host)
+	}
+
+	return smtp.SendMail(n.config.SMTPServer, auth, n.config.From, to, msg.Bytes())
+}
+
+// Each notifier gets its own queue so a slow one doesn't hold up the others
+// or the event bus. Stale builds are checked over and over, they are only
+// notified once per build.
+func StartNotifiers(configs []config.NotifierConfig, state *State) error {
+	for _, nc := range configs {
+		n, err := NewNotifier(nc)
+		if err != nil {
+			return err
+		}
+
+		nc := nc
+		queue := make(chan Event, notifierQueueSize)
+		go func() {
+			for e := range queue {
+				if err := n.Notify(e); err != nil {
+					logger.Error("notification failed", "notifier", nc, "type", e.Type, "hostname", e.Hostname, "error", err)
+				}
+			}
+		}()
+
+		var mux sync.Mutex
+		stale := map[string]bool{}
+		state.Events.Subscribe(func(e Event) {
+			mux.Lock()
+			seen := stale[e.Token]
+			switch e.Type {
+			case machine.EventBuildStale:
+				stale[e.Token] = true
+			case machine.EventBuildCompleted, machine.EventBuildCancelled:
+				delete(stale, e.Token)
+			}
+			mux.Unlock()
+
+			if !wants(nc, e.Type) || (e.Type == machine.EventBuildStale && seen) {
+				return
+			}
+
+			select {
+			case queue <- e:
+			default:
+				logger.Warn("notifier is falling behind, dropping event", "notifier", nc, "type", e.Type, "hostname", e.Hostname)
+			}
+		})
+	}
+	return nil
+}
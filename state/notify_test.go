@@ -0,0 +1,204 @@
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestNewNotifier(t *testing.T) {
+	if _, err := NewNotifier(config.NotifierConfig{Type: "slack"}); err == nil {
+		t.Errorf("expected a slack notifier without a url to fail")
+	}
+	if _, err := NewNotifier(config.NotifierConfig{Type: "carrier-pigeon"}); err == nil {
+		t.Errorf("expected an unknown notifier type to fail")
+	}
+	if _, err := NewNotifier(config.NotifierConfig{Type: "mattermost", URL: "http://chat.example.com/hooks/x"}); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestNotifierWants(t *testing.T) {
+	all := config.NotifierConfig{}
+	if !wants(all, machine.EventBuildStale) || wants(all, machine.EventHookTimeout) {
+		t.Errorf("expected the default to be all build events")
+	}
+
+	some := config.NotifierConfig{Events: []string{machine.EventBuildFailed}}
+	if !wants(some, machine.EventBuildFailed) || wants(some, machine.EventBuildStarted) {
+		t.Errorf("expected only the listed events")
+	}
+}
+
+func TestSlackNotifier(t *testing.T) {
+	received := make(chan slackMessage, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		var msg slackMessage
+		json.NewDecoder(request.Body).Decode(&msg)
+		received <- msg
+	}))
+	defer ts.Close()
+
+	state := New()
+	err := StartNotifiers([]config.NotifierConfig{{
+		Type:      "slack",
+		URL:       ts.URL,
+		Channel:   "#oncall",
+		Templates: map[string]string{machine.EventBuildStale: "{{ Hostname }} is stuck"},
+	}}, state)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	m := &machine.Machine{Hostname: "dns02.example.com", Token: "token"}
+	state.Emit(machine.EventBuildStale, m, "")
+	state.Emit(machine.EventBuildStale, m, "")
+	state.Emit(machine.EventHookTimeout, m, "")
+
+	select {
+	case msg := <-received:
+		if msg.Text != "dns02.example.com is stuck" || msg.Channel != "#oncall" {
+			t.Errorf("unexpected message %+v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected a notification")
+	}
+
+	select {
+	case msg := <-received:
+		t.Errorf("expected a stale build to be notified once, also got %+v", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestEmailRecipients(t *testing.T) {
+	n := &emailNotifier{config: config.NotifierConfig{To: []string{"ops@example.com"}}}
+	m := &machine.Machine{Config: config.Config{NotifyEmail: []string{"owner@example.com"}}}
+
+	to := n.recipients(Event{Machine: m})
+	if strings.Join(to, ",") != "ops@example.com,owner@example.com" {
+		t.Errorf("unexpected recipients %v", to)
+	}
+	if n.config.To[0] != "ops@example.com" || len(n.config.To) != 1 {
+		t.Errorf("recipients should not change the notifier config, got %v", n.config.To)
+	}
+}
+
+// Just enough SMTP to accept one message
+func fakeSMTPServer(t *testing.T) (string, chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan []string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		r := bufio.NewReader(conn)
+		conn.Write([]byte("220 localhost\r\n"))
+
+		var lines []string
+		data := false
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimRight(line, "\r\n")
+
+			if data {
+				if line == "." {
+					data = false
+					received <- lines
+					conn.Write([]byte("250 OK\r\n"))
+				} else {
+					lines = append(lines, line)
+				}
+				continue
+			}
+
+			switch {
+			case strings.HasPrefix(line, "DATA"):
+				data = true
+				conn.Write([]byte("354 go ahead\r\n"))
+			case strings.HasPrefix(line, "QUIT"):
+				conn.Write([]byte("221 bye\r\n"))
+				return
+			default:
+				lines = append(lines, line)
+				conn.Write([]byte("250 OK\r\n"))
+			}
+		}
+	}()
+
+	return l.Addr().String(), received
+}
+
+func TestEmailNotifier(t *testing.T) {
+	addr, received := fakeSMTPServer(t)
+
+	n, err := NewNotifier(config.NotifierConfig{Type: "email", SMTPServer: addr, From: "waitron@example.com", To: []string{"ops@example.com"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	m := &machine.Machine{Hostname: "dns02.example.com", Config: config.Config{NotifyEmail: []string{"owner@example.com"}}}
+	if err := n.Notify(Event{Type: machine.EventBuildCompleted, Hostname: m.Hostname, Machine: m, Timestamp: time.Now()}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	lines := strings.Join(<-received, "\n")
+	for _, expected := range []string{"RCPT TO:<ops@example.com>", "RCPT TO:<owner@example.com>", "From: waitron@example.com"} {
+		if !strings.Contains(lines, expected) {
+			t.Errorf("expected %q in\n%s", expected, lines)
+		}
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	var body map[string]interface{}
+	var auth string
+	ts := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		auth = request.Header.Get("Authorization")
+		json.NewDecoder(request.Body).Decode(&body)
+	}))
+	defer ts.Close()
+
+	n, err := NewNotifier(config.NotifierConfig{Type: "webhook", URL: ts.URL, Headers: map[string]string{"Authorization": "Bearer secret"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	m := &machine.Machine{Hostname: "dns02.example.com"}
+	if err := n.Notify(Event{Type: machine.EventBuildFailed, Hostname: m.Hostname, Machine: m}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if auth != "Bearer secret" {
+		t.Errorf("expected the configured header, got %q", auth)
+	}
+	if body["Type"] != machine.EventBuildFailed || body["Machine"] == nil {
+		t.Errorf("expected the event and machine as JSON, got %v", body)
+	}
+}
+
+func TestWebhookNotifierInvalidJSON(t *testing.T) {
+	n := &webhookNotifier{config: config.NotifierConfig{URL: "http://127.0.0.1:1", Body: `{"host": `}}
+	if err := n.Notify(Event{Type: machine.EventBuildFailed}); err == nil || !strings.Contains(err.Error(), "not valid JSON") {
+		t.Errorf("expected an invalid JSON body to fail, got %v", err)
+	}
+}
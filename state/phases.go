@@ -0,0 +1,58 @@
+package state
+
+import (
+	"time"
+
+	"github.com/ns1/waitron/machine"
+)
+
+const BuildsBucket = "builds"
+
+// Record a Waitron observed phase for a machine currently in build mode.
+func (state *State) RecordPhase(m *machine.Machine, name string) {
+	state.Mux.Lock()
+	m.AddPhase(name, false, "")
+	t := m.Advance(name)
+	state.Version++
+	state.Mux.Unlock()
+
+	state.emitTransition(m, t)
+}
+
+// Keep the record of a finished build in the store so its phases are still
+// available after the machine leaves build mode.
+func (state *State) saveBuildRecord(m *machine.Machine) {
+	if m.Token == "" {
+		return
+	}
+	if err := state.Store.Put(BuildsBucket, m.Token, m.BuildRecord()); err != nil {
+		logger.Machine(m).Error("cannot store build record", "error", err)
+	}
+}
+
+// Look up a build by token, in progress or finished.
+func (state *State) BuildByToken(token string) (*machine.BuildRecord, error) {
+	state.Mux.Lock()
+	m, found := state.MachineByUUID[token]
+	if found {
+		r := m.BuildRecord()
+		r.BuildEnd = time.Time{}
+		r.Phases = append([]machine.BuildPhase(nil), m.Phases...)
+		r.Transitions = append([]machine.StateTransition(nil), m.Transitions...)
+		r.HookResults = append([]machine.HookResult(nil), m.HookResults...)
+		r.Artifacts = append([]machine.ArtifactInfo(nil), m.Artifacts...)
+		state.Mux.Unlock()
+		return &r, nil
+	}
+	state.Mux.Unlock()
+
+	var r machine.BuildRecord
+	found, err := state.Store.Get(BuildsBucket, token, &r)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return state.Retention.fromHistory(token)
+	}
+	return &r, nil
+}
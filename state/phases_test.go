@@ -0,0 +1,42 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestBuildPhasesSurviveDone(t *testing.T) {
+	state := New()
+	m := &machine.Machine{Hostname: "dns02.example.com", Token: "token", Network: []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}}
+	state.MachineByUUID["token"] = m
+	state.MachineByHostname[m.Hostname] = m
+
+	state.RecordPhase(m, machine.PhaseBootServed)
+	if err := state.ReportProgress("token", machine.BuildProgress{Phase: "partitioning", Percent: 20}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := state.DoneBuildMode(*m, config.Config{}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	b, err := state.BuildByToken("token")
+	if err != nil || b == nil {
+		t.Fatalf("expected a build record, got %v, %v", b, err)
+	}
+
+	expected := []string{machine.PhaseBootServed, "partitioning", machine.PhaseDone}
+	if len(b.Phases) != len(expected) {
+		t.Fatalf("expected phases %v, got %+v", expected, b.Phases)
+	}
+	for i, name := range expected {
+		if b.Phases[i].Name != name {
+			t.Errorf("phase %d is %s, expected %s", i, b.Phases[i].Name, name)
+		}
+	}
+	if !b.Phases[1].Reported {
+		t.Errorf("installer reported phase should be marked as reported")
+	}
+}
@@ -0,0 +1,132 @@
+package state
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Addresses from phpIPAM's REST API, with an API app using an app code
+// token. Reserved addresses carry phpIPAM's Reserved tag until their build
+// is done and the Used tag after.
+
+const (
+	phpipamTagUsed     = 2
+	phpipamTagReserved = 3
+)
+
+type phpipamDriver struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+type phpipamResponse struct {
+	Success bool            `json:"success"`
+	Message string          `json:"message"`
+	ID      json.RawMessage `json:"id"`
+	Data    json.RawMessage `json:"data"`
+}
+
+func NewPHPIPAMDriver(config config.PHPIPAMConfig) *phpipamDriver {
+	if config.Token == "" {
+		config.Token = os.Getenv("PHPIPAM_TOKEN")
+	}
+	return &phpipamDriver{
+		url:    strings.TrimRight(config.URL, "/") + "/api/" + config.App,
+		token:  config.Token,
+		client: &http.Client{Timeout: ipamDriverTimeout},
+	}
+}
+
+// phpIPAM has ids as numbers or strings depending on its version
+func phpipamID(raw json.RawMessage) string {
+	return strings.Trim(string(raw), `"`)
+}
+
+func (d *phpipamDriver) do(method string, path string, body interface{}) (phpipamResponse, int, error) {
+	var r phpipamResponse
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	request, err := http.NewRequest(method, d.url+path, bytes.NewReader(data))
+	if err != nil {
+		return r, 0, err
+	}
+	token, err := config.ResolveSecret(d.token)
+	if err != nil {
+		return r, 0, err
+	}
+	request.Header.Set("token", token)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := d.client.Do(request)
+	if err != nil {
+		return r, 0, err
+	}
+	defer response.Body.Close()
+	data, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return r, response.StatusCode, err
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return r, response.StatusCode, fmt.Errorf("phpipam %s %s: %s", method, path, response.Status)
+	}
+	if !r.Success {
+		return r, response.StatusCode, fmt.Errorf("phpipam %s %s: %s", method, path, r.Message)
+	}
+	return r, response.StatusCode, nil
+}
+
+func (d *phpipamDriver) reserve(p *ipPool, hostname string, iface string) (net.IP, string, error) {
+	r, _, err := d.do("GET", "/subnets/cidr/"+p.network.String()+"/", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	var subnets []struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(r.Data, &subnets); err != nil || len(subnets) == 0 {
+		return nil, "", fmt.Errorf("no phpipam subnet %s", p.network)
+	}
+
+	r, _, err = d.do("POST", "/addresses/first_free/"+phpipamID(subnets[0].ID)+"/", map[string]interface{}{
+		"hostname":    hostname,
+		"description": "waitron " + iface,
+		"tag":         phpipamTagReserved,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	var address string
+	json.Unmarshal(r.Data, &address)
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, "", fmt.Errorf("phpipam gave out %s, which isn't an address", r.Data)
+	}
+	return ip, phpipamID(r.ID), nil
+}
+
+func (d *phpipamDriver) keep(a machine.IPAllocation) error {
+	_, _, err := d.do("PATCH", "/addresses/"+a.ExternalID+"/", map[string]interface{}{"tag": phpipamTagUsed})
+	return err
+}
+
+func (d *phpipamDriver) free(a machine.IPAllocation) error {
+	if a.ExternalID == "" {
+		return nil
+	}
+	_, code, err := d.do("DELETE", "/addresses/"+a.ExternalID+"/", nil)
+	if code == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
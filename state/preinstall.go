@@ -0,0 +1,130 @@
+package state
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Pre-install stages boot a machine into an image of their own before the
+// installer is served, in the order of machine.PreinstallStages, skipping those the
+// machine doesn't have. Each stage is a build state of its own. While the
+// build is in it, /v1/boot serves the stage's kernel, initrd and cmdline,
+// the cmdline being a template like the installer's. The image reports to
+// the stage's endpoint and reboots. A pass goes on to the next stage, or
+// once there are none, back to pending with the build's start time reset,
+// so the machine is served the installer when it boots again. A failure, or
+// no report within the stage's timeout, fails the build: the machine stops
+// being served a boot config, the failure hooks run and build-failed is
+// emitted. Builds that fail a stage aren't retried, they need a person.
+// Rescue builds skip the stages.
+
+var ErrNotInStage = errors.New("build is not in that stage")
+
+// Whether eventType is emitted when a build passes a stage
+func isStagePassed(eventType string) bool {
+	for _, stage := range machine.PreinstallStages {
+		if stage.PassedEvent == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Emit the move of m into stage and fail it if it doesn't report in time
+func (state *State) startStage(m *machine.Machine, config config.Config, stage *machine.PreinstallStage, t *machine.StateTransition) {
+	state.emitTransition(m, t)
+
+	state.Mux.Lock()
+	_, timeout, _ := stage.Image(m)
+	state.Mux.Unlock()
+	time.AfterFunc(timeout, func() {
+		state.FailStage(m, config, stage, fmt.Sprintf("no results within %s", timeout))
+	})
+}
+
+// Move the build of m on from stage, to the next stage it has or the install
+func (state *State) PassStage(m *machine.Machine, config config.Config, stage *machine.PreinstallStage, message string) error {
+	state.Mux.Lock()
+	if state.MachineByUUID[m.Token] != m || m.State != stage.State {
+		state.Mux.Unlock()
+		return ErrNotInStage
+	}
+	m.AddPhase(stage.Name+"-passed", true, message)
+	next := m.NextStage()
+	var t *machine.StateTransition
+	var err error
+	if next != nil {
+		t, err = m.EnterStage(next)
+	} else {
+		t, err = m.SetState(machine.BuildPending, stage.Name+" passed")
+		// The build proper starts now, as far as stale builds and ETAs go
+		m.BuildStart = time.Now()
+		m.ETA = state.Stats.estimate(m)
+	}
+	state.Version++
+	state.Mux.Unlock()
+
+	if err != nil {
+		logger.Machine(m).Warn("refused build state change", "error", err)
+	}
+	logger.Machine(m).Info(stage.Name+" passed", "message", message)
+	state.Emit(stage.PassedEvent, m, message)
+	if next != nil {
+		state.startStage(m, config, next, t)
+	} else {
+		state.emitTransition(m, t)
+	}
+	return nil
+}
+
+// Fail the build of m if it is still in stage
+func (state *State) FailStage(m *machine.Machine, config config.Config, stage *machine.PreinstallStage, message string) {
+	reason := stage.Name + " failed"
+	if message != "" {
+		reason += ": " + message
+	}
+
+	state.Mux.Lock()
+	if state.MachineByUUID[m.Token] != m || m.State != stage.State {
+		state.Mux.Unlock()
+		return
+	}
+	t, _ := m.SetState(machine.BuildFailed, reason)
+	// So it doesn't boot into the stage all over again
+	delete(state.MachineByMAC, m.Network[0].MacAddress)
+	m.AddPhase(stage.Name+"-failed", false, message)
+	state.Version++
+	state.Mux.Unlock()
+
+	logger.Machine(m).Error(stage.Name+" failed", "message", message)
+	state.emitTransition(m, t)
+	state.Emit(machine.EventBuildFailed, m, reason)
+	state.Workers.Submit(m.Hostname, func() {
+		if err := state.runWorkerHooks(machine.StageFailure, m, config); err != nil {
+			logger.With("stage", machine.StageFailure).Machine(m).Error("failure hooks failed", "error", err)
+		}
+	})
+}
+
+// The machine in stage for token, for recording what its image reported.
+// Callers must hold state.Mux.
+func (state *State) machineInStage(token string, stage *machine.PreinstallStage) (*machine.Machine, error) {
+	m, found := state.MachineByUUID[token]
+	if !found {
+		return nil, ErrUnknownBuild
+	}
+	if m.State != stage.State {
+		return nil, ErrNotInStage
+	}
+	return m, nil
+}
+
+// Reports whose body isn't JSON, or may be left out, decode themselves
+type RequestDecoder interface {
+	DecodeRequest(request *http.Request) error
+}
@@ -0,0 +1,53 @@
+package state
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ns1/waitron/machine"
+)
+
+// Keep the progress history of a single build from growing without bound if an
+// installer reports in a tight loop.
+const maxProgressHistory = 100
+
+var ErrUnknownBuild = errors.New("not in build mode or definition does not exist")
+
+// Record progress for the build identified by token.
+func (state *State) ReportProgress(token string, p machine.BuildProgress) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+
+	p.Timestamp = time.Now()
+
+	state.Mux.Lock()
+
+	m, found := state.MachineByUUID[token]
+	if !found {
+		state.Mux.Unlock()
+		return ErrUnknownBuild
+	}
+
+	// An installer that reports progress is installing, whatever it calls it
+	var t *machine.StateTransition
+	if m.State == machine.BuildPending || m.State == machine.BuildBooting {
+		t, _ = m.SetState(machine.BuildInstalling, "")
+	}
+
+	// A new phase name from the installer is also tracked as a build phase
+	if m.Progress == nil || m.Progress.Phase != p.Phase {
+		m.AddPhase(p.Phase, true, p.Message)
+	}
+
+	m.Progress = &p
+	m.ProgressHistory = append(m.ProgressHistory, p)
+	if len(m.ProgressHistory) > maxProgressHistory {
+		m.ProgressHistory = m.ProgressHistory[len(m.ProgressHistory)-maxProgressHistory:]
+	}
+	state.Version++
+	state.Mux.Unlock()
+
+	state.emitTransition(m, t)
+	return nil
+}
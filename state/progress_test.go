@@ -0,0 +1,42 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/ns1/waitron/machine"
+)
+
+func TestReportProgress(t *testing.T) {
+	state := New()
+	m := &machine.Machine{Hostname: "dns02.example.com"}
+	state.MachineByUUID["token"] = m
+
+	if err := state.ReportProgress("token", machine.BuildProgress{Phase: "partitioning", Percent: 10}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := state.ReportProgress("token", machine.BuildProgress{Phase: "packages", Percent: 50, Message: "installing"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if m.Progress == nil || m.Progress.Phase != "packages" || m.Progress.Percent != 50 {
+		t.Errorf("expected latest progress to be packages/50, got %+v", m.Progress)
+	}
+	if len(m.ProgressHistory) != 2 {
+		t.Errorf("expected 2 progress reports in history, got %d", len(m.ProgressHistory))
+	}
+}
+
+func TestReportProgressInvalid(t *testing.T) {
+	state := New()
+	state.MachineByUUID["token"] = &machine.Machine{}
+
+	if err := state.ReportProgress("token", machine.BuildProgress{Phase: "x", Percent: 101}); err == nil {
+		t.Errorf("expected an error for percent > 100")
+	}
+	if err := state.ReportProgress("token", machine.BuildProgress{Percent: 5}); err == nil {
+		t.Errorf("expected an error for a missing phase")
+	}
+	if err := state.ReportProgress("other", machine.BuildProgress{Phase: "x"}); err != ErrUnknownBuild {
+		t.Errorf("expected errUnknownBuild, got %v", err)
+	}
+}
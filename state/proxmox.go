@@ -0,0 +1,337 @@
+package state
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// The Proxmox VE driver for VMs, see vm.go. A VM runs on its proxmox.node,
+// the short name of the hypervisor its file is named after by default. A
+// guest that doesn't exist yet is created with its disks; an existing one is
+// stopped and gets the cores, memory and NICs of the definition, its disks
+// are left alone. NICs take their MAC address from the interface of the same
+// name in the machine definition and boot comes first from the network, so
+// the guest fetches its boot config from waitron while it is in build mode
+// and boots from its disk otherwise. The token needs VM.Allocate,
+// VM.Config.*, VM.PowerMgmt and, for new guests, Datastore.AllocateSpace.
+
+const (
+	proxmoxTimeout     = 30 * time.Second
+	proxmoxTaskTimeout = 5 * time.Minute
+
+	defaultProxmoxStorage = "local-lvm"
+	defaultProxmoxBridge  = "vmbr0"
+)
+
+type proxmox struct {
+	url     string
+	tokenID string
+	secret  string
+	storage string
+	bridge  string
+	client  *http.Client
+	// How often to check on a task
+	poll time.Duration
+}
+
+type proxmoxGuestStatus struct {
+	VMID   int    `json:"vmid"`
+	Name   string `json:"name"`
+	Status string `json:"status"`
+}
+
+func newProxmox(config config.ProxmoxConfig) (*proxmox, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("proxmox needs a url")
+	}
+	if config.TokenID == "" {
+		config.TokenID = os.Getenv("PROXMOX_TOKEN_ID")
+	}
+	if config.TokenSecret == "" {
+		config.TokenSecret = os.Getenv("PROXMOX_TOKEN_SECRET")
+	}
+	if config.Storage == "" {
+		config.Storage = defaultProxmoxStorage
+	}
+	if config.Bridge == "" {
+		config.Bridge = defaultProxmoxBridge
+	}
+
+	client := &http.Client{Timeout: proxmoxTimeout}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", config.CAFile)
+		}
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	return &proxmox{
+		url:     strings.TrimRight(config.URL, "/") + "/api2/json",
+		tokenID: config.TokenID,
+		secret:  config.TokenSecret,
+		storage: config.Storage,
+		bridge:  config.Bridge,
+		client:  client,
+		poll:    time.Second,
+	}, nil
+}
+
+// The API token as it is now
+func (p *proxmox) token() (string, error) {
+	id, err := config.ResolveSecret(p.tokenID)
+	if err != nil {
+		return "", err
+	}
+	secret, err := config.ResolveSecret(p.secret)
+	if err != nil {
+		return "", err
+	}
+	return "PVEAPIToken=" + id + "=" + secret, nil
+}
+
+// Call the API with form encoded params, result gets what is in data
+func (p *proxmox) do(method string, path string, params url.Values, result interface{}) error {
+	var body *strings.Reader
+	if params == nil {
+		body = strings.NewReader("")
+	} else {
+		body = strings.NewReader(params.Encode())
+	}
+	request, err := http.NewRequest(method, p.url+path, body)
+	if err != nil {
+		return err
+	}
+	token, err := p.token()
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Authorization", token)
+	if params != nil {
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	response, err := p.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	var envelope struct {
+		Data   json.RawMessage   `json:"data"`
+		Errors map[string]string `json:"errors"`
+	}
+	json.Unmarshal(data, &envelope)
+	if response.StatusCode/100 != 2 {
+		// The reason is in the status line, what was wrong with the
+		// params in errors
+		var problems []string
+		for param, problem := range envelope.Errors {
+			problems = append(problems, param+": "+strings.TrimSpace(problem))
+		}
+		if len(problems) > 0 {
+			return fmt.Errorf("proxmox %s %s: %s (%s)", method, path, response.Status, strings.Join(problems, "; "))
+		}
+		return fmt.Errorf("proxmox %s %s: %s", method, path, response.Status)
+	}
+	if result == nil || len(envelope.Data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(envelope.Data, result)
+}
+
+// Wait for the task an asynchronous call started to finish
+func (p *proxmox) wait(node string, upid string) error {
+	deadline := time.Now().Add(proxmoxTaskTimeout)
+	for {
+		var task struct {
+			Status     string `json:"status"`
+			ExitStatus string `json:"exitstatus"`
+		}
+		if err := p.do("GET", "/nodes/"+node+"/tasks/"+url.PathEscape(upid)+"/status", nil, &task); err != nil {
+			return err
+		}
+		if task.Status == "stopped" {
+			if task.ExitStatus != "OK" {
+				return fmt.Errorf("proxmox task %s: %s", upid, task.ExitStatus)
+			}
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("proxmox task %s still running after %s", upid, proxmoxTaskTimeout)
+		}
+		time.Sleep(p.poll)
+	}
+}
+
+// Make an asynchronous call and wait for its task
+func (p *proxmox) run(method string, node string, path string, params url.Values) error {
+	var upid string
+	if err := p.do(method, "/nodes/"+node+path, params, &upid); err != nil {
+		return err
+	}
+	return p.wait(node, upid)
+}
+
+// The guest with vmid, or when it is 0 the one called name, on node
+func (p *proxmox) guest(node string, vmid int, name string) (*proxmoxGuestStatus, error) {
+	var guests []proxmoxGuestStatus
+	if err := p.do("GET", "/nodes/"+node+"/qemu", nil, &guests); err != nil {
+		return nil, err
+	}
+	for _, g := range guests {
+		if (vmid != 0 && g.VMID == vmid) || (vmid == 0 && g.Name == name) {
+			return &g, nil
+		}
+	}
+	return nil, nil
+}
+
+// The settings that follow the definitions on every build
+func (p *proxmox) guestParams(m *machine.Machine, vm machine.VmInstance) (url.Values, error) {
+	params := url.Values{}
+	params.Set("name", m.Hostname)
+	if vm.Vcpu > 0 {
+		params.Set("cores", strconv.Itoa(vm.Vcpu))
+	}
+	if vm.Memory > 0 {
+		params.Set("memory", strconv.Itoa(vm.Memory))
+	}
+
+	bridge := vm.VirtNetwork
+	if bridge == "" {
+		bridge = p.bridge
+	}
+	nics, err := vmNICs(m, vm)
+	if err != nil {
+		return nil, err
+	}
+	for n, nic := range nics {
+		net := "virtio"
+		if nic.MAC != "" {
+			net += "=" + strings.ToUpper(nic.MAC)
+		}
+		net += ",bridge=" + bridge
+		if nic.Vlan > 0 {
+			net += ",tag=" + strconv.Itoa(nic.Vlan)
+		}
+		params.Set(fmt.Sprintf("net%d", n), net)
+	}
+	return params, nil
+}
+
+// Boot from the network, then from disk when there is one
+func proxmoxBootOrder(disk string) string {
+	if disk == "" {
+		return "order=net0"
+	}
+	return "order=net0;" + disk
+}
+
+// The disk an existing guest boots from after the network
+func (p *proxmox) bootDisk(node string, vmid int) (string, error) {
+	var config map[string]interface{}
+	if err := p.do("GET", "/nodes/"+node+"/qemu/"+strconv.Itoa(vmid)+"/config", nil, &config); err != nil {
+		return "", err
+	}
+	for _, disk := range []string{"scsi0", "virtio0", "sata0", "ide0"} {
+		if _, found := config[disk]; found {
+			return disk, nil
+		}
+	}
+	return "", nil
+}
+
+// Create or reset the guest for m on its node and boot it, the guest is
+// node/vmid
+func (p *proxmox) Boot(m *machine.Machine, vm machine.VmInstance, hypervisor string) (string, error) {
+	node := vm.Proxmox.Node
+	if node == "" {
+		node = strings.Split(hypervisor, ".")[0]
+	}
+	vmid, err := p.bootGuest(m, vm, node)
+	if vmid == 0 {
+		return node, err
+	}
+	return node + "/" + strconv.Itoa(vmid), err
+}
+
+func (p *proxmox) bootGuest(m *machine.Machine, vm machine.VmInstance, node string) (int, error) {
+	params, err := p.guestParams(m, vm)
+	if err != nil {
+		return 0, err
+	}
+
+	g, err := p.guest(node, vm.Proxmox.VMID, m.Hostname)
+	if err != nil {
+		return 0, err
+	}
+	vmid := vm.Proxmox.VMID
+	if g == nil {
+		if vmid == 0 {
+			var next interface{}
+			if err := p.do("GET", "/cluster/nextid", nil, &next); err != nil {
+				return 0, err
+			}
+			if vmid, err = strconv.Atoi(fmt.Sprint(next)); err != nil {
+				return 0, fmt.Errorf("proxmox gave %v as the next vmid", next)
+			}
+		}
+		storage := vm.Proxmox.Storage
+		if storage == "" {
+			storage = p.storage
+		}
+		params.Set("vmid", strconv.Itoa(vmid))
+		params.Set("ostype", "l26")
+		params.Set("scsihw", "virtio-scsi-pci")
+		for n, size := range vm.Proxmox.Disks {
+			params.Set(fmt.Sprintf("scsi%d", n), fmt.Sprintf("%s:%d", storage, size))
+		}
+		disk := ""
+		if len(vm.Proxmox.Disks) > 0 {
+			disk = "scsi0"
+		}
+		params.Set("boot", proxmoxBootOrder(disk))
+		if err := p.run("POST", node, "/qemu", params); err != nil {
+			return vmid, err
+		}
+	} else {
+		vmid = g.VMID
+		guest := "/qemu/" + strconv.Itoa(vmid)
+		if g.Status == "running" {
+			// A reset wouldn't pick up new cores or memory
+			if err := p.run("POST", node, guest+"/status/stop", url.Values{}); err != nil {
+				return vmid, err
+			}
+		}
+		disk, err := p.bootDisk(node, vmid)
+		if err != nil {
+			return vmid, err
+		}
+		params.Set("boot", proxmoxBootOrder(disk))
+		if err := p.do("PUT", "/nodes/"+node+guest+"/config", params, nil); err != nil {
+			return vmid, err
+		}
+	}
+
+	return vmid, p.run("POST", node, "/qemu/"+strconv.Itoa(vmid)+"/status/start", url.Values{})
+}
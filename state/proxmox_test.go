@@ -0,0 +1,125 @@
+package state
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestProxmoxBootVM(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-proxmox")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "pve1.example.com.yaml"), []byte(`{"vm": [
+		{"hostname": "vm01", "domain": "example.com", "memory": 2048, "vcpu": 2,
+		 "interfaces": [{"name": "eth0", "vlan": 10}, {"name": "eth1"}], "proxmox": {"disks": [32, 100]}}]}`), 0644)
+	config := configpkg.Config{VmPath: dir}
+
+	var calls []string
+	var forms []url.Values
+	guests := `[]`
+	taskStatus := "OK"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "PVEAPIToken=root@pam!waitron=secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		r.ParseForm()
+		p := strings.TrimPrefix(r.URL.Path, "/api2/json")
+		if !strings.Contains(p, "/tasks/") {
+			calls = append(calls, r.Method+" "+p)
+		}
+		switch {
+		case p == "/nodes/pve1/qemu" && r.Method == "GET":
+			io.WriteString(w, `{"data": `+guests+`}`)
+		case p == "/cluster/nextid":
+			io.WriteString(w, `{"data": "105"}`)
+		case p == "/nodes/pve1/qemu/105/config" && r.Method == "GET":
+			io.WriteString(w, `{"data": {"virtio0": "local-lvm:vm-105-disk-0,size=32G"}}`)
+		case p == "/nodes/pve1/qemu/105/config" && r.Method == "PUT":
+			forms = append(forms, r.PostForm)
+			io.WriteString(w, `{"data": null}`)
+		case strings.HasPrefix(p, "/nodes/pve1/tasks/"):
+			io.WriteString(w, `{"data": {"status": "stopped", "exitstatus": "`+taskStatus+`"}}`)
+		case r.Method == "POST":
+			forms = append(forms, r.PostForm)
+			io.WriteString(w, `{"data": "UPID:pve1:00001:`+strings.Replace(p, "/", "-", -1)+`:"}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	p, err := newProxmox(configpkg.ProxmoxConfig{URL: server.URL, TokenID: "root@pam!waitron", TokenSecret: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.poll = time.Millisecond
+	state := New()
+	state.VMs = p
+	m := &machine.Machine{Hostname: "vm01.example.com", Network: []machine.Interface{{Name: "eth0", MacAddress: "de:ad:be:ef:00:01"}}}
+
+	// A new guest
+	if err := state.bootVM(m, config); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(calls, ", ") != "GET /nodes/pve1/qemu, GET /cluster/nextid, POST /nodes/pve1/qemu, POST /nodes/pve1/qemu/105/status/start" {
+		t.Errorf("unexpected calls %v", calls)
+	}
+	created := forms[0]
+	for param, expected := range map[string]string{
+		"vmid":   "105",
+		"name":   "vm01.example.com",
+		"cores":  "2",
+		"memory": "2048",
+		"net0":   "virtio=DE:AD:BE:EF:00:01,bridge=vmbr0,tag=10",
+		"net1":   "virtio,bridge=vmbr0",
+		"scsi0":  "local-lvm:32",
+		"scsi1":  "local-lvm:100",
+		"boot":   "order=net0;scsi0",
+	} {
+		if created.Get(param) != expected {
+			t.Errorf("expected %s=%s, got %q", param, expected, created.Get(param))
+		}
+	}
+	if len(m.Phases) != 1 || m.Phases[0].Name != machine.PhaseVMBooted {
+		t.Errorf("expected the vm-booted phase, got %+v", m.Phases)
+	}
+
+	// A running guest is stopped and set up again, leaving its disks
+	calls, forms = nil, nil
+	guests = `[{"vmid": 105, "name": "vm01.example.com", "status": "running"}]`
+	if err := state.bootVM(m, config); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(calls, ", ") != "GET /nodes/pve1/qemu, POST /nodes/pve1/qemu/105/status/stop, GET /nodes/pve1/qemu/105/config, "+
+		"PUT /nodes/pve1/qemu/105/config, POST /nodes/pve1/qemu/105/status/start" {
+		t.Errorf("unexpected calls %v", calls)
+	}
+	if updated := forms[1]; updated.Get("boot") != "order=net0;virtio0" || updated.Get("scsi0") != "" || updated.Get("vmid") != "" {
+		t.Errorf("unexpected config %v", updated)
+	}
+
+	taskStatus = "start failed: not enough memory"
+	if err := state.bootVM(m, config); err == nil || !strings.Contains(err.Error(), "not enough memory") {
+		t.Errorf("expected the failed task to be reported, got %v", err)
+	}
+	taskStatus = "OK"
+
+	calls = nil
+	if err := state.bootVM(&machine.Machine{Hostname: "node01.example.com"}, config); err != nil || len(calls) != 0 {
+		t.Errorf("expected a machine that isn't a VM to be left alone, got %v %v", err, calls)
+	}
+	if err := state.bootVM(&machine.Machine{Hostname: "vm01.example.com", Network: []machine.Interface{{Name: "eth0"}}}, config); err == nil {
+		t.Error("expected a VM without a MAC address to boot from to be refused")
+	}
+}
@@ -0,0 +1,269 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Publishers are notifiers that hand every event to a message bus for other
+// automation to consume, as a versioned JSON envelope. Bump
+// eventSchemaVersion when a field changes meaning or goes away; new fields
+// can be added without it.
+const eventSchemaVersion = 1
+
+type eventEnvelope struct {
+	Schema        string
+	SchemaVersion int
+	Type          string
+	Hostname      string `json:",omitempty"`
+	Token         string `json:",omitempty"`
+	Message       string `json:",omitempty"`
+	Timestamp     time.Time
+	Machine       *machine.Machine `json:",omitempty"`
+}
+
+func marshalEvent(e Event) ([]byte, error) {
+	return json.Marshal(eventEnvelope{
+		Schema:        "waitron.event",
+		SchemaVersion: eventSchemaVersion,
+		Type:          e.Type,
+		Hostname:      e.Hostname,
+		Token:         e.Token,
+		Message:       e.Message,
+		Timestamp:     e.Timestamp,
+		Machine:       e.Machine,
+	})
+}
+
+func isPublisher(notifierType string) bool {
+	switch notifierType {
+	case "nats", "kafka", "mqtt", "redis":
+		return true
+	}
+	return false
+}
+
+const defaultNATSSubject = "waitron.events.{{ Type }}"
+
+// NATS speaks a simple text protocol, see
+// https://docs.nats.io/reference/reference-protocols/nats-protocol
+type natsPublisher struct {
+	config config.NotifierConfig
+	server *url.URL
+
+	mux  sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newNATSPublisher(nc config.NotifierConfig) (Notifier, error) {
+	if nc.URL == "" {
+		nc.URL = "nats://127.0.0.1:4222"
+	}
+	if nc.Subject == "" {
+		nc.Subject = defaultNATSSubject
+	}
+
+	u, err := url.Parse(nc.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "nats" {
+		return nil, fmt.Errorf("notifier %s url must be nats://host:port", nc)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+
+	return &natsPublisher{config: nc, server: u}, nil
+}
+
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	Name     string `json:"name"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+	Token    string `json:"auth_token,omitempty"`
+}
+
+func (p *natsPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", p.server.Host, notifierTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(notifierTimeout))
+	r := bufio.NewReader(conn)
+
+	info, err := r.ReadString('\n')
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("unexpected greeting from %s: %s", p.server.Host, strings.TrimSpace(info))
+	}
+
+	c := natsConnect{Name: "waitron", Token: p.config.APIKey}
+	if p.server.User != nil {
+		c.User = p.server.User.Username()
+		c.Pass, _ = p.server.User.Password()
+	}
+	js, _ := json.Marshal(c)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", js); err != nil {
+		conn.Close()
+		return err
+	}
+
+	p.conn, p.r = conn, r
+	return nil
+}
+
+func (p *natsPublisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn, p.r = nil, nil
+	}
+}
+
+// Publish followed by a PING, the PONG confirms the server took it
+func (p *natsPublisher) publish(subject string, payload []byte) error {
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	p.conn.SetDeadline(time.Now().Add(notifierTimeout))
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "PUB %s %d\r\n", subject, len(payload))
+	buf.Write(payload)
+	buf.WriteString("\r\nPING\r\n")
+	if _, err := p.conn.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line)
+
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := p.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("%s: %s", p.server.Host, line)
+		}
+	}
+}
+
+func (p *natsPublisher) Notify(e Event) error {
+	subject, err := renderNotification(p.config.Subject, e)
+	if err != nil {
+		return err
+	}
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n") {
+		return fmt.Errorf("invalid NATS subject %q", subject)
+	}
+
+	payload, err := marshalEvent(e)
+	if err != nil {
+		return err
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	// The server drops idle clients that don't answer its pings, so retry
+	// once on a fresh connection.
+	if err = p.publish(subject, payload); err != nil {
+		p.close()
+		if err = p.publish(subject, payload); err != nil {
+			p.close()
+		}
+	}
+	return err
+}
+
+const defaultKafkaTopic = "waitron-events"
+
+// Kafka through a REST proxy (Confluent's API v2), keyed by hostname so a
+// machine's events stay in order on one partition.
+type kafkaPublisher struct {
+	config config.NotifierConfig
+	client *http.Client
+}
+
+func newKafkaPublisher(nc config.NotifierConfig) (Notifier, error) {
+	if nc.URL == "" {
+		return nil, fmt.Errorf("notifier %s needs the url of a Kafka REST proxy", nc)
+	}
+	if nc.Topic == "" {
+		nc.Topic = defaultKafkaTopic
+	}
+	return &kafkaPublisher{config: nc, client: &http.Client{Timeout: notifierTimeout}}, nil
+}
+
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+type kafkaRecord struct {
+	Key   string          `json:"key,omitempty"`
+	Value json.RawMessage `json:"value"`
+}
+
+func (p *kafkaPublisher) Notify(e Event) error {
+	topic, err := renderNotification(p.config.Topic, e)
+	if err != nil {
+		return err
+	}
+
+	payload, err := marshalEvent(e)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(kafkaRecords{Records: []kafkaRecord{{Key: e.Hostname, Value: payload}}})
+	if err != nil {
+		return err
+	}
+
+	u := strings.TrimRight(p.config.URL, "/") + "/topics/" + url.PathEscape(topic)
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	for k, v := range p.config.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s returned %s", p.config, resp.Status)
+	}
+	return nil
+}
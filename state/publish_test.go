@@ -0,0 +1,112 @@
+package state
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Accepts one client and sends back the subject and payload of its first PUB
+func fakeNATSServer(t *testing.T) (string, chan []string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan []string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		conn.Write([]byte(`INFO {"server_id":"test"}` + "\r\n"))
+		r := bufio.NewReader(conn)
+		var pub []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			line = strings.TrimSpace(line)
+			switch {
+			case strings.HasPrefix(line, "PUB "):
+				payload, _ := r.ReadString('\n')
+				pub = []string{strings.Fields(line)[1], strings.TrimSpace(payload)}
+			case line == "PING":
+				conn.Write([]byte("PONG\r\n"))
+				if pub != nil {
+					received <- pub
+				}
+			}
+		}
+	}()
+
+	return "nats://" + l.Addr().String(), received
+}
+
+func TestNATSPublisher(t *testing.T) {
+	addr, received := fakeNATSServer(t)
+
+	p, err := NewNotifier(config.NotifierConfig{Type: "nats", URL: addr})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := p.Notify(Event{Type: machine.EventBuildStarted, Hostname: "dns02.example.com"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	pub := <-received
+	if pub[0] != "waitron.events.build-started" {
+		t.Errorf("unexpected subject %s", pub[0])
+	}
+
+	var e eventEnvelope
+	if err := json.Unmarshal([]byte(pub[1]), &e); err != nil {
+		t.Fatalf("invalid payload %s: %s", pub[1], err)
+	}
+	if e.SchemaVersion != eventSchemaVersion || e.Type != machine.EventBuildStarted || e.Hostname != "dns02.example.com" {
+		t.Errorf("unexpected event %+v", e)
+	}
+}
+
+func TestNATSPublisherURL(t *testing.T) {
+	if _, err := NewNotifier(config.NotifierConfig{Type: "nats", URL: "http://127.0.0.1:4222"}); err == nil {
+		t.Errorf("expected a non-nats url to fail")
+	}
+}
+
+func TestKafkaPublisher(t *testing.T) {
+	var path string
+	var records kafkaRecords
+	ts := httptest.NewServer(http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		path = request.URL.Path
+		json.NewDecoder(request.Body).Decode(&records)
+	}))
+	defer ts.Close()
+
+	p, err := NewNotifier(config.NotifierConfig{Type: "kafka", URL: ts.URL, Topic: "provisioning"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := p.Notify(Event{Type: machine.EventBuildCompleted, Hostname: "dns02.example.com"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if path != "/topics/provisioning" {
+		t.Errorf("unexpected path %s", path)
+	}
+	if len(records.Records) != 1 || records.Records[0].Key != "dns02.example.com" {
+		t.Errorf("expected one record keyed by hostname, got %+v", records)
+	}
+}
@@ -0,0 +1,113 @@
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/template"
+)
+
+// The RAID levels each controller's script can create and how it names them
+var raidLevels = map[string]map[string]string{
+	"perccli": {"0": "raid0", "1": "raid1", "5": "raid5", "6": "raid6", "10": "raid10", "50": "raid50", "60": "raid60"},
+	"storcli": {"0": "raid0", "1": "raid1", "5": "raid5", "6": "raid6", "10": "raid10", "50": "raid50", "60": "raid60"},
+	"ssacli":  {"0": "0", "1": "1", "5": "5", "6": "6", "10": "1+0", "50": "50", "60": "60"},
+}
+
+// The script that configures the RAID controller of m
+func raidScript(m machine.Machine, config config.Config) (string, error) {
+	s := m.RAID
+	if s.Template != "" {
+		return template.Render(m, s.Template, config)
+	}
+
+	levels, found := raidLevels[s.Controller]
+	if !found {
+		return "", fmt.Errorf("unknown RAID controller %q", s.Controller)
+	}
+	var b bytes.Buffer
+	b.WriteString("#!/bin/sh\nset -e\n")
+	switch s.Controller {
+	case "perccli", "storcli":
+		cli := fmt.Sprintf("%s64 /c%d", s.Controller, s.ControllerID)
+		fmt.Fprintf(&b, "%s/vall del force\n", cli)
+		for i, a := range s.Arrays {
+			level, found := levels[a.Level]
+			if !found {
+				return "", fmt.Errorf("%s cannot create RAID %q for %s", s.Controller, a.Level, a.Name)
+			}
+			size := "all"
+			if a.SizeGB > 0 {
+				size = fmt.Sprintf("%dGB", a.SizeGB)
+			}
+			fmt.Fprintf(&b, "%s add vd type=%s size=%s name=%s drives=%s\n", cli, level, size, a.Name, a.Drives)
+			if a.Boot {
+				fmt.Fprintf(&b, "%s/v%d set bootdrive=on\n", cli, i)
+			}
+		}
+	case "ssacli":
+		cli := fmt.Sprintf("ssacli ctrl slot=%d", s.ControllerID)
+		fmt.Fprintf(&b, "%s ld all delete forced\n", cli)
+		for i, a := range s.Arrays {
+			level, found := levels[a.Level]
+			if !found {
+				return "", fmt.Errorf("%s cannot create RAID %q for %s", s.Controller, a.Level, a.Name)
+			}
+			size := "max"
+			if a.SizeGB > 0 {
+				size = fmt.Sprintf("%d", a.SizeGB*1024)
+			}
+			fmt.Fprintf(&b, "%s create type=ld drives=%s raid=%s size=%s\n", cli, a.Drives, level, size)
+			if a.Boot {
+				fmt.Fprintf(&b, "%s ld %d modify bootvolume=primary\n", cli, i+1)
+			}
+		}
+	}
+	return b.String(), nil
+}
+
+// The RAID script of the build identified by token
+func (state *State) RAIDScriptFor(token string, config config.Config) (string, error) {
+	state.Mux.Lock()
+	m, err := state.machineInStage(token, machine.RAIDStage)
+	if err != nil {
+		state.Mux.Unlock()
+		return "", err
+	}
+	snapshot := *m
+	state.Mux.Unlock()
+
+	return raidScript(snapshot, config)
+}
+
+// Record how configuring the RAID controller of the build identified by token went
+// and let it go on or fail it
+func (state *State) ReportRAID(token string, r machine.RAIDResult, config config.Config) error {
+	r.Reported = time.Now()
+
+	state.Mux.Lock()
+	m, err := state.machineInStage(token, machine.RAIDStage)
+	if err != nil {
+		state.Mux.Unlock()
+		return err
+	}
+	m.RAIDResult = &r
+	state.Version++
+	state.Mux.Unlock()
+
+	if !r.Passed {
+		message := r.Message
+		if message == "" {
+			// The last thing the script printed is likely why
+			lines := strings.Split(strings.TrimSpace(r.Output), "\n")
+			message = lines[len(lines)-1]
+		}
+		state.FailStage(m, config, machine.RAIDStage, message)
+		return nil
+	}
+	return state.PassStage(m, config, machine.RAIDStage, r.Message)
+}
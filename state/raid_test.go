@@ -0,0 +1,54 @@
+package state
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestRAIDScript(t *testing.T) {
+	arrays := []config.RAIDArray{
+		{Name: "os", Level: "1", Drives: "32:0-1", SizeGB: 200, Boot: true},
+		{Name: "data", Level: "10", Drives: "32:2-5"},
+	}
+	m := machine.Machine{Hostname: "dns02.example.com"}
+	m.RAID = &config.RAIDConfig{Controller: "perccli", Arrays: arrays}
+	script, err := raidScript(m, config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `#!/bin/sh
+set -e
+perccli64 /c0/vall del force
+perccli64 /c0 add vd type=raid1 size=200GB name=os drives=32:0-1
+perccli64 /c0/v0 set bootdrive=on
+perccli64 /c0 add vd type=raid10 size=all name=data drives=32:2-5
+`
+	if script != expected {
+		t.Errorf("unexpected perccli script\n%s", script)
+	}
+
+	arrays[1].Drives = "1I:1:3,1I:1:4,2I:1:5,2I:1:6"
+	m.RAID = &config.RAIDConfig{Controller: "ssacli", ControllerID: 1, Arrays: arrays}
+	script, err = raidScript(m, config.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(script, "ssacli ctrl slot=1 ld all delete forced\n") ||
+		!strings.Contains(script, "ssacli ctrl slot=1 create type=ld drives=32:0-1 raid=1 size=204800\n") ||
+		!strings.Contains(script, "ssacli ctrl slot=1 ld 1 modify bootvolume=primary\n") ||
+		!strings.Contains(script, "raid=1+0 size=max\n") {
+		t.Errorf("unexpected ssacli script\n%s", script)
+	}
+
+	m.RAID = &config.RAIDConfig{Controller: "storcli", Arrays: []config.RAIDArray{{Name: "os", Level: "3"}}}
+	if _, err := raidScript(m, config.Config{}); err == nil {
+		t.Error("expected an unsupported RAID level to be refused")
+	}
+	m.RAID = &config.RAIDConfig{Controller: "mdadm"}
+	if _, err := raidScript(m, config.Config{}); err == nil {
+		t.Error("expected an unknown controller to be refused")
+	}
+}
@@ -0,0 +1,219 @@
+package state
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ns1/waitron/config"
+)
+
+// Redis publisher using the RESP protocol directly, see
+// https://redis.io/docs/reference/protocol-spec/
+// Events are PUBLISHed to a channel and, if a stream is configured, also
+// XADDed to it so consumers that were away can catch up.
+
+const defaultRedisChannel = "waitron:events"
+
+const defaultRedisStreamMaxLen = 10000
+
+type redisPublisher struct {
+	config config.NotifierConfig
+	server *url.URL
+
+	mux  sync.Mutex
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRedisPublisher(nc config.NotifierConfig) (Notifier, error) {
+	if nc.URL == "" {
+		nc.URL = "redis://127.0.0.1:6379"
+	}
+	if nc.Channel == "" {
+		nc.Channel = defaultRedisChannel
+	}
+	if nc.StreamMaxLen <= 0 {
+		nc.StreamMaxLen = defaultRedisStreamMaxLen
+	}
+
+	u, err := url.Parse(nc.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("notifier %s url must be redis:// or rediss://", nc)
+	}
+	if u.Port() == "" {
+		u.Host = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if _, err := strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("notifier %s has invalid database %q", nc, db)
+		}
+	}
+
+	return &redisPublisher{config: nc, server: u}, nil
+}
+
+func redisCommand(args ...string) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&buf, "$%d\r\n%s\r\n", len(a), a)
+	}
+	return buf.Bytes()
+}
+
+// An error reply, the connection is still fine
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+// Read one reply, returning errors from the server as redisError. The value of
+// integer, simple and bulk string replies is returned as a string.
+func readRedisReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("empty reply from redis")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", err
+		}
+		if n < 0 {
+			return "", nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return "", err
+		}
+		return string(buf[:n]), nil
+	}
+	return "", fmt.Errorf("unexpected reply from redis: %q", line)
+}
+
+func (p *redisPublisher) do(args ...string) (string, error) {
+	if _, err := p.conn.Write(redisCommand(args...)); err != nil {
+		return "", err
+	}
+	return readRedisReply(p.r)
+}
+
+func (p *redisPublisher) connect() error {
+	var conn net.Conn
+	var err error
+	dialer := &net.Dialer{Timeout: notifierTimeout}
+	if p.server.Scheme == "rediss" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", p.server.Host, &tls.Config{ServerName: p.server.Hostname()})
+	} else {
+		conn, err = dialer.Dial("tcp", p.server.Host)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(notifierTimeout))
+	p.conn, p.r = conn, bufio.NewReader(conn)
+
+	if p.server.User != nil {
+		args := []string{"AUTH"}
+		if user := p.server.User.Username(); user != "" {
+			args = append(args, user)
+		}
+		pass, _ := p.server.User.Password()
+		if _, err := p.do(append(args, pass)...); err != nil {
+			p.close()
+			return err
+		}
+	}
+
+	if db := strings.Trim(p.server.Path, "/"); db != "" {
+		if _, err := p.do("SELECT", db); err != nil {
+			p.close()
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *redisPublisher) close() {
+	if p.conn != nil {
+		p.conn.Close()
+		p.conn, p.r = nil, nil
+	}
+}
+
+func (p *redisPublisher) publish(channel string, stream string, payload string) error {
+	if p.conn == nil {
+		if err := p.connect(); err != nil {
+			return err
+		}
+	}
+	p.conn.SetDeadline(time.Now().Add(notifierTimeout))
+
+	if _, err := p.do("PUBLISH", channel, payload); err != nil {
+		return err
+	}
+	if stream != "" {
+		maxLen := strconv.Itoa(p.config.StreamMaxLen)
+		if _, err := p.do("XADD", stream, "MAXLEN", "~", maxLen, "*", "event", payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *redisPublisher) Notify(e Event) error {
+	channel, err := renderNotification(p.config.Channel, e)
+	if err != nil {
+		return err
+	}
+
+	var stream string
+	if p.config.Stream != "" {
+		if stream, err = renderNotification(p.config.Stream, e); err != nil {
+			return err
+		}
+	}
+
+	payload, err := marshalEvent(e)
+	if err != nil {
+		return err
+	}
+
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	// Retry once on a fresh connection in case the server closed an idle one
+	err = p.publish(channel, stream, string(payload))
+	if _, ok := err.(redisError); err != nil && !ok {
+		p.close()
+		if err = p.publish(channel, stream, string(payload)); err != nil {
+			p.close()
+		}
+	}
+	return err
+}
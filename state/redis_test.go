@@ -0,0 +1,89 @@
+package state
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Answers every command with +OK and hands back the commands it got
+func fakeRedisServer(t *testing.T, count int) (string, chan [][]string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	received := make(chan [][]string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		var commands [][]string
+		for len(commands) < count {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(line)[1:])
+
+			var args []string
+			for i := 0; i < n; i++ {
+				header, _ := r.ReadString('\n')
+				size, _ := strconv.Atoi(strings.TrimSpace(header)[1:])
+				buf := make([]byte, size+2)
+				io.ReadFull(r, buf)
+				args = append(args, string(buf[:size]))
+			}
+			commands = append(commands, args)
+			conn.Write([]byte("+OK\r\n"))
+		}
+		received <- commands
+	}()
+
+	return l.Addr().String(), received
+}
+
+func TestRedisPublisher(t *testing.T) {
+	addr, received := fakeRedisServer(t, 4)
+
+	p, err := NewNotifier(config.NotifierConfig{Type: "redis", URL: "redis://:secret@" + addr + "/2", Stream: "waitron:stream"})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := p.Notify(Event{Type: machine.EventBuildStarted, Hostname: "dns02.example.com"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	commands := <-received
+	expected := []string{"AUTH secret", "SELECT 2", "PUBLISH waitron:events", "XADD waitron:stream MAXLEN ~ 10000 * event"}
+	for i, c := range commands {
+		if !strings.HasPrefix(strings.Join(c, " "), expected[i]) {
+			t.Errorf("expected %q, got %q", expected[i], strings.Join(c, " "))
+		}
+	}
+}
+
+func TestReadRedisReply(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("$5\r\nhello\r\n-ERR wrong type\r\n:42\r\n"))
+
+	if v, err := readRedisReply(r); v != "hello" || err != nil {
+		t.Errorf("unexpected bulk reply %q %v", v, err)
+	}
+	if _, err := readRedisReply(r); err == nil || err.Error() != "ERR wrong type" {
+		t.Errorf("expected an error reply, got %v", err)
+	}
+	if v, _ := readRedisReply(r); v != "42" {
+		t.Errorf("unexpected integer reply %q", v)
+	}
+}
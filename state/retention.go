@@ -0,0 +1,161 @@
+package state
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Records of finished builds are kept in the state store so their phases
+// stay available. A retention sweep keeps them from piling up: records older
+// than max_age_secs, and the oldest records beyond max_records, are evicted.
+// With a history_path they are moved there first, and BuildByToken still
+// finds them. Their artifacts go with them, see artifacts.go. When the state
+// store is in memory, max_records defaults to defaultMaxBuildRecords so the
+// process has a bounded footprint.
+
+const (
+	defaultMaxBuildRecords       = 1000
+	defaultRetentionCheckSeconds = 60
+)
+
+type buildRetention struct {
+	config  config.BuildRetentionConfig
+	store   Store
+	history Store // nil without a history_path
+
+	mux     sync.Mutex
+	records int
+	evicted int // since the last report
+}
+
+func NewBuildRetention(config config.BuildRetentionConfig, store Store, persistent bool) (*buildRetention, error) {
+	if config.MaxRecords == 0 && !persistent {
+		config.MaxRecords = defaultMaxBuildRecords
+	}
+	r := &buildRetention{config: config, store: store}
+	if config.HistoryPath != "" {
+		history, err := newFileStore(config.HistoryPath)
+		if err != nil {
+			return nil, err
+		}
+		r.history = history
+	}
+	return r, nil
+}
+
+// Sweep now and then every check interval, until stop is closed
+func (r *buildRetention) Start(stop <-chan struct{}) {
+	interval := config.Seconds(r.config.CheckSeconds, defaultRetentionCheckSeconds)
+	go func() {
+		for {
+			if err := r.Sweep(time.Now()); err != nil {
+				logger.Error("cannot apply build retention", "error", err)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+type keyedRecord struct {
+	key    string
+	record machine.BuildRecord
+}
+
+// Evict the records that are too old or too many
+func (r *buildRetention) Sweep(now time.Time) error {
+	keys, err := r.store.List(BuildsBucket)
+	if err != nil {
+		return err
+	}
+
+	records := make([]keyedRecord, 0, len(keys))
+	for _, key := range keys {
+		var b machine.BuildRecord
+		if found, err := r.store.Get(BuildsBucket, key, &b); err != nil || !found {
+			continue
+		}
+		records = append(records, keyedRecord{key: key, record: b})
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].record.BuildEnd.Before(records[j].record.BuildEnd) })
+
+	// Oldest first, so whatever is cut for the count is also the oldest
+	expired := 0
+	if r.config.MaxAgeSeconds > 0 {
+		cutoff := now.Add(-time.Duration(r.config.MaxAgeSeconds) * time.Second)
+		for expired < len(records) && records[expired].record.BuildEnd.Before(cutoff) {
+			expired++
+		}
+	}
+	if r.config.MaxRecords > 0 && len(records)-expired > r.config.MaxRecords {
+		expired = len(records) - r.config.MaxRecords
+	}
+
+	evicted, archived := 0, 0
+	for _, kr := range records[:expired] {
+		if r.history != nil {
+			if err := r.history.Put(BuildsBucket, kr.key, kr.record); err != nil {
+				logger.Error("cannot move build record to history", "hostname", kr.record.Hostname, "token", kr.key, "error", err)
+				continue
+			}
+			archived++
+		}
+		if err := r.evictArtifacts(kr.record); err != nil {
+			logger.Error("cannot evict build artifacts", "hostname", kr.record.Hostname, "token", kr.key, "error", err)
+			continue
+		}
+		if err := r.store.Delete(BuildsBucket, kr.key); err != nil {
+			logger.Error("cannot evict build record", "hostname", kr.record.Hostname, "token", kr.key, "error", err)
+			continue
+		}
+		evicted++
+	}
+	if evicted > 0 {
+		logger.Info("evicted build records", "evicted", evicted, "archived", archived, "kept", len(records)-evicted)
+	}
+
+	r.mux.Lock()
+	r.records = len(records) - evicted
+	r.evicted += evicted
+	r.mux.Unlock()
+	return nil
+}
+
+// A record that has been moved to history
+func (r *buildRetention) fromHistory(token string) (*machine.BuildRecord, error) {
+	if r.history == nil {
+		return nil, nil
+	}
+	var b machine.BuildRecord
+	found, err := r.history.Get(BuildsBucket, token, &b)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// Build records in the state store as of the last sweep
+func (r *buildRetention) Size() int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.records
+}
+
+func (r *buildRetention) report(sink MetricSink) {
+	r.mux.Lock()
+	records, evicted := r.records, r.evicted
+	r.evicted = 0
+	r.mux.Unlock()
+
+	sink.Gauge("state.build_records", float64(records))
+	if evicted > 0 {
+		sink.Count("state.build_records.evicted", int64(evicted))
+	}
+}
@@ -0,0 +1,102 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func storeRecords(t *testing.T, store Store, now time.Time, ages ...time.Duration) {
+	for i, age := range ages {
+		r := machine.BuildRecord{Hostname: fmt.Sprintf("host%d.example.com", i), Token: fmt.Sprintf("token%d", i), BuildEnd: now.Add(-age)}
+		if err := store.Put(BuildsBucket, r.Token, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRetentionMaxRecords(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	storeRecords(t, store, now, 3*time.Hour, time.Hour, 2*time.Hour)
+
+	r, _ := NewBuildRetention(config.BuildRetentionConfig{MaxRecords: 2}, store, false)
+	if err := r.Sweep(now); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, _ := store.List(BuildsBucket)
+	if len(keys) != 2 || r.Size() != 2 {
+		t.Errorf("expected 2 records to be kept, got %v", keys)
+	}
+	if found, _ := store.Get(BuildsBucket, "token0", &machine.BuildRecord{}); found {
+		t.Error("expected the oldest record to be evicted")
+	}
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	store := NewMemoryStore()
+	now := time.Now()
+	storeRecords(t, store, now, 3*time.Hour, time.Minute)
+
+	r, _ := NewBuildRetention(config.BuildRetentionConfig{MaxAgeSeconds: 3600}, store, true)
+	r.Sweep(now)
+
+	if keys, _ := store.List(BuildsBucket); len(keys) != 1 || keys[0] != "token1" {
+		t.Errorf("expected only the recent record to be kept, got %v", keys)
+	}
+
+	counts := newFakeMetricSink()
+	r.report(counts)
+	if counts.counts["state.build_records.evicted"] != 1 {
+		t.Errorf("unexpected counts %v", counts.counts)
+	}
+	gauges := &gaugeSink{gauges: map[string]float64{}}
+	r.report(gauges)
+	if gauges.gauges["state.build_records"] != 1 {
+		t.Errorf("unexpected gauges %v", gauges.gauges)
+	}
+}
+
+func TestRetentionDefaults(t *testing.T) {
+	if r, _ := NewBuildRetention(config.BuildRetentionConfig{}, NewMemoryStore(), false); r.config.MaxRecords != defaultMaxBuildRecords {
+		t.Errorf("expected a memory store to be capped, got %d", r.config.MaxRecords)
+	}
+	if r, _ := NewBuildRetention(config.BuildRetentionConfig{}, NewMemoryStore(), true); r.config.MaxRecords != 0 {
+		t.Errorf("expected a persistent store to keep everything, got %d", r.config.MaxRecords)
+	}
+}
+
+func TestRetentionHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	state := New()
+	now := time.Now()
+	storeRecords(t, state.Store, now, 2*time.Hour, time.Hour)
+
+	state.Retention, err = NewBuildRetention(config.BuildRetentionConfig{MaxRecords: 1, HistoryPath: dir}, state.Store, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state.Retention.Sweep(now)
+
+	if found, _ := state.Store.Get(BuildsBucket, "token0", &machine.BuildRecord{}); found {
+		t.Error("expected the old record to leave the state store")
+	}
+	r, err := state.BuildByToken("token0")
+	if err != nil || r == nil || r.Hostname != "host0.example.com" {
+		t.Errorf("expected the record to be found in history, got %+v, %v", r, err)
+	}
+	if r, _ := state.BuildByToken("missing"); r != nil {
+		t.Errorf("expected an unknown token not to be found, got %+v", r)
+	}
+}
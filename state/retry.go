@@ -0,0 +1,108 @@
+package state
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// A build that fails or goes stale is retried up to build_retries times.
+// After build_retry_backoff_secs, doubled for every retry, it is armed again
+// as if it had just started: its start time and stale timer are reset and
+// whatever was rendered for it is dropped. Then the machine is power cycled
+// the way a build request does it, the token-issued hooks run again, that's
+// where an IPMI or Redfish power cycle goes, and a VM is booted again by its
+// vm driver, see vm.go. The token stays the same. Every retry is a retried
+// phase of the build and a build-retried event. Once the retries are used
+// up, a failed build is left for a person to look at and a stale one is
+// cancelled if cancel_stale_builds says so.
+
+const (
+	defaultBuildRetryBackoffSeconds = 60
+	maxBuildRetryBackoff            = time.Hour
+)
+
+// Schedule a retry of the build of m because of reason, returns whether one
+// is coming
+func (state *State) RetryBuild(m *machine.Machine, config config.Config, reason string) bool {
+	state.Mux.Lock()
+	if state.MachineByUUID[m.Token] != m {
+		state.Mux.Unlock()
+		return false
+	}
+	if m.RetryPending {
+		state.Mux.Unlock()
+		return true
+	}
+	// Once installed it is booting what was installed, not the installer,
+	// and a machine that fails a pre-install stage needs a person
+	if m.Retries >= m.BuildRetries || m.ValidationResults != nil || m.FailedStage() {
+		state.Mux.Unlock()
+		return false
+	}
+	m.RetryPending = true
+	m.Retries++
+	retry := m.Retries
+	state.Mux.Unlock()
+
+	backoff := buildRetryBackoff(m, retry)
+	logger.Machine(m).Warn("retrying build", "retry", retry, "of", m.BuildRetries, "in", backoff.String(), "reason", reason)
+	time.AfterFunc(backoff, func() {
+		state.rearmBuild(m, config, fmt.Sprintf("retry %d of %d: %s", retry, m.BuildRetries, reason))
+	})
+	return true
+}
+
+// How long retry n of the build of m waits
+func buildRetryBackoff(m *machine.Machine, n int) time.Duration {
+	backoff := time.Duration(m.BuildRetryBackoffSeconds) * time.Second
+	if backoff <= 0 {
+		backoff = defaultBuildRetryBackoffSeconds * time.Second
+	}
+	for i := 1; i < n && backoff < maxBuildRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBuildRetryBackoff {
+		backoff = maxBuildRetryBackoff
+	}
+	return backoff
+}
+
+// Put the build of m back to its start and power cycle the machine
+func (state *State) rearmBuild(m *machine.Machine, config config.Config, message string) {
+	state.Mux.Lock()
+	if state.MachineByUUID[m.Token] != m {
+		// Done or cancelled in the meantime
+		state.Mux.Unlock()
+		return
+	}
+	m.RetryPending = false
+	m.BuildStart = time.Now()
+	m.ETA = state.Stats.estimate(m)
+	pending, err := m.SetState(machine.BuildPending, message)
+	m.AddPhase(machine.PhaseRetried, false, message)
+	state.Version++
+	state.Mux.Unlock()
+
+	if err != nil {
+		logger.Machine(m).Warn("refused build state change", "error", err)
+	}
+
+	state.RenderCache.InvalidateToken(m.Token)
+	state.Emit(machine.EventBuildRetried, m, message)
+	state.emitTransition(m, pending)
+
+	// A failure here is a failed build that uses up a retry of its own
+	if err := state.runHooks(machine.StageTokenIssued, m, config, nil); err != nil {
+		logger.Machine(m).Error("token-issued hooks failed on retry", "error", err)
+		return
+	}
+	if err := state.bootVM(m, config); err != nil {
+		logger.Machine(m).Error("cannot boot the vm on retry", "error", err)
+		state.Transition(m, machine.BuildFailed, err.Error())
+		state.Emit(machine.EventBuildFailed, m, err.Error())
+		state.RetryBuild(m, config, err.Error())
+	}
+}
@@ -0,0 +1,92 @@
+package state
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestRetryBuild(t *testing.T) {
+	state := New()
+	retried := make(chan Event, 4)
+	state.Events.Subscribe(func(e Event) {
+		if e.Type == machine.EventBuildRetried {
+			retried <- e
+		}
+	})
+
+	started := time.Now().Add(-time.Hour)
+	m := staleTestBuild(state, "flaky", 60, started)
+	m.BuildRetries = 2
+	m.BuildRetryBackoffSeconds = 3600
+
+	if !state.RetryBuild(m, config.Config{}, "stale") || m.Retries != 1 {
+		t.Fatalf("expected a retry to be scheduled, got %d retries", m.Retries)
+	}
+	// A second failure while the retry waits doesn't use up another one
+	if !state.RetryBuild(m, config.Config{}, "token-issued hooks failed") || m.Retries != 1 {
+		t.Errorf("expected the pending retry to be reused, got %d retries", m.Retries)
+	}
+
+	state.rearmBuild(m, config.Config{}, "retry 1 of 2: stale")
+	select {
+	case e := <-retried:
+		if e.Token != "flaky" || e.Message != "retry 1 of 2: stale" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	default:
+		t.Error("expected a build-retried event")
+	}
+	if m.RetryPending || !m.BuildStart.After(started) || m.Status != "Installing" {
+		t.Errorf("expected the build to start over, got %+v", m)
+	}
+	if p := m.Phases[len(m.Phases)-1]; p.Name != machine.PhaseRetried || !strings.HasPrefix(p.Message, "retry 1 of 2") {
+		t.Errorf("expected the retry to be recorded, got %+v", p)
+	}
+
+	if !state.RetryBuild(m, config.Config{}, "stale") || m.Retries != 2 {
+		t.Errorf("expected the second retry, got %d retries", m.Retries)
+	}
+	m.RetryPending = false
+	if state.RetryBuild(m, config.Config{}, "stale") {
+		t.Error("expected no more retries than build_retries")
+	}
+
+	// Builds that are gone aren't retried
+	other := &machine.Machine{Hostname: "gone.example.com", Token: "gone"}
+	other.BuildRetries = 1
+	if state.RetryBuild(other, config.Config{}, "stale") {
+		t.Error("expected a build that isn't in build mode not to be retried")
+	}
+}
+
+func TestBuildRetryBackoff(t *testing.T) {
+	m := &machine.Machine{}
+	if b := buildRetryBackoff(m, 1); b != defaultBuildRetryBackoffSeconds*time.Second {
+		t.Errorf("expected the default backoff, got %s", b)
+	}
+	m.BuildRetryBackoffSeconds = 30
+	for n, expected := range map[int]time.Duration{1: 30 * time.Second, 2: time.Minute, 3: 2 * time.Minute, 20: maxBuildRetryBackoff} {
+		if b := buildRetryBackoff(m, n); b != expected {
+			t.Errorf("expected retry %d to wait %s, got %s", n, expected, b)
+		}
+	}
+}
+
+func TestStaleBuildRetriedBeforeCancelled(t *testing.T) {
+	state := New()
+	m := staleTestBuild(state, "retried", 60, time.Now().Add(-time.Hour))
+	m.BuildRetries = 1
+	m.BuildRetryBackoffSeconds = 3600
+	m.CancelStaleBuilds = true
+
+	state.markStale(m, config.Config{})
+	time.Sleep(50 * time.Millisecond)
+
+	if state.MachineByToken("retried") != m || m.Retries != 1 {
+		t.Errorf("expected the stale build to wait for its retry, got %d retries", m.Retries)
+	}
+}
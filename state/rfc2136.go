@@ -0,0 +1,296 @@
+package state
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/ns1/waitron/config"
+)
+
+// Dynamic updates (RFC 2136) sent over TCP, signed with TSIG (RFC 8945) when
+// a key is configured. Every replace or remove is one UPDATE message, so the
+// server applies it as a whole. The TSIG of the answer isn't checked.
+
+const (
+	dnsTypeA    = 1
+	dnsTypeSOA  = 6
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+	dnsTypeTSIG = 250
+
+	dnsClassIN   = 1
+	dnsClassNONE = 254
+	dnsClassANY  = 255
+
+	dnsOpcodeUpdate = 5
+	tsigFudge       = 300
+)
+
+var dnsRcodes = map[int]string{
+	1: "FORMERR", 2: "SERVFAIL", 3: "NXDOMAIN", 4: "NOTIMP", 5: "REFUSED",
+	6: "YXDOMAIN", 7: "YXRRSET", 8: "NXRRSET", 9: "NOTAUTH", 10: "NOTZONE",
+}
+
+var tsigAlgorithms = map[string]func() hash.Hash{
+	"hmac-sha1":   sha1.New,
+	"hmac-sha256": sha256.New,
+	"hmac-sha512": sha512.New,
+}
+
+type RFC2136Driver struct {
+	server    string
+	keyName   string
+	secret    []byte
+	algorithm string
+	hash      func() hash.Hash
+	now       func() time.Time
+}
+
+func newRFC2136Driver(config config.RFC2136Config) (*RFC2136Driver, error) {
+	if config.Server == "" {
+		return nil, fmt.Errorf("rfc2136 needs a server")
+	}
+	d := &RFC2136Driver{server: config.Server, now: time.Now}
+	if _, _, err := net.SplitHostPort(d.server); err != nil {
+		d.server = net.JoinHostPort(d.server, "53")
+	}
+	if config.TSIGName == "" {
+		return d, nil
+	}
+
+	secret, err := base64.StdEncoding.DecodeString(config.TSIGSecret)
+	if err != nil || len(secret) == 0 {
+		return nil, fmt.Errorf("tsig_secret for %s isn't base64", config.TSIGName)
+	}
+	d.algorithm = strings.ToLower(strings.TrimSuffix(config.TSIGAlgorithm, "."))
+	if d.algorithm == "" {
+		d.algorithm = "hmac-sha256"
+	}
+	var found bool
+	if d.hash, found = tsigAlgorithms[d.algorithm]; !found {
+		return nil, fmt.Errorf("unknown tsig_algorithm %s", config.TSIGAlgorithm)
+	}
+	d.keyName = dnsName(config.TSIGName)
+	d.secret = secret
+	return d, nil
+}
+
+func (d *RFC2136Driver) Replace(zone config.DNSZone, name string, rrtype string, ttl int, values []string) error {
+	t, err := dnsType(rrtype)
+	if err != nil {
+		return err
+	}
+	u := newDNSUpdate(zone.Name)
+	u.rr(name, t, dnsClassANY, 0, nil)
+	for _, v := range values {
+		rdata, err := dnsRdata(t, v)
+		if err != nil {
+			return err
+		}
+		u.rr(name, t, dnsClassIN, uint32(ttl), rdata)
+	}
+	return d.send(u)
+}
+
+func (d *RFC2136Driver) Remove(zone config.DNSZone, name string, rrtype string, value string) error {
+	t, err := dnsType(rrtype)
+	if err != nil {
+		return err
+	}
+	rdata, err := dnsRdata(t, value)
+	if err != nil {
+		return err
+	}
+	u := newDNSUpdate(zone.Name)
+	u.rr(name, t, dnsClassNONE, 0, rdata)
+	return d.send(u)
+}
+
+func dnsType(rrtype string) (uint16, error) {
+	switch rrtype {
+	case "A":
+		return dnsTypeA, nil
+	case "AAAA":
+		return dnsTypeAAAA, nil
+	case "PTR":
+		return dnsTypePTR, nil
+	}
+	return 0, fmt.Errorf("unsupported record type %s", rrtype)
+}
+
+func dnsRdata(t uint16, value string) ([]byte, error) {
+	switch t {
+	case dnsTypeA, dnsTypeAAAA:
+		ip := net.ParseIP(value)
+		if v4 := ip.To4(); t == dnsTypeA && v4 != nil {
+			return v4, nil
+		}
+		if ip != nil && ip.To4() == nil && t == dnsTypeAAAA {
+			return ip.To16(), nil
+		}
+		return nil, fmt.Errorf("%s isn't an address for this record type", value)
+	}
+	return dnsWireName(value)
+}
+
+// A domain name in wire format, lower case and uncompressed
+func dnsWireName(name string) ([]byte, error) {
+	var b bytes.Buffer
+	for _, label := range strings.Split(strings.TrimSuffix(dnsName(name), "."), ".") {
+		if label == "" {
+			continue
+		}
+		if len(label) > 63 {
+			return nil, fmt.Errorf("label %s of %s is too long", label, name)
+		}
+		b.WriteByte(byte(len(label)))
+		b.WriteString(label)
+	}
+	b.WriteByte(0)
+	return b.Bytes(), nil
+}
+
+// An UPDATE message being built
+type dnsUpdate struct {
+	zone    string
+	id      uint16
+	records bytes.Buffer
+	count   uint16
+	err     error
+}
+
+func newDNSUpdate(zone string) *dnsUpdate {
+	var id [2]byte
+	rand.Read(id[:])
+	return &dnsUpdate{zone: zone, id: binary.BigEndian.Uint16(id[:])}
+}
+
+// Add a record to the update section
+func (u *dnsUpdate) rr(name string, t uint16, class uint16, ttl uint32, rdata []byte) {
+	wire, err := dnsWireName(name)
+	if err != nil {
+		u.err = err
+		return
+	}
+	u.records.Write(wire)
+	binary.Write(&u.records, binary.BigEndian, []uint16{t, class})
+	binary.Write(&u.records, binary.BigEndian, ttl)
+	binary.Write(&u.records, binary.BigEndian, uint16(len(rdata)))
+	u.records.Write(rdata)
+	u.count++
+}
+
+// The message, with additional records to be appended
+func (u *dnsUpdate) message(additional uint16) ([]byte, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	zone, err := dnsWireName(u.zone)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	binary.Write(&b, binary.BigEndian, []uint16{u.id, dnsOpcodeUpdate << 11, 1, 0, u.count, additional})
+	b.Write(zone)
+	binary.Write(&b, binary.BigEndian, []uint16{dnsTypeSOA, dnsClassIN})
+	b.Write(u.records.Bytes())
+	return b.Bytes(), nil
+}
+
+// The message of u with its TSIG record
+func (d *RFC2136Driver) sign(u *dnsUpdate) ([]byte, error) {
+	unsigned, err := u.message(0)
+	if err != nil {
+		return nil, err
+	}
+	keyName, _ := dnsWireName(d.keyName)
+	algorithm, _ := dnsWireName(d.algorithm)
+	signed := uint64(d.now().Unix())
+	timeSigned := []byte{byte(signed >> 40), byte(signed >> 32), byte(signed >> 24), byte(signed >> 16), byte(signed >> 8), byte(signed)}
+
+	var variables bytes.Buffer
+	variables.Write(keyName)
+	binary.Write(&variables, binary.BigEndian, uint16(dnsClassANY))
+	binary.Write(&variables, binary.BigEndian, uint32(0))
+	variables.Write(algorithm)
+	variables.Write(timeSigned)
+	binary.Write(&variables, binary.BigEndian, []uint16{tsigFudge, 0, 0})
+
+	mac := hmac.New(d.hash, d.secret)
+	mac.Write(unsigned)
+	mac.Write(variables.Bytes())
+	sum := mac.Sum(nil)
+
+	var rdata bytes.Buffer
+	rdata.Write(algorithm)
+	rdata.Write(timeSigned)
+	binary.Write(&rdata, binary.BigEndian, []uint16{tsigFudge, uint16(len(sum))})
+	rdata.Write(sum)
+	binary.Write(&rdata, binary.BigEndian, []uint16{u.id, 0, 0})
+
+	message, _ := u.message(1)
+	var b bytes.Buffer
+	b.Write(message)
+	b.Write(keyName)
+	binary.Write(&b, binary.BigEndian, []uint16{dnsTypeTSIG, dnsClassANY})
+	binary.Write(&b, binary.BigEndian, uint32(0))
+	binary.Write(&b, binary.BigEndian, uint16(rdata.Len()))
+	b.Write(rdata.Bytes())
+	return b.Bytes(), nil
+}
+
+func (d *RFC2136Driver) send(u *dnsUpdate) error {
+	var message []byte
+	var err error
+	if d.keyName != "" {
+		message, err = d.sign(u)
+	} else {
+		message, err = u.message(0)
+	}
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", d.server, dnsTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(dnsTimeout))
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(message)))
+	if _, err := conn.Write(append(length, message...)); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return fmt.Errorf("no answer from %s: %s", d.server, err)
+	}
+	answer := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, answer); err != nil || len(answer) < 12 {
+		return fmt.Errorf("short answer from %s", d.server)
+	}
+	if binary.BigEndian.Uint16(answer) != u.id {
+		return fmt.Errorf("answer from %s is for another message", d.server)
+	}
+	if rcode := int(answer[3] & 0xf); rcode != 0 {
+		name, found := dnsRcodes[rcode]
+		if !found {
+			name = fmt.Sprintf("rcode %d", rcode)
+		}
+		return fmt.Errorf("%s refused the update of %s: %s", d.server, u.zone, name)
+	}
+	return nil
+}
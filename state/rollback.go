@@ -0,0 +1,88 @@
+package state
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// What m is about to be built with
+func (state *State) buildVersions(m *machine.Machine, config configpkg.Config) *machine.BuildVersions {
+	v := &machine.BuildVersions{ConfigChecksum: config.Checksum, Definition: m.DefinitionChecksum()}
+	if state.Repo != nil {
+		v.DefinitionsCommit = state.Repo.Commit()
+	}
+	for _, name := range []string{m.Preseed, m.Finish} {
+		if name == "" {
+			continue
+		}
+		location := configpkg.JoinLocation(config.TemplatePath, name)
+		data, err := configpkg.StorageFor(location).Read(location)
+		if err != nil {
+			logger.Machine(m).Warn("cannot checksum template", "template", name, "error", err)
+			continue
+		}
+		if v.Templates == nil {
+			v.Templates = make(map[string]string)
+		}
+		sum := sha256.Sum256(data)
+		v.Templates[name] = hex.EncodeToString(sum[:])
+	}
+	return v
+}
+
+// The templates that are new, gone or changed between the builds armed with
+// built and now, as "template <name>"
+func templateChanges(built, now *machine.BuildVersions) []string {
+	var templates []string
+	for name, sum := range built.Templates {
+		if now.Templates[name] != sum {
+			templates = append(templates, name)
+		}
+	}
+	for name := range now.Templates {
+		if _, found := built.Templates[name]; !found {
+			templates = append(templates, name)
+		}
+	}
+	sort.Strings(templates)
+	changes := make([]string, 0, len(templates))
+	for _, name := range templates {
+		changes = append(changes, fmt.Sprintf("template %s", name))
+	}
+	return changes
+}
+
+// RollbackChanges is what rolling m back to the build target doesn't back
+// out: m gets the profile of target, but the templates and definitions
+// served now. Nil when target kept no versions.
+func (state *State) RollbackChanges(target *machine.HistoryEntry, m *machine.Machine, config configpkg.Config) []string {
+	if target.Versions == nil {
+		return nil
+	}
+	now := state.buildVersions(m, config)
+
+	var changes []string
+	if now.Definition != target.Versions.Definition {
+		changes = append(changes, "definition")
+	}
+	if now.DefinitionsCommit != target.Versions.DefinitionsCommit {
+		changes = append(changes, fmt.Sprintf("definitions commit %s", now.DefinitionsCommit))
+	}
+	return append(changes, templateChanges(target.Versions, now)...)
+}
+
+// RollbackResult is what POST /api/v1/build/<hostname>/rollback answers
+type RollbackResult struct {
+	State string
+	Token string
+	// The completed build rolled back to and its profile
+	RollbackOf string
+	Profile    string `json:",omitempty"`
+	// What the rollback kept from now, when it was forced
+	Changed []string `json:",omitempty"`
+}
@@ -0,0 +1,192 @@
+package state
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	configpkg "github.com/ns1/waitron/config"
+)
+
+// Records in Route 53 hosted zones, changed with ChangeResourceRecordSets and
+// requests signed like the S3 ones. The credentials come from the config or
+// the AWS_* environment variables. Deleting needs the record set exactly as
+// it is, so it is read first.
+
+const (
+	defaultRoute53Endpoint = "https://route53.amazonaws.com"
+	route53Namespace       = "https://route53.amazonaws.com/doc/2013-04-01/"
+	// Route 53 is global, signed for us-east-1
+	route53Region = "us-east-1"
+)
+
+type route53Driver struct {
+	endpoint string
+	config   configpkg.S3Config
+	client   *http.Client
+	now      func() time.Time
+}
+
+type route53RecordSet struct {
+	Name    string          `xml:"Name"`
+	Type    string          `xml:"Type"`
+	TTL     int             `xml:"TTL"`
+	Records []route53Record `xml:"ResourceRecords>ResourceRecord"`
+}
+
+type route53Record struct {
+	Value string `xml:"Value"`
+}
+
+type route53Change struct {
+	Action string           `xml:"Action"`
+	Set    route53RecordSet `xml:"ResourceRecordSet"`
+}
+
+type route53ChangeRequest struct {
+	XMLName xml.Name        `xml:"ChangeResourceRecordSetsRequest"`
+	Xmlns   string          `xml:"xmlns,attr"`
+	Changes []route53Change `xml:"ChangeBatch>Changes>Change"`
+}
+
+type route53Error struct {
+	Code    string `xml:"Error>Code"`
+	Message string `xml:"Error>Message"`
+}
+
+func newRoute53Driver(config configpkg.Route53Config) *route53Driver {
+	endpoint := strings.TrimRight(config.Endpoint, "/")
+	if endpoint == "" {
+		endpoint = defaultRoute53Endpoint
+	}
+	return &route53Driver{
+		endpoint: endpoint,
+		config: configpkg.AWSFromEnv(configpkg.S3Config{
+			Region:       route53Region,
+			AccessKey:    config.AccessKey,
+			SecretKey:    config.SecretKey,
+			SessionToken: config.SessionToken,
+		}),
+		client: &http.Client{Timeout: dnsTimeout},
+		now:    time.Now,
+	}
+}
+
+func (d *route53Driver) Replace(zone configpkg.DNSZone, name string, rrtype string, ttl int, values []string) error {
+	if len(values) == 0 {
+		current, err := d.get(zone, name, rrtype)
+		if err != nil || current == nil {
+			return err
+		}
+		return d.change(zone, route53Change{Action: "DELETE", Set: *current})
+	}
+	set := route53RecordSet{Name: name, Type: rrtype, TTL: ttl}
+	for _, v := range values {
+		set.Records = append(set.Records, route53Record{Value: v})
+	}
+	return d.change(zone, route53Change{Action: "UPSERT", Set: set})
+}
+
+func (d *route53Driver) Remove(zone configpkg.DNSZone, name string, rrtype string, value string) error {
+	current, err := d.get(zone, name, rrtype)
+	if err != nil || current == nil {
+		return err
+	}
+	rest := *current
+	rest.Records = nil
+	for _, r := range current.Records {
+		if !strings.EqualFold(r.Value, value) {
+			rest.Records = append(rest.Records, r)
+		}
+	}
+	switch {
+	case len(rest.Records) == len(current.Records):
+		return nil
+	case len(rest.Records) == 0:
+		return d.change(zone, route53Change{Action: "DELETE", Set: *current})
+	}
+	return d.change(zone, route53Change{Action: "UPSERT", Set: rest})
+}
+
+func (d *route53Driver) zoneURL(zone configpkg.DNSZone, path string, query url.Values) string {
+	id := strings.TrimPrefix(zone.ID, "/hostedzone/")
+	u := d.endpoint + "/2013-04-01/hostedzone/" + configpkg.S3Escape(id, true) + path
+	if len(query) > 0 {
+		u += "?" + configpkg.S3Query(query)
+	}
+	return u
+}
+
+// The record set of rrtype at name, nil when there is none
+func (d *route53Driver) get(zone configpkg.DNSZone, name string, rrtype string) (*route53RecordSet, error) {
+	query := url.Values{"name": {name}, "type": {rrtype}, "maxitems": {"1"}}
+	var list struct {
+		Sets []route53RecordSet `xml:"ResourceRecordSets>ResourceRecordSet"`
+	}
+	if err := d.do("GET", d.zoneURL(zone, "/rrset", query), nil, &list); err != nil {
+		return nil, err
+	}
+	// Listing starts at name, what comes back may be the next one
+	for _, s := range list.Sets {
+		if dnsName(s.Name) == dnsName(name) && s.Type == rrtype {
+			return &s, nil
+		}
+	}
+	return nil, nil
+}
+
+func (d *route53Driver) change(zone configpkg.DNSZone, change route53Change) error {
+	body, err := xml.Marshal(route53ChangeRequest{Xmlns: route53Namespace, Changes: []route53Change{change}})
+	if err != nil {
+		return err
+	}
+	return d.do("POST", d.zoneURL(zone, "/rrset/", nil), append([]byte(xml.Header), body...), nil)
+}
+
+func (d *route53Driver) do(method string, u string, body []byte, result interface{}) error {
+	request, err := http.NewRequest(method, u, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+	request.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(sum[:]))
+	if body != nil {
+		request.Header.Set("Content-Type", "text/xml")
+	}
+	// Signed with the credentials as they are now
+	credentials := d.config
+	for _, v := range []*string{&credentials.AccessKey, &credentials.SecretKey, &credentials.SessionToken} {
+		if *v, err = configpkg.ResolveSecret(*v); err != nil {
+			return err
+		}
+	}
+	configpkg.SignAWSRequest(request, credentials, "route53", d.now())
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		var e route53Error
+		if xml.Unmarshal(data, &e) == nil && e.Code != "" {
+			return fmt.Errorf("route53 %s %s: %s", e.Code, request.URL.Path, e.Message)
+		}
+		return fmt.Errorf("route53 %s %s: %s", method, request.URL.Path, response.Status)
+	}
+	if result == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, result)
+}
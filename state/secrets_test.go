@@ -0,0 +1,72 @@
+package state
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+)
+
+func TestDriverSecrets(t *testing.T) {
+	var credentials []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, header := range []string{"Authorization", "Token", "X-Amz-Security-Token"} {
+			if v := r.Header.Get(header); v != "" {
+				credentials = append(credentials, header+": "+strings.SplitN(v, "/", 2)[0])
+			}
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/api2/json"):
+			io.WriteString(w, `{"data": null}`)
+		case strings.HasPrefix(r.URL.Path, "/api/waitron"):
+			io.WriteString(w, `{"success": true}`)
+		default:
+			io.WriteString(w, `{}`)
+		}
+	}))
+	defer server.Close()
+	defer os.Unsetenv("WAITRON_TEST_SECRET")
+
+	p, err := newProxmox(config.ProxmoxConfig{URL: server.URL, TokenID: "waitron@pve!build", TokenSecret: "env:WAITRON_TEST_SECRET"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	netbox := newNetBoxIPAMDriver(config.NetBoxIPAMConfig{URL: server.URL, Token: "env:WAITRON_TEST_SECRET"})
+	phpipam := NewPHPIPAMDriver(config.PHPIPAMConfig{URL: server.URL, App: "waitron", Token: "env:WAITRON_TEST_SECRET"})
+	route53 := newRoute53Driver(config.Route53Config{Endpoint: server.URL, AccessKey: "env:WAITRON_TEST_SECRET", SecretKey: "secret", SessionToken: "env:WAITRON_TEST_SECRET"})
+	call := func() error {
+		if err := p.do("GET", "/version", nil, nil); err != nil {
+			return err
+		}
+		if _, err := netbox.do("GET", "/ip-addresses/", nil, nil); err != nil {
+			return err
+		}
+		if _, _, err := phpipam.do("GET", "/addresses/", nil); err != nil {
+			return err
+		}
+		return route53.do("GET", server.URL+"/2013-04-01/hostedzone/Z123/rrset", nil, nil)
+	}
+
+	// Read for every request, rotated secrets are picked up
+	for _, secret := range []string{"first", "second"} {
+		os.Setenv("WAITRON_TEST_SECRET", secret)
+		credentials = nil
+		if err := call(); err != nil {
+			t.Fatal(err)
+		}
+		expected := "Authorization: PVEAPIToken=waitron@pve!build=" + secret + ", Authorization: Token " + secret +
+			", Token: " + secret + ", Authorization: AWS4-HMAC-SHA256 Credential=" + secret + ", X-Amz-Security-Token: " + secret
+		if strings.Join(credentials, ", ") != expected {
+			t.Errorf("expected %s, got %v", expected, credentials)
+		}
+	}
+
+	os.Unsetenv("WAITRON_TEST_SECRET")
+	if err := call(); err == nil || !strings.Contains(err.Error(), "is not set") {
+		t.Errorf("expected a secret that can't be read to fail the request, got %v", err)
+	}
+}
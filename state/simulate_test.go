@@ -0,0 +1,50 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestSimulateBuildCommands(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-simulate")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "dns02.example.com.yaml"),
+		[]byte(`{"operatingsystem": "ubuntu", "network": [{"name": "eth0", "macaddress": "de:ad:c0:de:ca:fe"}]}`), 0644)
+	ran := filepath.Join(dir, "ran")
+	commands := []config.BuildCommand{{Command: "touch " + ran, ErrorsFatal: true}}
+	config := config.Config{MachinePath: dir, GroupPath: dir, Simulate: true,
+		PreBuildCommands: commands, PostBuildCommands: commands, CancelBuildCommands: commands, StaleBuildCommands: commands}
+	state := New()
+
+	for _, done := range []bool{true, false} {
+		m, err := machine.MachineDefinition("dns02.example.com", dir, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := state.SetBuildMode(m, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		building := state.MachineByToken(token)
+		if err := building.RunBuildCommands(building.StaleBuildCommands); err != nil {
+			t.Fatal(err)
+		}
+		if done {
+			err = state.DoneBuildMode(*building, config)
+		} else {
+			err = state.CancelBuildMode(*building, config, "")
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := os.Stat(ran); err == nil {
+		t.Error("expected a simulated build to run no build commands")
+	}
+}
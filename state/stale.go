@@ -0,0 +1,327 @@
+package state
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Every build gets a timer for its own stale_build_threshold_secs, plus a
+// random delay of up to stale_build_jitter_secs so a rack that started
+// together doesn't run its stale commands all at once. A build is reported
+// stale once: the event is emitted and the stale commands and hooks run on
+// first detection only. A threshold of 0 turns the check off. A build with
+// build_retries left is retried, see retry.go. Otherwise, with
+// cancel_stale_builds the build is cancelled, as if by a request to
+// /cancel: it leaves build mode, its token stops working, its addresses are
+// released and the cancelbuild commands and post and cancel hooks run.
+//
+// With stale_silence_secs, a build whose installer started, by fetching its
+// preseed or cloud-init, is told apart by whether it is still heard from: a
+// heartbeat to /heartbeat/<hostname>/<token>, a progress report or a template
+// fetch. One silent for stale_silence_secs is stale as silent right away,
+// without waiting for the threshold. One still heard from is slow: it is held
+// to stale_active_build_threshold_secs instead, if set, and once past it the
+// event is emitted and the stale commands and hooks run, but it is neither
+// retried nor cancelled. A slow build can still go silent later.
+//
+// Timers are set up from the build-started event. Every
+// stale_build_check_frequency_secs a sweep catches builds that have no timer
+// and drops timers of builds that are gone.
+
+const defaultStaleBuildJitterSeconds = 30
+
+type staleWatcher struct {
+	config config.Config
+	state  *State
+
+	mux    sync.Mutex
+	timers map[string]*time.Timer // by token
+	fired  map[string]string      // how tokens were reported stale
+
+	// Random delay up to max, replaced in tests
+	jitter func(max time.Duration) time.Duration
+}
+
+func NewStaleWatcher(config config.Config, state *State) *staleWatcher {
+	return &staleWatcher{
+		config: config,
+		state:  state,
+		timers: make(map[string]*time.Timer),
+		fired:  make(map[string]string),
+		jitter: func(max time.Duration) time.Duration {
+			if max <= 0 {
+				return 0
+			}
+			return time.Duration(rand.Int63n(int64(max)))
+		},
+	}
+}
+
+// Follow builds on the event bus and sweep every interval, until the state is
+// closed
+func (w *staleWatcher) Start(interval time.Duration) {
+	w.state.Events.Subscribe(func(e Event) {
+		switch e.Type {
+		case machine.EventBuildStarted:
+			if e.Machine != nil {
+				w.schedule(e.Machine)
+			}
+		case machine.EventBuildCompleted, machine.EventBuildCancelled:
+			w.forget(e.Token)
+		case machine.EventBuildStateChanged:
+			// The installer started, it can go silent from now on
+			if e.Machine != nil && e.Machine.State == machine.BuildInstalling {
+				w.reschedule(e.Machine)
+			}
+		case machine.EventBuildRetried:
+			// The build starts over, it can go stale again
+			w.forget(e.Token)
+			if e.Machine != nil {
+				w.schedule(e.Machine)
+			}
+		default:
+			// Passing the last pre-install stage starts the build over too
+			if isStagePassed(e.Type) {
+				w.forget(e.Token)
+				if e.Machine != nil {
+					w.schedule(e.Machine)
+				}
+			}
+		}
+	})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.state.Stopped():
+				return
+			case <-ticker.C:
+				w.Sweep()
+			}
+		}
+	}()
+}
+
+// Set a timer for the build of m unless it has one or was already reported,
+// other than as slow. m must not be shared, pass a snapshot.
+func (w *staleWatcher) schedule(m *machine.Machine) {
+	if m.Token == "" || m.StaleBuildThresholdSeconds <= 0 {
+		return
+	}
+
+	jitter := time.Duration(defaultStaleBuildJitterSeconds) * time.Second
+	if m.StaleBuildJitterSeconds != 0 {
+		jitter = time.Duration(m.StaleBuildJitterSeconds) * time.Second
+	}
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	reported := w.fired[m.Token]
+	if _, found := w.timers[m.Token]; found || (reported != "" && reported != machine.StaleSlow) {
+		return
+	}
+	now := time.Now()
+	kind, due := m.Staleness(now)
+	if kind != "" && kind != reported {
+		due = now
+	}
+	if due.IsZero() {
+		return
+	}
+	delay := due.Sub(now) + w.jitter(jitter)
+	if delay < 0 {
+		delay = 0
+	}
+	token := m.Token
+	w.timers[token] = time.AfterFunc(delay, func() { w.fire(token) })
+}
+
+// Set the timer of the build of m again, keeping what it was reported as
+func (w *staleWatcher) reschedule(m *machine.Machine) {
+	if m.StaleSilenceSeconds <= 0 {
+		return
+	}
+
+	w.mux.Lock()
+	if t, found := w.timers[m.Token]; found {
+		t.Stop()
+		delete(w.timers, m.Token)
+	}
+	w.mux.Unlock()
+
+	w.schedule(m)
+}
+
+func (w *staleWatcher) forget(token string) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if t, found := w.timers[token]; found {
+		t.Stop()
+		delete(w.timers, token)
+	}
+	delete(w.fired, token)
+}
+
+// The timer stays in timers until the build is marked, so neither a sweep nor
+// a start event sets another one for it in the meantime
+func (w *staleWatcher) fire(token string) {
+	var snapshot machine.Machine
+	kind := ""
+	m := w.state.MachineByToken(token)
+	if m != nil {
+		w.state.Mux.Lock()
+		snapshot = *m
+		w.state.Mux.Unlock()
+		kind, _ = snapshot.Staleness(time.Now())
+	}
+
+	// Heard from since the timer was set, or slow and not silent yet, unless
+	// it was reported already
+	w.mux.Lock()
+	delete(w.timers, token)
+	reported := w.fired[token]
+	pending := m != nil && (reported == "" || reported == machine.StaleSlow)
+	report := pending && kind != "" && kind != reported
+	if report {
+		w.fired[token] = kind
+	}
+	w.mux.Unlock()
+
+	if report {
+		w.state.reportStale(m, w.config, kind)
+	}
+	if pending {
+		w.schedule(&snapshot)
+	}
+}
+
+// Schedule builds without a timer and drop the timers of finished builds
+func (w *staleWatcher) Sweep() {
+	w.state.Mux.Lock()
+	building := make(map[string]machine.Machine, len(w.state.MachineByUUID))
+	for token, m := range w.state.MachineByUUID {
+		building[token] = *m
+	}
+	w.state.Mux.Unlock()
+
+	for token, m := range building {
+		m := m
+		m.Token = token
+		w.schedule(&m)
+	}
+
+	w.mux.Lock()
+	var gone []string
+	for token := range w.timers {
+		if _, found := building[token]; !found {
+			gone = append(gone, token)
+		}
+	}
+	for token := range w.fired {
+		if _, found := building[token]; !found {
+			gone = append(gone, token)
+		}
+	}
+	w.mux.Unlock()
+
+	for _, token := range gone {
+		w.forget(token)
+	}
+}
+
+// Report the build of m stale, however it is at the moment
+func (state *State) markStale(m *machine.Machine, config config.Config) {
+	state.Mux.Lock()
+	kind, _ := m.Staleness(time.Now())
+	state.Mux.Unlock()
+	if kind == "" {
+		kind = machine.StaleOverdue
+	}
+	state.reportStale(m, config, kind)
+}
+
+// Report the build of m stale as kind and run the stale commands and hooks.
+// A slow build is neither retried nor cancelled, its installer is working.
+func (state *State) reportStale(m *machine.Machine, config config.Config, kind string) {
+	state.Mux.Lock()
+	waiting := m.State == machine.BuildValidating || machine.StageFor(m.State) != nil
+	heard := m.LastHeard()
+	state.Mux.Unlock()
+	if waiting {
+		// Validation and pre-install stages have timeouts of their own
+		return
+	}
+
+	reason, message := "", fmt.Sprintf("building since %s", m.BuildStart.Format(time.RFC3339))
+	switch kind {
+	case machine.StaleSilent:
+		reason = kind
+		message = fmt.Sprintf("silent since %s, %s", heard.Format(time.RFC3339), message)
+	case machine.StaleSlow:
+		reason = kind
+		message = fmt.Sprintf("still working, %s, last heard from %s", message, heard.Format(time.RFC3339))
+	}
+
+	state.Transition(m, machine.BuildStale, reason)
+	state.Emit(machine.EventBuildStale, m, message)
+	state.Workers.Submit(m.Hostname, func() {
+		if err := m.RunBuildCommands(m.StaleBuildCommands); err != nil {
+			logger.Machine(m).Error("stale build commands failed", "error", err)
+		}
+
+		if err := state.runWorkerHooks(machine.StageStale, m, config); err != nil {
+			logger.With("stage", machine.StageStale).Machine(m).Error("stale hooks failed", "error", err)
+		}
+
+		if kind == machine.StaleSlow {
+			return
+		}
+		if state.RetryBuild(m, config, "stale") {
+			return
+		}
+		// The build may have finished while the stale hooks ran
+		if m.CancelStaleBuilds && state.MachineByToken(m.Token) == m {
+			state.cancelStaleBuild(m, config)
+		}
+	})
+}
+
+// Record a heartbeat from the installer of the build identified by token
+func (state *State) Heartbeat(token string) error {
+	state.Mux.Lock()
+	defer state.Mux.Unlock()
+
+	m, found := state.MachineByUUID[token]
+	if !found {
+		return ErrUnknownBuild
+	}
+	m.LastHeartbeat = time.Now()
+	state.Version++
+	return nil
+}
+
+// Take the stale build of m out of build mode like a cancel request would,
+// on the worker for m
+func (state *State) cancelStaleBuild(m *machine.Machine, config config.Config) {
+	logger.Machine(m).Warn("cancelling stale build", "threshold", m.StaleBuildThresholdSeconds)
+	if err := state.CancelBuildMode(*m, config, "stale"); err != nil {
+		logger.Machine(m).Error("failed to cancel stale build", "error", err)
+		return
+	}
+
+	for _, stage := range []string{machine.StagePostHook, machine.StageCancel} {
+		if err := state.runWorkerHooks(stage, m, config); err != nil {
+			logger.With("stage", stage).Machine(m).Error("cancel hooks failed", "error", err)
+			return
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package state
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func staleTestBuild(state *State, token string, threshold int, started time.Time) *machine.Machine {
+	m := &machine.Machine{Hostname: token + ".example.com", Token: token, BuildStart: started}
+	m.StaleBuildThresholdSeconds = threshold
+	m.StaleBuildJitterSeconds = -1
+	m.Network = []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe"}}
+
+	state.Mux.Lock()
+	state.MachineByUUID[token] = m
+	state.MachineByHostname[m.Hostname] = m
+	state.Mux.Unlock()
+	return m
+}
+
+type staleEvents struct {
+	mux    sync.Mutex
+	events []Event
+}
+
+func (s *staleEvents) record(e Event) {
+	if e.Type == machine.EventBuildStale {
+		s.mux.Lock()
+		s.events = append(s.events, e)
+		s.mux.Unlock()
+	}
+}
+
+func (s *staleEvents) count() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return len(s.events)
+}
+
+func TestStaleWatcherFiresOnce(t *testing.T) {
+	state := New()
+	var stale staleEvents
+	state.Events.Subscribe(stale.record)
+
+	w := NewStaleWatcher(config.Config{}, state)
+	m := staleTestBuild(state, "overdue", 60, time.Now().Add(-time.Hour))
+
+	snapshot := *m
+	w.schedule(&snapshot)
+	time.Sleep(50 * time.Millisecond)
+
+	// Neither a sweep nor a repeated start event reports it again
+	w.Sweep()
+	w.schedule(&snapshot)
+	time.Sleep(50 * time.Millisecond)
+
+	if n := stale.count(); n != 1 {
+		t.Errorf("expected one stale event, got %d", n)
+	}
+}
+
+func TestStaleWatcherFiresOnceConcurrently(t *testing.T) {
+	state := New()
+	var stale staleEvents
+	state.Events.Subscribe(stale.record)
+
+	w := NewStaleWatcher(config.Config{}, state)
+	staleTestBuild(state, "overdue", 60, time.Now().Add(-time.Hour))
+
+	// Timers set by a sweep and a start event at once
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.fire("overdue")
+		}()
+	}
+	wg.Wait()
+	time.Sleep(50 * time.Millisecond)
+
+	if n := stale.count(); n != 1 {
+		t.Errorf("expected one stale event, got %d", n)
+	}
+}
+
+func TestStaleWatcherHonorsThreshold(t *testing.T) {
+	state := New()
+	var stale staleEvents
+	state.Events.Subscribe(stale.record)
+
+	w := NewStaleWatcher(config.Config{}, state)
+	m := staleTestBuild(state, "fresh", 3600, time.Now())
+	w.Sweep()
+
+	time.Sleep(50 * time.Millisecond)
+	if n := stale.count(); n != 0 {
+		t.Errorf("expected no stale events, got %d", n)
+	}
+
+	w.mux.Lock()
+	_, scheduled := w.timers[m.Token]
+	w.mux.Unlock()
+	if !scheduled {
+		t.Error("expected the sweep to schedule the build")
+	}
+}
+
+func TestStaleWatcherJitter(t *testing.T) {
+	state := New()
+	w := NewStaleWatcher(config.Config{}, state)
+
+	var max time.Duration
+	w.jitter = func(d time.Duration) time.Duration {
+		max = d
+		return 0
+	}
+
+	m := staleTestBuild(state, "jittered", 3600, time.Now())
+	m.StaleBuildJitterSeconds = 0
+	w.schedule(m)
+	if max != defaultStaleBuildJitterSeconds*time.Second {
+		t.Errorf("expected the default jitter, got %s", max)
+	}
+	w.forget(m.Token)
+
+	m.StaleBuildJitterSeconds = 5
+	w.schedule(m)
+	if max != 5*time.Second {
+		t.Errorf("expected 5s of jitter, got %s", max)
+	}
+	w.forget(m.Token)
+}
+
+func TestStaleWatcherForget(t *testing.T) {
+	state := New()
+	var stale staleEvents
+	state.Events.Subscribe(stale.record)
+
+	w := NewStaleWatcher(config.Config{}, state)
+	w.Start(time.Hour)
+
+	m := staleTestBuild(state, "done-in-time", 3600, time.Now())
+	state.Emit(machine.EventBuildStarted, m, "")
+
+	w.mux.Lock()
+	scheduled := len(w.timers)
+	w.mux.Unlock()
+	if scheduled != 1 {
+		t.Fatalf("expected a timer from the start event, got %d", scheduled)
+	}
+
+	state.Emit(machine.EventBuildCompleted, m, "")
+
+	w.mux.Lock()
+	scheduled = len(w.timers)
+	w.mux.Unlock()
+	if scheduled != 0 {
+		t.Errorf("expected the timer to go with the build, got %d", scheduled)
+	}
+}
+
+func TestStaleWatcherDisabled(t *testing.T) {
+	state := New()
+	w := NewStaleWatcher(config.Config{}, state)
+
+	m := staleTestBuild(state, "unchecked", 0, time.Now().Add(-time.Hour))
+	w.schedule(m)
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	if len(w.timers) != 0 {
+		t.Error("expected no timer without a threshold")
+	}
+}
+
+func TestStaleWatcherCancels(t *testing.T) {
+	state := New()
+	cancelled := make(chan Event, 1)
+	state.Events.Subscribe(func(e Event) {
+		if e.Type == machine.EventBuildCancelled {
+			cancelled <- e
+		}
+	})
+
+	w := NewStaleWatcher(config.Config{}, state)
+	m := staleTestBuild(state, "abandoned", 60, time.Now().Add(-time.Hour))
+	m.CancelStaleBuilds = true
+	kept := staleTestBuild(state, "watched", 60, time.Now().Add(-time.Hour))
+	kept.Network = []machine.Interface{{MacAddress: "de:ad:c0:de:ca:ff"}}
+	w.Sweep()
+
+	select {
+	case e := <-cancelled:
+		if e.Token != "abandoned" || e.Message != "stale" {
+			t.Errorf("unexpected event %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the stale build to be cancelled")
+	}
+
+	state.Mux.Lock()
+	_, building := state.MachineByUUID["abandoned"]
+	_, stillBuilding := state.MachineByUUID["watched"]
+	state.Mux.Unlock()
+	if building || !stillBuilding {
+		t.Errorf("expected only the build with cancel_stale_builds to be cancelled, got %v %v", building, stillBuilding)
+	}
+}
+
+// The stages a State ran hooks for, see State.Hooks
+type recordedHooks struct {
+	mux    sync.Mutex
+	stages []string
+}
+
+func (r *recordedHooks) RunHooks(stage string, m *machine.Machine, config config.Config, state *State, request *http.Request) error {
+	return r.RunWorkerHooks(stage, m, config, state)
+}
+
+func (r *recordedHooks) RunWorkerHooks(stage string, m *machine.Machine, config config.Config, state *State) error {
+	r.mux.Lock()
+	r.stages = append(r.stages, stage)
+	r.mux.Unlock()
+	return nil
+}
+
+func (r *recordedHooks) ran() []string {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return append([]string(nil), r.stages...)
+}
+
+func TestStaleWatcherRunsHooks(t *testing.T) {
+	state := New()
+	hooks := &recordedHooks{}
+	state.Hooks = hooks
+
+	w := NewStaleWatcher(config.Config{}, state)
+	m := staleTestBuild(state, "abandoned", 60, time.Now().Add(-time.Hour))
+	m.CancelStaleBuilds = true
+	w.Sweep()
+
+	expected := []string{machine.StageStale, machine.StagePostHook, machine.StageCancel}
+	deadline := time.Now().Add(time.Second)
+	for len(hooks.ran()) < len(expected) && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if ran := hooks.ran(); strings.Join(ran, " ") != strings.Join(expected, " ") {
+		t.Errorf("expected the %v hooks to run, got %v", expected, ran)
+	}
+}
@@ -0,0 +1,123 @@
+package state
+
+import (
+	"sync"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/template"
+)
+
+// State holds the machines currently in build mode
+type State struct {
+	Mux sync.Mutex
+	// Held by build requests from checking for a build in progress until
+	// the new one is armed, so a host is only ever in build mode once
+	BuildRequestMux sync.Mutex
+	// Held by writes to machine definition files, so checking the version
+	// and writing are one step
+	DefinitionsMux    sync.Mutex
+	Tokens            map[string]string
+	MachineByUUID     map[string]*machine.Machine
+	MachineByMAC      map[string]*machine.Machine
+	MachineByHostname map[string]*machine.Machine
+
+	// Persistent storage for data outside of the YAML definitions
+	Store Store
+
+	Events *eventBus
+
+	// Machine definitions by hostname, MAC and label, see machine/inventory.go
+	Inventory *machine.Inventory
+
+	// Downloaded boot images, nil when none are configured
+	Images *imageCatalog
+
+	// Git repository the definitions and templates come from, nil without one
+	Repo *machine.GitRepo
+
+	// Address pools and what they handed out, nil without ipam
+	IPAM *IPAM
+
+	// Publishes the records of built machines, nil without dns
+	DNS *DNSUpdater
+
+	// Creates and boots VMs being built, nil without proxmox, libvirt or vsphere
+	VMs vmDriver
+
+	// Rendered templates, used when Config.TemplateCache is set
+	RenderCache *template.RenderCache
+
+	// Evicts finished build records from Store
+	Retention *buildRetention
+
+	// Build durations and outcomes per os and group, fed from Events
+	Stats *buildStats
+
+	// Serializes updates to host histories in Store, see history.go
+	historyMux sync.Mutex
+
+	// Runs hooks and stale build commands
+	Workers *workerPool
+
+	// Runs the hooks of what happens to builds without a request, such as
+	// stale builds and failed stages, none when nil
+	Hooks hookRunner
+
+	// Holds the hosts of bulk builds until they can start, see bulk.go
+	Bulk *bulkScheduler
+
+	// Hosts whose definition changed since their last build, see drift.go
+	Drift *driftDetector
+
+	// Bumped on every change to the machine tables, used as the /status ETag
+	Version            uint64
+	StatusCache        []byte
+	StatusCacheVersion uint64
+
+	// Set once all templates have been parsed at startup
+	TemplatesWarm  bool
+	TemplatesError error
+
+	// Receives a reason when something other than a signal asks waitron to
+	// drain and exit, e.g. a handover to a new process
+	Shutdown chan string
+
+	// Closed by Close to stop the background work
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// New returns a State without any builds that keeps them in memory and runs
+// no hooks of its own, NewStore and Hooks change that
+func New() *State {
+	s := &State{}
+
+	// Initialize maps
+	s.Tokens = make(map[string]string)
+	s.MachineByUUID = make(map[string]*machine.Machine)
+	s.MachineByMAC = make(map[string]*machine.Machine)
+	s.MachineByHostname = make(map[string]*machine.Machine)
+	s.Store = NewMemoryStore()
+	s.Events = newEventBus()
+	s.RenderCache = template.NewRenderCache()
+	s.Stats = newBuildStats()
+	s.Events.Subscribe(s.Stats.record)
+	s.Events.Subscribe(s.watchOverdue)
+	s.Workers = NewWorkerPool(defaultHookWorkers)
+	s.Retention, _ = NewBuildRetention(config.BuildRetentionConfig{}, s.Store, false)
+	s.Shutdown = make(chan string, 1)
+	s.stopped = make(chan struct{})
+	return s
+}
+
+// Close stops the background work started for the state, such as the stale
+// build, retention and drift checks. Builds are left as they are.
+func (state *State) Close() {
+	state.closeOnce.Do(func() { close(state.stopped) })
+}
+
+// Stopped is closed once the state is closed
+func (state *State) Stopped() <-chan struct{} {
+	return state.stopped
+}
@@ -0,0 +1,193 @@
+package state
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/ns1/waitron/config"
+)
+
+// Store persists state that should outlive a single build, such as operator
+// annotations, independent of the YAML definitions.
+type Store interface {
+	Get(bucket string, key string, v interface{}) (bool, error)
+	Put(bucket string, key string, v interface{}) error
+	Delete(bucket string, key string) error
+	List(bucket string) ([]string, error)
+	Ping() error
+}
+
+// Picks the store backend from config: a directory of JSON files when
+// statepath is set, otherwise process memory.
+func NewStore(config config.Config) (Store, error) {
+	if config.StatePath == "" {
+		return NewMemoryStore(), nil
+	}
+	return newFileStore(config.StatePath)
+}
+
+type memoryStore struct {
+	mux  sync.Mutex
+	data map[string]map[string][]byte
+}
+
+func NewMemoryStore() *memoryStore {
+	return &memoryStore{data: make(map[string]map[string][]byte)}
+}
+
+func (s *memoryStore) Get(bucket string, key string, v interface{}) (bool, error) {
+	s.mux.Lock()
+	data, found := s.data[bucket][key]
+	s.mux.Unlock()
+
+	if !found {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func (s *memoryStore) Put(bucket string, key string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.data[bucket] == nil {
+		s.data[bucket] = make(map[string][]byte)
+	}
+	s.data[bucket][key] = data
+	return nil
+}
+
+func (s *memoryStore) Delete(bucket string, key string) error {
+	s.mux.Lock()
+	delete(s.data[bucket], key)
+	s.mux.Unlock()
+	return nil
+}
+
+func (s *memoryStore) List(bucket string) ([]string, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	keys := make([]string, 0, len(s.data[bucket]))
+	for k := range s.data[bucket] {
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+func (s *memoryStore) Ping() error {
+	return nil
+}
+
+// fileStore keeps one JSON file per key under <dir>/<bucket>/
+type fileStore struct {
+	dir string
+	mux sync.Mutex
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) keyPath(bucket string, key string) (string, error) {
+	if strings.ContainsAny(bucket+key, "/\\") || strings.HasPrefix(key, ".") || key == "" {
+		return "", errors.New("invalid store key " + bucket + "/" + key)
+	}
+	return path.Join(s.dir, bucket, key+".json"), nil
+}
+
+func (s *fileStore) Get(bucket string, key string, v interface{}) (bool, error) {
+	p, err := s.keyPath(bucket, key)
+	if err != nil {
+		return false, err
+	}
+
+	s.mux.Lock()
+	data, err := ioutil.ReadFile(p)
+	s.mux.Unlock()
+
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func (s *fileStore) Put(bucket string, key string, v interface{}) error {
+	p, err := s.keyPath(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err := os.MkdirAll(path.Dir(p), 0700); err != nil {
+		return err
+	}
+
+	// Write then rename so readers never see a half written file
+	if err := ioutil.WriteFile(p+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(p+".tmp", p)
+}
+
+func (s *fileStore) Delete(bucket string, key string) error {
+	p, err := s.keyPath(bucket, key)
+	if err != nil {
+		return err
+	}
+
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (s *fileStore) List(bucket string) ([]string, error) {
+	s.mux.Lock()
+	files, err := ioutil.ReadDir(path.Join(s.dir, bucket))
+	s.mux.Unlock()
+
+	keys := make([]string, 0, len(files))
+	if os.IsNotExist(err) {
+		return keys, nil
+	} else if err != nil {
+		return keys, err
+	}
+
+	for _, file := range files {
+		if name := file.Name(); path.Ext(name) == ".json" {
+			keys = append(keys, strings.TrimSuffix(name, ".json"))
+		}
+	}
+	return keys, nil
+}
+
+func (s *fileStore) Ping() error {
+	_, err := ioutil.ReadDir(s.dir)
+	return err
+}
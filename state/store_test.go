@@ -0,0 +1,64 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func testStore(t *testing.T, s Store) {
+	type item struct{ Name string }
+
+	if err := s.Put("things", "one", &item{Name: "first"}); err != nil {
+		t.Fatalf("Put failed: %s", err)
+	}
+
+	var got item
+	found, err := s.Get("things", "one", &got)
+	if err != nil || !found {
+		t.Fatalf("Get failed: found=%v err=%v", found, err)
+	}
+	if got.Name != "first" {
+		t.Errorf("expected first, got %s", got.Name)
+	}
+
+	keys, _ := s.List("things")
+	if len(keys) != 1 || keys[0] != "one" {
+		t.Errorf("expected [one], got %v", keys)
+	}
+
+	if err := s.Delete("things", "one"); err != nil {
+		t.Errorf("Delete failed: %s", err)
+	}
+	if found, _ := s.Get("things", "one", &got); found {
+		t.Errorf("expected key to be deleted")
+	}
+	if err := s.Ping(); err != nil {
+		t.Errorf("Ping failed: %s", err)
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore())
+}
+
+func TestFileStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-store")
+	defer os.RemoveAll(dir)
+
+	s, err := newFileStore(dir)
+	if err != nil {
+		t.Fatalf("Failed to create file store: %s", err)
+	}
+	testStore(t, s)
+}
+
+func TestFileStoreRejectsPathTraversal(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-store")
+	defer os.RemoveAll(dir)
+
+	s, _ := newFileStore(dir)
+	if err := s.Put("things", "../escape", "x"); err == nil {
+		t.Errorf("expected an error for a key containing a path separator")
+	}
+}
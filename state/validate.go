@@ -0,0 +1,237 @@
+package state
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// How often the checks run, replaced in tests
+var ValidationInterval = 10 * time.Second
+
+var errNotValidating = errors.New("build is not validating")
+
+// Take the build of m out of build mode now that /done was called, after
+// validating it if it has checks. A build already validating is left to
+// it, one that failed validation is done without validating again.
+func (state *State) CompleteBuild(m *machine.Machine, config config.Config) error {
+	state.Mux.Lock()
+	current, validated := m.State, m.ValidationResults != nil
+	state.Mux.Unlock()
+
+	if current == machine.BuildValidating {
+		return nil
+	}
+	if m.Validation.Enabled() && !validated {
+		return state.startValidation(m, config)
+	}
+	return state.DoneBuildMode(*m, config)
+}
+
+// Stop serving m its boot config and start checking it
+func (state *State) startValidation(m *machine.Machine, config config.Config) error {
+	if m.Validation.Kernel != "" {
+		if _, err := regexp.Compile(m.Validation.Kernel); err != nil {
+			return fmt.Errorf("invalid validation kernel %q: %s", m.Validation.Kernel, err)
+		}
+	}
+
+	state.Mux.Lock()
+	t, err := m.SetState(machine.BuildValidating, "")
+	if err != nil {
+		state.Mux.Unlock()
+		return err
+	}
+	delete(state.MachineByMAC, m.Network[0].MacAddress)
+	m.AddPhase(machine.PhaseValidating, false, "")
+	m.ValidationResults = &machine.BuildValidation{Started: time.Now()}
+	state.Version++
+	state.Mux.Unlock()
+
+	state.emitTransition(m, t)
+	go state.validate(m, config)
+	return nil
+}
+
+// Record what m posted on its first boot for the build identified by token
+func (state *State) ReportValidation(token string, r machine.ValidationReport) error {
+	state.Mux.Lock()
+	defer state.Mux.Unlock()
+
+	m, found := state.MachineByUUID[token]
+	if !found {
+		return ErrUnknownBuild
+	}
+	if m.State != machine.BuildValidating {
+		return errNotValidating
+	}
+	// Replaced rather than changed, snapshots share it
+	v := *m.ValidationResults
+	v.Report, v.Reported = &r, time.Now()
+	m.ValidationResults = &v
+	state.Version++
+	return nil
+}
+
+// Record that the installed system of the build identified by token phoned
+// home with r
+func (state *State) ReportPhoneHome(token string, r machine.PhoneHomeReport) error {
+	state.Mux.Lock()
+	defer state.Mux.Unlock()
+
+	m, found := state.MachineByUUID[token]
+	if !found {
+		return ErrUnknownBuild
+	}
+	if m.State != machine.BuildValidating {
+		return errNotValidating
+	}
+	v := *m.ValidationResults
+	v.PhoneHome, v.PhonedHome = &r, time.Now()
+	m.ValidationResults = &v
+	m.AddPhase(machine.PhasePhonedHome, false, "")
+	state.Version++
+	return nil
+}
+
+// Run the checks of m every ValidationInterval until they pass, the build
+// leaves validation or it times out
+func (state *State) validate(m *machine.Machine, config config.Config) {
+	state.Mux.Lock()
+	v := *m.Validation
+	deadline := m.ValidationResults.Started
+	state.Mux.Unlock()
+
+	timeout := v.TimeoutSeconds
+	if timeout <= 0 {
+		timeout = machine.DefaultValidationTimeoutSeconds
+	}
+	deadline = deadline.Add(time.Duration(timeout) * time.Second)
+
+	for {
+		state.Mux.Lock()
+		if state.MachineByUUID[m.Token] != m || m.State != machine.BuildValidating {
+			// Cancelled or failed in the meantime
+			state.Mux.Unlock()
+			return
+		}
+		results := *m.ValidationResults
+		state.Mux.Unlock()
+
+		checks, passed := runValidationChecks(m, v, results)
+
+		state.Mux.Lock()
+		results = *m.ValidationResults
+		results.Checks = checks
+		if passed || !time.Now().Before(deadline) {
+			results.Finished = time.Now()
+		}
+		m.ValidationResults = &results
+		state.Version++
+		state.Mux.Unlock()
+
+		if passed {
+			logger.Machine(m).Info("build validated")
+			if err := state.DoneBuildMode(*m, config); err != nil {
+				logger.Machine(m).Error("post build commands failed", "error", err)
+			}
+			return
+		}
+		if !results.Finished.IsZero() {
+			state.failValidation(m, config, checks)
+			return
+		}
+		time.Sleep(ValidationInterval)
+	}
+}
+
+// Fail the build of m for the checks that didn't pass
+func (state *State) failValidation(m *machine.Machine, config config.Config, checks []machine.ValidationCheck) {
+	var failed []string
+	for _, c := range checks {
+		if !c.Passed {
+			failed = append(failed, fmt.Sprintf("%s: %s", c.Name, c.Message))
+		}
+	}
+	reason := "validation failed, " + strings.Join(failed, ", ")
+	logger.Machine(m).Error("build failed validation", "checks", strings.Join(failed, ", "))
+
+	state.Transition(m, machine.BuildFailed, reason)
+	state.Emit(machine.EventBuildFailed, m, reason)
+	state.Workers.Submit(m.Hostname, func() {
+		if err := state.runWorkerHooks(machine.StageFailure, m, config); err != nil {
+			logger.With("stage", machine.StageFailure).Machine(m).Error("failure hooks failed", "error", err)
+		}
+	})
+}
+
+// The outcome of the checks v asks for, and whether all of them passed
+func runValidationChecks(m *machine.Machine, v config.ValidationConfig, results machine.BuildValidation) ([]machine.ValidationCheck, bool) {
+	report := results.Report
+	var checks []machine.ValidationCheck
+	if v.SSH {
+		c := machine.ValidationCheck{Name: "ssh", Passed: true}
+		if err := checkSSH(m.SSHAddress(v.SSHPort)); err != nil {
+			c.Passed, c.Message = false, err.Error()
+		}
+		checks = append(checks, c)
+	}
+	if v.Callback || v.Kernel != "" {
+		c := machine.ValidationCheck{Name: "callback", Passed: report != nil}
+		if report == nil {
+			c.Message = "no callback from the first boot"
+		}
+		checks = append(checks, c)
+	}
+	if v.Kernel != "" {
+		c := machine.ValidationCheck{Name: "kernel"}
+		if report == nil {
+			c.Message = "no kernel reported"
+		} else if matched, _ := regexp.MatchString(v.Kernel, report.Kernel); !matched {
+			c.Message = fmt.Sprintf("kernel %q doesn't match %s", report.Kernel, v.Kernel)
+		} else {
+			c.Passed = true
+		}
+		checks = append(checks, c)
+	}
+	if v.PhoneHome {
+		c := machine.ValidationCheck{Name: "phone-home", Passed: results.PhoneHome != nil}
+		if results.PhoneHome == nil {
+			c.Message = "the installed system didn't phone home"
+		}
+		checks = append(checks, c)
+	}
+
+	for _, c := range checks {
+		if !c.Passed {
+			return checks, false
+		}
+	}
+	return checks, true
+}
+
+// Check that an ssh server answers at address
+func checkSSH(address string) error {
+	conn, err := net.DialTimeout("tcp", address, machine.ValidationDialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(machine.ValidationDialTimeout))
+	banner, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("no banner from %s: %s", address, err)
+	}
+	if !strings.HasPrefix(banner, "SSH-") {
+		return fmt.Errorf("%s doesn't speak ssh", address)
+	}
+	return nil
+}
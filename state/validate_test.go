@@ -0,0 +1,111 @@
+package state
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestValidation(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(conn, "SSH-2.0-OpenSSH_9.6\r\n")
+			conn.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	sshPort, _ := strconv.Atoi(port)
+
+	interval := ValidationInterval
+	ValidationInterval = 10 * time.Millisecond
+	defer func() { ValidationInterval = interval }()
+
+	build := func(kernel string) (*State, *machine.Machine, chan Event) {
+		state := New()
+		outcomes := make(chan Event, 10)
+		state.Events.Subscribe(func(e Event) {
+			if e.Type == machine.EventBuildCompleted || e.Type == machine.EventBuildFailed {
+				outcomes <- e
+			}
+		})
+		m := machine.Machine{Hostname: "dns02.example.com", Network: []machine.Interface{{MacAddress: "de:ad:c0:de:ca:fe", Addresses4: []machine.IPConfig{{IPAddress: "127.0.0.1"}}}}}
+		m.Validation = &config.ValidationConfig{SSH: true, SSHPort: sshPort, Kernel: kernel, TimeoutSeconds: 1}
+		token, err := state.SetBuildMode(m, config.Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		building := state.MachineByToken(token)
+		if err := state.CompleteBuild(building, config.Config{}); err != nil {
+			t.Fatal(err)
+		}
+		return state, building, outcomes
+	}
+	wait := func(outcomes chan Event) Event {
+		select {
+		case e := <-outcomes:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the validation to finish")
+		}
+		return Event{}
+	}
+
+	state, m, outcomes := build(`^6\.8\.`)
+	if state.MachineByToken(m.Token) != m || m.State != machine.BuildValidating || len(state.MachineByMAC) != 0 {
+		t.Fatalf("expected the build to be validating without its boot config, got %s", m.State)
+	}
+	if err := state.ReportValidation(m.Token, machine.ValidationReport{Kernel: "6.8.0-45-generic"}); err != nil {
+		t.Fatal(err)
+	}
+	if e := wait(outcomes); e.Type != machine.EventBuildCompleted || e.Machine.State != machine.BuildDone || len(e.Machine.ValidationResults.Checks) != 3 {
+		t.Errorf("expected the build to pass validation, got %+v", e)
+	}
+	if state.MachineByToken(m.Token) != nil {
+		t.Error("expected the validated build to leave build mode")
+	}
+
+	state, m, outcomes = build(`^6\.8\.`)
+	state.ReportValidation(m.Token, machine.ValidationReport{Kernel: "5.15.0-1-generic"})
+	e := wait(outcomes)
+	if e.Type != machine.EventBuildFailed || !strings.Contains(e.Message, `kernel: kernel "5.15.0-1-generic" doesn't match ^6\.8\.`) || strings.Contains(e.Message, "ssh") {
+		t.Errorf("expected the kernel to fail validation, got %+v", e)
+	}
+	state.Mux.Lock()
+	failed := m.State
+	state.Mux.Unlock()
+	if failed != machine.BuildFailed || state.MachineByToken(m.Token) != m {
+		t.Errorf("expected the failed build to stay for a person to look at, got %s", failed)
+	}
+	if err := state.ReportValidation(m.Token, machine.ValidationReport{}); err != errNotValidating {
+		t.Errorf("expected a report after validation to be refused, got %v", err)
+	}
+	if err := state.CompleteBuild(m, config.Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if e := wait(outcomes); e.Type != machine.EventBuildCompleted {
+		t.Errorf("expected /done to complete the failed build, got %+v", e)
+	}
+
+	if err := checkSSH(listener.Addr().String()); err != nil {
+		t.Error(err)
+	}
+	listener.Close()
+	if err := checkSSH(listener.Addr().String()); err == nil {
+		t.Error("expected a closed port to fail the ssh check")
+	}
+}
@@ -0,0 +1,161 @@
+package state
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Building or rescuing a machine that is also a VM in vmpath gets the guest
+// ready on its hypervisor and boots it into the PXE flow, through the driver
+// for proxmox, libvirt or vsphere, whichever is configured. The VM is the one whose
+// hostname and domain make up the machine's hostname, on the hypervisor its
+// file is named after.
+
+type vmDriver interface {
+	// Create or reset the guest for m from vm on hypervisor and boot it from
+	// the network, returns what the driver calls the guest
+	Boot(m *machine.Machine, vm machine.VmInstance, hypervisor string) (string, error)
+}
+
+// A NIC of a VM, with the MAC address of the machine's interface of the
+// same name
+type vmNIC struct {
+	Name string
+	MAC  string
+	Vlan int
+}
+
+// The NICs of vm, those of the machine when the VM doesn't list any. The
+// first one is booted from, so it needs a MAC address.
+func vmNICs(m *machine.Machine, vm machine.VmInstance) ([]vmNIC, error) {
+	var nics []vmNIC
+	if len(vm.Interfaces) == 0 {
+		for _, i := range m.Network {
+			nics = append(nics, vmNIC{Name: i.Name, MAC: strings.ToLower(i.MacAddress)})
+		}
+	}
+	macs := make(map[string]string)
+	for _, i := range m.Network {
+		macs[i.Name] = strings.ToLower(i.MacAddress)
+	}
+	for _, i := range vm.Interfaces {
+		nics = append(nics, vmNIC{Name: i.Name, MAC: macs[i.Name], Vlan: i.Vlan})
+	}
+	if len(nics) == 0 || nics[0].MAC == "" {
+		return nil, fmt.Errorf("the first NIC of %s needs a MAC address in the machine definition to boot from", m.Hostname)
+	}
+	return nics, nil
+}
+
+// The driver for the configured hypervisors, nil without any
+func NewVMDriver(config config.Config) (vmDriver, error) {
+	configured := 0
+	for _, set := range []bool{config.Proxmox != nil, config.Libvirt != nil, config.VSphere != nil} {
+		if set {
+			configured++
+		}
+	}
+	if configured > 1 {
+		return nil, fmt.Errorf("only one of proxmox, libvirt and vsphere can be set")
+	}
+	if config.Proxmox != nil {
+		p, err := newProxmox(*config.Proxmox)
+		if err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+	if config.Libvirt != nil {
+		return NewLibvirt(*config.Libvirt), nil
+	}
+	if config.VSphere != nil {
+		v, err := newVSphere(*config.VSphere)
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	return nil, nil
+}
+
+// The VM hostname is in vmpath and the hypervisor it runs on, found is false
+// when hostname isn't a VM
+func findVM(hostname string, config config.Config) (machine.VmInstance, string, bool, error) {
+	if config.VmPath == "" {
+		return machine.VmInstance{}, "", false, nil
+	}
+	files, err := ioutil.ReadDir(config.VmPath)
+	if err != nil {
+		return machine.VmInstance{}, "", false, err
+	}
+	for _, f := range files {
+		if f.IsDir() || path.Ext(f.Name()) != ".yaml" {
+			continue
+		}
+		hypervisor := strings.TrimSuffix(f.Name(), ".yaml")
+		v, err := machine.VMDefinition(hypervisor, config)
+		if err != nil {
+			logger.Error("cannot read vm definition", "hypervisor", hypervisor, "error", err)
+			continue
+		}
+		for _, vm := range v.Vm {
+			name := strings.ToLower(vm.Hostname)
+			if vm.Domain != "" {
+				name += "." + strings.ToLower(vm.Domain)
+			}
+			if name == hostname {
+				return vm, hypervisor, true, nil
+			}
+		}
+	}
+	return machine.VmInstance{}, "", false, nil
+}
+
+// Boot m on its hypervisor when it is a VM, nothing to do without a driver
+func (state *State) bootVM(m *machine.Machine, config config.Config) error {
+	if state.VMs == nil {
+		return nil
+	}
+	vm, hypervisor, found, err := findVM(m.Hostname, config)
+	if err != nil || !found {
+		return err
+	}
+	guest, err := state.VMs.Boot(m, vm, hypervisor)
+	if err != nil {
+		return fmt.Errorf("cannot boot vm %s: %s", guest, err)
+	}
+	logger.Machine(m).Info("booted vm", "hypervisor", hypervisor, "guest", guest)
+	state.RecordPhase(m, machine.PhaseVMBooted)
+	return nil
+}
+
+// Boot the VM of the build token was issued for. ErrUnknownBuild when the
+// build went away meanwhile. A build whose VM can't be booted is cancelled,
+// nothing else would boot it.
+func (state *State) BootBuildVM(token string, config config.Config) error {
+	m := state.MachineByToken(token)
+	if m == nil {
+		return ErrUnknownBuild
+	}
+	err := state.bootVM(m, config)
+	if err == nil {
+		return nil
+	}
+
+	if cerr := state.CancelBuildMode(*m, config, "vm boot failed: "+err.Error()); cerr != nil {
+		logger.Machine(m).Error("failed to cancel build", "error", cerr)
+		return err
+	}
+	for _, stage := range []string{machine.StagePostHook, machine.StageCancel} {
+		if herr := state.runHooks(stage, m, config, nil); herr != nil {
+			logger.Machine(m).Error("cancel hooks failed", "stage", stage, "error", herr)
+			break
+		}
+	}
+	return err
+}
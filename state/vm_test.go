@@ -0,0 +1,53 @@
+package state
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+type failingVMDriver struct{}
+
+func (failingVMDriver) Boot(m *machine.Machine, vm machine.VmInstance, hypervisor string) (string, error) {
+	return "vm01", errors.New("hypervisor unreachable")
+}
+
+func TestBootBuildVM(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-vm")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "hv1.example.com.yaml"), []byte(`{"vm": [{"hostname": "vm01", "domain": "example.com"}]}`), 0644)
+	config := config.Config{VmPath: dir}
+
+	state := New()
+	state.VMs = failingVMDriver{}
+	var reason string
+	state.Events.Subscribe(func(e Event) {
+		if e.Type == machine.EventBuildCancelled {
+			reason = e.Message
+		}
+	})
+
+	if err := state.BootBuildVM("no-such-token", config); err != ErrUnknownBuild {
+		t.Errorf("expected a build that went away to be reported, got %v", err)
+	}
+
+	m := machine.Machine{Hostname: "vm01.example.com", Network: []machine.Interface{{Name: "eth0", MacAddress: "de:ad:be:ef:00:01"}}}
+	token, err := state.SetBuildMode(m, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := state.BootBuildVM(token, config); err == nil {
+		t.Fatal("expected the failed boot to be reported")
+	}
+	if state.MachineByToken(token) != nil || state.BuildInProgress("vm01.example.com") != nil {
+		t.Error("expected a build whose VM didn't boot to be cancelled")
+	}
+	if reason != "vm boot failed: cannot boot vm vm01: hypervisor unreachable" {
+		t.Errorf("unexpected cancel reason %q", reason)
+	}
+}
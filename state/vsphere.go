@@ -0,0 +1,384 @@
+package state
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// The vSphere driver for VMs, see vm.go, through the vCenter REST API of
+// vSphere 7.0U2 and later. The VM is found by its vsphere.name, the hostname
+// by default. An existing VM is powered off, its NICs get the MAC addresses
+// of the interfaces in the machine definition, and its boot order is set to
+// the network first, then its disks, before it is powered on again. With
+// vsphere.recreate the VM is deleted and made again from the definition
+// instead, on the resource pool, or else the ESXi host its file is named
+// after. The username and password are secret references, see config/secrets.go,
+// and are looked up for every session so they can be rotated.
+
+const (
+	vsphereTimeout = 2 * time.Minute
+
+	defaultVSphereGuestOS = "OTHER_LINUX_64"
+	defaultVSphereMemory  = 1024
+	defaultVSphereFolder  = "vm"
+)
+
+type vsphere struct {
+	url    string
+	config config.VSphereConfig
+	client *http.Client
+}
+
+func newVSphere(config config.VSphereConfig) (*vsphere, error) {
+	if config.URL == "" {
+		return nil, fmt.Errorf("vsphere needs a url")
+	}
+	if config.Username == "" {
+		config.Username = os.Getenv("VSPHERE_USERNAME")
+	}
+	if config.Password == "" {
+		config.Password = os.Getenv("VSPHERE_PASSWORD")
+	}
+	if config.Folder == "" {
+		config.Folder = defaultVSphereFolder
+	}
+	if config.GuestOS == "" {
+		config.GuestOS = defaultVSphereGuestOS
+	}
+
+	client := &http.Client{Timeout: vsphereTimeout}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", config.CAFile)
+		}
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+	}
+
+	return &vsphere{
+		url:    strings.TrimRight(config.URL, "/") + "/api",
+		config: config,
+		client: client,
+	}, nil
+}
+
+// Call the API in session with body as JSON, result gets the answer
+func (v *vsphere) do(session string, method string, path string, body interface{}, result interface{}) error {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	request, err := http.NewRequest(method, v.url+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("vmware-api-session-id", session)
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	return v.send(request, result)
+}
+
+func (v *vsphere) send(request *http.Request, result interface{}) error {
+	response, err := v.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+
+	if response.StatusCode/100 != 2 {
+		var problem struct {
+			ErrorType string `json:"error_type"`
+			Messages  []struct {
+				DefaultMessage string `json:"default_message"`
+			} `json:"messages"`
+		}
+		json.Unmarshal(data, &problem)
+		var messages []string
+		for _, m := range problem.Messages {
+			messages = append(messages, m.DefaultMessage)
+		}
+		if len(messages) > 0 {
+			return fmt.Errorf("vsphere %s %s: %s (%s)", request.Method, request.URL.Path, response.Status, strings.Join(messages, "; "))
+		}
+		return fmt.Errorf("vsphere %s %s: %s", request.Method, request.URL.Path, response.Status)
+	}
+	if result == nil || len(data) == 0 {
+		return nil
+	}
+	return json.Unmarshal(data, result)
+}
+
+// Start a session with the credentials as they are now
+func (v *vsphere) login() (string, error) {
+	username, err := config.ResolveSecret(v.config.Username)
+	if err != nil {
+		return "", err
+	}
+	password, err := config.ResolveSecret(v.config.Password)
+	if err != nil {
+		return "", err
+	}
+	request, err := http.NewRequest("POST", v.url+"/session", nil)
+	if err != nil {
+		return "", err
+	}
+	request.SetBasicAuth(username, password)
+	var session string
+	if err := v.send(request, &session); err != nil {
+		return "", err
+	}
+	return session, nil
+}
+
+func (v *vsphere) logout(session string) {
+	if err := v.do(session, "DELETE", "/session", nil, nil); err != nil {
+		logger.Warn("cannot end vsphere session", "error", err)
+	}
+}
+
+// The objects of kind, e.g. vm or datastore, called name
+func (v *vsphere) list(session string, kind string, name string, filter url.Values) ([]map[string]interface{}, error) {
+	if filter == nil {
+		filter = url.Values{}
+	}
+	filter.Set("names", name)
+	var objects []map[string]interface{}
+	if err := v.do(session, "GET", "/vcenter/"+kind+"?"+filter.Encode(), nil, &objects); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+// The id of the object of kind called name, key is the field the id is in
+func (v *vsphere) id(session string, kind string, key string, name string, filter url.Values) (string, error) {
+	objects, err := v.list(session, kind, name, filter)
+	if err != nil {
+		return "", err
+	}
+	if len(objects) == 0 {
+		return "", fmt.Errorf("vsphere has no %s called %s", kind, name)
+	}
+	return fmt.Sprint(objects[0][key]), nil
+}
+
+// The keys of the devices of kind, ethernet or disk, of VM id in order
+func (v *vsphere) devices(session string, id string, kind string) ([]string, error) {
+	var devices []map[string]interface{}
+	if err := v.do(session, "GET", "/vcenter/vm/"+id+"/hardware/"+kind, nil, &devices); err != nil {
+		return nil, err
+	}
+	key := kind
+	if kind == "ethernet" {
+		key = "nic"
+	}
+	var keys []string
+	for _, d := range devices {
+		keys = append(keys, fmt.Sprint(d[key]))
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// Give the NICs of the powered off VM id their MAC addresses and boot it
+// from the first one, then its disks
+func (v *vsphere) pxeBoot(session string, id string, nics []vmNIC) error {
+	keys, err := v.devices(session, id, "ethernet")
+	if err != nil {
+		return err
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("vsphere vm %s has no NIC to boot from", id)
+	}
+	for n, key := range keys {
+		if n >= len(nics) || nics[n].MAC == "" {
+			break
+		}
+		nic := "/vcenter/vm/" + id + "/hardware/ethernet/" + key
+		var current struct {
+			MACAddress string `json:"mac_address"`
+		}
+		if err := v.do(session, "GET", nic, nil, &current); err != nil {
+			return err
+		}
+		if strings.ToLower(current.MACAddress) == nics[n].MAC {
+			continue
+		}
+		// vCenter only takes manual addresses in 00:50:56:00:00:00 to
+		// 00:50:56:3f:ff:ff unless its MAC checks are turned off
+		if err := v.do(session, "PATCH", nic, map[string]string{"mac_type": "MANUAL", "mac_address": nics[n].MAC}, nil); err != nil {
+			return err
+		}
+	}
+
+	disks, err := v.devices(session, id, "disk")
+	if err != nil {
+		return err
+	}
+	order := []map[string]interface{}{{"type": "ETHERNET", "nic": keys[0]}}
+	if len(disks) > 0 {
+		order = append(order, map[string]interface{}{"type": "DISK", "disks": disks})
+	}
+	return v.do(session, "PUT", "/vcenter/vm/"+id+"/hardware/boot/device", map[string]interface{}{"devices": order}, nil)
+}
+
+// Make the VM name for m, on host when no resource pool is set, returns
+// its id
+func (v *vsphere) create(session string, name string, m *machine.Machine, vm machine.VmInstance, nics []vmNIC, host string) (string, error) {
+	folder, pool, datastore := vm.VSphere.Folder, vm.VSphere.ResourcePool, vm.VSphere.Datastore
+	if folder == "" {
+		folder = v.config.Folder
+	}
+	if pool == "" {
+		pool = v.config.ResourcePool
+	}
+	if datastore == "" {
+		datastore = v.config.Datastore
+	}
+
+	placement := make(map[string]string)
+	var err error
+	if placement["folder"], err = v.id(session, "folder", "folder", folder, url.Values{"type": {"VIRTUAL_MACHINE"}}); err != nil {
+		return "", err
+	}
+	if pool != "" {
+		placement["resource_pool"], err = v.id(session, "resource-pool", "resource_pool", pool, nil)
+	} else {
+		placement["host"], err = v.id(session, "host", "host", host, nil)
+	}
+	if err != nil {
+		return "", err
+	}
+	if datastore != "" {
+		if placement["datastore"], err = v.id(session, "datastore", "datastore", datastore, nil); err != nil {
+			return "", err
+		}
+	}
+
+	network := vm.VirtNetwork
+	if network == "" {
+		network = v.config.Network
+	}
+	if network == "" {
+		return "", fmt.Errorf("no port group for the NICs of %s, set virt_network or vsphere.network", name)
+	}
+	networks, err := v.list(session, "network", network, nil)
+	if err != nil {
+		return "", err
+	}
+	if len(networks) == 0 {
+		return "", fmt.Errorf("vsphere has no network called %s", network)
+	}
+	backing := map[string]interface{}{"type": networks[0]["type"], "network": networks[0]["network"]}
+
+	spec := map[string]interface{}{
+		"name":         name,
+		"guest_OS":     v.config.GuestOS,
+		"placement":    placement,
+		"boot_devices": []map[string]string{{"type": "ETHERNET"}, {"type": "DISK"}},
+	}
+	memory, cpus := vm.Memory, vm.Vcpu
+	if memory <= 0 {
+		memory = defaultVSphereMemory
+	}
+	if cpus <= 0 {
+		cpus = 1
+	}
+	spec["memory"] = map[string]int{"size_MiB": memory}
+	spec["cpu"] = map[string]int{"count": cpus}
+	var disks []map[string]interface{}
+	for _, size := range vm.VSphere.Disks {
+		disks = append(disks, map[string]interface{}{"new_vmdk": map[string]int64{"capacity": int64(size) << 30}})
+	}
+	spec["disks"] = disks
+	var specNICs []map[string]interface{}
+	for _, nic := range nics {
+		n := map[string]interface{}{"backing": backing, "start_connected": true, "mac_type": "GENERATED"}
+		if nic.MAC != "" {
+			n["mac_type"] = "MANUAL"
+			n["mac_address"] = nic.MAC
+		}
+		specNICs = append(specNICs, n)
+	}
+	spec["nics"] = specNICs
+
+	var id string
+	if err := v.do(session, "POST", "/vcenter/vm", spec, &id); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Power cycle the VM for m into a network boot, recreating it first when it
+// says so, the guest is name/id
+func (v *vsphere) Boot(m *machine.Machine, vm machine.VmInstance, hypervisor string) (string, error) {
+	name := vm.VSphere.Name
+	if name == "" {
+		name = m.Hostname
+	}
+	nics, err := vmNICs(m, vm)
+	if err != nil {
+		return name, err
+	}
+	session, err := v.login()
+	if err != nil {
+		return name, err
+	}
+	defer v.logout(session)
+
+	vms, err := v.list(session, "vm", name, nil)
+	if err != nil {
+		return name, err
+	}
+	var id string
+	if len(vms) > 0 {
+		id = fmt.Sprint(vms[0]["vm"])
+		if vms[0]["power_state"] != "POWERED_OFF" {
+			// A reset wouldn't pick up a new boot order or MAC address
+			if err := v.do(session, "POST", "/vcenter/vm/"+id+"/power?action=stop", nil, nil); err != nil {
+				return name + "/" + id, err
+			}
+		}
+	}
+
+	if vm.VSphere.Recreate {
+		if id != "" {
+			if err := v.do(session, "DELETE", "/vcenter/vm/"+id, nil, nil); err != nil {
+				return name + "/" + id, err
+			}
+		}
+		if id, err = v.create(session, name, m, vm, nics, hypervisor); err != nil {
+			return name, err
+		}
+	} else {
+		if id == "" {
+			return name, fmt.Errorf("vsphere has no vm called %s, set vsphere.recreate to create it", name)
+		}
+		if err := v.pxeBoot(session, id, nics); err != nil {
+			return name + "/" + id, err
+		}
+	}
+
+	return name + "/" + id, v.do(session, "POST", "/vcenter/vm/"+id+"/power?action=start", nil, nil)
+}
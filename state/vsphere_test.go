@@ -0,0 +1,173 @@
+package state
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestVSphereBootVM(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "waitron-vsphere")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "esx1.example.com.yaml"), []byte(`{"vm": [
+		{"hostname": "vm01", "domain": "example.com", "memory": 2048, "vcpu": 2, "virt_network": "build"},
+		{"hostname": "vm02", "domain": "example.com", "memory": 2048, "vcpu": 2,
+		 "vsphere": {"recreate": true, "datastore": "ds1", "disks": [32]}}]}`), 0644)
+	config := configpkg.Config{VmPath: dir}
+	passwordFile := filepath.Join(dir, "password")
+	ioutil.WriteFile(passwordFile, []byte("secret\n"), 0600)
+
+	var calls []string
+	var bodies []map[string]interface{}
+	vms := `[{"vm": "vm-42", "name": "vm01.example.com", "power_state": "POWERED_ON"}]`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, "/api")
+		if p == "/session" && r.Method == "POST" {
+			if user, password, _ := r.BasicAuth(); user != "waitron@vsphere.local" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				io.WriteString(w, `{"error_type": "UNAUTHENTICATED", "messages": [{"default_message": "Authentication required."}]}`)
+				return
+			}
+			io.WriteString(w, `"session-1"`)
+			return
+		}
+		if r.Header.Get("vmware-api-session-id") != "session-1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if p != "/session" {
+			call := r.Method + " " + p
+			if r.URL.RawQuery != "" {
+				call += "?" + r.URL.RawQuery
+			}
+			calls = append(calls, call)
+		}
+		if r.Method == "PATCH" || r.Method == "PUT" || (r.Method == "POST" && p == "/vcenter/vm") {
+			var body map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&body)
+			bodies = append(bodies, body)
+		}
+		switch {
+		case p == "/vcenter/vm" && r.Method == "GET":
+			if r.URL.Query().Get("names") == "vm01.example.com" {
+				io.WriteString(w, vms)
+			} else {
+				io.WriteString(w, `[]`)
+			}
+		case p == "/vcenter/vm" && r.Method == "POST":
+			io.WriteString(w, `"vm-43"`)
+		case p == "/vcenter/vm/vm-42/hardware/ethernet" && r.Method == "GET":
+			io.WriteString(w, `[{"nic": "4001"}, {"nic": "4000"}]`)
+		case p == "/vcenter/vm/vm-42/hardware/ethernet/4000" && r.Method == "GET":
+			io.WriteString(w, `{"mac_address": "00:50:56:aa:bb:cc", "mac_type": "ASSIGNED"}`)
+		case p == "/vcenter/vm/vm-42/hardware/disk":
+			io.WriteString(w, `[{"disk": "2000"}]`)
+		case p == "/vcenter/folder":
+			io.WriteString(w, `[{"folder": "group-v3", "name": "vm"}]`)
+		case p == "/vcenter/host":
+			io.WriteString(w, `[{"host": "host-10", "name": "esx1.example.com"}]`)
+		case p == "/vcenter/datastore":
+			io.WriteString(w, `[{"datastore": "datastore-11", "name": "ds1"}]`)
+		case p == "/vcenter/network":
+			io.WriteString(w, `[{"network": "dvportgroup-12", "name": "build", "type": "DISTRIBUTED_PORTGROUP"}]`)
+		case r.Method == "GET":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv("WAITRON_TEST_VSPHERE_USERNAME", "waitron@vsphere.local")
+	defer os.Unsetenv("WAITRON_TEST_VSPHERE_USERNAME")
+	driver, err := NewVMDriver(configpkg.Config{VSphere: &configpkg.VSphereConfig{URL: server.URL, Username: "env:WAITRON_TEST_VSPHERE_USERNAME", Password: "file:" + passwordFile, Network: "build"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	state := New()
+	state.VMs = driver
+	m := &machine.Machine{Hostname: "vm01.example.com", Network: []machine.Interface{{Name: "eth0", MacAddress: "00:50:56:00:00:01"}}}
+
+	// An existing VM is power cycled into a network boot
+	if err := state.bootVM(m, config); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(calls, ", ") != "GET /vcenter/vm?names=vm01.example.com, POST /vcenter/vm/vm-42/power?action=stop, "+
+		"GET /vcenter/vm/vm-42/hardware/ethernet, GET /vcenter/vm/vm-42/hardware/ethernet/4000, PATCH /vcenter/vm/vm-42/hardware/ethernet/4000, "+
+		"GET /vcenter/vm/vm-42/hardware/disk, PUT /vcenter/vm/vm-42/hardware/boot/device, POST /vcenter/vm/vm-42/power?action=start" {
+		t.Errorf("unexpected calls %v", calls)
+	}
+	if bodies[0]["mac_address"] != "00:50:56:00:00:01" || bodies[0]["mac_type"] != "MANUAL" {
+		t.Errorf("unexpected NIC %v", bodies[0])
+	}
+	order, _ := json.Marshal(bodies[1]["devices"])
+	if string(order) != `[{"nic":"4000","type":"ETHERNET"},{"disks":["2000"],"type":"DISK"}]` {
+		t.Errorf("unexpected boot order %s", order)
+	}
+	if len(m.Phases) != 1 || m.Phases[0].Name != machine.PhaseVMBooted {
+		t.Errorf("expected the vm-booted phase, got %+v", m.Phases)
+	}
+
+	// A VM that is off and already has the MAC address is only booted
+	calls, bodies = nil, nil
+	vms = `[{"vm": "vm-42", "name": "vm01.example.com", "power_state": "POWERED_OFF"}]`
+	m.Network[0].MacAddress = "00:50:56:AA:BB:CC"
+	if err := state.bootVM(m, config); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(calls, ", ") != "GET /vcenter/vm?names=vm01.example.com, GET /vcenter/vm/vm-42/hardware/ethernet, GET /vcenter/vm/vm-42/hardware/ethernet/4000, "+
+		"GET /vcenter/vm/vm-42/hardware/disk, PUT /vcenter/vm/vm-42/hardware/boot/device, POST /vcenter/vm/vm-42/power?action=start" {
+		t.Errorf("unexpected calls %v", calls)
+	}
+
+	// A recreated VM is made from the definition on the host of its file
+	calls, bodies = nil, nil
+	vm02 := &machine.Machine{Hostname: "vm02.example.com", Network: []machine.Interface{{Name: "eth0", MacAddress: "00:50:56:00:00:02"}}}
+	if err := state.bootVM(vm02, config); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(calls, ", ") != "GET /vcenter/vm?names=vm02.example.com, GET /vcenter/folder?names=vm&type=VIRTUAL_MACHINE, "+
+		"GET /vcenter/host?names=esx1.example.com, GET /vcenter/datastore?names=ds1, GET /vcenter/network?names=build, "+
+		"POST /vcenter/vm, POST /vcenter/vm/vm-43/power?action=start" {
+		t.Errorf("unexpected calls %v", calls)
+	}
+	spec, _ := json.Marshal(bodies[0])
+	for _, expected := range []string{
+		`"name":"vm02.example.com"`,
+		`"placement":{"datastore":"datastore-11","folder":"group-v3","host":"host-10"}`,
+		`"memory":{"size_MiB":2048}`,
+		`"cpu":{"count":2}`,
+		`"disks":[{"new_vmdk":{"capacity":34359738368}}]`,
+		`"backing":{"network":"dvportgroup-12","type":"DISTRIBUTED_PORTGROUP"}`,
+		`"mac_address":"00:50:56:00:00:02","mac_type":"MANUAL"`,
+	} {
+		if !strings.Contains(string(spec), expected) {
+			t.Errorf("expected %s in the spec, got %s", expected, spec)
+		}
+	}
+
+	// Without recreate, a VM has to exist
+	os.Remove(filepath.Join(dir, "esx1.example.com.yaml"))
+	ioutil.WriteFile(filepath.Join(dir, "esx1.example.com.yaml"), []byte(`{"vm": [{"hostname": "vm02", "domain": "example.com"}]}`), 0644)
+	if err := state.bootVM(vm02, config); err == nil || !strings.Contains(err.Error(), "no vm called vm02.example.com") {
+		t.Errorf("expected the missing VM to be reported, got %v", err)
+	}
+
+	ioutil.WriteFile(passwordFile, []byte("rotated\n"), 0600)
+	if err := state.bootVM(vm02, config); err == nil || !strings.Contains(err.Error(), "Authentication required") {
+		t.Errorf("expected the rotated password to be used, got %v", err)
+	}
+
+	if _, err := NewVMDriver(configpkg.Config{Libvirt: &configpkg.LibvirtConfig{}, VSphere: &configpkg.VSphereConfig{URL: server.URL}}); err == nil {
+		t.Error("expected only one vm driver to be allowed")
+	}
+}
@@ -0,0 +1,46 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Record the wipe certificate of the build identified by token, in its host's
+// history too, and let it go on or fail it. It passes when every disk the
+// image found was wiped.
+func (state *State) ReportWipe(token string, c machine.WipeCertificate, config config.Config) error {
+	c.Reported = time.Now()
+
+	state.Mux.Lock()
+	m, err := state.machineInStage(token, machine.WipeStage)
+	if err != nil {
+		state.Mux.Unlock()
+		return err
+	}
+	m.WipeResult = &c
+	state.Version++
+	snapshot := *m
+	state.Mux.Unlock()
+
+	state.RecordHistory(&snapshot)
+
+	var failed []string
+	for _, d := range c.Disks {
+		if !d.Passed {
+			failed = append(failed, fmt.Sprintf("%s: %s", d.Device, d.Message))
+		}
+	}
+	if len(c.Disks) == 0 {
+		failed = append(failed, "no disks reported")
+	}
+
+	if len(failed) > 0 {
+		state.FailStage(m, config, machine.WipeStage, strings.Join(failed, ", "))
+		return nil
+	}
+	return state.PassStage(m, config, machine.WipeStage, c.Message)
+}
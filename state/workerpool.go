@@ -0,0 +1,122 @@
+package state
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+const defaultHookWorkers = 8
+
+type poolJob struct {
+	host string
+	fn   func()
+}
+
+// workerPool runs jobs on a fixed number of goroutines. Jobs for the same host
+// run one at a time, in the order they were submitted.
+type workerPool struct {
+	mux     sync.Mutex
+	cond    *sync.Cond
+	ready   []poolJob
+	pending map[string][]poolJob
+	active  map[string]bool
+}
+
+func NewWorkerPool(workers int) *workerPool {
+	if workers <= 0 {
+		workers = defaultHookWorkers
+	}
+
+	p := &workerPool{
+		pending: make(map[string][]poolJob),
+		active:  make(map[string]bool),
+	}
+	p.cond = sync.NewCond(&p.mux)
+
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for {
+		p.mux.Lock()
+		for len(p.ready) == 0 {
+			p.cond.Wait()
+		}
+		job := p.ready[0]
+		p.ready = p.ready[1:]
+		p.mux.Unlock()
+
+		p.call(job)
+
+		// Hand the host over to its next job, if any
+		p.mux.Lock()
+		if next := p.pending[job.host]; len(next) > 0 {
+			p.ready = append(p.ready, next[0])
+			p.pending[job.host] = next[1:]
+			p.cond.Signal()
+		} else {
+			delete(p.pending, job.host)
+			delete(p.active, job.host)
+		}
+		p.mux.Unlock()
+	}
+}
+
+// Run a job, a panic in it only fails the job
+func (p *workerPool) call(job poolJob) {
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Error("worker job panicked", "host", job.host, "panic", r, "stack", string(debug.Stack()))
+		}
+	}()
+	job.fn()
+}
+
+// Queue fn to run for host and return immediately.
+func (p *workerPool) Submit(host string, fn func()) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	job := poolJob{host: host, fn: fn}
+	if p.active[host] {
+		p.pending[host] = append(p.pending[host], job)
+		return
+	}
+
+	p.active[host] = true
+	p.ready = append(p.ready, job)
+	p.cond.Signal()
+}
+
+// Queue fn to run for host and wait for it to finish. The error is that of
+// a panic in fn.
+func (p *workerPool) Run(host string, fn func()) error {
+	done := make(chan error, 1)
+	p.Submit(host, func() {
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Error("worker job panicked", "host", host, "panic", r, "stack", string(debug.Stack()))
+				done <- fmt.Errorf("job for %s panicked: %v", host, r)
+			}
+			close(done)
+		}()
+		fn()
+	})
+	return <-done
+}
+
+// Number of jobs waiting for a worker or for their host
+func (p *workerPool) Queued() int {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+
+	n := len(p.ready)
+	for _, jobs := range p.pending {
+		n += len(jobs)
+	}
+	return n
+}
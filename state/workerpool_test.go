@@ -0,0 +1,102 @@
+package state
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolBounded(t *testing.T) {
+	p := NewWorkerPool(2)
+
+	var running, peak int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		host := string(rune('a' + i))
+		p.Submit(host, func() {
+			defer wg.Done()
+			n := atomic.AddInt32(&running, 1)
+			for {
+				old := atomic.LoadInt32(&peak)
+				if n <= old || atomic.CompareAndSwapInt32(&peak, old, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	wg.Wait()
+
+	if peak > 2 {
+		t.Errorf("expected at most 2 jobs at once, saw %d", peak)
+	}
+}
+
+func TestWorkerPoolSerializesPerHost(t *testing.T) {
+	p := NewWorkerPool(4)
+
+	var mux sync.Mutex
+	var order []int
+	var running int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < 5; i++ {
+		i := i
+		wg.Add(1)
+		p.Submit("dns02.example.com", func() {
+			defer wg.Done()
+			if atomic.AddInt32(&running, 1) > 1 {
+				t.Errorf("two jobs for the same host ran at once")
+			}
+			time.Sleep(5 * time.Millisecond)
+			mux.Lock()
+			order = append(order, i)
+			mux.Unlock()
+			atomic.AddInt32(&running, -1)
+		})
+	}
+	wg.Wait()
+
+	for i, v := range order {
+		if i != v {
+			t.Errorf("jobs ran out of order: %v", order)
+			break
+		}
+	}
+	if p.Queued() != 0 {
+		t.Errorf("expected an empty queue, got %d", p.Queued())
+	}
+}
+
+func TestWorkerPoolRunWaits(t *testing.T) {
+	p := NewWorkerPool(1)
+
+	done := false
+	p.Run("dns02.example.com", func() {
+		time.Sleep(5 * time.Millisecond)
+		done = true
+	})
+
+	if !done {
+		t.Errorf("run returned before the job finished")
+	}
+}
+
+func TestWorkerPoolPanic(t *testing.T) {
+	p := NewWorkerPool(1)
+
+	p.Submit("dns02.example.com", func() { panic("queued job") })
+	if err := p.Run("dns02.example.com", func() { panic("bad hook template") }); err == nil || !strings.Contains(err.Error(), "bad hook template") {
+		t.Errorf("expected the panic as an error, got %v", err)
+	}
+
+	done := false
+	if err := p.Run("dns02.example.com", func() { done = true }); err != nil || !done {
+		t.Errorf("expected the pool to keep working, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package template
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/ns1/waitron/config"
+)
+
+// SHA256 sums of the static files, recomputed when a file's size or mtime
+// changes. They are served as /files/<path>.sha256, used as ETags and
+// available to templates as {{ sha256("path/in/staticspath") }}.
+
+type fileSum struct {
+	Size    int64
+	ModTime time.Time
+	Sum     string
+}
+
+type checksumCache struct {
+	mux  sync.Mutex
+	sums map[string]fileSum // by full path
+}
+
+var Checksums = &checksumCache{sums: make(map[string]fileSum)}
+
+// The hex SHA256 of name under root
+func (c *checksumCache) Sum(root string, name string) (string, error) {
+	f, info, err := OpenStaticFile(root, name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return c.SumOpen(filepath.Join(root, path.Clean("/"+name)), f, info)
+}
+
+// Like sum for a file already open, f is read from the start if the sum
+// isn't known yet
+func (c *checksumCache) SumOpen(full string, f io.ReadSeeker, info os.FileInfo) (string, error) {
+	c.mux.Lock()
+	cached, found := c.sums[full]
+	c.mux.Unlock()
+	if found && cached.Size == info.Size() && cached.ModTime.Equal(info.ModTime()) {
+		return cached.Sum, nil
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	c.mux.Lock()
+	c.sums[full] = fileSum{Size: info.Size(), ModTime: info.ModTime(), Sum: sum}
+	c.mux.Unlock()
+	return sum, nil
+}
+
+// Hash everything under root so the first download of a big image doesn't
+// wait for it
+func (c *checksumCache) Warm(root string) {
+	start := time.Now()
+	n := 0
+	filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return nil
+		}
+		if _, err := c.Sum(root, filepath.ToSlash(rel)); err != nil {
+			logger.Warn("cannot checksum static file", "path", p, "error", err)
+			return nil
+		}
+		n++
+		return nil
+	})
+	logger.Info("static file checksums ready", "files", n, "duration", time.Since(start).String())
+}
+
+// For templates: the SHA256 of a static file, empty if it can't be read
+func TemplateChecksum(config config.Config) func(name string) string {
+	return func(name string) string {
+		sum, err := Checksums.Sum(config.StaticFilesPath, name)
+		if err != nil {
+			logger.Warn("cannot checksum static file for template", "file", name, "error", err)
+			return ""
+		}
+		return sum
+	}
+}
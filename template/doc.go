@@ -0,0 +1,7 @@
+// Package template renders the templates Waitron serves to installers with
+// what a machine's definition holds.
+package template
+
+import "github.com/ns1/waitron/config"
+
+var logger = config.Log
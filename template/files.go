@@ -0,0 +1,27 @@
+package template
+
+import (
+	"net/http"
+	"os"
+	"path"
+)
+
+// Open name under root. http.Dir keeps it from escaping root, directories
+// are not served.
+func OpenStaticFile(root string, name string) (http.File, os.FileInfo, error) {
+	f, err := http.Dir(root).Open(path.Clean("/" + name))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		f.Close()
+		return nil, nil, os.ErrNotExist
+	}
+	return f, info, nil
+}
@@ -0,0 +1,45 @@
+package template
+
+import (
+	"io"
+
+	"github.com/flosch/pongo2"
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// What templates see: machine, config and helpers
+func Vars(m machine.Machine, config config.Config) pongo2.Context {
+	vars := pongo2.Context{"machine": m, "config": config, "sha256": TemplateChecksum(config)}
+	for name, helper := range machine.StorageTemplateHelpers(m) {
+		vars[name] = helper
+	}
+	for name, helper := range machine.NetworkTemplateHelpers(m) {
+		vars[name] = helper
+	}
+	return vars
+}
+
+// Render template among with machine and config struct
+func Render(m machine.Machine, template string, config config.Config) (string, error) {
+	tpl, err := machine.LoadTemplate(template, config)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := tpl.Execute(Vars(m, config))
+	if err != nil {
+		return "", err
+	}
+	return result, err
+}
+
+// Render template into w as it goes rather than into memory first. On error
+// part of the output may already have been written.
+func RenderTo(m machine.Machine, w io.Writer, template string, config config.Config) error {
+	tpl, err := machine.LoadTemplate(template, config)
+	if err != nil {
+		return err
+	}
+	return tpl.ExecuteWriterUnbuffered(Vars(m, config), w)
+}
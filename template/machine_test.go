@@ -0,0 +1,46 @@
+package template
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// The tests read config.yaml, machines, groups and templates from the top of
+// the repository
+func TestMain(m *testing.M) {
+	if err := os.Chdir(".."); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestRenderTemplate(t *testing.T) {
+	config, _ := configpkg.LoadConfig("config.yaml")
+	m, _ := machine.MachineDefinition("dns02.example.com", "machines", configpkg.Config{})
+
+	template, err := Render(m, "finish.j2", config)
+	if err != nil {
+		t.Errorf("failed to render template: %s", err)
+	}
+
+	expected := "example.com"
+	if !strings.Contains(template, expected) {
+		t.Errorf(fmt.Sprintf("Template does not contain '%s'", expected))
+	}
+}
+
+func TestRenderTemplateNotFound(t *testing.T) {
+	config, _ := configpkg.LoadConfig("config.yaml")
+	m, _ := machine.MachineDefinition("dns02.example.com", "machines", configpkg.Config{})
+	_, err := Render(m, "invalid.j2", config)
+
+	expected := "template \"templates/invalid.j2\" does not exist"
+	if err.Error() != expected {
+		t.Errorf(fmt.Sprintf("Expected: %s, got: %s", expected, err.Error()))
+	}
+}
@@ -0,0 +1,95 @@
+package template
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func TestSites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-sites")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "preseed.j2"), []byte("{{ machine.Site }} {{ machine.BaseURL }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := configpkg.Config{TemplatePath: dir, Sites: map[string]configpkg.SiteConfig{
+		"ams1": {
+			Subnets:    []string{"10.1.0.0/16"},
+			Definition: map[string]interface{}{"baseurl": "http://waitron.ams1.example.com", "params": map[string]string{"mirror": "mirror.ams1.example.com"}},
+		},
+		"ams1-oob": {
+			Subnets:    []string{"10.1.250.0/24"},
+			Definition: map[string]interface{}{"baseurl": "http://waitron-oob.ams1.example.com"},
+		},
+		"sjc1": {
+			Subnets:    []string{"10.2.0.0/16", "2001:db8:2::/48"},
+			Definition: map[string]interface{}{"baseurl": "http://waitron.sjc1.example.com"},
+		},
+	}}
+	if err := machine.ValidateSites(config); err != nil {
+		t.Fatal(err)
+	}
+	for _, site := range []configpkg.SiteConfig{
+		{},
+		{Subnets: []string{"10.3.0.0"}},
+		{Subnets: []string{"10.3.0.0/16"}, Definition: map[string]interface{}{"mirror": "mirror.example.com"}},
+	} {
+		if err := machine.ValidateSite(site, config); err == nil {
+			t.Errorf("expected %+v to be refused", site)
+		}
+	}
+
+	for address, expected := range map[string]string{
+		"10.1.2.3":      "ams1",
+		"10.1.250.3":    "ams1-oob",
+		"2001:db8:2::5": "sjc1",
+		"192.0.2.1":     "",
+	} {
+		if site, _ := machine.SiteFor(net.ParseIP(address), config.Sites); site != expected {
+			t.Errorf("expected %s to be in %q, got %q", address, expected, site)
+		}
+	}
+
+	m := &machine.Machine{
+		Hostname: "dns02.example.com",
+		Config:   configpkg.Config{BaseURL: "http://waitron.example.com", Params: map[string]string{"mirror": "mirror.example.com", "ntp": "ntp.example.com"}},
+		Network:  []machine.Interface{{Addresses4: []machine.IPConfig{{IPAddress: "10.2.0.10"}}}},
+	}
+	request := httptest.NewRequest("GET", "/template/preseed/dns02.example.com/token", nil)
+	request.RemoteAddr = "10.1.2.3:41234"
+	at, err := m.AtSite(request, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if at.Site != "ams1" || at.BaseURL != "http://waitron.ams1.example.com" || at.Params["mirror"] != "mirror.ams1.example.com" ||
+		at.Params["ntp"] != "ntp.example.com" {
+		t.Errorf("expected the site merged over the machine, got %s %s %v", at.Site, at.BaseURL, at.Params)
+	}
+	if m.Site != "" || m.BaseURL != "http://waitron.example.com" || m.Params["mirror"] != "mirror.example.com" {
+		t.Errorf("expected the machine itself to be left alone, got %s %s %v", m.Site, m.BaseURL, m.Params)
+	}
+	if rendered, err := Render(*at, "preseed.j2", config); err != nil || rendered != "ams1 http://waitron.ams1.example.com" {
+		t.Errorf("expected the template to see the site, got %q %v", rendered, err)
+	}
+
+	// pixiecore asking from elsewhere goes by the machine's address
+	request.RemoteAddr = "192.0.2.1:41234"
+	if at, err := m.AtSite(request, config); err != nil || at.Site != "sjc1" || at.BaseURL != "http://waitron.sjc1.example.com" {
+		t.Errorf("expected the site of the machine's address, got %+v %v", at, err)
+	}
+
+	m.Network = nil
+	if at, err := m.AtSite(request, config); err != nil || at != m {
+		t.Errorf("expected the machine as it is outside every site, got %+v %v", at, err)
+	}
+}
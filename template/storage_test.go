@@ -0,0 +1,101 @@
+package template
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// A web server for files, with ETags and a JSON index like nginx's
+type fakeWebServer struct {
+	mux      sync.Mutex
+	files    map[string]string
+	requests map[string]int
+}
+
+func (f *fakeWebServer) set(name string, content string) {
+	f.mux.Lock()
+	f.files[name] = content
+	f.mux.Unlock()
+}
+
+func (f *fakeWebServer) count(name string) int {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	return f.requests[name]
+}
+
+func (f *fakeWebServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.requests[r.URL.Path]++
+
+	if strings.HasSuffix(r.URL.Path, "/") {
+		var index []config.JSONIndexEntry
+		for name := range f.files {
+			if rest := strings.TrimPrefix(name, r.URL.Path); rest != name && !strings.Contains(rest, "/") {
+				index = append(index, config.JSONIndexEntry{Name: rest, Type: "file", MTime: time.Now().UTC().Format(http.TimeFormat)})
+			}
+		}
+		if index == nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(index)
+		return
+	}
+
+	content, found := f.files[r.URL.Path]
+	if !found {
+		http.NotFound(w, r)
+		return
+	}
+	etag := fmt.Sprintf(`"%x"`, len(content))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write([]byte(content))
+}
+
+func newFakeWebServer(files map[string]string) (*fakeWebServer, *httptest.Server) {
+	f := &fakeWebServer{files: files, requests: make(map[string]int)}
+	return f, httptest.NewServer(f)
+}
+
+func TestRemoteDefinitionsAndTemplates(t *testing.T) {
+	_, ts := newFakeWebServer(map[string]string{
+		"/machines/node01.example.com.yaml": `{"operatingsystem": "debian", "preseed": "preseed.j2"}`,
+		"/groups/example.com.yaml":          `{"finish": "finish.j2"}`,
+		"/templates/preseed.j2":             "os {{ machine.OperatingSystem }}",
+	})
+	defer ts.Close()
+
+	config := config.Config{MachinePath: ts.URL + "/machines", GroupPath: ts.URL + "/groups", TemplatePath: ts.URL + "/templates"}
+	m, err := machine.MachineDefinition("node01.example.com", config.MachinePath, config)
+	if err != nil || m.OperatingSystem != "debian" || m.Finish != "finish.j2" {
+		t.Fatalf("unexpected definition %+v, %v", m, err)
+	}
+
+	if out, err := Render(m, m.Preseed, config); err != nil || out != "os debian" {
+		t.Errorf("unexpected render %q, %v", out, err)
+	}
+	if _, err := Render(m, "missing.j2", config); err == nil {
+		t.Error("expected a missing template to fail")
+	}
+
+	if _, err := machine.MachineDefinition("node02.example.com", config.MachinePath, config); !os.IsNotExist(err) {
+		t.Errorf("expected a missing machine not to exist, got %v", err)
+	}
+}
@@ -0,0 +1,156 @@
+package template
+
+import (
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+// Installers often fetch the preseed more than once, so with template_cache
+// set a rendered template is kept until one of its inputs changes: the
+// template (or anything next to it it could include), the machine or group
+// definition, the config, or the build token. Leaving build mode and
+// DELETE /api/v1/template-cache drop entries explicitly.
+
+const MaxRenderCacheEntries = 1024
+
+type renderCacheKey struct {
+	Template string
+	Token    string
+	Site     string
+}
+
+type renderCacheEntry struct {
+	Hostname      string
+	TemplateMod   time.Time
+	DefinitionMod time.Time
+	Checksum      string
+	Result        string
+}
+
+type RenderCache struct {
+	mux     sync.Mutex
+	entries map[renderCacheKey]renderCacheEntry
+}
+
+func NewRenderCache() *RenderCache {
+	return &RenderCache{entries: make(map[renderCacheKey]renderCacheEntry)}
+}
+
+// Newest modification time of the files at paths, skipping missing ones
+func newestModTime(paths ...string) time.Time {
+	var newest time.Time
+	for _, p := range paths {
+		if modTime, err := configpkg.StorageFor(p).ModTime(p); err == nil && modTime.After(newest) {
+			newest = modTime
+		}
+	}
+	return newest
+}
+
+// The template and every file in its directory, which covers includes and
+// extends relative to it
+func templateModTime(template string) time.Time {
+	paths := []string{template}
+	dir := configpkg.ParentLocation(template)
+	if files, err := configpkg.StorageFor(dir).List(dir); err == nil {
+		for _, f := range files {
+			if !f.Dir {
+				paths = append(paths, configpkg.JoinLocation(dir, f.Name))
+			}
+		}
+	}
+	return newestModTime(paths...)
+}
+
+// The files machine.MachineDefinition merges for m
+func definitionModTime(m *machine.Machine, config configpkg.Config) time.Time {
+	name := m.Hostname
+	if m.Pattern != "" {
+		name = strings.TrimSuffix(m.Pattern, path.Ext(m.Pattern))
+	}
+	if config.ConsulKV != nil {
+		return config.ConsulKV.ModTime(name, m.Domain)
+	}
+	return newestModTime(
+		configpkg.JoinLocation(config.MachinePath, name+".yaml"),
+		configpkg.JoinLocation(config.MachinePath, name+".yml"),
+		configpkg.JoinLocation(config.GroupPath, m.Domain+".yaml"),
+		configpkg.JoinLocation(config.GroupPath, m.Domain+".yml"),
+	)
+}
+
+// Render template for m, reusing the previous result if nothing it depends on
+// changed since
+func (c *RenderCache) Render(m *machine.Machine, template string, config configpkg.Config) (string, error) {
+	key := renderCacheKey{Template: template, Token: m.Token, Site: m.Site}
+	entry := renderCacheEntry{
+		Hostname:      m.Hostname,
+		TemplateMod:   templateModTime(configpkg.JoinLocation(config.TemplatePath, template)),
+		DefinitionMod: definitionModTime(m, config),
+		Checksum:      config.Checksum,
+	}
+
+	c.mux.Lock()
+	cached, found := c.entries[key]
+	c.mux.Unlock()
+
+	if found && cached.TemplateMod.Equal(entry.TemplateMod) &&
+		cached.DefinitionMod.Equal(entry.DefinitionMod) && cached.Checksum == entry.Checksum {
+		logger.Machine(m).Debug("template served from cache", "template", template)
+		return cached.Result, nil
+	}
+
+	result, err := Render(*m, template, config)
+	if err != nil {
+		return "", err
+	}
+	entry.Result = result
+
+	c.mux.Lock()
+	if _, found := c.entries[key]; !found && len(c.entries) >= MaxRenderCacheEntries {
+		// Make room, any entry will do as they are cheap to recreate
+		for k := range c.entries {
+			delete(c.entries, k)
+			break
+		}
+	}
+	c.entries[key] = entry
+	c.mux.Unlock()
+
+	return result, nil
+}
+
+// Drop the entries of a build, returning how many there were
+func (c *RenderCache) InvalidateToken(token string) int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	n := 0
+	for k := range c.entries {
+		if k.Token == token {
+			delete(c.entries, k)
+			n++
+		}
+	}
+	return n
+}
+
+// Drop the entries of hostname, or all of them if it is empty
+func (c *RenderCache) Invalidate(hostname string) int {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	n := 0
+	for k, e := range c.entries {
+		if hostname == "" || strings.EqualFold(e.Hostname, hostname) {
+			delete(c.entries, k)
+			n++
+		}
+	}
+	return n
+}
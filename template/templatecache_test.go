@@ -0,0 +1,91 @@
+package template
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+)
+
+func writeTemplate(t *testing.T, path string, content string, mod time.Time) {
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRenderCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-templates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := config.Config{TemplatePath: dir, MachinePath: dir, GroupPath: dir}
+	m := &machine.Machine{Hostname: "dns02.example.com", Domain: "example.com", Token: "token"}
+	template := filepath.Join(dir, "preseed.j2")
+	then := time.Now().Add(-time.Hour)
+	writeTemplate(t, template, "first", then)
+
+	c := NewRenderCache()
+	if result, err := c.Render(m, "preseed.j2", config); err != nil || result != "first" {
+		t.Fatalf("expected first, got %q, %v", result, err)
+	}
+
+	// Same mtime, served from the cache
+	writeTemplate(t, template, "second", then)
+	if result, _ := c.Render(m, "preseed.j2", config); result != "first" {
+		t.Errorf("expected the cached render, got %q", result)
+	}
+
+	// A new token is a new build
+	m.Token = "other"
+	if result, _ := c.Render(m, "preseed.j2", config); result != "second" {
+		t.Errorf("expected a fresh render for a new token, got %q", result)
+	}
+
+	// Changing an included file invalidates
+	writeTemplate(t, template, "third", then)
+	writeTemplate(t, filepath.Join(dir, "partial.j2"), "", time.Now())
+	if result, _ := c.Render(m, "preseed.j2", config); result != "third" {
+		t.Errorf("expected a fresh render after an include changed, got %q", result)
+	}
+
+	// So does changing the machine definition
+	writeTemplate(t, template, "fourth", then)
+	writeTemplate(t, filepath.Join(dir, "dns02.example.com.yaml"), "", time.Now().Add(time.Minute))
+	if result, _ := c.Render(m, "preseed.j2", config); result != "fourth" {
+		t.Errorf("expected a fresh render after the definition changed, got %q", result)
+	}
+
+	// And the config
+	writeTemplate(t, template, "fifth", then)
+	config.Checksum = "changed"
+	if result, _ := c.Render(m, "preseed.j2", config); result != "fifth" {
+		t.Errorf("expected a fresh render after the config changed, got %q", result)
+	}
+}
+
+func TestRenderCacheInvalidate(t *testing.T) {
+	c := NewRenderCache()
+	c.entries[renderCacheKey{"preseed.j2", "a", ""}] = renderCacheEntry{Hostname: "a.example.com"}
+	c.entries[renderCacheKey{"finish.j2", "a", ""}] = renderCacheEntry{Hostname: "a.example.com"}
+	c.entries[renderCacheKey{"preseed.j2", "b", ""}] = renderCacheEntry{Hostname: "b.example.com"}
+	c.entries[renderCacheKey{"preseed.j2", "c", ""}] = renderCacheEntry{Hostname: "c.example.com"}
+
+	if n := c.InvalidateToken("a"); n != 2 {
+		t.Errorf("expected 2 entries dropped for the token, got %d", n)
+	}
+	if n := c.Invalidate("B.example.com"); n != 1 {
+		t.Errorf("expected 1 entry dropped for the host, got %d", n)
+	}
+	if n := c.Invalidate(""); n != 1 || len(c.entries) != 0 {
+		t.Errorf("expected everything dropped, got %d, %v", n, c.entries)
+	}
+}
@@ -0,0 +1,189 @@
+// Package waitron serves machine definitions, templates and build mode to
+// installers. The waitron command in cmd/waitron runs it as a server; other
+// programs embed it with NewState and server.NewHandler:
+//
+//	c, err := config.LoadConfig("config.yaml")
+//	...
+//	s, err := waitron.NewState(&c)
+//	...
+//	http.ListenAndServe(":9090", server.NewHandler(c, s))
+//
+// The packages under it are, each using only those before it:
+//
+//	config    the configuration, logging, secrets and storage backends
+//	machine   machine definitions, groups, profiles and the inventory
+//	template  rendering the templates of a machine
+//	state     builds in progress and what follows them
+//	hooks     running the hooks of build stages
+//	server    the HTTP API
+package waitron
+
+import (
+	"fmt"
+	"time"
+
+	configpkg "github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/hooks"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/server"
+	statepkg "github.com/ns1/waitron/state"
+)
+
+var logger = configpkg.Log
+
+// NewState sets up what serving config needs: the state store, build
+// retention, IPAM, DNS, VM drivers, the definitions from consul or git,
+// notifiers, the inventory and images, and starts the background work that
+// goes with them, the simulated installer too with simulate. It fills in the
+// defaults config leaves out, so config is what NewHandler should be given.
+// The background work runs until the state is closed.
+func NewState(config *configpkg.Config) (*statepkg.State, error) {
+	var err error
+
+	if config.Simulate {
+		config.HookDryRun = true
+	}
+
+	if config.Plugins, err = machine.DiscoverPlugins(config.PluginPath); err != nil {
+		return nil, fmt.Errorf("cannot load plugins from %s: %s", config.PluginPath, err)
+	}
+
+	configpkg.ConfigureS3(config.S3)
+
+	if config.Resolver != nil {
+		config.AttributeResolver = machine.NewMachineResolver(*config.Resolver)
+	}
+
+	if config.Consul != nil {
+		if config.Git != nil {
+			return nil, fmt.Errorf("machine definitions can come from consul or git, not both")
+		}
+		if config.ConsulKV, err = configpkg.NewConsulKV(*config.Consul); err != nil {
+			return nil, fmt.Errorf("cannot read definitions from consul at %s: %s", config.Consul.Address, err)
+		}
+	}
+
+	state := statepkg.New()
+	if config.ConsulKV != nil {
+		config.ConsulKV.Watch(state.Stopped())
+	}
+	state.Hooks = hooks.Runner{}
+	if state.Store, err = statepkg.NewStore(*config); err != nil {
+		return nil, fmt.Errorf("cannot open state store: %s", err)
+	}
+	if err := state.Stats.Seed(state.Store); err != nil {
+		logger.Error("cannot load build durations from host histories", "error", err)
+	}
+	if state.Retention, err = statepkg.NewBuildRetention(config.BuildRetention, state.Store, config.StatePath != ""); err != nil {
+		return nil, fmt.Errorf("cannot set up build retention: %s", err)
+	}
+	state.Retention.Start(state.Stopped())
+	if config.IPAM != nil {
+		if state.IPAM, err = statepkg.NewIPAM(*config.IPAM, state.Store); err != nil {
+			return nil, fmt.Errorf("invalid ipam config: %s", err)
+		}
+	}
+	if config.DNS != nil {
+		if state.DNS, err = statepkg.NewDNSUpdater(*config.DNS, state.Store); err != nil {
+			return nil, fmt.Errorf("invalid dns config: %s", err)
+		}
+	}
+	if err := machine.ValidateSites(*config); err != nil {
+		return nil, fmt.Errorf("invalid sites config: %s", err)
+	}
+	if state.VMs, err = statepkg.NewVMDriver(*config); err != nil {
+		return nil, fmt.Errorf("invalid vm driver config: %s", err)
+	}
+	if config.Simulate {
+		server.SimulateIntegrations(state)
+	}
+	if config.HookWorkers > 0 {
+		state.Workers = statepkg.NewWorkerPool(config.HookWorkers)
+	}
+
+	if config.Git != nil {
+		if state.Repo, err = machine.NewGitRepo(*config.Git); err != nil {
+			return nil, fmt.Errorf("invalid git config: %s", err)
+		}
+		if _, err := state.Repo.Sync(); err != nil {
+			if state.Repo.Commit() == "" {
+				return nil, fmt.Errorf("cannot sync definitions from %s: %s", config.Git.URL, err)
+			}
+			logger.Error("cannot sync definitions from git, serving the last good commit", "commit", state.Repo.Commit(), "error", err)
+		}
+		config.MachinePath = state.Repo.Dir(state.Repo.Config.MachineDir)
+		config.GroupPath = state.Repo.Dir(state.Repo.Config.GroupDir)
+		config.TemplatePath = state.Repo.Dir(state.Repo.Config.TemplateDir)
+		state.Repo.Start(state.Stopped())
+	}
+
+	if err := statepkg.StartNotifiers(config.Notifiers, state); err != nil {
+		return nil, fmt.Errorf("invalid notifier: %s", err)
+	}
+
+	state.Inventory = machine.NewInventory(*config)
+	if err := state.Inventory.Refresh(); err != nil {
+		logger.Error("cannot index machines", "path", config.MachinePath, "error", err)
+	}
+	if config.InventoryRefreshSeconds <= 0 {
+		config.InventoryRefreshSeconds = machine.DefaultInventoryRefreshSeconds
+	}
+	state.Inventory.Start(time.Duration(config.InventoryRefreshSeconds)*time.Second, state.Stopped())
+	refreshInventory := func() {
+		if err := state.Inventory.Refresh(); err != nil {
+			logger.Error("cannot index machines", "error", err)
+		}
+	}
+	if config.ConsulKV != nil {
+		config.ConsulKV.Subscribe(refreshInventory)
+	}
+	if state.Repo != nil {
+		state.Repo.Subscribe(refreshInventory)
+	}
+
+	go server.WarmTemplates(*config, state)
+
+	if len(config.Images) > 0 {
+		if state.Images, err = statepkg.NewImageCatalog(*config); err != nil {
+			return nil, fmt.Errorf("cannot set up images: %s", err)
+		}
+		if config.ImageSyncSeconds <= 0 {
+			config.ImageSyncSeconds = statepkg.DefaultImageSyncSeconds
+		}
+		state.Images.Start(time.Duration(config.ImageSyncSeconds)*time.Second, state.Stopped())
+	}
+
+	if config.StaleBuildCheckFrequency <= 0 {
+		config.StaleBuildCheckFrequency = 300
+	}
+
+	statepkg.NewStaleWatcher(*config, state).Start(time.Duration(config.StaleBuildCheckFrequency) * time.Second)
+
+	if config.Simulate {
+		if config.SimulateStepSeconds <= 0 {
+			config.SimulateStepSeconds = server.DefaultSimulateStepSeconds
+		}
+		server.NewSimulator(*config, state).Start()
+	}
+
+	state.Bulk = statepkg.NewBulkScheduler(*config, state)
+	state.Bulk.Start()
+
+	state.Drift = statepkg.NewDriftDetector(*config, state)
+	if config.DriftCheckSeconds == 0 {
+		config.DriftCheckSeconds = statepkg.DefaultDriftCheckSeconds
+	}
+	if config.DriftCheckSeconds > 0 {
+		state.Drift.Start(time.Duration(config.DriftCheckSeconds) * time.Second)
+	}
+
+	if config.DHCPLeases != nil {
+		leases, err := statepkg.NewLeaseWatcher(*config.DHCPLeases, state)
+		if err != nil {
+			return nil, fmt.Errorf("invalid dhcp_leases config: %s", err)
+		}
+		leases.Start()
+	}
+
+	return state, nil
+}
@@ -0,0 +1,47 @@
+package waitron
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ns1/waitron/config"
+	"github.com/ns1/waitron/machine"
+	"github.com/ns1/waitron/server"
+)
+
+func TestNewHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "waitron-embed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewState(&config.Config{Consul: &config.ConsulConfig{}, Git: &config.GitRepoConfig{}}); err == nil {
+		t.Error("expected definitions from both consul and git to be refused")
+	}
+
+	config := config.Config{MachinePath: dir, GroupPath: dir, TemplatePath: dir, DriftCheckSeconds: -1}
+	state, err := NewState(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Inventory == nil || state.Bulk == nil || state.Drift == nil || state.Images != nil {
+		t.Errorf("expected the state to be set up for config, got %+v", state)
+	}
+	if config.InventoryRefreshSeconds != machine.DefaultInventoryRefreshSeconds || config.StaleBuildCheckFrequency != 300 {
+		t.Errorf("expected the defaults to be filled in, got %+v", config)
+	}
+
+	response := httptest.NewRecorder()
+	server.NewHandler(config, state).ServeHTTP(response, httptest.NewRequest("GET", "/livez", nil))
+	if response.Code != 200 || response.Body.String() != `{"State":"OK"}` {
+		t.Errorf("expected the handler to route /livez, got %d %s", response.Code, response.Body.String())
+	}
+	response = httptest.NewRecorder()
+	server.NewHandler(config, state).ServeHTTP(response, httptest.NewRequest("GET", "/images/jammy", nil))
+	if response.Code != 404 {
+		t.Errorf("expected no images without any configured, got %d", response.Code)
+	}
+}